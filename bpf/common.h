@@ -1,7 +1,7 @@
 #ifndef __LINUX_PAGE_CONSTANTS_HACK__
 #define __LINUX_PAGE_CONSTANTS_HACK__
 
-// Values for x86_64 as of 6.0.18-200.
+// Values for x86_64 as of 6.0.18-200, which are the same on riscv64.
 #define TOP_OF_KERNEL_STACK_PADDING 0
 #define THREAD_SIZE_ORDER 2
 #define PAGE_SHIFT 12
@@ -13,6 +13,8 @@
 #ifndef __ERROR_CONSTANTS_HACK__
 #define __ERROR_CONSTANTS_HACK__
 
+#define E2BIG 7
+#define ENOMEM 12
 #define EFAULT 14
 #define EEXIST 17
 #endif
@@ -0,0 +1,161 @@
+// +build ignore
+// ^^ this is a golang build tag meant to exclude this C file from compilation
+// by the CGO compiler
+//
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright 2023 The Parca Authors
+
+#include "../common.h"
+#include "../vmlinux.h"
+
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+/*================================ CONSTANTS =================================*/
+
+// Maximum number of frames.
+#define MAX_STACK_DEPTH 127
+// Number of unique stacks.
+#define MAX_STACK_TRACES_ENTRIES 64000
+// Number of items in the contention aggregation map.
+#define MAX_CONTENTION_ENTRIES 10240
+// Number of threads that can be waiting at the same time.
+#define MAX_WAITING_THREADS 10240
+
+// futex(2) operations that block the caller. The private and clock flags are
+// masked out before comparing.
+#define FUTEX_WAIT 0
+#define FUTEX_LOCK_PI 6
+#define FUTEX_WAIT_BITSET 9
+#define FUTEX_WAIT_REQUEUE_PI 11
+#define FUTEX_LOCK_PI2 13
+#define FUTEX_PRIVATE_FLAG 128
+#define FUTEX_CLOCK_REALTIME 256
+#define FUTEX_CMD_MASK ~(FUTEX_PRIVATE_FLAG | FUTEX_CLOCK_REALTIME)
+
+struct contention_config_t {
+  u64 min_wait_ns;
+};
+
+const volatile struct contention_config_t contention_config = {};
+
+/*============================== MACROS =====================================*/
+
+#define BPF_MAP(_name, _type, _key_type, _value_type, _max_entries)                                                                                            \
+  struct {                                                                                                                                                     \
+    __uint(type, _type);                                                                                                                                       \
+    __uint(max_entries, _max_entries);                                                                                                                         \
+    __type(key, _key_type);                                                                                                                                    \
+    __type(value, _value_type);                                                                                                                                \
+  } _name SEC(".maps");
+
+typedef u64 stack_trace_type[MAX_STACK_DEPTH];
+#define BPF_STACK_TRACE(_name, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_STACK_TRACE, u32, stack_trace_type, _max_entries);
+
+#define BPF_HASH(_name, _key_type, _value_type, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_HASH, _key_type, _value_type, _max_entries);
+
+/*============================= INTERNAL STRUCTS ============================*/
+
+typedef struct {
+  int pid;
+  int tgid;
+  int user_stack_id;
+} contention_key_t;
+
+// A thread blocked in a futex wait.
+typedef struct {
+  u64 start_ns;
+  int user_stack_id;
+} wait_start_t;
+
+/*================================ MAPS =====================================*/
+
+BPF_STACK_TRACE(stack_traces, MAX_STACK_TRACES_ENTRIES);
+// Total nanoseconds spent waiting, per thread and stack.
+BPF_HASH(contention_ns, contention_key_t, u64, MAX_CONTENTION_ENTRIES);
+// Keyed by the thread ID.
+BPF_HASH(wait_starts, u32, wait_start_t, MAX_WAITING_THREADS);
+
+/*=========================== HELPER FUNCTIONS ==============================*/
+
+static __always_inline bool is_wait_op(int op) {
+  switch (op & FUTEX_CMD_MASK) {
+  case FUTEX_WAIT:
+  case FUTEX_LOCK_PI:
+  case FUTEX_WAIT_BITSET:
+  case FUTEX_WAIT_REQUEUE_PI:
+  case FUTEX_LOCK_PI2:
+    return true;
+  default:
+    return false;
+  }
+}
+
+/*=============================== PROGRAMS ==================================*/
+
+// glibc's pthread mutexes, condition variables and rwlocks only enter the
+// kernel through futex(2) when they are contended, so timing the blocking
+// futex operations measures the lock contention of most native programs.
+SEC("tracepoint/syscalls/sys_enter_futex")
+int futex_enter(struct trace_event_raw_sys_enter *ctx) {
+  if (!is_wait_op(ctx->args[1])) {
+    return 0;
+  }
+
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  u32 tid = pid_tgid;
+  if (tid == 0) {
+    return 0;
+  }
+
+  // The user stack is collected on entry, as it's the one of the code that
+  // is waiting for the lock.
+  int user_stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+  if (user_stack_id < 0) {
+    return 0;
+  }
+
+  wait_start_t start = {
+      .start_ns = bpf_ktime_get_ns(),
+      .user_stack_id = user_stack_id,
+  };
+  bpf_map_update_elem(&wait_starts, &tid, &start, BPF_ANY);
+  return 0;
+}
+
+SEC("tracepoint/syscalls/sys_exit_futex")
+int futex_exit(struct trace_event_raw_sys_exit *ctx) {
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  u32 tid = pid_tgid;
+
+  wait_start_t *start = bpf_map_lookup_elem(&wait_starts, &tid);
+  if (start == NULL) {
+    return 0;
+  }
+
+  u64 delta = bpf_ktime_get_ns() - start->start_ns;
+  contention_key_t key = {
+      .pid = pid_tgid >> 32,
+      .tgid = tid,
+      .user_stack_id = start->user_stack_id,
+  };
+  bpf_map_delete_elem(&wait_starts, &tid);
+
+  if (delta < contention_config.min_wait_ns) {
+    return 0;
+  }
+
+  u64 *total = bpf_map_lookup_elem(&contention_ns, &key);
+  if (total) {
+    __sync_fetch_and_add(total, delta);
+    return 0;
+  }
+  bpf_map_update_elem(&contention_ns, &key, &delta, BPF_NOEXIST);
+  return 0;
+}
+
+#define KBUILD_MODNAME "parca-agent"
+volatile const char bpf_metadata_name[] SEC(".rodata") = "parca-agent (https://github.com/parca-dev/parca-agent)";
+unsigned int VERSION SEC("version") = 1;
+char LICENSE[] SEC("license") = "GPL";
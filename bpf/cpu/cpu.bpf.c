@@ -19,14 +19,19 @@
 // Number of frames to walk per tail call iteration.
 #define MAX_STACK_DEPTH_PER_PROGRAM 15
 // Number of BPF tail calls that will be attempted.
-#define MAX_TAIL_CALLS 10
-// Maximum number of frames.
-#define MAX_STACK_DEPTH 127
+#define MAX_TAIL_CALLS 17
+// Maximum number of frames. Stacks are walked up to the depth set in the
+// unwinder config, which can't be larger than this.
+#define MAX_STACK_DEPTH 255
 _Static_assert(MAX_TAIL_CALLS *MAX_STACK_DEPTH_PER_PROGRAM >= MAX_STACK_DEPTH, "enough iterations to traverse the whole stack");
 // Number of unique stacks.
 #define MAX_STACK_TRACES_ENTRIES 64000
 // Number of items in the stack counts aggregation map.
 #define MAX_STACK_COUNTS_ENTRIES 10240
+// Number of timestamps kept per item of the stack counts aggregation map.
+#define MAX_SAMPLE_TIMESTAMPS 64
+// Maximum number of entries of the Last Branch Record.
+#define MAX_LBR_ENTRIES 32
 // Maximum number of processes we are willing to track.
 #define MAX_PROCESSES 5000
 // Binary search iterations for dwarf based stack walking.
@@ -40,8 +45,57 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 // Unwind tables bigger than can't fit in the remaining space
 // of the current shard are broken up into chunks up to `MAX_UNWIND_TABLE_SIZE`.
 #define MAX_UNWIND_TABLE_CHUNKS 30
+// Executables with more chunks than `MAX_UNWIND_TABLE_CHUNKS` chain them in
+// additional `unwind_info_chunks` entries, keyed by `executable_id | link << 32`.
+#define MAX_UNWIND_INFO_CHAIN_LINKS 4
 // Maximum memory mappings per process.
 #define MAX_MAPPINGS_PER_PROCESS 250
+// Maximum number of interpreter frames.
+#define MAX_INTERPRETER_STACK_DEPTH 64
+// Number of unique interpreter symbols.
+#define MAX_INTERPRETER_SYMBOLS 10000
+// Interpreter frames store the symbol ID in the upper 32 bits and the line
+// number in the lower ones, whose highest bit marks the entry frames.
+#define INTERPRETER_FRAME_ENTRY (1ULL << 31)
+#define INTERPRETER_FRAME_LINENO_MASK 0x7FFFFFFF
+// Symbol IDs are made of the CPU number and a per CPU counter.
+#define INTERPRETER_SYMBOL_COUNTER_BITS 20
+
+// V8 frames are stored as pairs of SharedFunctionInfo and program counter.
+#define MAX_V8_FRAMES_WALKED 128
+
+// Distinct unwinder failures sampled until userspace drains them.
+#define MAX_UNWIND_FAILURES 256
+
+// zend_function types that run user code.
+#define ZEND_USER_FUNCTION 2
+#define ZEND_EVAL_CODE 4
+
+// Registers of the samples, and where the frame pointer points to relative to
+// the saved frame pointer and return address of the caller. On x86_64 it
+// points to the saved frame pointer, above which the call pushed the return
+// address. On riscv64 it points to the CFA, below which the return address and
+// then the frame pointer are saved, and the return address of the innermost
+// frame may still be in its register.
+#if defined(__TARGET_ARCH_riscv64)
+#define USER_REGS_IP(regs) ((regs)->pc)
+#define TASK_REGS_IP(regs) ((regs)->epc)
+#define REGS_SP(regs) ((regs)->sp)
+#define REGS_FP(regs) ((regs)->s0)
+#define REGS_RA(regs) ((regs)->ra)
+#define FP_SAVED_FP_OFFSET -16
+#define FP_SAVED_RA_OFFSET -8
+#define FP_CFA_OFFSET 0
+#else
+#define USER_REGS_IP(regs) ((regs)->ip)
+#define TASK_REGS_IP(regs) ((regs)->ip)
+#define REGS_SP(regs) ((regs)->sp)
+#define REGS_FP(regs) ((regs)->bp)
+#define REGS_RA(regs) 0
+#define FP_SAVED_FP_OFFSET 0
+#define FP_SAVED_RA_OFFSET 8
+#define FP_CFA_OFFSET 16
+#endif
 
 // Values for dwarf expressions.
 #define DWARF_EXPRESSION_UNKNOWN 0
@@ -54,6 +108,9 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 #define CFA_TYPE_EXPRESSION 3
 // Special values.
 #define CFA_TYPE_END_OF_FDE_MARKER 4
+// CFA is the value stored at $register + offset.
+#define CFA_TYPE_DEREF_RBP 5
+#define CFA_TYPE_DEREF_RSP 6
 
 // Values for the unwind table's frame pointer type.
 #define RBP_TYPE_UNCHANGED 0
@@ -62,6 +119,12 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 #define RBP_TYPE_EXPRESSION 3
 // Special values.
 #define RBP_TYPE_UNDEFINED_RETURN_ADDRESS 4
+// Frame pointer is saved at $register + offset.
+#define RBP_TYPE_DEREF_RBP 5
+#define RBP_TYPE_DEREF_RSP 6
+// Frame pointer is unchanged and the return address is still in its register,
+// which only happens in the innermost frame on riscv64.
+#define RBP_TYPE_RETURN_ADDRESS_IN_REGISTER 7
 
 // Binary search error codes.
 #define BINARY_SEARCH_DEFAULT 0xFAFAFAFA
@@ -72,6 +135,9 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 #define REQUEST_UNWIND_INFORMATION (1ULL << 63)
 #define REQUEST_PROCESS_MAPPINGS (1ULL << 62)
 #define REQUEST_REFRESH_PROCINFO (1ULL << 61)
+#define PROCESS_EXEC (1ULL << 60)
+#define PROCESS_EXIT (1ULL << 59)
+#define LIBRARY_LOADED (1ULL << 58)
 
 #define ENABLE_STATS_PRINTING false
 
@@ -85,6 +151,14 @@ struct unwinder_config_t {
   bool filter_processes;
   bool verbose_logging;
   bool mixed_stack_enabled;
+  bool sample_timestamps;
+  bool cpu_labels;
+  bool numa_node_labels;
+  bool filter_cgroups;
+  bool events_ringbuf;
+  bool lbr_fallback;
+  // Number of frames after which stacks are truncated.
+  u32 max_stack_depth;
 };
 
 struct unwinder_stats_t {
@@ -98,8 +172,40 @@ struct unwinder_stats_t {
   u64 error_should_never_happen;
   u64 error_pc_not_covered;
   u64 error_jit;
+  // Samples dropped because a map storing stacks was full.
+  u64 stack_counts_full;
+  u64 stack_traces_full;
+  u64 dwarf_stack_traces_full;
+  u64 interpreter_stack_traces_full;
+  // Events dropped because the ring buffer was full.
+  u64 events_lost;
+  // Samples whose stack was read from the Last Branch Record, and the ones
+  // for which it was empty.
+  u64 total_lbr;
+  u64 error_lbr_empty;
+  // Samples of 32-bit processes, whose stacks aren't walked.
+  u64 skipped_compat;
 };
 
+// Why the DWARF unwinder failed. Always need to be in sync with
+// unwindFailureReasons in userspace.
+enum unwind_failure_reason {
+  UNWIND_FAILURE_PC_NOT_COVERED = 0,
+  UNWIND_FAILURE_UNSUPPORTED_EXPRESSION = 1,
+  UNWIND_FAILURE_UNSUPPORTED_FRAME_POINTER_ACTION = 2,
+  UNWIND_FAILURE_UNSUPPORTED_CFA_REGISTER = 3,
+  UNWIND_FAILURE_BOGUS_CFA = 4,
+  UNWIND_FAILURE_BOGUS_RETURN_ADDRESS = 5,
+};
+
+// A failure of the DWARF unwinder, sampled so userspace can tell which
+// binaries, and where in them, the unwinder fails.
+typedef struct {
+  int pid;
+  u32 reason;
+  u64 pc;
+} unwind_failure_t;
+
 const volatile struct unwinder_config_t unwinder_config = {};
 
 /*============================== MACROS =====================================*/
@@ -124,6 +230,9 @@ typedef u64 stack_trace_type[MAX_STACK_DEPTH];
 #define STACK_COLLISION(err) (err == -EEXIST)
 // Tried to read a kernel stack from a non-kernel context.
 #define IN_USERSPACE(err) (err == -EFAULT)
+// The map has no room left for the entry. Stack trace maps are also more
+// likely to have collisions the fuller they are.
+#define MAP_FULL(err) (err == -E2BIG || err == -ENOMEM)
 
 #define LOG(fmt, ...)                                                                                                                                          \
   ({                                                                                                                                                           \
@@ -161,8 +270,32 @@ typedef struct {
   int user_stack_id;
   int kernel_stack_id;
   int user_stack_id_dwarf;
+  int interpreter_stack_id;
+  // Goroutine running on the thread, for Go processes.
+  u64 goroutine_id;
+  u32 goroutine_status;
+  u32 goroutine_wait_reason;
+  // Span active on the thread, for processes publishing their trace context.
+  u8 trace_id[16];
+  u8 span_id[8];
+  // CPU and NUMA node the sample was taken on, when labeling samples with
+  // them.
+  u32 cpu;
+  u32 numa_node;
+  // Perf event the sample was taken on, zero for the CPU clock and the index
+  // of the hardware event plus one otherwise.
+  u32 event;
+  // Whether the user stack was cut at the maximum stack depth.
+  u32 truncated;
 } stack_count_key_t;
 
+// The times at which a stack was sampled, the first MAX_SAMPLE_TIMESTAMPS of
+// a profiling round.
+typedef struct {
+  u64 len;
+  u64 ktime[MAX_SAMPLE_TIMESTAMPS];
+} sample_timestamps_t;
+
 // Represents an executable mapping.
 typedef struct {
   u64 load_address;
@@ -179,18 +312,127 @@ typedef struct {
   mapping_t mappings[MAX_MAPPINGS_PER_PROCESS];
 } process_info_t;
 
+// Interpreters whose stacks can be walked.
+enum interpreter_type {
+  INTERPRETER_TYPE_NONE = 0,
+  INTERPRETER_TYPE_PHP = 1,
+  INTERPRETER_TYPE_V8 = 2,
+};
+
+// Offsets of the ZendVM structure fields needed to walk the PHP stack, which
+// vary between PHP versions.
+typedef struct {
+  u32 current_execute_data;
+  u32 execute_data_opline;
+  u32 execute_data_func;
+  u32 execute_data_type_info;
+  u32 execute_data_previous;
+  u32 function_type;
+  u32 function_name;
+  u32 function_scope;
+  u32 class_entry_name;
+  u32 op_array_filename;
+  u32 op_lineno;
+  u32 string_val;
+  u32 call_top_flag;
+  u32 padding;
+} php_offsets_t;
+
+// Offsets needed to find the functions of the V8 JavaScript frames, from the
+// postmortem metadata of the binary.
+typedef struct {
+  s32 fp_function;
+  s32 fp_context;
+  u32 js_function_shared;
+  u32 heap_object_tag_mask;
+  u32 heap_object_tag;
+  u32 smi_tag_mask;
+  u32 smi_tag;
+  u32 padding;
+} v8_offsets_t;
+
+// Interpreter run by a process.
+typedef struct {
+  u64 type;
+  // Address of the global state of the interpreter.
+  u64 globals_address;
+  php_offsets_t php;
+  v8_offsets_t v8;
+} interpreter_info_t;
+
+// Offsets needed to find the goroutine running on a thread of a Go process.
+typedef struct {
+  // Of the current g, relative to the thread pointer.
+  s64 tls_offset;
+  u32 g_goid;
+  u32 g_status;
+  u32 g_wait_reason;
+  u32 g_m;
+  u32 m_curg;
+  u32 padding;
+} go_runtime_info_t;
+
+// Where a process publishes the trace context of its threads.
+typedef struct {
+  // Of the pointer to the otel_thread_ctx_v1 record, relative to the thread
+  // pointer.
+  s64 tls_offset;
+} trace_context_info_t;
+
+// Samples of a process to keep, for processes sampled at a lower frequency
+// than the perf events fire at.
+typedef struct {
+  // Keep one in every `every` samples.
+  u32 every;
+  u32 count;
+} sampling_info_t;
+
+// Trace context published by a thread, see pkg/tracecontext.
+typedef struct {
+  u8 trace_id[16];
+  u8 span_id[8];
+} otel_thread_ctx_v1_t;
+
+// Symbol of an interpreter frame. Symbols are stored once and referenced by
+// ID from the frames.
+typedef struct {
+  char class_name[32];
+  char function_name[64];
+  char path[128];
+} symbol_t;
+
+// The frames of an interpreter stack trace.
+typedef struct {
+  u64 len;
+  u64 frames[MAX_INTERPRETER_STACK_DEPTH];
+} interpreter_stack_t;
+
 // State of unwinder such as the registers as well
 // as internal data.
 typedef struct {
   u64 ip;
   u64 sp;
   u64 bp;
+  // Frame pointer of the sample, as bp is changed by the native unwinder.
+  u64 initial_bp;
+  // Return address register of the sample, on riscv64.
+  u64 ra;
   u32 tail_calls;
   stack_trace_t stack;
-  bool unwinding_jit; // set to true during JITed unwinding; false unless mixed-mode unwinding is enabled
+  bool unwinding_jit; // set to true during frame pointer unwinding of JITed or FP-only mappings; false unless mixed-mode unwinding is enabled
+  // Set when the stack has more frames than the maximum stack depth.
+  bool truncated;
+  // Perf event the sample is being taken on, see stack_count_key_t.
+  u32 event;
+
+  // Key of the sample, for the interpreter unwinders to aggregate it.
+  stack_count_key_t stack_key;
+  interpreter_stack_t interpreter_stack;
+  symbol_t symbol;
 } unwind_state_t;
 
-// A row in the stack unwinding table for x86_64.
+// A row in the stack unwinding table for x86_64 and riscv64, where rbp is the
+// frame pointer and rsp the stack pointer of the architecture.
 typedef struct __attribute__((packed)) {
   u64 pc;
   u8 cfa_type;
@@ -208,17 +450,39 @@ typedef struct {
 /*================================ MAPS =====================================*/
 
 BPF_HASH(debug_pids, int, u8, 1); // Table size will be updated in userspace.
+BPF_HASH(cgroup_filter, u64, u8, 1); // Table size will be updated in userspace.
 BPF_HASH(process_info, int, process_info_t, MAX_PROCESSES);
 
 BPF_STACK_TRACE(stack_traces, MAX_STACK_TRACES_ENTRIES);
 BPF_HASH(dwarf_stack_traces, int, stack_trace_t, MAX_STACK_TRACES_ENTRIES);
 BPF_HASH(stack_counts, stack_count_key_t, u64, MAX_STACK_COUNTS_ENTRIES);
+BPF_HASH(stack_timestamps, stack_count_key_t, sample_timestamps_t, 1); // Table size will be updated in userspace.
+BPF_HASH(lost_samples, int, u64, MAX_PROCESSES);
+BPF_HASH(unwind_failures, unwind_failure_t, u64, MAX_UNWIND_FAILURES);
+// Initial value of the stack_timestamps entries, too big for the BPF stack.
+const sample_timestamps_t empty_sample_timestamps = {0};
 
 BPF_HASH(unwind_info_chunks, u64, unwind_info_chunks_t,
          5 * 1000); // Mapping of executable ID to unwind info chunks.
 BPF_HASH(unwind_tables, u64, stack_unwind_table_t,
          5); // Table size will be updated in userspace.
 
+BPF_HASH(interpreter_info, int, interpreter_info_t, MAX_PROCESSES);
+BPF_HASH(interpreter_stack_traces, int, interpreter_stack_t, MAX_STACK_COUNTS_ENTRIES);
+BPF_HASH(interpreter_symbols, symbol_t, u32, MAX_INTERPRETER_SYMBOLS);
+BPF_HASH(go_runtime_info, int, go_runtime_info_t, MAX_PROCESSES);
+BPF_HASH(trace_context_info, int, trace_context_info_t, MAX_PROCESSES);
+BPF_HASH(sampling_info, int, sampling_info_t, MAX_PROCESSES);
+BPF_HASH(unsymbolizable_pids, int, u8, MAX_PROCESSES);
+BPF_HASH(compat_pids, int, u8, MAX_PROCESSES);
+
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, u32);
+} interpreter_symbol_counter SEC(".maps");
+
 struct {
   __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
   __uint(max_entries, 1);
@@ -226,6 +490,18 @@ struct {
   __type(value, unwind_state_t);
 } heap SEC(".maps");
 
+// The entries of the Last Branch Record, too large for the stack.
+typedef struct {
+  struct perf_branch_entry entries[MAX_LBR_ENTRIES];
+} lbr_entries_t;
+
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, lbr_entries_t);
+} lbr_entries SEC(".maps");
+
 struct {
   __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
   __uint(max_entries, 1);
@@ -235,7 +511,7 @@ struct {
 
 struct {
   __uint(type, BPF_MAP_TYPE_PROG_ARRAY);
-  __uint(max_entries, 1);
+  __uint(max_entries, 3);
   __type(key, u32);
   __type(value, u32);
 } programs SEC(".maps");
@@ -247,6 +523,14 @@ struct {
   __uint(max_entries, 8192);
 } events SEC(".maps");
 
+// Used instead of the perf buffer above when enabled, on kernels supporting
+// it. Otherwise userspace turns it into a tiny queue, which can be created on
+// any kernel.
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 4096); // Size will be updated in userspace.
+} events_ringbuf SEC(".maps");
+
 /*=========================== HELPER FUNCTIONS ==============================*/
 
 #define DEFINE_COUNTER(__func__name)                                                                                                                           \
@@ -268,6 +552,14 @@ DEFINE_COUNTER(error_catchall);
 DEFINE_COUNTER(error_should_never_happen);
 DEFINE_COUNTER(error_pc_not_covered);
 DEFINE_COUNTER(error_jit);
+DEFINE_COUNTER(stack_counts_full);
+DEFINE_COUNTER(stack_traces_full);
+DEFINE_COUNTER(dwarf_stack_traces_full);
+DEFINE_COUNTER(interpreter_stack_traces_full);
+DEFINE_COUNTER(events_lost);
+DEFINE_COUNTER(total_lbr);
+DEFINE_COUNTER(error_lbr_empty);
+DEFINE_COUNTER(skipped_compat);
 
 static void unwind_print_stats() {
   // Do not use the LOG macro, always print the stats.
@@ -323,23 +615,34 @@ static __always_inline void *bpf_map_lookup_or_try_init(void *map, const void *k
 
 /*================================= EVENTS ==================================*/
 
+static __always_inline void send_event(void *ctx, u64 payload) {
+  if (unwinder_config.events_ringbuf) {
+    if (bpf_ringbuf_output(&events_ringbuf, &payload, sizeof(u64), 0) < 0) {
+      bump_unwind_events_lost();
+    }
+    return;
+  }
+  // Lost events are reported to userspace by the perf buffer itself.
+  bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &payload, sizeof(u64));
+}
+
 static __always_inline void request_unwind_information(struct bpf_perf_event_data *ctx, int user_pid) {
   char comm[20];
   bpf_get_current_comm(comm, 20);
   LOG("[debug] no fp, no unwind info for PID: %d, comm: %s ctx IP: %llx", user_pid, comm, ctx->regs.ip);
 
   u64 payload = REQUEST_UNWIND_INFORMATION | user_pid;
-  bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &payload, sizeof(u64));
+  send_event(ctx, payload);
 }
 
 static __always_inline void request_process_mappings(struct bpf_perf_event_data *ctx, int user_pid) {
   u64 payload = REQUEST_PROCESS_MAPPINGS | user_pid;
-  bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &payload, sizeof(u64));
+  send_event(ctx, payload);
 }
 
 static __always_inline void request_refresh_process_info(struct bpf_perf_event_data *ctx, int user_pid) {
   u64 payload = REQUEST_REFRESH_PROCINFO | user_pid;
-  bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &payload, sizeof(u64));
+  send_event(ctx, payload);
 }
 
 // Binary search the unwind table to find the row index containing the unwind
@@ -392,6 +695,33 @@ static __always_inline bool has_unwind_information(pid_t pid) {
   return false;
 }
 
+// Whether the sample should be dropped to sample the process at its own,
+// lower, frequency. Concurrent samples might race on the count, which only
+// makes the kept samples slightly less regular.
+static __always_inline bool should_skip_sample(int pid) {
+  sampling_info_t *info = bpf_map_lookup_elem(&sampling_info, &pid);
+  if (info == NULL || info->every <= 1) {
+    return false;
+  }
+
+  info->count += 1;
+  return info->count % info->every != 0;
+}
+
+// Processes none of whose binaries can be symbolized are not sampled, when
+// userspace is configured to skip them.
+static __always_inline bool is_unsymbolizable(int pid) {
+  return bpf_map_lookup_elem(&unsymbolizable_pids, &pid) != NULL;
+}
+
+// 32-bit processes, such as i386 or armv7 programs run in compatibility mode,
+// are not sampled, as their stacks would be walked as if they saved 64-bit
+// frame pointers and return addresses, and unwind tables aren't generated for
+// their executables.
+static __always_inline bool is_compat(int pid) {
+  return bpf_map_lookup_elem(&compat_pids, &pid) != NULL;
+}
+
 static __always_inline bool is_debug_enabled_for_pid(int pid) {
   void *val = bpf_map_lookup_elem(&debug_pids, &pid);
   if (val) {
@@ -400,6 +730,22 @@ static __always_inline bool is_debug_enabled_for_pid(int pid) {
   return false;
 }
 
+// Cgroups are profiled when their ID is in the filter, or when the filter
+// holds the ID 0, which userspace sets when the cgroups to profile don't all
+// fit in the map.
+static __always_inline bool is_cgroup_profiled(void) {
+  u64 cgroup_id = bpf_get_current_cgroup_id();
+  if (bpf_map_lookup_elem(&cgroup_filter, &cgroup_id)) {
+    return true;
+  }
+
+  u64 all_cgroups = 0;
+  if (bpf_map_lookup_elem(&cgroup_filter, &all_cgroups)) {
+    return true;
+  }
+  return false;
+}
+
 enum find_unwind_table_return {
   FIND_UNWIND_SUCCESS = 1,
 
@@ -410,6 +756,7 @@ enum find_unwind_table_return {
 
   FIND_UNWIND_JITTED = 100,
   FIND_UNWIND_SPECIAL = 200,
+  FIND_UNWIND_FRAME_POINTERS = 300,
 };
 
 // Finds the shard information for a given pid and program counter. Optionally,
@@ -463,6 +810,11 @@ static __always_inline enum find_unwind_table_return find_unwind_table(chunk_inf
     if (type == 2) {
       return FIND_UNWIND_SPECIAL;
     }
+    // Mappings without unwind information, such as stripped libraries without
+    // .eh_frame, are unwound with frame pointers in mixed-mode.
+    if (type == 3 && unwinder_config.mixed_stack_enabled) {
+      return FIND_UNWIND_FRAME_POINTERS;
+    }
   } else {
     LOG("[warn] :((( no mapping for ip=%llx", pc);
     return FIND_UNWIND_MAPPING_NOT_FOUND;
@@ -473,23 +825,37 @@ static __always_inline enum find_unwind_table_return find_unwind_table(chunk_inf
 
   // Find the chunk where this unwind table lives.
   // Each chunk maps to exactly one shard.
-  unwind_info_chunks_t *chunks = bpf_map_lookup_elem(&unwind_info_chunks, &executable_id);
-  if (chunks == NULL) {
-    LOG("[info] chunks is null for executable %llu", executable_id);
-    return FIND_UNWIND_CHUNK_NOT_FOUND;
-  }
-
   u64 adjusted_pc = pc - load_address;
-  for (int i = 0; i < MAX_UNWIND_TABLE_CHUNKS; i++) {
-    // Reached last chunk.
-    if (chunks->chunks[i].low_pc == 0) {
+  for (u64 link = 0; link < MAX_UNWIND_INFO_CHAIN_LINKS; link++) {
+    u64 chunks_key = executable_id | (link << 32);
+    unwind_info_chunks_t *chunks = bpf_map_lookup_elem(&unwind_info_chunks, &chunks_key);
+    if (chunks == NULL) {
+      if (link == 0) {
+        LOG("[info] chunks is null for executable %llu", executable_id);
+        return FIND_UNWIND_CHUNK_NOT_FOUND;
+      }
       break;
     }
-    if (chunks->chunks[i].low_pc <= adjusted_pc && adjusted_pc <= chunks->chunks[i].high_pc) {
-      LOG("[info] found chunk");
-      *chunk_info = &chunks->chunks[i];
-      return FIND_UNWIND_SUCCESS;
+
+    // Chunks are sorted by PC across the whole chain. If this link is full
+    // and the PC is past its last chunk, it can only be in the next links.
+    chunk_info_t *last_chunk = &chunks->chunks[MAX_UNWIND_TABLE_CHUNKS - 1];
+    if (last_chunk->low_pc != 0 && adjusted_pc > last_chunk->high_pc) {
+      continue;
+    }
+
+    for (int i = 0; i < MAX_UNWIND_TABLE_CHUNKS; i++) {
+      // Reached last chunk.
+      if (chunks->chunks[i].low_pc == 0) {
+        break;
+      }
+      if (chunks->chunks[i].low_pc <= adjusted_pc && adjusted_pc <= chunks->chunks[i].high_pc) {
+        LOG("[info] found chunk");
+        *chunk_info = &chunks->chunks[i];
+        return FIND_UNWIND_SUCCESS;
+      }
     }
+    break;
   }
 
   LOG("[error] could not find chunk");
@@ -523,8 +889,8 @@ static __always_inline bool is_kthread() {
 
 // avoid R0 invalid mem access 'scalar'
 // Port of `task_pt_regs` in BPF.
-static __always_inline bool retrieve_task_registers(u64 *ip, u64 *sp, u64 *bp) {
-  if (ip == NULL || sp == NULL || bp == NULL) {
+static __always_inline bool retrieve_task_registers(u64 *ip, u64 *sp, u64 *bp, u64 *ra) {
+  if (ip == NULL || sp == NULL || bp == NULL || ra == NULL) {
     return false;
   }
 
@@ -549,24 +915,34 @@ static __always_inline bool retrieve_task_registers(u64 *ip, u64 *sp, u64 *bp) {
   void *ptr = stack + THREAD_SIZE - TOP_OF_KERNEL_STACK_PADDING;
   struct pt_regs *regs = ((struct pt_regs *)ptr) - 1;
 
-  err = bpf_probe_read_kernel((void *)ip, 8, &regs->ip);
+  err = bpf_probe_read_kernel((void *)ip, 8, &TASK_REGS_IP(regs));
   if (err) {
     LOG("bpf_probe_read_kernel failed err %d", err);
     return false;
   }
 
-  err = bpf_probe_read_kernel((void *)sp, 8, &regs->sp);
+  err = bpf_probe_read_kernel((void *)sp, 8, &REGS_SP(regs));
   if (err) {
     LOG("bpf_probe_read_kernel failed err %d", err);
     return false;
   }
 
-  err = bpf_probe_read_kernel((void *)bp, 8, &regs->bp);
+  err = bpf_probe_read_kernel((void *)bp, 8, &REGS_FP(regs));
   if (err) {
     LOG("bpf_probe_read_kernel failed err %d", err);
     return false;
   }
 
+#if defined(__TARGET_ARCH_riscv64)
+  err = bpf_probe_read_kernel((void *)ra, 8, &REGS_RA(regs));
+  if (err) {
+    LOG("bpf_probe_read_kernel failed err %d", err);
+    return false;
+  }
+#else
+  *ra = 0;
+#endif
+
   return true;
 }
 
@@ -581,8 +957,8 @@ static __always_inline bool has_fp(u64 current_fp) {
   u64 ra;
 
   for (int i = 0; i < MAX_STACK_DEPTH; i++) {
-    int err = bpf_probe_read_user(&next_fp, 8, (void *)current_fp);
-    bpf_probe_read_user(&ra, 8, (void *)current_fp + 8);
+    int err = bpf_probe_read_user(&next_fp, 8, (void *)(current_fp + FP_SAVED_FP_OFFSET));
+    bpf_probe_read_user(&ra, 8, (void *)(current_fp + FP_SAVED_RA_OFFSET));
     if (err < 0) {
       // LOG("[debug] fp read failed with %d", err);
       return false;
@@ -608,9 +984,135 @@ static __always_inline bool has_fp(u64 current_fp) {
   return false;
 }
 
+// Count a sample of the given stacks.
+// Counts a sample of the given process that was taken but couldn't be
+// stored, so userspace can tell how much its profiles under-represent it.
+static __always_inline void count_lost_sample(int pid) {
+  u64 zero = 0;
+  u64 *lost = bpf_map_lookup_or_try_init(&lost_samples, &pid, &zero);
+  if (lost) {
+    __sync_fetch_and_add(lost, 1);
+  }
+}
+
+// Counts a failure of the DWARF unwinder. Only the first distinct failures
+// since userspace last drained them are kept, which samples them.
+static __always_inline void sample_unwind_failure(int pid, u64 pc, enum unwind_failure_reason reason) {
+  unwind_failure_t failure = {.pid = pid, .reason = reason, .pc = pc};
+  u64 zero = 0;
+  u64 *count = bpf_map_lookup_or_try_init(&unwind_failures, &failure, &zero);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+  }
+}
+
+static __always_inline void aggregate_stack(struct bpf_perf_event_data *ctx, stack_count_key_t *stack_key) {
+  u64 zero = 0;
+  u64 *scount = bpf_map_lookup_or_try_init(&stack_counts, stack_key, &zero);
+  if (scount) {
+    __sync_fetch_and_add(scount, 1);
+  } else {
+    bump_unwind_stack_counts_full();
+    count_lost_sample(stack_key->pid);
+  }
+
+  if (unwinder_config.sample_timestamps) {
+    sample_timestamps_t *timestamps = bpf_map_lookup_or_try_init(&stack_timestamps, stack_key, &empty_sample_timestamps);
+    if (timestamps) {
+      u64 i = __sync_fetch_and_add(&timestamps->len, 1);
+      if (i < MAX_SAMPLE_TIMESTAMPS) {
+        timestamps->ktime[i] = bpf_ktime_get_ns();
+      }
+    }
+  }
+
+  request_process_mappings(ctx, stack_key->pid);
+}
+
+// Returns the thread pointer of the current task, from which thread local
+// variables of the executable are at a fixed offset, or 0 on failure.
+static __always_inline u64 get_thread_pointer() {
+  struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+  u64 fsbase = 0;
+  if (bpf_probe_read_kernel(&fsbase, sizeof(fsbase), &task->thread.fsbase) < 0) {
+    return 0;
+  }
+  return fsbase;
+}
+
+// Sets the span active on the current thread, for processes publishing their
+// trace context.
+static __always_inline void add_trace_context(stack_count_key_t *stack_key) {
+  trace_context_info_t *info = bpf_map_lookup_elem(&trace_context_info, &stack_key->pid);
+  if (info == NULL) {
+    return;
+  }
+
+  u64 fsbase = get_thread_pointer();
+  if (fsbase == 0) {
+    return;
+  }
+
+  u64 ctx_ptr = 0;
+  if (bpf_probe_read_user(&ctx_ptr, sizeof(ctx_ptr), (void *)(fsbase + info->tls_offset)) < 0 || ctx_ptr == 0) {
+    return;
+  }
+
+  otel_thread_ctx_v1_t thread_ctx = {0};
+  if (bpf_probe_read_user(&thread_ctx, sizeof(thread_ctx), (void *)ctx_ptr) < 0) {
+    return;
+  }
+  __builtin_memcpy(stack_key->trace_id, thread_ctx.trace_id, sizeof(stack_key->trace_id));
+  __builtin_memcpy(stack_key->span_id, thread_ctx.span_id, sizeof(stack_key->span_id));
+}
+
+// Sets the goroutine running on the current thread of a Go process. Threads
+// running on the system stack, e.g. in the scheduler, run the g0 of their M,
+// in which case the goroutine they work for is the M's curg.
+static __always_inline void add_goroutine(stack_count_key_t *stack_key) {
+  go_runtime_info_t *info = bpf_map_lookup_elem(&go_runtime_info, &stack_key->pid);
+  if (info == NULL) {
+    return;
+  }
+
+  u64 fsbase = get_thread_pointer();
+  if (fsbase == 0) {
+    return;
+  }
+
+  u64 g = 0;
+  if (bpf_probe_read_user(&g, sizeof(g), (void *)(fsbase + info->tls_offset)) < 0 || g == 0) {
+    return;
+  }
+
+  u64 goid = 0;
+  bpf_probe_read_user(&goid, sizeof(goid), (void *)(g + info->g_goid));
+  if (goid == 0) {
+    u64 m = 0;
+    if (bpf_probe_read_user(&m, sizeof(m), (void *)(g + info->g_m)) < 0 || m == 0) {
+      return;
+    }
+    if (bpf_probe_read_user(&g, sizeof(g), (void *)(m + info->m_curg)) < 0 || g == 0) {
+      return;
+    }
+    bpf_probe_read_user(&goid, sizeof(goid), (void *)(g + info->g_goid));
+    if (goid == 0) {
+      return;
+    }
+  }
+
+  u32 status = 0;
+  u8 wait_reason = 0;
+  bpf_probe_read_user(&status, sizeof(status), (void *)(g + info->g_status));
+  bpf_probe_read_user(&wait_reason, sizeof(wait_reason), (void *)(g + info->g_wait_reason));
+
+  stack_key->goroutine_id = goid;
+  stack_key->goroutine_status = status;
+  stack_key->goroutine_wait_reason = wait_reason;
+}
+
 // Aggregate the given stacktrace.
 static __always_inline void add_stack(struct bpf_perf_event_data *ctx, u64 pid_tgid, enum stack_walking_method method, unwind_state_t *unwind_state) {
-  u64 zero = 0;
   stack_count_key_t stack_key = {0};
 
   // The `bpf_get_current_pid_tgid` helpers returns
@@ -624,16 +1126,33 @@ static __always_inline void add_stack(struct bpf_perf_event_data *ctx, u64 pid_t
   int user_tgid = pid_tgid;
   stack_key.pid = user_pid;
   stack_key.tgid = user_tgid;
+  u32 zero = 0;
+  unwind_state_t *heap_state = bpf_map_lookup_elem(&heap, &zero);
+  if (heap_state != NULL) {
+    stack_key.event = heap_state->event;
+  }
+  add_goroutine(&stack_key);
+  add_trace_context(&stack_key);
+  if (unwinder_config.cpu_labels) {
+    stack_key.cpu = bpf_get_smp_processor_id();
+  }
+  if (unwinder_config.numa_node_labels) {
+    stack_key.numa_node = bpf_get_numa_node_id();
+  }
 
   if (method == STACK_WALKING_METHOD_DWARF) {
     int stack_hash = MurmurHash2((u32 *)unwind_state->stack.addresses, MAX_STACK_DEPTH * sizeof(u64) / sizeof(u32), 0);
     LOG("stack hash %d", stack_hash);
     stack_key.user_stack_id_dwarf = stack_hash;
+    stack_key.truncated = unwind_state->truncated;
 
     // Insert stack.
     int err = bpf_map_update_elem(&dwarf_stack_traces, &stack_hash, &unwind_state->stack, BPF_ANY);
     if (err != 0) {
       LOG("[error] bpf_map_update_elem with ret: %d", err);
+      if (MAP_FULL(err)) {
+        bump_unwind_dwarf_stack_traces_full();
+      }
     }
   } else if (method == STACK_WALKING_METHOD_FP) {
     int stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
@@ -643,6 +1162,10 @@ static __always_inline void add_stack(struct bpf_perf_event_data *ctx, u64 pid_t
     // pointers aren't present.
     if (stack_id < 0) {
       LOG("[warn] bpf_get_stackid user failed with %d", stack_id);
+      if (MAP_FULL(stack_id) || STACK_COLLISION(stack_id)) {
+        bump_unwind_stack_traces_full();
+      }
+      count_lost_sample(user_pid);
       return;
     }
     stack_key.user_stack_id = stack_id;
@@ -652,17 +1175,66 @@ static __always_inline void add_stack(struct bpf_perf_event_data *ctx, u64 pid_t
   int kernel_stack_id = bpf_get_stackid(ctx, &stack_traces, 0);
   if (kernel_stack_id < 0 && !IN_USERSPACE(kernel_stack_id)) {
     LOG("[warn] bpf_get_stackid kernel failed with %d", kernel_stack_id);
+    if (MAP_FULL(kernel_stack_id) || STACK_COLLISION(kernel_stack_id)) {
+      bump_unwind_stack_traces_full();
+    }
+    count_lost_sample(user_pid);
     return;
   }
   stack_key.kernel_stack_id = kernel_stack_id;
 
-  // Aggregate stacks.
-  u64 *scount = bpf_map_lookup_or_try_init(&stack_counts, &stack_key, &zero);
-  if (scount) {
-    __sync_fetch_and_add(scount, 1);
+  // The interpreter stack is walked in its own program, stored at the index
+  // of the interpreter type, which aggregates the sample once done. If the
+  // tail call fails, the sample is aggregated without it.
+  interpreter_info_t *info = bpf_map_lookup_elem(&interpreter_info, &user_pid);
+  if (info != NULL) {
+    unwind_state_t *state = bpf_map_lookup_elem(&heap, &zero);
+    if (state != NULL) {
+      state->stack_key = stack_key;
+      bpf_tail_call(ctx, &programs, info->type);
+    }
   }
 
-  request_process_mappings(ctx, user_pid);
+  aggregate_stack(ctx, &stack_key);
+}
+
+// Takes the user stack from the call stack recorded by the Last Branch Record
+// of Intel CPUs, when enabled and the stack can be walked neither with frame
+// pointers nor with unwind information. Its entries are the calls of the
+// frames, most recent first, so the callers' frames are the addresses the
+// calls were made from. The stack is stored as the ones walked with unwind
+// information. Returns whether the sample was added.
+static __always_inline bool add_lbr_stack(struct bpf_perf_event_data *ctx, u64 pid_tgid, unwind_state_t *unwind_state) {
+  if (!unwinder_config.lbr_fallback) {
+    return false;
+  }
+  bump_unwind_total_lbr();
+
+  u32 zero = 0;
+  lbr_entries_t *lbr = bpf_map_lookup_elem(&lbr_entries, &zero);
+  if (lbr == NULL) {
+    // This should never happen.
+    return false;
+  }
+
+  long size = bpf_read_branch_records(ctx, lbr->entries, sizeof(lbr->entries), 0);
+  if (size <= 0) {
+    bump_unwind_error_lbr_empty();
+    return false;
+  }
+  u64 len = size / sizeof(struct perf_branch_entry);
+
+  unwind_state->stack.addresses[0] = unwind_state->ip;
+  for (int i = 0; i < MAX_LBR_ENTRIES; i++) {
+    if (i >= len) {
+      break;
+    }
+    unwind_state->stack.addresses[i + 1] = lbr->entries[i].from;
+  }
+  unwind_state->stack.len = len + 1;
+
+  add_stack(ctx, pid_tgid, STACK_WALKING_METHOD_DWARF, unwind_state);
+  return true;
 }
 
 // The unwinding machinery lives here.
@@ -682,6 +1254,9 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
   }
 
   for (int i = 0; i < MAX_STACK_DEPTH_PER_PROGRAM; i++) {
+    if (unwind_state->stack.len >= unwinder_config.max_stack_depth) {
+      break;
+    }
     LOG("[debug] Within unwinding machinery loop");
     LOG("## frame: %d", unwind_state->stack.len);
 
@@ -694,13 +1269,13 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
     chunk_info_t *chunk_info = NULL;
     enum find_unwind_table_return unwind_table_result = find_unwind_table(&chunk_info, user_pid, unwind_state->ip, &offset);
 
-    if (unwind_table_result == FIND_UNWIND_JITTED) {
+    if (unwind_table_result == FIND_UNWIND_JITTED || unwind_table_result == FIND_UNWIND_FRAME_POINTERS) {
       if (!unwinder_config.mixed_stack_enabled) {
         LOG("JIT section, stopping. Please enable mixed-mode unwinding with the --dwarf-unwinding-mixed=true to profile JITed stacks.");
         return 1;
       }
 
-      LOG("[debug] Unwinding JITed stacks");
+      LOG("[debug] Unwinding JITed stacks or mapping without unwind information with frame pointers");
 
       unwind_state->unwinding_jit = true;
 
@@ -719,7 +1294,7 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
         }
       }
 
-      err = bpf_probe_read_user(&next_fp, 8, (void *)unwind_state->bp);
+      err = bpf_probe_read_user(&next_fp, 8, (void *)(unwind_state->bp + FP_SAVED_FP_OFFSET));
       if (err < 0) {
         // TODO(sylfrena):
         // For some weird reason commenting out this and the next err log line results in a panic
@@ -732,7 +1307,7 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
       // LOG("[debug]  i=%d, err = %d && rbp = %llx && ra=%llx", i, err, next_fp, ra);
 
       // reading return address
-      err = bpf_probe_read_user(&ra, 8, (void *)unwind_state->bp + 8);
+      err = bpf_probe_read_user(&ra, 8, (void *)(unwind_state->bp + FP_SAVED_RA_OFFSET));
       if (err < 0) {
         // TODO(sylfrena)
         //  For some weird reason commenting out this and the next err log line results in a panic
@@ -748,7 +1323,7 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
       }
 
       // TODO(sylfrena): add comments to explain calculations
-      unwind_state->sp = unwind_state->bp + 16;
+      unwind_state->sp = unwind_state->bp + FP_CFA_OFFSET;
       unwind_state->bp = next_fp;
       unwind_state->ip = ra - 1;
       len = unwind_state->stack.len;
@@ -844,6 +1419,7 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
     if (found_rbp_type == RBP_TYPE_REGISTER || found_rbp_type == RBP_TYPE_EXPRESSION) {
       LOG("\t[error] frame pointer is %d (register or exp), bailing out", found_rbp_type);
       bump_unwind_error_unsupported_frame_pointer_action();
+      sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_UNSUPPORTED_FRAME_POINTER_ACTION);
       return 1;
     }
 
@@ -856,6 +1432,7 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
       if (found_cfa_offset == DWARF_EXPRESSION_UNKNOWN) {
         LOG("[unsup] CFA is an unsupported expression, bailing out");
         bump_unwind_error_unsupported_expression();
+        sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_UNSUPPORTED_EXPRESSION);
         return 1;
       }
 
@@ -873,9 +1450,19 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
         return 1;
       }
       previous_rsp = unwind_state->sp + 8 + ((((unwind_state->ip & 15) >= threshold)) << 3);
+    } else if (found_cfa_type == CFA_TYPE_DEREF_RBP || found_cfa_type == CFA_TYPE_DEREF_RSP) {
+      u64 cfa_addr = (found_cfa_type == CFA_TYPE_DEREF_RBP ? unwind_state->bp : unwind_state->sp) + found_cfa_offset;
+      int ret = bpf_probe_read_user(&previous_rsp, 8, (void *)(cfa_addr));
+      if (ret != 0) {
+        LOG("[error] failed to read the CFA from %llx, ret=%d", cfa_addr, ret);
+        bump_unwind_error_catchall();
+        sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_BOGUS_CFA);
+        return 1;
+      }
     } else {
       LOG("\t[unsup] register %d not valid (expected $rbp or $rsp)", found_cfa_type);
       bump_unwind_error_unsupported_cfa_register();
+      sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_UNSUPPORTED_CFA_REGISTER);
       return 1;
     }
 
@@ -885,15 +1472,27 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
     if (previous_rsp == 0) {
       LOG("[error] previous_rsp should not be zero.");
       bump_unwind_error_catchall();
+      sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_BOGUS_CFA);
       return 1;
     }
 
-    // HACK(javierhonduco): This is an architectural shortcut we can take. As we
-    // only support x86_64 at the minute, we can assume that the return address
-    // is *always* 8 bytes ahead of the previous stack pointer.
+    // HACK(javierhonduco): This is an architectural shortcut we can take. On
+    // x86_64 the return address is *always* 8 bytes ahead of the previous
+    // stack pointer, and riscv64 compilers save it there too, unless it's
+    // still in its register in the innermost frame.
     u64 previous_rip_addr = previous_rsp - 8; // the saved return address is 8 bytes ahead of the previous stack pointer
     u64 previous_rip = 0;
-    int err = bpf_probe_read_user(&previous_rip, 8, (void *)(previous_rip_addr));
+    int err = 0;
+    if (found_rbp_type == RBP_TYPE_RETURN_ADDRESS_IN_REGISTER) {
+      if (len != 0) {
+        LOG("[error] return address in its register in frame %d", len);
+        bump_unwind_error_catchall();
+        return 1;
+      }
+      previous_rip = unwind_state->ra;
+    } else {
+      err = bpf_probe_read_user(&previous_rip, 8, (void *)(previous_rip_addr));
+    }
 
     if (previous_rip == 0) {
       int user_pid = pid_tgid;
@@ -911,15 +1510,21 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
 
       LOG("[error] previous_rip should not be zero. This can mean that the read failed, ret=%d while reading @ %llx.", err, previous_rip_addr);
       bump_unwind_error_catchall();
+      sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_BOGUS_RETURN_ADDRESS);
       return 1;
     }
 
     // Set rbp register.
     u64 previous_rbp = 0;
-    if (found_rbp_type == RBP_TYPE_UNCHANGED) {
+    if (found_rbp_type == RBP_TYPE_UNCHANGED || found_rbp_type == RBP_TYPE_RETURN_ADDRESS_IN_REGISTER) {
       previous_rbp = unwind_state->bp;
     } else {
       u64 previous_rbp_addr = previous_rsp + found_rbp_offset;
+      if (found_rbp_type == RBP_TYPE_DEREF_RBP) {
+        previous_rbp_addr = unwind_state->bp + found_rbp_offset;
+      } else if (found_rbp_type == RBP_TYPE_DEREF_RSP) {
+        previous_rbp_addr = unwind_state->sp + found_rbp_offset;
+      }
       LOG("\t(bp_offset: %d, bp value stored at %llx)", found_rbp_offset, previous_rbp_addr);
       int ret = bpf_probe_read_user(&previous_rbp, 8, (void *)(previous_rbp_addr));
       if (ret != 0) {
@@ -976,21 +1581,259 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
       LOG("[error] Could not find unwind table and rbp != 0 (%llx). New mapping?", unwind_state->bp);
       request_refresh_process_info(ctx, user_pid);
       bump_unwind_error_pc_not_covered();
+      sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_PC_NOT_COVERED);
     }
     return 0;
-  } else if (unwind_state->stack.len < MAX_STACK_DEPTH && unwind_state->tail_calls < MAX_TAIL_CALLS) {
+  } else if (unwind_state->stack.len < unwinder_config.max_stack_depth && unwind_state->tail_calls < MAX_TAIL_CALLS) {
     LOG("Continuing walking the stack in a tail call, current tail %d", unwind_state->tail_calls);
     unwind_state->tail_calls++;
     bpf_tail_call(ctx, &programs, 0);
   }
 
-  // We couldn't get the whole stacktrace.
+  // We couldn't get the whole stacktrace. Once it's as deep as we walk
+  // stacks, keep the frames we got and let userspace mark it as truncated.
   bump_unwind_error_truncated();
+  if (unwind_state->stack.len >= unwinder_config.max_stack_depth) {
+    unwind_state->truncated = true;
+    add_stack(ctx, pid_tgid, STACK_WALKING_METHOD_DWARF, unwind_state);
+  }
+  return 0;
+}
+
+/*========================= INTERPRETER UNWINDERS ===========================*/
+
+// Returns the ID of the given symbol, storing it if it's new, or 0 if the
+// symbols map is full.
+static __always_inline u32 get_symbol_id(symbol_t *symbol) {
+  u32 *id = bpf_map_lookup_elem(&interpreter_symbols, symbol);
+  if (id != NULL) {
+    return *id;
+  }
+
+  u32 zero = 0;
+  u32 *counter = bpf_map_lookup_elem(&interpreter_symbol_counter, &zero);
+  if (counter == NULL) {
+    return 0;
+  }
+  *counter += 1;
+  u32 mask = (1 << INTERPRETER_SYMBOL_COUNTER_BITS) - 1;
+  if ((*counter & mask) == 0) {
+    // 0 is reserved for unknown symbols.
+    *counter += 1;
+  }
+  u32 new_id = (bpf_get_smp_processor_id() << INTERPRETER_SYMBOL_COUNTER_BITS) | (*counter & mask);
+
+  int err = bpf_map_update_elem(&interpreter_symbols, symbol, &new_id, BPF_NOEXIST);
+  if (err == -EEXIST) {
+    // Stored concurrently from another CPU.
+    id = bpf_map_lookup_elem(&interpreter_symbols, symbol);
+    return id != NULL ? *id : 0;
+  }
+  if (err != 0) {
+    LOG("[warn] failed to store interpreter symbol with %d", err);
+    return 0;
+  }
+  return new_id;
+}
+
+#define READ_PHP_STRING(dst, zend_string, offsets)                                                                                                             \
+  ({                                                                                                                                                           \
+    if (zend_string != 0) {                                                                                                                                    \
+      bpf_probe_read_user_str(dst, sizeof(dst), (void *)(zend_string + (offsets)->string_val));                                                                \
+    }                                                                                                                                                          \
+  })
+
+// Walks the chain of zend_execute_data of the PHP executor, starting from
+// executor_globals.current_execute_data. Only frames running user code are
+// stored, as internal functions already show up in the native stack.
+SEC("perf_event")
+int unwind_php_stack(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
+  if (unwind_state == NULL) {
+    return 0;
+  }
+
+  int user_pid = unwind_state->stack_key.pid;
+  interpreter_info_t *info = bpf_map_lookup_elem(&interpreter_info, &user_pid);
+  if (info == NULL || info->type != INTERPRETER_TYPE_PHP) {
+    aggregate_stack(ctx, &unwind_state->stack_key);
+    return 0;
+  }
+  php_offsets_t *offsets = &info->php;
+
+  interpreter_stack_t *stack = &unwind_state->interpreter_stack;
+  __builtin_memset(stack, 0, sizeof(interpreter_stack_t));
+
+  u64 execute_data = 0;
+  if (bpf_probe_read_user(&execute_data, sizeof(execute_data), (void *)(info->globals_address + offsets->current_execute_data)) < 0) {
+    LOG("[warn] failed to read PHP executor globals");
+    aggregate_stack(ctx, &unwind_state->stack_key);
+    return 0;
+  }
+
+  for (int i = 0; i < MAX_INTERPRETER_STACK_DEPTH; i++) {
+    if (execute_data == 0) {
+      break;
+    }
+
+    u64 func = 0;
+    u32 type_info = 0;
+    u64 previous = 0;
+    bpf_probe_read_user(&func, sizeof(func), (void *)(execute_data + offsets->execute_data_func));
+    bpf_probe_read_user(&type_info, sizeof(type_info), (void *)(execute_data + offsets->execute_data_type_info));
+    if (bpf_probe_read_user(&previous, sizeof(previous), (void *)(execute_data + offsets->execute_data_previous)) < 0) {
+      break;
+    }
+
+    u8 type = 0;
+    if (func != 0) {
+      bpf_probe_read_user(&type, sizeof(type), (void *)(func + offsets->function_type));
+    }
+
+    if (type == ZEND_USER_FUNCTION || type == ZEND_EVAL_CODE) {
+      symbol_t *symbol = &unwind_state->symbol;
+      __builtin_memset(symbol, 0, sizeof(symbol_t));
+
+      u64 name = 0;
+      bpf_probe_read_user(&name, sizeof(name), (void *)(func + offsets->function_name));
+      READ_PHP_STRING(symbol->function_name, name, offsets);
+
+      u64 scope = 0;
+      bpf_probe_read_user(&scope, sizeof(scope), (void *)(func + offsets->function_scope));
+      if (scope != 0) {
+        u64 class_name = 0;
+        bpf_probe_read_user(&class_name, sizeof(class_name), (void *)(scope + offsets->class_entry_name));
+        READ_PHP_STRING(symbol->class_name, class_name, offsets);
+      }
+
+      u64 filename = 0;
+      bpf_probe_read_user(&filename, sizeof(filename), (void *)(func + offsets->op_array_filename));
+      READ_PHP_STRING(symbol->path, filename, offsets);
+
+      u64 opline = 0;
+      u32 lineno = 0;
+      bpf_probe_read_user(&opline, sizeof(opline), (void *)(execute_data + offsets->execute_data_opline));
+      if (opline != 0) {
+        bpf_probe_read_user(&lineno, sizeof(lineno), (void *)(opline + offsets->op_lineno));
+      }
+
+      u64 frame = ((u64)get_symbol_id(symbol) << 32) | (lineno & INTERPRETER_FRAME_LINENO_MASK);
+      if (type_info & offsets->call_top_flag) {
+        frame |= INTERPRETER_FRAME_ENTRY;
+      }
+
+      u64 len = stack->len;
+      if (len < MAX_INTERPRETER_STACK_DEPTH) {
+        stack->frames[len] = frame;
+        stack->len++;
+      }
+    }
+
+    execute_data = previous;
+  }
+
+  if (stack->len > 0) {
+    int stack_hash = MurmurHash2((u32 *)stack->frames, MAX_INTERPRETER_STACK_DEPTH * sizeof(u64) / sizeof(u32), 0);
+    int err = bpf_map_update_elem(&interpreter_stack_traces, &stack_hash, stack, BPF_ANY);
+    if (err == 0) {
+      unwind_state->stack_key.interpreter_stack_id = stack_hash;
+    } else {
+      LOG("[error] failed to store interpreter stack with %d", err);
+      if (MAP_FULL(err)) {
+        bump_unwind_interpreter_stack_traces_full();
+      }
+    }
+  }
+
+  aggregate_stack(ctx, &unwind_state->stack_key);
+  return 0;
+}
+
+// Walks the frame pointers looking for V8 JavaScript frames, which hold the
+// JSFunction they run. Other frames, like the entry and exit ones, store a Smi
+// marker with their type where JavaScript frames have their context. Only the
+// SharedFunctionInfo of the function is stored, its name is read from the heap
+// in userspace.
+SEC("perf_event")
+int unwind_v8_stack(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
+  if (unwind_state == NULL) {
+    return 0;
+  }
+
+  int user_pid = unwind_state->stack_key.pid;
+  interpreter_info_t *info = bpf_map_lookup_elem(&interpreter_info, &user_pid);
+  if (info == NULL || info->type != INTERPRETER_TYPE_V8) {
+    aggregate_stack(ctx, &unwind_state->stack_key);
+    return 0;
+  }
+  v8_offsets_t *offsets = &info->v8;
+
+  interpreter_stack_t *stack = &unwind_state->interpreter_stack;
+  __builtin_memset(stack, 0, sizeof(interpreter_stack_t));
+
+  u64 fp = unwind_state->initial_bp;
+  // The program counter of the innermost frame is not known, as the leaf
+  // function might not have set up a frame.
+  u64 pc = 0;
+  for (int i = 0; i < MAX_V8_FRAMES_WALKED; i++) {
+    if (fp == 0) {
+      break;
+    }
+
+    u64 marker = 0;
+    if (bpf_probe_read_user(&marker, sizeof(marker), (void *)(fp + offsets->fp_context)) < 0) {
+      break;
+    }
+    if ((marker & offsets->smi_tag_mask) != offsets->smi_tag) {
+      u64 function = 0;
+      u64 shared = 0;
+      bpf_probe_read_user(&function, sizeof(function), (void *)(fp + offsets->fp_function));
+      if ((function & offsets->heap_object_tag_mask) == offsets->heap_object_tag) {
+        bpf_probe_read_user(&shared, sizeof(shared), (void *)(function - offsets->heap_object_tag + offsets->js_function_shared));
+      }
+
+      u64 len = stack->len;
+      if (shared != 0 && len < MAX_INTERPRETER_STACK_DEPTH - 1) {
+        stack->frames[len] = shared;
+        stack->frames[len + 1] = pc;
+        stack->len += 2;
+      }
+    }
+
+    u64 next_fp = 0;
+    if (bpf_probe_read_user(&next_fp, sizeof(next_fp), (void *)fp) < 0) {
+      break;
+    }
+    bpf_probe_read_user(&pc, sizeof(pc), (void *)(fp + 8));
+    // Callers' frames are always higher up.
+    if (next_fp <= fp) {
+      break;
+    }
+    fp = next_fp;
+  }
+
+  if (stack->len > 0) {
+    int stack_hash = MurmurHash2((u32 *)stack->frames, MAX_INTERPRETER_STACK_DEPTH * sizeof(u64) / sizeof(u32), 0);
+    int err = bpf_map_update_elem(&interpreter_stack_traces, &stack_hash, stack, BPF_ANY);
+    if (err == 0) {
+      unwind_state->stack_key.interpreter_stack_id = stack_hash;
+    } else {
+      LOG("[error] failed to store interpreter stack with %d", err);
+      if (MAP_FULL(err)) {
+        bump_unwind_interpreter_stack_traces_full();
+      }
+    }
+  }
+
+  aggregate_stack(ctx, &unwind_state->stack_key);
   return 0;
 }
 
 // Set up the initial registers to start unwinding.
-static __always_inline bool set_initial_state(struct pt_regs *regs) {
+static __always_inline bool set_initial_state(bpf_user_pt_regs_t *regs) {
   u32 zero = 0;
 
   unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
@@ -1004,26 +1847,32 @@ static __always_inline bool set_initial_state(struct pt_regs *regs) {
   unwind_state->stack.len = 0;
   unwind_state->tail_calls = 0;
   unwind_state->unwinding_jit = false;
+  unwind_state->truncated = false;
 
   u64 ip = 0;
   u64 sp = 0;
   u64 bp = 0;
+  u64 ra = 0;
 
-  if (in_kernel(regs->ip)) {
-    if (retrieve_task_registers(&ip, &sp, &bp)) {
+  if (in_kernel(USER_REGS_IP(regs))) {
+    if (retrieve_task_registers(&ip, &sp, &bp, &ra)) {
       // we are in kernelspace, but got the user regs
       unwind_state->ip = ip;
       unwind_state->sp = sp;
       unwind_state->bp = bp;
+      unwind_state->initial_bp = bp;
+      unwind_state->ra = ra;
     } else {
       // in kernelspace, but failed, probs a kworker
       return false;
     }
   } else {
     // in userspace
-    unwind_state->ip = regs->ip;
-    unwind_state->sp = regs->sp;
-    unwind_state->bp = regs->bp;
+    unwind_state->ip = USER_REGS_IP(regs);
+    unwind_state->sp = REGS_SP(regs);
+    unwind_state->bp = REGS_FP(regs);
+    unwind_state->initial_bp = REGS_FP(regs);
+    unwind_state->ra = REGS_RA(regs);
   }
 
   return true;
@@ -1039,8 +1888,8 @@ static __always_inline int walk_user_stacktrace(struct bpf_perf_event_data *ctx)
   return 0;
 }
 
-SEC("perf_event")
-int profile_cpu(struct bpf_perf_event_data *ctx) {
+// Samples the stack of the current task, on the given perf event.
+static __always_inline int profile(struct bpf_perf_event_data *ctx, u32 event) {
   u64 pid_tgid = bpf_get_current_pid_tgid();
   int user_pid = pid_tgid;
   int user_tgid = pid_tgid >> 32;
@@ -1061,6 +1910,24 @@ int profile_cpu(struct bpf_perf_event_data *ctx) {
     }
   }
 
+  if (unwinder_config.filter_cgroups && !is_cgroup_profiled()) {
+    return 0;
+  }
+
+  if (is_unsymbolizable(user_pid)) {
+    return 0;
+  }
+
+  if (is_compat(user_pid)) {
+    bump_unwind_skipped_compat();
+    return 0;
+  }
+
+  // Only the CPU clock is sampled at a frequency set per process.
+  if (event == 0 && should_skip_sample(user_pid)) {
+    return 0;
+  }
+
   set_initial_state(&ctx->regs);
   u32 zero = 0;
   unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
@@ -1068,6 +1935,7 @@ int profile_cpu(struct bpf_perf_event_data *ctx) {
     // This should never happen.
     return 0;
   }
+  unwind_state->event = event;
 
   if (has_fp(unwind_state->bp)) {
     add_stack(ctx, pid_tgid, STACK_WALKING_METHOD_FP, NULL);
@@ -1091,12 +1959,17 @@ int profile_cpu(struct bpf_perf_event_data *ctx) {
       if (unwind_table_result == FIND_UNWIND_MAPPING_NOT_FOUND) {
         request_refresh_process_info(ctx, user_pid);
         bump_unwind_error_pc_not_covered();
+        sample_unwind_failure(user_pid, unwind_state->ip, UNWIND_FAILURE_PC_NOT_COVERED);
+        add_lbr_stack(ctx, pid_tgid, unwind_state);
         return 1;
       } else if (unwind_table_result == FIND_UNWIND_JITTED) {
         if (!unwinder_config.mixed_stack_enabled) {
           bump_unwind_error_jit();
+          add_lbr_stack(ctx, pid_tgid, unwind_state);
           return 1;
         }
+      } else if (unwind_table_result == FIND_UNWIND_FRAME_POINTERS) {
+        LOG("[debug] IP 0x%llx is in a mapping without unwind information, using frame pointers", unwind_state->ip);
       } else if (proc_info->is_jit_compiler) {
 
         request_refresh_process_info(ctx, user_pid);
@@ -1112,6 +1985,101 @@ int profile_cpu(struct bpf_perf_event_data *ctx) {
   }
 
   request_unwind_information(ctx, user_pid);
+  add_lbr_stack(ctx, pid_tgid, unwind_state);
+  return 0;
+}
+
+SEC("perf_event")
+int profile_cpu(struct bpf_perf_event_data *ctx) {
+  return profile(ctx, 0);
+}
+
+// The hardware events sampled in addition to the CPU clock, up to
+// four of them, each attached to its own program.
+SEC("perf_event")
+int profile_event_1(struct bpf_perf_event_data *ctx) {
+  return profile(ctx, 1);
+}
+
+SEC("perf_event")
+int profile_event_2(struct bpf_perf_event_data *ctx) {
+  return profile(ctx, 2);
+}
+
+SEC("perf_event")
+int profile_event_3(struct bpf_perf_event_data *ctx) {
+  return profile(ctx, 3);
+}
+
+SEC("perf_event")
+int profile_event_4(struct bpf_perf_event_data *ctx) {
+  return profile(ctx, 4);
+}
+
+// Lets userspace fetch the information of new processes and build their
+// unwind tables right away, rather than once they are first sampled, so that
+// short-lived processes can be unwound and symbolized. Only attached when
+// enabled.
+SEC("tracepoint/sched/sched_process_exec")
+int trace_process_exec(void *ctx) {
+  int user_tgid = bpf_get_current_pid_tgid() >> 32;
+
+  // The processes to debug are only known once they are found by name.
+  if (unwinder_config.filter_processes) {
+    return 0;
+  }
+
+  if (unwinder_config.filter_cgroups && !is_cgroup_profiled()) {
+    return 0;
+  }
+
+  send_event(ctx, PROCESS_EXEC | user_tgid);
+  return 0;
+}
+
+// Lets userspace forget the unwind information of the processes that exited,
+// before their PID is reused. Only attached when enabled.
+SEC("tracepoint/sched/sched_process_exit")
+int trace_process_exit(void *ctx) {
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  int user_pid = pid_tgid;
+  int user_tgid = pid_tgid >> 32;
+
+  // Once the whole process exits, not each of its threads.
+  if (user_pid != user_tgid) {
+    return 0;
+  }
+
+  if (bpf_map_lookup_elem(&process_info, &user_tgid) == NULL) {
+    return 0;
+  }
+
+  send_event(ctx, PROCESS_EXIT | user_tgid);
+  return 0;
+}
+
+// Lets userspace read the mappings of the processes again as soon as they
+// load a shared library, so that it gets its unwind table and its debug
+// information uploaded before it is sampled. Only attached when enabled, to
+// the return of dlopen(3) and dlmopen(3) in the libraries defining them.
+SEC("uretprobe")
+int trace_dlopen(struct pt_regs *ctx) {
+  // The library failed to load.
+  if (PT_REGS_RC(ctx) == 0) {
+    return 0;
+  }
+
+  int user_tgid = bpf_get_current_pid_tgid() >> 32;
+
+  if (unwinder_config.filter_processes && !is_debug_enabled_for_pid(user_tgid)) {
+    return 0;
+  }
+
+  if (unwinder_config.filter_cgroups && !is_cgroup_profiled()) {
+    return 0;
+  }
+
+  send_event(ctx, LIBRARY_LOADED | user_tgid);
   return 0;
 }
 
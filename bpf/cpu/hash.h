@@ -17,8 +17,8 @@ uint32_t MurmurHash2(const void *key, int len, uint32_t seed) {
   /* Mix 4 bytes at a time into the hash */
 
   const unsigned char *data = (const unsigned char *)key;
-  // MAX_STACK_DEPTH * 2 = 256 (because we hash 32 bits at a time).
-  for (int i = 0; i < 256; i++) {
+  // MAX_STACK_DEPTH * 2 = 510 (because we hash 32 bits at a time).
+  for (int i = 0; i < 510; i++) {
     if (len < 4) {
       break;
     }
@@ -0,0 +1,161 @@
+// +build ignore
+// ^^ this is a golang build tag meant to exclude this C file from compilation
+// by the CGO compiler
+//
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright 2023 The Parca Authors
+
+#include "../common.h"
+#include "../vmlinux.h"
+
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+/*================================ CONSTANTS =================================*/
+
+// Maximum number of frames.
+#define MAX_STACK_DEPTH 127
+// Number of unique stacks.
+#define MAX_STACK_TRACES_ENTRIES 64000
+// Number of items in the network I/O aggregation map.
+#define MAX_NETIO_ENTRIES 10240
+// Number of threads that can be in a socket syscall at the same time.
+#define MAX_INFLIGHT_THREADS 10240
+
+#define DIRECTION_SEND 0
+#define DIRECTION_RECV 1
+
+/*============================== MACROS =====================================*/
+
+#define BPF_MAP(_name, _type, _key_type, _value_type, _max_entries)                                                                                            \
+  struct {                                                                                                                                                     \
+    __uint(type, _type);                                                                                                                                       \
+    __uint(max_entries, _max_entries);                                                                                                                         \
+    __type(key, _key_type);                                                                                                                                    \
+    __type(value, _value_type);                                                                                                                                \
+  } _name SEC(".maps");
+
+typedef u64 stack_trace_type[MAX_STACK_DEPTH];
+#define BPF_STACK_TRACE(_name, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_STACK_TRACE, u32, stack_trace_type, _max_entries);
+
+#define BPF_HASH(_name, _key_type, _value_type, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_HASH, _key_type, _value_type, _max_entries);
+
+/*============================= INTERNAL STRUCTS ============================*/
+
+typedef struct {
+  int pid;
+  int tgid;
+  int user_stack_id;
+  int direction;
+} netio_key_t;
+
+typedef struct {
+  u64 bytes;
+  u64 latency_ns;
+} netio_value_t;
+
+// A thread inside of a socket syscall.
+typedef struct {
+  u64 start_ns;
+  int user_stack_id;
+  int direction;
+} inflight_t;
+
+/*================================ MAPS =====================================*/
+
+BPF_STACK_TRACE(stack_traces, MAX_STACK_TRACES_ENTRIES);
+BPF_HASH(netio, netio_key_t, netio_value_t, MAX_NETIO_ENTRIES);
+// Keyed by the thread ID.
+BPF_HASH(inflight, u32, inflight_t, MAX_INFLIGHT_THREADS);
+
+/*=========================== HELPER FUNCTIONS ==============================*/
+
+static __always_inline int syscall_enter(void *ctx, int direction) {
+  u32 tid = bpf_get_current_pid_tgid();
+  if (tid == 0) {
+    return 0;
+  }
+
+  int user_stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+  if (user_stack_id < 0) {
+    return 0;
+  }
+
+  inflight_t start = {
+      .start_ns = bpf_ktime_get_ns(),
+      .user_stack_id = user_stack_id,
+      .direction = direction,
+  };
+  bpf_map_update_elem(&inflight, &tid, &start, BPF_ANY);
+  return 0;
+}
+
+static __always_inline int syscall_exit(struct trace_event_raw_sys_exit *ctx) {
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  u32 tid = pid_tgid;
+
+  inflight_t *start = bpf_map_lookup_elem(&inflight, &tid);
+  if (start == NULL) {
+    return 0;
+  }
+
+  u64 latency = bpf_ktime_get_ns() - start->start_ns;
+  netio_key_t key = {
+      .pid = pid_tgid >> 32,
+      .tgid = tid,
+      .user_stack_id = start->user_stack_id,
+      .direction = start->direction,
+  };
+  bpf_map_delete_elem(&inflight, &tid);
+
+  // Errors, such as EAGAIN on non-blocking sockets, are not accounted.
+  if (ctx->ret < 0) {
+    return 0;
+  }
+
+  netio_value_t *value = bpf_map_lookup_elem(&netio, &key);
+  if (value) {
+    __sync_fetch_and_add(&value->bytes, ctx->ret);
+    __sync_fetch_and_add(&value->latency_ns, latency);
+    return 0;
+  }
+
+  netio_value_t init = {
+      .bytes = ctx->ret,
+      .latency_ns = latency,
+  };
+  bpf_map_update_elem(&netio, &key, &init, BPF_NOEXIST);
+  return 0;
+}
+
+/*=============================== PROGRAMS ==================================*/
+
+SEC("tracepoint/syscalls/sys_enter_sendto")
+int sendto_enter(struct trace_event_raw_sys_enter *ctx) { return syscall_enter(ctx, DIRECTION_SEND); }
+
+SEC("tracepoint/syscalls/sys_exit_sendto")
+int sendto_exit(struct trace_event_raw_sys_exit *ctx) { return syscall_exit(ctx); }
+
+SEC("tracepoint/syscalls/sys_enter_sendmsg")
+int sendmsg_enter(struct trace_event_raw_sys_enter *ctx) { return syscall_enter(ctx, DIRECTION_SEND); }
+
+SEC("tracepoint/syscalls/sys_exit_sendmsg")
+int sendmsg_exit(struct trace_event_raw_sys_exit *ctx) { return syscall_exit(ctx); }
+
+SEC("tracepoint/syscalls/sys_enter_recvfrom")
+int recvfrom_enter(struct trace_event_raw_sys_enter *ctx) { return syscall_enter(ctx, DIRECTION_RECV); }
+
+SEC("tracepoint/syscalls/sys_exit_recvfrom")
+int recvfrom_exit(struct trace_event_raw_sys_exit *ctx) { return syscall_exit(ctx); }
+
+SEC("tracepoint/syscalls/sys_enter_recvmsg")
+int recvmsg_enter(struct trace_event_raw_sys_enter *ctx) { return syscall_enter(ctx, DIRECTION_RECV); }
+
+SEC("tracepoint/syscalls/sys_exit_recvmsg")
+int recvmsg_exit(struct trace_event_raw_sys_exit *ctx) { return syscall_exit(ctx); }
+
+#define KBUILD_MODNAME "parca-agent"
+volatile const char bpf_metadata_name[] SEC(".rodata") = "parca-agent (https://github.com/parca-dev/parca-agent)";
+unsigned int VERSION SEC("version") = 1;
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,177 @@
+// +build ignore
+// ^^ this is a golang build tag meant to exclude this C file from compilation
+// by the CGO compiler
+//
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright 2023 The Parca Authors
+
+#include "../common.h"
+#include "../vmlinux.h"
+
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+/*================================ CONSTANTS =================================*/
+
+// Maximum number of frames.
+#define MAX_STACK_DEPTH 127
+// Number of unique stacks.
+#define MAX_STACK_TRACES_ENTRIES 64000
+// Number of items in the wall-clock aggregation map.
+#define MAX_WALLCLOCK_ENTRIES 10240
+// Number of threads that can be off-CPU at the same time.
+#define MAX_OFF_CPU_THREADS 10240
+// Number of processes that can be profiled.
+#define MAX_PROFILED_PROCESSES 4096
+
+#define STATE_ON_CPU 0
+#define STATE_OFF_CPU 1
+
+struct wallclock_config_t {
+  u64 sample_period_ns;
+};
+
+const volatile struct wallclock_config_t wallclock_config = {};
+
+/*============================== MACROS =====================================*/
+
+#define BPF_MAP(_name, _type, _key_type, _value_type, _max_entries)                                                                                            \
+  struct {                                                                                                                                                     \
+    __uint(type, _type);                                                                                                                                       \
+    __uint(max_entries, _max_entries);                                                                                                                         \
+    __type(key, _key_type);                                                                                                                                    \
+    __type(value, _value_type);                                                                                                                                \
+  } _name SEC(".maps");
+
+typedef u64 stack_trace_type[MAX_STACK_DEPTH];
+#define BPF_STACK_TRACE(_name, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_STACK_TRACE, u32, stack_trace_type, _max_entries);
+
+#define BPF_HASH(_name, _key_type, _value_type, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_HASH, _key_type, _value_type, _max_entries);
+
+#define BPF_LRU_HASH(_name, _key_type, _value_type, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_LRU_HASH, _key_type, _value_type, _max_entries);
+
+/*============================= INTERNAL STRUCTS ============================*/
+
+typedef struct {
+  int pid;
+  int tid;
+  int user_stack_id;
+  int state;
+} wallclock_key_t;
+
+// A thread of a profiled process that was switched out.
+typedef struct {
+  u64 start_ns;
+  int pid;
+  int user_stack_id;
+} off_cpu_start_t;
+
+/*================================ MAPS =====================================*/
+
+BPF_STACK_TRACE(stack_traces, MAX_STACK_TRACES_ENTRIES);
+// Total nanoseconds spent on and off CPU, per thread and stack.
+BPF_HASH(wallclock_ns, wallclock_key_t, u64, MAX_WALLCLOCK_ENTRIES);
+// Keyed by the thread ID. Threads that exit are never switched back in, so
+// their entries are left to be evicted.
+BPF_LRU_HASH(off_cpu_starts, u32, off_cpu_start_t, MAX_OFF_CPU_THREADS);
+// Processes selected for wall-clock profiling, kept up to date from userspace,
+// with the ratio of their on-CPU samples to keep.
+BPF_HASH(profiled_pids, u32, u8, MAX_PROFILED_PROCESSES);
+
+/*=========================== HELPER FUNCTIONS ==============================*/
+
+static __always_inline void add_wallclock(wallclock_key_t *key, u64 delta) {
+  u64 *value = bpf_map_lookup_elem(&wallclock_ns, key);
+  if (value) {
+    __sync_fetch_and_add(value, delta);
+    return;
+  }
+  bpf_map_update_elem(&wallclock_ns, key, &delta, BPF_NOEXIST);
+}
+
+/*=============================== PROGRAMS ==================================*/
+
+// Samples the threads of the profiled processes that are running. One in
+// every `every` samples is kept at random, and accounts for as many sampling
+// periods of on-CPU time.
+SEC("perf_event")
+int on_cpu_sample(struct bpf_perf_event_data *ctx) {
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  u32 pid = pid_tgid >> 32;
+  u32 tid = pid_tgid;
+  if (pid == 0) {
+    return 0;
+  }
+  u8 *every = bpf_map_lookup_elem(&profiled_pids, &pid);
+  if (every == NULL) {
+    return 0;
+  }
+  u64 periods = *every > 1 ? *every : 1;
+  if (periods > 1 && bpf_get_prandom_u32() % periods != 0) {
+    return 0;
+  }
+
+  int user_stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+  if (user_stack_id < 0) {
+    return 0;
+  }
+
+  wallclock_key_t key = {
+      .pid = pid,
+      .tid = tid,
+      .user_stack_id = user_stack_id,
+      .state = STATE_ON_CPU,
+  };
+  add_wallclock(&key, periods * wallclock_config.sample_period_ns);
+  return 0;
+}
+
+// Times how long the threads of the profiled processes stay switched out,
+// whether they sleep in a syscall, wait on a lock or are preempted. The time
+// is accounted to the user stack they were switched out from once they are
+// switched back in, so threads that never wake up are not accounted.
+SEC("tracepoint/sched/sched_switch")
+int sched_switch(struct trace_event_raw_sched_switch *ctx) {
+  u64 now = bpf_ktime_get_ns();
+
+  // The previous task is still the current one, so its user stack can be
+  // collected.
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+  u32 pid = pid_tgid >> 32;
+  u32 prev_tid = pid_tgid;
+  if (pid != 0 && bpf_map_lookup_elem(&profiled_pids, &pid) != NULL) {
+    int user_stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+    if (user_stack_id >= 0) {
+      off_cpu_start_t start = {
+          .start_ns = now,
+          .pid = pid,
+          .user_stack_id = user_stack_id,
+      };
+      bpf_map_update_elem(&off_cpu_starts, &prev_tid, &start, BPF_ANY);
+    }
+  }
+
+  u32 next_tid = ctx->next_pid;
+  off_cpu_start_t *start = bpf_map_lookup_elem(&off_cpu_starts, &next_tid);
+  if (start == NULL) {
+    return 0;
+  }
+
+  wallclock_key_t key = {
+      .pid = start->pid,
+      .tid = next_tid,
+      .user_stack_id = start->user_stack_id,
+      .state = STATE_OFF_CPU,
+  };
+  u64 delta = now - start->start_ns;
+  bpf_map_delete_elem(&off_cpu_starts, &next_tid);
+
+  add_wallclock(&key, delta);
+  return 0;
+}
+
+#define KBUILD_MODNAME "parca-agent"
+volatile const char bpf_metadata_name[] SEC(".rodata") = "parca-agent (https://github.com/parca-dev/parca-agent)";
+unsigned int VERSION SEC("version") = 1;
+char LICENSE[] SEC("license") = "GPL";
@@ -20,14 +20,25 @@ import (
 
 	"github.com/alecthomas/kong"
 
+	"github.com/parca-dev/parca-agent/internal/procfs"
 	"github.com/parca-dev/parca-agent/pkg/logger"
+	"github.com/parca-dev/parca-agent/pkg/process"
 	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
 )
 
 type flags struct {
-	Executable string `kong:"help='The executable to print the .eh_unwind tables for.'"`
-	Compact    bool   `kong:"help='Whether to use the compact format.'"`
-	RelativePC uint64 `kong:"help='Filter FDEs that contain this PC'"`
+	Executable  string  `kong:"help='The executable to print the .eh_unwind tables for.'"`
+	PID         int     `kong:"name='pid',help='Print the .eh_unwind tables of all the objects mapped by the process with this PID, in address order.'"`
+	Core        string  `kong:"help='Print the .eh_unwind tables of all the objects mapped by the process this core dump was taken of, in address order. The objects are read at the paths they were mapped from.'"`
+	Compact     bool    `kong:"help='Whether to use the compact format.'"`
+	ORC         bool    `kong:"name='orc',help='Print the compact unwind table built from the ORC unwind information of the executable, a kernel image such as vmlinux, rather than from its .eh_frame section.'"`
+	RelativePC  uint64  `kong:"help='Filter FDEs that contain this PC'"`
+	Diff        bool    `kong:"help='Compare the unwind tables of two executables, passed as arguments, e.g. --diff old_binary new_binary.'"`
+	Stats       bool    `kong:"help='Print statistics about the unwind information of the executable.'"`
+	Validate    bool    `kong:"help='Exit with a non-zero status code if the .text coverage is below --min-coverage.'"`
+	MinCoverage float64 `kong:"help='Minimum fraction of .text that must be covered by unwind information in validate mode.',default='0.9'"`
+
+	Executables []string `kong:"arg='',optional='',help='Executables to compare in diff mode.'"`
 }
 
 // This tool exists for debugging .eh_frame unwinding and its intended for Parca Agent's
@@ -38,6 +49,62 @@ func main() {
 	flags := flags{}
 	kong.Parse(&flags)
 
+	ptb := unwind.NewUnwindTableBuilder(logger)
+
+	if flags.Diff {
+		if len(flags.Executables) != 2 {
+			// nolint
+			fmt.Fprintln(os.Stderr, "Diff mode requires exactly two executables")
+			os.Exit(1)
+		}
+
+		if err := ptb.DiffTables(os.Stdout, flags.Executables[0], flags.Executables[1]); err != nil {
+			// nolint
+			fmt.Println("failed with:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var pc *uint64
+
+	if flags.RelativePC != 0 {
+		pc = &flags.RelativePC
+	}
+
+	if flags.PID != 0 || flags.Core != "" {
+		var (
+			rawMappings []*procfs.ProcMap
+			objectPath  = func(m *unwind.ExecutableMapping) string { return m.Executable }
+			err         error
+		)
+		if flags.PID != 0 {
+			var proc procfs.Proc
+			proc, err = procfs.NewProc(flags.PID)
+			if err == nil {
+				rawMappings, err = proc.ProcMaps()
+			}
+			if err != nil {
+				// nolint
+				fmt.Println("failed with:", err)
+				os.Exit(1)
+			}
+			objectPath = func(m *unwind.ExecutableMapping) string {
+				return process.MappedFilePath(flags.PID, m.Executable, m.StartAddr, m.EndAddr)
+			}
+		} else {
+			rawMappings, err = unwind.CoreMappings(flags.Core)
+			if err != nil {
+				// nolint
+				fmt.Println("failed with:", err)
+				os.Exit(1)
+			}
+		}
+
+		ptb.PrintMappingTables(os.Stdout, unwind.ListExecutableMappings(rawMappings), objectPath, flags.Compact, pc)
+		return
+	}
+
 	executablePath := flags.Executable
 
 	if executablePath == "" {
@@ -46,13 +113,35 @@ func main() {
 		os.Exit(1)
 	}
 
-	var pc *uint64
+	if flags.Stats || flags.Validate {
+		stats, err := ptb.Stats(executablePath)
+		if err != nil {
+			// nolint
+			fmt.Println("failed with:", err)
+			os.Exit(1)
+		}
 
-	if flags.RelativePC != 0 {
-		pc = &flags.RelativePC
+		if flags.Stats {
+			stats.Print(os.Stdout)
+		}
+
+		if flags.Validate && stats.TextCoverage < flags.MinCoverage {
+			// nolint
+			fmt.Fprintf(os.Stderr, "validation failed: .text coverage %.2f%% is below %.2f%%\n", stats.TextCoverage*100, flags.MinCoverage*100)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flags.ORC {
+		if err := unwind.PrintORCTable(os.Stdout, executablePath, pc); err != nil {
+			// nolint
+			fmt.Println("failed with:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	ptb := unwind.NewUnwindTableBuilder(logger)
 	err := ptb.PrintTable(os.Stdout, executablePath, flags.Compact, pc)
 	if err != nil {
 		// nolint
@@ -0,0 +1,240 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+const bundleCommand = "bundle"
+
+const redacted = "<redacted>"
+
+// bundleFlags are the flags of the bundle subcommand.
+type bundleFlags struct {
+	AgentAddress string        `kong:"help='Address of the HTTP server of the running agent, as given with --http-address.',default='localhost:7071'"`
+	Output       string        `kong:"short='o',help='Path of the archive to write. Defaults to parca-agent-bundle-<time>.tar.gz in the working directory.'"`
+	LogFiles     []string      `kong:"help='Log files of the agent to include, e.g. the output of kubectl logs.'"`
+	RedactLabels []string      `kong:"help='Names of the labels whose values are sensitive, and are redacted from the bundle.'"`
+	BTFPath      string        `kong:"help='Path of a BTF file, or of a directory of <kernel release>.btf files, as given to the agent.'"`
+	Timeout      time.Duration `kong:"help='Timeout of the requests to the agent.',default='30s'"`
+}
+
+// bundleFile is a file of the support bundle.
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// agentEndpoints are the files of the support bundle fetched from the HTTP
+// server of the agent, by path.
+var agentEndpoints = []struct {
+	name string
+	path string
+}{
+	{"status.html", "/"},
+	{"metrics.txt", "/metrics"},
+	{"logs.txt", "/debug/logs"},
+	{"caches.json", "/debug/caches"},
+	{"events.json", "/debug/events"},
+	{"symbolization.json", "/debug/symbolization"},
+	{"unwind-failures.json", "/debug/unwind-failures"},
+	{"debuginfo-uploads.json", "/debug/debuginfo-uploads"},
+	{"debuginfo-skipped.json", "/debug/debuginfo-skipped"},
+	{"goroutines.txt", "/debug/pprof/goroutine?debug=2"},
+	{"heap.pb.gz", "/debug/pprof/heap"},
+}
+
+// runBundle collects what is needed to investigate an issue of the agent
+// running on this host in an archive to attach to bug reports.
+func runBundle(args []string) error {
+	flags := bundleFlags{}
+	parser, err := kong.New(&flags,
+		kong.Name("parca-agent "+bundleCommand),
+		kong.Description("Collect the status, metrics, recent errors and doctor report of the agent running on this host in an archive to attach to bug reports."),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = parser.Parse(args)
+	parser.FatalIfErrorf(err)
+
+	output := flags.Output
+	if output == "" {
+		output = fmt.Sprintf("parca-agent-bundle-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	files, errs := collectBundle(context.Background(), flags)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		var b strings.Builder
+		for _, err := range errs {
+			fmt.Fprintln(&b, err)
+		}
+		files = append(files, bundleFile{name: "errors.txt", data: []byte(b.String())})
+	}
+
+	redactor := newLabelRedactor(flags.RedactLabels)
+	for i, f := range files {
+		if !strings.HasSuffix(f.name, ".pb.gz") {
+			files[i].data = redactor.redact(f.data)
+		}
+	}
+
+	if err := writeBundle(output, files); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, "wrote", output)
+	return nil
+}
+
+// collectBundle collects the files of the support bundle. Files that can't be
+// collected are skipped, and the errors returned.
+func collectBundle(ctx context.Context, flags bundleFlags) ([]bundleFile, []error) {
+	var (
+		files []bundleFile
+		errs  []error
+	)
+
+	files = append(files, bundleFile{
+		name: "version.txt",
+		data: []byte(fmt.Sprintf("parca-agent, version %s (commit: %s, date: %s), arch: %s\n", version, commit, date, goArch)),
+	})
+
+	report, err := json.MarshalIndent(doctor(doctorFlags{BTFPath: flags.BTFPath}), "", "  ")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("doctor: %w", err))
+	} else {
+		files = append(files, bundleFile{name: "doctor.json", data: report})
+	}
+
+	client := &http.Client{Timeout: flags.Timeout}
+	base := flags.AgentAddress
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	for _, e := range agentEndpoints {
+		data, err := fetch(ctx, client, strings.TrimSuffix(base, "/")+e.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.name, err))
+			continue
+		}
+		files = append(files, bundleFile{name: e.name, data: data})
+	}
+
+	for _, path := range flags.LogFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("log file: %w", err))
+			continue
+		}
+		files = append(files, bundleFile{name: filepath.Join("logs", filepath.Base(path)), data: data})
+	}
+
+	return files, errs
+}
+
+func fetch(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// writeBundle writes the files in a gzipped tar archive at the given path.
+func writeBundle(path string, files []bundleFile) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer func() {
+		err = errors.Join(err, f.Close())
+	}()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	now := time.Now()
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    filepath.Join("parca-agent-bundle", file.name),
+			Mode:    0o644,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return zw.Close()
+}
+
+// labelRedactor replaces the values of sensitive labels, written as
+// name="value" in metrics, name=value in logs, or name:"value" on the status
+// page.
+type labelRedactor struct {
+	re *regexp.Regexp
+}
+
+func newLabelRedactor(names []string) *labelRedactor {
+	if len(names) == 0 {
+		return &labelRedactor{}
+	}
+	quoted := make([]string, 0, len(names))
+	for _, n := range names {
+		quoted = append(quoted, regexp.QuoteMeta(n))
+	}
+	return &labelRedactor{re: regexp.MustCompile(
+		`\b(` + strings.Join(quoted, "|") + `)([=:])("(?:[^"\\]|\\.)*"|&#34;.*?&#34;|[^\s",}]*)`,
+	)}
+}
+
+func (r *labelRedactor) redact(data []byte) []byte {
+	if r.re == nil {
+		return data
+	}
+	return r.re.ReplaceAll(data, []byte(`${1}${2}"`+redacted+`"`))
+}
@@ -0,0 +1,348 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"golang.org/x/sys/unix"
+
+	"github.com/parca-dev/parca-agent/pkg/capability"
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
+	"github.com/parca-dev/parca-agent/pkg/kconfig"
+	"github.com/parca-dev/parca-agent/pkg/metadata"
+	"github.com/parca-dev/parca-agent/pkg/rlimit"
+)
+
+const doctorCommand = "doctor"
+
+const btfRemediation = "Download the BTF of this kernel, e.g. from https://github.com/aquasecurity/btfhub-archive, and pass it with --btf-path."
+
+// Statuses of the checks of the doctor subcommand. Warnings are about
+// features that are degraded, errors about the agent not working at all.
+const (
+	statusOK      = "ok"
+	statusWarning = "warning"
+	statusError   = "error"
+)
+
+// doctorFlags are the flags of the doctor subcommand.
+type doctorFlags struct {
+	BTFPath               string        `kong:"help='Path of a BTF file, or of a directory of <kernel release>.btf files, as given to the agent.'"`
+	RemoteStoreAddress    string        `kong:"help='gRPC address of the store to check the connectivity to, as given to the agent. Leave this empty to skip the check.'"`
+	RemoteStoreInsecure   bool          `kong:"help='The store is reached via plaintext instead of TLS.'"`
+	RemoteStoreServerName string        `kong:"help='Server name to verify the certificate of the store against, instead of the host of the address.'"`
+	Timeout               time.Duration `kong:"help='Timeout of the connectivity check.',default='5s'"`
+	Output                string        `kong:"enum='text,json',default='text',help='Print the report as text or as JSON.'"`
+}
+
+// diagnosis is the outcome of one of the checks of the doctor subcommand.
+type diagnosis struct {
+	Check       string `json:"check"`
+	Status      string `json:"status"`
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// doctorReport is the machine-readable report of the doctor subcommand.
+type doctorReport struct {
+	KernelRelease string      `json:"kernel_release"`
+	OK            bool        `json:"ok"`
+	Checks        []diagnosis `json:"checks"`
+}
+
+// runDoctor checks that the host can run the agent, and prints how to fix it
+// otherwise.
+func runDoctor(args []string) error {
+	flags := doctorFlags{}
+	parser, err := kong.New(&flags,
+		kong.Name("parca-agent "+doctorCommand),
+		kong.Description("Check that this host can run the agent, and print how to fix it otherwise."),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = parser.Parse(args)
+	parser.FatalIfErrorf(err)
+
+	report := doctor(flags)
+	if flags.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printDiagnoses(os.Stdout, report.Checks)
+	}
+
+	failed := 0
+	for _, d := range report.Checks {
+		if d.Status == statusError {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(report.Checks))
+	}
+	return nil
+}
+
+// doctor runs the checks of the doctor subcommand.
+func doctor(flags doctorFlags) doctorReport {
+	release, _ := metadata.KernelRelease()
+	// The checks go on without the capabilities, as if there were none.
+	caps, capsErr := capability.Effective()
+	version, versionErr := kconfig.KernelVersion()
+
+	diagnoses := []diagnosis{
+		diagnoseKernel(version, versionErr),
+		diagnoseBTF(flags.BTFPath),
+		diagnoseCapabilities(caps, capsErr, version),
+		diagnosePerfEventParanoid(caps),
+		diagnoseKptrRestrict(caps),
+		diagnoseCgroup(),
+		diagnoseMemlock(caps, version),
+	}
+	if flags.RemoteStoreAddress != "" {
+		diagnoses = append(diagnoses, diagnoseConnectivity(flags))
+	}
+
+	report := doctorReport{KernelRelease: release, OK: true, Checks: diagnoses}
+	for _, d := range diagnoses {
+		if d.Status == statusError {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+func diagnoseKernel(version kconfig.Version, err error) diagnosis {
+	d := diagnosis{Check: "kernel"}
+	switch {
+	case err != nil:
+		d.Status = statusError
+		d.Detail = err.Error()
+	case !version.AtLeast(4, 18):
+		d.Status = statusError
+		d.Detail = fmt.Sprintf("kernel %s is older than 4.18", version)
+		d.Remediation = "Upgrade the kernel to 4.18 or later."
+	default:
+		d.Status = statusOK
+		d.Detail = "kernel " + version.String()
+	}
+	return d
+}
+
+func diagnoseBTF(path string) diagnosis {
+	d := diagnosis{Check: "btf"}
+	btf, err := kconfig.FindBTF(path)
+	if err != nil {
+		d.Status = statusError
+		d.Detail = err.Error()
+		d.Remediation = btfRemediation
+		return d
+	}
+	d.Status = statusOK
+	d.Detail = "kernel types are read from " + btf.Source
+	return d
+}
+
+func diagnoseCapabilities(caps capability.Set, err error, version kconfig.Version) diagnosis {
+	d := diagnosis{Check: "capabilities"}
+	if err != nil {
+		d.Status = statusError
+		d.Detail = fmt.Sprintf("failed to read the capabilities of the agent: %v", err)
+		return d
+	}
+
+	// CAP_SYSLOG is diagnosed along with kernel.kptr_restrict, and
+	// CAP_SYS_RESOURCE along with the memlock limit.
+	var needed []capability.Capability
+	for _, c := range capability.Needed(version) {
+		if c != capability.Syslog && c != capability.SysResource {
+			needed = append(needed, c)
+		}
+	}
+	var missing []string
+	for _, c := range caps.Missing(needed) {
+		missing = append(missing, c.String())
+	}
+
+	if len(missing) > 0 {
+		d.Status = statusError
+		d.Detail = "missing " + strings.Join(missing, ", ")
+		d.Remediation = "Run the agent as root, or grant it the missing capabilities, e.g. with securityContext.capabilities.add on Kubernetes."
+		return d
+	}
+	d.Status = statusOK
+	d.Detail = "the capabilities to load BPF programs, open perf events and read other processes are granted"
+	return d
+}
+
+func diagnosePerfEventParanoid(caps capability.Set) diagnosis {
+	d := diagnosis{Check: "perf_event_paranoid"}
+	v, err := readSysctl("kernel/perf_event_paranoid")
+	if err != nil {
+		d.Status = statusError
+		d.Detail = err.Error()
+		return d
+	}
+
+	d.Detail = fmt.Sprintf("kernel.perf_event_paranoid is %d", v)
+	// Values above 2 are patches of some distributions restricting perf
+	// events to CAP_SYS_ADMIN.
+	if v > 2 && !caps.Has(capability.SysAdmin) {
+		d.Status = statusError
+		d.Remediation = "Run the agent with CAP_SYS_ADMIN, or lower the setting with sysctl -w kernel.perf_event_paranoid=2."
+		return d
+	}
+	d.Status = statusOK
+	return d
+}
+
+func diagnoseKptrRestrict(caps capability.Set) diagnosis {
+	d := diagnosis{Check: "kptr_restrict"}
+	v, err := readSysctl("kernel/kptr_restrict")
+	if err != nil {
+		d.Status = statusWarning
+		d.Detail = err.Error()
+		return d
+	}
+
+	d.Detail = fmt.Sprintf("kernel.kptr_restrict is %d", v)
+	switch {
+	case v >= 2:
+		d.Status = statusWarning
+		d.Detail += ", kernel frames can't be symbolized"
+		d.Remediation = "Lower the setting with sysctl -w kernel.kptr_restrict=1."
+	case v == 1 && !caps.Has(capability.Syslog):
+		d.Status = statusWarning
+		d.Detail += " and CAP_SYSLOG is missing, kernel frames can't be symbolized"
+		d.Remediation = "Grant the agent CAP_SYSLOG."
+	default:
+		d.Status = statusOK
+	}
+	return d
+}
+
+func diagnoseCgroup() diagnosis {
+	d := diagnosis{Check: "cgroup"}
+	mountpoint, err := cgroup.V2Mountpoint()
+	if err != nil {
+		d.Status = statusWarning
+		d.Detail = "cgroup v1 only, --profiling-cgroup-filter is not available"
+		d.Remediation = "Boot with systemd.unified_cgroup_hierarchy=1 to use cgroup v2."
+		return d
+	}
+	d.Status = statusOK
+	d.Detail = "cgroup v2 is mounted at " + mountpoint
+	return d
+}
+
+func diagnoseMemlock(caps capability.Set, version kconfig.Version) diagnosis {
+	d := diagnosis{Check: "memlock"}
+	// BPF maps are accounted to the memory cgroup from 5.11 on.
+	if version.AtLeast(5, 11) {
+		d.Status = statusOK
+		d.Detail = "BPF memory is accounted to the memory cgroup"
+		return d
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(unix.RLIMIT_MEMLOCK, &limit); err != nil {
+		d.Status = statusError
+		d.Detail = fmt.Sprintf("failed to get memlock rlimit: %v", err)
+		return d
+	}
+
+	d.Detail = "memlock rlimit is " + rlimit.HumanizeRLimit(limit.Cur)
+	if caps.Has(capability.SysResource) {
+		d.Status = statusOK
+		d.Detail += ", and can be raised by the agent"
+		return d
+	}
+	if limit.Max != unix.RLIM_INFINITY && limit.Max < defaultMemlockRLimitWithDWARFUnwinding {
+		d.Status = statusError
+		d.Detail += " and can't be raised to " + rlimit.HumanizeRLimit(defaultMemlockRLimitWithDWARFUnwinding)
+		d.Remediation = "Grant the agent CAP_SYS_RESOURCE, or raise the limit, e.g. with ulimit -l unlimited or LimitMEMLOCK=infinity in its systemd unit."
+		return d
+	}
+	d.Status = statusOK
+	return d
+}
+
+func diagnoseConnectivity(flags doctorFlags) diagnosis {
+	d := diagnosis{Check: "connectivity"}
+	ctx, cancel := context.WithTimeout(context.Background(), flags.Timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", flags.RemoteStoreAddress)
+	if err != nil {
+		d.Status = statusError
+		d.Detail = fmt.Sprintf("failed to connect to %s: %v", flags.RemoteStoreAddress, err)
+		d.Remediation = "Check the address of the store, and that the firewall and proxies of the host let the agent reach it."
+		return d
+	}
+	defer conn.Close()
+
+	if !flags.RemoteStoreInsecure {
+		serverName := flags.RemoteStoreServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(flags.RemoteStoreAddress)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			d.Status = statusError
+			d.Detail = fmt.Sprintf("failed to establish TLS with %s: %v", flags.RemoteStoreAddress, err)
+			d.Remediation = "Check that the store serves TLS, or pass --remote-store-insecure, and that its certificate is trusted."
+			return d
+		}
+	}
+
+	d.Status = statusOK
+	d.Detail = "the store at " + flags.RemoteStoreAddress + " is reachable"
+	return d
+}
+
+// readSysctl reads an integer kernel setting.
+func readSysctl(name string) (int, error) {
+	b, err := os.ReadFile("/proc/sys/" + name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", strings.ReplaceAll(name, "/", "."), err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func printDiagnoses(w io.Writer, diagnoses []diagnosis) {
+	for _, d := range diagnoses {
+		fmt.Fprintf(w, "[%-7s] %s: %s\n", strings.ToUpper(d.Status), d.Check, d.Detail)
+		if d.Remediation != "" {
+			fmt.Fprintf(w, "          %s\n", d.Remediation)
+		}
+	}
+}
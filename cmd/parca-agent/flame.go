@@ -0,0 +1,132 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/google/pprof/profile"
+	"golang.org/x/term"
+
+	"github.com/parca-dev/parca-agent/pkg/flamegraph"
+)
+
+const flameCommand = "flame"
+
+// flameFlags are the flags of the flame subcommand.
+type flameFlags struct {
+	PID         int           `kong:"required,help='The process to profile.'"`
+	Duration    time.Duration `kong:"help='How long to profile the process for, rounded up to the profiling duration of the agent.',default='10s'"`
+	HTTPAddress string        `kong:"help='Address of the HTTP server of the agent running on this host.',default='localhost:7071'"`
+	Folded      bool          `kong:"help='Print the stacks in the folded format, e.g. to pipe them to flamegraph.pl, instead of rendering them.'"`
+	Width       int           `kong:"help='Number of columns of the flame graph. Leave this empty to use the width of the terminal.'"`
+	NoColor     bool          `kong:"help='Do not use ANSI colors.'"`
+}
+
+// runFlame captures a CPU profile of a process through the agent running on
+// the host, which symbolizes it as it does for any other profile, and renders
+// it in the terminal.
+func runFlame(args []string) error {
+	flags := flameFlags{}
+	parser, err := kong.New(&flags,
+		kong.Name("parca-agent "+flameCommand),
+		kong.Description("Render a flame graph of a process in the terminal, profiled by the agent running on this host."),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = parser.Parse(args)
+	parser.FatalIfErrorf(err)
+
+	prof, err := captureProfile(flags)
+	if err != nil {
+		return err
+	}
+
+	graph, err := flamegraph.FromProfile(prof, -1)
+	if err != nil {
+		return err
+	}
+
+	if flags.Folded {
+		return graph.WriteFolded(os.Stdout)
+	}
+
+	isTerminal := term.IsTerminal(int(os.Stdout.Fd()))
+	width := flags.Width
+	if width <= 0 {
+		width = 120
+		if isTerminal {
+			if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+				width = w
+			}
+		}
+	}
+	return graph.WriteANSI(os.Stdout, flamegraph.ANSIOptions{
+		Width: width,
+		Color: isTerminal && !flags.NoColor,
+	})
+}
+
+func captureProfile(flags flameFlags) (*profile.Profile, error) {
+	address := flags.HTTPAddress
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP address: %w", err)
+	}
+	u.Path = "/profiles/pid/" + strconv.Itoa(flags.PID)
+	u.RawQuery = url.Values{"duration": []string{flags.Duration.String()}}.Encode()
+
+	// The agent answers once the capture is over, which can take up to a
+	// profiling duration longer than requested.
+	ctx, cancel := context.WithTimeout(context.Background(), flags.Duration+time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Profiling process %d for %s...\n", flags.PID, flags.Duration)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the agent, is it running with --http-address=%s: %w", flags.HTTPAddress, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("agent responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	prof, err := profile.Parse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profile: %w", err)
+	}
+	return prof, nil
+}
@@ -12,22 +12,28 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	runtimepprof "runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -37,16 +43,18 @@ import (
 	okrun "github.com/oklog/run"
 	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
 	vtproto "github.com/planetscale/vtprotobuf/codec/grpc"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/procfs"
 	"github.com/prometheus/prometheus/promql/parser"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/automaxprocs/maxprocs"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/encoding"
 	_ "google.golang.org/grpc/encoding/proto"
@@ -55,23 +63,40 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/agent"
 	"github.com/parca-dev/parca-agent/pkg/buildinfo"
 	"github.com/parca-dev/parca-agent/pkg/byteorder"
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/capability"
 	"github.com/parca-dev/parca-agent/pkg/config"
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
 	"github.com/parca-dev/parca-agent/pkg/discovery"
+	"github.com/parca-dev/parca-agent/pkg/discovery/kubernetes"
+	"github.com/parca-dev/parca-agent/pkg/dotnet"
+	"github.com/parca-dev/parca-agent/pkg/encryption"
 	parcagrpc "github.com/parca-dev/parca-agent/pkg/grpc"
+	"github.com/parca-dev/parca-agent/pkg/hsperfdata"
+	parcahttp "github.com/parca-dev/parca-agent/pkg/http"
+	"github.com/parca-dev/parca-agent/pkg/jvm"
 	"github.com/parca-dev/parca-agent/pkg/kconfig"
 	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/lifecycle"
 	"github.com/parca-dev/parca-agent/pkg/logger"
 	"github.com/parca-dev/parca-agent/pkg/metadata"
 	"github.com/parca-dev/parca-agent/pkg/metadata/labels"
 	"github.com/parca-dev/parca-agent/pkg/namespace"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	"github.com/parca-dev/parca-agent/pkg/perf"
+	parcapprof "github.com/parca-dev/parca-agent/pkg/pprof"
 	"github.com/parca-dev/parca-agent/pkg/process"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
+	"github.com/parca-dev/parca-agent/pkg/profiler/contention"
 	"github.com/parca-dev/parca-agent/pkg/profiler/cpu"
+	"github.com/parca-dev/parca-agent/pkg/profiler/gpu"
+	"github.com/parca-dev/parca-agent/pkg/profiler/netio"
+	"github.com/parca-dev/parca-agent/pkg/profiler/self"
+	"github.com/parca-dev/parca-agent/pkg/profiler/wallclock"
 	"github.com/parca-dev/parca-agent/pkg/symbol"
+	"github.com/parca-dev/parca-agent/pkg/symbol/local"
 	"github.com/parca-dev/parca-agent/pkg/template"
+	"github.com/parca-dev/parca-agent/pkg/tenant"
 	"github.com/parca-dev/parca-agent/pkg/tracer"
 	"github.com/parca-dev/parca-agent/pkg/vdso"
 )
@@ -99,9 +124,35 @@ const (
 	// Setting the CPU sampling frequency too high can impact overall machine performance.
 	maxAdvicedCPUSamplingFrequency = 150
 
+	// Number of the most recent warnings and errors served on /debug/logs.
+	recentLogEntries = 200
+
+	// Number of the most recent lifecycle events kept per process, served on
+	// /debug/events, and of processes they are kept for.
+	lifecycleEventsPerProcess = 32
+	lifecycleProcesses        = 4096
+
+	// Number of the most recently sampled binaries whose symbolization
+	// coverage is reported.
+	symbolizationCoverageBinaries = 256
+	// Number of the most recently failing binaries whose unwinder failures
+	// are reported.
+	unwindFailuresBinaries = 256
+	// Number of binaries whose debug information is kept open to symbolize
+	// their addresses on the agent.
+	localSymbolizerBinaries = 128
+	// Number of the most recent debuginfo uploads reported in dry run mode.
+	debuginfoDryRunUploads = 256
+	// Number of the most recent debuginfo uploads skipped because of their
+	// size that are reported.
+	debuginfoSkippedUploads = 256
+
 	profilerStatusError    = "error"
 	profilerStatusActive   = "active"
 	profilerStatusInactive = "inactive"
+
+	// maxCaptureDuration bounds the duration of the profiles captured on demand.
+	maxCaptureDuration = 5 * time.Minute
 )
 
 type flags struct {
@@ -109,9 +160,24 @@ type flags struct {
 	HTTPAddress string    `kong:"help='Address to bind HTTP server to.',default=':7071'"`
 	Version     bool      `help:"Show application version."`
 
-	Node          string `kong:"help='The name of the node that the process is running on. If on Kubernetes, this must match the Kubernetes node name.',default='${hostname}'"`
-	ConfigPath    string `default:"" help:"Path to config file."`
-	MemlockRlimit uint64 `default:"${default_memlock_rlimit}" help:"The value for the maximum number of bytes of memory that may be locked into RAM. It is used to ensure the agent can lock memory for eBPF maps. 0 means no limit."`
+	Node              string        `kong:"help='The name of the node that the process is running on. If on Kubernetes, this must match the Kubernetes node name.',default='${hostname}'"`
+	ConfigPath        string        `default:"" help:"Path to config file. Send SIGHUP to reload it."`
+	MemlockRlimit     uint64        `default:"${default_memlock_rlimit}" help:"The value for the maximum number of bytes of memory that may be locked into RAM. It is used to ensure the agent can lock memory for eBPF maps. 0 means no limit."`
+	DropCapabilities  bool          `kong:"help='Drop the capabilities the agent does not need on the running kernel at startup. See --print-capabilities.'"`
+	PrintCapabilities bool          `kong:"help='Print the capabilities the agent needs on the running kernel and exit.'"`
+	ShutdownTimeout   time.Duration `kong:"help='The maximum duration to wait on SIGTERM for the last profiles to be sent and the debuginfo uploads in flight to finish. The profiles left are spooled to the write-ahead log, if any.',default='20s'"`
+	BTFPath           string        `kong:"help='Path of a BTF file, or of a directory of <kernel release>.btf files such as the ones of BTFHub, describing the types of the running kernel. Only needed on kernels built without CONFIG_DEBUG_INFO_BTF and without a vmlinux image installed.'"`
+
+	RuntimeUnwinders []string `kong:"help='Runtimes whose interpreted frames are walked by the BPF unwinders, when detected. One or more of: php, nodejs.',default='php,nodejs'"`
+
+	Demangle string `kong:"enum='none,simple,templates,full',default='none',help='Demangle the C++ and Rust symbols resolved on the host, from perf maps, jitdump files, kallsyms and the vDSO. One of: none, simple (without parameters, template parameters and return types), templates (without parameters and return types), full.'"`
+
+	PerfEvent []string `kong:"help='Hardware events to sample on in addition to the CPU clock, as <name>@<period> to take a sample every period occurrences of the event, e.g. instructions@1000000. Each is written as its own profile with the event as sample type. Up to ${max_perf_events} of: ${perf_event_names}.'"`
+
+	IncludeProcessNames []string `kong:"help='Only profile the processes whose command name or command line matches any of these regular expressions. Accepts Go regex syntax (https://pkg.go.dev/regexp/syntax).'"`
+	ExcludeProcessNames []string `kong:"help='Do not profile the processes whose command name or command line matches any of these regular expressions, even if they are included.'"`
+	ProcessOptOutEnv    string   `kong:"help='Do not profile the processes with this environment variable, as NAME=value, the value being compared case-insensitively. Leave this empty to ignore the environment of the processes.',default='PARCA_PROFILING=off'"`
+	ProcessOptOutFile   string   `kong:"help='Do not profile the processes with this file in their root filesystem, e.g. their container. Leave this empty to not look for it.',default='/.parca-no-profiling'"`
 
 	// pprof.
 	MutexProfileFraction int `default:"0" help:"Fraction of mutex profile samples to collect."`
@@ -119,12 +185,16 @@ type flags struct {
 
 	Profiling      FlagsProfiling      `embed:"" prefix:"profiling-"`
 	Metadata       FlagsMetadata       `embed:"" prefix:"metadata-"`
+	Discovery      FlagsDiscovery      `embed:"" prefix:"discovery-"`
 	LocalStore     FlagsLocalStore     `embed:"" prefix:"local-store-"`
 	RemoteStore    FlagsRemoteStore    `embed:"" prefix:"remote-store-"`
 	Debuginfo      FlagsDebuginfo      `embed:"" prefix:"debuginfo-"`
 	Symbolizer     FlagsSymbolizer     `embed:"" prefix:"symbolizer-"`
 	DWARFUnwinding FlagsDWARFUnwinding `embed:"" prefix:"dwarf-unwinding-"`
+	Java           FlagsJava           `embed:"" prefix:"java-"`
+	Dotnet         FlagsDotnet         `embed:"" prefix:"dotnet-"`
 	OTLP           FlagsOTLP           `embed:"" prefix:"otlp-"`
+	Encryption     FlagsEncryption     `embed:"" prefix:"encryption-"`
 
 	Hidden FlagsHidden `embed:"" prefix:"" hidden:""`
 
@@ -146,8 +216,37 @@ type FlagsOTLP struct {
 
 // FlagsProfiling provides profiling configuration flags.
 type FlagsProfiling struct {
-	Duration             time.Duration `kong:"help='The agent profiling duration to use. Leave this empty to use the defaults.',default='10s'"`
-	CPUSamplingFrequency uint64        `kong:"help='The frequency at which profiling data is collected, e.g., 19 samples per second.',default='${default_cpu_sampling_frequency}'"`
+	Duration                time.Duration      `kong:"help='The agent profiling duration to use. Leave this empty to use the defaults.',default='10s'"`
+	CPUSamplingFrequency    uint64             `kong:"help='The frequency at which profiling data is collected, e.g., 19 samples per second.',default='${default_cpu_sampling_frequency}'"`
+	CPUSamplingFrequencyMin uint64             `kong:"help='The lowest frequency the CPU sampling frequency is lowered to while the host is loaded. 0 means sampling at a fixed frequency.',default='0'"`
+	CPULoadHighThreshold    float64            `kong:"help='CPU load of the host in percents, the share of time tasks waited for a CPU when pressure stall information is available or else the CPU utilization, above which the CPU sampling frequency is halved.',default='80'"`
+	CPULoadLowThreshold     float64            `kong:"help='CPU load of the host in percents below which the CPU sampling frequency is doubled back.',default='40'"`
+	CPUBudget               float64            `kong:"help='Share of the CPU time of the host in percents the agent is allowed to use. The processes sampled the most by the CPU and wall-clock profilers are throttled to stay below it. 0 means no budget.',default='0'"`
+	CPUBudgetWeights        map[string]float64 `kong:"help='Weights of the profilers sharing the CPU budget, e.g. cpu=2;wall_clock=1. Only the cpu and wall_clock profilers sample at a rate the budget can lower, the agent has no allocation profiler. Profilers without a weight weigh 1.'"`
+	ContentionEnable        bool               `kong:"help='Enable the lock contention profiler, which records the time threads spend blocked on futexes.'"`
+	ContentionMinWait       time.Duration      `kong:"help='Ignore futex waits shorter than this duration.',default='0s'"`
+	NetworkIOEnable         bool               `kong:"help='Enable the network I/O profiler, which records the bytes transferred and the time spent in socket send and receive syscalls.'"`
+	WallClockEnable         bool               `kong:"help='Enable the wall-clock profiler, which samples the threads of the targets labeled __wall_clock__=true or the pods annotated with parca.dev/wall-clock=true both on and off CPU, at the CPU sampling frequency.'"`
+	SelfEnable              bool               `kong:"help='Profile the CPU and heap usage of the agent itself, and write the profiles labeled job=parca-agent-self along with the other ones.'"`
+	SelfInterval            time.Duration      `kong:"help='The interval to profile the agent itself at. Its CPU is profiled for the profiling duration.',default='1m'"`
+	GPUSocketPath           string             `kong:"help='Path of the unix socket to receive GPU kernel activity records on, e.g. from a CUPTI or ROCm tracer. Leave this empty to disable the GPU profiler.'"`
+	GoroutineLabels         bool               `kong:"help='Label the CPU samples of Go programs built with Go 1.17 to 1.22 with the ID, state and wait reason of the goroutine they were taken in.'"`
+	TraceContextLabels      bool               `kong:"help='Label the CPU samples of instrumented programs that publish the trace context of their threads in the otel_thread_ctx_v1 thread local variable with the trace and span IDs they were taken in.'"`
+	CPULabels               bool               `kong:"help='Label the CPU samples with the CPU and NUMA node they were taken on.'"`
+	NUMANodeLabels          bool               `kong:"help='Label the CPU samples with the NUMA node they were taken on, without the CPU, which keeps fewer distinct samples.'"`
+	SampleTimestamps        bool               `kong:"help='Record the time of the CPU samples, up to 64 per stack and thread in every profiling round, as their timestamp numeric label, for timeline views.'"`
+	CgroupFilter            bool               `kong:"help='Only take CPU samples in the BPF program from the cgroups of the processes kept by relabeling, which lowers the overhead on dense hosts. Processes dropped by relabeling can not be profiled on demand then. Requires cgroup2.'"`
+	SkipUnsymbolizable      bool               `kong:"help='Do not take CPU samples of the processes none of whose executable mappings has a build ID or unwind information and that have no perf map, as their profiles can not be symbolized.'"`
+	TrackProcesses          bool               `kong:"help='Fetch the information of the processes and build their unwind tables as soon as they exec, rather than once they are first sampled, so that short-lived processes are unwound and symbolized, and forget them as soon as they exit.'"`
+	TrackLibraries          bool               `kong:"help='Attach uprobes to dlopen and dlmopen in the C libraries of the processes discovered, so that the shared libraries they load get their unwind tables built and their debug information uploaded as soon as they are loaded, rather than once their mappings are read again.'"`
+	AggregateByExecutable   bool               `kong:"help='Write the CPU profiles of the processes running the same executable with the same labels other than their PID, which include their cgroup by default, as a single profile without the pid and ppid labels, for workloads spawning many identical short-lived processes.'"`
+	RollupIntervals         int                `kong:"help='Merge the profiles of every series written in this many successive profiling intervals into a single profile before writing it, which lowers the number of writes at the cost of time resolution. 1 means writing the profile of every interval.',default='1'"`
+	MaxStackDepth           uint32             `kong:"help='Number of frames the user stacks of the CPU samples are walked up to, at most 255. Deeper stacks are cut and get a [truncated] root frame. Raise it for deeply recursive workloads; the stack traces maps hold proportionally fewer stacks to use the same memory.',default='127'"`
+	TimeBuckets             int                `kong:"help='Number of time buckets every profiling round is cut into, each written as its own CPU profile with its own time and duration, e.g. 10 for 1s profiles with a 10s profiling duration. This gives a finer time resolution without sampling more. The profiles of processes merged with --profiling-aggregate-by-executable are not cut.',default='1'"`
+	ConversionWorkers       int                `kong:"help='Number of CPU profiles converted to pprof and written at once, so that the profiles of many processes are written well within a profiling round on large hosts.',default='4'"`
+	ConversionTimeout       time.Duration      `kong:"help='Time budget of the conversion and writing of every CPU profile, past which it is dropped. Leave this to zero for no budget.',default='0s'"`
+	EventsBuffer            string             `kong:"enum='auto,ringbuf,perf',default='auto',help='Buffer the BPF program sends its events through. The ring buffer, shared by all CPUs, requires Linux 5.8 or later; auto uses it when available and falls back to the per-CPU perf buffers otherwise.'"`
+	EventsBufferPages       int                `kong:"help='Size of the events buffer in memory pages per CPU. Raise it if events are lost at high sampling frequencies.',default='64'"`
 }
 
 // FlagsMetadata provides metadadata configuration flags.
@@ -155,44 +254,102 @@ type FlagsMetadata struct {
 	ExternalLabels             map[string]string `kong:"help='Label(s) to attach to all profiles.'"`
 	ContainerRuntimeSocketPath string            `kong:"help='The filesystem path to the container runtimes socket. Leave this empty to use the defaults.'"`
 	DisableCaching             bool              `kong:"help='Disable caching of metadata.',default='false'"`
+	Kubernetes                 bool              `kong:"help='Label profiles with the metadata of the pods of the node, watched through the Kubernetes API: their namespace, name, container, labels and the workload controlling them.'"`
+	KubernetesAnnotations      []string          `kong:"help='Pod annotations to attach as labels prefixed with annotation_, when Kubernetes metadata is enabled.'"`
+	Systemd                    bool              `kong:"help='Label profiles with the systemd unit and slice of their process, as told by its cgroup or else the systemd D-Bus API.'"`
+}
+
+// FlagsDiscovery provides process discovery configuration flags.
+type FlagsDiscovery struct {
+	Sources  []string      `kong:"help='Process discovery mechanisms to run. One or more of: kubernetes, systemd, procfs, docker, containerd.',default='kubernetes,systemd'"`
+	Interval time.Duration `kong:"help='The interval to scan for targets, for the discovery mechanisms that poll.',default='5s'"`
 }
 
 // FlagsLocalStore provides local store configuration flags.
 type FlagsLocalStore struct {
-	Directory string `kong:"help='The local directory to store the profiling data.'"`
+	Directory string        `kong:"help='The local directory to store the profiling data.'"`
+	Retention time.Duration `kong:"help='How long to keep the profiles in the local directory. Leave this empty to keep them forever.'"`
 }
 
 // FlagsRemoteStore provides remote store configuration flags.
 type FlagsRemoteStore struct {
 	Address                string        `kong:"help='gRPC address to send profiles and symbols to.'"`
 	BearerToken            string        `kong:"help='Bearer token to authenticate with store.'"`
-	BearerTokenFile        string        `kong:"help='File to read bearer token from to authenticate with store.'"`
+	BearerTokenFile        string        `kong:"help='File to read bearer token from to authenticate with store, e.g. an OIDC service account token or a SPIFFE JWT-SVID. It is read again when it changes.'"`
 	Insecure               bool          `kong:"help='Send gRPC requests via plaintext instead of TLS.'"`
 	InsecureSkipVerify     bool          `kong:"help='Skip TLS certificate verification.'"`
+	TLSCAFile              string        `kong:"name='tls-ca-file',help='CA certificate file to verify the store with, instead of the system ones. It is read again when it changes.'"`
+	TLSCertFile            string        `kong:"help='Client certificate file to authenticate with store using mutual TLS. It is read again when it changes.'"`
+	TLSKeyFile             string        `kong:"help='Client key file to authenticate with store using mutual TLS. It is read again when it changes.'"`
+	TLSServerName          string        `kong:"help='Server name to verify the certificate of the store against, instead of the host of the address.'"`
 	DebuginfoUploadDisable bool          `kong:"help='Disable debuginfo collection and upload.',default='false'"`
 	BatchWriteInterval     time.Duration `kong:"help='Interval between batch remote client writes. Leave this empty to use the default value of 10s.',default='10s'"`
+	WALDirectory           string        `kong:"help='The local directory to spool profiles to while the store is unreachable, they are sent once it is reachable again. Leave this empty to drop them.'"`
+	WALMaxSizeMB           int64         `kong:"help='The maximum size in megabytes of the spooled profiles, the oldest ones are dropped once it is exceeded.',default='256'"`
+	BatchCompression       bool          `kong:"help='Compress batched requests as a whole instead of every profile on its own, so the mappings and strings shared by the profiles of different processes are sent once. The store has to accept gzip compressed gRPC requests.'"`
+	TenantHeader           string        `kong:"help='Header to send the tenant of the profiles and debuginfo in, set by the __tenant__ label or the parca.dev/tenant pod annotation. Leave this empty to not send tenants.',default='X-Scope-OrgID'"`
+	MaxLabels              int           `kong:"help='The maximum number of labels of a profile series, series with more are aggregated into a series of their profile type with the overflow=\"other\" label. 0 means no limit.',default='64'"`
+	MaxLabelNameLength     int           `kong:"help='The maximum length of the label names of a profile series, series with longer ones are aggregated like the ones with too many labels. 0 means no limit.',default='128'"`
+	MaxLabelValueLength    int           `kong:"help='The maximum length of the label values of a profile series, series with longer ones are aggregated like the ones with too many labels. 0 means no limit.',default='2048'"`
+	MaxSeries              int           `kong:"help='The maximum number of profile series of a profile type written within an hour, further series are aggregated like the ones with too many labels. 0 means no limit.',default='10000'"`
 }
 
 // FlagsDebuginfo contains flags to configure debuginfo.
 type FlagsDebuginfo struct {
-	Directories           []string      `kong:"help='Ordered list of local directories to search for debuginfo files.',default='/usr/lib/debug'"`
+	Directories           []string      `kong:"help='Ordered list of local directories to search for debuginfo files. Each can be followed by options separated by colons: recursive, to also search its subdirectories, layout=all|buildid|debuglink, to only look files up by build ID or by debug link, and priority=N, to search the directories of higher priority first. The paths can be glob patterns, e.g. /nix/store/*-debug/lib/debug:layout=buildid.',default='/usr/lib/debug'"`
 	TempDir               string        `kong:"help='The local directory path to store the interim debuginfo files.',default='/tmp'"`
 	Strip                 bool          `kong:"help='Only upload information needed for symbolization. If false the exact binary the agent sees will be uploaded unmodified.',default='true'"`
 	UploadMaxParallel     int           `kong:"help='The maximum number of debuginfo upload requests to make in parallel.',default='25'"`
 	UploadTimeoutDuration time.Duration `kong:"help='The timeout duration to cancel upload requests.',default='2m'"`
 	UploadCacheDuration   time.Duration `kong:"help='The duration to cache debuginfo upload responses for.',default='5m'"`
+	UploadProxyURL        string        `kong:"help='Proxy to upload debuginfo to signed URLs through. Leave this empty to use the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.'"`
+	UploadCAFile          string        `kong:"help='CA certificates to trust, in addition to the system ones, when uploading debuginfo to signed URLs.'"`
+	UploadDialTimeout     time.Duration `kong:"help='The timeout to connect to signed URLs to upload debuginfo to.',default='30s'"`
+	UploadResponseTimeout time.Duration `kong:"help='The timeout to wait for the response of a signed URL once the debuginfo is uploaded.',default='1m'"`
 	DisableCaching        bool          `kong:"help='Disable caching of debuginfo.',default='false'"`
+	UploadBreakerFailures int           `kong:"help='The number of consecutive failures to reach the server after which the debuginfo uploads are paused. 0 never pauses them.',default='5'"`
+	UploadBreakerCooldown time.Duration `kong:"help='The duration to pause the debuginfo uploads for before checking again whether the server is back.',default='30s'"`
+	UploadMaxFileSizeMB   int64         `kong:"help='The maximum size in megabytes of a debuginfo file uploaded, larger ones are skipped and reported on /debug/debuginfo-skipped. 0 means no limit.',default='0'"`
+	UploadBudgetMBPerHour int64         `kong:"help='The maximum number of megabytes of debuginfo uploaded within an hour, further files are skipped until the budget frees up and reported on /debug/debuginfo-skipped. 0 means no limit.',default='0'"`
+	UploadDryRun          bool          `kong:"help='Find, extract and hash the debuginfo files but only log and report on /debug/debuginfo-uploads the ones that would be uploaded, without sending any data.',default='false'"`
 }
 
 // FlagsSymbolizer contains flags to configure symbolization.
 type FlagsSymbolizer struct {
-	JITDisable bool `kong:"help='Disable JIT symbolization.'"`
+	JITDisable    bool   `kong:"help='Disable JIT symbolization.'"`
+	Local         bool   `kong:"help='Symbolize the addresses of the native binaries on the agent, with their DWARF debug information, Go symbol table or symbol tables, so that the profiles are fully symbolized for the remote stores that do not symbolize them. The separate debuginfo files are looked up in the debuginfo directories.'"`
+	UnknownFrames string `kong:"enum='drop,address,placeholder',default='address',help='What becomes of the frames whose address is outside of the mappings of the process or can not be symbolized. One of: drop, which shortens the stacks, address, which keeps their raw address, placeholder, which replaces them with an [unknown <mapping>] function.'"`
 }
 
 // FlagsDWARFUnwinding contains flags to configure DWARF unwinding.
 type FlagsDWARFUnwinding struct {
-	Disable bool `kong:"help='Do not unwind using .eh_frame information.'"`
-	Mixed   bool `kong:"help='Unwind using .eh_frame information and frame pointers'"`
+	Disable        bool   `kong:"help='Do not unwind using .eh_frame information.'"`
+	Mixed          bool   `kong:"help='Unwind using .eh_frame information and frame pointers'"`
+	LBRFallback    bool   `kong:"help='Take the user stacks that can be walked neither with frame pointers nor with .eh_frame information from the Last Branch Record call stack of the CPU. Requires an Intel CPU from Haswell on, and samples the CPU cycles rather than the CPU clock.'"`
+	TableCacheDir  string `kong:"help='The local directory to persist generated unwind tables to. Leave this empty to disable the disk cache.'"`
+	TableServerURL string `kong:"help='The URL of an HTTP server to fetch precomputed unwind tables from, such as a static file server of the table cache directory of another agent. Tables it does not have are generated locally.'"`
+}
+
+// FlagsJava contains flags to configure the integration with JVMs.
+type FlagsJava struct {
+	PerfMapEnable          bool          `kong:"help='Attach to running JVMs to make them write perf maps of their JIT compiled code. JVMs need -XX:+PreserveFramePointer for complete stacks.'"`
+	PerfMapInterval        time.Duration `kong:"help='The interval to look for new JVMs.',default='30s'"`
+	PerfMapRefreshInterval time.Duration `kong:"help='The interval to make the JVMs write their perf maps again when no agent is configured, to include the code compiled since.',default='5m'"`
+	PerfMapAgentPath       string        `kong:"help='Path of a JVMTI agent, e.g. perf-map-agent, to load into the JVMs instead of using the Compiler.perfmap command of JDK 17+. It has to be accessible from the mount namespace of the JVMs.'"`
+	PerfMapAgentOptions    string        `kong:"help='Options to pass to the JVMTI agent.'"`
+}
+
+// FlagsDotnet contains flags to configure the integration with .NET runtimes.
+type FlagsDotnet struct {
+	PerfMapEnable   bool          `kong:"help='Enable the perf maps of running .NET processes through their diagnostic server. Requires .NET 8 or later, older runtimes need to be started with DOTNET_PerfMapEnabled=1.'"`
+	PerfMapInterval time.Duration `kong:"help='The interval to look for new .NET processes.',default='30s'"`
+}
+
+// FlagsEncryption contains flags to configure the encryption of the data
+// written to disk.
+type FlagsEncryption struct {
+	KeyFile          string `kong:"help='Path of the AES key, 16, 24 or 32 bytes long, raw or base64 encoded, to encrypt the profiles spooled to the write-ahead log and the debuginfo extracted to the temporary directory with AES-GCM. Leave this empty to write them unencrypted.'"`
+	KeyUnwrapCommand string `kong:"help='Shell command decrypting the key file, when it holds a data key encrypted by a key management service. It is given the contents of the key file on its standard input and must print the key on its standard output, e.g. aws kms decrypt --ciphertext-blob fileb:///dev/stdin --query Plaintext --output text.'"`
 }
 
 // FlagsHidden contains hidden flags. Hidden debug flags (only for debugging).
@@ -213,6 +370,28 @@ type Profiler interface {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == flameCommand {
+		if err := runFlame(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == doctorCommand {
+		if err := runDoctor(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == bundleCommand {
+		if err := runBundle(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Fetch build info such as the git revision we are based off
 	buildInfo, err := buildinfo.FetchBuildInfo()
 	if err != nil {
@@ -237,6 +416,8 @@ func main() {
 		"hostname":                       hostname,
 		"default_memlock_rlimit":         "0", // No limit by default.
 		"default_cpu_sampling_frequency": strconv.Itoa(defaultCPUSamplingFrequency),
+		"max_perf_events":                strconv.Itoa(cpu.MaxPerfEvents),
+		"perf_event_names":               strings.Join(profiler.PerfEventNames(), ", "),
 	})
 
 	if flags.Version {
@@ -244,7 +425,19 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := logger.NewLogger(flags.Log.Level, flags.Log.Format, "parca-agent")
+	if flags.PrintCapabilities {
+		kernelVersion, err := kconfig.KernelVersion()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to get the kernel version:", err)
+			os.Exit(1)
+		}
+		for _, c := range capability.Needed(kernelVersion) {
+			fmt.Println(c) //nolint:forbidigo
+		}
+		os.Exit(0)
+	}
+
+	logger, logRecorder := logger.NewRecordingLogger(flags.Log.Level, flags.Log.Format, "parca-agent", recentLogEntries)
 	level.Debug(logger).Log("msg", "parca-agent initialized",
 		"version", version,
 		"commit", commit,
@@ -253,6 +446,21 @@ func main() {
 		"arch", goArch,
 	)
 
+	if flags.DropCapabilities {
+		kernelVersion, err := kconfig.KernelVersion()
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to get the kernel version", "err", err)
+			os.Exit(1)
+		}
+		// Re-executes the agent unless it already runs with the needed
+		// capabilities only.
+		if err := capability.Reduce(capability.Needed(kernelVersion)); err != nil {
+			level.Error(logger).Log("msg", "failed to drop capabilities", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "dropped the capabilities not needed by the agent")
+	}
+
 	if flags.Node == "" && hostnameErr != nil {
 		level.Error(logger).Log("msg", "failed to get hostname. Please set it with the --node flag", "err", hostnameErr)
 		os.Exit(1)
@@ -313,12 +521,12 @@ func main() {
 	runtime.SetBlockProfileRate(flags.BlockProfileRate)
 	runtime.SetMutexProfileFraction(flags.MutexProfileFraction)
 
-	if err := run(logger, reg, flags); err != nil {
+	if err := run(logger, logRecorder, reg, flags); err != nil {
 		level.Error(logger).Log("err", err)
 	}
 }
 
-func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
+func run(logger log.Logger, logRecorder *logger.Recorder, reg *prometheus.Registry, flags flags) error {
 	var (
 		ctx = context.Background()
 
@@ -374,58 +582,96 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		level.Info(logger).Log("msg", "eBPF is supported and enabled by the host kernel")
 	}
 
-	profileStoreClient := agent.NewNoopProfileStoreClient()
-	var debuginfoClient debuginfopb.DebuginfoServiceClient = debuginfo.NewNoopClient()
+	btf, err := kconfig.FindBTF(flags.BTFPath)
+	if err != nil {
+		return fmt.Errorf("%w. %s", err, btfRemediation)
+	}
+	level.Info(logger).Log("msg", "reading kernel types", "path", btf.Source)
 
+	var cipher *encryption.Cipher
+	if flags.Encryption.KeyFile != "" {
+		key, err := encryption.LoadKey(flags.Encryption.KeyFile, flags.Encryption.KeyUnwrapCommand)
+		if err != nil {
+			return fmt.Errorf("failed to load encryption key: %w", err)
+		}
+		cipher, err = encryption.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		level.Info(logger).Log("msg", "spooled profiles and extracted debuginfo are encrypted")
+	}
+
+	remoteWriteConfigs := cfg.RemoteWrite
 	if len(flags.RemoteStore.Address) > 0 {
+		remoteWriteConfigs = append([]*config.RemoteWriteConfig{remoteStoreConfig(flags.RemoteStore)}, remoteWriteConfigs...)
+		if err := (&config.Config{RemoteWrite: remoteWriteConfigs}).Validate(); err != nil {
+			return fmt.Errorf("invalid remote write config: %w", err)
+		}
+	}
+
+	var (
+		debuginfoClient      debuginfopb.DebuginfoServiceClient = debuginfo.NewNoopClient()
+		batchWriteClients    []*agent.BatchWriteClient
+		remoteWriteEndpoints []*agent.RemoteWriteEndpoint
+	)
+	if len(remoteWriteConfigs) > 0 {
 		encoding.RegisterCodec(vtproto.Codec{})
+	}
+	for i, rwCfg := range remoteWriteConfigs {
+		logger := log.With(logger, "remote_name", rwCfg.Name)
+		reg := prometheus.WrapRegistererWith(prometheus.Labels{"remote_name": rwCfg.Name}, reg)
 
-		var opts []grpc.DialOption
-		if flags.RemoteStore.Insecure {
-			opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		} else {
-			config := &tls.Config{
-				//nolint:gosec
-				InsecureSkipVerify: flags.RemoteStore.InsecureSkipVerify,
-			}
-			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+		conn, err := remoteWriteConn(logger, reg, tp, rwCfg)
+		if err != nil {
+			return fmt.Errorf("failed to connect to remote write endpoint %q: %w", rwCfg.Name, err)
 		}
+		defer conn.Close()
 
-		if flags.RemoteStore.BearerToken != "" {
-			opts = append(opts, grpc.WithPerRPCCredentials(
-				parcagrpc.NewPerRequestBearerToken(flags.RemoteStore.BearerToken, flags.RemoteStore.Insecure)),
-			)
+		// Debug information is only uploaded to the store given by the flags.
+		if i == 0 && len(flags.RemoteStore.Address) > 0 {
+			if !flags.RemoteStore.DebuginfoUploadDisable {
+				debuginfoClient = debuginfopb.NewDebuginfoServiceClient(conn)
+			} else {
+				level.Info(logger).Log("msg", "debug information collection is disabled")
+			}
 		}
 
-		if flags.RemoteStore.BearerTokenFile != "" {
-			b, err := os.ReadFile(flags.RemoteStore.BearerTokenFile)
+		var wal *agent.WAL
+		if rwCfg.WALDirectory != "" {
+			wal, err = agent.NewWAL(log.With(logger, "component", "remote_write_wal"), reg, rwCfg.WALDirectory, flags.RemoteStore.WALMaxSizeMB*1024*1024, cipher)
 			if err != nil {
-				return fmt.Errorf("failed to read bearer token from file: %w", err)
+				return fmt.Errorf("failed to open write-ahead log: %w", err)
 			}
-			opts = append(opts, grpc.WithPerRPCCredentials(
-				parcagrpc.NewPerRequestBearerToken(strings.TrimSpace(string(b)), flags.RemoteStore.Insecure)),
-			)
+			defer wal.Close()
+			level.Info(logger).Log("msg", "profiles are spooled to disk while the store is unreachable", "dir", rwCfg.WALDirectory)
 		}
 
-		conn, err := parcagrpc.Conn(logger, reg, tp, flags.RemoteStore.Address, opts...)
-		if err != nil {
-			return err
-		}
-		defer conn.Close()
+		batchWriteClient := agent.NewBatchWriteClient(logger, reg, tp.Tracer("batch_write_client"), profilestorepb.NewProfileStoreServiceClient(conn), time.Duration(rwCfg.BatchWriteInterval), flags.Hidden.DebugNormalizeAddresses, wal, flags.RemoteStore.BatchCompression)
+		batchWriteClients = append(batchWriteClients, batchWriteClient)
+		remoteWriteEndpoints = append(remoteWriteEndpoints, agent.NewRemoteWriteEndpoint(rwCfg.Name, batchWriteClient, rwCfg.WriteRelabelConfigs))
+	}
 
-		profileStoreClient = profilestorepb.NewProfileStoreServiceClient(conn)
-		if !flags.RemoteStore.DebuginfoUploadDisable {
-			debuginfoClient = debuginfopb.NewDebuginfoServiceClient(conn)
-		} else {
-			level.Info(logger).Log("msg", "debug information collection is disabled")
-		}
+	// On shutdown the profilers are stopped first, the last profiles they
+	// write are then sent by the profile writers, and the debuginfo uploads
+	// in flight drained, within a single deadline.
+	var (
+		profilersStopped sync.WaitGroup
+		rollupStopped    sync.WaitGroup
+		shutdownOnce     sync.Once
+		shutdownDeadline time.Time
+	)
+	startShutdown := func() time.Time {
+		shutdownOnce.Do(func() {
+			shutdownDeadline = time.Now().Add(flags.ShutdownTimeout)
+		})
+		return shutdownDeadline
 	}
 
 	var (
 		g                   okrun.Group
-		batchWriteClient    = agent.NewBatchWriteClient(logger, reg, profileStoreClient, flags.RemoteStore.BatchWriteInterval, flags.Hidden.DebugNormalizeAddresses)
+		fanOutWriteClient   = agent.NewFanOutWriteClient(logger, remoteWriteEndpoints)
 		localStorageEnabled = flags.LocalStore.Directory != ""
-		profileListener     = agent.NewMatchingProfileListener(logger, batchWriteClient)
+		profileListener     = agent.NewMatchingProfileListener(logger, fanOutWriteClient)
 		profileWriter       profiler.ProfileWriter
 	)
 
@@ -458,22 +704,54 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 	}
 
 	if localStorageEnabled {
-		profileWriter = profiler.NewFileProfileWriter(flags.LocalStore.Directory)
-		level.Info(logger).Log("msg", "local profile storage is enabled", "dir", flags.LocalStore.Directory)
+		fileProfileWriter := profiler.NewFileProfileWriter(log.With(logger, "component", "local_profile_writer"), flags.LocalStore.Directory, flags.LocalStore.Retention)
+		profileWriter = fileProfileWriter
+		level.Info(logger).Log("msg", "local profile storage is enabled", "dir", flags.LocalStore.Directory, "retention", flags.LocalStore.Retention)
+
+		// Run group of local profile cleanup.
+		{
+			logger := log.With(logger, "group", "local_profile_writer")
+			ctx, cancel := context.WithCancel(ctx)
+			g.Add(func() error {
+				level.Debug(logger).Log("msg", "starting")
+				defer level.Debug(logger).Log("msg", "stopped")
+
+				var err error
+				runtimepprof.Do(ctx, runtimepprof.Labels("component", "local_profile_writer"), func(ctx context.Context) {
+					err = fileProfileWriter.Run(ctx)
+				})
+
+				return err
+			}, func(error) {
+				level.Debug(logger).Log("msg", "cleaning up")
+				defer level.Debug(logger).Log("msg", "cleanup finished")
+				cancel()
+			})
+		}
 	} else {
 		// TODO(kakkoyun): Writer can handle normalization by the help address normalizer.
-		profileWriter = profiler.NewRemoteProfileWriter(logger, profileListener, flags.Hidden.DebugNormalizeAddresses)
+		// The label limits are enforced before the profiles are matched,
+		// so the ones shown are the ones sent.
+		limitingWriteClient := agent.NewLimitingWriteClient(log.With(logger, "component", "limiting_write_client"), reg, profileListener, agent.LabelLimits{
+			MaxLabels:           flags.RemoteStore.MaxLabels,
+			MaxLabelNameLength:  flags.RemoteStore.MaxLabelNameLength,
+			MaxLabelValueLength: flags.RemoteStore.MaxLabelValueLength,
+			MaxSeries:           flags.RemoteStore.MaxSeries,
+		})
+		profileWriter = profiler.NewRemoteProfileWriter(logger, limitingWriteClient, flags.Hidden.DebugNormalizeAddresses, flags.RemoteStore.BatchCompression)
 
-		// Run group of profile writer.
-		{
-			logger := log.With(logger, "group", "profile_writer")
+		// Run group of profile writer, one per remote write endpoint.
+		for i, batchWriteClient := range batchWriteClients {
+			name := remoteWriteEndpoints[i].Name
+			batchWriteClient := batchWriteClient
+			logger := log.With(logger, "group", "profile_writer", "remote_name", name)
 			ctx, cancel := context.WithCancel(ctx)
 			g.Add(func() error {
 				level.Debug(logger).Log("msg", "starting")
 				defer level.Debug(logger).Log("msg", "stopped")
 
 				var err error
-				runtimepprof.Do(ctx, runtimepprof.Labels("component", "remote_profile_writer"), func(ctx context.Context) {
+				runtimepprof.Do(ctx, runtimepprof.Labels("component", "remote_profile_writer", "remote_name", name), func(ctx context.Context) {
 					err = batchWriteClient.Run(ctx)
 				})
 
@@ -481,7 +759,73 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 			}, func(error) {
 				level.Debug(logger).Log("msg", "cleaning up")
 				defer level.Debug(logger).Log("msg", "cleanup finished")
-				cancel()
+
+				// The interrupts are called one after the other, the
+				// profilers are waited for in the background.
+				deadline := startShutdown()
+				go func() {
+					defer cancel()
+
+					stopped := make(chan struct{})
+					go func() {
+						profilersStopped.Wait()
+						rollupStopped.Wait()
+						close(stopped)
+					}()
+					select {
+					case <-stopped:
+					case <-time.After(time.Until(deadline)):
+						level.Warn(logger).Log("msg", "profilers did not stop in time, sending the profiles written so far")
+					}
+				}()
+			})
+		}
+	}
+
+	if flags.Profiling.RollupIntervals < 1 {
+		return fmt.Errorf("the number of roll-up intervals must be at least 1, got %d", flags.Profiling.RollupIntervals)
+	}
+	if flags.Profiling.RollupIntervals > 1 {
+		rollupWriter := profiler.NewRollupProfileWriter(log.With(logger, "component", "rollup_profile_writer"), reg, profileWriter, flags.Profiling.RollupIntervals, flags.Profiling.Duration)
+		profileWriter = rollupWriter
+		level.Info(logger).Log("msg", "profiles are rolled up before they are written", "intervals", flags.Profiling.RollupIntervals)
+
+		// Run group of the profile roll-up.
+		{
+			logger := log.With(logger, "group", "rollup_profile_writer")
+			ctx, cancel := context.WithCancel(ctx)
+			rollupStopped.Add(1)
+			g.Add(func() error {
+				defer rollupStopped.Done()
+				level.Debug(logger).Log("msg", "starting")
+				defer level.Debug(logger).Log("msg", "stopped")
+
+				var err error
+				runtimepprof.Do(ctx, runtimepprof.Labels("component", "rollup_profile_writer"), func(ctx context.Context) {
+					err = rollupWriter.Run(ctx)
+				})
+
+				return err
+			}, func(error) {
+				level.Debug(logger).Log("msg", "cleaning up")
+				defer level.Debug(logger).Log("msg", "cleanup finished")
+
+				// The profiles rolled up so far are written once the
+				// profilers wrote their last ones.
+				deadline := startShutdown()
+				go func() {
+					defer cancel()
+
+					stopped := make(chan struct{})
+					go func() {
+						profilersStopped.Wait()
+						close(stopped)
+					}()
+					select {
+					case <-stopped:
+					case <-time.After(time.Until(deadline)):
+					}
+				}()
 			})
 		}
 	}
@@ -515,12 +859,10 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 	var discoveryManager *discovery.Manager
 	{
 		ctx, cancel := context.WithCancel(ctx)
-		configs := discovery.Configs{
-			discovery.NewPodConfig(
-				flags.Node,
-				flags.Metadata.ContainerRuntimeSocketPath,
-			),
-			discovery.NewSystemdConfig(),
+		configs, err := discoveryConfigs(flags)
+		if err != nil {
+			cancel()
+			return err
 		}
 		discoveryManager = discovery.NewManager(logger, reg)
 		if err := discoveryManager.ApplyConfig(ctx, map[string]discovery.Configs{"all": configs}); err != nil {
@@ -568,16 +910,29 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		})
 	}
 
-	// Run group for metadata discovery.
-	discoveryMetadata := metadata.ServiceDiscovery(logger, discoveryManager.SyncCh(), psTree)
+	rootFS := process.NewRootFS(logger, reg, procfs.DefaultMountPoint, flags.Profiling.Duration)
+	processFilter, err := process.NewNameFilter(
+		pfs,
+		rootFS,
+		flags.IncludeProcessNames,
+		flags.ExcludeProcessNames,
+		process.OptOut{Env: flags.ProcessOptOutEnv, File: flags.ProcessOptOutFile},
+	)
+	if err != nil {
+		return fmt.Errorf("invalid process name filter: %w", err)
+	}
+
+	// Run group for the discovered targets store.
+	targetStore := discovery.NewStore(log.With(logger, "component", "discovery_store"), processFilter)
+	discoveryMetadata := metadata.ServiceDiscovery(targetStore, psTree)
 	{
-		logger := log.With(logger, "group", "metadata_discovery")
+		logger := log.With(logger, "group", "discovery_store")
 		ctx, cancel := context.WithCancel(ctx)
 		g.Add(func() error {
 			level.Debug(logger).Log("msg", "starting")
 			defer level.Debug(logger).Log("msg", "stopped")
 
-			return discoveryMetadata.Run(ctx)
+			return targetStore.Run(ctx, discoveryManager.SyncCh())
 		}, func(error) {
 			level.Debug(logger).Log("msg", "cleaning up")
 			defer level.Debug(logger).Log("msg", "cleanup finished")
@@ -590,83 +945,528 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 
 	nsCache := namespace.NewCache(logger, reg, flags.Profiling.Duration)
 
+	providers := []metadata.Provider{
+		discoveryMetadata,
+		metadata.Target(flags.Node, flags.Metadata.ExternalLabels),
+		metadata.Compiler(logger, reg, ofp),
+		metadata.Process(pfs),
+		metadata.JavaProcess(logger, nsCache),
+		metadata.DotnetProcess(nsCache),
+		metadata.System(),
+		metadata.PodHosts(),
+		metadata.ECS(logger, reg, pfs),
+		metadata.Nomad(pfs),
+	}
+	if flags.Metadata.Kubernetes {
+		clientset, err := kubernetes.NewClientset()
+		if err != nil {
+			return fmt.Errorf("failed to create kubernetes clientset: %w", err)
+		}
+		podIndex := kubernetes.NewPodIndex(log.With(logger, "component", "pod_index"), flags.Node, clientset)
+		providers = append(providers, metadata.Kubernetes(logger, reg, pfs, podIndex, flags.Metadata.KubernetesAnnotations, flags.Profiling.Duration))
+
+		logger := log.With(logger, "group", "pod_index")
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting")
+			defer level.Debug(logger).Log("msg", "stopped")
+
+			return podIndex.Run(ctx)
+		}, func(error) {
+			level.Debug(logger).Log("msg", "cleaning up")
+			defer level.Debug(logger).Log("msg", "cleanup finished")
+			cancel()
+		})
+	}
+
+	if flags.Metadata.Systemd {
+		systemdMetadata := metadata.Systemd(log.With(logger, "component", "systemd_metadata"), pfs)
+		providers = append(providers, systemdMetadata)
+
+		logger := log.With(logger, "group", "systemd_metadata")
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting")
+			defer level.Debug(logger).Log("msg", "stopped")
+
+			return systemdMetadata.Run(ctx)
+		}, func(error) {
+			level.Debug(logger).Log("msg", "cleaning up")
+			defer level.Debug(logger).Log("msg", "cleanup finished")
+			cancel()
+		})
+	}
+
 	labelsManager := labels.NewManager(
 		log.With(logger, "component", "labels_manager"),
 		tp.Tracer("labels_manager"),
 		reg,
 		// All the metadata providers work best-effort.
-		[]metadata.Provider{
-			discoveryMetadata,
-			metadata.Target(flags.Node, flags.Metadata.ExternalLabels),
-			metadata.Compiler(logger, reg, ofp),
-			metadata.Process(pfs),
-			metadata.JavaProcess(logger, nsCache),
-			metadata.System(),
-			metadata.PodHosts(),
-		},
+		providers,
 		cfg.RelabelConfigs,
+		processFilter,
 		flags.Metadata.DisableCaching,
 		flags.Profiling.Duration, // Cache durations are calculated from profiling duration.
 	)
 
 	var vdsoResolver symbol.VDSOResolver
-	vdsoResolver, err = vdso.NewCache(reg, ofp)
+	vdsoResolver, err = vdso.NewCache(log.With(logger, "component", "vdso"), reg, ofp)
 	if err != nil {
 		vdsoResolver = vdso.NoopCache{}
 		level.Warn(logger).Log("msg", "failed to initialize vdso cache", "err", err)
 	}
 
-	var dbginfo process.DebuginfoManager
+	debugDirs, err := debuginfo.ParseDebugDirs(flags.Debuginfo.Directories)
+	if err != nil {
+		return err
+	}
+
+	var (
+		dbginfo         process.DebuginfoManager
+		debuginfoDryRun *debuginfo.DryRunLog
+		debuginfoBudget *debuginfo.UploadBudget
+	)
 	if !flags.RemoteStore.DebuginfoUploadDisable {
+		uploadTransport, err := parcahttp.NewTransport(parcahttp.TransportConfig{
+			ProxyURL:              flags.Debuginfo.UploadProxyURL,
+			CAFile:                flags.Debuginfo.UploadCAFile,
+			DialTimeout:           flags.Debuginfo.UploadDialTimeout,
+			ResponseHeaderTimeout: flags.Debuginfo.UploadResponseTimeout,
+			MaxIdleConnsPerHost:   flags.Debuginfo.UploadMaxParallel,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create debuginfo upload transport: %w", err)
+		}
+		if flags.Debuginfo.UploadBreakerFailures > 0 {
+			debuginfoClient = debuginfo.NewCircuitBreakerClient(
+				log.With(logger, "component", "debuginfo"),
+				reg,
+				debuginfoClient,
+				flags.Debuginfo.UploadBreakerFailures,
+				flags.Debuginfo.UploadBreakerCooldown,
+			)
+		}
+		if flags.Debuginfo.UploadDryRun {
+			debuginfoDryRun = debuginfo.NewDryRunLog(debuginfoDryRunUploads)
+		}
+		if flags.Debuginfo.UploadMaxFileSizeMB > 0 || flags.Debuginfo.UploadBudgetMBPerHour > 0 {
+			debuginfoBudget = debuginfo.NewUploadBudget(
+				reg,
+				flags.Debuginfo.UploadMaxFileSizeMB<<20,
+				flags.Debuginfo.UploadBudgetMBPerHour<<20,
+				debuginfoSkippedUploads,
+			)
+		}
 		dbginfo = debuginfo.New(
 			log.With(logger, "component", "debuginfo"),
 			tp.Tracer("debuginfo"),
 			reg,
 			ofp,
+			rootFS,
 			debuginfoClient,
 			flags.Debuginfo.UploadMaxParallel,
 			flags.Debuginfo.UploadTimeoutDuration,
 			flags.Debuginfo.DisableCaching,
 			flags.Debuginfo.UploadCacheDuration,
-			flags.Debuginfo.Directories,
+			debugDirs,
 			flags.Debuginfo.Strip,
 			flags.Debuginfo.TempDir,
+			cipher,
+			uploadTransport,
+			debuginfoDryRun,
+			debuginfoBudget,
 		)
-		defer dbginfo.Close()
+		defer func() {
+			ctx, cancel := context.WithDeadline(context.Background(), startShutdown())
+			defer cancel()
+
+			if err := dbginfo.Drain(ctx); err != nil {
+				level.Warn(logger).Log("msg", "debuginfo uploads abandoned on shutdown", "err", err)
+			}
+			dbginfo.Close()
+		}()
 	} else {
 		dbginfo = debuginfo.NoopDebuginfoManager{}
 	}
 
+	// Left nil when the server symbolizes the addresses of native binaries.
+	var localSymbolizer parcapprof.LocalSymbolizer
+	if flags.Symbolizer.Local {
+		// The debuginfo manager already has a finder, with its metrics.
+		var finder *debuginfo.Finder
+		if m, ok := dbginfo.(*debuginfo.Manager); ok {
+			finder = m.Finder
+		} else {
+			finder = debuginfo.NewFinder(log.With(logger, "component", "debuginfo"), tp.Tracer("debuginfo"), reg, debugDirs)
+		}
+		symbolizer := local.NewSymbolizer(
+			log.With(logger, "component", "local_symbolizer"),
+			reg,
+			ofp,
+			finder,
+			localSymbolizerBinaries,
+		)
+		defer symbolizer.Close()
+		localSymbolizer = symbolizer
+	}
+
+	runtimeUnwinders, err := process.ParseRuntimeUnwinders(flags.RuntimeUnwinders)
+	if err != nil {
+		return err
+	}
+
+	lifecycleEvents := lifecycle.NewEventLog(lifecycleEventsPerProcess, lifecycleProcesses)
+	symbolizationCoverage := parcapprof.NewSymbolizationCoverage(reg, symbolizationCoverageBinaries)
+	unwindFailures := profiler.NewUnwindFailures(reg, unwindFailuresBinaries)
+
+	var (
+		processInfoManager = process.NewInfoManager(
+			log.With(logger, "component", "process_info"),
+			tp.Tracer("process_info"),
+			reg,
+			process.NewMapManager(reg, pfs, ofp),
+			dbginfo,
+			labelsManager,
+			flags.Profiling.Duration,
+			runtimeUnwinders,
+			lifecycleEvents,
+		)
+		addressNormalizer = address.NewNormalizer(logger, reg, flags.Hidden.DebugNormalizeAddresses)
+		kernelSymbols     = ksym.NewKsym(logger, reg, flags.Debuginfo.TempDir)
+		perfMapCache      = perf.NewPerfMapCache(logger, reg, nsCache, rootFS, flags.Profiling.Duration)
+		jitdumpCache      = perf.NewJitdumpCache(logger, reg, rootFS, flags.Profiling.Duration)
+		demangler         = demangle.NewDemangler(flags.Demangle, false)
+	)
+
+	var frequencyController *profiler.FrequencyController
+	if flags.Profiling.CPUSamplingFrequencyMin > 0 {
+		frequencyController, err = profiler.NewFrequencyController(
+			flags.Profiling.CPUSamplingFrequencyMin,
+			flags.Profiling.CPUSamplingFrequency,
+			flags.Profiling.CPULoadLowThreshold,
+			flags.Profiling.CPULoadHighThreshold,
+		)
+		if err != nil {
+			return fmt.Errorf("invalid adaptive sampling frequency: %w", err)
+		}
+	}
+
+	// Run group for the CPU budget of the profilers.
+	var budget *profiler.Budget
+	if flags.Profiling.CPUBudget > 0 {
+		budget, err = profiler.NewBudget(log.With(logger, "component", "cpu_budget"), reg, pfs, flags.Profiling.CPUBudget, flags.Profiling.CPUBudgetWeights)
+		if err != nil {
+			return fmt.Errorf("invalid CPU budget: %w", err)
+		}
+
+		logger := log.With(logger, "group", "cpu_budget")
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting")
+			defer level.Debug(logger).Log("msg", "stopped")
+
+			return budget.Run(ctx, flags.Profiling.Duration)
+		}, func(error) {
+			level.Debug(logger).Log("msg", "cleaning up")
+			defer level.Debug(logger).Log("msg", "cleanup finished")
+			cancel()
+		})
+	}
+
+	if flags.Profiling.ConversionWorkers < 1 {
+		return fmt.Errorf("the number of conversion workers must be at least 1, got %d", flags.Profiling.ConversionWorkers)
+	}
+	if flags.Profiling.TimeBuckets < 1 {
+		return fmt.Errorf("the number of time buckets must be at least 1, got %d", flags.Profiling.TimeBuckets)
+	}
+	if flags.Profiling.MaxStackDepth < 1 || flags.Profiling.MaxStackDepth > cpu.MaxStackDepth {
+		return fmt.Errorf("the maximum stack depth must be between 1 and %d, got %d", cpu.MaxStackDepth, flags.Profiling.MaxStackDepth)
+	}
+
+	perfEvents, err := profiler.ParsePerfEvents(flags.PerfEvent)
+	if err != nil {
+		return err
+	}
+	if len(perfEvents) > cpu.MaxPerfEvents {
+		return fmt.Errorf("at most %d perf events can be sampled, got %d", cpu.MaxPerfEvents, len(perfEvents))
+	}
+
+	var cgroupFilter profiler.Labeler
+	if flags.Profiling.CgroupFilter {
+		cgroupFilter = labelsManager
+	}
+
 	profilers := []Profiler{
 		cpu.NewCPUProfiler(
 			log.With(logger, "component", "cpu_profiler"),
 			reg,
-			process.NewInfoManager(
-				log.With(logger, "component", "process_info"),
-				tp.Tracer("process_info"),
-				reg,
-				process.NewMapManager(reg, pfs, ofp),
-				dbginfo,
-				labelsManager,
-				flags.Profiling.Duration,
-			),
-			address.NewNormalizer(logger, reg, flags.Hidden.DebugNormalizeAddresses),
+			tp.Tracer("cpu_profiler"),
+			processInfoManager,
+			addressNormalizer,
+			vdsoResolver,
+			localSymbolizer,
+			kernelSymbols,
+			perfMapCache,
+			jitdumpCache,
+			demangler,
+			profileWriter,
+			frequencyController,
+			budget,
+			cgroupFilter,
+			lifecycleEvents,
+			symbolizationCoverage,
+			unwindFailures,
+			cpu.Options{
+				ProfilingDuration:       flags.Profiling.Duration,
+				SamplingFrequency:       flags.Profiling.CPUSamplingFrequency,
+				PerfEvents:              perfEvents,
+				MemlockRlimit:           flags.MemlockRlimit,
+				BTFPath:                 btf.Path,
+				DebugProcessNames:       flags.Hidden.DebugProcessNames,
+				DisableJITSymbolization: flags.Symbolizer.JITDisable,
+				UnknownFrames:           parcapprof.UnknownFramePolicy(flags.Symbolizer.UnknownFrames),
+				DisableDWARFUnwinding:   flags.DWARFUnwinding.Disable,
+				MixedUnwinding:          flags.DWARFUnwinding.Mixed,
+				LBRFallback:             flags.DWARFUnwinding.LBRFallback,
+				MaxStackDepth:           flags.Profiling.MaxStackDepth,
+				GoroutineLabels:         flags.Profiling.GoroutineLabels,
+				TraceContextLabels:      flags.Profiling.TraceContextLabels,
+				SampleTimestamps:        flags.Profiling.SampleTimestamps,
+				CPULabels:               flags.Profiling.CPULabels,
+				NUMANodeLabels:          flags.Profiling.NUMANodeLabels,
+				SkipUnsymbolizable:      flags.Profiling.SkipUnsymbolizable,
+				TrackProcesses:          flags.Profiling.TrackProcesses,
+				TrackLibraries:          flags.Profiling.TrackLibraries,
+				AggregateByExecutable:   flags.Profiling.AggregateByExecutable,
+				TimeBuckets:             flags.Profiling.TimeBuckets,
+				ConversionWorkers:       flags.Profiling.ConversionWorkers,
+				ConversionTimeout:       flags.Profiling.ConversionTimeout,
+				EventsBuffer:            flags.Profiling.EventsBuffer,
+				EventsBufferPages:       flags.Profiling.EventsBufferPages,
+				VerboseBPFLogging:       flags.VerboseBpfLogging,
+				UnwindTableCacheDir:     flags.DWARFUnwinding.TableCacheDir,
+				UnwindTableServerURL:    flags.DWARFUnwinding.TableServerURL,
+			},
+			bpfProgramLoaded,
+		),
+	}
+	if flags.Profiling.ContentionEnable {
+		profilers = append(profilers, contention.NewContentionProfiler(
+			log.With(logger, "component", "contention_profiler"),
+			reg,
+			processInfoManager,
+			addressNormalizer,
+			vdsoResolver,
+			localSymbolizer,
+			kernelSymbols,
+			perfMapCache,
+			jitdumpCache,
+			flags.Symbolizer.JITDisable,
+			demangler,
+			parcapprof.UnknownFramePolicy(flags.Symbolizer.UnknownFrames),
+			profileWriter,
+			flags.Profiling.Duration,
+			flags.Profiling.ContentionMinWait,
+			flags.MemlockRlimit,
+			btf.Path,
+		))
+	}
+	if flags.Profiling.GPUSocketPath != "" {
+		profilers = append(profilers, gpu.NewGPUProfiler(
+			log.With(logger, "component", "gpu_profiler"),
+			reg,
+			processInfoManager,
+			addressNormalizer,
+			vdsoResolver,
+			localSymbolizer,
+			kernelSymbols,
+			perfMapCache,
+			jitdumpCache,
+			flags.Symbolizer.JITDisable,
+			demangler,
+			parcapprof.UnknownFramePolicy(flags.Symbolizer.UnknownFrames),
+			profileWriter,
+			flags.Profiling.Duration,
+			flags.Profiling.GPUSocketPath,
+		))
+	}
+	if flags.Profiling.NetworkIOEnable {
+		profilers = append(profilers, netio.NewNetIOProfiler(
+			log.With(logger, "component", "network_io_profiler"),
+			reg,
+			processInfoManager,
+			addressNormalizer,
+			vdsoResolver,
+			localSymbolizer,
+			kernelSymbols,
+			perfMapCache,
+			jitdumpCache,
+			flags.Symbolizer.JITDisable,
+			demangler,
+			parcapprof.UnknownFramePolicy(flags.Symbolizer.UnknownFrames),
+			profileWriter,
+			flags.Profiling.Duration,
+			flags.MemlockRlimit,
+			btf.Path,
+		))
+	}
+	if flags.Profiling.WallClockEnable {
+		profilers = append(profilers, wallclock.NewWallClockProfiler(
+			log.With(logger, "component", "wall_clock_profiler"),
+			reg,
+			processInfoManager,
+			addressNormalizer,
 			vdsoResolver,
-			ksym.NewKsym(logger, reg, flags.Debuginfo.TempDir),
-			perf.NewPerfMapCache(logger, reg, nsCache, flags.Profiling.Duration),
-			perf.NewJitdumpCache(logger, reg, flags.Profiling.Duration),
+			localSymbolizer,
+			kernelSymbols,
+			perfMapCache,
+			jitdumpCache,
 			flags.Symbolizer.JITDisable,
+			demangler,
+			parcapprof.UnknownFramePolicy(flags.Symbolizer.UnknownFrames),
 			profileWriter,
+			labelsManager,
+			budget,
 			flags.Profiling.Duration,
 			flags.Profiling.CPUSamplingFrequency,
 			flags.MemlockRlimit,
-			flags.Hidden.DebugProcessNames,
-			flags.DWARFUnwinding.Disable,
-			flags.DWARFUnwinding.Mixed,
-			flags.VerboseBpfLogging,
-			bpfProgramLoaded,
-		),
+			btf.Path,
+		))
 	}
+	if flags.Profiling.SelfEnable {
+		profilers = append(profilers, self.NewSelfProfiler(
+			log.With(logger, "component", "self_profiler"),
+			profileWriter,
+			flags.Node,
+			flags.Metadata.ExternalLabels,
+			flags.Profiling.Duration,
+			flags.Profiling.SelfInterval,
+		))
+	}
+	cacheSizers := []cache.Sizer{ofp, rootFS, perfMapCache, jitdumpCache}
+	if sizer, ok := dbginfo.(cache.Sizer); ok {
+		cacheSizers = append(cacheSizers, sizer)
+	}
+	mux.HandleFunc("/debug/caches", func(w http.ResponseWriter, r *http.Request) {
+		sizes := map[string]int{}
+		for _, sizer := range cacheSizers {
+			for name, size := range sizer.CacheSizes() {
+				sizes[name] = size
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sizes); err != nil {
+			level.Debug(logger).Log("msg", "failed to write cache sizes", "err", err)
+		}
+	})
+	mux.HandleFunc("/debug/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, entry := range logRecorder.Entries() {
+			io.WriteString(w, entry) //nolint:errcheck
+		}
+	})
+	mux.HandleFunc("/debug/symbolization", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(symbolizationCoverage.Binaries()); err != nil {
+			level.Debug(logger).Log("msg", "failed to write symbolization coverage", "err", err)
+		}
+	})
+	mux.HandleFunc("/debug/unwind-failures", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(unwindFailures.Binaries()); err != nil {
+			level.Debug(logger).Log("msg", "failed to write unwind failures", "err", err)
+		}
+	})
+	mux.HandleFunc("/debug/debuginfo-uploads", func(w http.ResponseWriter, r *http.Request) {
+		// Nothing is recorded unless the uploads are dry run.
+		uploads := []debuginfo.DryRunUpload{}
+		if debuginfoDryRun != nil {
+			uploads = debuginfoDryRun.Uploads()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(uploads); err != nil {
+			level.Debug(logger).Log("msg", "failed to write debuginfo uploads", "err", err)
+		}
+	})
+	mux.HandleFunc("/debug/debuginfo-skipped", func(w http.ResponseWriter, r *http.Request) {
+		// Nothing is skipped unless the size of the uploads is limited.
+		skipped := []debuginfo.SkippedUpload{}
+		if debuginfoBudget != nil {
+			skipped = debuginfoBudget.Skipped()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(skipped); err != nil {
+			level.Debug(logger).Log("msg", "failed to write skipped debuginfo uploads", "err", err)
+		}
+	})
+	mux.HandleFunc("/debug/events", func(w http.ResponseWriter, r *http.Request) {
+		var pid int
+		if v := r.URL.Query().Get("pid"); v != "" {
+			var err error
+			pid, err = strconv.Atoi(v)
+			if err != nil || pid <= 0 {
+				http.Error(w, "pid must be a process ID", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lifecycleEvents.Events(pid)); err != nil {
+			level.Debug(logger).Log("msg", "failed to write lifecycle events", "err", err)
+		}
+	})
+	mux.HandleFunc("/profiles/pid/", func(w http.ResponseWriter, r *http.Request) {
+		pid, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/profiles/pid/"))
+		if err != nil || pid <= 0 {
+			http.Error(w, "expecting a process ID in the form of /profiles/pid/<pid>", http.StatusBadRequest)
+			return
+		}
+
+		duration := flags.Profiling.Duration
+		if v := r.URL.Query().Get("duration"); v != "" {
+			duration, err = time.ParseDuration(v)
+			if err != nil || duration <= 0 || duration > maxCaptureDuration {
+				http.Error(w, fmt.Sprintf("duration must be a positive duration of up to %s", maxCaptureDuration), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var capturer profiler.Capturer
+		for _, p := range profilers {
+			if c, ok := p.(profiler.Capturer); ok {
+				capturer = c
+				break
+			}
+		}
+		if capturer == nil {
+			http.Error(w, "no profiler can capture profiles on demand", http.StatusNotFound)
+			return
+		}
+
+		// The capture lasts whole profiling rounds, leave room for the last
+		// one to be processed.
+		deadline := time.Now().Add(duration + flags.Profiling.Duration + 10*time.Second)
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			level.Debug(logger).Log("msg", "failed to extend write deadline", "err", err)
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+
+		prof, err := capturer.Capture(ctx, pid, duration)
+		switch {
+		case errors.Is(err, cpu.ErrNoSamples):
+			http.Error(w, fmt.Sprintf("Process %d was not sampled in the last %s, it may be idle or not exist.", pid, duration), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, "Unexpected error occurred: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.google.protobuf+gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%d.pb.gz", pid))
+		if err := prof.Write(w); err != nil {
+			level.Error(logger).Log("msg", "failed to write profile", "err", err)
+		}
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/healthy" || r.URL.Path == "/ready" || r.URL.Path == "/favicon.ico" {
 			return
@@ -831,7 +1631,9 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 
 		for _, p := range profilers {
 			logger := log.With(logger, "group", "profiler/"+p.Name())
+			profilersStopped.Add(1)
 			g.Add(func() error {
+				defer profilersStopped.Done()
 				level.Debug(logger).Log("msg", "starting", "name", p.Name())
 				defer level.Debug(logger).Log("msg", "stopped", "err", err, "profiler", p.Name())
 
@@ -850,6 +1652,74 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		}
 	}
 
+	// Run group for the JVM perf map writer.
+	if flags.Java.PerfMapEnable {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		perfMapper := jvm.NewPerfMapper(
+			log.With(logger, "component", "jvm_perf_map"),
+			reg,
+			jvm.NewAttacher(5*time.Second, nsCache.Get),
+			hsperfdata.NewCache(logger, nsCache).IsJavaProcess,
+			pfs,
+			flags.Java.PerfMapInterval,
+			flags.Java.PerfMapRefreshInterval,
+			flags.Java.PerfMapAgentPath,
+			flags.Java.PerfMapAgentOptions,
+		)
+
+		logger := log.With(logger, "group", "jvm_perf_map")
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting")
+			defer level.Debug(logger).Log("msg", "stopped")
+
+			var err error
+			runtimepprof.Do(ctx, runtimepprof.Labels("component", "jvm_perf_map"), func(ctx context.Context) {
+				err = perfMapper.Run(ctx)
+			})
+
+			return err
+		}, func(error) {
+			level.Debug(logger).Log("msg", "cleaning up")
+			defer level.Debug(logger).Log("msg", "cleanup finished")
+
+			cancel()
+		})
+	}
+
+	// Run group for the .NET perf map enabler.
+	if flags.Dotnet.PerfMapEnable {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		perfMapper := dotnet.NewPerfMapper(
+			log.With(logger, "component", "dotnet_perf_map"),
+			reg,
+			nsCache.Get,
+			pfs,
+			flags.Dotnet.PerfMapInterval,
+		)
+
+		logger := log.With(logger, "group", "dotnet_perf_map")
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting")
+			defer level.Debug(logger).Log("msg", "stopped")
+
+			var err error
+			runtimepprof.Do(ctx, runtimepprof.Labels("component", "dotnet_perf_map"), func(ctx context.Context) {
+				err = perfMapper.Run(ctx)
+			})
+
+			return err
+		}, func(error) {
+			level.Debug(logger).Log("msg", "cleaning up")
+			defer level.Debug(logger).Log("msg", "cleanup finished")
+
+			cancel()
+		})
+	}
+
 	// Run group for http server.
 	{
 		srv := &http.Server{
@@ -902,6 +1772,22 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 					return labelsManager.ApplyConfig(cfg.RelabelConfigs)
 				},
 			},
+			{
+				// Endpoints are only set up at startup, the relabel configs
+				// of the existing ones can be changed without a restart.
+				Name: "remote_write",
+				Reloader: func(cfg *config.Config) error {
+					for _, rwCfg := range cfg.RemoteWrite {
+						endpoint, ok := fanOutWriteClient.Endpoint(rwCfg.Name)
+						if !ok {
+							level.Warn(logger).Log("msg", "new remote write endpoints require a restart", "remote_name", rwCfg.Name)
+							continue
+						}
+						endpoint.ApplyConfig(rwCfg.WriteRelabelConfigs)
+					}
+					return nil
+				},
+			},
 		}
 
 		cfgReloader, err := config.NewConfigReloader(logger, reg, flags.ConfigPath, reloaders)
@@ -931,8 +1817,111 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		)
 	}
 
+	// Run group for dumping the lifecycle events on SIGUSR1.
+	{
+		ctx, cancel := context.WithCancel(ctx)
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		g.Add(func() error {
+			for {
+				select {
+				case <-usr1:
+					if err := lifecycleEvents.Dump(os.Stderr); err != nil {
+						level.Warn(logger).Log("msg", "failed to dump lifecycle events", "err", err)
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}, func(error) {
+			signal.Stop(usr1)
+			cancel()
+		})
+	}
+
 	// Run group for signal handler.
-	g.Add(okrun.SignalHandler(ctx, os.Interrupt, os.Kill))
+	g.Add(okrun.SignalHandler(ctx, os.Interrupt, syscall.SIGTERM))
 
 	return g.Run()
 }
+
+// discoveryConfigs returns the configuration of the enabled discovery
+// mechanisms.
+func discoveryConfigs(flags flags) (discovery.Configs, error) {
+	configs := discovery.Configs{}
+	for _, source := range flags.Discovery.Sources {
+		switch source {
+		case "kubernetes":
+			configs = append(configs, discovery.NewPodConfig(flags.Node, flags.Metadata.ContainerRuntimeSocketPath))
+		case "systemd":
+			configs = append(configs, discovery.NewSystemdConfig())
+		case "procfs":
+			configs = append(configs, discovery.NewProcfsConfig(flags.Discovery.Interval))
+		case "docker":
+			configs = append(configs, discovery.NewDockerConfig(flags.Metadata.ContainerRuntimeSocketPath))
+		case "containerd":
+			configs = append(configs, discovery.NewContainerdConfig(flags.Metadata.ContainerRuntimeSocketPath, flags.Discovery.Interval))
+		default:
+			return nil, fmt.Errorf("unknown discovery source: %s", source)
+		}
+	}
+	return configs, nil
+}
+
+// remoteStoreConfig returns the remote write config of the store given by the
+// flags.
+func remoteStoreConfig(flags FlagsRemoteStore) *config.RemoteWriteConfig {
+	return &config.RemoteWriteConfig{
+		Name:            flags.Address,
+		Address:         flags.Address,
+		BearerToken:     commonconfig.Secret(flags.BearerToken),
+		BearerTokenFile: flags.BearerTokenFile,
+		Insecure:        flags.Insecure,
+		TLSConfig: commonconfig.TLSConfig{
+			CAFile:             flags.TLSCAFile,
+			CertFile:           flags.TLSCertFile,
+			KeyFile:            flags.TLSKeyFile,
+			ServerName:         flags.TLSServerName,
+			InsecureSkipVerify: flags.InsecureSkipVerify,
+		},
+		BatchWriteInterval: model.Duration(flags.BatchWriteInterval),
+		WALDirectory:       flags.WALDirectory,
+		TenantHeader:       flags.TenantHeader,
+	}
+}
+
+// remoteWriteConn dials the given remote write endpoint.
+func remoteWriteConn(logger log.Logger, reg prometheus.Registerer, tp trace.TracerProvider, cfg *config.RemoteWriteConfig) (*grpc.ClientConn, error) {
+	var opts []grpc.DialOption
+	if cfg.Insecure {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		creds, err := parcagrpc.NewTLSCredentials(&cfg.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS config: %w", err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	}
+
+	if cfg.BearerToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(
+			parcagrpc.NewPerRequestBearerToken(string(cfg.BearerToken), cfg.Insecure)),
+		)
+	}
+
+	if cfg.BearerTokenFile != "" {
+		// The token is read again when the file changes, to support
+		// short-lived workload identity tokens.
+		creds, err := parcagrpc.NewPerRequestBearerTokenFile(cfg.BearerTokenFile, cfg.Insecure)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token from file: %w", err)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(creds))
+	}
+
+	if cfg.TenantHeader != "" {
+		opts = append(opts, tenant.DialOptions(cfg.TenantHeader)...)
+	}
+
+	return parcagrpc.Conn(logger, reg, tp, cfg.Address, opts...)
+}
@@ -0,0 +1,30 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// The profilers are built on eBPF, so the agent can only run on Linux. It
+// still builds elsewhere so that the rest of the module, such as the eh-frame
+// tool, can be used and tested on developer machines.
+func main() {
+	fmt.Fprintf(os.Stderr, "parca-agent is only supported on Linux, not on %s\n", runtime.GOOS)
+	os.Exit(1)
+}
@@ -106,7 +106,7 @@ func TestGRPCIntegration(t *testing.T) {
 
 	t.Log("Performing Query Range Request")
 	queryRequestAgent := &pb.QueryRangeRequest{
-		Query: `parca_agent_cpu:samples:count:cpu:nanoseconds:delta`,
+		Query: `parca_agent_cpu:cpu:nanoseconds:cpu:nanoseconds:delta`,
 		Start: timestamppb.New(timestamp.Time(0)),
 		End:   timestamppb.New(timestamp.Time(math.MaxInt64)),
 		Limit: 10,
@@ -32,6 +32,13 @@ type FrameDescriptionEntry struct {
 	Instructions []byte
 	begin, size  uint64
 	order        binary.ByteOrder
+	regs         Registers
+}
+
+// Registers returns the stack and frame pointer registers of the
+// architecture of this frame.
+func (fde *FrameDescriptionEntry) Registers() Registers {
+	return fde.regs
 }
 
 // Cover returns whether or not the given address is within the
@@ -34,7 +34,8 @@ type parseContext struct {
 // has a pointer to CommonInformationEntry.
 // If ehFrameAddr is not zero the .eh_frame format will be used, a minor variant of DWARF described at https://www.airs.com/blog/archives/460.
 // The value of ehFrameAddr will be used as the address at which eh_frame will be mapped into memory.
-func Parse(data []byte, order binary.ByteOrder, staticBase uint64, ptrSize int, ehFrameAddr uint64) (FrameDescriptionEntries, error) {
+// The rules of the stack and frame pointers are tracked with the register numbers of the given architecture.
+func Parse(data []byte, order binary.ByteOrder, staticBase uint64, ptrSize int, ehFrameAddr uint64, regs Registers) (FrameDescriptionEntries, error) {
 	var (
 		buf  = bytes.NewBuffer(data)
 		pctx = &parseContext{buf: buf, totalLen: len(data), entries: newFrameIndex(), staticBase: staticBase, ptrSize: ptrSize, ehFrameAddr: ehFrameAddr, ciemap: map[int]*CommonInformationEntry{}}
@@ -49,6 +50,7 @@ func Parse(data []byte, order binary.ByteOrder, staticBase uint64, ptrSize int,
 
 	for i := range pctx.entries {
 		pctx.entries[i].order = order
+		pctx.entries[i].regs = regs
 	}
 
 	return pctx.entries, nil
@@ -31,6 +31,25 @@ const (
 	X86_64StackPointer = 7 // $rsp
 )
 
+// From the DWARF Register Numbers of the RISC-V ELF psABI
+// https://github.com/riscv-non-isa/riscv-elf-psabi-doc/blob/master/riscv-dwarf.adoc
+const (
+	RISCV64StackPointer = 2 // $sp (x2)
+	RISCV64FramePointer = 8 // $s0 (x8)
+)
+
+// Registers are the DWARF numbers of the stack pointer and frame pointer
+// registers of an architecture, whose rules are tracked.
+type Registers struct {
+	StackPointer uint64
+	FramePointer uint64
+}
+
+var (
+	X86_64Registers  = Registers{StackPointer: X86_64StackPointer, FramePointer: X86_64FramePointer}
+	RISCV64Registers = Registers{StackPointer: RISCV64StackPointer, FramePointer: RISCV64FramePointer}
+)
+
 type UnwindRegisters struct {
 	StackPointer DWRule
 	FramePointer DWRule
@@ -56,6 +75,7 @@ type InstructionContext struct {
 	RetAddrReg    uint64
 	codeAlignment uint64
 	dataAlignment int64
+	regs          Registers
 }
 
 func (instructionContext *InstructionContext) Loc() uint64 {
@@ -140,18 +160,20 @@ func (ctx *Context) currentInstruction() *InstructionContext {
 	return ctx.currInsCtx
 }
 
-func (frame *Context) reset(cie *CommonInformationEntry) {
+func (frame *Context) reset(cie *CommonInformationEntry, regs Registers) {
 	frame.currInsCtx.cie = cie
 	frame.currInsCtx.Regs = UnwindRegisters{}
 	frame.currInsCtx.RetAddrReg = cie.ReturnAddressRegister
 	frame.currInsCtx.codeAlignment = cie.CodeAlignmentFactor
 	frame.currInsCtx.dataAlignment = cie.DataAlignmentFactor
+	frame.currInsCtx.regs = regs
 
 	frame.lastInsCtx.cie = cie
 	frame.lastInsCtx.Regs = UnwindRegisters{}
 	frame.lastInsCtx.RetAddrReg = cie.ReturnAddressRegister
 	frame.lastInsCtx.codeAlignment = cie.CodeAlignmentFactor
 	frame.lastInsCtx.dataAlignment = cie.DataAlignmentFactor
+	frame.lastInsCtx.regs = regs
 
 	frame.buf.Reset(cie.InitialInstructions)
 	frame.rememberedState.reset()
@@ -250,19 +272,19 @@ func NewContext() *Context {
 	}
 }
 
-func executeCIEInstructions(cie *CommonInformationEntry, context *Context) *Context {
+func executeCIEInstructions(cie *CommonInformationEntry, regs Registers, context *Context) *Context {
 	if context == nil {
 		context = NewContext()
 	}
 
-	context.reset(cie)
+	context.reset(cie, regs)
 	context.executeDwarfProgram()
 	return context
 }
 
 // ExecuteDwarfProgram evaluates the unwind opcodes for a function.
 func ExecuteDwarfProgram(fde *FrameDescriptionEntry, context *Context) *InstructionContextIterator {
-	ctx := executeCIEInstructions(fde.CIE, context)
+	ctx := executeCIEInstructions(fde.CIE, fde.regs, context)
 	ctx.order = fde.order
 	frame := ctx.currentInstruction()
 	frame.loc = fde.Begin()
@@ -395,9 +417,9 @@ func lookupFunc(instruction byte, ctx *Context) instruction {
 
 func setRule(reg uint64, frame *InstructionContext, rule DWRule) {
 	switch reg {
-	case X86_64StackPointer:
+	case frame.regs.StackPointer:
 		frame.Regs.StackPointer = rule
-	case X86_64FramePointer:
+	case frame.regs.FramePointer:
 		frame.Regs.FramePointer = rule
 	case frame.RetAddrReg:
 		frame.Regs.SavedReturn = rule
@@ -406,13 +428,13 @@ func setRule(reg uint64, frame *InstructionContext, rule DWRule) {
 
 func restoreRule(reg uint64, frame *InstructionContext) {
 	switch reg {
-	case X86_64StackPointer:
+	case frame.regs.StackPointer:
 		if frame.initialRegs.StackPointer.Rule == RuleUnknown {
 			frame.Regs.StackPointer = DWRule{Rule: RuleUndefined}
 		} else {
 			frame.Regs.StackPointer = DWRule{Offset: frame.initialRegs.StackPointer.Offset, Rule: RuleOffset}
 		}
-	case X86_64FramePointer:
+	case frame.regs.FramePointer:
 		if frame.initialRegs.FramePointer.Rule == RuleUnknown {
 			frame.Regs.FramePointer = DWRule{Rule: RuleUndefined}
 		} else {
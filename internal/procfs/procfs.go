@@ -0,0 +1,24 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package procfs makes the parts of github.com/prometheus/procfs the agent
+// uses available on every platform. On Linux they are the ones of procfs, on
+// the other platforms, which have no proc filesystem and where procfs doesn't
+// always build, they only fail with ErrUnsupported.
+package procfs
+
+import (
+	"errors"
+)
+
+var ErrUnsupported = errors.New("the proc filesystem is only supported on Linux")
@@ -0,0 +1,44 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package procfs
+
+import (
+	"github.com/prometheus/procfs"
+)
+
+type (
+	FS                 = procfs.FS
+	Proc               = procfs.Proc
+	Procs              = procfs.Procs
+	ProcMap            = procfs.ProcMap
+	ProcMapPermissions = procfs.ProcMapPermissions
+	ProcStat           = procfs.ProcStat
+	PSILine            = procfs.PSILine
+	PSIStats           = procfs.PSIStats
+	Cgroup             = procfs.Cgroup
+	CPUStat            = procfs.CPUStat
+	Stat               = procfs.Stat
+)
+
+// NewDefaultFS returns the proc filesystem mounted at /proc.
+func NewDefaultFS() (FS, error) {
+	return procfs.NewDefaultFS()
+}
+
+// NewProc returns the process with the given PID in /proc.
+func NewProc(pid int) (Proc, error) {
+	return procfs.NewProc(pid)
+}
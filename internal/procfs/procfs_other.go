@@ -0,0 +1,156 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package procfs
+
+// FS mirrors procfs.FS.
+type FS struct{}
+
+// Proc mirrors procfs.Proc.
+type Proc struct {
+	PID int
+}
+
+// Procs mirrors procfs.Procs.
+type Procs []Proc
+
+// ProcMapPermissions mirrors procfs.ProcMapPermissions.
+type ProcMapPermissions struct {
+	Read    bool
+	Write   bool
+	Execute bool
+	Shared  bool
+	Private bool
+}
+
+// ProcMap mirrors procfs.ProcMap.
+type ProcMap struct {
+	StartAddr uintptr
+	EndAddr   uintptr
+	Perms     *ProcMapPermissions
+	Offset    int64
+	Dev       uint64
+	Inode     uint64
+	Pathname  string
+}
+
+// ProcStat mirrors the fields of procfs.ProcStat the agent reads.
+type ProcStat struct {
+	PID       int
+	Comm      string
+	PPID      int
+	Starttime uint64
+}
+
+// CPUTime returns the CPU time spent by the process in seconds.
+func (ProcStat) CPUTime() float64 {
+	return 0
+}
+
+// Cgroup mirrors procfs.Cgroup.
+type Cgroup struct {
+	HierarchyID int
+	Controllers []string
+	Path        string
+}
+
+// CPUStat mirrors procfs.CPUStat.
+type CPUStat struct {
+	User      float64
+	Nice      float64
+	System    float64
+	Idle      float64
+	Iowait    float64
+	IRQ       float64
+	SoftIRQ   float64
+	Steal     float64
+	Guest     float64
+	GuestNice float64
+}
+
+// Stat mirrors the fields of procfs.Stat the agent reads.
+type Stat struct {
+	CPUTotal CPUStat
+}
+
+// PSILine mirrors procfs.PSILine.
+type PSILine struct {
+	Avg10  float64
+	Avg60  float64
+	Avg300 float64
+	Total  uint64
+}
+
+// PSIStats mirrors procfs.PSIStats.
+type PSIStats struct {
+	Some *PSILine
+	Full *PSILine
+}
+
+func NewDefaultFS() (FS, error) {
+	return FS{}, ErrUnsupported
+}
+
+func NewProc(pid int) (Proc, error) {
+	return Proc{}, ErrUnsupported
+}
+
+func (FS) Proc(pid int) (Proc, error) {
+	return Proc{}, ErrUnsupported
+}
+
+func (FS) AllProcs() (Procs, error) {
+	return nil, ErrUnsupported
+}
+
+func (FS) PSIStatsForResource(resource string) (PSIStats, error) {
+	return PSIStats{}, ErrUnsupported
+}
+
+func (FS) Self() (Proc, error) {
+	return Proc{}, ErrUnsupported
+}
+
+func (FS) Stat() (Stat, error) {
+	return Stat{}, ErrUnsupported
+}
+
+func (Proc) Stat() (ProcStat, error) {
+	return ProcStat{}, ErrUnsupported
+}
+
+func (Proc) Comm() (string, error) {
+	return "", ErrUnsupported
+}
+
+func (Proc) CmdLine() ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+func (Proc) Environ() ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+func (Proc) Executable() (string, error) {
+	return "", ErrUnsupported
+}
+
+func (Proc) ProcMaps() ([]*ProcMap, error) {
+	return nil, ErrUnsupported
+}
+
+func (Proc) Cgroups() ([]Cgroup, error) {
+	return nil, ErrUnsupported
+}
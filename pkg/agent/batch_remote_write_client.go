@@ -16,6 +16,9 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,12 +28,20 @@ import (
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+	"github.com/parca-dev/parca-agent/pkg/tracer"
 )
 
 type metrics struct {
 	writeRawRetries            prometheus.Counter
 	writeRawWithRetriesLatency prometheus.Histogram
+	writeRawBytes              prometheus.Counter
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -47,6 +58,11 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			Help:                        "Histogram of overall latency when sending WriteRaw gRPC request with retries",
 			NativeHistogramBucketFactor: 1.1,
 		})
+	m.writeRawBytes = promauto.With(reg).NewCounter(
+		prometheus.CounterOpts{
+			Name: "parca_agent_batch_writer_sent_bytes_total",
+			Help: "Total number of bytes of the WriteRaw gRPC requests sent, before compression.",
+		})
 
 	return &m
 }
@@ -55,31 +71,60 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 type BatchWriteClient struct {
 	logger        log.Logger
 	metrics       *metrics
+	tracer        trace.Tracer
 	writeClient   profilestorepb.ProfileStoreServiceClient
 	writeInterval time.Duration
 	// isNormalized indicates whether sampled addresses are normalized by the agent.
 	isNormalized bool
+	// wal spools batches that couldn't be sent, it is nil when disabled.
+	wal *WAL
+	// compress indicates whether requests are compressed as a whole, so the
+	// mappings and strings the profiles of different processes share are
+	// only sent once over the wire.
+	compress bool
 
 	mtx    *sync.RWMutex
 	series []*profilestorepb.RawProfileSeries
+	// index maps the labels of the series of the current batch to their
+	// position in series.
+	index map[string]int
+	// The profile batch IDs of the series of the current batch, and the
+	// spans they were written in, which the span sending it links to.
+	batchIDs map[string]struct{}
+	links    []trace.Link
 
 	lastBatchSentAt    time.Time
 	lastBatchSendError error
 }
 
-func NewBatchWriteClient(logger log.Logger, reg prometheus.Registerer, wc profilestorepb.ProfileStoreServiceClient, writeInterval time.Duration, isNormalized bool) *BatchWriteClient {
+// NewBatchWriteClient creates a new BatchWriteClient. When wal is not nil,
+// batches that fail to be sent are appended to it and replayed once the
+// remote store accepts writes again.
+func NewBatchWriteClient(logger log.Logger, reg prometheus.Registerer, tracer trace.Tracer, wc profilestorepb.ProfileStoreServiceClient, writeInterval time.Duration, isNormalized bool, wal *WAL, compress bool) *BatchWriteClient {
 	return &BatchWriteClient{
 		logger:        logger,
 		metrics:       newMetrics(reg),
+		tracer:        tracer,
 		writeClient:   wc,
 		writeInterval: writeInterval,
 		isNormalized:  isNormalized,
+		wal:           wal,
+		compress:      compress,
 
-		series: []*profilestorepb.RawProfileSeries{},
-		mtx:    &sync.RWMutex{},
+		series:   []*profilestorepb.RawProfileSeries{},
+		index:    map[string]int{},
+		batchIDs: map[string]struct{}{},
+		mtx:      &sync.RWMutex{},
 	}
 }
 
+func (b *BatchWriteClient) callOptions() []grpc.CallOption {
+	if b.compress {
+		return []grpc.CallOption{grpc.UseCompressor(gzip.Name)}
+	}
+	return nil
+}
+
 func (b *BatchWriteClient) report(lastBatchSentAt time.Time, lastBatchSendError error) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
@@ -88,6 +133,9 @@ func (b *BatchWriteClient) report(lastBatchSentAt time.Time, lastBatchSendError
 	b.lastBatchSendError = lastBatchSendError
 }
 
+// Run sends the batches every write interval until the context is canceled,
+// then sends the last one. It is only canceled once nothing writes to it
+// anymore, for the profiles not to be lost.
 func (b *BatchWriteClient) Run(ctx context.Context) error {
 	ticker := time.NewTicker(b.writeInterval)
 	defer ticker.Stop()
@@ -95,6 +143,11 @@ func (b *BatchWriteClient) Run(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
+			// The last batch is spooled to the write-ahead log if it can't
+			// be sent within a write interval.
+			flushCtx, cancel := context.WithTimeout(context.Background(), b.writeInterval)
+			defer cancel()
+			b.report(time.Now(), b.batch(flushCtx))
 			return ctx.Err()
 		case <-ticker.C:
 		}
@@ -111,39 +164,183 @@ func (b *BatchWriteClient) batch(ctx context.Context) error {
 
 	b.mtx.Lock()
 	batch := b.series
+	batchIDs := make([]string, 0, len(b.batchIDs))
+	for id := range b.batchIDs {
+		batchIDs = append(batchIDs, id)
+	}
+	links := b.links
 	b.series = []*profilestorepb.RawProfileSeries{}
+	b.index = map[string]int{}
+	b.batchIDs = map[string]struct{}{}
+	b.links = nil
 	b.mtx.Unlock()
 
+	sort.Strings(batchIDs)
+	ctx, span := b.tracer.Start(ctx, "BatchWriteClient.batch",
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			tracer.ProfileBatchIDKey.StringSlice(batchIDs),
+			attribute.Int("series", len(batch)),
+		),
+	)
+	defer span.End()
+
+	req := &profilestorepb.WriteRawRequest{
+		Series:     batch,
+		Normalized: b.isNormalized,
+	}
+	var errs error
+	for _, r := range splitByTenant(req) {
+		if err := b.send(ctx, r); err != nil {
+			level.Warn(b.logger).Log("msg", "batch write client failed to send profiles", "count", len(r.batched.Series), "tenant", r.tenant, "err", err)
+			span.RecordError(err)
+			// The series are spooled with their tenant label, to be sent
+			// as their tenant again.
+			if b.wal != nil && len(r.batched.Series) > 0 {
+				if err := b.wal.Append(r.batched); err != nil {
+					level.Warn(b.logger).Log("msg", "failed to append profiles to the write-ahead log", "count", len(r.batched.Series), "err", err)
+				}
+			}
+			errs = errors.Join(errs, err)
+		}
+	}
+	if errs != nil {
+		span.SetStatus(codes.Error, errs.Error())
+		return errs
+	}
+
+	if len(batch) > 0 {
+		level.Debug(b.logger).Log("msg", "batch write client sent profiles", "count", len(batch))
+	}
+
+	if b.wal != nil && !b.wal.Empty() {
+		// The store is reachable again, catch up on what was spooled
+		// during the outage.
+		if err := b.replay(ctx); err != nil {
+			level.Warn(b.logger).Log("msg", "failed to replay profiles from the write-ahead log", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends the request as its tenant, retrying for up to a write interval.
+func (b *BatchWriteClient) send(ctx context.Context, r tenantRequest) error {
+	if r.tenant != "" {
+		ctx = tenant.WithTenant(ctx, r.tenant)
+	}
+
 	expbackOff := backoff.NewExponentialBackOff()
 	expbackOff.MaxElapsedTime = b.writeInterval         // TODO: Subtract ~10% of interval to account for overhead in loop
 	expbackOff.InitialInterval = 500 * time.Millisecond // Let's not retry to aggressively to start with.
 
 	err := backoff.Retry(func() error {
-		_, err := b.writeClient.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
-			Series:     batch,
-			Normalized: b.isNormalized,
-		})
+		_, err := b.writeClient.WriteRaw(ctx, r.req, b.callOptions()...)
 		// Only enter this block if retrying
 		if err != nil && expbackOff.NextBackOff().Nanoseconds() > 0 {
 			b.metrics.writeRawRetries.Inc()
 			level.Debug(b.logger).Log(
 				"msg", "batch write client failed to send profiles",
 				"retry", expbackOff.NextBackOff(),
-				"count", len(batch),
+				"count", len(r.req.Series),
 				"err", err,
 			)
 		}
 		return err
 	}, expbackOff)
 	if err != nil {
-		level.Warn(b.logger).Log("msg", "batch write client failed to send profiles", "count", len(batch), "err", err)
 		return err
 	}
+	b.metrics.writeRawBytes.Add(float64(r.req.SizeVT()))
+	return nil
+}
 
-	if len(batch) > 0 {
-		level.Debug(b.logger).Log("msg", "batch write client sent profiles", "count", len(batch))
+// tenantRequest is the part of a request sent as a tenant.
+type tenantRequest struct {
+	tenant string
+	// batched are the series as they were batched, with their tenant
+	// label.
+	batched *profilestorepb.WriteRawRequest
+	// req are the series as they are sent, without it.
+	req *profilestorepb.WriteRawRequest
+}
+
+// splitByTenant splits the request by the tenant label of its series, the
+// ones without it are sent without a tenant.
+func splitByTenant(r *profilestorepb.WriteRawRequest) []tenantRequest {
+	tenants := map[string]int{}
+	var res []tenantRequest
+	for _, series := range r.Series {
+		t, labels := tenantOf(series.Labels)
+		i, ok := tenants[t]
+		if !ok {
+			i = len(res)
+			tenants[t] = i
+			res = append(res, tenantRequest{
+				tenant:  t,
+				batched: &profilestorepb.WriteRawRequest{Normalized: r.Normalized},
+				req:     &profilestorepb.WriteRawRequest{Normalized: r.Normalized},
+			})
+		}
+		res[i].batched.Series = append(res[i].batched.Series, series)
+		if labels != series.Labels {
+			series = &profilestorepb.RawProfileSeries{Labels: labels, Samples: series.Samples}
+		}
+		res[i].req.Series = append(res[i].req.Series, series)
 	}
-	return nil
+	if len(res) == 0 || len(res) == 1 && res[0].tenant == "" {
+		// Without tenants the request is sent as it is, empty ones too.
+		return []tenantRequest{{batched: r, req: r}}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].tenant < res[j].tenant })
+	return res
+}
+
+// tenantOf returns the tenant of the labels and the labels without it.
+func tenantOf(ls *profilestorepb.LabelSet) (string, *profilestorepb.LabelSet) {
+	for i, l := range ls.GetLabels() {
+		if l.Name != string(tenant.Label) {
+			continue
+		}
+		labels := make([]*profilestorepb.Label, 0, len(ls.Labels)-1)
+		labels = append(labels, ls.Labels[:i]...)
+		labels = append(labels, ls.Labels[i+1:]...)
+		return l.Value, &profilestorepb.LabelSet{Labels: labels}
+	}
+	return "", ls
+}
+
+func (b *BatchWriteClient) replay(ctx context.Context) error {
+	// Bound the replay so the next batch is not delayed indefinitely, what
+	// is left over is picked up after the next successful batch.
+	ctx, cancel := context.WithTimeout(ctx, b.writeInterval)
+	defer cancel()
+
+	replayed := 0
+	err := b.wal.Replay(func(r *profilestorepb.WriteRawRequest) error {
+		for _, r := range splitByTenant(r) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			ctx := ctx
+			if r.tenant != "" {
+				ctx = tenant.WithTenant(ctx, r.tenant)
+			}
+			if _, err := b.writeClient.WriteRaw(ctx, r.req, b.callOptions()...); err != nil {
+				return err
+			}
+			b.metrics.writeRawBytes.Add(float64(r.req.SizeVT()))
+		}
+		replayed++
+		return nil
+	})
+	if replayed > 0 {
+		level.Info(b.logger).Log("msg", "batch write client replayed profiles from the write-ahead log", "requests", replayed)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return err
 }
 
 func isEqualLabel(a, b *profilestorepb.LabelSet) bool {
@@ -160,25 +357,42 @@ func isEqualLabel(a, b *profilestorepb.LabelSet) bool {
 	return ret
 }
 
-func findIndex(arr []*profilestorepb.RawProfileSeries, p *profilestorepb.RawProfileSeries) (int, bool) {
-	for i, val := range arr {
-		if isEqualLabel(val.Labels, p.Labels) {
-			return i, true
-		}
+// labelsKey returns a key identifying the label set, labels are expected to
+// be sorted by name.
+func labelsKey(ls *profilestorepb.LabelSet) string {
+	var sb strings.Builder
+	for _, l := range ls.GetLabels() {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0xff)
 	}
-	return -1, false
+	return sb.String()
 }
 
+// WriteRaw adds the series of the request to the current batch, merging the
+// samples of series with the same labels.
 func (b *BatchWriteClient) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 
+	if id, ok := tracer.ProfileBatchID(ctx); ok {
+		if _, seen := b.batchIDs[id]; !seen {
+			b.batchIDs[id] = struct{}{}
+			if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+				b.links = append(b.links, trace.Link{SpanContext: sc})
+			}
+		}
+	}
+
 	for _, profileSeries := range r.Series {
-		if j, ok := findIndex(b.series, profileSeries); ok {
+		key := labelsKey(profileSeries.Labels)
+		if j, ok := b.index[key]; ok {
 			b.series[j].Samples = append(b.series[j].Samples, profileSeries.Samples...)
 			continue
 		}
 
+		b.index[key] = len(b.series)
 		b.series = append(b.series, &profilestorepb.RawProfileSeries{
 			Labels:  profileSeries.Labels,
 			Samples: profileSeries.Samples,
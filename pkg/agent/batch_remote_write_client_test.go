@@ -23,6 +23,10 @@ import (
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+	"github.com/parca-dev/parca-agent/pkg/tracer"
 )
 
 func isEqualSample(a, b []*profilestorepb.RawSample) bool {
@@ -55,7 +59,7 @@ func compareProfileSeries(a, b []*profilestorepb.RawProfileSeries) bool {
 
 func TestWriteClient(t *testing.T) {
 	wc := NewNoopProfileStoreClient()
-	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, time.Second, true)
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), trace.NewNoopTracerProvider().Tracer("test"), wc, time.Second, true, nil, false)
 
 	labelset1 := profilestorepb.LabelSet{
 		Labels: []*profilestorepb.Label{{
@@ -138,3 +142,94 @@ func TestWriteClient(t *testing.T) {
 		require.Equal(t, true, compareProfileSeries(batcher.series, series))
 	})
 }
+
+func TestWriteClientCompression(t *testing.T) {
+	wc := &recordingProfileStoreClient{}
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), trace.NewNoopTracerProvider().Tracer("test"), wc, time.Second, true, nil, true)
+
+	ctx := context.Background()
+	for _, pid := range []string{"1", "2", "1"} {
+		_, err := batcher.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+			Series: []*profilestorepb.RawProfileSeries{{
+				Labels: &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{
+					{Name: "__name__", Value: "parca_agent_cpu"},
+					{Name: "pid", Value: pid},
+				}},
+				Samples: []*profilestorepb.RawSample{{RawProfile: []byte(pid)}},
+			}},
+		})
+		require.NoError(t, err)
+	}
+
+	// All the profiles of an interval are sent in a single request.
+	require.NoError(t, batcher.batch(ctx))
+	require.Len(t, wc.requests, 1)
+	require.Len(t, wc.requests[0].Series, 2)
+	require.Len(t, wc.requests[0].Series[0].Samples, 2)
+	require.Len(t, wc.requests[0].Series[1].Samples, 1)
+	require.Len(t, batcher.callOptions(), 1)
+}
+
+func TestWriteClientProfileBatchIDs(t *testing.T) {
+	wc := &recordingProfileStoreClient{}
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), trace.NewNoopTracerProvider().Tracer("test"), wc, time.Second, true, nil, false)
+
+	for _, id := range []string{"cpu-1", "cpu-2", "cpu-1"} {
+		_, err := batcher.WriteRaw(tracer.WithProfileBatchID(context.Background(), id), &profilestorepb.WriteRawRequest{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, map[string]struct{}{"cpu-1": {}, "cpu-2": {}}, batcher.batchIDs)
+
+	// The IDs are reset along with the series once the batch is sent.
+	require.NoError(t, batcher.batch(context.Background()))
+	require.Empty(t, batcher.batchIDs)
+}
+
+func TestWriteClientSendsLastBatch(t *testing.T) {
+	wc := &recordingProfileStoreClient{}
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), trace.NewNoopTracerProvider().Tracer("test"), wc, time.Hour, true, nil, false)
+
+	_, err := batcher.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels:  &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "__name__", Value: "parca_agent_cpu"}}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte("profile")}},
+		}},
+	})
+	require.NoError(t, err)
+
+	// Sent once stopped, without waiting for the write interval.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, batcher.Run(ctx), context.Canceled)
+	require.Len(t, wc.requests, 1)
+	require.Len(t, wc.requests[0].Series, 1)
+}
+
+func TestWriteClientSendsAsTenants(t *testing.T) {
+	wc := &recordingProfileStoreClient{}
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), trace.NewNoopTracerProvider().Tracer("test"), wc, time.Hour, true, nil, false)
+
+	series := func(labels ...*profilestorepb.Label) *profilestorepb.RawProfileSeries {
+		return &profilestorepb.RawProfileSeries{
+			Labels:  &profilestorepb.LabelSet{Labels: labels},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte("profile")}},
+		}
+	}
+	_, err := batcher.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{
+			series(&profilestorepb.Label{Name: "pod", Value: "a"}, &profilestorepb.Label{Name: string(tenant.Label), Value: "team-b"}),
+			series(&profilestorepb.Label{Name: "pod", Value: "b"}),
+			series(&profilestorepb.Label{Name: "pod", Value: "c"}, &profilestorepb.Label{Name: string(tenant.Label), Value: "team-a"}),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, batcher.batch(context.Background()))
+
+	// One request per tenant, without the tenant label.
+	require.Equal(t, []string{"", "team-a", "team-b"}, wc.tenants)
+	require.Len(t, wc.requests, 3)
+	for i, pod := range []string{"b", "c", "a"} {
+		require.Len(t, wc.requests[i].Series, 1)
+		require.Equal(t, []*profilestorepb.Label{{Name: "pod", Value: pod}}, wc.requests[i].Series[0].Labels.Labels)
+	}
+}
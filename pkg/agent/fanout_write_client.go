@@ -0,0 +1,154 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"google.golang.org/grpc"
+)
+
+// RemoteWriteEndpoint is a store the FanOutWriteClient sends profiles to.
+type RemoteWriteEndpoint struct {
+	Name string
+	// Client is usually a BatchWriteClient, so every endpoint has its own
+	// queue and a slow endpoint doesn't hold up the others.
+	Client profilestorepb.ProfileStoreServiceClient
+
+	mtx            sync.RWMutex
+	relabelConfigs []*relabel.Config
+}
+
+// NewRemoteWriteEndpoint creates a new RemoteWriteEndpoint, the given relabel
+// configs are applied to the profile series sent to it.
+func NewRemoteWriteEndpoint(name string, client profilestorepb.ProfileStoreServiceClient, relabelConfigs []*relabel.Config) *RemoteWriteEndpoint {
+	return &RemoteWriteEndpoint{
+		Name:           name,
+		Client:         client,
+		relabelConfigs: relabelConfigs,
+	}
+}
+
+// ApplyConfig replaces the relabel configs of the endpoint.
+func (e *RemoteWriteEndpoint) ApplyConfig(relabelConfigs []*relabel.Config) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.relabelConfigs = relabelConfigs
+}
+
+// relabel returns the request with the relabel configs of the endpoint
+// applied, series that are dropped are left out. It returns nil when no
+// series are left.
+func (e *RemoteWriteEndpoint) relabel(r *profilestorepb.WriteRawRequest) *profilestorepb.WriteRawRequest {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+
+	if len(e.relabelConfigs) == 0 {
+		return r
+	}
+
+	series := make([]*profilestorepb.RawProfileSeries, 0, len(r.Series))
+	for _, s := range r.Series {
+		lbls, keep := relabel.Process(labelSetToLabels(s.Labels), e.relabelConfigs...)
+		if !keep || lbls.IsEmpty() {
+			continue
+		}
+		series = append(series, &profilestorepb.RawProfileSeries{
+			Labels:  labelsToLabelSet(lbls),
+			Samples: s.Samples,
+		})
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
+	return &profilestorepb.WriteRawRequest{
+		Tenant:     r.Tenant,
+		Normalized: r.Normalized,
+		Series:     series,
+	}
+}
+
+// FanOutWriteClient sends every profile to all of its endpoints.
+type FanOutWriteClient struct {
+	logger    log.Logger
+	endpoints []*RemoteWriteEndpoint
+}
+
+// NewFanOutWriteClient creates a new FanOutWriteClient.
+func NewFanOutWriteClient(logger log.Logger, endpoints []*RemoteWriteEndpoint) *FanOutWriteClient {
+	return &FanOutWriteClient{
+		logger:    logger,
+		endpoints: endpoints,
+	}
+}
+
+// Endpoint returns the endpoint with the given name.
+func (c *FanOutWriteClient) Endpoint(name string) (*RemoteWriteEndpoint, bool) {
+	for _, e := range c.endpoints {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// WriteRaw passes the request to every endpoint. A failing endpoint doesn't
+// prevent the request from being passed to the others, the errors of all
+// endpoints are returned joined.
+func (c *FanOutWriteClient) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	var errs []error
+	for _, e := range c.endpoints {
+		req := e.relabel(r)
+		if req == nil {
+			continue
+		}
+		if _, err := e.Client.WriteRaw(ctx, req, opts...); err != nil {
+			level.Debug(c.logger).Log("msg", "failed to write profiles to remote write endpoint", "endpoint", e.Name, "err", err)
+			errs = append(errs, err)
+		}
+	}
+
+	return &profilestorepb.WriteRawResponse{}, errors.Join(errs...)
+}
+
+func labelSetToLabels(ls *profilestorepb.LabelSet) labels.Labels {
+	b := labels.NewScratchBuilder(len(ls.GetLabels()))
+	for _, l := range ls.GetLabels() {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+func labelsToLabelSet(lbls labels.Labels) *profilestorepb.LabelSet {
+	ls := &profilestorepb.LabelSet{
+		Labels: make([]*profilestorepb.Label, 0, lbls.Len()),
+	}
+	lbls.Range(func(l labels.Label) {
+		ls.Labels = append(ls.Labels, &profilestorepb.Label{
+			Name:  l.Name,
+			Value: l.Value,
+		})
+	})
+	return ls
+}
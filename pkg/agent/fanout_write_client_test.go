@@ -0,0 +1,101 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+)
+
+type recordingProfileStoreClient struct {
+	requests []*profilestorepb.WriteRawRequest
+	tenants  []string
+	err      error
+}
+
+func (c *recordingProfileStoreClient) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	c.requests = append(c.requests, r)
+	t, _ := tenant.FromContext(ctx)
+	c.tenants = append(c.tenants, t)
+	return &profilestorepb.WriteRawResponse{}, c.err
+}
+
+func TestFanOutWriteClient(t *testing.T) {
+	central := &recordingProfileStoreClient{err: errors.New("unreachable")}
+	team := &recordingProfileStoreClient{}
+
+	c := NewFanOutWriteClient(log.NewNopLogger(), []*RemoteWriteEndpoint{
+		NewRemoteWriteEndpoint("central", central, nil),
+		NewRemoteWriteEndpoint("team", team, []*relabel.Config{{
+			SourceLabels: model.LabelNames{"namespace"},
+			Regex:        relabel.MustNewRegexp("team-a"),
+			Action:       relabel.Keep,
+		}, {
+			Regex:  relabel.MustNewRegexp("node"),
+			Action: relabel.LabelDrop,
+		}}),
+	})
+
+	series := func(namespace string) *profilestorepb.RawProfileSeries {
+		return &profilestorepb.RawProfileSeries{
+			Labels: &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{
+				{Name: "node", Value: "n1"},
+				{Name: "namespace", Value: namespace},
+			}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte(namespace)}},
+		}
+	}
+
+	_, err := c.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Normalized: true,
+		Series:     []*profilestorepb.RawProfileSeries{series("team-a"), series("team-b")},
+	})
+	// The failing endpoint doesn't keep the request from the others.
+	require.Error(t, err)
+	require.Len(t, central.requests, 1)
+	require.Len(t, central.requests[0].Series, 2)
+
+	require.Len(t, team.requests, 1)
+	require.True(t, team.requests[0].Normalized)
+	require.Len(t, team.requests[0].Series, 1)
+	require.Equal(t, []*profilestorepb.Label{{Name: "namespace", Value: "team-a"}}, team.requests[0].Series[0].Labels.Labels)
+
+	// Requests without any series left are not passed on.
+	_, err = c.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{series("team-b")},
+	})
+	require.Error(t, err)
+	require.Len(t, central.requests, 2)
+	require.Len(t, team.requests, 1)
+
+	e, ok := c.Endpoint("team")
+	require.True(t, ok)
+	e.ApplyConfig(nil)
+
+	_, err = c.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{series("team-b")},
+	})
+	require.Error(t, err)
+	require.Len(t, team.requests, 2)
+}
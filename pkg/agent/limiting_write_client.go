@@ -0,0 +1,238 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+)
+
+const (
+	// OverflowLabel marks the series the ones over the limits are
+	// aggregated into.
+	OverflowLabel = "overflow"
+	// OverflowValue is the value of the OverflowLabel.
+	OverflowValue = "other"
+
+	// seriesTTL is how long a series counts towards the limit of series of
+	// its profile type after it was last written.
+	seriesTTL = time.Hour
+)
+
+const (
+	lvLabels           = "labels"
+	lvLabelNameLength  = "label_name_length"
+	lvLabelValueLength = "label_value_length"
+	lvSeries           = "series"
+)
+
+// LabelLimits are the limits of the labels of the profile series sent, they
+// are disabled when zero.
+type LabelLimits struct {
+	// MaxLabels is the maximum number of labels of a series.
+	MaxLabels int
+	// MaxLabelNameLength is the maximum length of a label name.
+	MaxLabelNameLength int
+	// MaxLabelValueLength is the maximum length of a label value.
+	MaxLabelValueLength int
+	// MaxSeries is the maximum number of series of a profile type written
+	// within the last hour.
+	MaxSeries int
+}
+
+type limitingMetrics struct {
+	aggregated *prometheus.CounterVec
+	series     prometheus.Gauge
+}
+
+func newLimitingMetrics(reg prometheus.Registerer) *limitingMetrics {
+	m := &limitingMetrics{
+		aggregated: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parca_agent_profile_series_aggregated_total",
+				Help: "Total number of profile series aggregated into the overflow series, by the limit they exceeded.",
+			},
+			[]string{"reason"},
+		),
+		series: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "parca_agent_profile_series",
+				Help: "Number of profile series counting towards the series limit.",
+			},
+		),
+	}
+	m.aggregated.WithLabelValues(lvLabels)
+	m.aggregated.WithLabelValues(lvLabelNameLength)
+	m.aggregated.WithLabelValues(lvLabelValueLength)
+	m.aggregated.WithLabelValues(lvSeries)
+	return m
+}
+
+// LimitingWriteClient enforces the label limits on the profiles before they
+// leave the agent, so the store is protected from label explosions, e.g.
+// caused by relabel configs. The series exceeding them are not dropped, but
+// aggregated into a series of their profile type with the OverflowLabel.
+type LimitingWriteClient struct {
+	logger  log.Logger
+	metrics *limitingMetrics
+	client  profilestorepb.ProfileStoreServiceClient
+	limits  LabelLimits
+
+	mtx sync.Mutex
+	// series are the times the series of every profile type were last
+	// written at, by the hash of their labels.
+	series map[string]map[uint64]time.Time
+	count  int
+	gcAt   time.Time
+}
+
+// NewLimitingWriteClient creates a new LimitingWriteClient.
+func NewLimitingWriteClient(logger log.Logger, reg prometheus.Registerer, client profilestorepb.ProfileStoreServiceClient, limits LabelLimits) *LimitingWriteClient {
+	return &LimitingWriteClient{
+		logger:  logger,
+		metrics: newLimitingMetrics(reg),
+		client:  client,
+		limits:  limits,
+		series:  map[string]map[uint64]time.Time{},
+	}
+}
+
+// WriteRaw passes the request on with the series over the limits aggregated.
+func (c *LimitingWriteClient) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	return c.client.WriteRaw(ctx, c.limit(r, time.Now()), opts...)
+}
+
+// limit returns the request with the series over the limits replaced by the
+// overflow series of their profile type.
+func (c *LimitingWriteClient) limit(r *profilestorepb.WriteRawRequest, now time.Time) *profilestorepb.WriteRawRequest {
+	var series []*profilestorepb.RawProfileSeries
+	for i, s := range r.Series {
+		reason := c.exceeded(s.Labels, now)
+		if reason == "" {
+			if series != nil {
+				series = append(series, s)
+			}
+			continue
+		}
+
+		c.metrics.aggregated.WithLabelValues(reason).Inc()
+		level.Debug(c.logger).Log("msg", "profile series exceeds the label limits, it is aggregated", "reason", reason, "labels", labelSetToLabels(s.Labels))
+		if series == nil {
+			series = make([]*profilestorepb.RawProfileSeries, i, len(r.Series))
+			copy(series, r.Series)
+		}
+		series = append(series, &profilestorepb.RawProfileSeries{
+			Labels:  overflowLabels(s.Labels),
+			Samples: s.Samples,
+		})
+	}
+	if series == nil {
+		return r
+	}
+
+	return &profilestorepb.WriteRawRequest{
+		Tenant:     r.Tenant,
+		Normalized: r.Normalized,
+		Series:     series,
+	}
+}
+
+// exceeded returns the limit the labels exceed, or an empty string if they
+// don't. The labels within them count towards the series of their profile
+// type.
+func (c *LimitingWriteClient) exceeded(ls *profilestorepb.LabelSet, now time.Time) string {
+	if c.limits.MaxLabels > 0 && len(ls.GetLabels()) > c.limits.MaxLabels {
+		return lvLabels
+	}
+	for _, l := range ls.GetLabels() {
+		if c.limits.MaxLabelNameLength > 0 && len(l.Name) > c.limits.MaxLabelNameLength {
+			return lvLabelNameLength
+		}
+		if c.limits.MaxLabelValueLength > 0 && len(l.Value) > c.limits.MaxLabelValueLength {
+			return lvLabelValueLength
+		}
+	}
+	if c.limits.MaxSeries <= 0 {
+		return ""
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if now.After(c.gcAt) {
+		c.gc(now)
+	}
+
+	lbls := labelSetToLabels(ls)
+	name := lbls.Get(model.MetricNameLabel)
+	series, ok := c.series[name]
+	if !ok {
+		series = map[uint64]time.Time{}
+		c.series[name] = series
+	}
+	h := lbls.Hash()
+	if _, ok := series[h]; !ok {
+		if len(series) >= c.limits.MaxSeries {
+			return lvSeries
+		}
+		c.count++
+		c.metrics.series.Set(float64(c.count))
+	}
+	series[h] = now
+	return ""
+}
+
+// gc forgets the series not written within the TTL.
+func (c *LimitingWriteClient) gc(now time.Time) {
+	for name, series := range c.series {
+		for h, t := range series {
+			if now.Sub(t) > seriesTTL {
+				delete(series, h)
+				c.count--
+			}
+		}
+		if len(series) == 0 {
+			delete(c.series, name)
+		}
+	}
+	c.metrics.series.Set(float64(c.count))
+	c.gcAt = now.Add(seriesTTL / 10)
+}
+
+// overflowLabels returns the labels of the overflow series the series with
+// the given labels is aggregated into, only its profile type and tenant are
+// kept.
+func overflowLabels(ls *profilestorepb.LabelSet) *profilestorepb.LabelSet {
+	res := &profilestorepb.LabelSet{}
+	for _, l := range ls.GetLabels() {
+		if l.Name == model.MetricNameLabel || l.Name == string(tenant.Label) {
+			res.Labels = append(res.Labels, l)
+		}
+	}
+	res.Labels = append(res.Labels, &profilestorepb.Label{Name: OverflowLabel, Value: OverflowValue})
+	sort.Slice(res.Labels, func(i, j int) bool { return res.Labels[i].Name < res.Labels[j].Name })
+	return res
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func limitedSeries(labels ...string) *profilestorepb.RawProfileSeries {
+	ls := &profilestorepb.LabelSet{}
+	for i := 0; i < len(labels); i += 2 {
+		ls.Labels = append(ls.Labels, &profilestorepb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return &profilestorepb.RawProfileSeries{
+		Labels:  ls,
+		Samples: []*profilestorepb.RawSample{{RawProfile: []byte(strings.Join(labels, ","))}},
+	}
+}
+
+func TestLimitingWriteClient(t *testing.T) {
+	wc := &recordingProfileStoreClient{}
+	c := NewLimitingWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, LabelLimits{
+		MaxLabels:           3,
+		MaxLabelNameLength:  10,
+		MaxLabelValueLength: 8,
+		MaxSeries:           2,
+	})
+
+	_, err := c.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{
+			limitedSeries("__name__", "cpu", "pod", "a"),
+			limitedSeries("__name__", "cpu", "pod", "b"),
+			limitedSeries("__name__", "cpu", "pod", "a"),
+			limitedSeries("__name__", "cpu", "pod", "c", "__tenant__", "team"),
+			limitedSeries("__name__", "memory", "pod", "c"),
+			limitedSeries("__name__", "memory", "a", "1", "b", "2", "c", "3"),
+			limitedSeries("__name__", "memory", "pod", "too long value"),
+			limitedSeries("__name__", "memory", "too long name", "c"),
+		},
+	})
+	require.NoError(t, err)
+
+	overflow := limitedSeries("__name__", "memory", OverflowLabel, OverflowValue).Labels
+	require.Len(t, wc.requests, 1)
+	series := wc.requests[0].Series
+	require.Len(t, series, 8)
+	require.True(t, isEqualLabel(limitedSeries("__name__", "cpu", "pod", "a").Labels, series[0].Labels))
+	require.True(t, isEqualLabel(limitedSeries("__name__", "cpu", "pod", "b").Labels, series[1].Labels))
+	require.True(t, isEqualLabel(limitedSeries("__name__", "cpu", "pod", "a").Labels, series[2].Labels))
+	// The third series of a profile type is aggregated, keeping its tenant.
+	require.True(t, isEqualLabel(limitedSeries("__name__", "cpu", "__tenant__", "team", OverflowLabel, OverflowValue).Labels, series[3].Labels))
+	require.True(t, isEqualLabel(limitedSeries("__name__", "memory", "pod", "c").Labels, series[4].Labels))
+	for _, s := range series[5:] {
+		require.True(t, isEqualLabel(overflow, s.Labels))
+	}
+	// The samples are kept.
+	require.Equal(t, []byte("__name__,memory,pod,too long value"), series[6].Samples[0].RawProfile)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.aggregated.WithLabelValues(lvSeries)))
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.aggregated.WithLabelValues(lvLabels)))
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.aggregated.WithLabelValues(lvLabelNameLength)))
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.aggregated.WithLabelValues(lvLabelValueLength)))
+	require.Equal(t, 3.0, testutil.ToFloat64(c.metrics.series))
+}
+
+func TestLimitingWriteClientForgetsSeries(t *testing.T) {
+	c := NewLimitingWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), &recordingProfileStoreClient{}, LabelLimits{MaxSeries: 1})
+
+	now := time.Now()
+	req := &profilestorepb.WriteRawRequest{Series: []*profilestorepb.RawProfileSeries{limitedSeries("__name__", "cpu", "pod", "a")}}
+	require.Same(t, req, c.limit(req, now))
+
+	req = &profilestorepb.WriteRawRequest{Series: []*profilestorepb.RawProfileSeries{limitedSeries("__name__", "cpu", "pod", "b")}}
+	require.NotSame(t, req, c.limit(req, now.Add(seriesTTL/2)))
+
+	// Once the first one is not written for long enough, there is room for
+	// another.
+	require.Same(t, req, c.limit(req, now.Add(seriesTTL+time.Minute)))
+}
@@ -0,0 +1,485 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/pkg/encryption"
+)
+
+const (
+	walSegmentSuffix = ".wal"
+	// Size of the length and checksum preceding every record.
+	walRecordHeaderSize = 8
+	// Segments are rolled once they grow past this fraction of the maximum
+	// size, so that the oldest data can be dropped in reasonably small units.
+	walSegmentsPerLog = 8
+)
+
+var errWALRecordCorrupt = errors.New("write-ahead log record is corrupt")
+
+type walMetrics struct {
+	appended      prometheus.Counter
+	replayed      prometheus.Counter
+	dropped       prometheus.Counter
+	corrupt       prometheus.Counter
+	size          prometheus.Gauge
+	segmentsCount prometheus.Gauge
+}
+
+func newWALMetrics(reg prometheus.Registerer) *walMetrics {
+	return &walMetrics{
+		appended: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_remote_write_wal_appended_requests_total",
+			Help: "Total number of write requests appended to the write-ahead log after failing to send them.",
+		}),
+		replayed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_remote_write_wal_replayed_requests_total",
+			Help: "Total number of write requests replayed from the write-ahead log.",
+		}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_remote_write_wal_dropped_requests_total",
+			Help: "Total number of write requests dropped from the write-ahead log because it exceeded its maximum size.",
+		}),
+		corrupt: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_remote_write_wal_corrupt_records_total",
+			Help: "Total number of corrupt records found while reading the write-ahead log.",
+		}),
+		size: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_remote_write_wal_size_bytes",
+			Help: "Current size of the write-ahead log on disk.",
+		}),
+		segmentsCount: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_remote_write_wal_segments",
+			Help: "Current number of segments in the write-ahead log.",
+		}),
+	}
+}
+
+type walSegment struct {
+	index   uint64
+	size    int64
+	records int
+}
+
+// WAL is a write-ahead log of the write requests that could not be delivered
+// to the remote store. Requests are appended to numbered segment files in the
+// given directory and replayed, oldest first, once the store is reachable
+// again. The log survives restarts of the agent.
+//
+// Each record in a segment is laid out as:
+//
+//	length u32 | crc32 u32 | serialized WriteRawRequest
+//
+// The total size of the log is bounded; once it is exceeded the oldest
+// segments are dropped. Segments that were only partially replayed are
+// compacted so the delivered records are not sent again.
+//
+// When a cipher is given, the serialized requests are encrypted, and the
+// records that can't be decrypted with it are skipped on replay.
+type WAL struct {
+	logger  log.Logger
+	metrics *walMetrics
+	dir     string
+	cipher  *encryption.Cipher
+
+	maxSize     int64
+	segmentSize int64
+
+	mtx      sync.Mutex
+	segments []*walSegment
+	// head is the segment requests are appended to, it is always the last
+	// one of segments when not nil.
+	head *os.File
+}
+
+// NewWAL opens the write-ahead log in the given directory, creating it if
+// needed, and picks up the segments left over from previous runs. The cipher
+// is nil when the log isn't encrypted.
+func NewWAL(logger log.Logger, reg prometheus.Registerer, dir string, maxSize int64, cipher *encryption.Cipher) (*WAL, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid maximum write-ahead log size %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create write-ahead log directory: %w", err)
+	}
+
+	w := &WAL{
+		logger:      logger,
+		metrics:     newWALMetrics(reg),
+		dir:         dir,
+		cipher:      cipher,
+		maxSize:     maxSize,
+		segmentSize: maxSize / walSegmentsPerLog,
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) path(index uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", index, walSegmentSuffix))
+}
+
+// load discovers the existing segments. Segments are never appended to after
+// a restart; a torn write at the end of the last one is skipped on replay.
+func (w *WAL) load() error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read write-ahead log directory: %w", err)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		index, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat write-ahead log segment: %w", err)
+		}
+		if info.Size() == 0 {
+			os.Remove(w.path(index))
+			continue
+		}
+		w.segments = append(w.segments, &walSegment{index: index, size: info.Size()})
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].index < w.segments[j].index })
+
+	if len(w.segments) > 0 {
+		level.Info(w.logger).Log("msg", "found write-ahead log segments to replay", "segments", len(w.segments), "size", w.totalSize())
+	}
+	w.updateMetrics()
+	return nil
+}
+
+func (w *WAL) totalSize() int64 {
+	var size int64
+	for _, s := range w.segments {
+		size += s.size
+	}
+	return size
+}
+
+func (w *WAL) updateMetrics() {
+	w.metrics.size.Set(float64(w.totalSize()))
+	w.metrics.segmentsCount.Set(float64(len(w.segments)))
+}
+
+// Empty reports whether there is nothing left to replay.
+func (w *WAL) Empty() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return len(w.segments) == 0
+}
+
+// Append persists the given request.
+func (w *WAL) Append(r *profilestorepb.WriteRawRequest) error {
+	payload, err := r.MarshalVT()
+	if err != nil {
+		return fmt.Errorf("failed to marshal write request: %w", err)
+	}
+	if w.cipher != nil {
+		payload, err = w.cipher.Seal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt write request: %w", err)
+		}
+	}
+	if int64(len(payload)+walRecordHeaderSize) > w.maxSize {
+		w.metrics.dropped.Inc()
+		return fmt.Errorf("write request of %d bytes exceeds the maximum write-ahead log size", len(payload))
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.head == nil || w.segments[len(w.segments)-1].size >= w.segmentSize {
+		if err := w.roll(); err != nil {
+			return err
+		}
+	}
+
+	rec := encodeWALRecord(payload)
+	head := w.segments[len(w.segments)-1]
+	if _, err := w.head.Write(rec); err != nil {
+		// Don't leave a torn record behind that later appends would follow.
+		w.closeHead()
+		return fmt.Errorf("failed to write write-ahead log record: %w", err)
+	}
+	head.size += int64(len(rec))
+	head.records++
+	w.metrics.appended.Inc()
+
+	w.truncate()
+	w.updateMetrics()
+	return nil
+}
+
+// roll closes the current head segment and starts a new one.
+func (w *WAL) roll() error {
+	w.closeHead()
+
+	var index uint64
+	if len(w.segments) > 0 {
+		index = w.segments[len(w.segments)-1].index + 1
+	}
+	f, err := os.OpenFile(w.path(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create write-ahead log segment: %w", err)
+	}
+	w.head = f
+	w.segments = append(w.segments, &walSegment{index: index})
+	return nil
+}
+
+func (w *WAL) closeHead() {
+	if w.head == nil {
+		return
+	}
+	if err := w.head.Close(); err != nil {
+		level.Debug(w.logger).Log("msg", "failed to close write-ahead log segment", "err", err)
+	}
+	w.head = nil
+}
+
+// truncate drops the oldest segments until the log fits its maximum size.
+// The head segment is never dropped.
+func (w *WAL) truncate() {
+	for len(w.segments) > 1 && w.totalSize() > w.maxSize {
+		s := w.segments[0]
+		records := s.records
+		if records == 0 {
+			// Segments from previous runs haven't been counted.
+			records = w.countRecords(w.path(s.index))
+		}
+		if err := os.Remove(w.path(s.index)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			level.Warn(w.logger).Log("msg", "failed to remove write-ahead log segment", "segment", s.index, "err", err)
+		}
+		w.segments = w.segments[1:]
+		w.metrics.dropped.Add(float64(records))
+		level.Warn(w.logger).Log("msg", "write-ahead log exceeded its maximum size, dropped oldest profiles", "segment", s.index, "requests", records)
+	}
+}
+
+// Replay passes the logged requests to send, oldest first, until send fails
+// or the log is exhausted. Delivered requests are removed from the log.
+func (w *WAL) Replay(send func(*profilestorepb.WriteRawRequest) error) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	// Seal the head so it can be replayed as any other segment, new
+	// requests go to a fresh one.
+	w.closeHead()
+	defer w.updateMetrics()
+
+	for len(w.segments) > 0 {
+		s := w.segments[0]
+		sent, err := w.replaySegment(s, send)
+		if err != nil {
+			if sent > 0 {
+				w.compact(s, sent)
+			}
+			return err
+		}
+		if err := os.Remove(w.path(s.index)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			level.Warn(w.logger).Log("msg", "failed to remove write-ahead log segment", "segment", s.index, "err", err)
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// replaySegment returns the number of records that were delivered.
+func (w *WAL) replaySegment(s *walSegment, send func(*profilestorepb.WriteRawRequest) error) (int, error) {
+	f, err := os.Open(w.path(s.index))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open write-ahead log segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	sent := 0
+	for {
+		payload, err := readWALRecord(r, w.maxSize)
+		if errors.Is(err, io.EOF) {
+			return sent, nil
+		}
+		if err != nil {
+			// Nothing after a corrupt record can be trusted, most likely a
+			// write was torn by a crash.
+			w.metrics.corrupt.Inc()
+			level.Warn(w.logger).Log("msg", "skipping rest of corrupt write-ahead log segment", "segment", s.index, "err", err)
+			return sent, nil
+		}
+		if w.cipher != nil {
+			payload, err = w.cipher.Open(payload)
+			if err != nil {
+				// Most likely written with another key, or without encryption.
+				w.metrics.corrupt.Inc()
+				level.Warn(w.logger).Log("msg", "skipping undecryptable write-ahead log record", "segment", s.index, "err", err)
+				sent++
+				continue
+			}
+		}
+
+		req := &profilestorepb.WriteRawRequest{}
+		if err := req.UnmarshalVT(payload); err != nil {
+			w.metrics.corrupt.Inc()
+			level.Warn(w.logger).Log("msg", "skipping undecodable write-ahead log record", "segment", s.index, "err", err)
+			sent++
+			continue
+		}
+		if err := send(req); err != nil {
+			return sent, err
+		}
+		w.metrics.replayed.Inc()
+		sent++
+	}
+}
+
+// compact rewrites the segment without its first n records.
+func (w *WAL) compact(s *walSegment, n int) {
+	p := w.path(s.index)
+	if err := w.compactSegment(p, n); err != nil {
+		// The delivered records will be sent again, which the store
+		// tolerates better than losing the rest of the segment.
+		level.Warn(w.logger).Log("msg", "failed to compact write-ahead log segment", "segment", s.index, "err", err)
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+	s.size = info.Size()
+	if s.records >= n {
+		s.records -= n
+	}
+}
+
+func (w *WAL) compactSegment(p string, n int) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	r := bufio.NewReader(src)
+	for i := 0; i < n; i++ {
+		if _, err := readWALRecord(r, w.maxSize); err != nil {
+			return err
+		}
+	}
+
+	dst, err := os.CreateTemp(w.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(dst.Name())
+
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to copy remaining records: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(dst.Name(), p); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
+
+// Close closes the head segment, the log can be reopened with NewWAL.
+func (w *WAL) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.closeHead()
+	return nil
+}
+
+func encodeWALRecord(payload []byte) []byte {
+	rec := make([]byte, walRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	copy(rec[walRecordHeaderSize:], payload)
+	return rec
+}
+
+func readWALRecord(r io.Reader, maxSize int64) ([]byte, error) {
+	var header [walRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("truncated header: %w", errWALRecordCorrupt)
+	}
+
+	length := int64(binary.LittleEndian.Uint32(header[0:]))
+	if length > maxSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the maximum size: %w", length, errWALRecordCorrupt)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("truncated payload: %w", errWALRecordCorrupt)
+	}
+	if binary.LittleEndian.Uint32(header[4:]) != crc32.ChecksumIEEE(payload) {
+		return nil, fmt.Errorf("checksum mismatch: %w", errWALRecordCorrupt)
+	}
+	return payload, nil
+}
+
+func (w *WAL) countRecords(p string) int {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	n := 0
+	for {
+		if _, err := readWALRecord(r, w.maxSize); err != nil {
+			return n
+		}
+		n++
+	}
+}
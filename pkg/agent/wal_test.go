@@ -0,0 +1,169 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-kit/log"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/encryption"
+)
+
+func walTestRequest(name string) *profilestorepb.WriteRawRequest {
+	return &profilestorepb.WriteRawRequest{
+		Normalized: true,
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels: &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{
+				Name:  "name",
+				Value: name,
+			}}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: make([]byte, 64)}},
+		}},
+	}
+}
+
+func walTestName(r *profilestorepb.WriteRawRequest) string {
+	return r.Series[0].Labels.Labels[0].Value
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20, nil)
+	require.NoError(t, err)
+	require.True(t, w.Empty())
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, w.Append(walTestRequest(name)))
+	}
+	require.False(t, w.Empty())
+	require.NoError(t, w.Close())
+
+	// Segments left over from a previous run are picked up.
+	w, err = NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20, nil)
+	require.NoError(t, err)
+	require.False(t, w.Empty())
+
+	errUnreachable := errors.New("unreachable")
+	var sent []string
+	err = w.Replay(func(r *profilestorepb.WriteRawRequest) error {
+		if len(sent) == 1 {
+			return errUnreachable
+		}
+		require.True(t, r.Normalized)
+		sent = append(sent, walTestName(r))
+		return nil
+	})
+	require.ErrorIs(t, err, errUnreachable)
+	require.Equal(t, []string{"a"}, sent)
+
+	// The delivered request has been compacted away.
+	sent = nil
+	require.NoError(t, w.Replay(func(r *profilestorepb.WriteRawRequest) error {
+		sent = append(sent, walTestName(r))
+		return nil
+	}))
+	require.Equal(t, []string{"b", "c"}, sent)
+	require.True(t, w.Empty())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestWALMaxSize(t *testing.T) {
+	payload, err := walTestRequest("a").MarshalVT()
+	require.NoError(t, err)
+	recordSize := int64(walRecordHeaderSize + len(payload))
+
+	// Every segment holds a single record.
+	w, err := NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), recordSize*walSegmentsPerLog/2, nil)
+	require.NoError(t, err)
+
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for _, name := range names {
+		require.NoError(t, w.Append(walTestRequest(name)))
+	}
+
+	var sent []string
+	require.NoError(t, w.Replay(func(r *profilestorepb.WriteRawRequest) error {
+		sent = append(sent, walTestName(r))
+		return nil
+	}))
+	require.Equal(t, []string{"c", "d", "e", "f"}, sent)
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20, nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Append(walTestRequest("a")))
+	require.NoError(t, w.Append(walTestRequest("b")))
+	require.NoError(t, w.Close())
+
+	// Simulate a write torn by a crash.
+	p := w.path(0)
+	info, err := os.Stat(p)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(p, info.Size()-1))
+
+	w, err = NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20, nil)
+	require.NoError(t, err)
+
+	var sent []string
+	require.NoError(t, w.Replay(func(r *profilestorepb.WriteRawRequest) error {
+		sent = append(sent, walTestName(r))
+		return nil
+	}))
+	require.Equal(t, []string{"a"}, sent)
+	require.True(t, w.Empty())
+}
+
+func TestWALEncryption(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	w, err := NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20, c)
+	require.NoError(t, err)
+	require.NoError(t, w.Append(walTestRequest("secret")))
+	require.NoError(t, w.Close())
+
+	data, err := os.ReadFile(w.path(0))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "secret")
+
+	// Records encrypted with another key are skipped.
+	other, err := encryption.NewCipher(bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, err)
+	w, err = NewWAL(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20, other)
+	require.NoError(t, err)
+	require.NoError(t, w.Append(walTestRequest("other")))
+
+	var sent []string
+	require.NoError(t, w.Replay(func(r *profilestorepb.WriteRawRequest) error {
+		sent = append(sent, walTestName(r))
+		return nil
+	}))
+	require.Equal(t, []string{"other"}, sent)
+	require.True(t, w.Empty())
+}
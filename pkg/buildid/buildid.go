@@ -15,6 +15,7 @@ package buildid
 
 import (
 	"debug/elf"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -33,6 +34,11 @@ import (
 // - Move files here from internal package to simplify things.
 
 // NOTICE: This is temporary for the first iteration. We will refactor this.
+//
+// BuildID returns the Go or GNU build ID of the given ELF file, or else a hash
+// of its contents, as the ones built by some toolchains, such as embedded ones,
+// have neither. The unwind tables, the uploaded debuginfo and the mappings of
+// the profiles are all keyed by it.
 func BuildID(f *os.File, ef *elf.File) (string, error) {
 	hasGoBuildIDSection := false
 	for _, s := range ef.Sections {
@@ -134,21 +140,38 @@ func elfBuildID(f *os.File, ef *elf.File) (string, error) {
 	}
 
 	if b == nil {
-		h := xxhash.New()
-		text := ef.Section(".text")
-		if text == nil {
-			return "", errors.New("could not find .text section")
-		}
-		if _, err := io.Copy(h, text.Open()); err != nil {
-			return "", fmt.Errorf("hash elf .text section: %w", err)
+		h, err := contentHash(ef)
+		if err != nil {
+			return "", err
 		}
-
-		return hex.EncodeToString(h.Sum(nil)), nil
+		return hex.EncodeToString(h), nil
 	}
 
 	return hex.EncodeToString(b), nil
 }
 
+// contentHash hashes the program headers and the .text section of the given
+// ELF file. Unlike the .text section alone, the program headers tell apart
+// binaries whose code is the same but whose data or layout differ.
+func contentHash(ef *elf.File) ([]byte, error) {
+	text := ef.Section(".text")
+	if text == nil {
+		return nil, errors.New("could not find .text section")
+	}
+
+	h := xxhash.New()
+	for _, p := range ef.Progs {
+		header := []uint64{uint64(p.Type), uint64(p.Flags), p.Off, p.Vaddr, p.Paddr, p.Filesz, p.Memsz, p.Align}
+		if err := binary.Write(h, ef.ByteOrder, header); err != nil {
+			return nil, fmt.Errorf("hash elf program headers: %w", err)
+		}
+	}
+	if _, err := io.Copy(h, text.Open()); err != nil {
+		return nil, fmt.Errorf("hash elf .text section: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
 func rewind(f io.ReadSeeker) error {
 	_, err := f.Seek(0, io.SeekStart)
 	return err
@@ -137,7 +137,7 @@ func Test_elfBuildID(t *testing.T) {
 			args: args{
 				path: "./testdata/readelf-sections",
 			},
-			want: "bd1ca7c3af25af95", // fallbacks to hash of .text
+			want: "2e22f9e0f78f5cd4", // fallbacks to hash of the program headers and .text
 		},
 		{
 			name: "rust binary",
@@ -205,3 +205,21 @@ func Test_fastGoBuildID(t *testing.T) {
 		})
 	}
 }
+
+func Test_contentHash(t *testing.T) {
+	ef, err := elf.Open("./testdata/readelf-sections")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		ef.Close()
+	})
+
+	h, err := contentHash(ef)
+	require.NoError(t, err)
+	require.Equal(t, "2e22f9e0f78f5cd4", hex.EncodeToString(h))
+
+	// The same code laid out differently is told apart.
+	ef.Progs[0].Vaddr += 0x1000
+	moved, err := contentHash(ef)
+	require.NoError(t, err)
+	require.NotEqual(t, h, moved)
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/goburrow/cache"
+)
+
+// Sizer is implemented by the components holding caches, to report how many
+// entries they hold, keyed by the names of the caches.
+type Sizer interface {
+	CacheSizes() map[string]int
+}
+
+// SizedCache is a Cache that keeps track of how many entries it holds, which
+// the caches of goburrow/cache don't expose.
+type SizedCache struct {
+	cache.Cache
+
+	mtx  sync.Mutex
+	keys map[cache.Key]struct{}
+}
+
+// NewSizedCache creates a cache with the given options that keeps track of
+// how many entries it holds. The options must not set a removal listener.
+func NewSizedCache(options ...cache.Option) *SizedCache {
+	c := &SizedCache{keys: map[cache.Key]struct{}{}}
+	c.Cache = cache.New(append(options, cache.WithRemovalListener(c.onRemoval))...)
+	return c
+}
+
+func (c *SizedCache) Put(k cache.Key, v cache.Value) {
+	c.mtx.Lock()
+	c.keys[k] = struct{}{}
+	c.mtx.Unlock()
+	c.Cache.Put(k, v)
+}
+
+// onRemoval is called once the cache has removed an entry, either evicted,
+// expired or invalidated.
+func (c *SizedCache) onRemoval(k cache.Key, _ cache.Value) {
+	c.mtx.Lock()
+	delete(c.keys, k)
+	c.mtx.Unlock()
+}
+
+// Len returns how many entries the cache holds, including the expired ones
+// it hasn't removed yet.
+func (c *SizedCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.keys)
+}
+
+// Len returns how many entries the given cache holds, or 0 when it doesn't
+// keep track of them.
+func Len(c cache.Cache) int {
+	if s, ok := c.(*SizedCache); ok {
+		return s.Len()
+	}
+	return 0
+}
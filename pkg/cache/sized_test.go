@@ -0,0 +1,41 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goburrow/cache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizedCache(t *testing.T) {
+	c := NewSizedCache(cache.WithMaximumSize(2))
+	t.Cleanup(func() { c.Close() })
+
+	c.Put("a", 1)
+	c.Put("a", 2)
+	c.Put("b", 1)
+	require.Equal(t, 2, Len(c))
+
+	// Over the maximum size, an entry is evicted.
+	c.Put("c", 1)
+	require.Eventually(t, func() bool { return c.Len() == 2 }, time.Second, time.Millisecond)
+
+	c.InvalidateAll()
+	require.Eventually(t, func() bool { return c.Len() == 0 }, time.Second, time.Millisecond)
+
+	require.Equal(t, 0, Len(NewNoopCache()))
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package capability
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/parca-dev/parca-agent/pkg/kconfig"
+)
+
+// Capability is a Linux capability, see capabilities(7).
+type Capability uint
+
+// The capabilities the agent may need.
+const (
+	SysPtrace   Capability = 19
+	SysAdmin    Capability = 21
+	SysResource Capability = 24
+	Syslog      Capability = 34
+	Perfmon     Capability = 38
+	BPF         Capability = 39
+)
+
+var names = map[Capability]string{
+	SysPtrace:   "CAP_SYS_PTRACE",
+	SysAdmin:    "CAP_SYS_ADMIN",
+	SysResource: "CAP_SYS_RESOURCE",
+	Syslog:      "CAP_SYSLOG",
+	Perfmon:     "CAP_PERFMON",
+	BPF:         "CAP_BPF",
+}
+
+func (c Capability) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return "CAP_" + strconv.Itoa(int(c))
+}
+
+// Set is a set of capabilities, as a bitmask.
+type Set uint64
+
+// Has returns whether the set holds the given capability.
+func (s Set) Has(c Capability) bool {
+	return s&(1<<c) != 0
+}
+
+// Missing returns the given capabilities the set doesn't hold.
+// CAP_SYS_ADMIN holds the capabilities split from it.
+func (s Set) Missing(caps []Capability) []Capability {
+	var missing []Capability
+	for _, c := range caps {
+		if s.Has(c) || ((c == BPF || c == Perfmon) && s.Has(SysAdmin)) {
+			continue
+		}
+		missing = append(missing, c)
+	}
+	return missing
+}
+
+// Needed returns the minimal set of capabilities the agent needs on a kernel
+// of the given version:
+//   - CAP_BPF and CAP_PERFMON, or CAP_SYS_ADMIN before they were split from
+//     it in 5.8, to load the BPF programs and open perf events.
+//   - CAP_SYS_PTRACE to read the memory, mappings and files of other
+//     processes.
+//   - CAP_SYSLOG to read the addresses of kernel symbols when
+//     kernel.kptr_restrict is 1.
+//   - CAP_SYS_RESOURCE to raise the memlock limit before BPF memory was
+//     accounted to the memory cgroup in 5.11.
+func Needed(version kconfig.Version) []Capability {
+	caps := []Capability{SysPtrace, Syslog}
+	if version.AtLeast(5, 8) {
+		caps = append(caps, BPF, Perfmon)
+	} else {
+		caps = append(caps, SysAdmin)
+	}
+	if !version.AtLeast(5, 11) {
+		caps = append(caps, SysResource)
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i] < caps[j] })
+	return caps
+}
+
+// Effective returns the effective capabilities of the current process.
+func Effective() (Set, error) {
+	return current("CapEff")
+}
+
+// Permitted returns the permitted capabilities of the current process.
+func Permitted() (Set, error) {
+	return current("CapPrm")
+}
+
+func current(field string) (Set, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseStatus(f, field)
+}
+
+// parseStatus reads a capability set from a /proc/<pid>/status file.
+func parseStatus(r io.Reader, field string) (Set, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		k, v, ok := strings.Cut(s.Text(), ":")
+		if !ok || k != field {
+			continue
+		}
+		set, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s capabilities %q: %w", field, v, err)
+		}
+		return Set(set), nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no %s capabilities in status", field)
+}
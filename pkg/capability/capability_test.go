@@ -0,0 +1,77 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package capability
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/kconfig"
+)
+
+func TestParseStatus(t *testing.T) {
+	status := `Name:	parca-agent
+Uid:	0	0	0	0
+CapInh:	0000000000000000
+CapPrm:	000001ffffffffff
+CapEff:	000000c000200000
+CapBnd:	000001ffffffffff
+`
+	set, err := parseStatus(strings.NewReader(status), "CapEff")
+	require.NoError(t, err)
+	require.True(t, set.Has(SysAdmin))
+	require.True(t, set.Has(BPF))
+	require.True(t, set.Has(Perfmon))
+	require.False(t, set.Has(SysPtrace))
+
+	_, err = parseStatus(strings.NewReader("Name:	cat\n"), "CapEff")
+	require.Error(t, err)
+
+	require.Equal(t, "CAP_PERFMON", Perfmon.String())
+	require.Equal(t, "CAP_40", Capability(40).String())
+}
+
+func TestNeeded(t *testing.T) {
+	require.Equal(t,
+		[]Capability{SysPtrace, SysAdmin, SysResource, Syslog},
+		Needed(kconfig.Version{Major: 4, Minor: 18}),
+	)
+	require.Equal(t,
+		[]Capability{SysPtrace, SysResource, Syslog, Perfmon, BPF},
+		Needed(kconfig.Version{Major: 5, Minor: 10}),
+	)
+	require.Equal(t,
+		[]Capability{SysPtrace, Syslog, Perfmon, BPF},
+		Needed(kconfig.Version{Major: 6, Minor: 1}),
+	)
+}
+
+func TestMissing(t *testing.T) {
+	caps := Needed(kconfig.Version{Major: 6, Minor: 1})
+	require.Equal(t, caps, Set(0).Missing(caps))
+	require.Equal(t, []Capability{SysPtrace, Syslog}, Set(1<<SysAdmin).Missing(caps))
+	require.Empty(t, Set(1<<SysPtrace|1<<Syslog|1<<Perfmon|1<<BPF).Missing(caps))
+}
+
+func TestReduced(t *testing.T) {
+	permitted := Set(1<<SysAdmin | 1<<Perfmon | 1<<BPF | 1<<SysPtrace)
+	require.Equal(t,
+		Set(1<<Perfmon|1<<BPF|1<<SysPtrace),
+		reduced(permitted, Needed(kconfig.Version{Major: 6, Minor: 1})),
+	)
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package capability
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Secure bits, see capabilities(7), keeping root from regaining every
+// capability on exec.
+const (
+	secbitNoroot       = 1 << 0
+	secbitNorootLocked = 1 << 1
+)
+
+// Reduce re-executes the current program with only the given capabilities,
+// out of the permitted ones. They are kept across the exec as ambient
+// capabilities, and every other one is dropped from the bounding set so it
+// can't be regained. It returns without re-executing when the program
+// already runs with them only.
+//
+// Capabilities belong to threads, and can only be changed by the thread
+// itself, so re-executing from a single thread is the only way to drop them
+// from every thread of a Go program.
+func Reduce(keep []Capability) error {
+	permitted, err := Permitted()
+	if err != nil {
+		return fmt.Errorf("failed to read permitted capabilities: %w", err)
+	}
+	target := reduced(permitted, keep)
+	if permitted == target {
+		return nil
+	}
+
+	// Exec must happen from the thread whose capabilities are changed. It
+	// is never unlocked: on errors the thread is left with the reduced
+	// capabilities, and is thrown away when the goroutine exits.
+	runtime.LockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_SECUREBITS, secbitNoroot|secbitNorootLocked, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set secure bits: %w", err)
+	}
+	for c := Capability(0); c <= unix.CAP_LAST_CAP; c++ {
+		if target.Has(c) {
+			continue
+		}
+		// Capabilities unknown to the running kernel are invalid.
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("failed to drop %s from the bounding set: %w", c, err)
+		}
+	}
+
+	data := [2]unix.CapUserData{}
+	for i := range data {
+		bits := uint32(target >> (32 * i))
+		data[i] = unix.CapUserData{Effective: bits, Permitted: bits, Inheritable: bits}
+	}
+	if err := unix.Capset(&unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+	for c := Capability(0); c <= unix.CAP_LAST_CAP; c++ {
+		if !target.Has(c) {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("failed to raise ambient %s: %w", c, err)
+		}
+	}
+
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+// reduced returns the given capabilities that are permitted.
+func reduced(permitted Set, keep []Capability) Set {
+	var s Set
+	for _, c := range keep {
+		if permitted.Has(c) {
+			s |= 1 << c
+		}
+	}
+	return s
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// Kubernetes QoS classes, as in the status of pods.
+const (
+	QoSClassGuaranteed = "Guaranteed"
+	QoSClassBurstable  = "Burstable"
+	QoSClassBestEffort = "BestEffort"
+)
+
+// Attribution is the workload a cgroup belongs to, as far as it can be told
+// from its path.
+type Attribution struct {
+	// Kubernetes QoS class of the pod, if the cgroup belongs to one.
+	QoSClass string
+	// Container runtime of the container, if the cgroup belongs to one and
+	// the runtime can be told.
+	ContainerRuntime string
+}
+
+// Leaves of container cgroups, for both the systemd and cgroupfs drivers,
+// e.g. "docker-<id>.scope" and "docker/<id>".
+var containerScopes = []struct {
+	re      *regexp.Regexp
+	runtime string
+}{
+	{regexp.MustCompile(`^docker-[0-9a-f]{64}\.scope$`), "docker"},
+	{regexp.MustCompile(`^cri-containerd-[0-9a-f]{64}\.scope$`), "containerd"},
+	{regexp.MustCompile(`^crio-[0-9a-f]{64}\.scope$`), "cri-o"},
+	{regexp.MustCompile(`^libpod-[0-9a-f]{64}\.scope$`), "podman"},
+}
+
+var (
+	containerParents = map[string]string{
+		"docker":        "docker",
+		"libpod_parent": "podman",
+	}
+	containerID          = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	containerIDInSegment = regexp.MustCompile(`(?:^|-)([0-9a-f]{64})(?:\.scope)?$`)
+)
+
+// UnifiedPath returns the cgroup v2 path of a process. On hosts without the
+// unified hierarchy, or where it holds no path for the process, it returns the
+// path of the container group instead, so mixed cgroup v1 and v2 hosts
+// attribute processes alike.
+func UnifiedPath(cgroups []procfs.Cgroup) string {
+	for _, cg := range cgroups {
+		if cg.HierarchyID == 0 && len(cg.Controllers) == 0 && cg.Path != "/" && cg.Path != "" {
+			return cg.Path
+		}
+	}
+	return FindContainerGroup(cgroups).Path
+}
+
+// Attribute returns the workload the cgroup with the given path belongs to.
+func Attribute(path string) Attribution {
+	var a Attribution
+
+	parent := ""
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if a.QoSClass == "" || a.QoSClass == QoSClassGuaranteed {
+			if qos := qosClass(segment); qos != "" {
+				a.QoSClass = qos
+			}
+		}
+
+		for _, s := range containerScopes {
+			if s.re.MatchString(segment) {
+				a.ContainerRuntime = s.runtime
+			}
+		}
+		if containerID.MatchString(segment) {
+			// The cgroupfs driver of Kubernetes doesn't tell the runtime.
+			a.ContainerRuntime = containerParents[parent]
+		}
+		parent = segment
+	}
+	return a
+}
+
+// ContainerID returns the ID of the container the cgroup with the given path
+// belongs to, or an empty string if it doesn't belong to one.
+func ContainerID(path string) string {
+	segments := strings.Split(path, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if m := containerIDInSegment.FindStringSubmatch(segments[i]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// qosClass returns the QoS class of a Kubernetes cgroup from one of its
+// segments, e.g. "kubepods-burstable.slice" or "besteffort". Pods in the
+// "kubepods" cgroup itself are guaranteed.
+func qosClass(segment string) string {
+	segment = strings.TrimSuffix(segment, ".slice")
+	switch {
+	case segment == "kubepods":
+		return QoSClassGuaranteed
+	case segment == "burstable" || segment == "kubepods-burstable":
+		return QoSClassBurstable
+	case segment == "besteffort" || segment == "kubepods-besteffort":
+		return QoSClassBestEffort
+	}
+	return ""
+}
@@ -22,58 +22,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"unsafe"
 
-	"github.com/prometheus/procfs"
+	"github.com/parca-dev/parca-agent/internal/procfs"
 )
 
-/*
-#define _GNU_SOURCE
-#include <stdlib.h>
-#include <stdio.h>
-#include <sys/types.h>
-#include <sys/stat.h>
-#include <fcntl.h>
-#include <stdint.h>
-
-struct cgid_file_handle
-{
-  //struct file_handle handle;
-  unsigned int handle_bytes;
-  int handle_type;
-  uint64_t cgid;
-};
-
-uint64_t get_cgroupid(char *path) {
-  struct cgid_file_handle *h;
-  int mount_id;
-  int err;
-  uint64_t ret;
-
-  h = malloc(sizeof(struct cgid_file_handle));
-  if (!h)
-    return 0;
-
-  h->handle_bytes = 8;
-  err = name_to_handle_at(AT_FDCWD, path, (struct file_handle *)h, &mount_id, 0);
-  if (err != 0) {
-    free(h);
-    return 0;
-  }
-
-  if (h->handle_bytes != 8) {
-    free(h);
-    return 0;
-  }
-
-  ret = h->cgid;
-  free(h);
-
-  return ret;
-}
-*/
-import "C"
-
 // FindContainerGroup returns the cgroup with the cpu controller or first systemd slice cgroup.
 func FindContainerGroup(cgroups []procfs.Cgroup) procfs.Cgroup {
 	// If only 1 cgroup, simply return it
@@ -119,17 +71,6 @@ func PathV2AddMountpoint(path string) (string, error) {
 	return pathWithMountpoint, nil
 }
 
-// ID returns the cgroup2 ID of a path.
-func ID(pathWithMountpoint string) (uint64, error) {
-	cPathWithMountpoint := C.CString(pathWithMountpoint)
-	ret := uint64(C.get_cgroupid(cPathWithMountpoint))
-	C.free(unsafe.Pointer(cPathWithMountpoint))
-	if ret == 0 {
-		return 0, fmt.Errorf("GetCgroupID on %q failed", pathWithMountpoint)
-	}
-	return ret, nil
-}
-
 // Paths returns the cgroup1 and cgroup2 paths of a process.
 // It does not include the "/sys/fs/cgroup/{unified,systemd,}" prefix.
 func Paths(pid int) (string, string, error) {
@@ -0,0 +1,95 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+#define _GNU_SOURCE
+#include <stdlib.h>
+#include <stdio.h>
+#include <sys/types.h>
+#include <sys/stat.h>
+#include <fcntl.h>
+#include <stdint.h>
+
+struct cgid_file_handle
+{
+  //struct file_handle handle;
+  unsigned int handle_bytes;
+  int handle_type;
+  uint64_t cgid;
+};
+
+uint64_t get_cgroupid(char *path) {
+  struct cgid_file_handle *h;
+  int mount_id;
+  int err;
+  uint64_t ret;
+
+  h = malloc(sizeof(struct cgid_file_handle));
+  if (!h)
+    return 0;
+
+  h->handle_bytes = 8;
+  err = name_to_handle_at(AT_FDCWD, path, (struct file_handle *)h, &mount_id, 0);
+  if (err != 0) {
+    free(h);
+    return 0;
+  }
+
+  if (h->handle_bytes != 8) {
+    free(h);
+    return 0;
+  }
+
+  ret = h->cgid;
+  free(h);
+
+  return ret;
+}
+*/
+import "C"
+
+// V2Mountpoint returns where the cgroup2 hierarchy is mounted, on hybrid
+// systems as well as on unified ones. It errors on systems using cgroup1 only.
+func V2Mountpoint() (string, error) {
+	for _, path := range []string{"/sys/fs/cgroup/unified", "/sys/fs/cgroup"} {
+		var st unix.Statfs_t
+		if err := unix.Statfs(path, &st); err != nil {
+			continue
+		}
+		if st.Type == unix.CGROUP2_SUPER_MAGIC {
+			return path, nil
+		}
+	}
+	return "", errors.New("no cgroup2 hierarchy is mounted")
+}
+
+// ID returns the cgroup2 ID of a path.
+func ID(pathWithMountpoint string) (uint64, error) {
+	cPathWithMountpoint := C.CString(pathWithMountpoint)
+	ret := uint64(C.get_cgroupid(cPathWithMountpoint))
+	C.free(unsafe.Pointer(cPathWithMountpoint))
+	if ret == 0 {
+		return 0, fmt.Errorf("GetCgroupID on %q failed", pathWithMountpoint)
+	}
+	return ret, nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package cgroup
+
+import "errors"
+
+var errUnsupported = errors.New("cgroups are only supported on Linux")
+
+// V2Mountpoint returns where the cgroup2 hierarchy is mounted.
+func V2Mountpoint() (string, error) {
+	return "", errUnsupported
+}
+
+// ID returns the cgroup2 ID of a path.
+func ID(string) (uint64, error) {
+	return 0, errUnsupported
+}
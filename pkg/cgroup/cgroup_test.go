@@ -199,3 +199,102 @@ func TestFindFirstCPUCgroup(t *testing.T) {
 		})
 	}
 }
+
+func TestUnifiedPath(t *testing.T) {
+	const scope = "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1ff39434b35faeef64159d11e3f96024.slice/cri-containerd-09af509f3db677a2275723fc71bff3d9b6d19e4d404c44822f2262f700adcd4b.scope"
+
+	// cgroup v2.
+	require.Equal(t, scope, UnifiedPath([]procfs.Cgroup{{Path: scope}}))
+	// Hybrid, the unified hierarchy has the same path as the v1 ones.
+	require.Equal(t, scope, UnifiedPath([]procfs.Cgroup{
+		{HierarchyID: 3, Controllers: []string{"cpu", "cpuacct"}, Path: scope},
+		{HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: scope},
+		{HierarchyID: 0, Path: scope},
+	}))
+	// Hybrid without any path in the unified hierarchy.
+	require.Equal(t, scope, UnifiedPath([]procfs.Cgroup{
+		{HierarchyID: 3, Controllers: []string{"cpu", "cpuacct"}, Path: scope},
+		{HierarchyID: 0, Path: "/"},
+	}))
+}
+
+func TestAttribute(t *testing.T) {
+	tests := []struct {
+		path string
+		want Attribution
+	}{
+		{
+			path: "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1ff39434b35faeef64159d11e3f96024.slice/cri-containerd-09af509f3db677a2275723fc71bff3d9b6d19e4d404c44822f2262f700adcd4b.scope",
+			want: Attribution{QoSClass: QoSClassBurstable, ContainerRuntime: "containerd"},
+		},
+		{
+			path: "/kubepods.slice/kubepods-pod1ff39434b35faeef64159d11e3f96024.slice/crio-09af509f3db677a2275723fc71bff3d9b6d19e4d404c44822f2262f700adcd4b.scope",
+			want: Attribution{QoSClass: QoSClassGuaranteed, ContainerRuntime: "cri-o"},
+		},
+		{
+			path: "/kubepods/besteffort/pod1ff39434-b35f-aeef-6415-9d11e3f96024/09af509f3db677a2275723fc71bff3d9b6d19e4d404c44822f2262f700adcd4b",
+			want: Attribution{QoSClass: QoSClassBestEffort},
+		},
+		{
+			path: "/docker/09af509f3db677a2275723fc71bff3d9b6d19e4d404c44822f2262f700adcd4b",
+			want: Attribution{ContainerRuntime: "docker"},
+		},
+		{
+			path: "/system.slice/systemd-journald.service",
+			want: Attribution{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			require.Equal(t, tt.want, Attribute(tt.path))
+		})
+	}
+}
+
+func TestContainerID(t *testing.T) {
+	const id = "09af509f3db677a2275723fc71bff3d9b6d19e4d404c44822f2262f700adcd4b"
+
+	require.Equal(t, id, ContainerID("/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1ff39434b35faeef64159d11e3f96024.slice/cri-containerd-"+id+".scope"))
+	require.Equal(t, id, ContainerID("/kubepods/besteffort/pod1ff39434-b35f-aeef-6415-9d11e3f96024/"+id))
+	require.Equal(t, "", ContainerID("/system.slice/systemd-journald.service"))
+}
+
+func TestParseSystemdUnit(t *testing.T) {
+	tests := []struct {
+		cgroups []procfs.Cgroup
+		want    SystemdUnit
+	}{
+		{
+			cgroups: []procfs.Cgroup{{Path: "/system.slice/nginx.service"}},
+			want:    SystemdUnit{Unit: "nginx.service", Slice: "system.slice"},
+		},
+		{
+			cgroups: []procfs.Cgroup{{Path: "/user.slice/user-1000.slice/user@1000.service/app.slice/app-gnome-firefox-2893.scope"}},
+			want:    SystemdUnit{Unit: "user@1000.service", Slice: "user-1000.slice", UserUnit: "app-gnome-firefox-2893.scope"},
+		},
+		{
+			cgroups: []procfs.Cgroup{{Path: "/user.slice/user-1000.slice/session-3.scope"}},
+			want:    SystemdUnit{Unit: "session-3.scope", Slice: "user-1000.slice"},
+		},
+		{
+			// cgroup v1, where only the named systemd hierarchy is
+			// organized by units.
+			cgroups: []procfs.Cgroup{
+				{HierarchyID: 3, Controllers: []string{"cpu", "cpuacct"}, Path: "/"},
+				{HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: "/system.slice/sshd.service"},
+			},
+			want: SystemdUnit{Unit: "sshd.service", Slice: "system.slice"},
+		},
+		{
+			cgroups: []procfs.Cgroup{{Path: "/"}},
+			want:    SystemdUnit{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want.Unit, func(t *testing.T) {
+			require.Equal(t, tt.want, ParseSystemdUnit(SystemdPath(tt.cgroups)))
+		})
+	}
+}
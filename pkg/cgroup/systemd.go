@@ -0,0 +1,72 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"strings"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// SystemdUnit is the systemd unit a cgroup belongs to.
+type SystemdUnit struct {
+	// Unit of the system manager, e.g. "nginx.service" or "user@1000.service".
+	Unit string
+	// Slice the unit is in, e.g. "system.slice".
+	Slice string
+	// Unit of the user manager, when the cgroup belongs to one, e.g.
+	// "app.service" in "user@1000.service".
+	UserUnit string
+}
+
+// SystemdPath returns the path of the cgroup of the systemd hierarchy: the
+// named one of cgroup v1 hosts, or else the unified one.
+func SystemdPath(cgroups []procfs.Cgroup) string {
+	unified := ""
+	for _, cg := range cgroups {
+		for _, ctlr := range cg.Controllers {
+			if ctlr == "name=systemd" {
+				return cg.Path
+			}
+		}
+		if cg.HierarchyID == 0 && len(cg.Controllers) == 0 {
+			unified = cg.Path
+		}
+	}
+	return unified
+}
+
+// ParseSystemdUnit returns the systemd unit the cgroup with the given path
+// belongs to, following the naming of
+// https://systemd.io/CGROUP_DELEGATION/#systemds-unit-types.
+func ParseSystemdUnit(path string) SystemdUnit {
+	var u SystemdUnit
+
+	slice := ""
+	for _, segment := range strings.Split(path, "/") {
+		switch {
+		case strings.HasSuffix(segment, ".slice"):
+			slice = segment
+		case strings.HasSuffix(segment, ".service") || strings.HasSuffix(segment, ".scope"):
+			if u.Unit == "" {
+				u.Unit, u.Slice = segment, slice
+				continue
+			}
+			if strings.HasPrefix(u.Unit, "user@") {
+				u.UserUnit = segment
+			}
+		}
+	}
+	return u
+}
@@ -15,16 +15,87 @@ package config
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
 	"gopkg.in/yaml.v3"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
 )
 
+// DefaultRemoteWriteConfig is the default configuration of a remote write
+// endpoint.
+var DefaultRemoteWriteConfig = RemoteWriteConfig{
+	BatchWriteInterval: model.Duration(10 * time.Second),
+	TenantHeader:       tenant.DefaultHeader,
+}
+
 // Config holds all the configuration information for Parca Agent.
 type Config struct {
 	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// RemoteWrite configures additional stores to send profiles to, next to
+	// the one given with the --remote-store-* flags.
+	RemoteWrite []*RemoteWriteConfig `yaml:"remote_write,omitempty"`
+}
+
+// RemoteWriteConfig configures a remote store profiles are sent to.
+type RemoteWriteConfig struct {
+	// Name identifies the endpoint in metrics and logs, it defaults to the
+	// address.
+	Name               string                 `yaml:"name,omitempty"`
+	Address            string                 `yaml:"address"`
+	BearerToken        commonconfig.Secret    `yaml:"bearer_token,omitempty"`
+	BearerTokenFile    string                 `yaml:"bearer_token_file,omitempty"`
+	Insecure           bool                   `yaml:"insecure,omitempty"`
+	TLSConfig          commonconfig.TLSConfig `yaml:"tls_config,omitempty"`
+	BatchWriteInterval model.Duration         `yaml:"batch_write_interval,omitempty"`
+	// WALDirectory is the directory profiles are spooled to while the
+	// endpoint is unreachable, spooling is disabled when empty.
+	WALDirectory string `yaml:"wal_directory,omitempty"`
+	// TenantHeader is the header the tenant of the profiles and debuginfo
+	// is sent in, tenants are not sent when empty.
+	TenantHeader        string            `yaml:"tenant_header,omitempty"`
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *RemoteWriteConfig) UnmarshalYAML(value *yaml.Node) error {
+	*c = DefaultRemoteWriteConfig
+	type plain RemoteWriteConfig
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Address == "" {
+		return errors.New("remote write address is required")
+	}
+	if c.Name == "" {
+		c.Name = c.Address
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return errors.New("at most one of bearer_token and bearer_token_file must be configured")
+	}
+	if c.BatchWriteInterval <= 0 {
+		return fmt.Errorf("invalid batch write interval %s for remote write %q", c.BatchWriteInterval, c.Name)
+	}
+	return nil
+}
+
+// Validate checks the configuration for consistency.
+func (c *Config) Validate() error {
+	names := map[string]struct{}{}
+	for _, rw := range c.RemoteWrite {
+		if _, ok := names[rw.Name]; ok {
+			return fmt.Errorf("found multiple remote write configs with name %q", rw.Name)
+		}
+		names[rw.Name] = struct{}{}
+	}
+	return nil
 }
 
 func (c Config) String() string {
@@ -44,6 +115,9 @@ func Load(s string) (*Config, error) {
 	if err := dec.Decode(cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
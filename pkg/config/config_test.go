@@ -15,6 +15,7 @@ package config_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
@@ -44,3 +45,46 @@ func TestLoad(t *testing.T) {
 		},
 	}, c)
 }
+
+func TestLoadRemoteWrite(t *testing.T) {
+	t.Parallel()
+
+	c, err := config.Load(`remote_write:
+- address: central.example.com:443
+  bearer_token: secret
+- name: team
+  address: team.example.com:7070
+  insecure: true
+  batch_write_interval: 30s
+  write_relabel_configs:
+  - source_labels: [namespace]
+    regex: team-a
+    action: keep
+`)
+	require.NoError(t, err)
+	require.Len(t, c.RemoteWrite, 2)
+
+	require.Equal(t, "central.example.com:443", c.RemoteWrite[0].Name)
+	require.Equal(t, model.Duration(10*time.Second), c.RemoteWrite[0].BatchWriteInterval)
+	require.Empty(t, c.RemoteWrite[0].WriteRelabelConfigs)
+
+	require.Equal(t, "team", c.RemoteWrite[1].Name)
+	require.True(t, c.RemoteWrite[1].Insecure)
+	require.Equal(t, model.Duration(30*time.Second), c.RemoteWrite[1].BatchWriteInterval)
+	require.Len(t, c.RemoteWrite[1].WriteRelabelConfigs, 1)
+	require.Equal(t, relabel.Keep, c.RemoteWrite[1].WriteRelabelConfigs[0].Action)
+
+	// Secrets are not leaked through the config page.
+	require.NotContains(t, c.String(), "secret\n")
+
+	_, err = config.Load(`remote_write:
+- name: team
+`)
+	require.Error(t, err)
+
+	_, err = config.Load(`remote_write:
+- address: team.example.com:7070
+- address: team.example.com:7070
+`)
+	require.Error(t, err)
+}
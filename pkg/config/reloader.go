@@ -16,6 +16,9 @@ package config
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -142,7 +145,12 @@ func (r *ConfigReloader) reloadFile() (err error) {
 }
 
 // Run starts watching the config file and wait for reload triggers.
+// Besides file modifications, a reload can be requested by sending SIGHUP.
 func (r *ConfigReloader) Run(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
 	go r.watchFile()
 	for {
 		select {
@@ -150,6 +158,11 @@ func (r *ConfigReloader) Run(ctx context.Context) error {
 			if err := r.reloadFile(); err != nil {
 				level.Error(r.logger).Log("msg", "failed to reload configuration file", "err", err)
 			}
+		case <-hup:
+			level.Debug(r.logger).Log("msg", "received SIGHUP, reloading configuration")
+			if err := r.reloadFile(); err != nil {
+				level.Error(r.logger).Log("msg", "failed to reload configuration file", "err", err)
+			}
 		case <-ctx.Done():
 			r.watcher.Close()
 			return nil
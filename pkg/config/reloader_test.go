@@ -17,6 +17,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -129,3 +130,47 @@ func TestReloadInvalid(t *testing.T) {
 	case <-ctx.Done():
 	}
 }
+
+// TestReloadSignal is not parallel so the signal isn't observed by the
+// reloaders of other tests.
+func TestReloadSignal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	filename := filepath.Join(t.TempDir(), "parca-agent.yaml")
+	cfgStr := `relabel_configs:
+- source_labels: [comm]
+  regex: 'sshd'
+  action: drop
+`
+	require.NoError(t, os.WriteFile(filename, []byte(cfgStr), 0o644))
+
+	reloadConfig := make(chan *config.Config, 1)
+	reloaders := []config.ComponentReloader{
+		{
+			Name: "test",
+			Reloader: func(cfg *config.Config) error {
+				reloadConfig <- cfg
+				return nil
+			},
+		},
+	}
+
+	cfgReloader, err := config.NewConfigReloader(log.NewNopLogger(), prometheus.NewRegistry(), filename, reloaders)
+	require.NoError(t, err)
+
+	go cfgReloader.Run(ctx)
+
+	time.Sleep(time.Millisecond * 100)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	select {
+	case cfg := <-reloadConfig:
+		require.Len(t, cfg.RelabelConfigs, 1)
+		require.Equal(t, relabel.Drop, cfg.RelabelConfigs[0].Action)
+		require.Equal(t, model.LabelNames{"comm"}, cfg.RelabelConfigs[0].SourceLabels)
+	case <-ctx.Done():
+		t.Error("configuration reload timed out")
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/parca-dev/parca-agent/pkg/process"
+)
+
+type circuitState int
+
+const (
+	// Calls go through.
+	circuitClosed circuitState = iota
+	// Calls are rejected until the cooldown is over.
+	circuitOpen
+	// A single call probes whether the server is back.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerClient is a debuginfo client that stops calling the server
+// once it fails too many times in a row, so the uploads don't pile up while
+// it is down. The calls fail with process.ErrDebuginfoUnavailable until the
+// cooldown is over, then a single call probes the server: if it succeeds the
+// calls go through again, otherwise they are rejected for another cooldown.
+type CircuitBreakerClient struct {
+	debuginfopb.DebuginfoServiceClient
+
+	logger  log.Logger
+	metrics *breakerMetrics
+
+	threshold int
+	cooldown  time.Duration
+
+	mtx      sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreakerClient wraps the client with a circuit breaker opening
+// after threshold consecutive failures.
+func NewCircuitBreakerClient(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	client debuginfopb.DebuginfoServiceClient,
+	threshold int,
+	cooldown time.Duration,
+) *CircuitBreakerClient {
+	c := &CircuitBreakerClient{
+		DebuginfoServiceClient: client,
+
+		logger:  logger,
+		metrics: newBreakerMetrics(reg),
+
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	c.metrics.state.Set(float64(circuitClosed))
+	return c
+}
+
+func (c *CircuitBreakerClient) Upload(ctx context.Context, opts ...grpc.CallOption) (debuginfopb.DebuginfoService_UploadClient, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	stream, err := c.DebuginfoServiceClient.Upload(ctx, opts...)
+	c.done(err)
+	return stream, err
+}
+
+func (c *CircuitBreakerClient) ShouldInitiateUpload(ctx context.Context, in *debuginfopb.ShouldInitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.DebuginfoServiceClient.ShouldInitiateUpload(ctx, in, opts...)
+	c.done(err)
+	return resp, err
+}
+
+func (c *CircuitBreakerClient) InitiateUpload(ctx context.Context, in *debuginfopb.InitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.InitiateUploadResponse, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.DebuginfoServiceClient.InitiateUpload(ctx, in, opts...)
+	c.done(err)
+	return resp, err
+}
+
+func (c *CircuitBreakerClient) MarkUploadFinished(ctx context.Context, in *debuginfopb.MarkUploadFinishedRequest, opts ...grpc.CallOption) (*debuginfopb.MarkUploadFinishedResponse, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.DebuginfoServiceClient.MarkUploadFinished(ctx, in, opts...)
+	c.done(err)
+	return resp, err
+}
+
+// allow returns an error if the call has to be rejected.
+func (c *CircuitBreakerClient) allow() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			break
+		}
+		// This call is the probe.
+		c.setState(circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		// The probe is in flight.
+	default:
+		return nil
+	}
+	c.metrics.rejected.Inc()
+	return process.ErrDebuginfoUnavailable
+}
+
+// done records the outcome of an allowed call.
+func (c *CircuitBreakerClient) done(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if status.Code(err) == codes.Canceled {
+		// Tells nothing about the server, the next call probes it again.
+		if c.state == circuitHalfOpen {
+			c.setState(circuitOpen)
+		}
+		return
+	}
+
+	if !isServerFailure(err) {
+		c.failures = 0
+		if c.state != circuitClosed {
+			level.Info(c.logger).Log("msg", "debuginfo server is back, resuming uploads")
+			c.setState(circuitClosed)
+		}
+		return
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.threshold {
+		if c.state == circuitClosed {
+			level.Warn(c.logger).Log("msg", "debuginfo server is unavailable, pausing uploads", "cooldown", c.cooldown, "err", err)
+			c.metrics.opened.Inc()
+		}
+		c.openedAt = time.Now()
+		c.setState(circuitOpen)
+	}
+}
+
+func (c *CircuitBreakerClient) setState(s circuitState) {
+	c.state = s
+	c.metrics.state.Set(float64(s))
+}
+
+// isServerFailure returns whether the error means that the server can't be
+// reached or can't keep up, rather than that the request was refused.
+func isServerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/parca-dev/parca-agent/pkg/process"
+)
+
+func TestCircuitBreakerClient(t *testing.T) {
+	var (
+		calls int
+		err   error
+	)
+	c := NewCircuitBreakerClient(log.NewNopLogger(), prometheus.NewRegistry(), &testClient{
+		ShouldInitiateUploadF: func(in *debuginfopb.ShouldInitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+			calls++
+			return &debuginfopb.ShouldInitiateUploadResponse{}, err
+		},
+	}, 2, time.Hour)
+	call := func() error {
+		_, err := c.ShouldInitiateUpload(context.Background(), &debuginfopb.ShouldInitiateUploadRequest{})
+		return err
+	}
+
+	// Refused requests don't open the circuit.
+	err = status.Error(codes.InvalidArgument, "invalid")
+	require.Error(t, call())
+	require.Error(t, call())
+	require.Equal(t, circuitClosed, c.state)
+
+	// Opens after two consecutive failures to reach the server.
+	err = status.Error(codes.Unavailable, "unavailable")
+	require.Error(t, call())
+	require.Equal(t, circuitClosed, c.state)
+	require.Error(t, call())
+	require.Equal(t, circuitOpen, c.state)
+	require.Equal(t, 4, calls)
+
+	// Rejected without calling the server during the cooldown.
+	require.ErrorIs(t, call(), process.ErrDebuginfoUnavailable)
+	require.Equal(t, 4, calls)
+
+	// A failing probe opens it again for another cooldown.
+	c.openedAt = time.Now().Add(-2 * time.Hour)
+	require.Error(t, call())
+	require.Equal(t, 5, calls)
+	require.Equal(t, circuitOpen, c.state)
+	require.ErrorIs(t, call(), process.ErrDebuginfoUnavailable)
+
+	// A successful probe closes it.
+	err = nil
+	c.openedAt = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, call())
+	require.Equal(t, circuitClosed, c.state)
+	require.NoError(t, call())
+	require.Equal(t, 7, calls)
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	lvFileSize = "file_size"
+	lvBudget   = "budget"
+
+	// budgetWindow is how long the bytes of an upload count towards the
+	// budget.
+	budgetWindow = time.Hour
+)
+
+// SkippedUpload is a debuginfo file not uploaded because of its size.
+type SkippedUpload struct {
+	BuildID       string    `json:"build_id"`
+	Tenant        string    `json:"tenant,omitempty"`
+	DebuginfoFile string    `json:"debuginfo_file"`
+	Size          int64     `json:"size"`
+	Reason        string    `json:"reason"`
+	Time          time.Time `json:"time"`
+}
+
+type budgetMetrics struct {
+	skipped *prometheus.CounterVec
+	used    prometheus.Gauge
+}
+
+func newBudgetMetrics(reg prometheus.Registerer) *budgetMetrics {
+	m := &budgetMetrics{
+		skipped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_debuginfo_upload_skipped_total",
+			Help: "Number of debuginfo uploads skipped, by whether the file is too large or the hourly upload budget is exhausted.",
+		}, []string{"reason"}),
+		used: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_debuginfo_upload_budget_used_bytes",
+			Help: "Number of bytes of debuginfo uploaded, or being uploaded, within the last hour.",
+		}),
+	}
+	m.skipped.WithLabelValues(lvFileSize)
+	m.skipped.WithLabelValues(lvBudget)
+	return m
+}
+
+// UploadBudget bounds the size of the debuginfo files uploaded, so a few
+// pathologically large ones can't hold up the uploads of the others. The
+// limits are disabled when zero.
+type UploadBudget struct {
+	metrics *budgetMetrics
+
+	maxFileSize     int64
+	maxBytesPerHour int64
+	size            int
+
+	mtx          sync.Mutex
+	reservations []*reservation
+	used         int64
+	// skipped are the most recently skipped uploads, the oldest first.
+	skipped []skippedEntry
+}
+
+type skippedEntry struct {
+	key    string
+	upload SkippedUpload
+}
+
+// reservation is the part of the budget taken by an upload.
+type reservation struct {
+	at   time.Time
+	size int64
+}
+
+// NewUploadBudget creates an UploadBudget that keeps the size most recently
+// skipped uploads.
+func NewUploadBudget(reg prometheus.Registerer, maxFileSize, maxBytesPerHour int64, size int) *UploadBudget {
+	return &UploadBudget{
+		metrics:         newBudgetMetrics(reg),
+		maxFileSize:     maxFileSize,
+		maxBytesPerHour: maxBytesPerHour,
+		size:            size,
+	}
+}
+
+// reserve takes the size of the given upload off the budget. It returns nil,
+// and records the upload as skipped, when it exceeds the limits.
+func (b *UploadBudget) reserve(key string, u SkippedUpload, now time.Time) *reservation {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.expire(now)
+	switch {
+	case b.maxFileSize > 0 && u.Size > b.maxFileSize:
+		u.Reason = lvFileSize
+	case b.maxBytesPerHour > 0 && b.used+u.Size > b.maxBytesPerHour:
+		u.Reason = lvBudget
+	default:
+		b.forget(key)
+		r := &reservation{at: now, size: u.Size}
+		b.reservations = append(b.reservations, r)
+		b.used += r.size
+		b.metrics.used.Set(float64(b.used))
+		return r
+	}
+
+	b.metrics.skipped.WithLabelValues(u.Reason).Inc()
+	u.Time = now
+	b.forget(key)
+	if len(b.skipped) >= b.size {
+		b.skipped = b.skipped[1:]
+	}
+	b.skipped = append(b.skipped, skippedEntry{key: key, upload: u})
+	return nil
+}
+
+// release gives the size of a reservation back to the budget, for the
+// uploads that didn't happen.
+func (b *UploadBudget) release(r *reservation) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.used -= r.size
+	r.size = 0
+	b.metrics.used.Set(float64(b.used))
+}
+
+// expire gives the size of the reservations older than the budget window
+// back to the budget.
+func (b *UploadBudget) expire(now time.Time) {
+	i := 0
+	for ; i < len(b.reservations) && now.Sub(b.reservations[i].at) > budgetWindow; i++ {
+		b.used -= b.reservations[i].size
+	}
+	if i == 0 {
+		return
+	}
+	b.reservations = b.reservations[i:]
+	b.metrics.used.Set(float64(b.used))
+}
+
+// forget removes the upload of the given key from the skipped ones.
+func (b *UploadBudget) forget(key string) {
+	for i, e := range b.skipped {
+		if e.key == key {
+			b.skipped = append(b.skipped[:i], b.skipped[i+1:]...)
+			return
+		}
+	}
+}
+
+// Skipped returns the uploads most recently skipped, the most recent first.
+func (b *UploadBudget) Skipped() []SkippedUpload {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	res := make([]SkippedUpload, len(b.skipped))
+	for i, e := range b.skipped {
+		res[len(res)-1-i] = e.upload
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+)
+
+func TestUploadBudget(t *testing.T) {
+	b := NewUploadBudget(prometheus.NewRegistry(), 100, 150, 8)
+	now := time.Now()
+
+	require.Nil(t, b.reserve("a", SkippedUpload{BuildID: "a", Size: 101}, now))
+	r := b.reserve("b", SkippedUpload{BuildID: "b", Size: 100}, now)
+	require.NotNil(t, r)
+	require.Nil(t, b.reserve("c", SkippedUpload{BuildID: "c", Size: 60}, now))
+	require.Equal(t, 1.0, testutil.ToFloat64(b.metrics.skipped.WithLabelValues(lvFileSize)))
+	require.Equal(t, 1.0, testutil.ToFloat64(b.metrics.skipped.WithLabelValues(lvBudget)))
+	require.Equal(t, []SkippedUpload{
+		{BuildID: "c", Size: 60, Reason: lvBudget, Time: now},
+		{BuildID: "a", Size: 101, Reason: lvFileSize, Time: now},
+	}, b.Skipped())
+
+	// The uploads that didn't happen don't count towards the budget.
+	b.release(r)
+	require.NotNil(t, b.reserve("c", SkippedUpload{BuildID: "c", Size: 60}, now))
+	require.Len(t, b.Skipped(), 1)
+
+	// Neither do the ones older than an hour.
+	require.Nil(t, b.reserve("d", SkippedUpload{BuildID: "d", Size: 100}, now.Add(time.Minute)))
+	require.NotNil(t, b.reserve("d", SkippedUpload{BuildID: "d", Size: 100}, now.Add(budgetWindow+time.Minute)))
+	require.Equal(t, 100.0, testutil.ToFloat64(b.metrics.used))
+}
+
+func TestUploadSkippedOverBudget(t *testing.T) {
+	objFilePool := objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 0)
+	t.Cleanup(func() { objFilePool.Close() })
+
+	dbgFile, err := objFilePool.Open(filepath.Join("../../internal/pprof/binutils/testdata", "exe_linux_64"))
+	require.NoError(t, err)
+	t.Cleanup(func() { dbgFile.HoldOn() })
+
+	c := &testClient{
+		ShouldInitiateUploadF: func(in *debuginfopb.ShouldInitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+			return &debuginfopb.ShouldInitiateUploadResponse{ShouldInitiateUpload: true}, nil
+		},
+		InitiateUploadF: func(in *debuginfopb.InitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.InitiateUploadResponse, error) {
+			t.Error("upload initiated over the budget")
+			return nil, context.Canceled
+		},
+	}
+
+	budget := NewUploadBudget(prometheus.NewRegistry(), dbgFile.Size-1, 0, 8)
+	dim := New(
+		log.NewNopLogger(),
+		trace.NewNoopTracerProvider().Tracer("test"),
+		prometheus.NewRegistry(),
+		objFilePool,
+		nil,
+		c,
+		1,
+		2*time.Minute,
+		false,
+		5*time.Minute,
+		defaultDebugDirs,
+		true,
+		t.TempDir(),
+		nil,
+		nil,
+		nil,
+		budget,
+	)
+	t.Cleanup(func() { dim.Close() })
+
+	require.NoError(t, dim.Upload(context.Background(), dbgFile))
+	require.Equal(t, 0.0, testutil.ToFloat64(dim.metrics.uploadAttempts))
+
+	skipped := budget.Skipped()
+	require.Len(t, skipped, 1)
+	require.Equal(t, dbgFile.BuildID, skipped[0].BuildID)
+	require.Equal(t, lvFileSize, skipped[0].Reason)
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DebugDirLayout is how the separate debuginfo files of a debug directory are
+// named.
+type DebugDirLayout string
+
+const (
+	// DebugDirLayoutAll looks the files up both by build ID and by debug link.
+	DebugDirLayoutAll DebugDirLayout = "all"
+	// DebugDirLayoutBuildID looks the files up by build ID, at
+	// .build-id/ab/cdef1234.debug or at abcdef1234/debuginfo.
+	DebugDirLayoutBuildID DebugDirLayout = "buildid"
+	// DebugDirLayoutDebuglink looks the files up by the path of their binary
+	// within the directory, named after their debug link.
+	DebugDirLayoutDebuglink DebugDirLayout = "debuglink"
+)
+
+// dwzDir holds the supplementary files dwz(1) moves the debug information
+// shared by the debuginfo files of a package to. They are never the debuginfo
+// file of a binary.
+const dwzDir = ".dwz"
+
+// DebugDir is a directory the separate debuginfo files are looked for in.
+type DebugDir struct {
+	// Path of the directory within the root of the processes. It can be a
+	// glob pattern, e.g. /nix/store/*-debug/lib/debug for the debug outputs
+	// of the Nix store.
+	Path string
+	// Whether the files are also looked for in the subdirectories, once they
+	// are not found at their usual paths.
+	Recursive bool
+	Layout    DebugDirLayout
+	// The directories of higher priority are looked in first, the ones of
+	// the same priority in the order they are given.
+	Priority int
+}
+
+func (d DebugDir) byBuildID() bool {
+	return d.Layout != DebugDirLayoutDebuglink
+}
+
+func (d DebugDir) byDebuglink() bool {
+	return d.Layout != DebugDirLayoutBuildID
+}
+
+// ParseDebugDirs parses the debug directories, given as their path followed by
+// their options, separated by colons, e.g.
+// /opt/debug:recursive:layout=buildid:priority=10.
+func ParseDebugDirs(dirs []string) ([]DebugDir, error) {
+	res := make([]DebugDir, 0, len(dirs))
+	for _, dir := range dirs {
+		parts := strings.Split(dir, ":")
+		d := DebugDir{Path: parts[0], Layout: DebugDirLayoutAll}
+		if d.Path == "" {
+			return nil, fmt.Errorf("debug directory %q has no path", dir)
+		}
+		if _, err := filepath.Match(d.Path, ""); err != nil {
+			return nil, fmt.Errorf("debug directory %q: %w", dir, err)
+		}
+		for _, opt := range parts[1:] {
+			name, value, _ := strings.Cut(opt, "=")
+			switch name {
+			case "recursive":
+				d.Recursive = true
+			case "layout":
+				switch l := DebugDirLayout(value); l {
+				case DebugDirLayoutAll, DebugDirLayoutBuildID, DebugDirLayoutDebuglink:
+					d.Layout = l
+				default:
+					return nil, fmt.Errorf("debug directory %q: unknown layout %q, supported layouts are: %s, %s, %s", dir, value, DebugDirLayoutAll, DebugDirLayoutBuildID, DebugDirLayoutDebuglink)
+				}
+			case "priority":
+				p, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("debug directory %q: invalid priority %q: %w", dir, value, err)
+				}
+				d.Priority = p
+			default:
+				return nil, fmt.Errorf("debug directory %q: unknown option %q, supported options are: recursive, layout, priority", dir, name)
+			}
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// sortDebugDirs orders the debug directories by priority.
+func sortDebugDirs(dirs []DebugDir) []DebugDir {
+	sorted := make([]DebugDir, len(dirs))
+	copy(sorted, dirs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// expand returns the directories the path of a debug directory stands for
+// within the given root.
+func (d DebugDir) expand(root string) []string {
+	dir := filepath.Join(root, d.Path)
+	if !strings.ContainsAny(d.Path, `*?[\`) {
+		return []string{dir}
+	}
+	// The pattern is validated when parsed.
+	matches, _ := fs.Glob(fileSystem, dir)
+	return matches
+}
+
+// errFound stops the walk of a debug directory.
+var errFound = errors.New("found")
+
+// search walks the given directory for the debuginfo file of a binary, by
+// build ID or by the name of its debug link, according to the layout of the
+// debug directory. The supplementary files of dwz are skipped.
+func (d DebugDir) search(dir, buildID, filename string) (found string, byBuildID bool) { //nolint:nonamedreturns
+	_ = fs.WalkDir(fileSystem, dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped.
+			return nil //nolint:nilerr
+		}
+		if e.IsDir() {
+			if e.Name() == dwzDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		parent := filepath.Base(filepath.Dir(path))
+		switch {
+		case d.byBuildID() && len(buildID) > 2 && parent == buildID[:2] && e.Name() == buildID[2:]+dbgExt,
+			d.byBuildID() && parent == buildID && e.Name() == "debuginfo":
+			found, byBuildID = path, true
+			return errFound
+		case d.byDebuglink() && filename != "" && e.Name() == filename:
+			found = path
+			return errFound
+		}
+		return nil
+	})
+	return found, byBuildID
+}
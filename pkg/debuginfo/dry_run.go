@@ -0,0 +1,91 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"sync"
+	"time"
+)
+
+// DryRunUpload is a debuginfo file that would have been uploaded.
+type DryRunUpload struct {
+	BuildID string `json:"build_id"`
+	Tenant  string `json:"tenant,omitempty"`
+	// The binary the debuginfo file is of.
+	File string `json:"file"`
+	// The debuginfo file found on the host, or extracted from the binary.
+	DebuginfoFile string    `json:"debuginfo_file"`
+	Size          int64     `json:"size"`
+	Hash          string    `json:"hash"`
+	Time          time.Time `json:"time"`
+}
+
+// DryRunLog keeps the most recent debuginfo files that would have been
+// uploaded, once per build ID and tenant, for the uploads to be audited
+// before they are enabled.
+type DryRunLog struct {
+	mtx     sync.Mutex
+	size    int
+	uploads []dryRunEntry
+	keys    map[string]struct{}
+}
+
+type dryRunEntry struct {
+	key    string
+	upload DryRunUpload
+}
+
+// NewDryRunLog creates a DryRunLog of at most size uploads.
+func NewDryRunLog(size int) *DryRunLog {
+	return &DryRunLog{
+		size: size,
+		keys: map[string]struct{}{},
+	}
+}
+
+// has returns whether the upload of the given key was already recorded.
+func (l *DryRunLog) has(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	_, ok := l.keys[key]
+	return ok
+}
+
+// record records the upload of the given key, evicting the oldest one when
+// the log is full. It returns false when the upload was already recorded.
+func (l *DryRunLog) record(key string, u DryRunUpload) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, ok := l.keys[key]; ok {
+		return false
+	}
+	if len(l.uploads) >= l.size {
+		delete(l.keys, l.uploads[0].key)
+		l.uploads = l.uploads[1:]
+	}
+	l.keys[key] = struct{}{}
+	l.uploads = append(l.uploads, dryRunEntry{key: key, upload: u})
+	return true
+}
+
+// Uploads returns the uploads recorded, the most recent first.
+func (l *DryRunLog) Uploads() []DryRunUpload {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	res := make([]DryRunUpload, len(l.uploads))
+	for i, e := range l.uploads {
+		res[len(res)-1-i] = e.upload
+	}
+	return res
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+)
+
+func TestDryRunLog(t *testing.T) {
+	l := NewDryRunLog(2)
+	require.True(t, l.record("a", DryRunUpload{BuildID: "a"}))
+	require.False(t, l.record("a", DryRunUpload{BuildID: "a"}))
+	require.True(t, l.record("b", DryRunUpload{BuildID: "b"}))
+	require.True(t, l.record("c", DryRunUpload{BuildID: "c"}))
+
+	require.False(t, l.has("a"))
+	require.True(t, l.has("b"))
+	require.Equal(t, []DryRunUpload{{BuildID: "c"}, {BuildID: "b"}}, l.Uploads())
+}
+
+func TestDryRunDoesNotUpload(t *testing.T) {
+	objFilePool := objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 0)
+	t.Cleanup(func() { objFilePool.Close() })
+
+	src, err := objFilePool.Open(filepath.Join("../../internal/pprof/binutils/testdata", "exe_linux_64"))
+	require.NoError(t, err)
+	t.Cleanup(func() { src.HoldOn() })
+
+	dryRun := NewDryRunLog(8)
+	dim := New(
+		log.NewNopLogger(),
+		trace.NewNoopTracerProvider().Tracer("test"),
+		prometheus.NewRegistry(),
+		objFilePool,
+		nil,
+		// Any call to the server panics.
+		&testClient{},
+		1,
+		2*time.Minute,
+		false,
+		5*time.Minute,
+		defaultDebugDirs,
+		true,
+		t.TempDir(),
+		nil,
+		nil,
+		dryRun,
+		nil,
+	)
+	t.Cleanup(func() { dim.Close() })
+
+	ctx := context.Background()
+	shouldInitiate, err := dim.ShouldInitiateUpload(ctx, src.BuildID)
+	require.NoError(t, err)
+	require.True(t, shouldInitiate)
+
+	require.NoError(t, dim.recordDryRun(ctx, src, src))
+	require.NoError(t, dim.recordDryRun(ctx, src, src))
+
+	shouldInitiate, err = dim.ShouldInitiateUpload(ctx, src.BuildID)
+	require.NoError(t, err)
+	require.False(t, shouldInitiate)
+
+	uploads := dryRun.Uploads()
+	require.Len(t, uploads, 1)
+	require.Equal(t, src.BuildID, uploads[0].BuildID)
+	require.Equal(t, src.Path, uploads[0].DebuginfoFile)
+	require.Equal(t, src.Size, uploads[0].Size)
+	require.NotEmpty(t, uploads[0].Hash)
+}
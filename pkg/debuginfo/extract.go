@@ -62,7 +62,7 @@ func (e *Extractor) ExtractAll(ctx context.Context, srcDsts map[string]io.WriteS
 		}
 		defer f.Close()
 
-		if err := e.Extract(ctx, dst, f); err != nil {
+		if err := e.Extract(ctx, dst, f, nil); err != nil {
 			level.Debug(e.logger).Log(
 				"msg", "failed to extract debug information", "file", src, "err", err,
 			)
@@ -77,9 +77,10 @@ func (e *Extractor) ExtractAll(ctx context.Context, srcDsts map[string]io.WriteS
 	return nil
 }
 
-// Extract extracts debug information from the given executable.
+// Extract extracts debug information from the given executable, along with
+// the one of its split DWARF package, if not nil.
 // Cleaning up the temporary directory and the interim file is the caller's responsibility.
-func (e *Extractor) Extract(ctx context.Context, dst io.WriteSeeker, src SeekReaderAt) error {
+func (e *Extractor) Extract(ctx context.Context, dst io.WriteSeeker, src, dwp SeekReaderAt) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
@@ -87,14 +88,30 @@ func (e *Extractor) Extract(ctx context.Context, dst io.WriteSeeker, src SeekRea
 	_, span := e.tracer.Start(ctx, "DebuginfoExtractor.Extract")
 	defer span.End()
 
-	return extract(dst, src)
+	return extract(dst, src, dwp)
 }
 
-func extract(dst io.WriteSeeker, src SeekReaderAt) error {
+func extract(dst io.WriteSeeker, src, dwp SeekReaderAt) error {
 	w, err := elfwriter.NewFromSource(dst, src)
 	if err != nil {
 		return fmt.Errorf("failed to initialize writer: %w", err)
 	}
+	if dwp != nil {
+		pkg, err := elf.NewFile(dwp)
+		if err != nil {
+			return fmt.Errorf("failed to read split DWARF package: %w", err)
+		}
+		defer pkg.Close()
+
+		// All the sections of a package are DWARF ones, named after the
+		// ones of the .dwo files, such as .debug_info.dwo, or indexes of
+		// their units.
+		for _, s := range pkg.Sections {
+			if isDwarf(s) {
+				w.AddSections(s)
+			}
+		}
+	}
 	w.FilterPrograms(func(p *elf.Prog) bool {
 		return p.Type == elf.PT_NOTE
 	})
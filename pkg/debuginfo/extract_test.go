@@ -61,7 +61,7 @@ func TestExtractor_Extract(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			err = extract(buf, f)
+			err = extract(buf, f, nil)
 			if tt.wantErr {
 				require.Error(t, err)
 			} else {
@@ -89,3 +89,38 @@ func TestExtractor_Extract(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractSplitDWARF(t *testing.T) {
+	src, err := os.Open("testdata/split-dwarf")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		src.Close()
+	})
+	dwp, err := os.Open("testdata/split-dwarf.dwp")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		dwp.Close()
+	})
+
+	buf := flexbuf.New()
+	require.NoError(t, extract(buf, src, dwp))
+
+	buf.SeekStart()
+	elfFile, err := elf.NewFile(buf)
+	require.NoError(t, err)
+
+	pkg, err := elf.NewFile(dwp)
+	require.NoError(t, err)
+
+	// The skeleton units are kept along with the sections of the package.
+	require.NotNil(t, elfFile.Section(".debug_info"))
+	for _, name := range []string{".debug_info.dwo", ".debug_line.dwo", ".debug_cu_index"} {
+		sec := elfFile.Section(name)
+		require.NotNil(t, sec, name)
+		data, err := sec.Data()
+		require.NoError(t, err)
+		expected, err := pkg.Section(name).Data()
+		require.NoError(t, err)
+		require.Equal(t, expected, data, name)
+	}
+}
@@ -26,7 +26,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	burrow "github.com/goburrow/cache"
@@ -35,6 +37,7 @@ import (
 
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/process"
 )
 
 type realfs struct{}
@@ -48,24 +51,58 @@ type Finder struct {
 	logger log.Logger
 	tracer trace.Tracer
 
-	cache     burrow.Cache
-	debugDirs []string
+	cache burrow.Cache
+	// Ordered by priority.
+	debugDirs []DebugDir
+
+	// The build IDs whose debuginfo files were not found, which are looked
+	// up again once files are created in the debug directories.
+	notFoundMtx sync.Mutex
+	notFound    map[string]struct{}
+
+	// Watches the debug directories of the roots files were not found in,
+	// nil when they can't be watched.
+	watcher      *fsnotify.Watcher
+	mtx          sync.Mutex
+	watched      map[dirKey]struct{}
+	watchedPaths map[string]dirKey
 }
 
 // NewFinder creates a new Finder.
-func NewFinder(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, debugDirs []string) *Finder {
-	return &Finder{
-		logger: log.With(logger, "component", "finder"),
-		tracer: tracer,
-		cache: burrow.New(
-			burrow.WithMaximumSize(128),
-			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "debuginfo_find")),
-		), // Arbitrary cache size.
-		debugDirs: debugDirs,
+func NewFinder(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, debugDirs []DebugDir) *Finder {
+	f := &Finder{
+		logger:    log.With(logger, "component", "finder"),
+		tracer:    tracer,
+		debugDirs: sortDebugDirs(debugDirs),
+
+		notFound: map[string]struct{}{},
+
+		watched:      map[dirKey]struct{}{},
+		watchedPaths: map[string]dirKey{},
+	}
+	f.cache = burrow.New(
+		burrow.WithMaximumSize(128),
+		burrow.WithRemovalListener(func(k burrow.Key, _ burrow.Value) {
+			f.setNotFound(k.(string), false) //nolint:forcetypeassert
+		}),
+		burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "debuginfo_find")),
+	) // Arbitrary cache size.
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		// The files not found are only looked up again once evicted.
+		level.Warn(f.logger).Log("msg", "failed to watch debug directories", "err", err)
+		return f
 	}
+	f.watcher = watcher
+	go f.runWatcher()
+	return f
 }
 
 func (f *Finder) Close() error {
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
 	return f.cache.Close()
 }
 
@@ -95,6 +132,8 @@ func (f *Finder) Find(ctx context.Context, root string, obj *objectfile.ObjectFi
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			f.cache.Put(buildID, err)
+			f.setNotFound(buildID, true)
+			f.watchDebugDirs(root)
 			return "", err
 		}
 		// Return the error without caching it.
@@ -102,6 +141,7 @@ func (f *Finder) Find(ctx context.Context, root string, obj *objectfile.ObjectFi
 	}
 
 	f.cache.Put(buildID, file)
+	f.setNotFound(buildID, false)
 	return file, nil
 }
 
@@ -166,11 +206,12 @@ func (f *Finder) find(ctx context.Context, root string, obj *objectfile.ObjectFi
 		return "", errors.New("failed to generate paths")
 	}
 
-	var found string
+	var candidate, found string
 	for _, file := range files {
-		_, err := fs.Stat(fileSystem, file)
+		resolved := resolveInRoot(root, file)
+		_, err := fs.Stat(fileSystem, resolved)
 		if err == nil {
-			found = file
+			candidate, found = file, resolved
 			break
 		}
 		if os.IsNotExist(err) || errors.Is(err, fs.ErrNotExist) {
@@ -178,11 +219,16 @@ func (f *Finder) find(ctx context.Context, root string, obj *objectfile.ObjectFi
 		}
 	}
 
+	byBuildID := strings.Contains(candidate, ".build-id") || strings.HasSuffix(candidate, "/debuginfo")
+	if found == "" {
+		candidate, byBuildID = f.search(root, obj.BuildID, obj.Path, base)
+		found = resolveInRoot(root, candidate)
+	}
 	if found == "" {
 		return "", os.ErrNotExist
 	}
 
-	if strings.Contains(found, ".build-id") || strings.HasSuffix(found, "/debuginfo") || crc <= 0 {
+	if byBuildID || crc <= 0 {
 		return found, nil
 	}
 
@@ -219,8 +265,11 @@ func readDebuglink(ef *elf.File) (string, uint32, error) {
 	return "", 0, errSectionNotFound
 }
 
-func (f *Finder) generatePaths(root, buildID, path, filename string) []string {
-	const dbgExt = ".debug"
+const dbgExt = ".debug"
+
+// debugFilePath returns the path of the debug file next to the binary, named
+// after its debug link.
+func debugFilePath(path, filename string) string {
 	if len(filename) == 0 {
 		filename = filepath.Base(path)
 	}
@@ -228,25 +277,72 @@ func (f *Finder) generatePaths(root, buildID, path, filename string) []string {
 	if ext == "" {
 		ext = dbgExt
 	}
-	dbgFilePath := filepath.Join(filepath.Dir(path), strings.TrimSuffix(filename, ext)) + ext
+	return filepath.Join(filepath.Dir(path), strings.TrimSuffix(filename, ext)) + ext
+}
 
-	var files []string
-	for _, dir := range f.debugDirs {
-		rel, err := filepath.Rel(root, dbgFilePath)
-		if err != nil {
-			continue
+func (f *Finder) generatePaths(root, buildID, path, filename string) []string {
+	dbgFilePath := debugFilePath(path, filename)
+	rel, err := filepath.Rel(root, dbgFilePath)
+	if err != nil || len(f.debugDirs) == 0 {
+		return nil
+	}
+
+	files := []string{
+		dbgFilePath,
+		filepath.Join(filepath.Dir(path), dbgExt, filepath.Base(dbgFilePath)),
+	}
+	for _, d := range f.debugDirs {
+		for _, dir := range d.expand(root) {
+			if d.byDebuglink() {
+				files = append(files, filepath.Join(dir, rel))
+			}
+			if d.byBuildID() {
+				files = append(files,
+					filepath.Join(dir, ".build-id", buildID[:2], buildID[2:])+dbgExt,
+					filepath.Join(dir, buildID, "debuginfo"),
+				)
+			}
 		}
-		files = append(files, []string{
-			dbgFilePath,
-			filepath.Join(filepath.Dir(path), dbgExt, filepath.Base(dbgFilePath)),
-			filepath.Join(root, dir, rel),
-			filepath.Join(root, dir, ".build-id", buildID[:2], buildID[2:]) + dbgExt,
-			filepath.Join(root, dir, buildID, "debuginfo"),
-		}...)
 	}
 	return files
 }
 
+// search walks the recursive debug directories for the debuginfo file, once
+// it isn't found at the usual paths. It returns whether the file was found by
+// build ID, rather than by debug link.
+func (f *Finder) search(root, buildID, path, filename string) (string, bool) {
+	filename = filepath.Base(debugFilePath(path, filename))
+	for _, d := range f.debugDirs {
+		if !d.Recursive {
+			continue
+		}
+		for _, dir := range d.expand(root) {
+			if found, byBuildID := d.search(dir, buildID, filename); found != "" {
+				return found, byBuildID
+			}
+		}
+	}
+	return "", false
+}
+
+// resolveInRoot follows the symbolic links of the given path within the given
+// root, as the ones of the .build-id directories of containers can point to
+// absolute paths, which are only valid within the container.
+func resolveInRoot(root, path string) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	resolved, err := process.ResolveInRoot(root, rel)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
+
 // NOTE: we are within the race condition window, but alas.
 func checkSum(path string, crc uint32) (bool, error) {
 	file, err := fileSystem.Open(path)
@@ -18,7 +18,9 @@ import (
 	"context"
 	"debug/elf"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/goburrow/cache"
@@ -34,7 +36,7 @@ type fakeCache struct {
 	cache.Cache
 }
 
-var defaultDebugDirs = []string{"/usr/lib/debug"}
+var defaultDebugDirs = []DebugDir{{Path: "/usr/lib/debug"}}
 
 func TestFinderWithFakeFS_find(t *testing.T) {
 	mockObjectFile, err := os.Open("./testdata/readelf-sections")
@@ -173,7 +175,7 @@ func TestFinder_find(t *testing.T) {
 
 func TestFinder_generatePaths(t *testing.T) {
 	type fields struct {
-		debugDirs []string
+		debugDirs []DebugDir
 	}
 	type args struct {
 		root    string
@@ -226,7 +228,7 @@ func TestFinder_generatePaths(t *testing.T) {
 		{
 			name: "with custom global debug file dir",
 			fields: fields{
-				debugDirs: []string{"/custom/global/debug"},
+				debugDirs: []DebugDir{{Path: "/custom/global/debug"}},
 			},
 			args: args{
 				root:    "/proc/124/root",
@@ -317,3 +319,142 @@ func Test_readDebuglink(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	dbg := filepath.Join(root, "usr", "lib", "debug")
+	require.NoError(t, os.MkdirAll(filepath.Join(dbg, ".build-id", "ab"), 0o755))
+	// The links of some distributions point to absolute paths.
+	require.NoError(t, os.Symlink("/usr/lib/debug/usr/bin/app.debug", filepath.Join(dbg, ".build-id", "ab", "cdef.debug")))
+
+	require.Equal(t, filepath.Join(dbg, "usr", "bin", "app.debug"), resolveInRoot(root, filepath.Join(dbg, ".build-id", "ab", "cdef.debug")))
+	require.Equal(t, "/usr/bin/app", resolveInRoot(root, "/usr/bin/app"))
+	require.Equal(t, "testdata/readelf-sections", resolveInRoot("", "testdata/readelf-sections"))
+}
+
+func TestParseDebugDirs(t *testing.T) {
+	dirs, err := ParseDebugDirs([]string{
+		"/usr/lib/debug",
+		"/opt/debug:recursive:layout=buildid:priority=10",
+		"/nix/store/*-debug/lib/debug:layout=buildid",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []DebugDir{
+		{Path: "/usr/lib/debug", Layout: DebugDirLayoutAll},
+		{Path: "/opt/debug", Recursive: true, Layout: DebugDirLayoutBuildID, Priority: 10},
+		{Path: "/nix/store/*-debug/lib/debug", Layout: DebugDirLayoutBuildID},
+	}, dirs)
+
+	for _, dir := range []string{
+		"",
+		":recursive",
+		"/opt/debug:layout=flat",
+		"/opt/debug:priority=high",
+		"/opt/debug:unknown",
+		"/opt/[debug",
+	} {
+		_, err := ParseDebugDirs([]string{dir})
+		require.Error(t, err, dir)
+	}
+}
+
+func TestFinder_generatePathsOfDebugDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"nix/store/abc-foo-debug/lib/debug", "nix/store/def-bar-debug/lib/debug", "nix/store/ghi-bar"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0o755))
+	}
+	dirs, err := ParseDebugDirs([]string{
+		"/usr/lib/debug:layout=debuglink",
+		"/nix/store/*-debug/lib/debug:layout=buildid:priority=1",
+	})
+	require.NoError(t, err)
+
+	f := NewFinder(log.NewNopLogger(), trace.NewNoopTracerProvider().Tracer("test"), prometheus.NewRegistry(), dirs)
+	t.Cleanup(func() { f.Close() })
+	require.Equal(t, []string{
+		filepath.Join(root, "bin/foo.debug"),
+		filepath.Join(root, "bin/.debug/foo.debug"),
+		filepath.Join(root, "nix/store/abc-foo-debug/lib/debug/.build-id/ab/cdef.debug"),
+		filepath.Join(root, "nix/store/abc-foo-debug/lib/debug/abcdef/debuginfo"),
+		filepath.Join(root, "nix/store/def-bar-debug/lib/debug/.build-id/ab/cdef.debug"),
+		filepath.Join(root, "nix/store/def-bar-debug/lib/debug/abcdef/debuginfo"),
+		filepath.Join(root, "usr/lib/debug/bin/foo.debug"),
+	}, f.generatePaths(root, "abcdef", filepath.Join(root, "bin/foo"), ""))
+}
+
+func TestFinder_search(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{
+		"opt/debug/pkg/.dwz/ab/cdef.debug",
+		"opt/debug/pkg/ab/cdef.debug",
+		"opt/debug/other/foo.debug",
+		"usr/lib/debug/bar.debug",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, file), []byte("whatever"), 0o600))
+	}
+	dirs, err := ParseDebugDirs([]string{"/usr/lib/debug", "/opt/debug:recursive"})
+	require.NoError(t, err)
+	f := NewFinder(log.NewNopLogger(), trace.NewNoopTracerProvider().Tracer("test"), prometheus.NewRegistry(), dirs)
+	t.Cleanup(func() { f.Close() })
+
+	// The supplementary files of dwz are skipped.
+	found, byBuildID := f.search(root, "abcdef", filepath.Join(root, "bin/app"), "")
+	require.Equal(t, filepath.Join(root, "opt/debug/pkg/ab/cdef.debug"), found)
+	require.True(t, byBuildID)
+
+	found, byBuildID = f.search(root, "123456", filepath.Join(root, "bin/app"), "foo.debug")
+	require.Equal(t, filepath.Join(root, "opt/debug/other/foo.debug"), found)
+	require.False(t, byBuildID)
+
+	// Only the recursive directories are walked.
+	found, _ = f.search(root, "123456", filepath.Join(root, "bin/bar"), "")
+	require.Empty(t, found)
+}
+
+func TestFinderWatchesDebugDirs(t *testing.T) {
+	root := t.TempDir()
+	dbg := filepath.Join(root, "usr", "lib", "debug")
+	require.NoError(t, os.MkdirAll(filepath.Join(dbg, ".build-id", "ab"), 0o755))
+
+	f := NewFinder(log.NewNopLogger(), trace.NewNoopTracerProvider().Tracer("test"), prometheus.NewRegistry(), defaultDebugDirs)
+	t.Cleanup(func() { f.Close() })
+	if f.watcher == nil {
+		t.Skip("inotify is not available")
+	}
+
+	notFound := func(buildIDs ...string) {
+		t.Helper()
+		for _, buildID := range buildIDs {
+			f.cache.Put(buildID, os.ErrNotExist)
+			f.setNotFound(buildID, true)
+		}
+		f.watchDebugDirs(root)
+	}
+	cached := func(buildID string) bool {
+		_, ok := f.cache.GetIfPresent(buildID)
+		return ok
+	}
+
+	// The files named after a build ID only invalidate it.
+	notFound("abcdef", "123456")
+	require.NoError(t, os.WriteFile(filepath.Join(dbg, ".build-id", "ab", "cdef.debug"), []byte("whatever"), 0o600))
+	require.Eventually(t, func() bool { return !cached("abcdef") }, time.Second, 10*time.Millisecond)
+	require.True(t, cached("123456"))
+
+	// The new directories of build IDs are watched.
+	require.NoError(t, os.Mkdir(filepath.Join(dbg, ".build-id", "12"), 0o755))
+	require.Eventually(t, func() bool {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		_, ok := f.watchedPaths[filepath.Join(dbg, ".build-id", "12")]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, os.WriteFile(filepath.Join(dbg, ".build-id", "12", "3456.debug"), []byte("whatever"), 0o600))
+	require.Eventually(t, func() bool { return !cached("123456") }, time.Second, 10*time.Millisecond)
+
+	// The others invalidate all the files not found.
+	notFound("abcdef", "123456")
+	require.NoError(t, os.WriteFile(filepath.Join(dbg, "app.debug"), []byte("whatever"), 0o600))
+	require.Eventually(t, func() bool { return !cached("abcdef") && !cached("123456") }, time.Second, 10*time.Millisecond)
+}
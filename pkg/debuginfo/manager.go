@@ -21,9 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptrace"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/log"
@@ -43,9 +45,11 @@ import (
 	"google.golang.org/grpc/status"
 
 	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/encryption"
 	parcahttp "github.com/parca-dev/parca-agent/pkg/http"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/tenant"
 )
 
 // Manager is a mechanism for extracting or finding the relevant debug information for the discovered executables.
@@ -55,10 +59,13 @@ type Manager struct {
 	metrics *metrics
 
 	objFilePool *objectfile.Pool
+	rootFS      *process.RootFS
 
 	debuginfoClient debuginfopb.DebuginfoServiceClient
 	stripDebuginfos bool
 	tempDir         string
+	// Encrypts the files extracted to tempDir, nil when they aren't.
+	cipher *encryption.Cipher
 
 	// If requested buildID is not in the cache, we do NOT initiate an upload request to the server.
 	shouldInitiateCache burrow.Cache
@@ -72,10 +79,22 @@ type Manager struct {
 	// Makes sure we do not try to upload the same buildID simultaneously.
 	uploadSingleflight    *singleflight.Group
 	uploadTaskTokens      *semaphore.Weighted
+	uploadMaxParallel     int64
 	uploadTimeoutDuration time.Duration
 
+	// The uploads outlive the context of their callers, they are only
+	// canceled once the manager is drained.
+	uploadCtx    context.Context //nolint:containedctx
+	uploadCancel context.CancelFunc
+	draining     atomic.Bool
+
 	httpClient *http.Client
 
+	// Records the uploads instead of making them, nil unless dry running.
+	dryRun *DryRunLog
+	// Skips the uploads of files too large, nil when their size is unlimited.
+	budget *UploadBudget
+
 	*Extractor
 	*Finder
 }
@@ -86,40 +105,53 @@ func New(
 	tracer trace.Tracer,
 	reg prometheus.Registerer,
 	objFilePool *objectfile.Pool,
+	rootFS *process.RootFS,
 	debuginfoClient debuginfopb.DebuginfoServiceClient,
 	uploadMaxParallel int,
 	uploadTimeout time.Duration,
 	cacheDisabled bool,
 	cacheTTL time.Duration,
-	debugDirs []string,
+	debugDirs []DebugDir,
 	stripDebuginfos bool,
 	tempDir string,
+	cipher *encryption.Cipher,
+	uploadTransport http.RoundTripper,
+	dryRun *DryRunLog,
+	budget *UploadBudget,
 ) *Manager {
 	var (
 		shouldInitiateCache burrow.Cache = cache.NewNoopCache()
 		hashCache           burrow.Cache = cache.NewNoopCache()
 	)
 	if !cacheDisabled {
-		shouldInitiateCache = burrow.New(
+		shouldInitiateCache = cache.NewSizedCache(
 			burrow.WithExpireAfterWrite(cacheTTL),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "debuginfo_should_initiate")),
 		)
-		hashCache = burrow.New(
+		hashCache = cache.NewSizedCache(
 			burrow.WithExpireAfterAccess(5*time.Minute),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "debuginfo_hash")),
 		)
 	}
+	if uploadTransport == nil {
+		uploadTransport = http.DefaultTransport
+	}
+	uploadCtx, uploadCancel := context.WithCancel(context.Background())
 	return &Manager{
 		logger:      logger,
 		tracer:      tracer,
 		metrics:     newMetrics(reg),
 		objFilePool: objFilePool,
+		rootFS:      rootFS,
 
 		debuginfoClient: debuginfoClient,
 		stripDebuginfos: stripDebuginfos,
 		tempDir:         tempDir,
+		cipher:          cipher,
 
-		httpClient: parcahttp.NewClient(reg),
+		httpClient: parcahttp.NewClient(reg, uploadTransport),
+		dryRun:     dryRun,
+		budget:     budget,
 		Extractor:  NewExtractor(logger, tracer),
 		Finder:     NewFinder(logger, tracer, reg, debugDirs),
 
@@ -131,7 +163,11 @@ func New(
 
 		uploadSingleflight:    &singleflight.Group{},
 		uploadTaskTokens:      semaphore.NewWeighted(int64(uploadMaxParallel)),
+		uploadMaxParallel:     int64(uploadMaxParallel),
 		uploadTimeoutDuration: uploadTimeout,
+
+		uploadCtx:    uploadCtx,
+		uploadCancel: uploadCancel,
 	}
 }
 
@@ -186,7 +222,7 @@ func (di *Manager) UploadMapping(ctx context.Context, m *process.Mapping) (err e
 		// Therefore, to be able shorten this window as much as possible, we extract and find the debuginfo
 		// files synchronously and upload them asynchronously.
 		// We still might be too slow to obtain the necessary file descriptors for certain short-lived processes.
-		if dbg, err = di.ExtractOrFind(ctx, m.Root(), src); err != nil {
+		if dbg, err = di.ExtractOrFind(ctx, di.rootFS.Root(m.PID), src); err != nil {
 			di.metrics.ensureUploadedErrors.WithLabelValues(lvExtractOrFind).Inc()
 			return err
 		}
@@ -194,9 +230,13 @@ func (di *Manager) UploadMapping(ctx context.Context, m *process.Mapping) (err e
 		src.DebugFile = dbg
 	}
 
+	if di.dryRun != nil {
+		return di.recordDryRun(ctx, src, dbg)
+	}
+
 	// NOTICE: All the caches and references are based on the source file's buildID.
-	// Extraction won't change the buildID, but finding might.
-	// This is not a problem, Find has its own cache and it will be bounced back from server upload step.
+	// Neither extraction nor finding change the buildID, even if it is a hash of
+	// the contents of the source file.
 	if err := di.Upload(ctx, dbg); err != nil {
 		di.metrics.ensureUploadedErrors.WithLabelValues(lvUpload).Inc()
 		return err
@@ -217,7 +257,13 @@ func (di *Manager) ShouldInitiateUpload(ctx context.Context, buildID string) (_
 		}
 	}()
 
-	if _, ok := di.shouldInitiateCache.GetIfPresent(buildID); ok {
+	// Nothing is sent to the server when dry running.
+	if di.dryRun != nil {
+		return !di.dryRun.has(tenant.CacheKey(ctx, buildID)), nil
+	}
+
+	// Each tenant has its own debuginfo.
+	if _, ok := di.shouldInitiateCache.GetIfPresent(tenant.CacheKey(ctx, buildID)); ok {
 		return false, nil
 	}
 
@@ -229,7 +275,7 @@ func (di *Manager) ShouldInitiateUpload(ctx context.Context, buildID string) (_
 	}
 
 	if !shouldInitiateResp.ShouldInitiateUpload {
-		di.shouldInitiateCache.Put(buildID, struct{}{})
+		di.shouldInitiateCache.Put(tenant.CacheKey(ctx, buildID), struct{}{})
 		return false, nil
 	}
 
@@ -252,7 +298,7 @@ func (di *Manager) ExtractOrFind(ctx context.Context, root string, src *objectfi
 	if err == nil && dbgInfoPath != "" {
 		di.metrics.found.WithLabelValues(lvSuccess).Inc()
 		di.metrics.findDuration.Observe(time.Since(now).Seconds())
-		dbgInfoFile, err := di.objFilePool.Open(dbgInfoPath)
+		dbgInfoFile, err := di.objFilePool.OpenWithBuildID(dbgInfoPath, src.BuildID)
 		if err == nil {
 			return dbgInfoFile, nil
 		}
@@ -264,7 +310,7 @@ func (di *Manager) ExtractOrFind(ctx context.Context, root string, src *objectfi
 	}
 
 	// If we didn't find an external debuginfo file, we continue with striping to create one.
-	dbgInfoFile, err := di.Extract(ctx, src)
+	dbgInfoFile, err := di.Extract(ctx, root, src)
 	if err != nil {
 		return nil, fmt.Errorf("failed to strip debuginfo: %w", err)
 	}
@@ -273,7 +319,9 @@ func (di *Manager) ExtractOrFind(ctx context.Context, root string, src *objectfi
 	return dbgInfoFile, nil
 }
 
-func (di *Manager) Extract(ctx context.Context, src *objectfile.ObjectFile) (*objectfile.ObjectFile, error) {
+// Extract extracts the debug information of the given object file, along with
+// the one of its split DWARF package, if it was built with -gsplit-dwarf.
+func (di *Manager) Extract(ctx context.Context, root string, src *objectfile.ObjectFile) (*objectfile.ObjectFile, error) {
 	defer src.HoldOn()
 
 	ctx, span := di.tracer.Start(ctx, "DebuginfoManager.Extract")
@@ -293,8 +341,9 @@ func (di *Manager) Extract(ctx context.Context, src *objectfile.ObjectFile) (*ob
 		ctx, cancel := context.WithTimeout(ctx, di.extractTimeoutDuration)
 		defer cancel()
 
+		dwp := di.splitDWARFPackage(root, src, ef)
 		val, err, shared := di.extractSingleflight.Do(buildID, func() (interface{}, error) {
-			return di.extract(ctx, buildID, src)
+			return di.extract(ctx, buildID, src, dwp)
 		})
 		if err != nil {
 			if shared {
@@ -313,7 +362,39 @@ func (di *Manager) Extract(ctx context.Context, src *objectfile.ObjectFile) (*ob
 	return src, nil
 }
 
-func (di *Manager) extract(ctx context.Context, buildID string, src *objectfile.ObjectFile) (_ *objectfile.ObjectFile, err error) { //nolint:nonamedreturns
+// splitDWARFPackage returns the path of the split DWARF package of the given
+// object file, if its DWARF was split and it was packaged.
+func (di *Manager) splitDWARFPackage(root string, src *objectfile.ObjectFile, ef *elf.File) string {
+	units, err := skeletonUnits(ef)
+	if err != nil {
+		level.Debug(di.logger).Log("msg", "failed to read skeleton units", "path", src.Path, "err", err)
+		return ""
+	}
+	if len(units) == 0 {
+		return ""
+	}
+
+	dwp, err := findSplitDWARFPackage(src.Path)
+	if err == nil {
+		di.metrics.splitDWARF.WithLabelValues(lvSplitDWARFPackage).Inc()
+		return dwp
+	}
+
+	// The .dwo files are not packaged by the agent, as it requires merging
+	// the string tables and indexing the units, like dwp does.
+	for _, u := range units {
+		if _, err := fs.Stat(fileSystem, resolveInRoot(root, u.path(root))); err == nil {
+			di.metrics.splitDWARF.WithLabelValues(lvSplitDWARFObjects).Inc()
+			level.Debug(di.logger).Log("msg", "split DWARF objects are not uploaded, package them with dwp to upload their line information", "path", src.Path, "package", src.Path+splitDWARFPackageExt)
+			return ""
+		}
+	}
+	di.metrics.splitDWARF.WithLabelValues(lvSplitDWARFMissing).Inc()
+	level.Debug(di.logger).Log("msg", "split DWARF not found", "path", src.Path, "err", err)
+	return ""
+}
+
+func (di *Manager) extract(ctx context.Context, buildID string, src *objectfile.ObjectFile, dwp string) (_ *objectfile.ObjectFile, err error) { //nolint:nonamedreturns
 	defer src.HoldOn()
 
 	ctx, span := di.tracer.Start(ctx, "DebuginfoManager.extract")
@@ -334,7 +415,7 @@ func (di *Manager) extract(ctx context.Context, buildID string, src *objectfile.
 	if err := os.MkdirAll(di.tempDir, 0o755); err != nil {
 		return nil, fmt.Errorf("failed to create temp dir: %w", err)
 	}
-	f, err := os.CreateTemp(di.tempDir, buildID)
+	f, err := di.createTemp(buildID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
@@ -351,7 +432,20 @@ func (di *Manager) extract(ctx context.Context, buildID string, src *objectfile.
 	span.AddEvent("acquired reader for objectfile")
 	defer release()
 
-	if err := di.Extractor.Extract(ctx, f, r); err != nil {
+	// The package is best effort, the line information of the split units
+	// is missing without it.
+	var pkg SeekReaderAt
+	if dwp != "" {
+		pf, err := os.Open(dwp)
+		if err != nil {
+			level.Debug(di.logger).Log("msg", "failed to open split DWARF package", "path", dwp, "err", err)
+		} else {
+			defer pf.Close()
+			pkg = pf
+		}
+	}
+
+	if err := di.Extractor.Extract(ctx, f, r, pkg); err != nil {
 		err = fmt.Errorf("failed to extract debug information: %w", err)
 		return nil, err
 	}
@@ -360,8 +454,10 @@ func (di *Manager) extract(ctx context.Context, buildID string, src *objectfile.
 		return nil, fmt.Errorf("failed to seek to the beginning of the file: %w", err)
 	}
 
-	// Try to open the file to make sure it's valid.
-	debuginfoFile, err := di.objFilePool.NewFile(f)
+	// Try to open the file to make sure it's valid. It is known by the build
+	// ID of its source, which differs from the hash of its contents when the
+	// source has no build ID.
+	debuginfoFile, err := di.objFilePool.NewFileWithBuildID(f, buildID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open debuginfo file: %w", err)
 	}
@@ -383,7 +479,11 @@ func (di *Manager) Upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 		}
 	}()
 
-	ctx, cancel := context.WithTimeout(ctx, di.uploadTimeoutDuration)
+	if di.draining.Load() {
+		return errDraining
+	}
+
+	ctx, cancel := context.WithTimeout(detachedContext{Context: di.uploadCtx, values: ctx}, di.uploadTimeoutDuration)
 	defer cancel()
 
 	buildID := dbg.BuildID
@@ -407,7 +507,8 @@ func (di *Manager) Upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 
 	now = time.Now()
 	// The singleflight group prevents uploading the same buildID concurrently.
-	_, err, shared := di.uploadSingleflight.Do(buildID, func() (interface{}, error) {
+	key := tenant.CacheKey(ctx, buildID)
+	_, err, shared := di.uploadSingleflight.Do(key, func() (interface{}, error) {
 		return nil, di.upload(ctx, dbg)
 	})
 	if shared {
@@ -415,7 +516,7 @@ func (di *Manager) Upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 		span.SetAttributes(attribute.Bool("shared", true))
 	}
 	if err != nil {
-		di.uploadSingleflight.Forget(buildID) // Do not cache failed uploads.
+		di.uploadSingleflight.Forget(key) // Do not cache failed uploads.
 		di.metrics.uploaded.WithLabelValues(lvFail).Inc()
 		return err
 	}
@@ -424,6 +525,30 @@ func (di *Manager) Upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 	return nil
 }
 
+// tempFile is a file debuginfo is extracted to.
+type tempFile interface {
+	objectfile.File
+	io.Writer
+}
+
+// createTemp creates a temporary file in tempDir, encrypted if a cipher is
+// configured.
+func (di *Manager) createTemp(pattern string) (tempFile, error) {
+	var (
+		f   tempFile
+		err error
+	)
+	if di.cipher != nil {
+		f, err = di.cipher.CreateTemp(di.tempDir, pattern)
+	} else {
+		f, err = os.CreateTemp(di.tempDir, pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (di *Manager) upload(ctx context.Context, dbg *objectfile.ObjectFile) (err error) { //nolint:nonamedreturns
 	defer dbg.HoldOn()
 
@@ -443,35 +568,34 @@ func (di *Manager) upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 		}
 	}()
 
-	di.metrics.uploadAttempts.Inc()
-
-	var (
-		// The hash is cached to avoid re-hashing the same binary
-		// and getting to the same result again.
-		key = hashCacheKey{
-			buildID: buildID,
-			modtime: dbg.Modtime.Unix(),
+	size := dbg.Size
+	uploaded := false
+	if di.budget != nil {
+		t, _ := tenant.FromContext(ctx)
+		r := di.budget.reserve(tenant.CacheKey(ctx, buildID), SkippedUpload{
+			BuildID:       buildID,
+			Tenant:        t,
+			DebuginfoFile: dbg.Path,
+			Size:          size,
+		}, time.Now())
+		if r == nil {
+			level.Debug(di.logger).Log("msg", "debuginfo upload skipped, it exceeds the size limits", "buildid", buildID, "path", dbg.Path, "size", size)
+			span.SetAttributes(attribute.Bool("skipped", true))
+			return nil
 		}
-		size = dbg.Size
-		h    string
-	)
-	if v, ok := di.hashCache.GetIfPresent(key); ok {
-		h = v.(string) //nolint:forcetypeassert
-	} else {
-		span.AddEvent("acquiring reader for objectfile")
-		r, release, err := dbg.Reader()
-		if err != nil {
-			return fmt.Errorf("failed to obtain reader for object file: %w", err)
-		}
-		span.AddEvent("acquired reader for objectfile")
+		// Only the bytes actually uploaded count towards the budget.
+		defer func() {
+			if err != nil || !uploaded {
+				di.budget.release(r)
+			}
+		}()
+	}
 
-		h, err = hash.Reader(r)
-		if err != nil {
-			release()
-			return fmt.Errorf("hash debuginfos: %w", err)
-		}
-		release()
-		di.hashCache.Put(key, h)
+	di.metrics.uploadAttempts.Inc()
+
+	h, err := di.hash(ctx, dbg)
+	if err != nil {
+		return err
 	}
 
 	initiateResp, err := di.debuginfoClient.InitiateUpload(ctx, &debuginfopb.InitiateUploadRequest{
@@ -482,7 +606,7 @@ func (di *Manager) upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 	if err != nil {
 		if sts, ok := status.FromError(err); ok {
 			if sts.Code() == codes.AlreadyExists {
-				di.shouldInitiateCache.Put(buildID, struct{}{})
+				di.shouldInitiateCache.Put(tenant.CacheKey(ctx, buildID), struct{}{})
 				return nil
 			}
 		}
@@ -504,6 +628,7 @@ func (di *Manager) upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 		err = fmt.Errorf("upload debuginfo: %w", err)
 		return err
 	}
+	uploaded = true
 
 	_, err = di.debuginfoClient.MarkUploadFinished(ctx, &debuginfopb.MarkUploadFinishedRequest{
 		BuildId:  buildID,
@@ -515,12 +640,77 @@ func (di *Manager) upload(ctx context.Context, dbg *objectfile.ObjectFile) (err
 	return nil
 }
 
+// hash returns the hash of a debuginfo file. It is cached to avoid re-hashing
+// the same binary and getting to the same result again.
+func (di *Manager) hash(ctx context.Context, dbg *objectfile.ObjectFile) (string, error) {
+	span := trace.SpanFromContext(ctx)
+	key := hashCacheKey{
+		buildID: dbg.BuildID,
+		modtime: dbg.Modtime.Unix(),
+	}
+	if v, ok := di.hashCache.GetIfPresent(key); ok {
+		return v.(string), nil //nolint:forcetypeassert
+	}
+
+	span.AddEvent("acquiring reader for objectfile")
+	r, release, err := dbg.Reader()
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain reader for object file: %w", err)
+	}
+	defer release()
+	span.AddEvent("acquired reader for objectfile")
+
+	h, err := hash.Reader(r)
+	if err != nil {
+		return "", fmt.Errorf("hash debuginfos: %w", err)
+	}
+	di.hashCache.Put(key, h)
+	return h, nil
+}
+
+// recordDryRun records the debuginfo file of a binary that would have been
+// uploaded, once per build ID and tenant.
+func (di *Manager) recordDryRun(ctx context.Context, src, dbg *objectfile.ObjectFile) error {
+	key := tenant.CacheKey(ctx, src.BuildID)
+	if di.dryRun.has(key) {
+		return nil
+	}
+
+	h, err := di.hash(ctx, dbg)
+	if err != nil {
+		return err
+	}
+	t, _ := tenant.FromContext(ctx)
+	u := DryRunUpload{
+		BuildID:       src.BuildID,
+		Tenant:        t,
+		File:          src.Path,
+		DebuginfoFile: dbg.Path,
+		Size:          dbg.Size,
+		Hash:          h,
+		Time:          time.Now(),
+	}
+	if di.dryRun.record(key, u) {
+		level.Info(di.logger).Log("msg", "debuginfo would be uploaded", "buildid", u.BuildID, "tenant", u.Tenant, "file", u.File, "debuginfo_file", u.DebuginfoFile, "size", u.Size, "hash", u.Hash)
+	}
+	return nil
+}
+
 func (di *Manager) uploadFile(ctx context.Context, uploadInstructions *debuginfopb.UploadInstructions, r io.Reader, size int64) error {
+	start := time.Now()
 	switch uploadInstructions.UploadStrategy {
 	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_GRPC:
-		return di.uploadViaGRPC(ctx, di.debuginfoClient, uploadInstructions, r)
+		if err := di.uploadViaGRPC(ctx, di.debuginfoClient, uploadInstructions, r); err != nil {
+			return err
+		}
+		di.observeUpload(lvGRPC, size, time.Since(start))
+		return nil
 	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL:
-		return di.uploadViaSignedURL(ctx, uploadInstructions.SignedUrl, r, size)
+		if err := di.uploadViaSignedURL(ctx, uploadInstructions.SignedUrl, r, size); err != nil {
+			return err
+		}
+		di.observeUpload(lvSignedURL, size, time.Since(start))
+		return nil
 	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_UNSPECIFIED:
 		return fmt.Errorf("upload strategy unspecified, must set one of UPLOAD_STRATEGY_GRPC or UPLOAD_STRATEGY_SIGNED_URL")
 	default:
@@ -528,6 +718,13 @@ func (di *Manager) uploadFile(ctx context.Context, uploadInstructions *debuginfo
 	}
 }
 
+func (di *Manager) observeUpload(strategy string, size int64, duration time.Duration) {
+	di.metrics.uploadedBytes.WithLabelValues(strategy).Add(float64(size))
+	if duration > 0 {
+		di.metrics.uploadThroughput.WithLabelValues(strategy).Observe(float64(size) / duration.Seconds())
+	}
+}
+
 func (di *Manager) uploadViaGRPC(ctx context.Context, debuginfoClient debuginfopb.DebuginfoServiceClient, uploadInstructions *debuginfopb.UploadInstructions, r io.Reader) error {
 	ctx, span := di.tracer.Start(ctx, "DebuginfoManager.uploadViaGRPC")
 	defer span.End()
@@ -572,6 +769,44 @@ func (di *Manager) uploadViaSignedURL(ctx context.Context, url string, r io.Read
 	return nil
 }
 
+// CacheSizes returns how many build IDs not to upload and ELF hashes are
+// cached.
+func (di *Manager) CacheSizes() map[string]int {
+	return map[string]int{
+		"debuginfo_should_initiate": cache.Len(di.shouldInitiateCache),
+		"debuginfo_hash":            cache.Len(di.hashCache),
+	}
+}
+
+// errDraining is returned by the uploads requested once the manager is
+// drained.
+var errDraining = errors.New("debuginfo manager is shutting down")
+
+// detachedContext has the values of the context of the caller, such as its
+// span, but is only canceled along with the uploads of the manager.
+type detachedContext struct { //nolint:containedctx
+	context.Context
+	values context.Context
+}
+
+func (c detachedContext) Value(key any) any {
+	return c.values.Value(key)
+}
+
+// Drain refuses the new uploads and waits for the ones in flight or waiting
+// for a token to finish, until the context is done. The ones left are then
+// canceled.
+func (di *Manager) Drain(ctx context.Context) error {
+	di.draining.Store(true)
+	defer di.uploadCancel()
+
+	if err := di.uploadTaskTokens.Acquire(ctx, di.uploadMaxParallel); err != nil {
+		return fmt.Errorf("uploads in flight: %w", err)
+	}
+	di.uploadTaskTokens.Release(di.uploadMaxParallel)
+	return nil
+}
+
 func (di *Manager) Close() error {
 	var err error
 	err = errors.Join(err, di.Finder.Close())
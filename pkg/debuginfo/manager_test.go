@@ -41,6 +41,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/parca-dev/parca-agent/pkg/encryption"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 )
 
@@ -70,14 +71,19 @@ func BenchmarkUploadInitiateUploadError(b *testing.B) {
 		trace.NewNoopTracerProvider().Tracer("test"),
 		prometheus.NewRegistry(),
 		objFilePool,
+		nil,
 		c,
 		25,
 		2*time.Minute,
 		false,
 		5*time.Minute,
-		[]string{"/usr/lib/debug"},
+		defaultDebugDirs,
 		true,
 		"/tmp",
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 
 	ctx := context.Background()
@@ -155,14 +161,19 @@ func TestUpload(t *testing.T) {
 		trace.NewNoopTracerProvider().Tracer("test"),
 		prometheus.NewRegistry(),
 		objFilePool,
+		nil,
 		c,
 		25,
 		2*time.Minute,
 		false,
 		5*time.Minute,
-		[]string{"/usr/lib/debug"},
+		defaultDebugDirs,
 		true,
 		"/tmp",
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 
 	// Upload: 1 (canceled)
@@ -278,14 +289,19 @@ func TestUploadSingleFlight(t *testing.T) {
 		trace.NewNoopTracerProvider().Tracer("test"),
 		prometheus.NewRegistry(),
 		objFilePool,
+		nil,
 		c,
 		5,
 		2*time.Minute,
 		false,
 		5*time.Minute,
-		[]string{"/usr/lib/debug"},
+		defaultDebugDirs,
 		true,
 		"/tmp",
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 
 	done := make(chan struct{})
@@ -322,6 +338,92 @@ func TestUploadSingleFlight(t *testing.T) {
 	require.GreaterOrEqual(t, testutil.ToFloat64(dim.metrics.uploaded.WithLabelValues(lvShared)), 5.0)
 }
 
+func TestDrain(t *testing.T) {
+	name := filepath.Join("../../internal/pprof/binutils/testdata", "exe_linux_64")
+	objFilePool := objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 0)
+	t.Cleanup(func() {
+		objFilePool.Close()
+	})
+
+	dbgFile, err := objFilePool.Open(name)
+	require.NoError(t, err)
+	t.Cleanup(func() { dbgFile.HoldOn() })
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	t.Cleanup(func() {
+		testServer.Close()
+	})
+
+	c := &testClient{
+		ShouldInitiateUploadF: func(in *debuginfopb.ShouldInitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+			return &debuginfopb.ShouldInitiateUploadResponse{ShouldInitiateUpload: true}, nil
+		},
+		InitiateUploadF: func(in *debuginfopb.InitiateUploadRequest, opts ...grpc.CallOption) (*debuginfopb.InitiateUploadResponse, error) {
+			return &debuginfopb.InitiateUploadResponse{
+				UploadInstructions: &debuginfopb.UploadInstructions{
+					UploadId:       "upload-id",
+					BuildId:        dbgFile.BuildID,
+					UploadStrategy: debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL,
+					SignedUrl:      testServer.URL,
+				},
+			}, nil
+		},
+	}
+
+	dim := New(
+		log.NewNopLogger(),
+		trace.NewNoopTracerProvider().Tracer("test"),
+		prometheus.NewRegistry(),
+		objFilePool,
+		nil,
+		c,
+		5,
+		2*time.Minute,
+		false,
+		5*time.Minute,
+		defaultDebugDirs,
+		true,
+		"/tmp",
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	// The upload outlives the context of its caller.
+	ctx, cancel := context.WithCancel(context.Background())
+	uploaded := make(chan error)
+	go func() {
+		uploaded <- dim.Upload(ctx, dbgFile)
+	}()
+	<-started
+	cancel()
+
+	drained := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		drained <- dim.Drain(ctx)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drained with an upload in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-uploaded)
+	require.NoError(t, <-drained)
+
+	// The uploads are refused once drained.
+	require.ErrorIs(t, dim.Upload(context.Background(), dbgFile), errDraining)
+}
+
 func TestDisableStripping(t *testing.T) {
 	file := "./testdata/readelf-sections"
 	originalContent, err := os.ReadFile(file)
@@ -340,7 +442,7 @@ func TestDisableStripping(t *testing.T) {
 	t.Cleanup(func() { obj.HoldOn() })
 
 	// buildid: "test"
-	dbg, err := m.Extract(context.Background(), obj)
+	dbg, err := m.Extract(context.Background(), "", obj)
 	require.NoError(t, err)
 
 	r, release, err := dbg.Reader()
@@ -355,6 +457,58 @@ func TestDisableStripping(t *testing.T) {
 	}
 }
 
+func TestExtractEncrypted(t *testing.T) {
+	extract := func(t *testing.T, cipher *encryption.Cipher) []byte {
+		t.Helper()
+
+		objFilePool := objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 0)
+		t.Cleanup(func() { objFilePool.Close() })
+		m := New(
+			log.NewNopLogger(),
+			trace.NewNoopTracerProvider().Tracer("test"),
+			prometheus.NewRegistry(),
+			objFilePool,
+			nil,
+			nil,
+			1,
+			2*time.Minute,
+			true,
+			time.Minute,
+			nil,
+			true,
+			t.TempDir(),
+			cipher,
+			nil,
+			nil,
+			nil,
+		)
+
+		obj, err := objFilePool.Open("./testdata/readelf-sections")
+		require.NoError(t, err)
+		t.Cleanup(func() { obj.HoldOn() })
+
+		dbg, err := m.Extract(context.Background(), "", obj)
+		require.NoError(t, err)
+		require.NotSame(t, obj, dbg)
+
+		ef, release, err := dbg.ELF()
+		require.NoError(t, err)
+		require.NotNil(t, ef.Section(".symtab"))
+		release()
+
+		r, release, err := dbg.Reader()
+		require.NoError(t, err)
+		defer release()
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return content
+	}
+
+	cipher, err := encryption.NewCipher(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	require.Equal(t, extract(t, nil), extract(t, cipher))
+}
+
 func TestHasTextSection(t *testing.T) {
 	testCases := []struct {
 		name              string
@@ -26,6 +26,13 @@ const (
 
 	lvExtractOrFind = "extract_or_find"
 	lvUpload        = "upload"
+
+	lvGRPC      = "grpc"
+	lvSignedURL = "signed_url"
+
+	lvSplitDWARFPackage = "package"
+	lvSplitDWARFObjects = "objects"
+	lvSplitDWARFMissing = "missing"
 )
 
 type metrics struct {
@@ -34,6 +41,7 @@ type metrics struct {
 
 	extracted       *prometheus.CounterVec
 	extractDuration prometheus.Histogram
+	splitDWARF      *prometheus.CounterVec
 
 	found        *prometheus.CounterVec
 	findDuration prometheus.Histogram
@@ -45,6 +53,8 @@ type metrics struct {
 	uploadInitiated           prometheus.Counter
 	uploaded                  *prometheus.CounterVec
 	uploadDuration            prometheus.Histogram
+	uploadedBytes             *prometheus.CounterVec
+	uploadThroughput          *prometheus.HistogramVec
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -66,6 +76,10 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			Help:                        "Total time spent extracting debuginfo.",
 			NativeHistogramBucketFactor: 1.1,
 		}),
+		splitDWARF: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_debuginfo_split_dwarf_total",
+			Help: "Number of binaries with split DWARF extracted, by whether their package was found, only their unpackaged objects were, or neither.",
+		}, []string{"result"}),
 		found: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "parca_agent_debuginfo_found_total",
 			Help: "Total number of debug information found.",
@@ -105,6 +119,15 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			Help:                        "Total time spent loading cache.",
 			NativeHistogramBucketFactor: 1.1,
 		}),
+		uploadedBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_debuginfo_uploaded_bytes_total",
+			Help: "Total number of bytes of debuginfo uploaded, by upload strategy.",
+		}, []string{"strategy"}),
+		uploadThroughput: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        "parca_agent_debuginfo_upload_throughput_bytes_per_second",
+			Help:                        "Throughput of the debuginfo uploads, by upload strategy.",
+			NativeHistogramBucketFactor: 1.1,
+		}, []string{"strategy"}),
 	}
 	m.ensureUploadedRequests.WithLabelValues(lvSuccess)
 	m.ensureUploadedRequests.WithLabelValues(lvFail)
@@ -112,10 +135,38 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 	m.ensureUploadedErrors.WithLabelValues(lvUpload)
 	m.extracted.WithLabelValues(lvSuccess)
 	m.extracted.WithLabelValues(lvFail)
+	m.splitDWARF.WithLabelValues(lvSplitDWARFPackage)
+	m.splitDWARF.WithLabelValues(lvSplitDWARFObjects)
+	m.splitDWARF.WithLabelValues(lvSplitDWARFMissing)
 	m.found.WithLabelValues(lvSuccess)
 	m.found.WithLabelValues(lvFail)
 	m.uploaded.WithLabelValues(lvSuccess)
 	m.uploaded.WithLabelValues(lvFail)
 	m.uploaded.WithLabelValues(lvShared)
+	m.uploadedBytes.WithLabelValues(lvGRPC)
+	m.uploadedBytes.WithLabelValues(lvSignedURL)
 	return m
 }
+
+type breakerMetrics struct {
+	state    prometheus.Gauge
+	opened   prometheus.Counter
+	rejected prometheus.Counter
+}
+
+func newBreakerMetrics(reg prometheus.Registerer) *breakerMetrics {
+	return &breakerMetrics{
+		state: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_debuginfo_circuit_breaker_state",
+			Help: "State of the circuit breaker of the debuginfo client: 0 closed, 1 open, 2 half-open.",
+		}),
+		opened: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_debuginfo_circuit_breaker_opened_total",
+			Help: "Number of times the debuginfo server was found unavailable and the uploads paused.",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_debuginfo_circuit_breaker_rejected_total",
+			Help: "Number of calls to the debuginfo server rejected while it is unavailable.",
+		}),
+	}
+}
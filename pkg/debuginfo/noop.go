@@ -35,4 +35,6 @@ func (NoopDebuginfoManager) ExtractOrFind(_ context.Context, _ string, obj *obje
 
 func (NoopDebuginfoManager) Upload(context.Context, *objectfile.ObjectFile) error { return nil }
 
+func (NoopDebuginfoManager) Drain(context.Context) error { return nil }
+
 func (NoopDebuginfoManager) Close() error { return nil }
@@ -0,0 +1,106 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package debuginfo
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// Binaries built with -gsplit-dwarf only keep a skeleton of each compilation
+// unit, which names the .dwo file the rest of its DWARF, such as its line
+// information, was moved to. The .dwo files can be packaged into a single
+// .dwp file next to the binary, whose sections are extracted along with the
+// ones of the binary.
+//
+// See https://gcc.gnu.org/wiki/DebugFission.
+
+// attrGNUDwoName is the attribute naming the .dwo file of a skeleton unit
+// before DWARF 5.
+const attrGNUDwoName dwarf.Attr = 0x2130
+
+const splitDWARFPackageExt = ".dwp"
+
+var errSplitDWARFPackageNotFound = errors.New("split DWARF package not found")
+
+// skeletonUnit is a compilation unit whose DWARF is in a .dwo file.
+type skeletonUnit struct {
+	dwoName string
+	compDir string
+}
+
+// path returns the path of the .dwo file of the unit.
+func (u skeletonUnit) path(root string) string {
+	if filepath.IsAbs(u.dwoName) {
+		return filepath.Join(root, u.dwoName)
+	}
+	return filepath.Join(root, u.compDir, u.dwoName)
+}
+
+// skeletonUnits returns the compilation units of the given binary whose DWARF
+// was split.
+func skeletonUnits(ef *elf.File) ([]skeletonUnit, error) {
+	if ef.Section(".debug_info") == nil {
+		return nil, nil
+	}
+	d, err := ef.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DWARF: %w", err)
+	}
+
+	var units []skeletonUnit
+	r := d.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compilation unit: %w", err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagCompileUnit && entry.Tag != dwarf.TagSkeletonUnit {
+			r.SkipChildren()
+			continue
+		}
+
+		dwoName, ok := entry.Val(dwarf.AttrDwoName).(string)
+		if !ok {
+			dwoName, ok = entry.Val(attrGNUDwoName).(string)
+		}
+		if ok {
+			compDir, _ := entry.Val(dwarf.AttrCompDir).(string)
+			units = append(units, skeletonUnit{dwoName: dwoName, compDir: compDir})
+		}
+		r.SkipChildren()
+	}
+	return units, nil
+}
+
+// findSplitDWARFPackage returns the path of the .dwp package of the binary
+// at the given path, which is next to it.
+func findSplitDWARFPackage(path string) (string, error) {
+	dwp := path + splitDWARFPackageExt
+	if _, err := fs.Stat(fileSystem, dwp); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", errSplitDWARFPackageNotFound
+		}
+		return "", err
+	}
+	return dwp, nil
+}
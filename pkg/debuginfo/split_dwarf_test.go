@@ -0,0 +1,54 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package debuginfo
+
+import (
+	"debug/elf"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkeletonUnits(t *testing.T) {
+	ef, err := elf.Open("testdata/split-dwarf")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		ef.Close()
+	})
+
+	units, err := skeletonUnits(ef)
+	require.NoError(t, err)
+	require.Equal(t, []skeletonUnit{{dwoName: "split-dwarf.dwo", compDir: "."}}, units)
+	require.Equal(t, "/proc/1/root/split-dwarf.dwo", units[0].path("/proc/1/root"))
+
+	ef, err = elf.Open("testdata/readelf-sections.debug")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		ef.Close()
+	})
+
+	units, err = skeletonUnits(ef)
+	require.NoError(t, err)
+	require.Empty(t, units)
+}
+
+func TestFindSplitDWARFPackage(t *testing.T) {
+	dwp, err := findSplitDWARFPackage("testdata/split-dwarf")
+	require.NoError(t, err)
+	require.Equal(t, "testdata/split-dwarf.dwp", dwp)
+
+	_, err = findSplitDWARFPackage("testdata/readelf-sections")
+	require.ErrorIs(t, err, errSplitDWARFPackageNotFound)
+}
@@ -30,3 +30,13 @@ objcopy --add-gnu-debuglink=readelf-sections.debug readelf-sections
 cd ../..
 cp tmp/readelf-sections/readelf-sections.debug .
 cp tmp/readelf-sections/readelf-sections .
+
+# Split DWARF, packaged into split-dwarf.dwp.
+mkdir -p tmp/split-dwarf
+cp split-dwarf.c tmp/split-dwarf
+cd tmp/split-dwarf
+gcc -g -O0 -gsplit-dwarf -fdebug-prefix-map="$PWD"=. -o split-dwarf split-dwarf.c
+llvm-dwp -e split-dwarf -o split-dwarf.dwp
+
+cd ../..
+cp tmp/split-dwarf/split-dwarf tmp/split-dwarf/split-dwarf.dwp .
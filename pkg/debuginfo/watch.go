@@ -0,0 +1,187 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debuginfo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log/level"
+
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
+)
+
+// maxWatches bounds the inotify watches on the debug directories, of which
+// the system only allows so many.
+const maxWatches = 1024
+
+// dirKey identifies a watched directory, which the roots of the processes
+// sharing a filesystem see at different paths.
+type dirKey struct {
+	dev uint64
+	ino uint64
+}
+
+// watchDebugDirs watches the debug directories within the given root, their
+// .build-id directory and its subdirectories, for the debuginfo files
+// installed once they were looked for. The subdirectories of the recursive
+// ones aren't watched.
+func (f *Finder) watchDebugDirs(root string) {
+	if f.watcher == nil {
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, d := range f.debugDirs {
+		for _, dir := range d.expand(root) {
+			f.watch(dir)
+			if !d.byBuildID() {
+				continue
+			}
+			// The subdirectories are only listed once.
+			buildIDDir := filepath.Join(dir, ".build-id")
+			if !f.watch(buildIDDir) {
+				continue
+			}
+			entries, err := os.ReadDir(buildIDDir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					f.watch(filepath.Join(buildIDDir, e.Name()))
+				}
+			}
+		}
+	}
+}
+
+// watch adds a watch on a directory, unless it is already watched, e.g. from
+// another root. It returns whether the watch was added.
+func (f *Finder) watch(dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	id, ok := fileinfo.IDOf(info)
+	if !ok {
+		return false
+	}
+	key := dirKey{dev: id.Dev, ino: id.Ino}
+	if _, ok := f.watched[key]; ok {
+		return false
+	}
+	if len(f.watched) >= maxWatches {
+		return false
+	}
+	if err := f.watcher.Add(dir); err != nil {
+		level.Debug(f.logger).Log("msg", "failed to watch debug directory", "dir", dir, "err", err)
+		return false
+	}
+	f.watched[key] = struct{}{}
+	f.watchedPaths[dir] = key
+	return true
+}
+
+// runWatcher invalidates the files not found in the cache once new files are
+// created in the debug directories, e.g. by a package manager, until the
+// watcher is closed.
+func (f *Finder) runWatcher() {
+	for {
+		select {
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			f.handleEvent(event)
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			level.Debug(f.logger).Log("msg", "error encountered while watching debug directories", "err", err)
+		}
+	}
+}
+
+func (f *Finder) handleEvent(event fsnotify.Event) {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		// The watches of the removed directories are gone.
+		if key, ok := f.watchedPaths[event.Name]; ok {
+			delete(f.watchedPaths, event.Name)
+			delete(f.watched, key)
+		}
+		return
+	}
+	if !event.Has(fsnotify.Create) {
+		return
+	}
+
+	name := filepath.Base(event.Name)
+	if name == ".build-id" || filepath.Base(filepath.Dir(event.Name)) == ".build-id" {
+		// The new directories of the build IDs are watched as well.
+		f.mtx.Lock()
+		f.watch(event.Name)
+		f.mtx.Unlock()
+	}
+
+	// The files named after their build ID only invalidate it, the others,
+	// named after their binary or debug link, all the files not found.
+	var invalidated []string
+	f.notFoundMtx.Lock()
+	if buildID, ok := buildIDOfPath(event.Name); ok {
+		if _, ok := f.notFound[buildID]; ok {
+			invalidated = append(invalidated, buildID)
+		}
+	} else {
+		for buildID := range f.notFound {
+			invalidated = append(invalidated, buildID)
+		}
+	}
+	f.notFoundMtx.Unlock()
+
+	if len(invalidated) > 0 {
+		level.Debug(f.logger).Log("msg", "debuginfo file created, looking up the files not found again", "path", event.Name, "invalidated", len(invalidated))
+	}
+	for _, buildID := range invalidated {
+		f.cache.Invalidate(buildID)
+	}
+}
+
+// setNotFound records whether the debuginfo file of a build ID was not
+// found, to look it up again once new files are created.
+func (f *Finder) setNotFound(buildID string, notFound bool) {
+	f.notFoundMtx.Lock()
+	defer f.notFoundMtx.Unlock()
+	if notFound {
+		f.notFound[buildID] = struct{}{}
+	} else {
+		delete(f.notFound, buildID)
+	}
+}
+
+// buildIDOfPath returns the build ID a debuginfo file is named after, at
+// .build-id/ab/cdef1234.debug.
+func buildIDOfPath(path string) (string, bool) {
+	name := filepath.Base(path)
+	prefix := filepath.Base(filepath.Dir(path))
+	if len(prefix) != 2 || !strings.HasSuffix(name, dbgExt) || filepath.Base(filepath.Dir(filepath.Dir(path))) != ".build-id" {
+		return "", false
+	}
+	return prefix + strings.TrimSuffix(name, dbgExt), true
+}
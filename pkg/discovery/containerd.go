@@ -0,0 +1,119 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/discovery/kubernetes/containerruntimes/containerd"
+)
+
+type ContainerdConfig struct {
+	socketPath string
+	interval   time.Duration
+}
+
+func NewContainerdConfig(socketPath string, interval time.Duration) *ContainerdConfig {
+	if socketPath == "" {
+		socketPath = containerd.DefaultSocketPath
+	}
+	return &ContainerdConfig{socketPath: socketPath, interval: interval}
+}
+
+func (c *ContainerdConfig) Name() string {
+	return "containerd"
+}
+
+func (c *ContainerdConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	client, err := containerd.NewContainerdClient(c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("create containerd client: %w", err)
+	}
+
+	return &ContainerdDiscoverer{
+		logger:   d.Logger,
+		client:   client,
+		interval: c.interval,
+	}, nil
+}
+
+// ContainerdDiscoverer polls containerd's CRI API and reports the main
+// process of every running container.
+type ContainerdDiscoverer struct {
+	logger   log.Logger
+	client   *containerd.Client
+	interval time.Duration
+
+	seen map[string]struct{}
+}
+
+func (d *ContainerdDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
+	defer d.client.Close()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		containers, err := d.client.RunningContainers(ctx)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to list containers from containerd", "err", err)
+		} else if err := send(ctx, up, d.groups(containers)); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// groups returns the groups of the running containers plus empty groups for
+// the ones that stopped, so they are removed.
+func (d *ContainerdDiscoverer) groups(containers []containerd.Container) []Group {
+	recent := make(map[string]struct{}, len(containers))
+	groups := make([]Group, 0, len(containers))
+	for _, container := range containers {
+		recent[container.ID] = struct{}{}
+		groups = append(groups, &SingleTargetGroup{
+			source: containerdSource(container.ID),
+			labels: model.LabelSet{
+				"container":       model.LabelValue(container.Name),
+				"containerid":     model.LabelValue(container.ID),
+				"container_image": model.LabelValue(container.Image),
+			},
+			Target: container.PID,
+		})
+	}
+
+	for id := range d.seen {
+		if _, ok := recent[id]; !ok {
+			groups = append(groups, &SingleTargetGroup{source: containerdSource(id)})
+		}
+	}
+	d.seen = recent
+
+	return groups
+}
+
+func containerdSource(id string) string {
+	return "containerd/" + id
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/discovery/kubernetes/containerruntimes/docker"
+)
+
+type DockerConfig struct {
+	socketPath string
+}
+
+func NewDockerConfig(socketPath string) *DockerConfig {
+	if socketPath == "" {
+		socketPath = docker.DefaultSocketPath
+	}
+	return &DockerConfig{socketPath: socketPath}
+}
+
+func (c *DockerConfig) Name() string {
+	return "docker"
+}
+
+func (c *DockerConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	client, err := docker.NewDockerClient(c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("create docker client: %w", err)
+	}
+
+	return &DockerDiscoverer{
+		logger: d.Logger,
+		client: client,
+	}, nil
+}
+
+// DockerDiscoverer watches the Docker events API and reports the main process
+// of every running container.
+type DockerDiscoverer struct {
+	logger log.Logger
+	client *docker.Client
+}
+
+func (d *DockerDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
+	defer d.client.Close()
+
+	for {
+		err := d.watch(ctx, up)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		level.Warn(d.logger).Log("msg", "docker events stream failed, reconnecting", "err", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// watch sends all the running containers and then the changes reported by
+// the events API, until it fails.
+func (d *DockerDiscoverer) watch(ctx context.Context, up chan<- []Group) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before listing, so no container is missed.
+	msgs, errs := d.client.ContainerEvents(ctx)
+
+	ids, err := d.client.RunningContainers(ctx)
+	if err != nil {
+		return err
+	}
+
+	groups := make([]Group, 0, len(ids))
+	for _, id := range ids {
+		groups = append(groups, d.buildGroup(ctx, id))
+	}
+	if err := send(ctx, up, groups); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case msg := <-msgs:
+			if msg.Type != events.ContainerEventType {
+				continue
+			}
+
+			var group Group
+			switch msg.Action {
+			case "start", "unpause":
+				group = d.buildGroup(ctx, msg.Actor.ID)
+			case "die", "destroy", "pause":
+				group = &SingleTargetGroup{source: dockerSource(msg.Actor.ID)}
+			default:
+				continue
+			}
+
+			if err := send(ctx, up, []Group{group}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *DockerDiscoverer) buildGroup(ctx context.Context, id string) Group {
+	container, err := d.client.Container(ctx, id)
+	if err != nil || container.PID == 0 {
+		level.Debug(d.logger).Log("msg", "skipping container, cannot find pid", "container", id, "err", err)
+		return &SingleTargetGroup{source: dockerSource(id)}
+	}
+
+	return &SingleTargetGroup{
+		source: dockerSource(id),
+		labels: model.LabelSet{
+			"container":       model.LabelValue(container.Name),
+			"containerid":     model.LabelValue(container.ID),
+			"container_image": model.LabelValue(container.Image),
+		},
+		Target: container.PID,
+	}
+}
+
+func dockerSource(id string) string {
+	return "docker/" + id
+}
+
+func send(ctx context.Context, up chan<- []Group, groups []Group) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case up <- groups:
+		return nil
+	}
+}
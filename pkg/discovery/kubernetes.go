@@ -23,6 +23,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 
 	"github.com/parca-dev/parca-agent/pkg/discovery/kubernetes"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
 )
 
 type PodConfig struct {
@@ -119,6 +120,7 @@ func (g *PodDiscoverer) buildGroup(pod *v1.Pod, containers []*kubernetes.Contain
 	for k, v := range pod.ObjectMeta.Labels {
 		tg.labels[model.LabelName(strutil.SanitizeLabelName(k))] = model.LabelValue(v)
 	}
+	tg.labels = tg.labels.Merge(profiler.OverrideLabels(pod.ObjectMeta.Annotations))
 
 	for _, container := range containers {
 		tg.Targets[container.PID] = tg.Targets[container.PID].Merge(model.LabelSet{
@@ -101,3 +101,40 @@ func (c *Client) PIDFromContainerID(containerID string) (int, error) {
 
 	return containerdInspect.PID, nil
 }
+
+// Container is a running container managed by containerd.
+type Container struct {
+	ID    string
+	Name  string
+	Image string
+	PID   int
+}
+
+// RunningContainers returns the containers that are running.
+func (c *Client) RunningContainers(ctx context.Context) ([]Container, error) {
+	resp, err := c.client.ListContainers(ctx, &pb.ListContainersRequest{
+		Filter: &pb.ContainerFilter{
+			State: &pb.ContainerStateValue{State: pb.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	containers := make([]Container, 0, len(resp.Containers))
+	for _, container := range resp.Containers {
+		pid, err := c.PIDFromContainerID("containerd://" + container.Id)
+		if err != nil {
+			// The container might have exited in the meantime.
+			continue
+		}
+
+		containers = append(containers, Container{
+			ID:    container.Id,
+			Name:  container.GetMetadata().GetName(),
+			Image: container.GetImage().GetImage(),
+			PID:   pid,
+		})
+	}
+	return containers, nil
+}
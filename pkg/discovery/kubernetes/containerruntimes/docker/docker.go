@@ -20,6 +20,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 )
 
@@ -80,3 +83,54 @@ func (c *Client) PIDFromContainerID(containerID string) (int, error) {
 
 	return containerJSON.State.Pid, nil
 }
+
+// Container is a running Docker container.
+type Container struct {
+	ID    string
+	Name  string
+	Image string
+	PID   int
+}
+
+// Container returns the details of the given container.
+func (c *Client) Container(ctx context.Context, containerID string) (Container, error) {
+	containerJSON, err := c.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return Container{}, fmt.Errorf("failed to inspect container, container id: %s: %w", containerID, err)
+	}
+
+	if containerJSON.State == nil {
+		return Container{}, fmt.Errorf("container state is nil")
+	}
+
+	container := Container{
+		ID:   containerJSON.ID,
+		Name: strings.TrimPrefix(containerJSON.Name, "/"),
+		PID:  containerJSON.State.Pid,
+	}
+	if containerJSON.Config != nil {
+		container.Image = containerJSON.Config.Image
+	}
+	return container, nil
+}
+
+// RunningContainers returns the IDs of the containers that are running.
+func (c *Client) RunningContainers(ctx context.Context) ([]string, error) {
+	containers, err := c.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	return ids, nil
+}
+
+// ContainerEvents subscribes to the lifecycle events of containers.
+func (c *Client) ContainerEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	return c.client.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(filters.Arg("type", string(events.ContainerEventType))),
+	})
+}
@@ -48,26 +48,9 @@ type Client struct {
 }
 
 func NewKubernetesClient(logger log.Logger, nodeName, socketPath string) (*Client, error) {
-	var (
-		config *rest.Config
-		err    error
-	)
-	kubeconfigFile := os.Getenv(KubeConfigEnv)
-	if kubeconfigFile != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigFile)
-		if err != nil {
-			return nil, fmt.Errorf("create config from %s: %w", kubeconfigFile, err)
-		}
-	} else {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, fmt.Errorf("create in-cluster config: %w", err)
-		}
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := NewClientset()
 	if err != nil {
-		return nil, fmt.Errorf("create clientset: %w", err)
+		return nil, err
 	}
 
 	fieldSelector := fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
@@ -92,6 +75,33 @@ func NewKubernetesClient(logger log.Logger, nodeName, socketPath string) (*Clien
 	}, nil
 }
 
+// NewClientset creates a clientset from the kubeconfig file in the
+// KUBECONFIG environment variable, or else the in-cluster configuration.
+func NewClientset() (*kubernetes.Clientset, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	kubeconfigFile := os.Getenv(KubeConfigEnv)
+	if kubeconfigFile != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("create config from %s: %w", kubeconfigFile, err)
+		}
+	} else {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("create in-cluster config: %w", err)
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("create clientset: %w", err)
+	}
+	return clientset, nil
+}
+
 func (c *Client) Clientset() kubernetes.Interface {
 	return c.clientset
 }
@@ -0,0 +1,129 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const containerIDIndex = "containerID"
+
+// PodIndex keeps the pods of a node up to date, indexed by the IDs of their
+// containers.
+type PodIndex struct {
+	logger   log.Logger
+	informer cache.SharedIndexInformer
+}
+
+func NewPodIndex(logger log.Logger, node string, clientset kubernetes.Interface) *PodIndex {
+	optionsModifier := func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", node).String()
+	}
+	podListWatcher := cache.NewFilteredListWatchFromClient(clientset.CoreV1().RESTClient(), "pods", "", optionsModifier)
+
+	informer := cache.NewSharedIndexInformer(podListWatcher, &v1.Pod{}, 0, cache.Indexers{
+		containerIDIndex: podContainerIDs,
+	})
+	return &PodIndex{
+		logger:   logger,
+		informer: informer,
+	}
+}
+
+// Run watches the pods until the context is done.
+func (i *PodIndex) Run(ctx context.Context) error {
+	level.Debug(i.logger).Log("msg", "starting pod index")
+	i.informer.Run(ctx.Done())
+	level.Debug(i.logger).Log("msg", "stopping pod index")
+	return nil
+}
+
+// HasSynced returns true once the pods of the node were listed.
+func (i *PodIndex) HasSynced() bool {
+	return i.informer.HasSynced()
+}
+
+// ContainerPod returns the pod running the container with the given ID, and
+// the name of the container.
+func (i *PodIndex) ContainerPod(containerID string) (*v1.Pod, string, bool) {
+	objs, err := i.informer.GetIndexer().ByIndex(containerIDIndex, containerID)
+	if err != nil || len(objs) == 0 {
+		return nil, "", false
+	}
+	pod, ok := objs[0].(*v1.Pod)
+	if !ok {
+		return nil, "", false
+	}
+	for _, s := range containerStatuses(pod) {
+		if trimContainerID(s.ContainerID) == containerID {
+			return pod, s.Name, true
+		}
+	}
+	return nil, "", false
+}
+
+// Workload returns the kind and name of the workload controlling the pod,
+// e.g. its Deployment rather than the ReplicaSet it was created by.
+func Workload(pod *v1.Pod) (string, string) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", ""
+	}
+	if owner.Kind == "ReplicaSet" {
+		// Named after their Deployment and the hash of the pod template.
+		if hash, ok := pod.Labels["pod-template-hash"]; ok && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "Deployment", strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	}
+	return owner.Kind, owner.Name
+}
+
+func podContainerIDs(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	var ids []string
+	for _, s := range containerStatuses(pod) {
+		if id := trimContainerID(s.ContainerID); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func containerStatuses(pod *v1.Pod) []v1.ContainerStatus {
+	statuses := make([]v1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses)+len(pod.Status.EphemeralContainerStatuses))
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	return append(statuses, pod.Status.EphemeralContainerStatuses...)
+}
+
+// trimContainerID removes the runtime prefix of container IDs in pod
+// statuses, e.g. "containerd://".
+func trimContainerID(id string) string {
+	if i := strings.Index(id, "://"); i >= 0 {
+		return id[i+3:]
+	}
+	return id
+}
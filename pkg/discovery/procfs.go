@@ -0,0 +1,122 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+type ProcfsConfig struct {
+	interval time.Duration
+}
+
+func NewProcfsConfig(interval time.Duration) *ProcfsConfig {
+	return &ProcfsConfig{interval: interval}
+}
+
+func (c *ProcfsConfig) Name() string {
+	return "procfs"
+}
+
+func (c *ProcfsConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	fs, err := procfs.NewDefaultFS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open procfs: %w", err)
+	}
+
+	return &ProcfsDiscoverer{
+		logger:   d.Logger,
+		fs:       fs,
+		interval: c.interval,
+	}, nil
+}
+
+// ProcfsDiscoverer periodically scans procfs and reports every process as a
+// target, labelled with its command name.
+type ProcfsDiscoverer struct {
+	logger   log.Logger
+	fs       procfs.FS
+	interval time.Duration
+
+	seen map[int]string
+}
+
+func (d *ProcfsDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		targets, changed, err := d.scan()
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to scan procfs", "err", err)
+		} else if changed {
+			groups := []Group{&MultiTargetGroup{source: "procfs", Targets: targets}}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case up <- groups:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan returns the current processes and whether they changed since the last
+// scan.
+func (d *ProcfsDiscoverer) scan() (map[int]model.LabelSet, bool, error) {
+	procs, err := d.fs.AllProcs()
+	if err != nil {
+		return nil, false, err
+	}
+
+	recent := make(map[int]string, len(procs))
+	for _, p := range procs {
+		comm, err := p.Comm()
+		if err != nil {
+			// The process might have exited already.
+			continue
+		}
+		recent[p.PID] = comm
+	}
+
+	changed := len(recent) != len(d.seen)
+	if !changed {
+		for pid, comm := range recent {
+			if seenComm, ok := d.seen[pid]; !ok || seenComm != comm {
+				changed = true
+				break
+			}
+		}
+	}
+	d.seen = recent
+
+	targets := make(map[int]model.LabelSet, len(recent))
+	for pid, comm := range recent {
+		targets[pid] = model.LabelSet{"comm": model.LabelValue(comm)}
+	}
+	return targets, changed, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/process"
+)
+
+// Store keeps the latest targets sent by the discovery Manager, indexed by
+// PID, so they can be shared by several consumers. Processes dropped by the
+// filter are not targets.
+type Store struct {
+	logger log.Logger
+	filter *process.NameFilter
+
+	mtx   *sync.RWMutex
+	state map[int]model.LabelSet
+}
+
+func NewStore(logger log.Logger, filter *process.NameFilter) *Store {
+	return &Store{
+		logger: logger,
+		filter: filter,
+		mtx:    &sync.RWMutex{},
+		state:  map[int]model.LabelSet{},
+	}
+}
+
+// Run consumes the target updates from the given channel until the context
+// is canceled.
+func (s *Store) Run(ctx context.Context, ch <-chan map[string][]Group) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case tSets := <-ch:
+			level.Debug(s.logger).Log("msg", "received new service discovery targets", "targets", fmt.Sprintf("%+v", tSets))
+			s.update(tSets)
+		}
+	}
+}
+
+func (s *Store) update(tSets map[string][]Group) {
+	state := map[int]model.LabelSet{}
+	for _, groups := range tSets {
+		for _, group := range groups {
+			switch v := group.(type) {
+			case *SingleTargetGroup:
+				if s.filter.Keep(v.Target) {
+					updateState(state, v.Target, group.Labels())
+				}
+			case *MultiTargetGroup:
+				for pid, labels := range v.Targets {
+					if s.filter.Keep(pid) {
+						updateState(state, pid, group.Labels().Merge(labels))
+					}
+				}
+			default:
+				level.Warn(s.logger).Log("msg", "unknown group type", "type", fmt.Sprintf("%T", group))
+				continue
+			}
+		}
+	}
+
+	s.mtx.Lock()
+	s.state = state
+	s.mtx.Unlock()
+}
+
+func updateState(state map[int]model.LabelSet, pid int, labels model.LabelSet) {
+	if pid == 0 {
+		return
+	}
+	if len(labels) == 0 {
+		return
+	}
+	if _, ok := state[pid]; ok {
+		state[pid] = state[pid].Merge(labels)
+	} else {
+		state[pid] = labels
+	}
+}
+
+// Labels returns the labels of the target with the given PID.
+func (s *Store) Labels(pid int) (model.LabelSet, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	labels, ok := s.state[pid]
+	return labels, ok
+}
+
+// PIDs returns the sorted PIDs of all the discovered targets.
+func (s *Store) PIDs() []int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	pids := make([]int, 0, len(s.state))
+	for pid := range s.state {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(log.NewNopLogger(), nil)
+	// There are no targets until the first update.
+	_, found := s.Labels(10)
+	require.False(t, found)
+
+	s.update(map[string][]Group{
+		"all": {
+			&SingleTargetGroup{source: "systemd/a.service", labels: model.LabelSet{"systemd_unit": "a.service"}, Target: 10},
+			// Deleted groups don't have targets.
+			&SingleTargetGroup{source: "docker/b"},
+			&MultiTargetGroup{
+				source:  "pod/ns/pod",
+				labels:  model.LabelSet{"namespace": "ns"},
+				Targets: map[int]model.LabelSet{20: {"container": "c"}, 10: {"container": "d"}},
+			},
+		},
+	})
+
+	require.Equal(t, []int{10, 20}, s.PIDs())
+
+	labels, ok := s.Labels(10)
+	require.True(t, ok)
+	require.Equal(t, model.LabelSet{"systemd_unit": "a.service", "namespace": "ns", "container": "d"}, labels)
+
+	labels, ok = s.Labels(20)
+	require.True(t, ok)
+	require.Equal(t, model.LabelSet{"namespace": "ns", "container": "c"}, labels)
+
+	_, ok = s.Labels(30)
+	require.False(t, ok)
+}
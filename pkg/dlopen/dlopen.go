@@ -0,0 +1,160 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dlopen finds the functions processes load shared libraries with at
+// runtime, dlopen(3) and dlmopen(3), so that uprobes can be attached to them
+// to learn about the libraries as soon as they are loaded.
+package dlopen
+
+import (
+	"debug/elf"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// Symbols are the names of the functions loading shared libraries.
+var Symbols = []string{"dlopen", "dlmopen"}
+
+// Libraries are the prefixes of the names of the libraries defining the
+// functions: the C library since glibc 2.34, libdl before, and the dynamic
+// linker of musl.
+var Libraries = []string{"libc.so", "libc-", "libdl.so", "libdl-", "ld-musl-"}
+
+// Target is a file defining the functions loading shared libraries.
+type Target struct {
+	// Path of the file, through the root filesystem of the process mapping it.
+	Path string
+	// Offsets of the functions in the file, to attach uprobes at.
+	Offsets []uint64
+}
+
+// Finder finds the files defining the functions loading shared libraries in
+// the mappings of processes. Every file is only returned once, as the uprobes
+// attached to a file fire in all the processes mapping it.
+type Finder struct {
+	mtx  *sync.Mutex
+	seen map[fileKey]struct{}
+}
+
+type fileKey struct {
+	dev, ino uint64
+}
+
+func NewFinder() *Finder {
+	return &Finder{
+		mtx:  &sync.Mutex{},
+		seen: map[fileKey]struct{}{},
+	}
+}
+
+// Find returns the files mapped by the given process that define the
+// functions loading shared libraries, and that weren't returned before.
+func (f *Finder) Find(pid int, maps []*procfs.ProcMap) ([]Target, error) {
+	var targets []Target
+	for _, m := range maps {
+		if m.Perms == nil || !m.Perms.Execute || !isLibrary(m.Pathname) {
+			continue
+		}
+
+		key := fileKey{dev: m.Dev, ino: m.Inode}
+		f.mtx.Lock()
+		_, seen := f.seen[key]
+		f.seen[key] = struct{}{}
+		f.mtx.Unlock()
+		if seen {
+			continue
+		}
+
+		p := path.Join("/proc", strconv.Itoa(pid), "root", m.Pathname)
+		offsets, err := symbolOffsets(p, Symbols)
+		if err != nil {
+			// Try again once another process maps it.
+			f.mtx.Lock()
+			delete(f.seen, key)
+			f.mtx.Unlock()
+			return targets, fmt.Errorf("failed to find the symbols of %s: %w", m.Pathname, err)
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		targets = append(targets, Target{Path: p, Offsets: offsets})
+	}
+	return targets, nil
+}
+
+// isLibrary returns true if the mapped file might define the functions
+// loading shared libraries.
+func isLibrary(pathname string) bool {
+	base := path.Base(pathname)
+	for _, prefix := range Libraries {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// symbolOffsets returns the offsets in the file at the given path of the
+// functions with the given names it defines.
+func symbolOffsets(path string, names []string) ([]uint64, error) {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+
+	syms, err := ef.DynamicSymbols()
+	if err != nil {
+		return nil, err
+	}
+
+	// Versioned symbols, such as dlopen@GLIBC_2.2.5 and dlopen@@GLIBC_2.34,
+	// usually share their address.
+	offsets := map[uint64]struct{}{}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF || !contains(names, sym.Name) {
+			continue
+		}
+		for _, p := range ef.Progs {
+			if p.Type != elf.PT_LOAD || p.Flags&elf.PF_X == 0 {
+				continue
+			}
+			if sym.Value >= p.Vaddr && sym.Value < p.Vaddr+p.Memsz {
+				offsets[sym.Value-p.Vaddr+p.Off] = struct{}{}
+				break
+			}
+		}
+	}
+
+	res := make([]uint64, 0, len(offsets))
+	for off := range offsets {
+		res = append(res, off)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlopen
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+const libc = "../elfwriter/testdata/libc.so.6"
+
+func TestSymbolOffsets(t *testing.T) {
+	offsets, err := symbolOffsets(libc, Symbols)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0x88540, 0x88680}, offsets)
+
+	offsets, err = symbolOffsets(libc, []string{"nonexistent"})
+	require.NoError(t, err)
+	require.Empty(t, offsets)
+}
+
+func TestIsLibrary(t *testing.T) {
+	require.True(t, isLibrary("/usr/lib/x86_64-linux-gnu/libc.so.6"))
+	require.True(t, isLibrary("/lib/libc-2.31.so"))
+	require.True(t, isLibrary("/lib/x86_64-linux-gnu/libdl.so.2"))
+	require.True(t, isLibrary("/lib/ld-musl-x86_64.so.1"))
+	require.False(t, isLibrary("/usr/lib/libcrypto.so.3"))
+	require.False(t, isLibrary("/app"))
+	require.False(t, isLibrary(""))
+}
+
+func TestFind(t *testing.T) {
+	abs, err := filepath.Abs(libc)
+	require.NoError(t, err)
+
+	exec := procfs.ProcMapPermissions{Read: true, Execute: true}
+	maps := []*procfs.ProcMap{
+		{Pathname: "/app", Perms: &exec, Dev: 1, Inode: 1},
+		{Pathname: abs, Perms: &procfs.ProcMapPermissions{Read: true}, Dev: 1, Inode: 2},
+		{Pathname: abs, Perms: &exec, Dev: 1, Inode: 2},
+	}
+
+	f := NewFinder()
+	targets, err := f.Find(os.Getpid(), maps)
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	require.Equal(t, filepath.Join("/proc", strconv.Itoa(os.Getpid()), "root", abs), targets[0].Path)
+	require.Equal(t, []uint64{0x88540, 0x88680}, targets[0].Offsets)
+
+	// The uprobes attached to the file fire in all the processes mapping it.
+	targets, err = f.Find(os.Getpid(), maps)
+	require.NoError(t, err)
+	require.Empty(t, targets)
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dotnet talks to running .NET (CoreCLR) processes through their
+// diagnostic server, the same IPC channel used by dotnet-trace and
+// dotnet-counters.
+package dotnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	ipcMagic      = "DOTNET_IPC_V1\x00"
+	ipcHeaderSize = len(ipcMagic) + 2 + 1 + 1 + 2
+
+	commandSetServer  = 0xFF
+	commandSetProcess = 0x04
+
+	commandIDOK    = 0x00
+	commandIDError = 0xFF
+
+	processCommandEnablePerfMap = 0x05
+)
+
+// PerfMapType selects which files the runtime writes for its JIT compiled
+// code.
+type PerfMapType uint32
+
+const (
+	PerfMapTypeDisabled PerfMapType = 0
+	PerfMapTypeAll      PerfMapType = 1
+	PerfMapTypeJitdump  PerfMapType = 2
+	PerfMapTypePerfMap  PerfMapType = 3
+)
+
+var ErrNoDiagnosticSocket = errors.New("diagnostic socket not found")
+
+// FindDiagnosticSocket returns the path of the diagnostic server socket of
+// the given process, which is created in the temporary directory of its
+// mount namespace as dotnet-diagnostic-<pid>-<disambiguation key>-socket.
+// Runtimes started with DOTNET_EnableDiagnostics=0 don't create one.
+func FindDiagnosticSocket(pid, nsPID int) (string, error) {
+	pattern := filepath.Join("/proc", strconv.Itoa(pid), "root", "tmp", fmt.Sprintf("dotnet-diagnostic-%d-*-socket", nsPID))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to list diagnostic sockets: %w", err)
+	}
+	if len(matches) == 0 {
+		return "", ErrNoDiagnosticSocket
+	}
+	// A process that exec'd another runtime could leave a stale socket
+	// behind, the most recent one sorts last.
+	return matches[len(matches)-1], nil
+}
+
+// EnablePerfMap asks the runtime listening on the given diagnostic socket to
+// start writing perf maps, including the code that was compiled before. The
+// command is only available since .NET 8, older runtimes need to be started
+// with DOTNET_PerfMapEnabled=1.
+func EnablePerfMap(ctx context.Context, socketPath string, typ PerfMapType) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the diagnostic server: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("failed to set deadline: %w", err)
+		}
+	}
+
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, uint32(typ))
+	return request(conn, commandSetProcess, processCommandEnablePerfMap, payload)
+}
+
+// request sends an IPC message and checks its response. Messages start with
+// a header made of the magic, the total size, the command set and ID and two
+// reserved bytes, all little endian, followed by the payload. Both success
+// and error responses carry a 32-bit HRESULT.
+func request(conn io.ReadWriter, commandSet, commandID uint8, payload []byte) error {
+	var req bytes.Buffer
+	req.WriteString(ipcMagic)
+	_ = binary.Write(&req, binary.LittleEndian, uint16(ipcHeaderSize+len(payload)))
+	req.WriteByte(commandSet)
+	req.WriteByte(commandID)
+	_ = binary.Write(&req, binary.LittleEndian, uint16(0))
+	req.Write(payload)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+
+	header := make([]byte, ipcHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read response header: %w", err)
+	}
+	if string(header[:len(ipcMagic)]) != ipcMagic {
+		return fmt.Errorf("unexpected response magic %q", header[:len(ipcMagic)])
+	}
+	size := int(binary.LittleEndian.Uint16(header[len(ipcMagic):]))
+	if size < ipcHeaderSize+4 {
+		return fmt.Errorf("unexpected response size %d", size)
+	}
+	body := make([]byte, size-ipcHeaderSize)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	respSet, respID := header[len(ipcMagic)+2], header[len(ipcMagic)+3]
+	hresult := binary.LittleEndian.Uint32(body)
+	if respSet != commandSetServer {
+		return fmt.Errorf("unexpected response command set %#x", respSet)
+	}
+	switch respID {
+	case commandIDOK:
+		if hresult != 0 {
+			return fmt.Errorf("command failed with HRESULT %#x", hresult)
+		}
+		return nil
+	case commandIDError:
+		return fmt.Errorf("command failed with HRESULT %#x", hresult)
+	default:
+		return fmt.Errorf("unexpected response command ID %#x", respID)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dotnet
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRuntime reads a request of the given size and replies with a response
+// made of the given command ID and HRESULT.
+func fakeRuntime(t *testing.T, conn net.Conn, size int, commandID uint8, hresult uint32) <-chan []byte {
+	t.Helper()
+
+	req := make(chan []byte, 1)
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			close(req)
+			return
+		}
+		req <- buf
+		resp := []byte(ipcMagic)
+		resp = append(resp, byte(ipcHeaderSize+4), 0, commandSetServer, commandID, 0, 0)
+		resp = append(resp, byte(hresult), byte(hresult>>8), byte(hresult>>16), byte(hresult>>24))
+		_, _ = conn.Write(resp)
+	}()
+	return req
+}
+
+func TestRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	req := fakeRuntime(t, server, ipcHeaderSize+4, commandIDOK, 0)
+
+	err := request(client, commandSetProcess, processCommandEnablePerfMap, []byte{3, 0, 0, 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("DOTNET_IPC_V1\x00\x18\x00\x04\x05\x00\x00\x03\x00\x00\x00"), <-req)
+}
+
+func TestRequestError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Unknown command.
+	fakeRuntime(t, server, ipcHeaderSize+4, commandIDError, 0x80131384)
+
+	err := request(client, commandSetProcess, processCommandEnablePerfMap, []byte{3, 0, 0, 0})
+	require.ErrorContains(t, err, "0x80131384")
+}
+
+func TestEnablePerfMap(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dotnet-diagnostic-1-1-socket")
+	l, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer l.Close()
+
+	var req <-chan []byte
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		req = fakeRuntime(t, conn, ipcHeaderSize+4, commandIDOK, 0)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, EnablePerfMap(ctx, socketPath, PerfMapTypePerfMap))
+
+	<-accepted
+	require.Equal(t, byte(PerfMapTypePerfMap), (<-req)[ipcHeaderSize])
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dotnet
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+const (
+	lvSuccess = "success"
+	lvError   = "error"
+
+	enableTimeout = 5 * time.Second
+)
+
+// PerfMapper enables the perf map writer of the .NET processes running on
+// the host, so CoreCLR JIT frames are symbolized like any other perf map.
+// Once enabled the runtime keeps the map up to date, so every process is
+// only asked once.
+type PerfMapper struct {
+	logger  log.Logger
+	enables *prometheus.CounterVec
+
+	findNSPIDs func(pid int) ([]int, error)
+	procs      func() (procfs.Procs, error)
+
+	interval time.Duration
+
+	// PIDs that have the perf map enabled or where enabling it failed.
+	done map[int]struct{}
+}
+
+func NewPerfMapper(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	findNSPIDs func(pid int) ([]int, error),
+	fs procfs.FS,
+	interval time.Duration,
+) *PerfMapper {
+	enables := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "parca_agent_dotnet_perf_map_enables_total",
+		Help: "Total number of attempts to enable the perf map of a .NET process.",
+	}, []string{"result"})
+	enables.WithLabelValues(lvSuccess)
+	enables.WithLabelValues(lvError)
+
+	return &PerfMapper{
+		logger:  logger,
+		enables: enables,
+
+		findNSPIDs: findNSPIDs,
+		procs:      fs.AllProcs,
+
+		interval: interval,
+
+		done: map[int]struct{}{},
+	}
+}
+
+func (m *PerfMapper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *PerfMapper) refresh(ctx context.Context) {
+	procs, err := m.procs()
+	if err != nil {
+		level.Warn(m.logger).Log("msg", "failed to list processes", "err", err)
+		return
+	}
+
+	self := os.Getpid()
+	alive := make(map[int]struct{}, len(procs))
+	for _, proc := range procs {
+		pid := proc.PID
+		alive[pid] = struct{}{}
+		if pid == self {
+			continue
+		}
+		if _, ok := m.done[pid]; ok {
+			continue
+		}
+
+		nsPIDs, err := m.findNSPIDs(pid)
+		if err != nil {
+			continue
+		}
+		socketPath, err := FindDiagnosticSocket(pid, nsPIDs[len(nsPIDs)-1])
+		if err != nil {
+			// Not a .NET process, or one with diagnostics disabled.
+			continue
+		}
+		m.done[pid] = struct{}{}
+
+		ctx, cancel := context.WithTimeout(ctx, enableTimeout)
+		err = EnablePerfMap(ctx, socketPath, PerfMapTypePerfMap)
+		cancel()
+		if err != nil {
+			m.enables.WithLabelValues(lvError).Inc()
+			level.Debug(m.logger).Log("msg", "failed to enable the .NET perf map, runtimes older than .NET 8 need DOTNET_PerfMapEnabled=1", "pid", pid, "err", err)
+			continue
+		}
+		m.enables.WithLabelValues(lvSuccess).Inc()
+	}
+
+	for pid := range m.done {
+		if _, ok := alive[pid]; !ok {
+			delete(m.done, pid)
+		}
+	}
+}
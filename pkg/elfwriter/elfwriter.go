@@ -30,8 +30,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-
-	"golang.org/x/sys/unix"
+	"strings"
 )
 
 const sectionHeaderStrTable = ".shstrtab"
@@ -788,11 +787,13 @@ func (w *Writer) writeStringTable(strs []string) {
 		if s == "" {
 			continue
 		}
-		data, err := unix.ByteSliceFromString(s)
-		if err != nil && w.err == nil {
-			w.err = err
+		if strings.IndexByte(s, 0) != -1 {
+			if w.err == nil {
+				w.err = fmt.Errorf("string table entry %q contains a NUL byte", s)
+			}
 			break
 		}
+		data := append([]byte(s), 0)
 		w.shStrIdx[s] = i
 		w.write(data)
 		i += len(data)
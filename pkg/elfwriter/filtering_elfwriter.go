@@ -30,6 +30,9 @@ type FilteringWriter struct {
 	progPredicates          []func(*elf.Prog) bool
 	sectionPredicates       []func(*elf.Section) bool
 	sectionHeaderPredicates []func(*elf.Section) bool
+
+	// Sections of other files to write in addition to the filtered ones.
+	additionalSections []*elf.Section
 }
 
 // NewFromSource creates a new Writer using given source.
@@ -68,6 +71,12 @@ func (w *FilteringWriter) FilterHeaderOnlySections(predicates ...func(*elf.Secti
 	w.sectionHeaderPredicates = append(w.sectionHeaderPredicates, predicates...)
 }
 
+// AddSections adds sections of other ELF files, which must not link to other
+// sections, to the ones filtered from the source.
+func (w *FilteringWriter) AddSections(secs ...*elf.Section) {
+	w.additionalSections = append(w.additionalSections, secs...)
+}
+
 func (w *FilteringWriter) Flush() error {
 	if len(w.progPredicates) > 0 {
 		newProgs := []*elf.Prog{}
@@ -129,6 +138,23 @@ func (w *FilteringWriter) Flush() error {
 		w.sectionHeaders = newSectionHeaders
 	}
 
+	if len(w.additionalSections) > 0 {
+		additional := make(map[*elf.Section]struct{}, len(w.additionalSections))
+		for _, sec := range w.additionalSections {
+			additional[sec] = struct{}{}
+			newSections = append(newSections, sec)
+		}
+		// They can't be read from the raw source.
+		withRawSource := w.sectionWriter
+		withoutRawSource := writeSectionWithoutRawSource(w.fhdr)
+		w.sectionWriter = sectionWriterFn(func(writer io.Writer, sec *elf.Section) error {
+			if _, ok := additional[sec]; ok {
+				return withoutRawSource(writer, sec)
+			}
+			return withRawSource.writeSection(writer, sec)
+		})
+	}
+
 	w.sections = newSections
 
 	return w.Writer.Flush()
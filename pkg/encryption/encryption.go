@@ -0,0 +1,137 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption encrypts the data the agent writes to disk, such as the
+// spooled profiles and the extracted debuginfo files, with AES-GCM.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Time to wait for the command unwrapping the key.
+const unwrapTimeout = 30 * time.Second
+
+var ErrDecrypt = errors.New("failed to decrypt data")
+
+// Cipher encrypts and authenticates data with AES-GCM.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a cipher using the given key, which must be 16, 24 or 32
+// bytes long to use AES-128, AES-192 or AES-256.
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Overhead is the number of bytes Seal adds to the plaintext.
+func (c *Cipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// Seal encrypts the plaintext under a random nonce, which is prepended to
+// the returned ciphertext.
+func (c *Cipher) Seal(plaintext []byte) ([]byte, error) {
+	return c.seal(plaintext, nil)
+}
+
+// Open decrypts a ciphertext returned by Seal.
+func (c *Cipher) Open(ciphertext []byte) ([]byte, error) {
+	return c.open(ciphertext, nil)
+}
+
+func (c *Cipher) seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.Overhead()+len(plaintext))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (c *Cipher) open(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < c.Overhead() {
+		return nil, fmt.Errorf("ciphertext of %d bytes is too short: %w", len(ciphertext), ErrDecrypt)
+	}
+	nonce, ciphertext := ciphertext[:c.aead.NonceSize()], ciphertext[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	return plaintext, nil
+}
+
+// LoadKey reads the key in the given file, either as raw bytes or base64
+// encoded, such as the output of `openssl rand -base64 32`.
+//
+// When unwrapCommand is set, the file holds a data key encrypted by a key
+// management service instead, following the envelope encryption scheme of AWS
+// KMS, Google Cloud KMS or Vault's transit engine. The command is run by the
+// shell with the contents of the file on its standard input, and must print
+// the plaintext data key, in either encoding, on its standard output.
+func LoadKey(path, unwrapCommand string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	if unwrapCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), unwrapTimeout)
+		defer cancel()
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", unwrapCommand)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = &stderr
+		data, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap key: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	}
+	return decodeKey(data)
+}
+
+func decodeKey(data []byte) ([]byte, error) {
+	if validKeySize(len(data)) {
+		return data, nil
+	}
+	trimmed := bytes.TrimSpace(data)
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(trimmed)))
+	n, err := base64.StdEncoding.Decode(key, trimmed)
+	if err == nil && validKeySize(n) {
+		return key[:n], nil
+	}
+	return nil, fmt.Errorf("key must be 16, 24 or 32 bytes long, raw or base64 encoded, got %d bytes", len(data))
+}
+
+func validKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testCipher(t *testing.T) *Cipher {
+	t.Helper()
+
+	c, err := NewCipher(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	return c
+}
+
+func TestSealOpen(t *testing.T) {
+	c := testCipher(t)
+
+	sealed, err := c.Seal([]byte("profile"))
+	require.NoError(t, err)
+	require.Len(t, sealed, len("profile")+c.Overhead())
+	require.NotContains(t, string(sealed), "profile")
+
+	plaintext, err := c.Open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "profile", string(plaintext))
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = c.Open(sealed)
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	_, err = c.Open(sealed[:4])
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	other, err := NewCipher(bytes.Repeat([]byte{2}, 16))
+	require.NoError(t, err)
+	sealed, err = c.Seal([]byte("profile"))
+	require.NoError(t, err)
+	_, err = other.Open(sealed)
+	require.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0xab}, 32)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+		return path
+	}
+
+	loaded, err := LoadKey(write("raw", key), "")
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+
+	loaded, err = LoadKey(write("base64", []byte(base64.StdEncoding.EncodeToString(key)+"\n")), "")
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+
+	_, err = LoadKey(write("short", []byte("short")), "")
+	require.ErrorContains(t, err, "key must be 16, 24 or 32 bytes long")
+
+	// The wrapped key is passed on the standard input of the command.
+	loaded, err = LoadKey(write("wrapped", []byte(base64.StdEncoding.EncodeToString(key))), "base64 -d")
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+
+	_, err = LoadKey(write("failing", key), "echo denied >&2; exit 1")
+	require.ErrorContains(t, err, "denied")
+
+	_, err = LoadKey(filepath.Join(dir, "missing"), "")
+	require.ErrorContains(t, err, "failed to read key file")
+}
+
+func TestFile(t *testing.T) {
+	c := testCipher(t)
+	f, err := c.CreateTemp(t.TempDir(), "file")
+	require.NoError(t, err)
+
+	// Sizes straddling chunk boundaries.
+	data := make([]byte, 3*chunkSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	n, err := f.Write(data[:chunkSize+10])
+	require.NoError(t, err)
+	require.Equal(t, chunkSize+10, n)
+	_, err = f.Write(data[chunkSize+10:])
+	require.NoError(t, err)
+
+	// Overwrite a range spanning two chunks, as the ELF writer does with
+	// its headers.
+	patch := bytes.Repeat([]byte{0xff}, 200)
+	copy(data[chunkSize-100:], patch)
+	_, err = f.Seek(chunkSize-100, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write(patch)
+	require.NoError(t, err)
+
+	// Writing past the end fills the hole with zeros.
+	data = append(data, make([]byte, chunkSize)...)
+	data = append(data, 'x')
+	_, err = f.WriteAt([]byte{'x'}, int64(len(data)-1))
+	require.NoError(t, err)
+
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size())
+
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	read, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	buf := make([]byte, 300)
+	n, err = f.ReadAt(buf, 2*chunkSize-150)
+	require.NoError(t, err)
+	require.Equal(t, 300, n)
+	require.Equal(t, data[2*chunkSize-150:2*chunkSize+150], buf)
+
+	n, err = f.ReadAt(buf, int64(len(data)-10))
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 10, n)
+
+	// Nothing is written in plaintext.
+	name := f.Name()
+	require.NoError(t, f.Close())
+	onDisk, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(onDisk, data[:64]))
+	require.False(t, bytes.Contains(onDisk, patch[:64]))
+
+	// Tampered chunks are detected.
+	f, err = c.CreateTemp(t.TempDir(), "file")
+	require.NoError(t, err)
+	_, err = f.Write(data[:chunkSize+1])
+	require.NoError(t, err)
+	require.NoError(t, f.flush())
+	_, err = f.f.WriteAt([]byte{0}, 100)
+	require.NoError(t, err)
+	_, err = f.ReadAt(buf, 0)
+	require.ErrorIs(t, err, ErrDecrypt)
+	require.NoError(t, f.Close())
+}
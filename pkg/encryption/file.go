@@ -0,0 +1,263 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Size of the plaintext of every chunk of a file but the last one.
+const chunkSize = 64 * 1024
+
+// File is an encrypted file that can be read and written at any offset, as
+// the ELF writer and reader do, in plaintext.
+//
+// The plaintext is split in chunks that are sealed separately, each under a
+// random nonce and with its index as additional data so that chunks can't be
+// swapped. A chunk is kept in memory while it is accessed, and is only
+// written back once another one is accessed or the file is closed.
+type File struct {
+	c *Cipher
+	f *os.File
+
+	mtx sync.Mutex
+	// Size of the plaintext.
+	size int64
+	// Offset of Read, Write and Seek.
+	off int64
+	// Index and plaintext of the chunk in memory, index is -1 when none is.
+	index int64
+	buf   []byte
+	dirty bool
+}
+
+// CreateTemp creates a new empty encrypted temporary file, see os.CreateTemp.
+func (c *Cipher) CreateTemp(dir, pattern string) (*File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		c:     c,
+		f:     f,
+		index: -1,
+		buf:   make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Name returns the name of the underlying file.
+func (f *File) Name() string {
+	return f.f.Name()
+}
+
+// Stat returns the info of the underlying file, with the size of the
+// plaintext.
+func (f *File) Stat() (fs.FileInfo, error) {
+	info, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return fileInfo{FileInfo: info, size: f.size}, nil
+}
+
+type fileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i fileInfo) Size() int64 { return i.size }
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	n, err := f.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Close writes back the chunk in memory and closes the underlying file.
+func (f *File) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return errors.Join(f.flush(), f.f.Close())
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) && off < f.size {
+		if err := f.load(off / chunkSize); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], f.buf[off%chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	// Chunks are never left unwritten, holes are filled with zeros.
+	for f.size < off {
+		gap := off - f.size
+		if gap > chunkSize {
+			gap = chunkSize
+		}
+		if _, err := f.writeAt(make([]byte, gap), f.size); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for n < len(p) {
+		if err := f.load(off / chunkSize); err != nil {
+			return n, err
+		}
+		start := int(off % chunkSize)
+		end := start + len(p) - n
+		if end > chunkSize {
+			end = chunkSize
+		}
+		if end > len(f.buf) {
+			f.buf = f.buf[:end]
+		}
+		c := copy(f.buf[start:end], p[n:])
+		f.dirty = true
+		n += c
+		off += int64(c)
+		if off > f.size {
+			f.size = off
+		}
+	}
+	return n, nil
+}
+
+// stride is the size of every chunk on disk but the last one.
+func (f *File) stride() int64 {
+	return int64(chunkSize + f.c.Overhead())
+}
+
+// load makes the chunk of the given index the one in memory.
+func (f *File) load(index int64) error {
+	if index == f.index {
+		return nil
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	f.index = -1
+	f.buf = f.buf[:0]
+	n := f.size - index*chunkSize
+	if n > chunkSize {
+		n = chunkSize
+	}
+	if n > 0 {
+		ciphertext := make([]byte, n+int64(f.c.Overhead()))
+		if _, err := f.f.ReadAt(ciphertext, index*f.stride()); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %w", index, err)
+		}
+		plaintext, err := f.c.open(ciphertext, chunkAdditionalData(index))
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", index, err)
+		}
+		f.buf = append(f.buf, plaintext...)
+	}
+	f.index = index
+	return nil
+}
+
+// flush writes the chunk in memory back to disk if it was modified.
+func (f *File) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	ciphertext, err := f.c.seal(f.buf, chunkAdditionalData(f.index))
+	if err != nil {
+		return err
+	}
+	if _, err := f.f.WriteAt(ciphertext, f.index*f.stride()); err != nil {
+		return fmt.Errorf("failed to write chunk %d: %w", f.index, err)
+	}
+	f.dirty = false
+	return nil
+}
+
+func chunkAdditionalData(index int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(index))
+}
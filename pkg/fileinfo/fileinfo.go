@@ -0,0 +1,48 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fileinfo reads the platform specific details of an fs.FileInfo,
+// so that the packages using them build on every platform.
+package fileinfo
+
+import (
+	"io/fs"
+	"time"
+)
+
+// ID identifies a file regardless of the path it is reached through.
+type ID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// IDOf returns the ID of the file, false if the platform doesn't provide one.
+func IDOf(fi fs.FileInfo) (ID, bool) {
+	return idOf(fi)
+}
+
+// ChangeTime returns when the file status last changed, which, unlike its
+// modification time, can't be set by the user. It falls back to the
+// modification time on platforms that don't provide it.
+func ChangeTime(fi fs.FileInfo) time.Time {
+	if t, ok := changeTime(fi); ok {
+		return t
+	}
+	return fi.ModTime()
+}
+
+// Owner returns the user and group owning the file, false if the platform
+// doesn't provide them.
+func Owner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return owner(fi)
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileinfo
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDOf(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("file IDs are not supported on", runtime.GOOS)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	require.NoError(t, os.Symlink(path, filepath.Join(dir, "link")))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	id, ok := IDOf(fi)
+	require.True(t, ok)
+
+	// The same file reached through another path.
+	fi, err = os.Stat(filepath.Join(dir, "link"))
+	require.NoError(t, err)
+	linked, ok := IDOf(fi)
+	require.True(t, ok)
+	require.Equal(t, id, linked)
+
+	other := filepath.Join(dir, "other")
+	require.NoError(t, os.WriteFile(other, nil, 0o600))
+	fi, err = os.Stat(other)
+	require.NoError(t, err)
+	otherID, ok := IDOf(fi)
+	require.True(t, ok)
+	require.NotEqual(t, id, otherID)
+	require.False(t, ChangeTime(fi).IsZero())
+}
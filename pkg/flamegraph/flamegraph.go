@@ -0,0 +1,231 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flamegraph renders pprof profiles as flame graphs, either in the
+// folded format understood by most flame graph tools or with ANSI colors for
+// terminals.
+package flamegraph
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// RootName is the name of the root frame, which spans all the samples.
+const RootName = "all"
+
+// Node is a frame of the flame graph. Its value is the sum of the values of
+// the samples it is on the stack of.
+type Node struct {
+	Name     string
+	Value    int64
+	Children []*Node
+
+	children map[string]*Node
+}
+
+func newNode(name string) *Node {
+	return &Node{Name: name, children: map[string]*Node{}}
+}
+
+func (n *Node) child(name string) *Node {
+	c, ok := n.children[name]
+	if !ok {
+		c = newNode(name)
+		n.children[name] = c
+		n.Children = append(n.Children, c)
+	}
+	return c
+}
+
+// FromProfile builds the flame graph of the given sample type of the profile,
+// the last one if sampleIndex is negative.
+func FromProfile(p *profile.Profile, sampleIndex int) (*Node, error) {
+	if sampleIndex < 0 {
+		sampleIndex = len(p.SampleType) - 1
+	}
+	if sampleIndex < 0 || sampleIndex >= len(p.SampleType) {
+		return nil, fmt.Errorf("sample index %d out of range, the profile has %d sample types", sampleIndex, len(p.SampleType))
+	}
+
+	root := newNode(RootName)
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		if v == 0 {
+			continue
+		}
+		root.Value += v
+
+		n := root
+		// Locations go from the leaf to the root, and the lines of a
+		// location from the innermost inlined function to its caller.
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			names := frameNames(s.Location[i])
+			for j := len(names) - 1; j >= 0; j-- {
+				n = n.child(names[j])
+				n.Value += v
+			}
+		}
+	}
+
+	root.sort()
+	return root, nil
+}
+
+func frameNames(loc *profile.Location) []string {
+	names := make([]string, 0, len(loc.Line))
+	for _, l := range loc.Line {
+		if l.Function != nil && l.Function.Name != "" {
+			names = append(names, l.Function.Name)
+		}
+	}
+	if len(names) > 0 {
+		return names
+	}
+
+	// Frames that couldn't be symbolized are shown by their address and the
+	// file they were mapped from.
+	if m := loc.Mapping; m != nil && m.File != "" {
+		return []string{fmt.Sprintf("0x%x (%s)", loc.Address, filepath.Base(m.File))}
+	}
+	return []string{fmt.Sprintf("0x%x", loc.Address)}
+}
+
+// sort orders the children by name, as flame graphs conventionally do, so
+// the output is stable.
+func (n *Node) sort() {
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
+
+// WriteFolded writes the stacks in the folded format, one line per distinct
+// stack with its frames separated by semicolons followed by its value.
+func (n *Node) WriteFolded(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range n.Children {
+		writeFolded(bw, c, nil)
+	}
+	return bw.Flush()
+}
+
+func writeFolded(w *bufio.Writer, n *Node, stack []string) {
+	stack = append(stack, n.Name)
+
+	self := n.Value
+	for _, c := range n.Children {
+		self -= c.Value
+	}
+	if self > 0 {
+		fmt.Fprintf(w, "%s %d\n", strings.Join(stack, ";"), self)
+	}
+	for _, c := range n.Children {
+		writeFolded(w, c, stack)
+	}
+}
+
+// ANSIOptions configure the rendering of a flame graph in a terminal.
+type ANSIOptions struct {
+	// Width is the number of columns the root frame spans.
+	Width int
+	// Color enables the ANSI escape sequences, frames are separated by
+	// vertical bars otherwise.
+	Color bool
+}
+
+// Colors of the frames, from the 256 color palette, in the warm tones flame
+// graphs usually use.
+var palette = []int{166, 172, 178, 202, 208, 214, 220, 196}
+
+// WriteANSI renders the flame graph with the root at the top, one line per
+// stack depth. Frames narrower than a column are left out.
+func (n *Node) WriteANSI(w io.Writer, opts ANSIOptions) error {
+	if opts.Width <= 0 {
+		return fmt.Errorf("invalid width %d", opts.Width)
+	}
+
+	bw := bufio.NewWriter(w)
+	if n.Value == 0 {
+		fmt.Fprintln(bw, "no samples")
+		return bw.Flush()
+	}
+
+	type cell struct {
+		node  *Node
+		x     int
+		width int
+	}
+	level := []cell{{node: n, width: opts.Width}}
+	for len(level) > 0 {
+		var (
+			line strings.Builder
+			next []cell
+			col  int
+		)
+		for _, c := range level {
+			line.WriteString(strings.Repeat(" ", c.x-col))
+			line.WriteString(frame(c.node, c.width, opts.Color))
+			col = c.x + c.width
+
+			// Children are laid out from the left edge of their parent,
+			// their positions are computed from the cumulated values so
+			// rounding errors don't add up.
+			var cum int64
+			for _, child := range c.node.Children {
+				start := c.x + int(cum*int64(c.width)/c.node.Value)
+				cum += child.Value
+				end := c.x + int(cum*int64(c.width)/c.node.Value)
+				if end-start < 1 {
+					continue
+				}
+				next = append(next, cell{node: child, x: start, width: end - start})
+			}
+		}
+		fmt.Fprintln(bw, line.String())
+		level = next
+	}
+	return bw.Flush()
+}
+
+// frame renders a frame of the given width, truncating its name to fit.
+func frame(n *Node, width int, color bool) string {
+	label := n.Name
+	if !color && width > 1 {
+		// Separate adjacent frames when they can't be told apart by color.
+		label = "|" + label
+	}
+	runes := []rune(label)
+	if len(runes) > width {
+		if width > 1 {
+			runes = append(runes[:width-1], '…')
+		} else {
+			runes = runes[:width]
+		}
+	}
+	text := string(runes) + strings.Repeat(" ", width-len(runes))
+	if !color {
+		return text
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(n.Name))
+	return fmt.Sprintf("\x1b[30;48;5;%dm%s\x1b[0m", palette[h.Sum32()%uint32(len(palette))], text)
+}
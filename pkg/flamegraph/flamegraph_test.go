@@ -0,0 +1,89 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flamegraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func testProfile() *profile.Profile {
+	var (
+		mainFn  = &profile.Function{ID: 1, Name: "main"}
+		workFn  = &profile.Function{ID: 2, Name: "work"}
+		hashFn  = &profile.Function{ID: 3, Name: "hash"}
+		sleepFn = &profile.Function{ID: 4, Name: "sleep"}
+
+		mapping = &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "/usr/bin/app"}
+
+		mainLoc = &profile.Location{ID: 1, Line: []profile.Line{{Function: mainFn}}}
+		// hash is inlined into work.
+		workLoc  = &profile.Location{ID: 2, Line: []profile.Line{{Function: hashFn}, {Function: workFn}}}
+		sleepLoc = &profile.Location{ID: 3, Line: []profile.Line{{Function: sleepFn}}}
+		unknown  = &profile.Location{ID: 4, Address: 0x1234, Mapping: mapping}
+	)
+
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{6}},
+			{Location: []*profile.Location{sleepLoc, mainLoc}, Value: []int64{2}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{1}},
+			{Location: []*profile.Location{unknown}, Value: []int64{1}},
+			{Location: []*profile.Location{sleepLoc}, Value: []int64{0}},
+		},
+	}
+}
+
+func TestFromProfile(t *testing.T) {
+	root, err := FromProfile(testProfile(), -1)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), root.Value)
+
+	var b bytes.Buffer
+	require.NoError(t, root.WriteFolded(&b))
+	require.Equal(t, `0x1234 (app) 1
+main 1
+main;sleep 2
+main;work;hash 6
+`, b.String())
+
+	_, err = FromProfile(testProfile(), 1)
+	require.Error(t, err)
+}
+
+func TestWriteANSI(t *testing.T) {
+	root, err := FromProfile(testProfile(), -1)
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, root.WriteANSI(&b, ANSIOptions{Width: 20}))
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	require.Equal(t, []string{
+		"|all                ",
+		"|…|main             ",
+		"  |sl…|work       ",
+		"      |hash       ",
+	}, lines)
+
+	b.Reset()
+	require.NoError(t, root.WriteANSI(&b, ANSIOptions{Width: 20, Color: true}))
+	require.Contains(t, b.String(), "\x1b[0m")
+	require.Len(t, strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n"), 4)
+}
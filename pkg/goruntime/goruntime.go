@@ -0,0 +1,284 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package goruntime finds the layout of the runtime of Go processes, so the
+// goroutine running on a sampled thread can be read from BPF.
+package goruntime
+
+import (
+	"debug/buildinfo"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
+)
+
+// Offsets are the offsets needed to find the goroutine of a thread. Must be
+// in sync with go_runtime_info_t in the BPF program.
+type Offsets struct {
+	// Of the current g in the thread local storage, relative to the thread
+	// pointer.
+	TLSOffset int64
+	// Of goid, atomicstatus, waitreason and m in runtime.g.
+	GoID       uint32
+	Status     uint32
+	WaitReason uint32
+	M          uint32
+	// Of curg in runtime.m.
+	MCurG uint32
+	_     uint32
+}
+
+// The layout of runtime.g and runtime.m up to the fields used didn't change
+// between the supported versions, on amd64.
+var goOffsets = Offsets{
+	GoID:       152,
+	Status:     144,
+	WaitReason: 176,
+	M:          48,
+	MCurG:      200,
+}
+
+const (
+	minSupportedMinor = 17
+	maxSupportedMinor = 22
+
+	// Go places g right before the thread pointer when it links the binary
+	// itself.
+	defaultTLSOffset = -8
+
+	// Set in atomicstatus while the stack of the goroutine is scanned.
+	statusScanBit = 0x1000
+)
+
+// Names of the goroutine statuses, from runtime/runtime2.go.
+var statuses = map[uint32]string{
+	0: "idle",
+	1: "runnable",
+	2: "running",
+	3: "syscall",
+	4: "waiting",
+	6: "dead",
+	8: "copystack",
+	9: "preempted",
+}
+
+// Reasons of runtime.gopark, from runtime/runtime2.go. The first ones are
+// the same in all the supported versions, later ones were inserted between
+// existing ones and differ.
+var (
+	commonWaitReasons = []string{
+		"",
+		"GC assist marking",
+		"IO wait",
+		"chan receive (nil chan)",
+		"chan send (nil chan)",
+		"dumping heap",
+		"garbage collection",
+		"garbage collection scan",
+		"panicwait",
+		"select",
+		"select (no cases)",
+		"GC assist wait",
+		"GC sweep wait",
+		"GC scavenge wait",
+		"chan receive",
+		"chan send",
+		"finalizer wait",
+		"force gc (idle)",
+		"semacquire",
+		"sleep",
+		"sync.Cond.Wait",
+	}
+	waitReasons = map[int][]string{
+		17: append(commonWaitReasons[:len(commonWaitReasons):len(commonWaitReasons)],
+			"timer goroutine (idle)",
+			"trace reader (blocked)",
+			"wait for GC cycle",
+			"GC worker (idle)",
+			"preempted",
+			"debug call",
+		),
+		20: append(commonWaitReasons[:len(commonWaitReasons):len(commonWaitReasons)],
+			"timer goroutine (idle)",
+			"trace reader (blocked)",
+			"wait for GC cycle",
+			"GC worker (idle)",
+			"GC worker (active)",
+			"preempted",
+			"debug call",
+			"GC mark termination",
+			"stopping the world",
+		),
+	}
+)
+
+var goVersionRegexp = regexp.MustCompile(`^go1\.([0-9]+)`)
+
+// Info describes the Go runtime of a process.
+type Info struct {
+	Version string
+	Offsets Offsets
+
+	waitReasons []string
+}
+
+// Labels returns the pprof labels of a sample taken while the given goroutine
+// was running on the thread.
+func (i *Info) Labels(goid uint64, status, waitReason uint32) map[string]string {
+	labels := map[string]string{
+		"goroutine_id": strconv.FormatUint(goid, 10),
+	}
+	status &^= statusScanBit
+	if s, ok := statuses[status]; ok {
+		labels["goroutine_state"] = s
+	}
+	if status == 4 && waitReason != 0 {
+		if int(waitReason) < len(i.waitReasons) {
+			labels["goroutine_wait_reason"] = i.waitReasons[waitReason]
+		} else {
+			labels["goroutine_wait_reason"] = "unknown"
+		}
+	}
+	return labels
+}
+
+// Finder finds the Go runtime of processes. Results for the same binary are
+// cached, as many processes usually share it.
+type Finder struct {
+	mtx   *sync.Mutex
+	cache map[fileKey]*Info
+}
+
+type fileKey struct {
+	dev, ino uint64
+	mtime    int64
+}
+
+func NewFinder() *Finder {
+	return &Finder{
+		mtx:   &sync.Mutex{},
+		cache: map[fileKey]*Info{},
+	}
+}
+
+// Find returns the Go runtime of the given process, or nil if it isn't a Go
+// program built with a supported version.
+func (f *Finder) Find(pid int) (*Info, error) {
+	path := filepath.Join("/proc", strconv.Itoa(pid), "exe")
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var key fileKey
+	if id, ok := fileinfo.IDOf(stat); ok {
+		key = fileKey{dev: id.Dev, ino: id.Ino, mtime: stat.ModTime().UnixNano()}
+	}
+
+	f.mtx.Lock()
+	info, ok := f.cache[key]
+	f.mtx.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err = find(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mtx.Lock()
+	f.cache[key] = info
+	f.mtx.Unlock()
+	return info, nil
+}
+
+func find(path string) (*Info, error) {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+
+	if ef.Section(".go.buildinfo") == nil || ef.Machine != elf.EM_X86_64 {
+		return nil, nil //nolint:nilnil
+	}
+
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build info: %w", err)
+	}
+	match := goVersionRegexp.FindStringSubmatch(bi.GoVersion)
+	if match == nil {
+		return nil, nil //nolint:nilnil
+	}
+	minor, err := strconv.Atoi(match[1])
+	if err != nil || minor < minSupportedMinor || minor > maxSupportedMinor {
+		return nil, nil //nolint:nilnil
+	}
+
+	offsets := goOffsets
+	offsets.TLSOffset = tlsOffset(ef)
+
+	reasons := waitReasons[17]
+	switch {
+	case minor == 20:
+		reasons = waitReasons[20]
+	case minor > 20:
+		reasons = commonWaitReasons
+	}
+
+	return &Info{
+		Version:     bi.GoVersion,
+		Offsets:     offsets,
+		waitReasons: reasons,
+	}, nil
+}
+
+// tlsOffset returns the offset of runtime.tlsg from the thread pointer. The
+// TLS block ends at the thread pointer on amd64. When the binary was linked
+// externally its position is decided by the C linker.
+func tlsOffset(ef *elf.File) int64 {
+	var tls *elf.Prog
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_TLS {
+			tls = p
+			break
+		}
+	}
+	if tls == nil {
+		return defaultTLSOffset
+	}
+
+	syms, err := ef.Symbols()
+	if err != nil {
+		return defaultTLSOffset
+	}
+	for _, sym := range syms {
+		if sym.Name != "runtime.tlsg" {
+			continue
+		}
+		align := tls.Align
+		if align == 0 {
+			align = 1
+		}
+		size := (tls.Memsz + align - 1) &^ (align - 1)
+		return int64(sym.Value) - int64(size)
+	}
+	return defaultTLSOffset
+}
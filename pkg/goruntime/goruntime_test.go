@@ -0,0 +1,58 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goruntime
+
+import (
+	"debug/elf"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	info := &Info{waitReasons: waitReasons[20]}
+
+	require.Equal(t, map[string]string{
+		"goroutine_id":    "42",
+		"goroutine_state": "running",
+	}, info.Labels(42, 2, 0))
+
+	// Waiting on a channel, while its stack is being scanned.
+	require.Equal(t, map[string]string{
+		"goroutine_id":          "7",
+		"goroutine_state":       "waiting",
+		"goroutine_wait_reason": "chan receive",
+	}, info.Labels(7, statusScanBit|4, 14))
+
+	require.Equal(t, "unknown", info.Labels(7, 4, 200)["goroutine_wait_reason"])
+}
+
+func TestWaitReasons(t *testing.T) {
+	require.Equal(t, "debug call", waitReasons[17][26])
+	require.Equal(t, "debug call", waitReasons[20][27])
+	// Extending the version specific tables must not modify the common one.
+	require.Len(t, commonWaitReasons, 21)
+}
+
+func TestTLSOffset(t *testing.T) {
+	path, err := os.Executable()
+	require.NoError(t, err)
+	ef, err := elf.Open(path)
+	require.NoError(t, err)
+	defer ef.Close()
+
+	// The test binary is linked internally.
+	require.Equal(t, int64(defaultTLSOffset), tlsOffset(ef))
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	commonconfig "github.com/prometheus/common/config"
+	"google.golang.org/grpc/credentials"
+)
+
+// watchedFile caches the content of a file, which is read again whenever its
+// modification time or size changes, so that rotated credentials, e.g. the
+// ones written by cert-manager, spiffe-helper or projected service account
+// tokens, are picked up without restarting.
+type watchedFile struct {
+	path  string
+	parse func([]byte) (any, error)
+
+	mtx     sync.Mutex
+	modTime time.Time
+	size    int64
+	value   any
+}
+
+func newWatchedFile(path string, parse func([]byte) (any, error)) (*watchedFile, error) {
+	f := &watchedFile{path: path, parse: parse}
+	if _, err := f.get(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// get returns the parsed content of the file. If the file can't be read or
+// parsed anymore, e.g. while it is being replaced, the last valid content is
+// returned.
+func (f *watchedFile) get() (any, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		if f.value != nil {
+			return f.value, nil
+		}
+		return nil, err
+	}
+	if f.value != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.value, nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err == nil {
+		var v any
+		if v, err = f.parse(b); err == nil {
+			f.value, f.modTime, f.size = v, fi.ModTime(), fi.Size()
+			return v, nil
+		}
+	}
+	if f.value != nil {
+		return f.value, nil
+	}
+	return nil, fmt.Errorf("failed to load %s: %w", f.path, err)
+}
+
+// NewTLSCredentials returns the transport credentials of the given TLS
+// config. Unlike with commonconfig.NewTLSConfig alone, the CA file is read
+// again when it changes, like the client certificate and key are, so both
+// sides of a mutual TLS connection can be rotated.
+func NewTLSCredentials(cfg *commonconfig.TLSConfig) (credentials.TransportCredentials, error) {
+	tlsConfig, err := commonconfig.NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CAFile == "" || cfg.InsecureSkipVerify {
+		return credentials.NewTLS(tlsConfig), nil
+	}
+
+	ca, err := newWatchedFile(cfg.CAFile, func(b []byte) (any, error) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate found")
+		}
+		return pool, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The server certificate is verified against the current CA by
+	// VerifyConnection, the default verification would use the RootCAs the
+	// config was created with.
+	tlsConfig.RootCAs = nil
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		pool, err := ca.get()
+		if err != nil {
+			return err
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         pool.(*x509.CertPool),
+			DNSName:       cs.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+type perRequestBearerTokenFile struct {
+	file     *watchedFile
+	insecure bool
+}
+
+// NewPerRequestBearerTokenFile returns credentials sending the bearer token
+// of the given file, read again whenever it changes so short-lived workload
+// identity tokens, e.g. OIDC service account tokens or SPIFFE JWT-SVIDs, can
+// be used.
+func NewPerRequestBearerTokenFile(path string, insecure bool) (*perRequestBearerTokenFile, error) {
+	file, err := newWatchedFile(path, func(b []byte) (any, error) {
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return nil, errors.New("empty bearer token")
+		}
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &perRequestBearerTokenFile{
+		file:     file,
+		insecure: insecure,
+	}, nil
+}
+
+func (t *perRequestBearerTokenFile) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := t.file.get()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"authorization": "Bearer " + token.(string),
+	}, nil
+}
+
+func (t *perRequestBearerTokenFile) RequireTransportSecurity() bool {
+	return !t.insecure
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerRequestBearerTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+
+	_, err := NewPerRequestBearerTokenFile(path, false)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+	creds, err := NewPerRequestBearerTokenFile(path, false)
+	require.NoError(t, err)
+	require.True(t, creds.RequireTransportSecurity())
+
+	md, err := creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Bearer first", md["authorization"])
+
+	// A rotated token is picked up.
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Bearer second", md["authorization"])
+
+	// The last token is kept while the file is missing or empty.
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Bearer second", md["authorization"])
+
+	require.NoError(t, os.Remove(path))
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Bearer second", md["authorization"])
+}
+
+func TestNewTLSCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, []byte("not a certificate"), 0o600))
+
+	_, err := NewTLSCredentials(&commonconfig.TLSConfig{CAFile: path})
+	require.Error(t, err)
+
+	_, err = NewTLSCredentials(&commonconfig.TLSConfig{CertFile: path})
+	require.Error(t, err)
+
+	_, err = NewTLSCredentials(&commonconfig.TLSConfig{})
+	require.NoError(t, err)
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hsperfdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	perfDataMagic = 0xcafec0c0
+
+	prologueSize = 32
+	entrySize    = 20
+
+	typeLong = 'J'
+	typeByte = 'B'
+)
+
+var ErrInvalidPerfData = errors.New("invalid hsperfdata file")
+
+// PerfData holds the counters a HotSpot JVM exports in its hsperfdata file,
+// as jstat reads them.
+type PerfData struct {
+	// Whether the JVM finished initializing its counters.
+	Accessible bool
+	Longs      map[string]int64
+	Strings    map[string]string
+}
+
+// ReadPerfData reads and parses the hsperfdata file at the given path.
+func ReadPerfData(path string) (*PerfData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePerfData(data)
+}
+
+// ParsePerfData parses the contents of an hsperfdata file, which starts
+// with a prologue followed by the counter entries, each of them with its
+// name and value.
+func ParsePerfData(data []byte) (*PerfData, error) {
+	if len(data) < prologueSize {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidPerfData)
+	}
+	// The magic is always big endian, the rest uses the byte order of
+	// the JVM.
+	if binary.BigEndian.Uint32(data[0:4]) != perfDataMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidPerfData)
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if data[4] == 1 {
+		order = binary.LittleEndian
+	}
+	if major := data[5]; major != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidPerfData, major)
+	}
+
+	pd := &PerfData{
+		Accessible: data[7] != 0,
+		Longs:      map[string]int64{},
+		Strings:    map[string]string{},
+	}
+
+	offset := int(order.Uint32(data[24:28]))
+	entries := int(order.Uint32(data[28:32]))
+	for i := 0; i < entries; i++ {
+		if offset < 0 || offset+entrySize > len(data) {
+			return nil, fmt.Errorf("%w: entry %d out of bounds", ErrInvalidPerfData, i)
+		}
+		entry := data[offset:]
+		length := int(order.Uint32(entry[0:4]))
+		nameOffset := int(order.Uint32(entry[4:8]))
+		vectorLength := int(order.Uint32(entry[8:12]))
+		dataType := entry[12]
+		dataOffset := int(order.Uint32(entry[16:20]))
+		if length < entrySize || offset+length > len(data) || nameOffset >= length || dataOffset > length {
+			return nil, fmt.Errorf("%w: entry %d out of bounds", ErrInvalidPerfData, i)
+		}
+		entry = entry[:length]
+
+		name := cString(entry[nameOffset:])
+		value := entry[dataOffset:]
+		switch {
+		case dataType == typeLong && vectorLength == 0 && len(value) >= 8:
+			pd.Longs[name] = int64(order.Uint64(value))
+		case dataType == typeByte && vectorLength > 0:
+			if vectorLength < len(value) {
+				value = value[:vectorLength]
+			}
+			pd.Strings[name] = cString(value)
+		}
+		offset += length
+	}
+	return pd, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hsperfdata
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// perfData builds an hsperfdata file in little endian with the given
+// counters, which are either int64 or string.
+func perfData(accessible bool, counters map[string]interface{}) []byte {
+	le := binary.LittleEndian
+
+	var entries []byte
+	for name, value := range counters {
+		var data []byte
+		var dataType byte
+		vectorLength := 0
+		switch v := value.(type) {
+		case int64:
+			data = le.AppendUint64(nil, uint64(v))
+			dataType = typeLong
+		case string:
+			data = append([]byte(v), 0)
+			dataType = typeByte
+			vectorLength = len(data)
+		}
+		nameBytes := append([]byte(name), 0)
+		length := entrySize + len(nameBytes) + len(data)
+
+		entries = le.AppendUint32(entries, uint32(length))
+		entries = le.AppendUint32(entries, entrySize)
+		entries = le.AppendUint32(entries, uint32(vectorLength))
+		entries = append(entries, dataType, 0, 0, 0)
+		entries = le.AppendUint32(entries, uint32(entrySize+len(nameBytes)))
+		entries = append(entries, nameBytes...)
+		entries = append(entries, data...)
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, perfDataMagic)
+	b = append(b, 1, 2, 0, 0)
+	if accessible {
+		b[7] = 1
+	}
+	b = le.AppendUint32(b, uint32(prologueSize+len(entries)))
+	b = le.AppendUint32(b, 0)
+	b = le.AppendUint64(b, 0)
+	b = le.AppendUint32(b, prologueSize)
+	b = le.AppendUint32(b, uint32(len(counters)))
+	return append(b, entries...)
+}
+
+func TestParsePerfData(t *testing.T) {
+	pd, err := ParsePerfData(perfData(true, map[string]interface{}{
+		"sun.rt.vmInitDoneTime": int64(12345),
+		"java.rt.vmArgs":        "-Xmx1g -Xrs",
+	}))
+	require.NoError(t, err)
+	require.True(t, pd.Accessible)
+	require.Equal(t, map[string]int64{"sun.rt.vmInitDoneTime": 12345}, pd.Longs)
+	require.Equal(t, map[string]string{"java.rt.vmArgs": "-Xmx1g -Xrs"}, pd.Strings)
+}
+
+func TestParsePerfDataInvalid(t *testing.T) {
+	_, err := ParsePerfData([]byte("not hsperfdata, but long enough to be one"))
+	require.ErrorIs(t, err, ErrInvalidPerfData)
+
+	data := perfData(false, map[string]interface{}{"java.rt.vmArgs": "-Xrs"})
+	_, err = ParsePerfData(data[:len(data)-4])
+	require.ErrorIs(t, err, ErrInvalidPerfData)
+}
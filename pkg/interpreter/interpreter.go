@@ -0,0 +1,454 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package interpreter finds the interpreters running in other processes, so
+// their stacks can be walked from BPF, and places the interpreter frames
+// among the native ones.
+package interpreter
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+	"github.com/parca-dev/parca-agent/pkg/buildid"
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+// Type of interpreter. Must be in sync with enum interpreter_type in the BPF
+// program.
+type Type uint64
+
+const (
+	TypeNone Type = iota
+	TypePHP
+	TypeV8
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeNone:
+		return "none"
+	case TypePHP:
+		return "php"
+	case TypeV8:
+		return "v8"
+	default:
+		return "unknown"
+	}
+}
+
+// Info describes the interpreter of a process. Addresses are absolute, in
+// the address space of the process.
+type Info struct {
+	Type    Type
+	Version string
+
+	// Address of the global state of the interpreter, e.g. executor_globals
+	// for PHP.
+	GlobalsAddress uint64
+	// Address range of the interpreter loop. Interpreter frames are placed
+	// right before the native frames of the loop running them.
+	LoopStart uint64
+	LoopEnd   uint64
+
+	PHP PHPOffsets
+	V8  V8Offsets
+
+	v8Symbols v8Constants
+}
+
+// Interleave sets the native frame each interpreter frame of the sample
+// belongs to. Frames left over, e.g. because native unwinding stopped early,
+// are placed at the root.
+func (i *Info) Interleave(sample *profile.RawSample) {
+	if i.Type == TypeV8 {
+		interleaveByAddress(sample)
+		return
+	}
+
+	frames := sample.InterpreterStack
+	next := 0
+	for idx, addr := range sample.UserStack {
+		if next == len(frames) {
+			return
+		}
+		if addr < i.LoopStart || addr >= i.LoopEnd {
+			continue
+		}
+		for next < len(frames) {
+			frames[next].NativeIndex = idx
+			next++
+			if frames[next-1].Entry {
+				break
+			}
+		}
+	}
+	for ; next < len(frames); next++ {
+		frames[next].NativeIndex = len(sample.UserStack)
+	}
+}
+
+// interleaveByAddress places the frames that have the address of a native
+// frame at that frame, and the ones without one right before the next frame
+// that has one.
+func interleaveByAddress(sample *profile.RawSample) {
+	frames := sample.InterpreterStack
+	idx := 0
+	pending := 0
+	for n := range frames {
+		if frames[n].Address == 0 {
+			continue
+		}
+		for j := idx; j < len(sample.UserStack); j++ {
+			if sample.UserStack[j] == frames[n].Address {
+				idx = j
+				for ; pending <= n; pending++ {
+					frames[pending].NativeIndex = idx
+				}
+				break
+			}
+		}
+	}
+	for ; pending < len(frames); pending++ {
+		frames[pending].NativeIndex = len(sample.UserStack)
+	}
+}
+
+// Finder finds the interpreters of processes. Results for the same binary
+// are cached, as many processes usually share it, by file and by build ID,
+// for the copies of the binary in different containers.
+type Finder struct {
+	mtx       *sync.Mutex
+	cache     map[fileKey]*binaryInfo
+	byBuildID map[string]*binaryInfo
+}
+
+type fileKey struct {
+	dev, ino uint64
+	mtime    int64
+}
+
+// binaryInfo is the interpreter information of a binary, with addresses
+// relative to its load bias.
+type binaryInfo struct {
+	typ            Type
+	version        string
+	globalsAddress uint64
+	loopStart      uint64
+	loopEnd        uint64
+	php            PHPOffsets
+	v8             V8Offsets
+	v8Symbols      v8Constants
+}
+
+var finders = []struct {
+	typ   Type
+	match func(pathname string) bool
+	find  func(*elf.File, *dwarf.Data) (*binaryInfo, error)
+}{
+	{TypePHP, isPHPBinary, findPHP},
+	{TypeV8, isV8Binary, findV8},
+}
+
+// Match returns the type of interpreter the given binary might contain,
+// judging by its name.
+func Match(pathname string) Type {
+	for _, finder := range finders {
+		if finder.match(pathname) {
+			return finder.typ
+		}
+	}
+	return TypeNone
+}
+
+func NewFinder() *Finder {
+	return &Finder{
+		mtx:       &sync.Mutex{},
+		cache:     map[fileKey]*binaryInfo{},
+		byBuildID: map[string]*binaryInfo{},
+	}
+}
+
+// Find returns the interpreter run by the process with the given mappings,
+// or nil if it doesn't run a supported one.
+func (f *Finder) Find(pid int, maps []*procfs.ProcMap) (*Info, error) {
+	for _, m := range maps {
+		if !m.Perms.Execute {
+			continue
+		}
+		var find func(*elf.File, *dwarf.Data) (*binaryInfo, error)
+		for _, finder := range finders {
+			if finder.match(m.Pathname) {
+				find = finder.find
+				break
+			}
+		}
+		if find == nil {
+			continue
+		}
+
+		root := filepath.Join("/proc", strconv.Itoa(pid), "root")
+		path := filepath.Join(root, m.Pathname)
+		bi, err := f.binaryInfo(root, path, find)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %w", m.Pathname, err)
+		}
+		if bi == nil {
+			continue
+		}
+
+		bias, err := loadBias(path, m.Pathname, maps)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Info{
+			Type:           bi.typ,
+			Version:        bi.version,
+			GlobalsAddress: bi.globalsAddress + bias,
+			LoopStart:      bi.loopStart + bias,
+			LoopEnd:        bi.loopEnd + bias,
+			PHP:            bi.php,
+			V8:             bi.v8,
+			v8Symbols:      bi.v8Symbols,
+		}, nil
+	}
+	return nil, nil //nolint:nilnil
+}
+
+func (f *Finder) binaryInfo(root, path string, find func(*elf.File, *dwarf.Data) (*binaryInfo, error)) (*binaryInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var key fileKey
+	if id, ok := fileinfo.IDOf(stat); ok {
+		key = fileKey{dev: id.Dev, ino: id.Ino, mtime: stat.ModTime().UnixNano()}
+	}
+
+	f.mtx.Lock()
+	bi, ok := f.cache[key]
+	f.mtx.Unlock()
+	if ok {
+		return bi, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ef, err := elf.NewFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Best effort, the binary is only cached by file without it.
+	id, _ := buildid.BuildID(file, ef)
+	if id != "" {
+		f.mtx.Lock()
+		bi, ok = f.byBuildID[id]
+		if ok {
+			f.cache[key] = bi
+		}
+		f.mtx.Unlock()
+		if ok {
+			return bi, nil
+		}
+	}
+
+	bi, err = find(ef, debugInfo(root, ef, id))
+	if err != nil {
+		return nil, err
+	}
+
+	f.mtx.Lock()
+	f.cache[key] = bi
+	if id != "" {
+		f.byBuildID[id] = bi
+	}
+	f.mtx.Unlock()
+	return bi, nil
+}
+
+// debugInfo returns the DWARF debug information of the given binary, from the
+// binary itself or from the separate debug file installed for its build ID in
+// the given root, such as the ones of the -dbg and -debuginfo packages, or nil
+// if there is none.
+func debugInfo(root string, ef *elf.File, buildID string) *dwarf.Data {
+	if ef.Section(".debug_info") != nil {
+		if d, err := ef.DWARF(); err == nil {
+			return d
+		}
+	}
+	if len(buildID) < 3 {
+		return nil
+	}
+
+	debug, err := elf.Open(filepath.Join(root, "usr", "lib", "debug", ".build-id", buildID[:2], buildID[2:]+".debug"))
+	if err != nil {
+		return nil
+	}
+	defer debug.Close()
+	d, err := debug.DWARF()
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// structTypes returns the structure and union types with the given names
+// found in the DWARF debug information, skipping their declarations.
+func structTypes(d *dwarf.Data, names ...string) (map[string]*dwarf.StructType, error) {
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+	}
+
+	found := make(map[string]*dwarf.StructType, len(names))
+	r := d.Reader()
+	for len(found) < len(wanted) {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagStructType && e.Tag != dwarf.TagUnionType {
+			continue
+		}
+		name, _ := e.Val(dwarf.AttrName).(string)
+		if _, ok := wanted[name]; !ok {
+			continue
+		}
+		if _, ok := found[name]; ok {
+			continue
+		}
+		if decl, _ := e.Val(dwarf.AttrDeclaration).(bool); decl {
+			continue
+		}
+		t, err := d.Type(e.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if st, ok := t.(*dwarf.StructType); ok {
+			found[name] = st
+		}
+	}
+	return found, nil
+}
+
+// fieldOffset returns the offset of the field at the given path in the given
+// structure, following nested structures and unions, e.g. This, u1 and
+// type_info for the type information of the zval This of zend_execute_data.
+func fieldOffset(st *dwarf.StructType, path ...string) (uint32, error) {
+	var offset int64
+	t := dwarf.Type(st)
+	for _, name := range path {
+		for {
+			typedef, ok := t.(*dwarf.TypedefType)
+			if !ok {
+				break
+			}
+			t = typedef.Type
+		}
+		st, ok := t.(*dwarf.StructType)
+		if !ok {
+			return 0, fmt.Errorf("%s is not a structure", name)
+		}
+		var field *dwarf.StructField
+		for _, f := range st.Field {
+			if f.Name == name {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return 0, fmt.Errorf("field %s not found in %s", name, st.StructName)
+		}
+		offset += field.ByteOffset
+		t = field.Type
+	}
+	return uint32(offset), nil
+}
+
+// loadBias returns the difference between the addresses the given binary
+// was loaded at and the ones in its ELF file.
+func loadBias(path, pathname string, maps []*procfs.ProcMap) (uint64, error) {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer ef.Close()
+
+	if ef.Type == elf.ET_EXEC {
+		return 0, nil
+	}
+
+	var first *elf.Prog
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_LOAD {
+			first = p
+			break
+		}
+	}
+	if first == nil || first.Off != 0 {
+		return 0, errors.New("unexpected program headers")
+	}
+
+	for _, m := range maps {
+		if m.Pathname == pathname && m.Offset == 0 {
+			pageMask := uint64(os.Getpagesize() - 1)
+			return uint64(m.StartAddr) - first.Vaddr&^pageMask, nil
+		}
+	}
+	return 0, errors.New("no mapping found for the start of the binary")
+}
+
+// findSymbols returns the values and sizes of the given symbols, looking at
+// the dynamic symbols first.
+func findSymbols(ef *elf.File, names ...string) map[string]elf.Symbol {
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+	}
+
+	found := make(map[string]elf.Symbol, len(names))
+	for _, symbols := range []func() ([]elf.Symbol, error){ef.DynamicSymbols, ef.Symbols} {
+		syms, err := symbols()
+		if err != nil {
+			continue
+		}
+		for _, sym := range syms {
+			if _, ok := wanted[sym.Name]; !ok || sym.Value == 0 {
+				continue
+			}
+			if _, ok := found[sym.Name]; !ok {
+				found[sym.Name] = sym
+			}
+		}
+		if len(found) == len(wanted) {
+			break
+		}
+	}
+	return found
+}
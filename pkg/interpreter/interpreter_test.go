@@ -0,0 +1,142 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+func TestInterleave(t *testing.T) {
+	info := &Info{LoopStart: 0x1000, LoopEnd: 0x2000}
+	sample := &profile.RawSample{
+		// leaf, execute_ex, zend_call_function, execute_ex, main
+		UserStack: []uint64{0x500, 0x1010, 0x3000, 0x1020, 0x4000},
+		InterpreterStack: []profile.InterpreterFrame{
+			{Line: profile.Line{Function: profile.Function{Name: "inner"}}},
+			{Line: profile.Line{Function: profile.Function{Name: "callback"}}, Entry: true},
+			{Line: profile.Line{Function: profile.Function{Name: "array_user"}}},
+			{Line: profile.Line{Function: profile.Function{Name: "{main}"}}, Entry: true},
+		},
+	}
+
+	info.Interleave(sample)
+
+	indexes := make([]int, 0, len(sample.InterpreterStack))
+	for _, f := range sample.InterpreterStack {
+		indexes = append(indexes, f.NativeIndex)
+	}
+	require.Equal(t, []int{1, 1, 3, 3}, indexes)
+}
+
+func TestInterleaveLeftovers(t *testing.T) {
+	info := &Info{LoopStart: 0x1000, LoopEnd: 0x2000}
+	sample := &profile.RawSample{
+		// Native unwinding stopped before the outer interpreter loop.
+		UserStack: []uint64{0x1010, 0x3000},
+		InterpreterStack: []profile.InterpreterFrame{
+			{Entry: true},
+			{Entry: true},
+		},
+	}
+
+	info.Interleave(sample)
+
+	require.Equal(t, 0, sample.InterpreterStack[0].NativeIndex)
+	require.Equal(t, 2, sample.InterpreterStack[1].NativeIndex)
+}
+
+func TestPHPVersion(t *testing.T) {
+	version, err := phpVersion([]byte("\x00garbage\x00X-Powered-By: PHP/8.2.7\x00more"))
+	require.NoError(t, err)
+	require.Equal(t, "8.2", version)
+
+	_, err = phpVersion([]byte("no version here"))
+	require.ErrorIs(t, err, errPHPVersionNotFound)
+}
+
+func TestIsPHPBinary(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/usr/local/bin/php":         true,
+		"/usr/sbin/php-fpm8.2":       true,
+		"/usr/bin/php7.4":            true,
+		"/usr/lib/libphp.so":         true,
+		"/usr/lib/libphp8.so.8.1.0":  true,
+		"/usr/lib/libc.so.6":         false,
+		"/usr/bin/phpunit":           false,
+		"/usr/local/bin/php-wrapper": false,
+	} {
+		require.Equal(t, expected, isPHPBinary(path), path)
+	}
+}
+
+func TestPHPOffsetsFromDWARF(t *testing.T) {
+	ef, err := elf.Open("testdata/php-dwarf.o")
+	require.NoError(t, err)
+	t.Cleanup(func() { ef.Close() })
+	d, err := ef.DWARF()
+	require.NoError(t, err)
+
+	offsets, err := phpOffsetsFromDWARF(d)
+	require.NoError(t, err)
+	require.Equal(t, php8Offsets, offsets)
+
+	// Preferred to the offsets of the version.
+	offsets, err = phpOffsetsFor("7.4", d)
+	require.NoError(t, err)
+	require.Equal(t, php8Offsets, offsets)
+}
+
+func TestPHPOffsetsFor(t *testing.T) {
+	offsets, err := phpOffsetsFor("7.4", nil)
+	require.NoError(t, err)
+	require.Equal(t, php74Offsets, offsets)
+
+	// Newer minor versions fall back to the closest older one.
+	offsets, err = phpOffsetsFor("8.4", nil)
+	require.NoError(t, err)
+	require.Equal(t, phpOffsets["8.3"], offsets)
+
+	for _, version := range []string{"7.3", "9.0", "8"} {
+		_, err = phpOffsetsFor(version, nil)
+		require.Error(t, err, version)
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	stripped, err := elf.Open("../elfwriter/testdata/libc.so.6")
+	require.NoError(t, err)
+	t.Cleanup(func() { stripped.Close() })
+
+	root := t.TempDir()
+	require.Nil(t, debugInfo(root, stripped, "abcdef"))
+
+	data, err := os.ReadFile("testdata/php-dwarf.o")
+	require.NoError(t, err)
+	dir := filepath.Join(root, "usr/lib/debug/.build-id/ab")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cdef.debug"), data, 0o644))
+	require.NotNil(t, debugInfo(root, stripped, "abcdef"))
+
+	withDebugInfo, err := elf.Open("testdata/php-dwarf.o")
+	require.NoError(t, err)
+	t.Cleanup(func() { withDebugInfo.Close() })
+	require.NotNil(t, debugInfo(t.TempDir(), withDebugInfo, ""))
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PHPOffsets are the offsets of the ZendVM structure fields needed to walk
+// the PHP stack. Must be in sync with php_offsets_t in the BPF program.
+type PHPOffsets struct {
+	// Of current_execute_data in zend_executor_globals.
+	CurrentExecuteData uint32
+	// Of opline, func, This.u1.type_info and prev_execute_data in
+	// zend_execute_data.
+	ExecuteDataOpline   uint32
+	ExecuteDataFunc     uint32
+	ExecuteDataTypeInfo uint32
+	ExecuteDataPrevious uint32
+	FunctionType        uint32
+	FunctionName        uint32
+	FunctionScope       uint32
+	ClassEntryName      uint32
+	OpArrayFilename     uint32
+	OpLineno            uint32
+	StringVal           uint32
+	CallTopFlag         uint32
+	_                   uint32
+}
+
+// The layout of the structures used by the unwinder only changed slightly
+// between the supported versions. ZTS builds keep executor_globals in
+// thread local storage and are not supported.
+//
+// The offsets are read from the debug information of the binaries that have
+// it, and taken from the closest older minor version of the same major one
+// for the versions that aren't listed.
+var (
+	php74Offsets = PHPOffsets{
+		CurrentExecuteData:  416,
+		ExecuteDataOpline:   0,
+		ExecuteDataFunc:     24,
+		ExecuteDataTypeInfo: 40,
+		ExecuteDataPrevious: 48,
+		FunctionType:        0,
+		FunctionName:        8,
+		FunctionScope:       16,
+		ClassEntryName:      8,
+		OpArrayFilename:     136,
+		OpLineno:            24,
+		StringVal:           24,
+		CallTopFlag:         1 << 17,
+	}
+	// PHP 8 added the attributes to zend_op_array.
+	php8Offsets = func() PHPOffsets {
+		o := php74Offsets
+		o.OpArrayFilename = 144
+		return o
+	}()
+
+	phpOffsets = map[string]PHPOffsets{
+		"7.4": php74Offsets,
+		"8.0": php8Offsets,
+		"8.1": php8Offsets,
+		"8.2": php8Offsets,
+		"8.3": php8Offsets,
+	}
+)
+
+var (
+	phpBinaryRegexp  = regexp.MustCompile(`^(php(-fpm|-cgi)?[0-9.]*|libphp[0-9.]*\.so(\.[0-9.]+)?)$`)
+	phpVersionRegexp = regexp.MustCompile(`X-Powered-By: PHP/([0-9]+)\.([0-9]+)\.[0-9]+`)
+
+	errPHPVersionNotFound = errors.New("PHP version not found")
+)
+
+func isPHPBinary(pathname string) bool {
+	return phpBinaryRegexp.MatchString(filepath.Base(pathname))
+}
+
+// findPHP returns the interpreter information of a PHP binary, or nil if it
+// doesn't contain the interpreter.
+func findPHP(ef *elf.File, d *dwarf.Data) (*binaryInfo, error) {
+	syms := findSymbols(ef, "executor_globals", "execute_ex")
+	globals, ok := syms["executor_globals"]
+	if !ok {
+		// Either a ZTS build or the SAPI binary linking libphp.
+		return nil, nil //nolint:nilnil
+	}
+	loop, ok := syms["execute_ex"]
+	if !ok {
+		return nil, errors.New("execute_ex not found")
+	}
+
+	rodata := ef.Section(".rodata")
+	if rodata == nil {
+		return nil, errors.New("no .rodata section")
+	}
+	data, err := rodata.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .rodata: %w", err)
+	}
+	version, err := phpVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := phpOffsetsFor(version, d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &binaryInfo{
+		typ:            TypePHP,
+		version:        version,
+		globalsAddress: globals.Value,
+		loopStart:      loop.Value,
+		loopEnd:        loop.Value + loop.Size,
+		php:            offsets,
+	}, nil
+}
+
+// phpVersion returns the major and minor version of PHP from the
+// X-Powered-By header embedded in the binary.
+func phpVersion(rodata []byte) (string, error) {
+	idx := bytes.Index(rodata, []byte("X-Powered-By: PHP/"))
+	if idx == -1 {
+		return "", errPHPVersionNotFound
+	}
+	end := idx + 64
+	if end > len(rodata) {
+		end = len(rodata)
+	}
+	match := phpVersionRegexp.FindSubmatch(rodata[idx:end])
+	if match == nil {
+		return "", errPHPVersionNotFound
+	}
+	return string(match[1]) + "." + string(match[2]), nil
+}
+
+// phpOffsetsFor returns the offsets of the given version of PHP, read from
+// its debug information if there is any.
+func phpOffsetsFor(version string, d *dwarf.Data) (PHPOffsets, error) {
+	if d != nil {
+		if offsets, err := phpOffsetsFromDWARF(d); err == nil {
+			return offsets, nil
+		}
+	}
+	if offsets, ok := phpOffsets[version]; ok {
+		return offsets, nil
+	}
+
+	// Minor versions rarely change the layout of the structures used.
+	major, minor, ok := splitVersion(version)
+	if !ok {
+		return PHPOffsets{}, fmt.Errorf("unsupported PHP version %s", version)
+	}
+	closest := -1
+	for v := range phpOffsets {
+		vMajor, vMinor, ok := splitVersion(v)
+		if ok && vMajor == major && vMinor < minor && vMinor > closest {
+			closest = vMinor
+		}
+	}
+	if closest == -1 {
+		return PHPOffsets{}, fmt.Errorf("unsupported PHP version %s", version)
+	}
+	return phpOffsets[strconv.Itoa(major)+"."+strconv.Itoa(closest)], nil
+}
+
+func splitVersion(version string) (int, int, bool) {
+	majorStr, minorStr, ok := strings.Cut(version, ".")
+	if !ok {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// phpOffsetsFromDWARF reads the offsets of the fields used by the unwinder
+// from the types of the ZendVM structures in the given debug information.
+func phpOffsetsFromDWARF(d *dwarf.Data) (PHPOffsets, error) {
+	types, err := structTypes(d,
+		"_zend_executor_globals",
+		"_zend_execute_data",
+		"_zend_function",
+		"_zend_class_entry",
+		"_zend_op_array",
+		"_zend_op",
+		"_zend_string",
+	)
+	if err != nil {
+		return PHPOffsets{}, err
+	}
+
+	offsets := PHPOffsets{
+		// A flag of This.u1.type_info, defined by a macro.
+		CallTopFlag: php74Offsets.CallTopFlag,
+	}
+	for _, f := range []struct {
+		dst  *uint32
+		typ  string
+		path []string
+	}{
+		{&offsets.CurrentExecuteData, "_zend_executor_globals", []string{"current_execute_data"}},
+		{&offsets.ExecuteDataOpline, "_zend_execute_data", []string{"opline"}},
+		{&offsets.ExecuteDataFunc, "_zend_execute_data", []string{"func"}},
+		{&offsets.ExecuteDataTypeInfo, "_zend_execute_data", []string{"This", "u1", "type_info"}},
+		{&offsets.ExecuteDataPrevious, "_zend_execute_data", []string{"prev_execute_data"}},
+		{&offsets.FunctionType, "_zend_function", []string{"type"}},
+		{&offsets.FunctionName, "_zend_function", []string{"common", "function_name"}},
+		{&offsets.FunctionScope, "_zend_function", []string{"common", "scope"}},
+		{&offsets.ClassEntryName, "_zend_class_entry", []string{"name"}},
+		{&offsets.OpArrayFilename, "_zend_op_array", []string{"filename"}},
+		{&offsets.OpLineno, "_zend_op", []string{"lineno"}},
+		{&offsets.StringVal, "_zend_string", []string{"val"}},
+	} {
+		st, ok := types[f.typ]
+		if !ok {
+			return PHPOffsets{}, fmt.Errorf("type %s not found", f.typ)
+		}
+		off, err := fieldOffset(st, f.path...)
+		if err != nil {
+			return PHPOffsets{}, err
+		}
+		*f.dst = off
+	}
+	return offsets, nil
+}
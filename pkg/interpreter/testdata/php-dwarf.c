@@ -0,0 +1,99 @@
+// The layout of the ZendVM structures of PHP 8 used by the unwinder, built
+// with gcc -g -c -o php-dwarf.o php-dwarf.c to test the discovery of their
+// offsets from DWARF.
+#include <stdint.h>
+
+typedef unsigned char zend_uchar;
+typedef struct _zend_string zend_string;
+typedef struct _zend_class_entry zend_class_entry;
+typedef struct _zend_execute_data zend_execute_data;
+typedef union _zend_function zend_function;
+
+struct _zend_string {
+  uint32_t refcount;
+  uint32_t type_info;
+  uint64_t h;
+  uint64_t len;
+  char val[1];
+};
+
+typedef union _zend_value {
+  int64_t lval;
+  double dval;
+  void *ptr;
+} zend_value;
+
+typedef struct _zval_struct {
+  zend_value value;
+  union {
+    uint32_t type_info;
+    struct {
+      zend_uchar type;
+      zend_uchar type_flags;
+      uint16_t extra;
+    } v;
+  } u1;
+  union {
+    uint32_t next;
+    uint32_t lineno;
+  } u2;
+} zval;
+
+typedef struct _zend_op {
+  const void *handler;
+  uint32_t op1;
+  uint32_t op2;
+  uint32_t result;
+  uint32_t extended_value;
+  uint32_t lineno;
+  zend_uchar opcode;
+} zend_op;
+
+struct _zend_class_entry {
+  char type;
+  zend_string *name;
+};
+
+typedef struct _zend_op_array {
+  zend_uchar type;
+  zend_uchar arg_flags[3];
+  uint32_t fn_flags;
+  zend_string *function_name;
+  zend_class_entry *scope;
+  char _pad[120];
+  zend_string *filename;
+} zend_op_array;
+
+union _zend_function {
+  zend_uchar type;
+  uint32_t quick_arg_flags;
+  struct {
+    zend_uchar type;
+    zend_uchar arg_flags[3];
+    uint32_t fn_flags;
+    zend_string *function_name;
+    zend_class_entry *scope;
+  } common;
+  zend_op_array op_array;
+};
+
+struct _zend_execute_data {
+  const zend_op *opline;
+  zend_execute_data *call;
+  zval *return_value;
+  zend_function *func;
+  zval This;
+  zend_execute_data *prev_execute_data;
+};
+
+typedef struct _zend_executor_globals {
+  char _pad[416];
+  zend_execute_data *current_execute_data;
+} zend_executor_globals;
+
+zend_executor_globals executor_globals;
+zend_execute_data execute_data;
+zend_function function;
+zend_class_entry class_entry;
+zend_op op;
+zend_string string;
@@ -0,0 +1,451 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+// V8Offsets are the offsets needed to find the functions of the JavaScript
+// frames. Must be in sync with v8_offsets_t in the BPF program.
+type V8Offsets struct {
+	// Of the JSFunction and the context or frame type marker, relative to
+	// the frame pointer.
+	FramePointerFunction int32
+	FramePointerContext  int32
+	// Of the SharedFunctionInfo in JSFunction.
+	JSFunctionShared  uint32
+	HeapObjectTagMask uint32
+	HeapObjectTag     uint32
+	SmiTagMask        uint32
+	SmiTag            uint32
+	_                 uint32
+}
+
+// v8Constants describe the V8 heap layout, used to read the names of the
+// functions in userspace.
+type v8Constants struct {
+	heapObjectTag   uint64
+	smiShift        uint64
+	mapOffset       uint64
+	instanceTypeOff uint64
+
+	sharedFunctionInfoType uint64
+	scopeInfoType          uint64
+	firstNonstringType     uint64
+
+	sharedNameOffset   uint64
+	sharedScriptOffset uint64
+	scriptNameOffset   uint64
+
+	scopeInfoContextLocalCountIndex uint64
+	scopeInfoFirstVarsIndex         uint64
+
+	stringLengthOffset       uint64
+	stringRepresentationMask uint64
+	stringEncodingMask       uint64
+	seqStringTag             uint64
+	consStringTag            uint64
+	thinStringTag            uint64
+	oneByteStringTag         uint64
+	seqOneByteCharsOffset    uint64
+	seqTwoByteCharsOffset    uint64
+	consFirstOffset          uint64
+	consSecondOffset         uint64
+	thinActualOffset         uint64
+}
+
+const (
+	// Limits to what is read from the heap for a single name.
+	maxV8StringLength = 256
+	maxV8ConsDepth    = 8
+	// llnode looks for the function name in the first slots after the
+	// context locals of a ScopeInfo, as there is no metadata to find its
+	// exact position.
+	v8ScopeInfoNameCandidates = 3
+)
+
+var v8BinaryRegexp = regexp.MustCompile(`^(node(js)?[0-9.]*|libnode\.so(\.[0-9.]+)?)$`)
+
+func isV8Binary(pathname string) bool {
+	return v8BinaryRegexp.MatchString(filepath.Base(pathname))
+}
+
+// findV8 returns the interpreter information of a binary embedding V8 from
+// its postmortem debugging metadata, the v8dbg_* symbols Node.js is built
+// with.
+func findV8(ef *elf.File, _ *dwarf.Data) (*binaryInfo, error) {
+	c := &v8ConstantsReader{ef: ef}
+	if _, ok := c.lookup("v8dbg_SmiTag"); !ok {
+		return nil, nil //nolint:nilnil
+	}
+
+	offsets := V8Offsets{
+		FramePointerFunction: int32(c.get("v8dbg_off_fp_function")),
+		FramePointerContext:  int32(c.get("v8dbg_off_fp_context")),
+		JSFunctionShared:     uint32(c.get("v8dbg_class_JSFunction__shared__SharedFunctionInfo", "v8dbg_class_JSFunction__shared_function_info__SharedFunctionInfo")),
+		HeapObjectTagMask:    uint32(c.get("v8dbg_HeapObjectTagMask")),
+		HeapObjectTag:        uint32(c.get("v8dbg_HeapObjectTag")),
+		SmiTagMask:           uint32(c.get("v8dbg_SmiTagMask")),
+		SmiTag:               uint32(c.get("v8dbg_SmiTag")),
+	}
+
+	consts := v8Constants{
+		heapObjectTag:   uint64(offsets.HeapObjectTag),
+		smiShift:        uint64(c.get("v8dbg_SmiShiftSize")) + 1,
+		mapOffset:       uint64(c.get("v8dbg_class_HeapObject__map__Map")),
+		instanceTypeOff: uint64(c.get("v8dbg_class_Map__instance_type__uint16_t")),
+
+		sharedFunctionInfoType: uint64(c.get("v8dbg_type_SharedFunctionInfo__SHARED_FUNCTION_INFO_TYPE")),
+		scopeInfoType:          uint64(c.get("v8dbg_type_ScopeInfo__SCOPE_INFO_TYPE")),
+		firstNonstringType:     uint64(c.get("v8dbg_FirstNonstringType")),
+
+		sharedNameOffset:   uint64(c.get("v8dbg_class_SharedFunctionInfo__name_or_scope_info__Object", "v8dbg_class_SharedFunctionInfo__name__Object")),
+		sharedScriptOffset: uint64(c.get("v8dbg_class_SharedFunctionInfo__script_or_debug_info__Object", "v8dbg_class_SharedFunctionInfo__script_or_debug_info__HeapObject", "v8dbg_class_SharedFunctionInfo__script__Object")),
+		scriptNameOffset:   uint64(c.get("v8dbg_class_Script__name__Object")),
+
+		scopeInfoContextLocalCountIndex: uint64(c.getOr(2, "v8dbg_scopeinfo_idx_ncontextlocals")),
+		scopeInfoFirstVarsIndex:         uint64(c.getOr(3, "v8dbg_scopeinfo_idx_first_vars")),
+
+		stringLengthOffset:       uint64(c.get("v8dbg_class_String__length__int32_t", "v8dbg_class_String__length__SMI")),
+		stringRepresentationMask: uint64(c.get("v8dbg_StringRepresentationMask")),
+		stringEncodingMask:       uint64(c.get("v8dbg_StringEncodingMask")),
+		seqStringTag:             uint64(c.get("v8dbg_SeqStringTag")),
+		consStringTag:            uint64(c.get("v8dbg_ConsStringTag")),
+		thinStringTag:            uint64(c.getOr(-1, "v8dbg_ThinStringTag")),
+		oneByteStringTag:         uint64(c.get("v8dbg_OneByteStringTag")),
+		seqOneByteCharsOffset:    uint64(c.get("v8dbg_class_SeqOneByteString__chars__char")),
+		seqTwoByteCharsOffset:    uint64(c.get("v8dbg_class_SeqTwoByteString__chars__char")),
+		consFirstOffset:          uint64(c.get("v8dbg_class_ConsString__first__String")),
+		consSecondOffset:         uint64(c.get("v8dbg_class_ConsString__second__String")),
+		thinActualOffset:         uint64(c.getOr(0, "v8dbg_class_ThinString__actual__String")),
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return &binaryInfo{
+		typ:       TypeV8,
+		v8:        offsets,
+		v8Symbols: consts,
+	}, nil
+}
+
+// v8ConstantsReader reads the values of the v8dbg_* symbols, which are
+// global integers. The first error is kept.
+type v8ConstantsReader struct {
+	ef      *elf.File
+	symbols map[string]elf.Symbol
+	err     error
+}
+
+func (r *v8ConstantsReader) lookup(name string) (int64, bool) {
+	if r.symbols == nil {
+		r.symbols = map[string]elf.Symbol{}
+		for _, symbols := range []func() ([]elf.Symbol, error){r.ef.DynamicSymbols, r.ef.Symbols} {
+			syms, err := symbols()
+			if err != nil {
+				continue
+			}
+			for _, sym := range syms {
+				if len(sym.Name) > 6 && sym.Name[:6] == "v8dbg_" {
+					r.symbols[sym.Name] = sym
+				}
+			}
+		}
+	}
+
+	sym, ok := r.symbols[name]
+	if !ok {
+		return 0, false
+	}
+	for _, s := range r.ef.Sections {
+		if s.Type != elf.SHT_PROGBITS || sym.Value < s.Addr || sym.Value+4 > s.Addr+s.Size {
+			continue
+		}
+		buf := make([]byte, 4)
+		if _, err := s.ReadAt(buf, int64(sym.Value-s.Addr)); err != nil {
+			return 0, false
+		}
+		return int64(int32(r.ef.ByteOrder.Uint32(buf))), true
+	}
+	return 0, false
+}
+
+// get returns the value of the first of the given symbols that exists.
+func (r *v8ConstantsReader) get(names ...string) int64 {
+	for _, name := range names {
+		if v, ok := r.lookup(name); ok {
+			return v
+		}
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("V8 constant %s not found", names[0])
+	}
+	return 0
+}
+
+func (r *v8ConstantsReader) getOr(def int64, names ...string) int64 {
+	for _, name := range names {
+		if v, ok := r.lookup(name); ok {
+			return v
+		}
+	}
+	return def
+}
+
+// V8Symbolizer resolves the JavaScript frames walked by the BPF program,
+// which only records the SharedFunctionInfo of each of them, by reading the
+// heap of the process. Objects might have been moved by the garbage
+// collector since, so what is read is validated and frames that can't be
+// resolved are dropped.
+type V8Symbolizer struct {
+	c     v8Constants
+	mem   io.ReaderAt
+	close func() error
+	cache map[uint64]*profile.Function
+}
+
+func NewV8Symbolizer(pid int, info *Info) (*V8Symbolizer, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "mem"))
+	if err != nil {
+		return nil, err
+	}
+	return &V8Symbolizer{
+		c:     info.v8Symbols,
+		mem:   f,
+		close: f.Close,
+		cache: map[uint64]*profile.Function{},
+	}, nil
+}
+
+func (s *V8Symbolizer) Close() error {
+	return s.close()
+}
+
+// Frames symbolizes the frames of a V8 stack, stored by the BPF program as
+// pairs of SharedFunctionInfo and program counter.
+func (s *V8Symbolizer) Frames(raw []uint64) []profile.InterpreterFrame {
+	frames := make([]profile.InterpreterFrame, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		fn := s.function(raw[i])
+		if fn == nil {
+			continue
+		}
+		frames = append(frames, profile.InterpreterFrame{
+			Line:    profile.Line{Function: *fn},
+			Address: raw[i+1],
+		})
+	}
+	return frames
+}
+
+func (s *V8Symbolizer) function(shared uint64) *profile.Function {
+	if fn, ok := s.cache[shared]; ok {
+		return fn
+	}
+
+	var fn *profile.Function
+	if typ, err := s.instanceType(shared); err == nil && typ == s.c.sharedFunctionInfoType {
+		name := s.functionName(shared)
+		if name == "" {
+			name = "(anonymous)"
+		}
+		fn = &profile.Function{Name: name, Filename: s.scriptName(shared)}
+	}
+	s.cache[shared] = fn
+	return fn
+}
+
+func (s *V8Symbolizer) functionName(shared uint64) string {
+	nameOrScopeInfo, err := s.readTagged(shared, s.c.sharedNameOffset)
+	if err != nil {
+		return ""
+	}
+	if name, err := s.readString(nameOrScopeInfo, 0); err == nil {
+		return name
+	}
+
+	if typ, err := s.instanceType(nameOrScopeInfo); err != nil || typ != s.c.scopeInfoType {
+		return ""
+	}
+	count, err := s.readTagged(nameOrScopeInfo, s.slot(s.c.scopeInfoContextLocalCountIndex))
+	if err != nil {
+		return ""
+	}
+	// Names and infos of the context locals come first.
+	first := s.c.scopeInfoFirstVarsIndex + (count>>s.c.smiShift)*2
+	for i := uint64(0); i < v8ScopeInfoNameCandidates; i++ {
+		candidate, err := s.readTagged(nameOrScopeInfo, s.slot(first+i))
+		if err != nil {
+			return ""
+		}
+		if name, err := s.readString(candidate, 0); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func (s *V8Symbolizer) scriptName(shared uint64) string {
+	script, err := s.readTagged(shared, s.c.sharedScriptOffset)
+	if err != nil {
+		return ""
+	}
+	name, err := s.readTagged(script, s.c.scriptNameOffset)
+	if err != nil {
+		return ""
+	}
+	str, err := s.readString(name, 0)
+	if err != nil {
+		return ""
+	}
+	return str
+}
+
+// slot returns the offset of a tagged field of a ScopeInfo, which come
+// right after its map.
+func (s *V8Symbolizer) slot(index uint64) uint64 {
+	return s.c.mapOffset + 8 + index*8
+}
+
+func (s *V8Symbolizer) read(addr uint64, buf []byte) error {
+	_, err := s.mem.ReadAt(buf, int64(addr))
+	return err
+}
+
+// readTagged reads a tagged field of the given heap object.
+func (s *V8Symbolizer) readTagged(object, offset uint64) (uint64, error) {
+	buf := make([]byte, 8)
+	if err := s.read(object-s.c.heapObjectTag+offset, buf); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+func (s *V8Symbolizer) instanceType(object uint64) (uint64, error) {
+	if object&3 != s.c.heapObjectTag {
+		return 0, errors.New("not a heap object")
+	}
+	m, err := s.readTagged(object, s.c.mapOffset)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 2)
+	if err := s.read(m-s.c.heapObjectTag+s.c.instanceTypeOff, buf); err != nil {
+		return 0, err
+	}
+	return uint64(binary.LittleEndian.Uint16(buf)), nil
+}
+
+var errNotString = errors.New("not a string")
+
+// readString reads a V8 string, following cons and thin strings.
+func (s *V8Symbolizer) readString(object uint64, depth int) (string, error) {
+	if depth > maxV8ConsDepth {
+		return "", errors.New("string nested too deep")
+	}
+	typ, err := s.instanceType(object)
+	if err != nil {
+		return "", err
+	}
+	if typ >= s.c.firstNonstringType {
+		return "", errNotString
+	}
+
+	switch typ & s.c.stringRepresentationMask {
+	case s.c.consStringTag:
+		first, err := s.readTagged(object, s.c.consFirstOffset)
+		if err != nil {
+			return "", err
+		}
+		second, err := s.readTagged(object, s.c.consSecondOffset)
+		if err != nil {
+			return "", err
+		}
+		a, err := s.readString(first, depth+1)
+		if err != nil {
+			return "", err
+		}
+		b, err := s.readString(second, depth+1)
+		if err != nil {
+			return "", err
+		}
+		return truncate(a + b), nil
+	case s.c.thinStringTag:
+		actual, err := s.readTagged(object, s.c.thinActualOffset)
+		if err != nil {
+			return "", err
+		}
+		return s.readString(actual, depth+1)
+	case s.c.seqStringTag:
+	default:
+		return "", fmt.Errorf("unsupported string representation %#x", typ)
+	}
+
+	lengthBuf := make([]byte, 4)
+	if err := s.read(object-s.c.heapObjectTag+s.c.stringLengthOffset, lengthBuf); err != nil {
+		return "", err
+	}
+	length := uint64(binary.LittleEndian.Uint32(lengthBuf))
+	if length > maxV8StringLength {
+		length = maxV8StringLength
+	}
+
+	if typ&s.c.stringEncodingMask == s.c.oneByteStringTag {
+		buf := make([]byte, length)
+		if err := s.read(object-s.c.heapObjectTag+s.c.seqOneByteCharsOffset, buf); err != nil {
+			return "", err
+		}
+		return latin1(buf), nil
+	}
+
+	buf := make([]byte, length*2)
+	if err := s.read(object-s.c.heapObjectTag+s.c.seqTwoByteCharsOffset, buf); err != nil {
+		return "", err
+	}
+	chars := make([]uint16, length)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(buf[i*2:])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// latin1 decodes one byte strings, which V8 stores as Latin-1.
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func truncate(s string) string {
+	if len(s) > maxV8StringLength {
+		return s[:maxV8StringLength]
+	}
+	return s
+}
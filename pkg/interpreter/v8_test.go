@@ -0,0 +1,173 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+const (
+	testSharedFunctionInfoType = 0xa0
+	testScopeInfoType          = 0xb0
+	testSeqOneByteStringType   = 0x08
+	testSeqTwoByteStringType   = 0x00
+	testConsOneByteStringType  = 0x09
+)
+
+var testV8Constants = v8Constants{
+	heapObjectTag:   1,
+	smiShift:        32,
+	mapOffset:       0,
+	instanceTypeOff: 12,
+
+	sharedFunctionInfoType: testSharedFunctionInfoType,
+	scopeInfoType:          testScopeInfoType,
+	firstNonstringType:     0x80,
+
+	sharedNameOffset:   8,
+	sharedScriptOffset: 16,
+	scriptNameOffset:   8,
+
+	scopeInfoContextLocalCountIndex: 2,
+	scopeInfoFirstVarsIndex:         3,
+
+	stringLengthOffset:       12,
+	stringRepresentationMask: 0x7,
+	stringEncodingMask:       0x8,
+	seqStringTag:             0,
+	consStringTag:            1,
+	thinStringTag:            5,
+	oneByteStringTag:         0x8,
+	seqOneByteCharsOffset:    16,
+	seqTwoByteCharsOffset:    16,
+	consFirstOffset:          16,
+	consSecondOffset:         24,
+	thinActualOffset:         16,
+}
+
+// fakeHeap is the memory of a process, starting at address 0.
+type fakeHeap []byte
+
+func (h fakeHeap) object(addr uint64, typ uint16) uint64 {
+	m := 0x8000 + uint64(typ)*0x10
+	binary.LittleEndian.PutUint16(h[m+testV8Constants.instanceTypeOff:], typ)
+	binary.LittleEndian.PutUint64(h[addr:], m+1)
+	return addr + 1
+}
+
+func (h fakeHeap) field(object, offset, value uint64) {
+	binary.LittleEndian.PutUint64(h[object-1+offset:], value)
+}
+
+func (h fakeHeap) oneByteString(addr uint64, s string) uint64 {
+	str := h.object(addr, testSeqOneByteStringType)
+	binary.LittleEndian.PutUint32(h[addr+12:], uint32(len(s)))
+	copy(h[addr+16:], s)
+	return str
+}
+
+func (h fakeHeap) twoByteString(addr uint64, s string) uint64 {
+	str := h.object(addr, testSeqTwoByteStringType)
+	chars := []rune(s)
+	binary.LittleEndian.PutUint32(h[addr+12:], uint32(len(chars)))
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(h[addr+16+uint64(i)*2:], uint16(c))
+	}
+	return str
+}
+
+func TestV8SymbolizerFrames(t *testing.T) {
+	heap := make(fakeHeap, 0x10000)
+
+	first := heap.oneByteString(0x4100, "/app/")
+	second := heap.oneByteString(0x4200, "index.js")
+	path := heap.object(0x4000, testConsOneByteStringType)
+	heap.field(path, 16, first)
+	heap.field(path, 24, second)
+	script := heap.object(0x3000, 0x90)
+	heap.field(script, 8, path)
+
+	// A function whose name is stored in the SharedFunctionInfo.
+	foo := heap.object(0x1000, testSharedFunctionInfoType)
+	heap.field(foo, 8, heap.oneByteString(0x2000, "foo"))
+	heap.field(foo, 16, script)
+
+	// One whose name is stored in the ScopeInfo, after a context local.
+	scopeInfo := heap.object(0x5000, testScopeInfoType)
+	heap.field(scopeInfo, 8+2*8, 1<<32)
+	heap.field(scopeInfo, 8+5*8, 0)
+	heap.field(scopeInfo, 8+6*8, heap.twoByteString(0x6000, "bär"))
+	bar := heap.object(0x1100, testSharedFunctionInfoType)
+	heap.field(bar, 8, scopeInfo)
+	heap.field(bar, 16, script)
+
+	s := &V8Symbolizer{
+		c:     testV8Constants,
+		mem:   bytes.NewReader(heap),
+		cache: map[uint64]*profile.Function{},
+	}
+
+	frames := s.Frames([]uint64{
+		foo, 0x100,
+		// Not a SharedFunctionInfo, e.g. moved by the garbage collector.
+		0x7001, 0x200,
+		bar, 0x300,
+	})
+	require.Equal(t, []profile.InterpreterFrame{
+		{Line: profile.Line{Function: profile.Function{Name: "foo", Filename: "/app/index.js"}}, Address: 0x100},
+		{Line: profile.Line{Function: profile.Function{Name: "bär", Filename: "/app/index.js"}}, Address: 0x300},
+	}, frames)
+}
+
+func TestInterleaveByAddress(t *testing.T) {
+	info := &Info{Type: TypeV8}
+	sample := &profile.RawSample{
+		UserStack: []uint64{0x100, 0x200, 0x300, 0x400},
+		InterpreterStack: []profile.InterpreterFrame{
+			// Leaf frame, whose program counter isn't known.
+			{},
+			{Address: 0x200},
+			{Address: 0x400},
+			// Not in the native stack.
+			{Address: 0x500},
+		},
+	}
+
+	info.Interleave(sample)
+
+	indexes := make([]int, 0, len(sample.InterpreterStack))
+	for _, f := range sample.InterpreterStack {
+		indexes = append(indexes, f.NativeIndex)
+	}
+	require.Equal(t, []int{1, 1, 3, 4}, indexes)
+}
+
+func TestIsV8Binary(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/usr/local/bin/node":          true,
+		"/usr/bin/nodejs":              true,
+		"/usr/bin/node18":              true,
+		"/usr/lib/libnode.so.108":      true,
+		"/usr/lib/libc.so.6":           false,
+		"/usr/local/bin/node-exporter": false,
+	} {
+		require.Equal(t, expected, isV8Binary(path), path)
+	}
+}
@@ -54,6 +54,11 @@ type JITHeader struct {
 // JITHeaderVersion is the supported version of the JITDUMP specification.
 const JITHeaderVersion = 1
 
+// JITDumpFlagArchTimestamp is the flag of the header set when the timestamps
+// of the records are read from an architecture specific counter, such as the
+// TSC, rather than CLOCK_MONOTONIC.
+const JITDumpFlagArchTimestamp uint64 = 1 << 0
+
 // JITRecordType is the value identifying the record type.
 type JITRecordType uint32
 
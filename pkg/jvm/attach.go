@@ -0,0 +1,249 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jvm talks to running HotSpot JVMs through the dynamic attach
+// mechanism, the same one used by jcmd and jattach.
+package jvm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
+	"github.com/parca-dev/parca-agent/pkg/hsperfdata"
+)
+
+const (
+	attachProtocolVersion = "1"
+	// The attach listener always expects three arguments.
+	attachArgs = 3
+
+	attachPollInterval = 20 * time.Millisecond
+)
+
+var (
+	ErrAttachTimeout = errors.New("timed out waiting for the JVM attach listener")
+	// ErrAttachDisabled is returned for JVMs that can't be asked to start
+	// their attach listener, either because they opted out or because they
+	// don't handle SIGQUIT, which would then terminate them.
+	ErrAttachDisabled = errors.New("attach mechanism disabled in the JVM")
+	// ErrNotInitialized is returned for JVMs that are still starting up and
+	// might not have installed their signal handlers yet.
+	ErrNotInitialized = errors.New("JVM not initialized yet")
+)
+
+// Attacher executes commands in JVMs of other processes, which might live
+// in different mount and PID namespaces.
+type Attacher struct {
+	// Timeout for the attach listener of the JVM to start.
+	timeout time.Duration
+	// findNSPIDs returns the PIDs of a process in all the namespaces it
+	// belongs to, the innermost last.
+	findNSPIDs func(pid int) ([]int, error)
+}
+
+func NewAttacher(timeout time.Duration, findNSPIDs func(pid int) ([]int, error)) *Attacher {
+	return &Attacher{
+		timeout:    timeout,
+		findNSPIDs: findNSPIDs,
+	}
+}
+
+// Execute runs an attach command, such as "jcmd" or "load", in the JVM of
+// the given process and returns its output.
+func (a *Attacher) Execute(ctx context.Context, pid int, cmd string, args ...string) (string, error) {
+	nsPIDs, err := a.findNSPIDs(pid)
+	if err != nil {
+		return "", fmt.Errorf("failed to find namespaced PID: %w", err)
+	}
+	nsPID := nsPIDs[len(nsPIDs)-1]
+
+	// The JVM creates its socket in its own temporary directory.
+	tmp := filepath.Join("/proc", strconv.Itoa(pid), "root", "tmp")
+	socketPath := filepath.Join(tmp, fmt.Sprintf(".java_pid%d", nsPID))
+
+	if _, err := os.Stat(socketPath); err != nil {
+		if err := a.startAttachListener(ctx, pid, nsPID, tmp, socketPath); err != nil {
+			return "", err
+		}
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to the JVM: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return "", fmt.Errorf("failed to set deadline: %w", err)
+		}
+	}
+
+	return execute(conn, cmd, args...)
+}
+
+// startAttachListener asks the JVM to start its attach listener, by creating
+// the attach file and sending it SIGQUIT, and waits for its socket.
+func (a *Attacher) startAttachListener(ctx context.Context, pid, nsPID int, tmp, socketPath string) error {
+	// Check it's safe to send SIGQUIT before doing anything.
+	perfData, err := readPerfData(tmp, nsPID)
+	if err != nil {
+		return err
+	}
+	if err := checkAttachable(perfData); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf(".attach_pid%d", nsPID)
+	attachFile := filepath.Join("/proc", strconv.Itoa(pid), "cwd", name)
+	f, err := os.Create(attachFile)
+	if err != nil {
+		// The working directory might not be writable.
+		attachFile = filepath.Join(tmp, name)
+		f, err = os.Create(attachFile)
+		if err != nil {
+			return fmt.Errorf("failed to create attach file: %w", err)
+		}
+	}
+	f.Close()
+	defer os.Remove(attachFile)
+
+	// Older JVMs ignore attach files that aren't owned by their user.
+	if info, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err == nil {
+		if uid, gid, ok := fileinfo.Owner(info); ok {
+			_ = os.Chown(attachFile, uid, gid)
+		}
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGQUIT); err != nil {
+		return fmt.Errorf("failed to signal the JVM: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(attachPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ErrAttachTimeout
+		case <-ticker.C:
+		}
+	}
+}
+
+// readPerfData reads the hsperfdata file of the JVM, which lives in the
+// temporary directory of its mount namespace.
+func readPerfData(tmp string, nsPID int) (*hsperfdata.PerfData, error) {
+	paths, err := filepath.Glob(filepath.Join(tmp, "hsperfdata_*", strconv.Itoa(nsPID)))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no hsperfdata file found for PID %d", nsPID)
+	}
+	perfData, err := hsperfdata.ReadPerfData(paths[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hsperfdata: %w", err)
+	}
+	return perfData, nil
+}
+
+// checkAttachable returns an error unless the JVM is fully initialized and
+// starts its attach listener on SIGQUIT. With -Xrs the JVM doesn't install
+// its signal handlers, so SIGQUIT would dump its core and terminate it.
+func checkAttachable(perfData *hsperfdata.PerfData) error {
+	if !perfData.Accessible || perfData.Longs["sun.rt.vmInitDoneTime"] == 0 {
+		return ErrNotInitialized
+	}
+
+	args, ok := perfData.Strings["java.rt.vmArgs"]
+	if !ok {
+		// The name used by older JVMs.
+		args = perfData.Strings["sun.rt.jvmArgs"]
+	}
+	disabled := false
+	for _, arg := range strings.Fields(args) {
+		switch arg {
+		case "-Xrs":
+			return ErrAttachDisabled
+		case "-XX:+DisableAttachMechanism":
+			disabled = true
+		case "-XX:-DisableAttachMechanism":
+			disabled = false
+		}
+	}
+	if disabled {
+		return ErrAttachDisabled
+	}
+	return nil
+}
+
+// execute sends a command through the attach protocol, which is made of the
+// protocol version, the command and its arguments, each of them null
+// terminated. The response starts with the return code in its own line.
+func execute(conn io.ReadWriter, cmd string, args ...string) (string, error) {
+	if len(args) > attachArgs {
+		return "", fmt.Errorf("too many arguments: %d", len(args))
+	}
+
+	var req bytes.Buffer
+	req.WriteString(attachProtocolVersion)
+	req.WriteByte(0)
+	req.WriteString(cmd)
+	req.WriteByte(0)
+	for i := 0; i < attachArgs; i++ {
+		if i < len(args) {
+			req.WriteString(args[i])
+		}
+		req.WriteByte(0)
+	}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return "", fmt.Errorf("failed to send command: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	codeLine, err := r.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(codeLine))
+	if err != nil {
+		return "", fmt.Errorf("unexpected response %q", codeLine)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if code != 0 {
+		return string(out), fmt.Errorf("command %q failed with code %d: %s", cmd, code, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jvm
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/hsperfdata"
+)
+
+// fakeJVM reads a request of the given size and replies with response.
+func fakeJVM(t *testing.T, conn net.Conn, size int, response string) <-chan []byte {
+	t.Helper()
+
+	req := make(chan []byte, 1)
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			close(req)
+			return
+		}
+		req <- buf
+		_, _ = conn.Write([]byte(response))
+	}()
+	return req
+}
+
+func TestExecute(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	expected := "1\x00jcmd\x00Compiler.perfmap\x00\x00\x00"
+	req := fakeJVM(t, server, len(expected), "0\nperf map written\n")
+
+	out, err := execute(client, "jcmd", "Compiler.perfmap")
+	require.NoError(t, err)
+	require.Equal(t, "perf map written\n", out)
+	require.Equal(t, expected, string(<-req))
+}
+
+func TestExecuteFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	expected := "1\x00jcmd\x00Compiler.perfmap\x00\x00\x00"
+	fakeJVM(t, server, len(expected), "1\nUnknown diagnostic command\n")
+
+	_, err := execute(client, "jcmd", "Compiler.perfmap")
+	require.ErrorContains(t, err, "Unknown diagnostic command")
+}
+
+func TestExecuteTooManyArguments(t *testing.T) {
+	_, err := execute(nil, "load", "a", "b", "c", "d")
+	require.Error(t, err)
+}
+
+func TestCheckAttachable(t *testing.T) {
+	initialized := map[string]int64{"sun.rt.vmInitDoneTime": 1}
+
+	for _, tc := range []struct {
+		name     string
+		perfData hsperfdata.PerfData
+		err      error
+	}{
+		{
+			name:     "attachable",
+			perfData: hsperfdata.PerfData{Accessible: true, Longs: initialized, Strings: map[string]string{"java.rt.vmArgs": "-Xmx1g"}},
+		},
+		{
+			name:     "not initialized",
+			perfData: hsperfdata.PerfData{Accessible: true, Strings: map[string]string{"java.rt.vmArgs": "-Xmx1g"}},
+			err:      ErrNotInitialized,
+		},
+		{
+			name:     "not accessible",
+			perfData: hsperfdata.PerfData{Longs: initialized},
+			err:      ErrNotInitialized,
+		},
+		{
+			name:     "reduced signals",
+			perfData: hsperfdata.PerfData{Accessible: true, Longs: initialized, Strings: map[string]string{"java.rt.vmArgs": "-Xmx1g -Xrs"}},
+			err:      ErrAttachDisabled,
+		},
+		{
+			name:     "attach disabled",
+			perfData: hsperfdata.PerfData{Accessible: true, Longs: initialized, Strings: map[string]string{"sun.rt.jvmArgs": "-XX:+DisableAttachMechanism"}},
+			err:      ErrAttachDisabled,
+		},
+		{
+			name:     "attach enabled again",
+			perfData: hsperfdata.PerfData{Accessible: true, Longs: initialized, Strings: map[string]string{"java.rt.vmArgs": "-XX:+DisableAttachMechanism -XX:-DisableAttachMechanism"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkAttachable(&tc.perfData)
+			if tc.err == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+}
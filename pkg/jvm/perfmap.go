@@ -0,0 +1,189 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jvm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+const (
+	lvSuccess = "success"
+	lvError   = "error"
+
+	perfMapCommand = "Compiler.perfmap"
+)
+
+// PerfMapper makes the JVMs running on the host write the perf maps of their
+// JIT compiled code, so Java frames can be symbolized without running
+// perf-map-agent by hand.
+//
+// By default the "Compiler.perfmap" diagnostic command, available since JDK
+// 17, is run again in every JVM once per refresh interval, as it only dumps
+// the code compiled so far. When an
+// agent is configured, such as perf-map-agent or a jitdump emitting JVMTI
+// agent, it is loaded once in every JVM instead, as these keep the maps up
+// to date.
+//
+// Frame pointers can't be enabled at runtime, so JVMs still need to be
+// started with -XX:+PreserveFramePointer to get complete stacks.
+type PerfMapper struct {
+	logger   log.Logger
+	attaches *prometheus.CounterVec
+
+	attacher      *Attacher
+	isJavaProcess func(pid int) (bool, error)
+	procs         func() (procfs.Procs, error)
+
+	interval        time.Duration
+	refreshInterval time.Duration
+	agentPath       string
+	agentOptions    string
+
+	// PIDs that have the agent loaded, or where attaching failed or isn't
+	// allowed. Either way they are not attached to again.
+	done map[int]struct{}
+	// When the perf map of each JVM was last written by Compiler.perfmap.
+	written map[int]time.Time
+}
+
+func NewPerfMapper(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	attacher *Attacher,
+	isJavaProcess func(pid int) (bool, error),
+	fs procfs.FS,
+	interval time.Duration,
+	refreshInterval time.Duration,
+	agentPath string,
+	agentOptions string,
+) *PerfMapper {
+	attaches := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "parca_agent_jvm_perf_map_attaches_total",
+		Help: "Total number of attempts to make a JVM write its perf map.",
+	}, []string{"result"})
+	attaches.WithLabelValues(lvSuccess)
+	attaches.WithLabelValues(lvError)
+
+	return &PerfMapper{
+		logger:   logger,
+		attaches: attaches,
+
+		attacher:      attacher,
+		isJavaProcess: isJavaProcess,
+		procs:         fs.AllProcs,
+
+		interval:        interval,
+		refreshInterval: refreshInterval,
+		agentPath:       agentPath,
+		agentOptions:    agentOptions,
+
+		done:    map[int]struct{}{},
+		written: map[int]time.Time{},
+	}
+}
+
+func (m *PerfMapper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *PerfMapper) refresh(ctx context.Context) {
+	procs, err := m.procs()
+	if err != nil {
+		level.Warn(m.logger).Log("msg", "failed to list processes", "err", err)
+		return
+	}
+
+	self := os.Getpid()
+	now := time.Now()
+	alive := make(map[int]struct{}, len(procs))
+	for _, proc := range procs {
+		pid := proc.PID
+		alive[pid] = struct{}{}
+		if pid == self {
+			continue
+		}
+		if _, ok := m.done[pid]; ok {
+			continue
+		}
+		if last, ok := m.written[pid]; ok && now.Sub(last) < m.refreshInterval {
+			continue
+		}
+
+		java, err := m.isJavaProcess(pid)
+		if err != nil || !java {
+			continue
+		}
+
+		if err := m.attach(ctx, pid); err != nil {
+			if errors.Is(err, ErrNotInitialized) {
+				// Try again once it finished starting up.
+				continue
+			}
+			m.attaches.WithLabelValues(lvError).Inc()
+			level.Debug(m.logger).Log("msg", "failed to make the JVM write its perf map", "pid", pid, "err", err)
+			m.done[pid] = struct{}{}
+			continue
+		}
+		m.attaches.WithLabelValues(lvSuccess).Inc()
+		if m.agentPath != "" {
+			m.done[pid] = struct{}{}
+		} else {
+			m.written[pid] = now
+		}
+	}
+
+	for pid := range m.done {
+		if _, ok := alive[pid]; !ok {
+			delete(m.done, pid)
+		}
+	}
+	for pid := range m.written {
+		if _, ok := alive[pid]; !ok {
+			delete(m.written, pid)
+		}
+	}
+}
+
+func (m *PerfMapper) attach(ctx context.Context, pid int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	if m.agentPath != "" {
+		_, err := m.attacher.Execute(ctx, pid, "load", m.agentPath, "true", m.agentOptions)
+		return err
+	}
+	_, err := m.attacher.Execute(ctx, pid, "jcmd", perfMapCommand)
+	return err
+}
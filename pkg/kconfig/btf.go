@@ -0,0 +1,104 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBTFNotFound is returned when the types of the running kernel, which the
+// BPF programs are relocated against when loaded, can't be found.
+var ErrBTFNotFound = errors.New("BTF of the running kernel not found")
+
+// vmlinuxBTFPath is where kernels built with CONFIG_DEBUG_INFO_BTF expose
+// their types.
+const vmlinuxBTFPath = "/sys/kernel/btf/vmlinux"
+
+// libbpfVmlinuxPaths are the vmlinux images with BTF that libbpf falls back
+// to by itself, formatted with the kernel release.
+var libbpfVmlinuxPaths = []string{
+	"/boot/vmlinux-%[1]s",
+	"/lib/modules/%[1]s/vmlinux-%[1]s",
+	"/lib/modules/%[1]s/build/vmlinux",
+	"/usr/lib/modules/%[1]s/kernel/vmlinux",
+	"/usr/lib/debug/boot/vmlinux-%[1]s",
+	"/usr/lib/debug/boot/vmlinux-%[1]s.debug",
+	"/usr/lib/debug/lib/modules/%[1]s/vmlinux",
+}
+
+// BTF tells where the types of the running kernel are read from.
+type BTF struct {
+	// Path is the BTF file to load the BPF programs with, empty when libbpf
+	// finds the types by itself.
+	Path string
+	// Source is the file the types are read from.
+	Source string
+}
+
+// FindBTF returns where the types of the running kernel are read from. When
+// the kernel doesn't expose them, they are read from the given path, either a
+// BTF file or a directory of <kernel release>.btf files such as the ones of
+// BTFHub, or else from a vmlinux image installed on the host.
+func FindBTF(path string) (BTF, error) {
+	release, err := unameRelease()
+	if err != nil {
+		return BTF{}, err
+	}
+	return findBTF("", release, path)
+}
+
+// findBTF looks for the types of the given kernel release under the given
+// root directory.
+func findBTF(root, release, path string) (BTF, error) {
+	if exists(filepath.Join(root, vmlinuxBTFPath)) {
+		return BTF{Source: vmlinuxBTFPath}, nil
+	}
+
+	tried := []string{vmlinuxBTFPath}
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return BTF{}, fmt.Errorf("failed to read BTF path: %w", err)
+		}
+		if info.IsDir() {
+			path = filepath.Join(path, release+".btf")
+		}
+		if exists(path) {
+			return BTF{Path: path, Source: path}, nil
+		}
+		tried = append(tried, path)
+	}
+
+	for _, format := range libbpfVmlinuxPaths {
+		p := fmt.Sprintf(format, release)
+		if exists(filepath.Join(root, p)) {
+			return BTF{Source: p}, nil
+		}
+		tried = append(tried, p)
+	}
+
+	return BTF{}, fmt.Errorf(
+		"%w: kernel %s is built without CONFIG_DEBUG_INFO_BTF and none of %s exist",
+		ErrBTFNotFound, release, strings.Join(tried, ", "),
+	)
+}
+
+func exists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
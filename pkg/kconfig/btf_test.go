@@ -0,0 +1,84 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindBTF(t *testing.T) {
+	const release = "4.18.0-425.3.1.el8.x86_64"
+
+	create := func(t *testing.T, path string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, nil, 0o644))
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := findBTF(t.TempDir(), release, "")
+		require.ErrorIs(t, err, ErrBTFNotFound)
+		require.ErrorContains(t, err, "/boot/vmlinux-"+release)
+	})
+
+	t.Run("exposed by the kernel", func(t *testing.T) {
+		root := t.TempDir()
+		create(t, filepath.Join(root, vmlinuxBTFPath))
+
+		btf, err := findBTF(root, release, filepath.Join(root, "btfhub"))
+		require.NoError(t, err)
+		require.Equal(t, BTF{Source: vmlinuxBTFPath}, btf)
+	})
+
+	t.Run("directory of releases", func(t *testing.T) {
+		root := t.TempDir()
+		dir := filepath.Join(root, "btfhub")
+		create(t, filepath.Join(dir, release+".btf"))
+
+		btf, err := findBTF(root, release, dir)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, release+".btf"), btf.Path)
+
+		_, err = findBTF(root, "5.4.0-1.el8.x86_64", dir)
+		require.ErrorIs(t, err, ErrBTFNotFound)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		root := t.TempDir()
+		file := filepath.Join(root, "vmlinux.btf")
+		create(t, file)
+
+		btf, err := findBTF(root, release, file)
+		require.NoError(t, err)
+		require.Equal(t, BTF{Path: file, Source: file}, btf)
+	})
+
+	t.Run("vmlinux image", func(t *testing.T) {
+		root := t.TempDir()
+		create(t, filepath.Join(root, "/usr/lib/debug/boot/vmlinux-"+release))
+
+		btf, err := findBTF(root, release, "")
+		require.NoError(t, err)
+		require.Equal(t, BTF{Source: "/usr/lib/debug/boot/vmlinux-" + release}, btf)
+	})
+
+	t.Run("missing path", func(t *testing.T) {
+		_, err := findBTF(t.TempDir(), release, "/nonexistent")
+		require.ErrorContains(t, err, "failed to read BTF path")
+	})
+}
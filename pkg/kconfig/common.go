@@ -19,27 +19,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
-	"syscall"
 )
 
-// unameRelease fetches the version string of the current running kernel.
-func unameRelease() (string, error) {
-	var uname syscall.Utsname
-	if err := syscall.Uname(&uname); err != nil {
-		return "", fmt.Errorf("could not get utsname")
-	}
-
-	var buf [65]byte
-	for i, b := range uname.Release {
-		buf[i] = byte(b)
-	}
-
-	ver := string(buf[:])
-	ver = strings.Trim(ver, "\x00")
-
-	return ver, nil
-}
-
 func parse(s *bufio.Scanner, p map[string]string) error {
 	r := regexp.MustCompile("^(?:# *)?(CONFIG_\\w*)(?:=| )(y|n|m|is not set|\\d+|0x.+|\".*\")$")
 
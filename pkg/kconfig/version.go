@@ -0,0 +1,68 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kconfig
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of a kernel, without the suffixes of its release.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// KernelVersion returns the version of the running kernel.
+func KernelVersion() (Version, error) {
+	release, err := unameRelease()
+	if err != nil {
+		return Version{}, err
+	}
+	return ParseRelease(release)
+}
+
+// ParseRelease parses the version of a kernel release such as
+// 5.15.0-91-generic, the patch version is optional.
+func ParseRelease(release string) (Version, error) {
+	// Drop the suffixes of distributions and local versions.
+	v := release
+	if i := strings.IndexAny(v, "-+_ "); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) < 2 {
+		return Version{}, fmt.Errorf("invalid kernel release %q", release)
+	}
+	var (
+		nums [3]int
+		err  error
+	)
+	for i, part := range parts {
+		if nums[i], err = strconv.Atoi(part); err != nil {
+			return Version{}, fmt.Errorf("invalid kernel release %q", release)
+		}
+	}
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+// AtLeast returns whether the version is the given one or a later one.
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRelease(t *testing.T) {
+	for release, want := range map[string]Version{
+		"5.15.0-91-generic":         {5, 15, 0},
+		"4.18.0-425.3.1.el8.x86_64": {4, 18, 0},
+		"6.1.55+":                   {6, 1, 55},
+		"6.6":                       {6, 6, 0},
+		"5.10.197_1":                {5, 10, 197},
+	} {
+		v, err := ParseRelease(release)
+		require.NoError(t, err, release)
+		require.Equal(t, want, v, release)
+	}
+
+	for _, release := range []string{"", "6", "linux-6.1", "6.x.1"} {
+		_, err := ParseRelease(release)
+		require.Error(t, err, release)
+	}
+
+	v := Version{Major: 5, Minor: 8}
+	require.True(t, v.AtLeast(4, 18))
+	require.True(t, v.AtLeast(5, 8))
+	require.False(t, v.AtLeast(5, 11))
+	require.Equal(t, "5.8.0", v.String())
+}
@@ -29,8 +29,13 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/parca-dev/parca-agent/pkg/hash"
+	"github.com/parca-dev/parca-agent/pkg/logger"
 )
 
+// Interval in which the lines of kallsyms that can't be parsed are logged at
+// most once, as the whole file is read on every reload.
+const errorLogInterval = time.Minute
+
 type Ksym struct {
 	logger                log.Logger
 	tempDir               string
@@ -40,6 +45,8 @@ type Ksym struct {
 	updateDuration        time.Duration
 	mtx                   *sync.RWMutex
 	optimizedReader       *fileReader
+	errorLogs             *logger.Deduplicator
+	restore               sync.Once
 }
 
 type realfs struct{}
@@ -57,10 +64,31 @@ func NewKsym(logger log.Logger, reg prometheus.Registerer, tempDir string, f ...
 		fs:             fs,
 		updateDuration: time.Minute * 5,
 		mtx:            &sync.RWMutex{},
+		errorLogs:      newErrorLogs(reg),
 	}
 }
 
+func newErrorLogs(reg prometheus.Registerer) *logger.Deduplicator {
+	return logger.NewDeduplicator(reg, "ksym", errorLogInterval)
+}
+
 func (c *Ksym) Resolve(addrs map[uint64]struct{}) (map[uint64]string, error) {
+	c.restore.Do(func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		if err := c.restoreSnapshot(); err != nil {
+			level.Debug(c.logger).Log("msg", "failed to restore kernel symbols snapshot", "err", err)
+			return
+		}
+		if c.optimizedReader != nil {
+			// The staleness interval starts now, as if kallsyms had just
+			// been read.
+			c.lastCacheInvalidation = time.Now()
+			level.Debug(c.logger).Log("msg", "restored kernel symbols snapshot")
+		}
+	})
+
 	c.mtx.RLock()
 	lastCacheInvalidation := c.lastCacheInvalidation
 	lastHash := c.lastHash
@@ -121,7 +149,7 @@ func unsafeString(b []byte) string {
 }
 
 func (c *Ksym) reload() error {
-	path := path.Join(c.tempDir, "parca-agent-kernel-symbols")
+	path := path.Join(c.tempDir, optimizedFileName)
 
 	// Generate optimized file.
 	writer, err := NewWriter(path, 100)
@@ -149,6 +177,10 @@ func (c *Ksym) reload() error {
 		return fmt.Errorf("newReader: %w", err)
 	}
 	c.optimizedReader = reader
+
+	if err := c.saveSnapshot(c.lastHash); err != nil {
+		level.Debug(c.logger).Log("msg", "failed to save kernel symbols snapshot", "err", err)
+	}
 	return nil
 }
 
@@ -168,7 +200,9 @@ func (c *Ksym) loadKsyms(callback func(uint64, string)) error {
 
 		address, err := strconv.ParseUint(unsafeString(line[:16]), 16, 64)
 		if err != nil {
-			level.Debug(c.logger).Log("msg", "failed to parse kallsym address")
+			if ok, suppressed := c.errorLogs.Allow("parse_address"); ok {
+				level.Debug(c.logger).Log("msg", "failed to parse kallsym address", "err", err, "suppressed", suppressed)
+			}
 			continue
 		}
 
@@ -16,6 +16,8 @@ package ksym
 import (
 	"bytes"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/go-kit/log"
@@ -239,6 +241,47 @@ ffffffff8f6d15c4 a not_in_order
 	}, syms)
 }
 
+func TestKsymSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	files := func(bootID, kallsyms string) map[string][]byte {
+		return map[string][]byte{
+			"/proc/sys/kernel/random/boot_id": []byte(bootID + "\n"),
+			"/proc/modules":                   []byte("nf_tables 274432 0 - Live 0x0000000000000000\n"),
+			"/proc/kallsyms":                  []byte(kallsyms),
+		}
+	}
+	addr := uint64(0xffffffff8f6d1600)
+
+	c := NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), dir,
+		testutil.NewFakeFS(files("boot-1", "ffffffff8f6d1600 T xfrm_state_afinfo\n")))
+	syms, err := c.Resolve(map[uint64]struct{}{addr: {}})
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]string{addr: "xfrm_state_afinfo"}, syms)
+
+	// Restarting on the same boot serves the symbols from the snapshot
+	// without reading kallsyms.
+	c = NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), dir,
+		testutil.NewFakeFS(files("boot-1", "ffffffff8f6d1600 T from_kallsyms\n")))
+	syms, err = c.Resolve(map[uint64]struct{}{addr: {}})
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]string{addr: "xfrm_state_afinfo"}, syms)
+
+	// A corrupted snapshot is ignored.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, optimizedFileName), []byte("garbage"), 0o600))
+	c = NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), dir,
+		testutil.NewFakeFS(files("boot-1", "ffffffff8f6d1600 T from_kallsyms\n")))
+	syms, err = c.Resolve(map[uint64]struct{}{addr: {}})
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]string{addr: "from_kallsyms"}, syms)
+
+	// A different boot re-reads kallsyms.
+	c = NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), dir,
+		testutil.NewFakeFS(files("boot-2", "ffffffff8f6d1600 T after_reboot\n")))
+	syms, err = c.Resolve(map[uint64]struct{}{addr: {}})
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]string{addr: "after_reboot"}, syms)
+}
+
 var errLoadKsyms error
 
 func BenchmarkLoadKernelSymbols(b *testing.B) {
@@ -0,0 +1,157 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ksym
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/parca-dev/parca-agent/pkg/hash"
+)
+
+const (
+	optimizedFileName = "parca-agent-kernel-symbols"
+	snapshotFileName  = optimizedFileName + ".meta"
+)
+
+// snapshot describes the optimized kernel symbols file left on disk by a
+// previous run, so that a restart on the same boot can reuse it instead of
+// re-reading and re-parsing /proc/kallsyms.
+type snapshot struct {
+	BootID string `json:"boot_id"`
+	// ModulesHash is a cheap stand-in for the kallsyms hash: the kernel
+	// symbols only change within a boot when modules are (un)loaded.
+	ModulesHash  uint64 `json:"modules_hash"`
+	KallsymsHash uint64 `json:"kallsyms_hash"`
+	// FileHash guards against a truncated or half-written optimized file.
+	FileHash uint64 `json:"file_hash"`
+}
+
+// currentSnapshot returns the snapshot identity of the running kernel.
+func (c *Ksym) currentSnapshot() (snapshot, error) {
+	bootID, err := readFile(c.fs, "/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return snapshot{}, fmt.Errorf("read boot id: %w", err)
+	}
+	bootID = bytes.TrimSpace(bootID)
+	if len(bootID) == 0 {
+		return snapshot{}, errors.New("empty boot id")
+	}
+
+	modulesHash, err := hash.File(c.fs, "/proc/modules")
+	if err != nil {
+		return snapshot{}, fmt.Errorf("hash modules: %w", err)
+	}
+
+	return snapshot{BootID: string(bootID), ModulesHash: modulesHash}, nil
+}
+
+// restoreSnapshot loads the optimized file written by a previous run if it
+// was written on the same boot with the same modules loaded.
+func (c *Ksym) restoreSnapshot() error {
+	current, err := c.currentSnapshot()
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(path.Join(c.tempDir, snapshotFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	if s.BootID != current.BootID || s.ModulesHash != current.ModulesHash {
+		return nil
+	}
+
+	p := path.Join(c.tempDir, optimizedFileName)
+	fileHash, err := hashFile(p)
+	if err != nil {
+		return fmt.Errorf("hash optimized file: %w", err)
+	}
+	if fileHash != s.FileHash {
+		return errors.New("optimized file does not match snapshot checksum")
+	}
+
+	reader, err := NewReader(p)
+	if err != nil {
+		return fmt.Errorf("newReader: %w", err)
+	}
+
+	c.optimizedReader = reader
+	c.lastHash = s.KallsymsHash
+	return nil
+}
+
+// saveSnapshot records the optimized file that was just written so that it
+// can be restored after a restart.
+func (c *Ksym) saveSnapshot(kallsymsHash uint64) error {
+	s, err := c.currentSnapshot()
+	if err != nil {
+		return err
+	}
+	s.KallsymsHash = kallsymsHash
+
+	s.FileHash, err = hashFile(path.Join(c.tempDir, optimizedFileName))
+	if err != nil {
+		return fmt.Errorf("hash optimized file: %w", err)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	// Write to a temporary file first so a crash can't leave a partial
+	// snapshot behind.
+	p := path.Join(c.tempDir, snapshotFileName)
+	if err := os.WriteFile(p+".tmp", b, 0o600); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	return nil
+}
+
+func hashFile(p string) (uint64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return hash.Reader(f)
+}
+
+func readFile(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
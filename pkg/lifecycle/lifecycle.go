@@ -0,0 +1,208 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lifecycle records the events in the profiling of each process, from
+// its discovery to the upload of its profiles, so what happened to a process
+// can be looked up without going through the debug logs of every subsystem.
+package lifecycle
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of a lifecycle event.
+type Kind string
+
+const (
+	// Discovered is recorded once the information of a process is fetched.
+	Discovered Kind = "discovered"
+	// UnwindTableBuilt is recorded once the unwind tables of the executables
+	// of a process are added to the BPF maps.
+	UnwindTableBuilt Kind = "unwind_table_built"
+	// FirstSample is recorded once for the first samples of a process.
+	FirstSample Kind = "first_sample"
+	// ConversionError is recorded when the samples of a process can't be
+	// converted to a profile.
+	ConversionError Kind = "conversion_error"
+	// ProfileWritten is recorded once for the first profile of a process
+	// written.
+	ProfileWritten Kind = "profile_written"
+	// ProfileWriteError is recorded when a profile of a process can't be
+	// written.
+	ProfileWriteError Kind = "profile_write_error"
+	// DebuginfoUpload is recorded with the result of the upload of the debug
+	// information of an executable of a process.
+	DebuginfoUpload Kind = "debuginfo_upload"
+)
+
+// Event is something that happened in the profiling of a process.
+type Event struct {
+	Time   time.Time `json:"time"`
+	PID    int       `json:"pid"`
+	Kind   Kind      `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s pid=%d kind=%s", e.Time.UTC().Format(time.RFC3339Nano), e.PID, e.Kind)
+	if e.Detail != "" {
+		s += fmt.Sprintf(" detail=%q", e.Detail)
+	}
+	if e.Error != "" {
+		s += fmt.Sprintf(" error=%q", e.Error)
+	}
+	return s
+}
+
+// process holds the most recent events of a process in a ring buffer.
+type process struct {
+	events []Event
+	// start is the index of the oldest event once the buffer is full.
+	start int
+	last  time.Time
+}
+
+func (p *process) add(e Event, size int) {
+	p.last = e.Time
+	if len(p.events) < size {
+		p.events = append(p.events, e)
+		return
+	}
+	p.events[p.start] = e
+	p.start = (p.start + 1) % size
+}
+
+func (p *process) ordered() []Event {
+	events := make([]Event, 0, len(p.events))
+	events = append(events, p.events[p.start:]...)
+	return append(events, p.events[:p.start]...)
+}
+
+// EventLog keeps the most recent lifecycle events of the most recently
+// active processes in memory. A nil EventLog records nothing.
+type EventLog struct {
+	mtx       sync.Mutex
+	processes map[int]*process
+
+	eventsPerProcess int
+	maxProcesses     int
+}
+
+// NewEventLog returns a log of the given number of events per process, for
+// up to the given number of processes. The events of the process that has
+// been inactive for the longest are dropped to make room for new ones.
+func NewEventLog(eventsPerProcess, maxProcesses int) *EventLog {
+	return &EventLog{
+		processes:        map[int]*process{},
+		eventsPerProcess: eventsPerProcess,
+		maxProcesses:     maxProcesses,
+	}
+}
+
+// Record records an event of the given process. The error is optional.
+func (l *EventLog) Record(pid int, kind Kind, detail string, err error) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.record(pid, kind, detail, err)
+}
+
+// RecordOnce records an event of the given process, unless the log already
+// holds one of the same kind for it.
+func (l *EventLog) RecordOnce(pid int, kind Kind, detail string) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if p, ok := l.processes[pid]; ok {
+		for _, e := range p.events {
+			if e.Kind == kind {
+				return
+			}
+		}
+	}
+	l.record(pid, kind, detail, nil)
+}
+
+func (l *EventLog) record(pid int, kind Kind, detail string, err error) {
+	e := Event{Time: time.Now(), PID: pid, Kind: kind, Detail: detail}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	p, ok := l.processes[pid]
+	if !ok {
+		if len(l.processes) >= l.maxProcesses {
+			l.evictLeastRecent()
+		}
+		p = &process{}
+		l.processes[pid] = p
+	}
+	p.add(e, l.eventsPerProcess)
+}
+
+func (l *EventLog) evictLeastRecent() {
+	var (
+		oldestPID int
+		oldest    time.Time
+	)
+	for pid, p := range l.processes {
+		if oldest.IsZero() || p.last.Before(oldest) {
+			oldestPID, oldest = pid, p.last
+		}
+	}
+	delete(l.processes, oldestPID)
+}
+
+// Events returns the events of the given process, or of all of them when the
+// PID is 0, oldest first.
+func (l *EventLog) Events(pid int) []Event {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if pid != 0 {
+		if p, ok := l.processes[pid]; ok {
+			return p.ordered()
+		}
+		return []Event{}
+	}
+
+	events := []Event{}
+	for _, p := range l.processes {
+		events = append(events, p.ordered()...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// Dump writes the events of all the processes, one per line.
+func (l *EventLog) Dump(w io.Writer) error {
+	for _, e := range l.Events(0) {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lifecycle
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func kinds(events []Event) []Kind {
+	ks := make([]Kind, 0, len(events))
+	for _, e := range events {
+		ks = append(ks, e.Kind)
+	}
+	return ks
+}
+
+func TestEventLog(t *testing.T) {
+	l := NewEventLog(3, 2)
+
+	l.Record(1, Discovered, "runtime=go", nil)
+	l.RecordOnce(1, FirstSample, "")
+	l.RecordOnce(1, FirstSample, "")
+	l.Record(1, ConversionError, "", errors.New("boom"))
+	l.Record(1, ProfileWriteError, "", errors.New("unavailable"))
+
+	// The oldest event of the process was dropped.
+	require.Equal(t, []Kind{FirstSample, ConversionError, ProfileWriteError}, kinds(l.Events(1)))
+	require.Equal(t, "boom", l.Events(1)[1].Error)
+
+	l.Record(2, Discovered, "", nil)
+	l.Record(1, UnwindTableBuilt, "", nil)
+	// Process 2 is now the least recently active one.
+	l.Record(3, Discovered, "", nil)
+	require.Empty(t, l.Events(2))
+	require.Len(t, l.Events(0), 4)
+
+	var buf bytes.Buffer
+	require.NoError(t, l.Dump(&buf))
+	require.Contains(t, buf.String(), `pid=1 kind=conversion_error error="boom"`)
+
+	var nilLog *EventLog
+	nilLog.Record(1, Discovered, "", nil)
+	require.Empty(t, nilLog.Events(0))
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Deduplicator rate limits the log entries of errors that can happen for
+// every sample or line processed, such as failing to symbolize an address.
+// Only the first entry with a given key is logged in every interval, and the
+// ones suppressed are counted.
+//
+// It doesn't wrap a log.Logger, so that the caller of the entries logged is
+// still reported right:
+//
+//	if ok, suppressed := d.Allow("vdso"); ok {
+//		level.Debug(logger).Log("msg", "...", "suppressed", suppressed)
+//	}
+//
+// A nil Deduplicator allows every entry.
+type Deduplicator struct {
+	interval   time.Duration
+	suppressed *prometheus.CounterVec
+	now        func() time.Time
+
+	mtx  sync.Mutex
+	keys map[string]*dedupKey
+}
+
+type dedupKey struct {
+	lastLogged time.Time
+	// Entries suppressed since the last one logged.
+	suppressed uint64
+}
+
+// NewDeduplicator returns a deduplicator letting an entry per key through in
+// every interval. The component tells the deduplicators apart in the metrics.
+func NewDeduplicator(reg prometheus.Registerer, component string, interval time.Duration) *Deduplicator {
+	return &Deduplicator{
+		interval: interval,
+		suppressed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "parca_agent_log_entries_suppressed_total",
+			Help:        "Total number of log entries suppressed as duplicates of a recent one.",
+			ConstLabels: map[string]string{"component": component},
+		}, []string{"key"}),
+		now:  time.Now,
+		keys: map[string]*dedupKey{},
+	}
+}
+
+// Allow reports whether an entry with the given key should be logged, along
+// with the number of entries with the key suppressed since the last one that
+// was. Keys are expected to come from a small set, such as the messages or
+// the kinds of errors.
+func (d *Deduplicator) Allow(key string) (bool, uint64) {
+	if d == nil {
+		return true, 0
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := d.now()
+	k, ok := d.keys[key]
+	if !ok {
+		d.keys[key] = &dedupKey{lastLogged: now}
+		return true, 0
+	}
+	if now.Sub(k.lastLogged) < d.interval {
+		k.suppressed++
+		d.suppressed.WithLabelValues(key).Inc()
+		return false, 0
+	}
+
+	suppressed := k.suppressed
+	k.lastLogged = now
+	k.suppressed = 0
+	return true, suppressed
+}
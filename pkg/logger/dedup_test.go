@@ -0,0 +1,52 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := NewDeduplicator(prometheus.NewRegistry(), "test", time.Minute)
+	d.now = func() time.Time { return now }
+
+	ok, _ := d.Allow("vdso")
+	require.True(t, ok)
+	ok, _ = d.Allow("ksym")
+	require.True(t, ok)
+
+	for i := 0; i < 3; i++ {
+		ok, _ = d.Allow("vdso")
+		require.False(t, ok)
+	}
+	require.Equal(t, 3.0, testutil.ToFloat64(d.suppressed.WithLabelValues("vdso")))
+
+	now = now.Add(time.Minute)
+	ok, suppressed := d.Allow("vdso")
+	require.True(t, ok)
+	require.Equal(t, uint64(3), suppressed)
+
+	ok, _ = d.Allow("vdso")
+	require.False(t, ok)
+
+	var nilDedup *Deduplicator
+	ok, _ = nilDedup.Allow("vdso")
+	require.True(t, ok)
+}
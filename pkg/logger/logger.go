@@ -31,6 +31,13 @@ const (
 // if the log level is not error, warn, info or debug. Log level is expected to
 // be validated before passed to this function.
 func NewLogger(logLevel, logFormat, debugName string) log.Logger {
+	logger, _ := NewRecordingLogger(logLevel, logFormat, debugName, 0)
+	return logger
+}
+
+// NewRecordingLogger returns a log.Logger like NewLogger, along with the
+// recorder of the given number of its most recent warnings and errors.
+func NewRecordingLogger(logLevel, logFormat, debugName string, size int) (log.Logger, *Recorder) {
 	var (
 		logger log.Logger
 		lvl    level.Option
@@ -61,11 +68,12 @@ func NewLogger(logLevel, logFormat, debugName string) log.Logger {
 		logger = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
 	}
 
-	logger = level.NewFilter(logger, lvl)
+	recorder := newRecorder(logger, size)
+	logger = level.NewFilter(recorder, lvl)
 
 	if debugName != "" {
 		logger = log.With(logger, "name", debugName)
 	}
 
-	return log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+	return log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller), recorder
 }
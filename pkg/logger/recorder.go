@@ -0,0 +1,89 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Recorder is a log.Logger that keeps the most recent warnings and errors
+// logged through it in memory, in logfmt, before passing every entry on to
+// the next logger.
+type Recorder struct {
+	next log.Logger
+
+	mtx     sync.Mutex
+	entries []string
+	// start is the index of the oldest entry once the buffer is full.
+	start int
+	size  int
+}
+
+// newRecorder returns a recorder of the given number of most recent warnings
+// and errors.
+func newRecorder(next log.Logger, size int) *Recorder {
+	return &Recorder{
+		next:    next,
+		entries: make([]string, 0, size),
+		size:    size,
+	}
+}
+
+func (r *Recorder) Log(keyvals ...interface{}) error {
+	if r.size > 0 && isWarnOrError(keyvals) {
+		var buf bytes.Buffer
+		if err := log.NewLogfmtLogger(&buf).Log(keyvals...); err == nil {
+			r.record(buf.String())
+		}
+	}
+	return r.next.Log(keyvals...)
+}
+
+func (r *Recorder) record(entry string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.start] = entry
+	r.start = (r.start + 1) % r.size
+}
+
+// Entries returns the recorded warnings and errors, oldest first.
+func (r *Recorder) Entries() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	entries := make([]string, 0, len(r.entries))
+	entries = append(entries, r.entries[r.start:]...)
+	return append(entries, r.entries[:r.start]...)
+}
+
+func isWarnOrError(keyvals []interface{}) bool {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		if v, ok := keyvals[i+1].(level.Value); ok {
+			return v == level.WarnValue() || v == level.ErrorValue()
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	var out bytes.Buffer
+	r := newRecorder(log.NewLogfmtLogger(&out), 2)
+	logger := log.With(r, "component", "test")
+
+	level.Info(logger).Log("msg", "info")
+	level.Warn(logger).Log("msg", "first")
+	level.Error(logger).Log("msg", "second")
+	level.Error(logger).Log("msg", "third")
+
+	entries := r.Entries()
+	require.Len(t, entries, 2)
+	require.Contains(t, entries[0], `level=error component=test msg=second`)
+	require.Contains(t, entries[1], `msg=third`)
+
+	// Every entry is passed on.
+	require.Contains(t, out.String(), "msg=info")
+}
@@ -16,7 +16,9 @@ package metadata
 
 import (
 	"context"
+	"debug/buildinfo"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -77,16 +79,43 @@ func Compiler(logger log.Logger, reg prometheus.Registerer, objFilePool *objectf
 			if err != nil {
 				return nil, fmt.Errorf("failed to get ELF file for process %d: %w", pid, err)
 			}
-			defer release()
 			labels := model.LabelSet{
 				"compiler": model.LabelValue(ainur.Compiler(ef)),
 				"stripped": model.LabelValue(fmt.Sprintf("%t", ainur.Stripped(ef))),
 				"static":   model.LabelValue(fmt.Sprintf("%t", ainur.Static(ef))),
 				"buildid":  model.LabelValue(buildID),
 			}
+			// Released before acquiring the reader, as both hold the same lock.
+			release()
+
+			r, releaseReader, err := obj.Reader()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get reader for process %d: %w", pid, err)
+			}
+			defer releaseReader()
+			labels = labels.Merge(goBuildInfoLabels(r))
 
 			cache.Put(buildID, labels)
 			return labels, nil
 		}},
 	}
 }
+
+// goBuildInfoLabels returns the Go version and main module a Go binary was
+// built with, if it is one.
+func goBuildInfoLabels(r io.ReaderAt) model.LabelSet {
+	info, err := buildinfo.Read(r)
+	if err != nil {
+		return nil
+	}
+
+	labels := model.LabelSet{
+		"go_version": model.LabelValue(info.GoVersion),
+	}
+	// Not set for binaries built outside of a module.
+	if info.Main.Path != "" {
+		labels["go_module"] = model.LabelValue(info.Main.Path)
+		labels["go_module_version"] = model.LabelValue(info.Main.Version)
+	}
+	return labels
+}
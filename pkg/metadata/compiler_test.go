@@ -0,0 +1,45 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoBuildInfoLabels(t *testing.T) {
+	path, err := os.Executable()
+	require.NoError(t, err)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	labels := goBuildInfoLabels(f)
+	require.Equal(t, model.LabelValue(runtime.Version()), labels["go_version"])
+	require.Equal(t, model.LabelValue("github.com/parca-dev/parca-agent"), labels["go_module"])
+	require.Contains(t, labels, model.LabelName("go_module_version"))
+
+	f, err = os.Open("/proc/self/cmdline")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+	require.Empty(t, goBuildInfoLabels(f))
+}
@@ -0,0 +1,49 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/dotnet"
+	"github.com/parca-dev/parca-agent/pkg/namespace"
+)
+
+func DotnetProcess(nsCache *namespace.Cache) Provider {
+	return &StatelessProvider{"dotnet process", func(ctx context.Context, pid int) (model.LabelSet, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		nsPIDs, err := nsCache.Get(pid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find namespaced PID for PID %d: %w", pid, err)
+		}
+
+		if _, err := dotnet.FindDiagnosticSocket(pid, nsPIDs[len(nsPIDs)-1]); err != nil {
+			if errors.Is(err, dotnet.ErrNoDiagnosticSocket) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to determine if PID %d belongs to a .NET process: %w", pid, err)
+		}
+
+		return model.LabelSet{
+			"dotnet": "true",
+		}, nil
+	}}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	burrow "github.com/goburrow/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+	"github.com/parca-dev/parca-agent/pkg/cache"
+)
+
+// Set by the ECS agent in the environment of containers, v4 first.
+// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-metadata-endpoint.html
+var ecsMetadataURIVariables = []string{"ECS_CONTAINER_METADATA_URI_V4", "ECS_CONTAINER_METADATA_URI"}
+
+const ecsMetadataTimeout = 2 * time.Second
+
+type ecsContainer struct {
+	Name string `json:"Name"`
+}
+
+type ecsTask struct {
+	Cluster     string `json:"Cluster"`
+	ServiceName string `json:"ServiceName"`
+	TaskARN     string `json:"TaskARN"`
+	Family      string `json:"Family"`
+	Revision    string `json:"Revision"`
+}
+
+// ECS provides the metadata of the AWS ECS task and container a process runs
+// in, from the task metadata endpoint of its container.
+func ECS(logger log.Logger, reg prometheus.Registerer, pfs procfs.FS) Provider {
+	client := &http.Client{Timeout: ecsMetadataTimeout}
+	// Processes of the same container share its endpoint.
+	endpoints := burrow.New(
+		burrow.WithMaximumSize(512),
+		burrow.WithExpireAfterAccess(time.Hour),
+		burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "metadata_ecs")),
+	)
+
+	return &StatelessProvider{"ecs", func(ctx context.Context, pid int) (model.LabelSet, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		env, err := environ(pfs, pid)
+		if err != nil {
+			return nil, err
+		}
+		uri := ""
+		for _, v := range ecsMetadataURIVariables {
+			if uri = env[v]; uri != "" {
+				break
+			}
+		}
+		if uri == "" {
+			return nil, nil
+		}
+
+		if labels, ok := endpoints.GetIfPresent(uri); ok {
+			if labels, ok := labels.(model.LabelSet); ok {
+				return labels, nil
+			}
+		}
+		labels, err := fetchECSLabels(ctx, client, uri)
+		if err != nil {
+			return nil, err
+		}
+		endpoints.Put(uri, labels)
+		return labels, nil
+	}}
+}
+
+func fetchECSLabels(ctx context.Context, client *http.Client, uri string) (model.LabelSet, error) {
+	var container ecsContainer
+	if err := getJSON(ctx, client, uri, &container); err != nil {
+		return nil, fmt.Errorf("failed to get ECS container metadata: %w", err)
+	}
+	var task ecsTask
+	if err := getJSON(ctx, client, uri+"/task", &task); err != nil {
+		return nil, fmt.Errorf("failed to get ECS task metadata: %w", err)
+	}
+
+	labels := model.LabelSet{
+		// Either the name or the ARN of the cluster.
+		"ecs_cluster":       model.LabelValue(task.Cluster[strings.LastIndex(task.Cluster, "/")+1:]),
+		"ecs_task_arn":      model.LabelValue(task.TaskARN),
+		"ecs_task_family":   model.LabelValue(task.Family),
+		"ecs_task_revision": model.LabelValue(task.Revision),
+		"ecs_container":     model.LabelValue(container.Name),
+	}
+	if task.ServiceName != "" {
+		labels["ecs_service"] = model.LabelValue(task.ServiceName)
+	}
+	return labels, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
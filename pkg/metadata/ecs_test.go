@@ -0,0 +1,76 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchECSLabels(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v4/abc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"DockerId": "abc", "Name": "checkout", "Image": "checkout:1.2"}`))
+	})
+	mux.HandleFunc("/v4/abc/task", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"Cluster": "arn:aws:ecs:us-west-2:111122223333:cluster/shop",
+			"TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/shop/158d1c8083dd49d6b527399fd6414f5c",
+			"Family": "checkout",
+			"Revision": "7",
+			"ServiceName": "checkout-svc"
+		}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	labels, err := fetchECSLabels(context.Background(), srv.Client(), srv.URL+"/v4/abc")
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{
+		"ecs_cluster":       "shop",
+		"ecs_service":       "checkout-svc",
+		"ecs_task_arn":      "arn:aws:ecs:us-west-2:111122223333:task/shop/158d1c8083dd49d6b527399fd6414f5c",
+		"ecs_task_family":   "checkout",
+		"ecs_task_revision": "7",
+		"ecs_container":     "checkout",
+	}, labels)
+
+	_, err = fetchECSLabels(context.Background(), srv.Client(), srv.URL+"/v4/missing")
+	require.Error(t, err)
+}
+
+func TestNomadLabels(t *testing.T) {
+	require.Equal(t, model.LabelSet{
+		"nomad_alloc_id":  "5456bd7a-9fc0-c0dd-6131-cbee77f57577",
+		"nomad_namespace": "default",
+		"nomad_job":       "shop",
+		"nomad_group":     "api",
+		"nomad_task":      "checkout",
+	}, nomadLabels(map[string]string{
+		"NOMAD_ALLOC_ID":   "5456bd7a-9fc0-c0dd-6131-cbee77f57577",
+		"NOMAD_ALLOC_DIR":  "/alloc",
+		"NOMAD_NAMESPACE":  "default",
+		"NOMAD_JOB_NAME":   "shop",
+		"NOMAD_GROUP_NAME": "api",
+		"NOMAD_TASK_NAME":  "checkout",
+		"PATH":             "/bin",
+	}))
+
+	require.Nil(t, nomadLabels(map[string]string{"PATH": "/bin"}))
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	burrow "github.com/goburrow/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/strutil"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
+	"github.com/parca-dev/parca-agent/pkg/discovery/kubernetes"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+// PodIndex finds the pods running containers.
+type PodIndex interface {
+	HasSynced() bool
+	ContainerPod(containerID string) (*v1.Pod, string, bool)
+}
+
+// KubernetesProvider labels the processes running in the pods of the node
+// with the metadata of their pod.
+type KubernetesProvider struct {
+	pfs         procfs.FS
+	index       PodIndex
+	annotations []string
+
+	// PIDs with the ID of their container, or an empty string for processes
+	// outside of containers.
+	containers burrow.Cache
+}
+
+func Kubernetes(logger log.Logger, reg prometheus.Registerer, pfs procfs.FS, index PodIndex, annotations []string, profilingDuration time.Duration) *KubernetesProvider {
+	return &KubernetesProvider{
+		pfs:         pfs,
+		index:       index,
+		annotations: annotations,
+		containers: burrow.New(
+			burrow.WithMaximumSize(4096),
+			// Processes that exited stop being accessed.
+			burrow.WithExpireAfterAccess(10*profilingDuration),
+			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "kubernetes_container")),
+		),
+	}
+}
+
+func (p *KubernetesProvider) Name() string {
+	return "kubernetes"
+}
+
+// ShouldCache returns false, as the labels and annotations of pods change
+// while they run.
+func (p *KubernetesProvider) ShouldCache() bool {
+	return false
+}
+
+func (p *KubernetesProvider) Labels(ctx context.Context, pid int) (model.LabelSet, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if !p.index.HasSynced() {
+		return nil, errors.New("pods not synced")
+	}
+
+	containerID, err := p.containerID(pid)
+	if err != nil {
+		return nil, err
+	}
+	if containerID == "" {
+		return nil, nil
+	}
+
+	pod, container, ok := p.index.ContainerPod(containerID)
+	if !ok {
+		// The container is gone, and the PID might be reused.
+		p.containers.Invalidate(pid)
+		return nil, fmt.Errorf("no pod found for container %s", containerID)
+	}
+	return podLabels(pod, container, p.annotations), nil
+}
+
+func (p *KubernetesProvider) containerID(pid int) (string, error) {
+	if id, ok := p.containers.GetIfPresent(pid); ok {
+		if id, ok := id.(string); ok {
+			return id, nil
+		}
+	}
+
+	proc, err := p.pfs.Proc(pid)
+	if err != nil {
+		return "", fmt.Errorf("failed to instantiate procfs for PID %d: %w", pid, err)
+	}
+	cgroups, err := proc.Cgroups()
+	if err != nil {
+		return "", fmt.Errorf("failed to get cgroups for PID %d: %w", pid, err)
+	}
+
+	id := cgroup.ContainerID(cgroup.UnifiedPath(cgroups))
+	p.containers.Put(pid, id)
+	return id, nil
+}
+
+func podLabels(pod *v1.Pod, container string, annotations []string) model.LabelSet {
+	labels := model.LabelSet{
+		"namespace": model.LabelValue(pod.Namespace),
+		"pod":       model.LabelValue(pod.Name),
+		"container": model.LabelValue(container),
+	}
+	if kind, name := kubernetes.Workload(pod); kind != "" {
+		labels["workload_kind"] = model.LabelValue(kind)
+		labels["workload_name"] = model.LabelValue(name)
+	}
+	for k, v := range pod.Labels {
+		labels[model.LabelName(strutil.SanitizeLabelName(k))] = model.LabelValue(v)
+	}
+	for k, v := range profiler.OverrideLabels(pod.Annotations) {
+		labels[k] = v
+	}
+	for _, k := range annotations {
+		if v, ok := pod.Annotations[k]; ok {
+			labels[model.LabelName(strutil.SanitizeLabelName("annotation_"+k))] = model.LabelValue(v)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodLabels(t *testing.T) {
+	controller := true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "shop",
+			Name:      "checkout-7d9f8b6c5-x2x4q",
+			Labels: map[string]string{
+				"app.kubernetes.io/name": "checkout",
+				"pod-template-hash":      "7d9f8b6c5",
+			},
+			Annotations: map[string]string{
+				"team":                        "payments",
+				"prometheus.io/scrape":        "true",
+				"kubectl.kubernetes.io/other": "ignored",
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				Kind:       "ReplicaSet",
+				Name:       "checkout-7d9f8b6c5",
+				Controller: &controller,
+			}},
+		},
+	}
+
+	require.Equal(t, model.LabelSet{
+		"namespace":                       "shop",
+		"pod":                             "checkout-7d9f8b6c5-x2x4q",
+		"container":                       "server",
+		"workload_kind":                   "Deployment",
+		"workload_name":                   "checkout",
+		"app_kubernetes_io_name":          "checkout",
+		"pod_template_hash":               "7d9f8b6c5",
+		"annotation_team":                 "payments",
+		"annotation_prometheus_io_scrape": "true",
+	}, podLabels(pod, "server", []string{"team", "prometheus.io/scrape", "missing"}))
+
+	// Standalone pods are not controlled by any workload.
+	pod.OwnerReferences = nil
+	labels := podLabels(pod, "server", nil)
+	require.NotContains(t, labels, model.LabelName("workload_kind"))
+	require.NotContains(t, labels, model.LabelName("annotation_team"))
+}
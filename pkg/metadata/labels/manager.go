@@ -33,6 +33,7 @@ import (
 
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/metadata"
+	"github.com/parca-dev/parca-agent/pkg/process"
 )
 
 // Manager is responsible for aggregating, mutating, and serving process labels.
@@ -45,6 +46,8 @@ type Manager struct {
 
 	mtx            *sync.RWMutex
 	relabelConfigs []*relabel.Config
+	// Processes it drops are dropped like they are by relabeling.
+	processFilter *process.NameFilter
 
 	labelCache burrow.Cache
 }
@@ -56,6 +59,7 @@ func NewManager(
 	reg prometheus.Registerer,
 	providers []metadata.Provider,
 	relabelConfigs []*relabel.Config,
+	processFilter *process.NameFilter,
 	cacheDisabled bool,
 	profilingDuration time.Duration,
 ) *Manager {
@@ -84,6 +88,7 @@ func NewManager(
 
 		mtx:            &sync.RWMutex{},
 		relabelConfigs: relabelConfigs,
+		processFilter:  processFilter,
 
 		labelCache:    labelCache,
 		providerCache: providerCache,
@@ -168,6 +173,10 @@ func (m *Manager) Labels(ctx context.Context, pid int) (labels.Labels, error) {
 		return labelSetToLabels(labelSet), nil
 	}
 
+	if !m.processFilter.Keep(pid) {
+		return nil, nil
+	}
+
 	labelSet, err := m.labelSet(ctx, pid)
 	if err != nil {
 		return nil, err
@@ -201,6 +210,11 @@ func (m *Manager) LabelSet(ctx context.Context, pid int) (model.LabelSet, error)
 		return labelSet, nil
 	}
 
+	if !m.processFilter.Keep(pid) {
+		m.labelCache.Put(labelCacheKey(pid), model.LabelSet{})
+		return nil, nil
+	}
+
 	labelSet, err := m.labelSet(ctx, pid)
 	if err != nil {
 		return nil, err
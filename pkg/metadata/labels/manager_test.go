@@ -59,6 +59,7 @@ func TestManager(t *testing.T) {
 				Action:       relabel.Drop,
 			},
 		},
+		nil,
 		false,
 		time.Second,
 	)
@@ -0,0 +1,86 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// Set by Nomad in the environment of tasks, whichever their driver.
+// https://developer.hashicorp.com/nomad/docs/runtime/environment
+var nomadVariables = map[string]model.LabelName{
+	"NOMAD_ALLOC_ID":   "nomad_alloc_id",
+	"NOMAD_NAMESPACE":  "nomad_namespace",
+	"NOMAD_JOB_NAME":   "nomad_job",
+	"NOMAD_GROUP_NAME": "nomad_group",
+	"NOMAD_TASK_NAME":  "nomad_task",
+	"NOMAD_DC":         "nomad_datacenter",
+	"NOMAD_REGION":     "nomad_region",
+}
+
+// Nomad provides the metadata of the HashiCorp Nomad allocation and task a
+// process runs in.
+func Nomad(pfs procfs.FS) Provider {
+	return &StatelessProvider{"nomad", func(ctx context.Context, pid int) (model.LabelSet, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		env, err := environ(pfs, pid)
+		if err != nil {
+			return nil, err
+		}
+		return nomadLabels(env), nil
+	}}
+}
+
+func nomadLabels(env map[string]string) model.LabelSet {
+	if env["NOMAD_ALLOC_ID"] == "" {
+		return nil
+	}
+
+	labels := model.LabelSet{}
+	for v, name := range nomadVariables {
+		if value := env[v]; value != "" {
+			labels[name] = model.LabelValue(value)
+		}
+	}
+	return labels
+}
+
+// environ returns the environment variables of a process.
+func environ(pfs procfs.FS, pid int) (map[string]string, error) {
+	p, err := pfs.Proc(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate procfs for PID %d: %w", pid, err)
+	}
+	vars, err := p.Environ()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment for PID %d: %w", pid, err)
+	}
+
+	env := make(map[string]string, len(vars))
+	for _, v := range vars {
+		if k, value, ok := strings.Cut(v, "="); ok {
+			env[k] = value
+		}
+	}
+	return env, nil
+}
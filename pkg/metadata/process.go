@@ -20,8 +20,8 @@ import (
 	"strconv"
 
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/procfs"
 
+	"github.com/parca-dev/parca-agent/internal/procfs"
 	"github.com/parca-dev/parca-agent/pkg/cgroup"
 )
 
@@ -41,7 +41,8 @@ func Process(procfs procfs.FS) Provider {
 			return nil, fmt.Errorf("failed to get cgroups for PID %d: %w", pid, err)
 		}
 
-		cgroup := cgroup.FindContainerGroup(cgroups)
+		containerGroup := cgroup.FindContainerGroup(cgroups)
+		unifiedPath := cgroup.UnifiedPath(cgroups)
 
 		comm, err := p.Comm()
 		if err != nil {
@@ -58,11 +59,22 @@ func Process(procfs procfs.FS) Provider {
 			return nil, fmt.Errorf("failed to get stat for PID %d: %w", pid, err)
 		}
 
-		return model.LabelSet{
-			"cgroup_name": model.LabelValue(cgroup.Path),
+		labels := model.LabelSet{
+			"cgroup_name": model.LabelValue(containerGroup.Path),
+			"cgroup":      model.LabelValue(unifiedPath),
 			"comm":        model.LabelValue(comm),
 			"executable":  model.LabelValue(executable),
 			"ppid":        model.LabelValue(strconv.Itoa(stat.PPID)),
-		}, nil
+		}
+
+		attribution := cgroup.Attribute(unifiedPath)
+		if attribution.QoSClass != "" {
+			labels["qos_class"] = model.LabelValue(attribution.QoSClass)
+		}
+		if attribution.ContainerRuntime != "" {
+			labels["container_runtime"] = model.LabelValue(attribution.ContainerRuntime)
+		}
+
+		return labels, nil
 	}}
 }
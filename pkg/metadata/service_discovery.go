@@ -18,10 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sync"
 
-	"github.com/go-kit/log"
-	"github.com/go-kit/log/level"
 	"github.com/prometheus/common/model"
 
 	"github.com/parca-dev/parca-agent/pkg/discovery"
@@ -29,13 +26,8 @@ import (
 )
 
 type ServiceDiscoveryProvider struct {
-	logger log.Logger
-
-	mtx   *sync.RWMutex
-	state map[int]model.LabelSet
-
-	tree        *process.Tree
-	discoveryCh <-chan map[string][]discovery.Group
+	store *discovery.Store
+	tree  *process.Tree
 }
 
 func (p *ServiceDiscoveryProvider) Name() string {
@@ -56,17 +48,8 @@ func (p *ServiceDiscoveryProvider) Labels(ctx context.Context, pid int) (model.L
 		return nil, fmt.Errorf("failed to find all ancestor process IDs in same cgroup: %w", err)
 	}
 
-	p.mtx.RLock()
-	state := p.state
-	p.mtx.RUnlock()
-
-	if state == nil {
-		return nil, errors.New("state not initialized")
-	}
-
 	for _, pid := range append(pids, pid) {
-		v, ok := state[pid]
-		if ok {
+		if v, ok := p.store.Labels(pid); ok {
 			return v, nil
 		}
 	}
@@ -75,58 +58,9 @@ func (p *ServiceDiscoveryProvider) Labels(ctx context.Context, pid int) (model.L
 }
 
 // ServiceDiscovery metadata provider.
-func ServiceDiscovery(logger log.Logger, ch <-chan map[string][]discovery.Group, psTree *process.Tree) *ServiceDiscoveryProvider {
+func ServiceDiscovery(store *discovery.Store, psTree *process.Tree) *ServiceDiscoveryProvider {
 	return &ServiceDiscoveryProvider{
-		logger:      logger,
-		state:       map[int]model.LabelSet{},
-		mtx:         &sync.RWMutex{},
-		tree:        psTree,
-		discoveryCh: ch,
-	}
-}
-
-func (p *ServiceDiscoveryProvider) Run(ctx context.Context) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case tSets := <-p.discoveryCh:
-			level.Debug(p.logger).Log("msg", "received new service discovery targets", "targets", fmt.Sprintf("%+v", tSets))
-			state := map[int]model.LabelSet{}
-			// Update process labels.
-			for _, groups := range tSets {
-				for _, group := range groups {
-					switch v := group.(type) {
-					case *discovery.SingleTargetGroup:
-						updateState(state, v.Target, group.Labels())
-					case *discovery.MultiTargetGroup:
-						for pid, labels := range v.Targets {
-							updateState(state, pid, group.Labels().Merge(labels))
-						}
-					default:
-						level.Warn(p.logger).Log("msg", "unknown group type", "type", fmt.Sprintf("%T", group))
-						continue
-					}
-				}
-			}
-
-			p.mtx.Lock()
-			p.state = state
-			p.mtx.Unlock()
-		}
-	}
-}
-
-func updateState(state map[int]model.LabelSet, pid int, labels model.LabelSet) {
-	if pid == 0 {
-		return
-	}
-	if len(labels) == 0 {
-		return
-	}
-	if _, ok := state[pid]; ok {
-		state[pid] = state[pid].Merge(labels)
-	} else {
-		state[pid] = labels
+		store: store,
+		tree:  psTree,
 	}
 }
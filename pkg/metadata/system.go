@@ -16,9 +16,7 @@ package metadata
 
 import (
 	"context"
-	"strings"
 	"sync"
-	"syscall"
 
 	"github.com/prometheus/common/model"
 
@@ -71,24 +69,3 @@ func setMetadata() {
 		"agent_revision": model.LabelValue(revision),
 	}
 }
-
-func int8SliceToString(arr []int8) string {
-	var b strings.Builder
-	for _, v := range arr {
-		// NUL byte, as it's a C string.
-		if v == 0 {
-			break
-		}
-		b.WriteByte(byte(v))
-	}
-	return b.String()
-}
-
-func KernelRelease() (string, error) {
-	var uname syscall.Utsname
-	if err := syscall.Uname(&uname); err != nil {
-		return "", err
-	}
-
-	return int8SliceToString(uname.Release[:]), nil
-}
@@ -0,0 +1,158 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
+	"github.com/parca-dev/parca-agent/pkg/discovery/systemd"
+)
+
+const systemdRefreshInterval = 30 * time.Second
+
+// SystemdProvider labels processes with the systemd unit and slice they run
+// in, as told by their cgroup. On hosts whose cgroups don't tell, it falls
+// back to the main PIDs of the running services reported over D-Bus.
+type SystemdProvider struct {
+	logger log.Logger
+	pfs    procfs.FS
+
+	mtx      *sync.RWMutex
+	mainPIDs map[int]string
+}
+
+func Systemd(logger log.Logger, pfs procfs.FS) *SystemdProvider {
+	return &SystemdProvider{
+		logger:   logger,
+		pfs:      pfs,
+		mtx:      &sync.RWMutex{},
+		mainPIDs: map[int]string{},
+	}
+}
+
+func (p *SystemdProvider) Name() string {
+	return "systemd"
+}
+
+// ShouldCache returns false, as main PIDs are only known once refreshed.
+func (p *SystemdProvider) ShouldCache() bool {
+	return false
+}
+
+func (p *SystemdProvider) Labels(ctx context.Context, pid int) (model.LabelSet, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	proc, err := p.pfs.Proc(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate procfs for PID %d: %w", pid, err)
+	}
+	cgroups, err := proc.Cgroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cgroups for PID %d: %w", pid, err)
+	}
+
+	unit := cgroup.ParseSystemdUnit(cgroup.SystemdPath(cgroups))
+	if unit.Unit == "" {
+		p.mtx.RLock()
+		unit.Unit = p.mainPIDs[pid]
+		p.mtx.RUnlock()
+	}
+	return systemdLabels(unit), nil
+}
+
+// Run refreshes the main PIDs of the running services until the context is
+// done. Without D-Bus, processes are only labelled from their cgroup.
+func (p *SystemdProvider) Run(ctx context.Context) error {
+	client, err := systemd.New()
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to connect to systemd D-Bus API, using cgroups only", "err", err)
+		<-ctx.Done()
+		return nil
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			level.Warn(p.logger).Log("msg", "failed to close systemd client", "err", err)
+		}
+	}()
+
+	ticker := time.NewTicker(systemdRefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.refresh(client); err != nil {
+			level.Warn(p.logger).Log("msg", "failed to get units from systemd D-Bus API", "err", err)
+			if err := client.Reset(); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to reset systemd client", "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *SystemdProvider) refresh(client *systemd.Client) error {
+	var running []string
+	err := client.ListUnits(systemd.IsService, func(u *systemd.Unit) {
+		if u.SubState == "running" {
+			running = append(running, u.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	mainPIDs := make(map[int]string, len(running))
+	for _, name := range running {
+		pid, err := client.MainPID(name)
+		if err != nil {
+			return fmt.Errorf("get MainPID of %s: %w", name, err)
+		}
+		if pid != 0 {
+			mainPIDs[int(pid)] = name
+		}
+	}
+
+	p.mtx.Lock()
+	p.mainPIDs = mainPIDs
+	p.mtx.Unlock()
+	return nil
+}
+
+func systemdLabels(u cgroup.SystemdUnit) model.LabelSet {
+	labels := model.LabelSet{}
+	if u.Unit != "" {
+		labels["systemd_unit"] = model.LabelValue(u.Unit)
+	}
+	if u.Slice != "" {
+		labels["systemd_slice"] = model.LabelValue(u.Slice)
+	}
+	if u.UserUnit != "" {
+		labels["systemd_user_unit"] = model.LabelValue(u.UserUnit)
+	}
+	return labels
+}
@@ -22,20 +22,21 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
+
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
 )
 
 // MountNamespaceInode returns the inode of the mount namespace of the given pid.
 func MountNamespaceInode(pid int) (uint64, error) {
-	fileinfo, err := os.Stat(filepath.Join("/proc", fmt.Sprintf("%d", pid), "ns/mnt"))
+	info, err := os.Stat(filepath.Join("/proc", fmt.Sprintf("%d", pid), "ns/mnt"))
 	if err != nil {
 		return 0, err
 	}
-	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	id, ok := fileinfo.IDOf(info)
 	if !ok {
-		return 0, fmt.Errorf("not a syscall.Stat_t")
+		return 0, fmt.Errorf("unexpected stat type %T", info.Sys())
 	}
-	return stat.Ino, nil
+	return id.Ino, nil
 }
 
 // TODO(kakkoyun): Do not expose fs.FS directly.
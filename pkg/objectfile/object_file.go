@@ -21,13 +21,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 )
 
+// File is a file object files are read from, such as an *os.File or an
+// encrypted file.
+type File interface {
+	io.ReaderAt
+	io.ReadSeekCloser
+	Name() string
+	Stat() (fs.FileInfo, error)
+}
+
 // ObjectFile represents an executable or library file.
 // It handles the lifetime of the underlying file descriptor.
 type ObjectFile struct {
@@ -41,7 +50,7 @@ type ObjectFile struct {
 	openedAt time.Time
 
 	mtx  *sync.RWMutex
-	file *os.File
+	file File
 	// Protected by mtx. ELF file is read using ReaderAt,
 	// which means concurrent reads are allowed.
 	elf      *elf.File
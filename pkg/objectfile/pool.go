@@ -116,11 +116,11 @@ const keepAliveProfileCycle = 30
 func NewPool(logger log.Logger, reg prometheus.Registerer, profilingDuration time.Duration) *Pool {
 	return &Pool{
 		metrics: newMetrics(reg),
-		buildIDCache: burrow.New(
+		buildIDCache: cache.NewSizedCache(
 			burrow.WithExpireAfterAccess(keepAliveProfileCycle*profilingDuration),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "buildid")),
 		),
-		objCache: burrow.New(
+		objCache: cache.NewSizedCache(
 			burrow.WithExpireAfterAccess(keepAliveProfileCycle*profilingDuration),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "objectfile")),
 		),
@@ -146,7 +146,18 @@ func (p *Pool) get(buildID string) (*ObjectFile, error) {
 // The returned reference should be released after use.
 // The file will be closed when the reference is released.
 func (p *Pool) Open(path string) (*ObjectFile, error) {
-	if val, ok := p.buildIDCache.GetIfPresent(path); ok {
+	return p.open(path, "")
+}
+
+// OpenWithBuildID is like Open, for files known by the build ID of the file
+// they were derived from, such as the debuginfo files of binaries without a
+// build ID, whose contents, and so identifier, differ from the binary's.
+func (p *Pool) OpenWithBuildID(path, buildID string) (*ObjectFile, error) {
+	return p.open(path, buildID)
+}
+
+func (p *Pool) open(path, buildID string) (*ObjectFile, error) {
+	if val, ok := p.buildIDCache.GetIfPresent(path); ok && buildID == "" {
 		buildID, ok := val.(string)
 		if !ok {
 			return nil, fmt.Errorf("unexpected type in cache: %T", val)
@@ -163,7 +174,7 @@ func (p *Pool) Open(path string) (*ObjectFile, error) {
 		}
 		return nil, fmt.Errorf("error opening %s: %w", path, err)
 	}
-	return p.NewFile(f)
+	return p.newFile(f, buildID)
 }
 
 // var elfOpen = elf.Open       // Has a closer and keeps a reference to the file.
@@ -172,7 +183,21 @@ var elfNewFile = elf.NewFile // Doesn't have a closer and doesn't keep a referen
 // NewFile creates a new ObjectFile reference from an existing file.
 // The returned reference should be released after use.
 // The file will be closed when the reference is released.
-func (p *Pool) NewFile(f *os.File) (_ *ObjectFile, err error) { //nolint:nonamedreturns
+func (p *Pool) NewFile(f *os.File) (*ObjectFile, error) {
+	return p.newFile(f, "")
+}
+
+// NewFileWithBuildID is like NewFile, for files known by the build ID of the
+// file they were derived from, see OpenWithBuildID. Unlike NewFile, the file
+// doesn't need to be an *os.File.
+func (p *Pool) NewFileWithBuildID(f File, buildID string) (*ObjectFile, error) {
+	if buildID == "" {
+		return nil, errors.New("build ID must be given")
+	}
+	return p.newFile(f, buildID)
+}
+
+func (p *Pool) newFile(f File, buildID string) (_ *ObjectFile, err error) { //nolint:nonamedreturns
 	defer func() {
 		if err != nil {
 			p.metrics.opened.WithLabelValues(lvError).Inc()
@@ -202,10 +227,18 @@ func (p *Pool) NewFile(f *os.File) (_ *ObjectFile, err error) { //nolint:nonamed
 		return nil, closer(errors.New("ELF does not have any sections"))
 	}
 
-	buildID, err := buildid.BuildID(f, ef)
-	if err != nil {
-		p.metrics.openErrors.WithLabelValues(lvBuildID).Inc()
-		return nil, closer(fmt.Errorf("failed to get build ID for %s: %w", path, err))
+	// Only the build IDs of the files themselves are cached by path.
+	ownBuildID := buildID == ""
+	if ownBuildID {
+		osFile, ok := f.(*os.File)
+		if !ok {
+			return nil, closer(fmt.Errorf("build ID of %s must be given", path))
+		}
+		buildID, err = buildid.BuildID(osFile, ef)
+		if err != nil {
+			p.metrics.openErrors.WithLabelValues(lvBuildID).Inc()
+			return nil, closer(fmt.Errorf("failed to get build ID for %s: %w", path, err))
+		}
 	}
 	if rErr := rewind(f); rErr != nil {
 		p.metrics.openErrors.WithLabelValues(lvRewind).Inc()
@@ -264,11 +297,22 @@ func (p *Pool) NewFile(f *os.File) (_ *ObjectFile, err error) { //nolint:nonamed
 	runtime.SetFinalizer(ref, func(obj *ObjectFile) error {
 		return errors.Join(obj.close(), f.Close())
 	})
-	p.buildIDCache.Put(path, buildID)
+	if ownBuildID {
+		p.buildIDCache.Put(path, buildID)
+	}
 	p.objCache.Put(buildID, obj)
 	return ref, nil
 }
 
+// CacheSizes returns how many object files and build IDs of paths the pool
+// holds.
+func (p *Pool) CacheSizes() map[string]int {
+	return map[string]int{
+		"objectfile": cache.Len(p.objCache),
+		"buildid":    cache.Len(p.buildIDCache),
+	}
+}
+
 // Close closes the pool and all the files in it.
 func (p *Pool) Close() error {
 	// Closing cache will remove all the entries.
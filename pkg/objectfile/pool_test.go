@@ -100,6 +100,22 @@ func TestPoolWithFinalizer(t *testing.T) {
 	t.Log(objPool.stats())
 }
 
+func TestPoolOpenWithBuildID(t *testing.T) {
+	objPool := NewPool(log.NewNopLogger(), prometheus.NewRegistry(), time.Minute)
+	t.Cleanup(func() {
+		require.NoError(t, objPool.Close())
+	})
+
+	obj, err := objPool.OpenWithBuildID("./testdata/fib", "deadbeef")
+	require.NoError(t, err)
+	require.Equal(t, "deadbeef", obj.BuildID)
+
+	// Files are known by the given build ID rather than their own.
+	obj, err = objPool.Open("./testdata/fib")
+	require.NoError(t, err)
+	require.NotEqual(t, "deadbeef", obj.BuildID)
+}
+
 func TestObjectFileLifeCycleELF(t *testing.T) {
 	// On a slow filessystem, the test may fail because the cache expiration.
 	objPool := NewPool(log.NewNopLogger(), prometheus.NewRegistry(), time.Millisecond)
@@ -0,0 +1,26 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package perf
+
+import (
+	"errors"
+)
+
+// monotonicClockStart fails, as the JIT dump timestamps are only read on
+// Linux.
+func monotonicClockStart() (int64, error) {
+	return 0, errors.New("the JIT dump clock is only supported on Linux")
+}
@@ -15,10 +15,8 @@ package perf
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"os"
-	"sort"
 	"time"
 
 	"github.com/go-kit/log"
@@ -28,16 +26,18 @@ import (
 
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/jit"
+	"github.com/parca-dev/parca-agent/pkg/process"
 )
 
 type JitdumpCache struct {
 	logger log.Logger
 
-	cache burrow.Cache
+	cache  burrow.Cache
+	rootFS *process.RootFS
 }
 
 type jitdumpCacheValue struct {
-	m Map
+	m JITMap
 
 	// We assume the file is unchanged if the size and modtime are the same as
 	// last time we parsed it.
@@ -47,10 +47,10 @@ type jitdumpCacheValue struct {
 
 var ErrJITDumpNotFound = errors.New("jitdump not found")
 
-func ReadJitdump(logger log.Logger, fileName string) (Map, error) {
+func ReadJitdump(logger log.Logger, fileName string) (JITMap, error) {
 	fd, err := os.Open(fileName)
 	if err != nil {
-		return Map{}, err
+		return JITMap{}, err
 	}
 	defer fd.Close()
 
@@ -58,45 +58,46 @@ func ReadJitdump(logger log.Logger, fileName string) (Map, error) {
 	err = jit.LoadJITDump(logger, fd, dump)
 	if errors.Is(err, io.ErrUnexpectedEOF) {
 		if dump == nil || dump.CodeLoads == nil {
-			return Map{}, err
+			return JITMap{}, err
 		}
 		// Some runtimes update their dump all the time (e.g. libperf_jvmti.so),
 		// making it nearly impossible to read a complete file
 		level.Warn(logger).Log("msg", "JIT dump file ended unexpectedly", "filename", fileName, "err", err)
 	} else if err != nil {
-		return Map{}, err
+		return JITMap{}, err
 	}
 
-	addrs := make([]MapAddr, 0, len(dump.CodeLoads))
-	for _, cl := range dump.CodeLoads {
-		addrs = append(addrs, MapAddr{cl.CodeAddr, cl.CodeAddr + cl.CodeSize, cl.Name})
+	monotonicStart, err := monotonicClockStart()
+	if err != nil {
+		return JITMap{}, err
 	}
-
-	// Sorted by end address to allow binary search during look-up. End to find
-	// the (closest) address _before_ the end. This could be an inlined instruction
-	// within a larger blob.
-	sort.Slice(addrs, func(i, j int) bool {
-		return addrs[i].End < addrs[j].End
-	})
-
-	return Map{addrs: addrs}, nil
+	return newJITMap(dump, monotonicStart), nil
 }
 
-func NewJitdumpCache(logger log.Logger, reg prometheus.Registerer, profilingDuration time.Duration) *JitdumpCache {
+func NewJitdumpCache(logger log.Logger, reg prometheus.Registerer, rootFS *process.RootFS, profilingDuration time.Duration) *JitdumpCache {
 	return &JitdumpCache{
 		logger: logger,
-		cache: burrow.New(
+		cache: cache.NewSizedCache(
 			burrow.WithMaximumSize(512),
 			burrow.WithExpireAfterAccess(10*profilingDuration),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "jitdump_cache")),
 		),
+		rootFS: rootFS,
 	}
 }
 
+// CacheSizes returns how many JIT dumps are cached.
+func (p *JitdumpCache) CacheSizes() map[string]int {
+	return map[string]int{"jitdump_cache": cache.Len(p.cache)}
+}
+
 // DumpForPID reads the JIT dump for the given PID and filename and returns a
-// Map that can be queried.
-func (p *JitdumpCache) JitdumpForPID(pid int, path string) (*Map, error) {
-	jitdumpFile := fmt.Sprintf("/proc/%d/root%s", pid, path)
+// JITMap that can be queried.
+func (p *JitdumpCache) JitdumpForPID(pid int, path string) (*JITMap, error) {
+	jitdumpFile, err := p.rootFS.Path(pid, path)
+	if err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(jitdumpFile)
 	if os.IsNotExist(err) {
 		return nil, ErrJITDumpNotFound
@@ -0,0 +1,145 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perf
+
+import (
+	"sort"
+
+	"github.com/parca-dev/parca-agent/pkg/jit"
+)
+
+// JITMapAddr is the code of a function JIT-compiled at some point in time.
+type JITMapAddr struct {
+	MapAddr
+	// Unix times in nanoseconds from which the code is at the address, and
+	// until which, when it was moved elsewhere. Zero when unknown.
+	Loaded   int64
+	Unloaded int64
+	// Whether the code was moved elsewhere.
+	moved bool
+	// Order in which the code was loaded at the address.
+	seq int
+}
+
+// JITMap is the index of the functions of a JIT dump. JITs reuse the address
+// ranges of the code they garbage collect, so the functions are looked up by
+// the time the address was sampled at.
+type JITMap struct {
+	// Sorted by start address.
+	addrs []JITMapAddr
+	// Size of the largest function, which bounds how far before an address
+	// the functions containing it can start.
+	maxSize uint64
+	// Whether the times of the functions are known.
+	timed bool
+}
+
+// newJITMap indexes the code loaded and moved by the records of the given
+// dump. The timestamps of the records are CLOCK_MONOTONIC ones unless the
+// header says otherwise, monotonicStart is the Unix time in nanoseconds of
+// their origin.
+func newJITMap(dump *jit.JITDump, monotonicStart int64) JITMap {
+	timed := dump.Header != nil && dump.Header.Flags&jit.JITDumpFlagArchTimestamp == 0
+	unixTime := func(ts uint64) int64 {
+		if !timed {
+			return 0
+		}
+		return monotonicStart + int64(ts)
+	}
+
+	// The records are replayed in the order they were written in.
+	type record struct {
+		load *jit.JRCodeLoad
+		move *jit.JRCodeMove
+		ts   uint64
+	}
+	records := make([]record, 0, len(dump.CodeLoads)+len(dump.CodeMoves))
+	for _, cl := range dump.CodeLoads {
+		records = append(records, record{load: cl, ts: cl.Prefix.Timestamp})
+	}
+	for _, cm := range dump.CodeMoves {
+		records = append(records, record{move: cm, ts: cm.Prefix.Timestamp})
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ts < records[j].ts
+	})
+
+	var (
+		addrs = make([]JITMapAddr, 0, len(records))
+		// Index in addrs of the current code of each function.
+		byCodeIndex = make(map[uint64]int, len(dump.CodeLoads))
+		maxSize     uint64
+	)
+	for i, r := range records {
+		var a JITMapAddr
+		switch {
+		case r.load != nil:
+			a.MapAddr = MapAddr{r.load.CodeAddr, r.load.CodeAddr + r.load.CodeSize, r.load.Name}
+			byCodeIndex[r.load.CodeIndex] = len(addrs)
+		default:
+			j, ok := byCodeIndex[r.move.CodeIndex]
+			if !ok {
+				continue
+			}
+			addrs[j].Unloaded = unixTime(r.ts)
+			addrs[j].moved = true
+			a.MapAddr = MapAddr{r.move.NewCodeAddr, r.move.NewCodeAddr + r.move.CodeSize, addrs[j].Symbol}
+			byCodeIndex[r.move.CodeIndex] = len(addrs)
+		}
+		a.Loaded = unixTime(r.ts)
+		a.seq = i
+		if size := a.End - a.Start; size > maxSize {
+			maxSize = size
+		}
+		addrs = append(addrs, a)
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].Start < addrs[j].Start
+	})
+	return JITMap{addrs: addrs, maxSize: maxSize, timed: timed}
+}
+
+// Lookup returns the function at the given address at the given Unix time in
+// nanoseconds, the one most recently loaded there. When the time is zero, or
+// the times of the functions are unknown, it is the function currently
+// there.
+func (m *JITMap) Lookup(addr uint64, ts int64) (string, error) {
+	// The first function starting after the address.
+	idx := sort.Search(len(m.addrs), func(i int) bool {
+		return addr < m.addrs[i].Start
+	})
+
+	found := -1
+	for i := idx - 1; i >= 0 && addr-m.addrs[i].Start < m.maxSize; i-- {
+		a := &m.addrs[i]
+		if addr >= a.End {
+			continue
+		}
+		if ts == 0 || !m.timed {
+			if a.moved {
+				continue
+			}
+		} else if a.Loaded > ts || (a.moved && a.Unloaded <= ts) {
+			continue
+		}
+		if found == -1 || a.seq > m.addrs[found].seq {
+			found = i
+		}
+	}
+	if found == -1 {
+		return "", ErrNoSymbolFound
+	}
+	return m.addrs[found].Symbol, nil
+}
@@ -14,7 +14,10 @@
 package perf
 
 import (
+	"bytes"
 	"errors"
+	"hash/maphash"
+	"math"
 	"sort"
 )
 
@@ -26,17 +29,104 @@ type MapAddr struct {
 	Symbol string
 }
 
+// Map is the index of the symbols of a perf map. Perf maps of runtimes like V8
+// have tens of thousands of entries, often of the same symbols as functions
+// are compiled again, so the symbols are interned in a single arena the
+// entries refer to.
 type Map struct {
-	addrs []MapAddr
+	// Sorted by end address to allow binary search during look-up. End to
+	// find the (closest) address _before_ the end. This could be an inlined
+	// instruction within a larger blob.
+	entries []mapEntry
+	arena   string
+}
+
+// mapEntry is a MapAddr with its symbol in the arena of its Map.
+type mapEntry struct {
+	start, end uint64
+	symbolOff  uint32
+	symbolLen  uint32
 }
 
 func (p *Map) Lookup(addr uint64) (string, error) {
-	idx := sort.Search(len(p.addrs), func(i int) bool {
-		return addr < p.addrs[i].End
+	idx := sort.Search(len(p.entries), func(i int) bool {
+		return addr < p.entries[i].end
 	})
-	if idx == len(p.addrs) || p.addrs[idx].Start > addr {
+	if idx == len(p.entries) || p.entries[idx].start > addr {
 		return "", ErrNoSymbolFound
 	}
 
-	return p.addrs[idx].Symbol, nil
+	return p.symbol(&p.entries[idx]), nil
+}
+
+func (p *Map) symbol(e *mapEntry) string {
+	return p.arena[e.symbolOff : e.symbolOff+e.symbolLen]
+}
+
+// len returns the number of entries of the map.
+func (p *Map) len() int {
+	return len(p.entries)
+}
+
+// addr returns the i-th entry of the map, by end address.
+func (p *Map) addr(i int) MapAddr {
+	e := &p.entries[i]
+	return MapAddr{Start: e.start, End: e.end, Symbol: p.symbol(e)}
+}
+
+var errMapTooLarge = errors.New("perf map symbols too large")
+
+// mapBuilder builds a Map, interning the symbols of its entries.
+type mapBuilder struct {
+	entries []mapEntry
+	arena   []byte
+	// Offsets of the symbols in the arena by their hash, so the symbols
+	// aren't copied once more as keys while the map is built.
+	seed     maphash.Seed
+	interned map[uint64]uint32
+}
+
+// newMapBuilder creates a mapBuilder for about the given number of entries,
+// whose symbols are about the given size in total.
+func newMapBuilder(entries, symbolsSize int) *mapBuilder {
+	return &mapBuilder{
+		entries:  make([]mapEntry, 0, entries),
+		arena:    make([]byte, 0, symbolsSize),
+		seed:     maphash.MakeSeed(),
+		interned: make(map[uint64]uint32, entries),
+	}
+}
+
+func (b *mapBuilder) add(start, end uint64, symbol []byte) error {
+	h := maphash.Bytes(b.seed, symbol)
+	off, ok := b.interned[h]
+	symbolEnd := int(off) + len(symbol)
+	if !ok || symbolEnd > len(b.arena) || !bytes.Equal(b.arena[off:symbolEnd], symbol) {
+		if len(b.arena)+len(symbol) > math.MaxUint32 {
+			return errMapTooLarge
+		}
+		off = uint32(len(b.arena))
+		b.arena = append(b.arena, symbol...)
+		if !ok {
+			// Colliding symbols are left out.
+			b.interned[h] = off
+		}
+	}
+	b.entries = append(b.entries, mapEntry{start: start, end: end, symbolOff: off, symbolLen: uint32(len(symbol))})
+	return nil
+}
+
+// build returns the Map, which only holds on to as much memory as its
+// entries and their symbols need, however off the estimates of their sizes
+// were.
+func (b *mapBuilder) build() Map {
+	entries := b.entries
+	if cap(entries) > len(entries)+len(entries)/8 {
+		entries = make([]mapEntry, len(b.entries))
+		copy(entries, b.entries)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].end < entries[j].end
+	})
+	return Map{entries: entries, arena: string(b.arena)}
 }
@@ -22,7 +22,6 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"sort"
 	"time"
 
 	"github.com/go-kit/log"
@@ -32,6 +31,7 @@ import (
 
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/namespace"
+	"github.com/parca-dev/parca-agent/pkg/process"
 )
 
 type PerfMapCache struct {
@@ -39,6 +39,7 @@ type PerfMapCache struct {
 
 	cache   burrow.Cache
 	nsCache *namespace.Cache
+	rootFS  *process.RootFS
 }
 
 type perfMapCacheValue struct {
@@ -67,24 +68,18 @@ func ReadPerfMap(fileName string) (Map, error) {
 		return Map{}, err
 	}
 
-	// Estimate the number of lines in the map file
-	// and allocate a string converter when the file is sufficiently large.
+	// Estimate the number of lines in the map file and the size of their
+	// symbols.
 	const (
 		avgLineLen = 60
 		avgFuncLen = 42
 	)
-	fileSize := stat.Size()
-	linesCount := int(fileSize / avgLineLen)
-	convBufSize := 0
-	if linesCount > 400 {
-		convBufSize = linesCount * avgFuncLen
-	}
+	linesCount := int(stat.Size() / avgLineLen)
 
 	r := bufio.NewReader(fd)
-	addrs := make([]MapAddr, 0, linesCount)
-	conv := newStringConverter(convBufSize)
+	b := newMapBuilder(linesCount, linesCount*avgFuncLen)
 	for {
-		b, err := r.ReadSlice('\n')
+		line, err := r.ReadSlice('\n')
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
@@ -92,31 +87,28 @@ func ReadPerfMap(fileName string) (Map, error) {
 			return Map{}, err
 		}
 
-		line, err := parsePerfMapLine(b, conv)
+		start, end, symbol, err := parsePerfMapLine(line)
 		if err != nil {
 			return Map{}, err
 		}
-
-		addrs = append(addrs, line)
+		if err := b.add(start, end, symbol); err != nil {
+			return Map{}, err
+		}
 	}
-	// Sorted by end address to allow binary search during look-up. End to find
-	// the (closest) address _before_ the end. This could be an inlined instruction
-	// within a larger blob.
-	sort.Slice(addrs, func(i, j int) bool {
-		return addrs[i].End < addrs[j].End
-	})
-	return Map{addrs: addrs}, nil
+	return b.build(), nil
 }
 
-func parsePerfMapLine(b []byte, conv *stringConverter) (MapAddr, error) {
+// parsePerfMapLine returns the address range and the symbol of a line of a
+// perf map. The symbol is only valid until the next line is read.
+func parsePerfMapLine(b []byte) (uint64, uint64, []byte, error) {
 	firstSpace := bytes.Index(b, []byte(" "))
 	if firstSpace == -1 {
-		return MapAddr{}, fmt.Errorf("invalid line: %s", b)
+		return 0, 0, nil, fmt.Errorf("invalid line: %s", b)
 	}
 
 	secondSpace := bytes.Index(b[firstSpace+1:], []byte(" "))
 	if secondSpace == -1 {
-		return MapAddr{}, fmt.Errorf("invalid line: %s", b)
+		return 0, 0, nil, fmt.Errorf("invalid line: %s", b)
 	}
 
 	addrBytes := b[:firstSpace]
@@ -132,40 +124,42 @@ func parsePerfMapLine(b []byte, conv *stringConverter) (MapAddr, error) {
 
 	start, err := parseHexToUint64(addrBytes)
 	if err != nil {
-		return MapAddr{}, fmt.Errorf("parsing start failed on %v: %w", string(b), err)
+		return 0, 0, nil, fmt.Errorf("parsing start failed on %v: %w", string(b), err)
 	}
 	size, err := parseHexToUint64(sizeBytes)
 	if err != nil {
-		return MapAddr{}, fmt.Errorf("parsing end failed on %v: %w", string(b), err)
+		return 0, 0, nil, fmt.Errorf("parsing end failed on %v: %w", string(b), err)
 	}
 	if start+size < start {
-		return MapAddr{}, fmt.Errorf("overflowed mapping: %v", string(b))
+		return 0, 0, nil, fmt.Errorf("overflowed mapping: %v", string(b))
 	}
 
 	if symbolBytes[len(symbolBytes)-1] == '\n' {
 		symbolBytes = symbolBytes[:len(symbolBytes)-1]
 	}
 
-	return MapAddr{
-		Start:  start,
-		End:    start + size,
-		Symbol: conv.String(symbolBytes),
-	}, nil
+	return start, start + size, symbolBytes, nil
 }
 
-func NewPerfMapCache(logger log.Logger, reg prometheus.Registerer, nsCache *namespace.Cache, profilingDuration time.Duration) *PerfMapCache {
+func NewPerfMapCache(logger log.Logger, reg prometheus.Registerer, nsCache *namespace.Cache, rootFS *process.RootFS, profilingDuration time.Duration) *PerfMapCache {
 	return &PerfMapCache{
 		logger: logger,
-		cache: burrow.New(
+		cache: cache.NewSizedCache(
 			burrow.WithMaximumSize(512),
 			burrow.WithExpireAfterAccess(10*profilingDuration),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "perf_map_cache")),
 		),
 		nsCache: nsCache,
+		rootFS:  rootFS,
 	}
 }
 
 // MapForPID returns the Map for the given pid if it exists.
+// CacheSizes returns how many perf maps are cached.
+func (p *PerfMapCache) CacheSizes() map[string]int {
+	return map[string]int{"perf_map_cache": cache.Len(p.cache)}
+}
+
 func (p *PerfMapCache) PerfMapForPID(pid int) (*Map, error) {
 	// NOTE(zecke): There are various limitations and things to note.
 	// 1st) The input file is "tainted" and under control by the user. By all
@@ -180,7 +174,10 @@ func (p *PerfMapCache) PerfMapForPID(pid int) (*Map, error) {
 	}
 	nsPid := nsPids[len(nsPids)-1]
 
-	perfFile := fmt.Sprintf("/proc/%d/root/tmp/perf-%d.map", pid, nsPid)
+	perfFile, err := p.rootFS.Path(pid, fmt.Sprintf("/tmp/perf-%d.map", nsPid))
+	if err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(perfFile)
 	if os.IsNotExist(err) {
 		return nil, ErrPerfMapNotFound
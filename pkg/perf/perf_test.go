@@ -17,14 +17,16 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/jit"
 )
 
 func TestPerfMapParse(t *testing.T) {
 	res, err := ReadPerfMap("testdata/nodejs-perf-map")
 	require.NoError(t, err)
-	require.Len(t, res.addrs, 28)
+	require.Equal(t, 28, res.len())
 	// Check for 4edd3cca B0 LazyCompile:~Timeout internal/timers.js:55
-	require.Equal(t, res.addrs[12], MapAddr{0x4edd4f12, 0x4edd4f47, "LazyCompile:~remove internal/linkedlist.js:15"})
+	require.Equal(t, res.addr(12), MapAddr{0x4edd4f12, 0x4edd4f47, "LazyCompile:~remove internal/linkedlist.js:15"})
 
 	// Look-up a symbol.
 	sym, err := res.Lookup(0x4edd4f12 + 4)
@@ -35,11 +37,82 @@ func TestPerfMapParse(t *testing.T) {
 	require.ErrorIs(t, err, ErrNoSymbolFound)
 }
 
+func TestMapInternsSymbols(t *testing.T) {
+	b := newMapBuilder(0, 0)
+	require.NoError(t, b.add(0x30, 0x40, []byte("LazyCompile:~foo")))
+	require.NoError(t, b.add(0x10, 0x20, []byte("LazyCompile:~foo")))
+	require.NoError(t, b.add(0x20, 0x30, []byte("LazyCompile:*bar")))
+	m := b.build()
+	require.Len(t, m.arena, len("LazyCompile:~foo")+len("LazyCompile:*bar"))
+
+	require.Equal(t, MapAddr{0x10, 0x20, "LazyCompile:~foo"}, m.addr(0))
+	require.Equal(t, MapAddr{0x20, 0x30, "LazyCompile:*bar"}, m.addr(1))
+	require.Equal(t, MapAddr{0x30, 0x40, "LazyCompile:~foo"}, m.addr(2))
+	sym, err := m.Lookup(0x25)
+	require.NoError(t, err)
+	require.Equal(t, "LazyCompile:*bar", sym)
+}
+
 func TestPerfMapParseErlangPerfMap(t *testing.T) {
 	_, err := ReadPerfMap("testdata/erlang-perf-map")
 	require.NoError(t, err)
 }
 
+func TestJITMapLookup(t *testing.T) {
+	load := func(ts, addr, size, index uint64, name string) *jit.JRCodeLoad {
+		return &jit.JRCodeLoad{Prefix: &jit.JRPrefix{Timestamp: ts}, CodeAddr: addr, CodeSize: size, CodeIndex: index, Name: name}
+	}
+	dump := &jit.JITDump{
+		Header: &jit.JITHeader{},
+		CodeLoads: []*jit.JRCodeLoad{
+			load(100, 0x1000, 0x100, 1, "a"),
+			load(110, 0x2000, 0x100, 2, "b"),
+			// The code of a was garbage collected, and the range reused.
+			load(200, 0x1080, 0x40, 3, "c"),
+		},
+		CodeMoves: []*jit.JRCodeMove{
+			{Prefix: &jit.JRPrefix{Timestamp: 300}, NewCodeAddr: 0x3000, CodeSize: 0x100, CodeIndex: 2},
+		},
+	}
+	const start = 1_000_000
+	m := newJITMap(dump, start)
+
+	for _, tc := range []struct {
+		addr     uint64
+		ts       int64
+		expected string
+	}{
+		{0x1090, start + 150, "a"},
+		{0x1090, start + 250, "c"},
+		{0x1090, 0, "c"},
+		{0x1010, start + 250, "a"},
+		{0x2010, start + 250, "b"},
+		{0x2010, start + 350, ""},
+		{0x2010, 0, ""},
+		{0x3010, start + 350, "b"},
+		{0x3010, start + 250, ""},
+		// Before anything was loaded.
+		{0x1010, start + 50, ""},
+	} {
+		sym, err := m.Lookup(tc.addr, tc.ts)
+		if tc.expected == "" {
+			require.ErrorIs(t, err, ErrNoSymbolFound, "%#x at %d", tc.addr, tc.ts)
+			continue
+		}
+		require.NoError(t, err, "%#x at %d", tc.addr, tc.ts)
+		require.Equal(t, tc.expected, sym, "%#x at %d", tc.addr, tc.ts)
+	}
+
+	// Without the times of the records, only the current code is known.
+	dump.Header.Flags = jit.JITDumpFlagArchTimestamp
+	m = newJITMap(dump, start)
+	sym, err := m.Lookup(0x1090, start+150)
+	require.NoError(t, err)
+	require.Equal(t, "c", sym)
+	_, err = m.Lookup(0x2010, start+150)
+	require.ErrorIs(t, err, ErrNoSymbolFound)
+}
+
 func BenchmarkPerfMapParse(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,181 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"sync"
+
+	pprofprofile "github.com/google/pprof/profile"
+
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+const (
+	// Smallest chunk the objects of a profile are allocated in.
+	minSlabSize = 64
+	// Number of processes the sizes of the last profile are kept for.
+	maxProfileSizes = 4096
+)
+
+// slab hands out the objects of a profile from chunks allocated at once,
+// rather than one by one. The chunks live as long as the profile does.
+type slab[T any] struct {
+	free []T
+	// Size of the next chunk.
+	size int
+}
+
+func newSlab[T any](size int) slab[T] {
+	return slab[T]{size: size}
+}
+
+// take returns n objects with a capacity of n, so that appending to them
+// doesn't overwrite the next ones.
+func (s *slab[T]) take(n int) []T {
+	if len(s.free) < n {
+		size := s.size
+		if size < minSlabSize {
+			size = minSlabSize
+		}
+		if size < n {
+			size = n
+		}
+		s.free = make([]T, size)
+		s.size = minSlabSize
+	}
+	t := s.free[:n:n]
+	s.free = s.free[n:]
+	return t
+}
+
+func (s *slab[T]) next() *T {
+	return &s.take(1)[0]
+}
+
+// indexes are the lookup tables of a conversion. They don't outlive it, and
+// are pooled as they grow as large as the profiles converted.
+type indexes struct {
+	kernelAddresses map[uint64]struct{}
+
+	functionIndex        map[string]*pprofprofile.Function
+	addrLocationIndex    map[uint64]*pprofprofile.Location
+	perfmapLocationIndex map[string]*pprofprofile.Location
+	jitdumpLocationIndex map[string]*pprofprofile.Location
+	kernelLocationIndex  map[string]*pprofprofile.Location
+	vdsoLocationIndex    map[string]*pprofprofile.Location
+
+	interpreterFunctionIndex map[profile.Function]*pprofprofile.Function
+	interpreterLocationIndex map[profile.Line]*pprofprofile.Location
+	unknownLocationIndex     map[unknownLocationKey]*pprofprofile.Location
+	localFunctionIndex       map[profile.Function]*pprofprofile.Function
+	localLocationIndex       map[localLocationKey]*pprofprofile.Location
+}
+
+var indexPool = sync.Pool{
+	New: func() any {
+		return &indexes{
+			kernelAddresses: map[uint64]struct{}{},
+
+			functionIndex:        map[string]*pprofprofile.Function{},
+			addrLocationIndex:    map[uint64]*pprofprofile.Location{},
+			perfmapLocationIndex: map[string]*pprofprofile.Location{},
+			jitdumpLocationIndex: map[string]*pprofprofile.Location{},
+			kernelLocationIndex:  map[string]*pprofprofile.Location{},
+			vdsoLocationIndex:    map[string]*pprofprofile.Location{},
+
+			interpreterFunctionIndex: map[profile.Function]*pprofprofile.Function{},
+			interpreterLocationIndex: map[profile.Line]*pprofprofile.Location{},
+			unknownLocationIndex:     map[unknownLocationKey]*pprofprofile.Location{},
+			localFunctionIndex:       map[profile.Function]*pprofprofile.Function{},
+			localLocationIndex:       map[localLocationKey]*pprofprofile.Location{},
+		}
+	},
+}
+
+// release empties the tables, which otherwise keep the profile alive, and
+// puts them back in the pool.
+func (i *indexes) release() {
+	for k := range i.kernelAddresses {
+		delete(i.kernelAddresses, k)
+	}
+	for k := range i.functionIndex {
+		delete(i.functionIndex, k)
+	}
+	for k := range i.addrLocationIndex {
+		delete(i.addrLocationIndex, k)
+	}
+	for k := range i.perfmapLocationIndex {
+		delete(i.perfmapLocationIndex, k)
+	}
+	for k := range i.jitdumpLocationIndex {
+		delete(i.jitdumpLocationIndex, k)
+	}
+	for k := range i.kernelLocationIndex {
+		delete(i.kernelLocationIndex, k)
+	}
+	for k := range i.vdsoLocationIndex {
+		delete(i.vdsoLocationIndex, k)
+	}
+	for k := range i.interpreterFunctionIndex {
+		delete(i.interpreterFunctionIndex, k)
+	}
+	for k := range i.interpreterLocationIndex {
+		delete(i.interpreterLocationIndex, k)
+	}
+	for k := range i.unknownLocationIndex {
+		delete(i.unknownLocationIndex, k)
+	}
+	for k := range i.localFunctionIndex {
+		delete(i.localFunctionIndex, k)
+	}
+	for k := range i.localLocationIndex {
+		delete(i.localLocationIndex, k)
+	}
+	indexPool.Put(i)
+}
+
+// profileSizes are the sizes of the last profile converted for a process,
+// which the next one is usually close to.
+type profileSizes struct {
+	locations int
+	lines     int
+	functions int
+}
+
+func (m *ConverterMetrics) lastProfileSizes(pid int) profileSizes {
+	if m == nil {
+		return profileSizes{}
+	}
+
+	m.sizesMtx.Lock()
+	defer m.sizesMtx.Unlock()
+	return m.sizes[pid]
+}
+
+func (m *ConverterMetrics) setLastProfileSizes(pid int, sizes profileSizes) {
+	if m == nil {
+		return
+	}
+
+	m.sizesMtx.Lock()
+	defer m.sizesMtx.Unlock()
+	if _, ok := m.sizes[pid]; !ok && len(m.sizes) >= maxProfileSizes {
+		// The processes come and go, any of them can make room.
+		for evicted := range m.sizes {
+			delete(m.sizes, evicted)
+			break
+		}
+	}
+	m.sizes[pid] = sizes
+}
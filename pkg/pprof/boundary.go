@@ -0,0 +1,137 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import "strings"
+
+// StackBoundaryLabel is the label of the samples whose kernel and user stacks
+// don't make up a single call stack, with the reason as its value, so that
+// they can be told apart rather than read as user code calling the kernel.
+const StackBoundaryLabel = "stack_boundary"
+
+const (
+	// The kernel stack was taken while handling a hardware interrupt, which
+	// was not called by the code it interrupted.
+	stackBoundaryIRQ = "irq"
+	// The kernel stack was taken while running softirqs, which were not
+	// called by the code running before them either.
+	stackBoundarySoftIRQ = "softirq"
+	// Addresses were on the wrong side of the boundary and were moved or
+	// dropped.
+	stackBoundaryCorrected = "corrected"
+)
+
+// Prefixes of the kernel functions entering interrupt handling on x86_64,
+// arm64 and riscv64, and of the ones running softirqs.
+var (
+	irqEntryPrefixes = []string{
+		"asm_common_interrupt",
+		"asm_sysvec_",
+		"common_interrupt",
+		"sysvec_",
+		"__sysvec_",
+		"el0_interrupt",
+		"el1_interrupt",
+		"gic_handle_irq",
+		"handle_riscv_irq",
+	}
+	softIRQPrefixes = []string{
+		"__do_softirq",
+		"handle_softirqs",
+		"do_softirq",
+	}
+)
+
+// isKernelAddress reports whether addr is in the upper half of the address
+// space, where the kernel is on all the supported architectures.
+func isKernelAddress(addr uint64) bool {
+	return addr>>63 == 1
+}
+
+// stackBoundary is where the kernel stack of a sample ends and its user stack
+// starts, once the addresses on the wrong side are dealt with.
+type stackBoundary struct {
+	kernelStack []uint64
+	// Index of the first user stack frame kept.
+	userStart int
+	corrected bool
+}
+
+// newStackBoundary validates the kernel/user boundary of the given stacks,
+// sorted from the leaf. The leaf frames of the user stack in kernel space,
+// e.g. when it was walked from kernel registers, are the kernel stack when
+// there is none, and are dropped otherwise. The user space addresses of the
+// kernel stack are dropped.
+func newStackBoundary(userStack, kernelStack []uint64) stackBoundary {
+	b := stackBoundary{kernelStack: kernelStack}
+	for b.userStart < len(userStack) && isKernelAddress(userStack[b.userStart]) {
+		b.userStart++
+	}
+	if b.userStart > 0 {
+		b.corrected = true
+		if len(kernelStack) == 0 {
+			b.kernelStack = userStack[:b.userStart]
+		}
+	}
+
+	for i, addr := range b.kernelStack {
+		if isKernelAddress(addr) {
+			continue
+		}
+		kept := make([]uint64, i, len(b.kernelStack)-1)
+		copy(kept, b.kernelStack[:i])
+		for _, addr := range b.kernelStack[i+1:] {
+			if isKernelAddress(addr) {
+				kept = append(kept, addr)
+			}
+		}
+		b.kernelStack = kept
+		b.corrected = true
+		break
+	}
+	return b
+}
+
+// reason returns why the stacks don't make up a single call stack, given the
+// symbols of the kernel stack, or an empty string if they do.
+func (b stackBoundary) reason(kernelSymbols map[uint64]string) string {
+	irq := false
+	for _, addr := range b.kernelStack {
+		name := kernelSymbols[addr]
+		if hasAnyPrefix(name, softIRQPrefixes) {
+			// Softirqs are usually run on the way out of an interrupt.
+			return stackBoundarySoftIRQ
+		}
+		if hasAnyPrefix(name, irqEntryPrefixes) {
+			irq = true
+		}
+	}
+	switch {
+	case irq:
+		return stackBoundaryIRQ
+	case b.corrected:
+		return stackBoundaryCorrected
+	default:
+		return ""
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStackBoundary(t *testing.T) {
+	const (
+		kernelA = 0xffffffff81000010
+		kernelB = 0xffffffff81000020
+		userA   = 0x401000
+		userB   = 0x402000
+	)
+
+	// Consistent stacks are kept as they are.
+	b := newStackBoundary([]uint64{userA, userB}, []uint64{kernelA, kernelB})
+	require.Equal(t, stackBoundary{kernelStack: []uint64{kernelA, kernelB}}, b)
+	require.Empty(t, b.reason(nil))
+
+	// Kernel leaf frames of the user stack are the kernel stack when there
+	// is none.
+	b = newStackBoundary([]uint64{kernelA, kernelB, userA}, nil)
+	require.Equal(t, stackBoundary{kernelStack: []uint64{kernelA, kernelB}, userStart: 2, corrected: true}, b)
+	require.Equal(t, stackBoundaryCorrected, b.reason(nil))
+
+	// And are dropped otherwise, as are the user addresses of the kernel
+	// stack.
+	b = newStackBoundary([]uint64{kernelB, userA}, []uint64{kernelA, userB, kernelB})
+	require.Equal(t, stackBoundary{kernelStack: []uint64{kernelA, kernelB}, userStart: 1, corrected: true}, b)
+
+	// Interrupts are told apart from the corrections.
+	b = newStackBoundary([]uint64{userA}, []uint64{kernelA, kernelB})
+	symbols := map[uint64]string{kernelA: "handle_irq_event", kernelB: "asm_common_interrupt"}
+	require.Equal(t, stackBoundaryIRQ, b.reason(symbols))
+	symbols[kernelA] = "__do_softirq"
+	require.Equal(t, stackBoundarySoftIRQ, b.reason(symbols))
+}
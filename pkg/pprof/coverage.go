@@ -0,0 +1,229 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// symbolizationResult tells how the address of a frame is symbolized.
+type symbolizationResult int
+
+const (
+	// By the agent, e.g. from perf maps or by the interpreter unwinders.
+	symbolizedLocally symbolizationResult = iota
+	// By the server, from the debug information of the binary.
+	symbolizedByServer
+	// By neither, e.g. the binary has no build ID or the address can't be
+	// normalized.
+	unsymbolizable
+
+	numSymbolizationResults
+)
+
+var symbolizationResultNames = [numSymbolizationResults]string{
+	symbolizedLocally:  "local",
+	symbolizedByServer: "server",
+	unsymbolizable:     "unsymbolizable",
+}
+
+// binaryCounts counts the sampled addresses of a binary by how they are
+// symbolized, weighted by the number of times they were sampled.
+type binaryCounts struct {
+	buildID string
+	file    string
+	counts  [numSymbolizationResults]uint64
+}
+
+// symbolizationCounts are the counts of the binaries of a profile, by
+// coverageKey. A nil one counts nothing.
+type symbolizationCounts map[string]*binaryCounts
+
+// coverageKey identifies a binary by its build ID, or by its file when it has
+// none, such as the mappings of JIT compiled code.
+func coverageKey(m *pprofprofile.Mapping) string {
+	if m.BuildID != "" {
+		return m.BuildID
+	}
+	return m.File
+}
+
+func (s symbolizationCounts) add(m *pprofprofile.Mapping, result symbolizationResult, n uint64) {
+	if s == nil {
+		return
+	}
+	key := coverageKey(m)
+	b, ok := s[key]
+	if !ok {
+		b = &binaryCounts{buildID: m.BuildID, file: m.File}
+		s[key] = b
+	}
+	b.counts[result] += n
+}
+
+var (
+	descSymbolizationAddresses = prometheus.NewDesc(
+		"parca_agent_symbolization_addresses_total",
+		"Total number of sampled addresses of a binary by how they are symbolized.",
+		[]string{"build_id", "file", "result"}, nil,
+	)
+	descSymbolizationCoverage = prometheus.NewDesc(
+		"parca_agent_symbolization_coverage_ratio",
+		"Share of the sampled addresses of a binary by how they are symbolized.",
+		[]string{"build_id", "file", "result"}, nil,
+	)
+)
+
+// SymbolizationCoverage tracks, for the most recently sampled binaries, the
+// share of their sampled addresses symbolized by the agent, left for the
+// server to symbolize, or that can't be symbolized, so the binaries that need
+// their debug information looked at can be found. It is a collector of the
+// metrics of each binary.
+type SymbolizationCoverage struct {
+	mtx         sync.Mutex
+	binaries    map[string]*binaryCoverage
+	maxBinaries int
+}
+
+type binaryCoverage struct {
+	binaryCounts
+	lastSampled time.Time
+}
+
+// NewSymbolizationCoverage returns the coverage of up to the given number of
+// binaries, registered with the given registerer. The binaries sampled the
+// least recently are forgotten to make room for new ones.
+func NewSymbolizationCoverage(reg prometheus.Registerer, maxBinaries int) *SymbolizationCoverage {
+	c := &SymbolizationCoverage{
+		binaries:    map[string]*binaryCoverage{},
+		maxBinaries: maxBinaries,
+	}
+	if reg != nil {
+		reg.MustRegister(c)
+	}
+	return c
+}
+
+// record adds the counts of a converted profile.
+func (c *SymbolizationCoverage) record(counts symbolizationCounts) {
+	if c == nil || len(counts) == 0 {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	for key, counts := range counts {
+		b, ok := c.binaries[key]
+		if !ok {
+			if len(c.binaries) >= c.maxBinaries {
+				c.evictLeastRecent()
+			}
+			b = &binaryCoverage{binaryCounts: binaryCounts{buildID: counts.buildID, file: counts.file}}
+			c.binaries[key] = b
+		}
+		for i, n := range counts.counts {
+			b.counts[i] += n
+		}
+		b.lastSampled = now
+	}
+}
+
+func (c *SymbolizationCoverage) evictLeastRecent() {
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, b := range c.binaries {
+		if oldest.IsZero() || b.lastSampled.Before(oldest) {
+			oldestKey, oldest = key, b.lastSampled
+		}
+	}
+	delete(c.binaries, oldestKey)
+}
+
+// BinaryCoverage is the symbolization coverage of a binary.
+type BinaryCoverage struct {
+	BuildID string `json:"build_id,omitempty"`
+	File    string `json:"file"`
+	// Number of sampled addresses and their share, by how they are
+	// symbolized.
+	Addresses map[string]uint64  `json:"addresses"`
+	Ratios    map[string]float64 `json:"ratios"`
+}
+
+// Binaries returns the coverage of the binaries, the ones with the most
+// unsymbolizable addresses first.
+func (c *SymbolizationCoverage) Binaries() []BinaryCoverage {
+	if c == nil {
+		return []BinaryCoverage{}
+	}
+
+	c.mtx.Lock()
+	binaries := make([]binaryCounts, 0, len(c.binaries))
+	for _, b := range c.binaries {
+		binaries = append(binaries, b.binaryCounts)
+	}
+	c.mtx.Unlock()
+
+	sort.Slice(binaries, func(i, j int) bool {
+		if binaries[i].counts[unsymbolizable] != binaries[j].counts[unsymbolizable] {
+			return binaries[i].counts[unsymbolizable] > binaries[j].counts[unsymbolizable]
+		}
+		return binaries[i].file < binaries[j].file
+	})
+
+	res := make([]BinaryCoverage, 0, len(binaries))
+	for _, b := range binaries {
+		var total uint64
+		for _, n := range b.counts {
+			total += n
+		}
+		bc := BinaryCoverage{
+			BuildID:   b.buildID,
+			File:      b.file,
+			Addresses: make(map[string]uint64, numSymbolizationResults),
+			Ratios:    make(map[string]float64, numSymbolizationResults),
+		}
+		for i, n := range b.counts {
+			name := symbolizationResultNames[i]
+			bc.Addresses[name] = n
+			if total > 0 {
+				bc.Ratios[name] = float64(n) / float64(total)
+			}
+		}
+		res = append(res, bc)
+	}
+	return res
+}
+
+func (c *SymbolizationCoverage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descSymbolizationAddresses
+	ch <- descSymbolizationCoverage
+}
+
+func (c *SymbolizationCoverage) Collect(ch chan<- prometheus.Metric) {
+	for _, b := range c.Binaries() {
+		for result, n := range b.Addresses {
+			ch <- prometheus.MustNewConstMetric(descSymbolizationAddresses, prometheus.CounterValue, float64(n), b.BuildID, b.File, result)
+			ch <- prometheus.MustNewConstMetric(descSymbolizationCoverage, prometheus.GaugeValue, b.Ratios[result], b.BuildID, b.File, result)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"testing"
+
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymbolizationCoverage(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewSymbolizationCoverage(reg, 2)
+
+	var (
+		app  = &pprofprofile.Mapping{BuildID: "abc", File: "/usr/bin/app"}
+		jit  = &pprofprofile.Mapping{File: "jit"}
+		libc = &pprofprofile.Mapping{BuildID: "def", File: "/usr/lib/libc.so.6"}
+	)
+	counts := symbolizationCounts{}
+	counts.add(app, symbolizedByServer, 3)
+	counts.add(app, unsymbolizable, 1)
+	counts.add(jit, symbolizedLocally, 2)
+	c.record(counts)
+
+	binaries := c.Binaries()
+	require.Len(t, binaries, 2)
+	require.Equal(t, "abc", binaries[0].BuildID)
+	require.Equal(t, uint64(3), binaries[0].Addresses["server"])
+	require.Equal(t, 0.25, binaries[0].Ratios["unsymbolizable"])
+	require.Equal(t, 1.0, binaries[1].Ratios["local"])
+	require.Equal(t, 6, testutil.CollectAndCount(reg, "parca_agent_symbolization_coverage_ratio"))
+
+	// The binary sampled the least recently is forgotten.
+	c.binaries["jit"].lastSampled = c.binaries["abc"].lastSampled.Add(-1)
+	counts = symbolizationCounts{}
+	counts.add(libc, symbolizedByServer, 1)
+	c.record(counts)
+	require.Len(t, c.Binaries(), 2)
+	require.NotContains(t, c.binaries, "jit")
+}
@@ -14,31 +14,108 @@
 package pprof
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/pkg/logger"
 )
 
 const (
-	labelFrameDropReasonMappingNil = "mapping_nil"
+	labelFrameDropReasonMappingNil     = "mapping_nil"
+	labelFrameDropReasonUnsymbolizable = "unsymbolizable"
+
+	lvSuccess = "success"
+	lvFail    = "fail"
+
+	// Interval in which an error of each kind is logged at most once, as
+	// they can happen for every address converted.
+	errorLogInterval = time.Minute
 )
 
 type ConverterMetrics struct {
-	frameDrop *prometheus.CounterVec
+	frameDrop          *prometheus.CounterVec
+	buildIDsResolved   *prometheus.CounterVec
+	stacksTruncated    prometheus.Counter
+	stacksInconsistent *prometheus.CounterVec
+
+	// Shared by the converters of the profiler, which only live for a
+	// single profile.
+	errorLogs *logger.Deduplicator
+
+	// Sizes of the last profile of each process, to allocate the next one
+	// at once.
+	sizesMtx sync.Mutex
+	sizes    map[int]profileSizes
 }
 
-func NewConverterMetrics(reg prometheus.Registerer) *ConverterMetrics {
+func NewConverterMetrics(reg prometheus.Registerer, profilerType string) *ConverterMetrics {
 	m := &ConverterMetrics{
 		frameDrop: promauto.With(reg).NewCounterVec(
 			prometheus.CounterOpts{
 				Name:        "parca_agent_profiler_frame_drop_total",
 				Help:        "Number of addresses dropped from the profile.",
-				ConstLabels: map[string]string{"type": "cpu"},
+				ConstLabels: map[string]string{"type": profilerType},
+			},
+			[]string{"reason"},
+		),
+		buildIDsResolved: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_mapping_build_ids_resolved_total",
+				Help:        "Number of build IDs of the mappings of the profiles looked up because they were missing.",
+				ConstLabels: map[string]string{"type": profilerType},
+			},
+			[]string{"result"},
+		),
+		stacksTruncated: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_stacks_truncated_total",
+				Help:        "Number of samples whose stacks were cut at the maximum stack depth. Their count per target is the one of the [truncated] root frame in its profiles.",
+				ConstLabels: map[string]string{"type": profilerType},
+			},
+		),
+		stacksInconsistent: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_stacks_inconsistent_total",
+				Help:        "Number of samples whose kernel and user stacks don't make up a single call stack, labeled with " + StackBoundaryLabel + ".",
+				ConstLabels: map[string]string{"type": profilerType},
 			},
 			[]string{"reason"},
 		),
+		errorLogs: logger.NewDeduplicator(reg, profilerType+"_converter", errorLogInterval),
+		sizes:     map[int]profileSizes{},
 	}
 
 	m.frameDrop.WithLabelValues(labelFrameDropReasonMappingNil)
+	m.frameDrop.WithLabelValues(labelFrameDropReasonUnsymbolizable)
+	m.buildIDsResolved.WithLabelValues(lvSuccess)
+	m.buildIDsResolved.WithLabelValues(lvFail)
+	for _, reason := range []string{stackBoundaryIRQ, stackBoundarySoftIRQ, stackBoundaryCorrected} {
+		m.stacksInconsistent.WithLabelValues(reason)
+	}
 
 	return m
 }
+
+func (m *ConverterMetrics) buildIDResolved(result string) {
+	if m == nil {
+		return
+	}
+	m.buildIDsResolved.WithLabelValues(result).Inc()
+}
+
+func (m *ConverterMetrics) inconsistentStack(reason string, samples uint64) {
+	if m == nil {
+		return
+	}
+	m.stacksInconsistent.WithLabelValues(reason).Add(float64(samples))
+}
+
+func (m *ConverterMetrics) stackTruncated(samples uint64) {
+	if m == nil {
+		return
+	}
+	m.stacksTruncated.Add(float64(samples))
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	pprofprofile "github.com/google/pprof/profile"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
 
 	"github.com/parca-dev/parca-agent/pkg/ksym"
 	"github.com/parca-dev/parca-agent/pkg/perf"
@@ -34,50 +35,112 @@ type VDSOSymbolizer interface {
 	Resolve(addr uint64, m *process.Mapping) (string, error)
 }
 
+// LocalSymbolizer symbolizes the normalized addresses of the native binaries
+// on the host, rather than leaving them to the server. The lines are ordered
+// innermost inlined function first, with the function names mangled.
+type LocalSymbolizer interface {
+	Symbolize(m *process.Mapping, addr uint64) ([]profile.Line, error)
+}
+
+// UnknownFramePolicy is what becomes of the frames whose address is outside of
+// the mappings of the process, or can't be symbolized.
+type UnknownFramePolicy string
+
+const (
+	// UnknownFramesDrop drops the frames, which shortens the stacks.
+	UnknownFramesDrop UnknownFramePolicy = "drop"
+	// UnknownFramesAddress keeps the raw addresses of the frames, the ones
+	// outside of the mappings in an "[unknown]" mapping.
+	UnknownFramesAddress UnknownFramePolicy = "address"
+	// UnknownFramesPlaceholder replaces the frames with an
+	// "[unknown <mapping>]" function, or "[unknown]" outside of the
+	// mappings.
+	UnknownFramesPlaceholder UnknownFramePolicy = "placeholder"
+)
+
+// TimestampLabel is the numeric label holding the Unix times in nanoseconds
+// at which the stacks of a sample were taken, when they are recorded.
+const TimestampLabel = "timestamp"
+
+// ConverterOptions are the symbolizers and settings shared by the
+// conversions of the profiles of a profiler. Unset symbolizers are skipped.
+type ConverterOptions struct {
+	AddressNormalizer profiler.AddressNormalizer
+	Ksym              *ksym.Ksym
+	VDSOSymbolizer    VDSOSymbolizer
+	LocalSymbolizer   LocalSymbolizer
+	PerfMapCache      *perf.PerfMapCache
+	JitdumpCache      *perf.JitdumpCache
+	Metrics           *ConverterMetrics
+	// Coverage records how the addresses of each binary are symbolized,
+	// when set.
+	Coverage                *SymbolizationCoverage
+	DisableJITSymbolization bool
+	Demangler               *demangle.Demangler
+	UnknownFrames           UnknownFramePolicy
+}
+
 type Converter struct {
 	logger log.Logger
 
 	addressNormalizer       profiler.AddressNormalizer
 	ksym                    *ksym.Ksym
 	vdsoSymbolizer          VDSOSymbolizer
+	localSymbolizer         LocalSymbolizer
 	metrics                 *ConverterMetrics
+	coverage                *SymbolizationCoverage
 	perfMapCache            *perf.PerfMapCache
 	jitdumpCache            *perf.JitdumpCache
 	disableJITSymbolization bool
+	demangler               *demangle.Demangler
+	unknownFrames           UnknownFramePolicy
 
 	// We already have the perf map cache but it Stats() the perf map on every
 	// cache retrieval, but we only want to do that once per conversion.
 	cachedPerfMap    *perf.Map
 	cachedPerfMapErr error
 
-	cachedJitdump    map[string]*perf.Map
+	cachedJitdump    map[string]*perf.JITMap
 	cachedJitdumpErr map[string]error
 
-	functionIndex        map[string]*pprofprofile.Function
-	addrLocationIndex    map[uint64]*pprofprofile.Location
-	perfmapLocationIndex map[string]*pprofprofile.Location
-	jitdumpLocationIndex map[string]*pprofprofile.Location
-	kernelLocationIndex  map[string]*pprofprofile.Location
-	vdsoLocationIndex    map[string]*pprofprofile.Location
+	*indexes
 
-	pid           int
+	// The objects of the profile are allocated in chunks, the first ones as
+	// large as the last profile of the process.
+	locations slab[pprofprofile.Location]
+	lines     slab[pprofprofile.Line]
+	functions slab[pprofprofile.Function]
+
+	pid int
+	// Validates what is read from /proc/<pid> during the conversion, which
+	// may happen after the process exited and its PID got reused.
+	pidfd *process.PIDFD
+	// The executable mappings, in the order of the mappings of the profile.
 	mappings      []*process.Mapping
 	kernelMapping *pprofprofile.Mapping
+	// Only added when there are interpreter frames.
+	interpreterMapping *pprofprofile.Mapping
+	// Only added when there are frames outside of the mappings kept.
+	unknownMapping *pprofprofile.Mapping
+	// Root frame of the samples whose stacks were cut at the maximum stack
+	// depth, only added when there are some.
+	truncatedLocation *pprofprofile.Location
+
+	// How the addresses of each binary are symbolized, recorded in the
+	// coverage once the profile is converted.
+	symbolization symbolizationCounts
 
 	result *pprofprofile.Profile
 }
 
+// NewConverter returns a converter of the samples of the given process,
+// taken from the capture time on at the given period.
 func NewConverter(
 	logger log.Logger,
-	addressNormalizer profiler.AddressNormalizer,
-	ksym *ksym.Ksym,
-	vdsoSymbolizer VDSOSymbolizer,
-	perfMapCache *perf.PerfMapCache,
-	jitdumpCache *perf.JitdumpCache,
-	metrics *ConverterMetrics,
-	disableJITSymbolization bool,
+	options ConverterOptions,
 
 	pid int,
+	pidfd *process.PIDFD,
 	mappings process.Mappings,
 	captureTime time.Time,
 	periodNS int64,
@@ -89,30 +152,43 @@ func NewConverter(
 	}
 	pprofMappings = append(pprofMappings, kernelMapping)
 
+	sizes := options.Metrics.lastProfileSizes(pid)
+
+	var symbolization symbolizationCounts
+	if options.Coverage != nil {
+		symbolization = symbolizationCounts{}
+	}
+
 	return &Converter{
 		logger:                  log.With(logger, "pid", pid),
-		addressNormalizer:       addressNormalizer,
-		ksym:                    ksym,
-		vdsoSymbolizer:          vdsoSymbolizer,
-		perfMapCache:            perfMapCache,
-		jitdumpCache:            jitdumpCache,
-		metrics:                 metrics,
-		disableJITSymbolization: disableJITSymbolization,
-
-		cachedJitdump:    map[string]*perf.Map{},
+		addressNormalizer:       options.AddressNormalizer,
+		ksym:                    options.Ksym,
+		vdsoSymbolizer:          options.VDSOSymbolizer,
+		localSymbolizer:         options.LocalSymbolizer,
+		perfMapCache:            options.PerfMapCache,
+		jitdumpCache:            options.JitdumpCache,
+		metrics:                 options.Metrics,
+		coverage:                options.Coverage,
+		disableJITSymbolization: options.DisableJITSymbolization,
+		demangler:               options.Demangler,
+		unknownFrames:           options.UnknownFrames,
+
+		cachedJitdump:    map[string]*perf.JITMap{},
 		cachedJitdumpErr: map[string]error{},
 
-		functionIndex:        map[string]*pprofprofile.Function{},
-		addrLocationIndex:    map[uint64]*pprofprofile.Location{},
-		perfmapLocationIndex: map[string]*pprofprofile.Location{},
-		jitdumpLocationIndex: map[string]*pprofprofile.Location{},
-		kernelLocationIndex:  map[string]*pprofprofile.Location{},
-		vdsoLocationIndex:    map[string]*pprofprofile.Location{},
+		indexes: indexPool.Get().(*indexes),
+
+		locations: newSlab[pprofprofile.Location](sizes.locations),
+		lines:     newSlab[pprofprofile.Line](sizes.lines),
+		functions: newSlab[pprofprofile.Function](sizes.functions),
 
 		pid:           pid,
-		mappings:      mappings,
+		pidfd:         pidfd,
+		mappings:      mappings.Executable(),
 		kernelMapping: kernelMapping,
 
+		symbolization: symbolization,
+
 		result: &pprofprofile.Profile{
 			TimeNanos:     captureTime.UnixNano(),
 			DurationNanos: int64(time.Since(captureTime)),
@@ -126,7 +202,9 @@ func NewConverter(
 				Type: "cpu",
 				Unit: "nanoseconds",
 			},
-			Mapping: pprofMappings,
+			Mapping:  pprofMappings,
+			Location: make([]*pprofprofile.Location, 0, sizes.locations),
+			Function: make([]*pprofprofile.Function, 0, sizes.functions),
 		},
 	}
 }
@@ -134,62 +212,219 @@ func NewConverter(
 // Convert converts a profile to a pprof profile. It is intended to only be
 // used once.
 func (c *Converter) Convert(ctx context.Context, rawData []profile.RawSample) (*pprofprofile.Profile, error) {
-	kernelAddresses := map[uint64]struct{}{}
-	for _, sample := range rawData {
-		for _, addr := range sample.KernelStack {
-			kernelAddresses[addr] = struct{}{}
+	defer c.release()
+
+	frames := 0
+	boundaries := make([]stackBoundary, len(rawData))
+	for i, sample := range rawData {
+		boundaries[i] = newStackBoundary(sample.UserStack, sample.KernelStack)
+		for _, addr := range boundaries[i].kernelStack {
+			c.kernelAddresses[addr] = struct{}{}
 		}
+		frames += sampleFrames(sample)
 	}
 
-	kernelSymbols, err := c.ksym.Resolve(kernelAddresses)
+	// The samples are only allocated once their number is known.
+	samples := make([]pprofprofile.Sample, len(rawData))
+	values := make([]int64, len(rawData))
+	locations := newSlab[*pprofprofile.Location](frames)
+	c.result.Sample = make([]*pprofprofile.Sample, 0, len(rawData))
+
+	c.resolveBuildIDs()
+
+	kernelSymbols, err := c.ksym.Resolve(c.kernelAddresses)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to resolve kernel symbols skipping profile", "err", err)
+		if ok, suppressed := c.metrics.errorLogs.Allow("ksym"); ok {
+			level.Debug(c.logger).Log("msg", "failed to resolve kernel symbols skipping profile", "err", err, "suppressed", suppressed)
+		}
 		kernelSymbols = map[uint64]string{}
 	}
 
-	for _, sample := range rawData {
-		pprofSample := &pprofprofile.Sample{
-			Value:    []int64{int64(sample.Value)},
-			Location: make([]*pprofprofile.Location, 0, len(sample.UserStack)+len(sample.KernelStack)),
+	for i, sample := range rawData {
+		// Conversions can be given a time budget.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		value := int64(sample.Value)
+		if sample.PeriodNS != 0 {
+			value *= sample.PeriodNS
+		}
+		values[i] = value
+		pprofSample := &samples[i]
+		pprofSample.Value = values[i : i+1 : i+1]
+		pprofSample.Location = locations.take(sampleFrames(sample))[:0]
+		if len(sample.Labels) > 0 {
+			pprofSample.Label = make(map[string][]string, len(sample.Labels))
+			for k, v := range sample.Labels {
+				pprofSample.Label[k] = []string{v}
+			}
+		}
+		if len(sample.Timestamps) > 0 {
+			units := make([]string, len(sample.Timestamps))
+			for i := range units {
+				units[i] = "nanoseconds"
+			}
+			pprofSample.NumLabel = map[string][]int64{TimestampLabel: sample.Timestamps}
+			pprofSample.NumUnit = map[string][]string{TimestampLabel: units}
 		}
 
-		for _, addr := range sample.KernelStack {
+		boundary := boundaries[i]
+		if reason := boundary.reason(kernelSymbols); reason != "" {
+			c.metrics.inconsistentStack(reason, sample.Value)
+			if pprofSample.Label == nil {
+				pprofSample.Label = make(map[string][]string, 1)
+			}
+			pprofSample.Label[StackBoundaryLabel] = []string{reason}
+		}
+
+		for _, addr := range boundary.kernelStack {
 			l := c.addKernelLocation(c.kernelMapping, kernelSymbols, addr)
 			pprofSample.Location = append(pprofSample.Location, l)
 		}
 
-		for _, addr := range sample.UserStack {
+		interpreterFrames := sample.InterpreterStack
+		for j := boundary.userStart; j < len(sample.UserStack); j++ {
+			addr := sample.UserStack[j]
+			replaced := false
+			for len(interpreterFrames) > 0 && interpreterFrames[0].NativeIndex <= j {
+				pprofSample.Location = append(pprofSample.Location, c.addInterpreterLocation(interpreterFrames[0].Line))
+				if interpreterFrames[0].Address == addr {
+					replaced = true
+				}
+				interpreterFrames = interpreterFrames[1:]
+			}
 			mappingIndex := mappingForAddr(c.result.Mapping, addr)
+			if replaced {
+				// Already symbolized by the interpreter unwinder.
+				if mappingIndex != -1 {
+					c.symbolization.add(c.result.Mapping[mappingIndex], symbolizedLocally, sample.Value)
+				}
+				continue
+			}
 			if mappingIndex == -1 {
-				c.metrics.frameDrop.WithLabelValues(labelFrameDropReasonMappingNil).Inc()
-				// Normalization will fail anyway, so we can skip this frame.
+				// Normalization would fail, the address is kept as is.
+				if l := c.addUnknownLocation(nil, nil, addr); l != nil {
+					pprofSample.Location = append(pprofSample.Location, l)
+				} else {
+					c.metrics.frameDrop.WithLabelValues(labelFrameDropReasonMappingNil).Inc()
+				}
 				continue
 			}
 
 			processMapping := c.mappings[mappingIndex]
 			pprofMapping := c.result.Mapping[mappingIndex]
+			var (
+				l      *pprofprofile.Location
+				result symbolizationResult
+			)
 			switch {
 			case pprofMapping.File == "[vdso]":
-				pprofSample.Location = append(pprofSample.Location, c.addVDSOLocation(processMapping, pprofMapping, addr))
+				l, result = c.addVDSOLocation(processMapping, pprofMapping, addr)
 			case pprofMapping.File == "jit":
-				pprofSample.Location = append(pprofSample.Location, c.addPerfMapLocation(pprofMapping, addr))
+				l, result = c.addPerfMapLocation(pprofMapping, addr)
+			case processMapping.IsAnonymous() && c.perfMapCovers(addr):
+				// JITs such as Julia and LuaJIT write perf maps for the
+				// code of named anonymous or memfd mappings too, which may
+				// hold regular binaries otherwise.
+				l, result = c.addPerfMapLocation(pprofMapping, addr)
 			case strings.HasSuffix(pprofMapping.File, ".dump"):
 				// TODO: The .dump is only a convention, it doesn't have to
 				// have this suffix. Better would be to check the magic number
 				// of the mapping file:
 				// https://elixir.bootlin.com/linux/v4.10/source/tools/perf/Documentation/jitdump-specification.txt
-				pprofSample.Location = append(pprofSample.Location, c.addJITDumpLocation(pprofMapping, addr, pprofMapping.File))
+				l, result = c.addJITDumpLocation(pprofMapping, addr, pprofMapping.File, sampleTime(sample))
 			default:
-				pprofSample.Location = append(pprofSample.Location, c.addAddrLocation(processMapping, pprofMapping, addr))
+				l, result = c.addAddrLocation(processMapping, pprofMapping, addr)
+			}
+			c.symbolization.add(pprofMapping, result, sample.Value)
+			if result == unsymbolizable {
+				l = c.addUnknownLocation(pprofMapping, l, addr)
+				if l == nil {
+					c.metrics.frameDrop.WithLabelValues(labelFrameDropReasonUnsymbolizable).Inc()
+					continue
+				}
 			}
+			pprofSample.Location = append(pprofSample.Location, l)
+		}
+		for _, frame := range interpreterFrames {
+			pprofSample.Location = append(pprofSample.Location, c.addInterpreterLocation(frame.Line))
+		}
+		if sample.Truncated {
+			pprofSample.Location = append(pprofSample.Location, c.addTruncatedLocation())
+			c.metrics.stackTruncated(sample.Value)
 		}
 
 		c.result.Sample = append(c.result.Sample, pprofSample)
 	}
 
+	c.coverage.record(c.symbolization)
+	sizes := profileSizes{
+		locations: len(c.result.Location),
+		functions: len(c.result.Function),
+	}
+	for _, l := range c.result.Location {
+		sizes.lines += len(l.Line)
+	}
+	c.metrics.setLastProfileSizes(c.pid, sizes)
 	return c.result, nil
 }
 
+// sampleFrames returns the number of frames of the given sample, including the
+// root frame marking truncated stacks.
+func sampleFrames(sample profile.RawSample) int {
+	n := len(sample.KernelStack) + len(sample.UserStack) + len(sample.InterpreterStack)
+	if sample.Truncated {
+		n++
+	}
+	return n
+}
+
+// resolveBuildIDs fills the build IDs the mappings of the profile are missing,
+// as the server can't symbolize the addresses of the binaries without one at
+// all.
+func (c *Converter) resolveBuildIDs() {
+	resolved := map[int]string{}
+	for i, m := range c.mappings {
+		if c.result.Mapping[i].BuildID != "" {
+			continue
+		}
+
+		buildID, err := m.ResolveBuildID()
+		if err != nil {
+			c.metrics.buildIDResolved(lvFail)
+			if ok, suppressed := c.metrics.errorLogs.Allow("buildid"); ok {
+				level.Debug(c.logger).Log("msg", "failed to resolve build ID of mapping", "path", m.Pathname, "err", err, "suppressed", suppressed)
+			}
+			continue
+		}
+		if buildID == "" {
+			continue
+		}
+		resolved[i] = buildID
+	}
+	if len(resolved) == 0 {
+		return
+	}
+
+	// The files were opened through /proc/<pid>/root.
+	if err := c.pidfd.Check(); err != nil {
+		level.Debug(c.logger).Log("msg", "discarding the resolved build IDs", "pid", c.pid, "err", err)
+		return
+	}
+	for i, buildID := range resolved {
+		c.metrics.buildIDResolved(lvSuccess)
+		c.result.Mapping[i].BuildID = buildID
+	}
+}
+
+// release gives the lookup tables of the conversion back once the profile is
+// converted.
+func (c *Converter) release() {
+	c.indexes.release()
+	c.indexes = nil
+}
+
 func mappingForAddr(mappings []*pprofprofile.Mapping, addr uint64) int {
 	for i, m := range mappings {
 		if m.Start <= addr && addr < m.Limit {
@@ -213,16 +448,10 @@ func (c *Converter) addKernelLocation(
 		return l
 	}
 
-	l := &pprofprofile.Location{
-		ID:      uint64(len(c.result.Location)) + 1,
-		Mapping: m,
-		Line: []pprofprofile.Line{{
-			Function: c.addFunction(kernelSymbol),
-		}},
-	}
+	l := c.newLocation(m, 0)
+	l.Line = c.newLine(c.addFunction(kernelSymbol), 0)
 
 	c.kernelLocationIndex[kernelSymbol] = l
-	c.result.Location = append(c.result.Location, l)
 
 	return l
 }
@@ -231,43 +460,51 @@ func (c *Converter) addVDSOLocation(
 	processMapping *process.Mapping,
 	m *pprofprofile.Mapping,
 	addr uint64,
-) *pprofprofile.Location {
+) (*pprofprofile.Location, symbolizationResult) {
+	// The symbolizer logs and counts its own errors.
+	result := symbolizedLocally
 	functionName, err := c.vdsoSymbolizer.Resolve(addr, processMapping)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to symbolize VDSO address", "address", fmt.Sprintf("%x", addr), "err", err)
 		functionName = "unknown"
+		result = unsymbolizable
 	}
 
 	if l, ok := c.vdsoLocationIndex[functionName]; ok {
-		return l
+		return l, result
 	}
 
-	l := &pprofprofile.Location{
-		ID:      uint64(len(c.result.Location)) + 1,
-		Mapping: m,
-		Line: []pprofprofile.Line{{
-			Function: c.addFunction(functionName),
-		}},
-	}
+	l := c.newLocation(m, 0)
+	l.Line = c.newLine(c.addFunction(functionName), 0)
 
 	c.vdsoLocationIndex[functionName] = l
-	c.result.Location = append(c.result.Location, l)
 
-	return l
+	return l, result
 }
 
 func (c *Converter) addAddrLocation(
 	processMapping *process.Mapping,
 	m *pprofprofile.Mapping,
 	addr uint64,
-) *pprofprofile.Location {
+) (*pprofprofile.Location, symbolizationResult) {
 	normalizedAddress, err := c.addressNormalizer.Normalize(processMapping, addr)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to normalize address", "address", fmt.Sprintf("%x", addr), "err", err)
-		normalizedAddress = addr
+		if ok, suppressed := c.metrics.errorLogs.Allow("normalize"); ok {
+			level.Debug(c.logger).Log("msg", "failed to normalize address", "address", fmt.Sprintf("%x", addr), "err", err, "suppressed", suppressed)
+		}
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
+	}
+
+	if c.localSymbolizer != nil {
+		return c.addLocalLocation(processMapping, m, normalizedAddress)
 	}
 
-	return c.addAddrLocationNoNormalization(m, normalizedAddress)
+	// The server symbolizes the addresses of the binaries it has the debug
+	// information of, which it looks up by build ID.
+	result := symbolizedByServer
+	if m.BuildID == "" {
+		result = unsymbolizable
+	}
+	return c.addAddrLocationNoNormalization(m, normalizedAddress), result
 }
 
 func (c *Converter) addAddrLocationNoNormalization(m *pprofprofile.Mapping, addr uint64) *pprofprofile.Location {
@@ -275,56 +512,104 @@ func (c *Converter) addAddrLocationNoNormalization(m *pprofprofile.Mapping, addr
 		return l
 	}
 
-	l := &pprofprofile.Location{
-		ID:      uint64(len(c.result.Location)) + 1,
-		Mapping: m,
-		Address: addr,
-	}
+	l := c.newLocation(m, addr)
 
 	c.addrLocationIndex[addr] = l
-	c.result.Location = append(c.result.Location, l)
 
 	return l
 }
 
+// localLocationKey identifies the locations of the addresses symbolized on
+// the host, as the normalized addresses of different binaries overlap.
+type localLocationKey struct {
+	mappingID uint64
+	addr      uint64
+}
+
+// addLocalLocation adds the location of a normalized address symbolized on
+// the host. The address is kept, with the lines of the functions inlined at
+// it. The location has no lines when the address can't be symbolized.
+func (c *Converter) addLocalLocation(
+	processMapping *process.Mapping,
+	m *pprofprofile.Mapping,
+	addr uint64,
+) (*pprofprofile.Location, symbolizationResult) {
+	key := localLocationKey{mappingID: m.ID, addr: addr}
+	if l, ok := c.localLocationIndex[key]; ok {
+		if len(l.Line) == 0 {
+			return l, unsymbolizable
+		}
+		return l, symbolizedLocally
+	}
+
+	l := c.newLocation(m, addr)
+	c.localLocationIndex[key] = l
+
+	// The symbolizer logs and counts its own errors.
+	lines, err := c.localSymbolizer.Symbolize(processMapping, addr)
+	if err != nil {
+		return l, unsymbolizable
+	}
+
+	l.Line = c.lines.take(len(lines))
+	for i, line := range lines {
+		l.Line[i] = pprofprofile.Line{Function: c.addLocalFunction(line.Function), Line: int64(line.Line)}
+	}
+	// The mapping no longer needs to be symbolized by the server.
+	m.HasFunctions = true
+	return l, symbolizedLocally
+}
+
 func (c *Converter) addPerfMapLocation(
 	m *pprofprofile.Mapping,
 	addr uint64,
-) *pprofprofile.Location {
+) (*pprofprofile.Location, symbolizationResult) {
 	if c.disableJITSymbolization {
-		return c.addAddrLocationNoNormalization(m, addr)
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
 	}
 
 	perfMap, err := c.perfMap()
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to get perf map for PID", "err", err)
+		if ok, suppressed := c.metrics.errorLogs.Allow("perf_map"); ok {
+			level.Debug(c.logger).Log("msg", "failed to get perf map for PID", "err", err, "suppressed", suppressed)
+		}
 	}
 
 	if perfMap == nil {
-		return c.addAddrLocationNoNormalization(m, addr)
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
 	}
 
 	symbol, err := perfMap.Lookup(addr)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to lookup symbol for address", "address", fmt.Sprintf("%x", addr), "err", err)
-		return c.addAddrLocationNoNormalization(m, addr)
+		if ok, suppressed := c.metrics.errorLogs.Allow("perf_map_lookup"); ok {
+			level.Debug(c.logger).Log("msg", "failed to lookup symbol for address", "address", fmt.Sprintf("%x", addr), "err", err, "suppressed", suppressed)
+		}
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
 	}
 
 	if l, ok := c.perfmapLocationIndex[symbol]; ok {
-		return l
+		return l, symbolizedLocally
 	}
 
-	l := &pprofprofile.Location{
-		ID:      uint64(len(c.result.Location)) + 1,
-		Mapping: m,
-		Line: []pprofprofile.Line{{
-			Function: c.addFunction(symbol),
-		}},
-	}
+	l := c.newLocation(m, 0)
+	l.Line = c.newLine(c.addFunction(symbol), 0)
 
 	c.perfmapLocationIndex[symbol] = l
-	c.result.Location = append(c.result.Location, l)
-	return l
+	return l, symbolizedLocally
+}
+
+// perfMapCovers returns true if the process has a perf map with a symbol for
+// the given address, for the anonymous mappings not named like JIT ones.
+func (c *Converter) perfMapCovers(addr uint64) bool {
+	if c.disableJITSymbolization {
+		return false
+	}
+	perfMap, _ := c.perfMap()
+	if perfMap == nil {
+		return false
+	}
+	_, err := perfMap.Lookup(addr)
+	return err == nil
 }
 
 func (c *Converter) perfMap() (*perf.Map, error) {
@@ -333,6 +618,11 @@ func (c *Converter) perfMap() (*perf.Map, error) {
 	}
 
 	c.cachedPerfMap, c.cachedPerfMapErr = c.perfMapCache.PerfMapForPID(c.pid)
+	if c.cachedPerfMapErr == nil {
+		if err := c.pidfd.Check(); err != nil {
+			c.cachedPerfMap, c.cachedPerfMapErr = nil, err
+		}
+	}
 	return c.cachedPerfMap, c.cachedPerfMapErr
 }
 
@@ -340,44 +630,53 @@ func (c *Converter) addJITDumpLocation(
 	m *pprofprofile.Mapping,
 	addr uint64,
 	path string,
-) *pprofprofile.Location {
+	ts int64,
+) (*pprofprofile.Location, symbolizationResult) {
 	if c.disableJITSymbolization {
-		return c.addAddrLocationNoNormalization(m, addr)
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
 	}
 
 	jitdump, err := c.jitdump(path)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to get perf map for PID", "err", err)
+		if ok, suppressed := c.metrics.errorLogs.Allow("jitdump"); ok {
+			level.Debug(c.logger).Log("msg", "failed to get jitdump for PID", "path", path, "err", err, "suppressed", suppressed)
+		}
 	}
 
 	if jitdump == nil {
-		return c.addAddrLocationNoNormalization(m, addr)
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
 	}
 
-	symbol, err := jitdump.Lookup(addr)
+	// The JIT may have reused the address for other code since.
+	symbol, err := jitdump.Lookup(addr, ts)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "failed to lookup symbol for address", "address", fmt.Sprintf("%x", addr), "err", err)
-		return c.addAddrLocationNoNormalization(m, addr)
+		if ok, suppressed := c.metrics.errorLogs.Allow("jitdump_lookup"); ok {
+			level.Debug(c.logger).Log("msg", "failed to lookup symbol for address", "address", fmt.Sprintf("%x", addr), "err", err, "suppressed", suppressed)
+		}
+		return c.addAddrLocationNoNormalization(m, addr), unsymbolizable
 	}
 
 	if l, ok := c.jitdumpLocationIndex[symbol]; ok {
-		return l
+		return l, symbolizedLocally
 	}
 
-	l := &pprofprofile.Location{
-		ID:      uint64(len(c.result.Location)) + 1,
-		Mapping: m,
-		Line: []pprofprofile.Line{{
-			Function: c.addFunction(symbol),
-		}},
-	}
+	l := c.newLocation(m, 0)
+	l.Line = c.newLine(c.addFunction(symbol), 0)
 
 	c.jitdumpLocationIndex[symbol] = l
-	c.result.Location = append(c.result.Location, l)
-	return l
+	return l, symbolizedLocally
 }
 
-func (c *Converter) jitdump(path string) (*perf.Map, error) {
+// sampleTime returns the Unix time in nanoseconds at which the stacks of the
+// sample were last sampled, or zero when it is unknown.
+func sampleTime(sample profile.RawSample) int64 {
+	if len(sample.Timestamps) == 0 {
+		return 0
+	}
+	return sample.Timestamps[len(sample.Timestamps)-1]
+}
+
+func (c *Converter) jitdump(path string) (*perf.JITMap, error) {
 	jitdump, jitdumpExists := c.cachedJitdump[path]
 	jitdumpErr, jitdumpErrExists := c.cachedJitdumpErr[path]
 	if jitdumpExists || jitdumpErrExists {
@@ -385,11 +684,116 @@ func (c *Converter) jitdump(path string) (*perf.Map, error) {
 	}
 
 	jitdump, err := c.jitdumpCache.JitdumpForPID(c.pid, path)
+	if err == nil {
+		if err = c.pidfd.Check(); err != nil {
+			jitdump = nil
+		}
+	}
 	c.cachedJitdump[path] = jitdump
 	c.cachedJitdumpErr[path] = err
 	return jitdump, err
 }
 
+// unknownLocationKey identifies the locations of the frames that are outside
+// of the mappings or can't be symbolized, by mapping and by address when
+// their raw address is kept.
+type unknownLocationKey struct {
+	mappingID uint64
+	addr      uint64
+}
+
+// addUnknownLocation returns the location of a frame outside of the mappings,
+// with a nil mapping and location, or that can't be symbolized, according to
+// the unknown frame policy. It is nil when the frame is dropped.
+func (c *Converter) addUnknownLocation(m *pprofprofile.Mapping, l *pprofprofile.Location, addr uint64) *pprofprofile.Location {
+	switch c.unknownFrames {
+	case UnknownFramesDrop:
+		return nil
+	case UnknownFramesPlaceholder:
+		// One placeholder per mapping.
+		addr = 0
+	default:
+		if l != nil {
+			return l
+		}
+	}
+
+	if m == nil {
+		if c.unknownMapping == nil {
+			c.unknownMapping = &pprofprofile.Mapping{
+				ID:   uint64(len(c.result.Mapping)) + 1,
+				File: "[unknown]",
+			}
+			c.result.Mapping = append(c.result.Mapping, c.unknownMapping)
+		}
+		m = c.unknownMapping
+	}
+
+	key := unknownLocationKey{mappingID: m.ID, addr: addr}
+	if l, ok := c.unknownLocationIndex[key]; ok {
+		return l
+	}
+
+	l = c.newLocation(m, addr)
+	if c.unknownFrames == UnknownFramesPlaceholder {
+		name := "[unknown]"
+		if m != c.unknownMapping {
+			name = "[unknown " + m.File + "]"
+		}
+		l.Line = c.newLine(c.addFunction(name), 0)
+	}
+
+	c.unknownLocationIndex[key] = l
+	return l
+}
+
+// addTruncatedLocation returns the "[truncated]" frame placed at the root of
+// the stacks cut at the maximum stack depth, so that the missing frames are
+// accounted for rather than the stacks looking complete.
+func (c *Converter) addTruncatedLocation() *pprofprofile.Location {
+	if c.truncatedLocation != nil {
+		return c.truncatedLocation
+	}
+
+	l := c.newLocation(nil, 0)
+	l.Line = c.newLine(c.addFunction("[truncated]"), 0)
+	c.truncatedLocation = l
+	return l
+}
+
+// addInterpreterLocation adds a location for a frame the unwinder already
+// symbolized.
+func (c *Converter) addInterpreterLocation(line profile.Line) *pprofprofile.Location {
+	if l, ok := c.interpreterLocationIndex[line]; ok {
+		return l
+	}
+
+	if c.interpreterMapping == nil {
+		c.interpreterMapping = &pprofprofile.Mapping{
+			ID:   uint64(len(c.result.Mapping)) + 1,
+			File: "[interpreter]",
+		}
+		c.result.Mapping = append(c.result.Mapping, c.interpreterMapping)
+	}
+
+	f, ok := c.interpreterFunctionIndex[line.Function]
+	if !ok {
+		f = c.newFunction(line.Name)
+		f.Filename = line.Filename
+		f.StartLine = int64(line.StartLine)
+		c.interpreterFunctionIndex[line.Function] = f
+	}
+
+	l := c.newLocation(c.interpreterMapping, 0)
+	l.Line = c.newLine(f, int64(line.Line))
+
+	c.interpreterLocationIndex[line] = l
+	return l
+}
+
+// addFunction adds the function of a symbol resolved on the host, demangling
+// its name when a demangler is configured. The mangled name is kept as the
+// system name. Both are interned across the conversions.
 // TODO: add support for filename and startLine of functions.
 func (c *Converter) addFunction(
 	name string,
@@ -398,13 +802,53 @@ func (c *Converter) addFunction(
 		return f
 	}
 
-	f := &pprofprofile.Function{
-		ID:   uint64(len(c.result.Function) + 1),
-		Name: name,
-	}
+	sym := symbols.lookup(name, c.demangler)
+	f := c.newFunction(sym.name)
+	f.SystemName = sym.systemName
 
 	c.functionIndex[name] = f
-	c.result.Function = append(c.result.Function, f)
 
 	return f
 }
+
+// addLocalFunction adds a function symbolized on the host, demangling its
+// name like addFunction does.
+func (c *Converter) addLocalFunction(fn profile.Function) *pprofprofile.Function {
+	if f, ok := c.localFunctionIndex[fn]; ok {
+		return f
+	}
+
+	sym := symbols.lookup(fn.Name, c.demangler)
+	f := c.newFunction(sym.name)
+	f.SystemName = sym.systemName
+	f.Filename = fn.Filename
+	f.StartLine = int64(fn.StartLine)
+
+	c.localFunctionIndex[fn] = f
+	return f
+}
+
+// newLocation adds a location to the profile.
+func (c *Converter) newLocation(m *pprofprofile.Mapping, addr uint64) *pprofprofile.Location {
+	l := c.locations.next()
+	l.ID = uint64(len(c.result.Location)) + 1
+	l.Mapping = m
+	l.Address = addr
+	c.result.Location = append(c.result.Location, l)
+	return l
+}
+
+func (c *Converter) newLine(f *pprofprofile.Function, line int64) []pprofprofile.Line {
+	lines := c.lines.take(1)
+	lines[0] = pprofprofile.Line{Function: f, Line: line}
+	return lines
+}
+
+// newFunction adds a function to the profile.
+func (c *Converter) newFunction(name string) *pprofprofile.Function {
+	f := c.functions.next()
+	f.ID = uint64(len(c.result.Function)) + 1
+	f.Name = name
+	c.result.Function = append(c.result.Function, f)
+	return f
+}
@@ -0,0 +1,356 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+	"github.com/parca-dev/parca-agent/pkg/testutil"
+)
+
+func TestAddFunctionDemangles(t *testing.T) {
+	newConverter := func(demangler *demangle.Demangler) *Converter {
+		return NewConverter(log.NewNopLogger(), ConverterOptions{Demangler: demangler, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 0)
+	}
+
+	const (
+		cpp  = "_ZN3foo3barEv"
+		rust = "_RNvCs15kBYyAo9fc_7mycrate7example"
+	)
+
+	c := newConverter(nil)
+	f := c.addFunction(cpp)
+	require.Equal(t, cpp, f.Name)
+	require.Empty(t, f.SystemName)
+
+	c = newConverter(demangle.NewDemangler("simple", false))
+	f = c.addFunction(cpp)
+	require.Equal(t, "foo::bar", f.Name)
+	require.Equal(t, cpp, f.SystemName)
+	require.Same(t, f, c.addFunction(cpp))
+
+	f = c.addFunction(rust)
+	require.Equal(t, "mycrate::example", f.Name)
+	require.Equal(t, rust, f.SystemName)
+
+	f = c.addFunction("do_syscall_64")
+	require.Equal(t, "do_syscall_64", f.Name)
+
+	c = newConverter(demangle.NewDemangler("full", false))
+	require.Equal(t, "foo::bar()", c.addFunction(cpp).Name)
+}
+
+func TestConvertWeighsSamples(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\n"),
+	}))
+	prof, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 1_000).Convert(context.Background(), []profile.RawSample{
+		{Value: 3},
+		{Value: 3, PeriodNS: 2_000},
+	})
+	require.NoError(t, err)
+	require.Len(t, prof.Sample, 2)
+	require.Equal(t, []int64{3}, prof.Sample[0].Value)
+	require.Equal(t, []int64{6_000}, prof.Sample[1].Value)
+}
+
+func TestConvertUnknownFrames(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\n"),
+	}))
+	convert := func(policy UnknownFramePolicy) *pprofprofile.Profile {
+		t.Helper()
+		metrics := NewConverterMetrics(prometheus.NewRegistry(), "test")
+		prof, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, Metrics: metrics, UnknownFrames: policy}, 1, nil, nil, time.Now(), 1).Convert(context.Background(), []profile.RawSample{
+			{UserStack: []uint64{0x1000, 0x2000}, Value: 1},
+			{UserStack: []uint64{0x1000}, Value: 1},
+		})
+		require.NoError(t, err)
+		require.Len(t, prof.Sample, 2)
+		return prof
+	}
+
+	prof := convert(UnknownFramesDrop)
+	require.Empty(t, prof.Sample[0].Location)
+	require.Empty(t, prof.Location)
+
+	prof = convert(UnknownFramesAddress)
+	require.Len(t, prof.Sample[0].Location, 2)
+	require.Equal(t, uint64(0x1000), prof.Sample[0].Location[0].Address)
+	require.Equal(t, "[unknown]", prof.Sample[0].Location[0].Mapping.File)
+	require.Same(t, prof.Sample[0].Location[0], prof.Sample[1].Location[0])
+	require.Len(t, prof.Location, 2)
+
+	prof = convert(UnknownFramesPlaceholder)
+	require.Len(t, prof.Sample[0].Location, 2)
+	require.Same(t, prof.Sample[0].Location[0], prof.Sample[0].Location[1])
+	require.Equal(t, "[unknown]", prof.Sample[0].Location[0].Line[0].Function.Name)
+	require.Len(t, prof.Location, 1)
+}
+
+func TestConvertTruncatedStacks(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\n"),
+	}))
+	metrics := NewConverterMetrics(prometheus.NewRegistry(), "test")
+	prof, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, Metrics: metrics, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 1).Convert(context.Background(), []profile.RawSample{
+		{UserStack: []uint64{0x1000, 0x2000}, Value: 2, Truncated: true},
+		{UserStack: []uint64{0x1000}, Value: 1},
+		{UserStack: []uint64{0x3000}, Value: 3, Truncated: true},
+	})
+	require.NoError(t, err)
+	require.NoError(t, prof.CheckValid())
+	require.Len(t, prof.Sample, 3)
+
+	// The marker is the root frame of the truncated samples only.
+	require.Len(t, prof.Sample[0].Location, 3)
+	root := prof.Sample[0].Location[2]
+	require.Equal(t, "[truncated]", root.Line[0].Function.Name)
+	require.Len(t, prof.Sample[1].Location, 1)
+	require.Same(t, root, prof.Sample[2].Location[1])
+
+	require.Equal(t, float64(5), promtestutil.ToFloat64(metrics.stacksTruncated))
+}
+
+func TestConvertLabelsInconsistentStacks(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\nffffffff8f6d2000 T asm_common_interrupt\n"),
+	}))
+	metrics := NewConverterMetrics(prometheus.NewRegistry(), "test")
+	prof, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, Metrics: metrics, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 1).Convert(context.Background(), []profile.RawSample{
+		{UserStack: []uint64{0x1000}, KernelStack: []uint64{0xffffffff8f6d1140}, Value: 1},
+		{UserStack: []uint64{0x1000}, KernelStack: []uint64{0xffffffff8f6d2000}, Value: 2, Labels: map[string]string{"a": "b"}},
+		{UserStack: []uint64{0xffffffff8f6d1140, 0x1000}, Value: 3},
+	})
+	require.NoError(t, err)
+	require.Len(t, prof.Sample, 3)
+
+	require.Empty(t, prof.Sample[0].Label)
+	require.Equal(t, map[string][]string{"a": {"b"}, StackBoundaryLabel: {"irq"}}, prof.Sample[1].Label)
+
+	// The kernel frame walked as part of the user stack is a kernel frame.
+	require.Equal(t, map[string][]string{StackBoundaryLabel: {"corrected"}}, prof.Sample[2].Label)
+	require.Len(t, prof.Sample[2].Location, 2)
+	require.Same(t, prof.Sample[0].Location[0], prof.Sample[2].Location[0])
+
+	require.Equal(t, float64(2), promtestutil.ToFloat64(metrics.stacksInconsistent.WithLabelValues("irq")))
+	require.Equal(t, float64(3), promtestutil.ToFloat64(metrics.stacksInconsistent.WithLabelValues("corrected")))
+}
+
+// offsetNormalizer normalizes the addresses as offsets from the start of
+// their mapping.
+type offsetNormalizer struct{}
+
+func (offsetNormalizer) Normalize(m *process.Mapping, addr uint64) (uint64, error) {
+	return addr - uint64(m.StartAddr), nil
+}
+
+// fakeLocalSymbolizer has the lines of the addresses by build ID.
+type fakeLocalSymbolizer map[string]map[uint64][]profile.Line
+
+func (s fakeLocalSymbolizer) Symbolize(m *process.Mapping, addr uint64) ([]profile.Line, error) {
+	lines, ok := s[m.BuildID][addr]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return lines, nil
+}
+
+func TestConvertSymbolizesLocally(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\n"),
+	}))
+	mappings := process.Mappings{
+		{ProcMap: &procfs.ProcMap{StartAddr: 0x1000, EndAddr: 0x2000, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "/bin/app"}, BuildID: "app"},
+		{ProcMap: &procfs.ProcMap{StartAddr: 0x3000, EndAddr: 0x4000, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "/lib/libc.so"}, BuildID: "libc"},
+	}
+	symbolizer := fakeLocalSymbolizer{"app": {
+		0x10: {
+			{Function: profile.Function{Name: "_ZN3foo3barEv", Filename: "foo.cc", StartLine: 10}, Line: 12},
+			{Function: profile.Function{Name: "main", Filename: "main.cc", StartLine: 1}, Line: 3},
+		},
+	}}
+	prof, err := NewConverter(
+		log.NewNopLogger(), ConverterOptions{AddressNormalizer: offsetNormalizer{}, Ksym: k, LocalSymbolizer: symbolizer, Demangler: demangle.NewDemangler("simple", false), UnknownFrames: UnknownFramesAddress},
+		1, nil, mappings, time.Now(), 1,
+	).Convert(context.Background(), []profile.RawSample{
+		// The same normalized address in both binaries.
+		{UserStack: []uint64{0x1010, 0x3010}, Value: 1},
+		{UserStack: []uint64{0x1010, 0x1020}, Value: 1},
+	})
+	require.NoError(t, err)
+
+	app := prof.Sample[0].Location[0]
+	require.Equal(t, uint64(0x10), app.Address)
+	require.Len(t, app.Line, 2)
+	require.Equal(t, "foo::bar", app.Line[0].Function.Name)
+	require.Equal(t, "_ZN3foo3barEv", app.Line[0].Function.SystemName)
+	require.Equal(t, "foo.cc", app.Line[0].Function.Filename)
+	require.Equal(t, int64(10), app.Line[0].Function.StartLine)
+	require.Equal(t, int64(12), app.Line[0].Line)
+	require.Equal(t, "main", app.Line[1].Function.Name)
+	require.True(t, app.Mapping.HasFunctions)
+	require.Same(t, app, prof.Sample[1].Location[0])
+
+	// The symbolizer only knows the address of the first binary.
+	libc := prof.Sample[0].Location[1]
+	require.NotSame(t, app, libc)
+	require.Equal(t, uint64(0x10), libc.Address)
+	require.Empty(t, libc.Line)
+	require.False(t, libc.Mapping.HasFunctions)
+
+	require.Empty(t, prof.Sample[1].Location[1].Line)
+	require.Len(t, prof.Function, 2)
+}
+
+func TestConvertResolvesBuildIDs(t *testing.T) {
+	abs, err := filepath.Abs("../process/testdata/fib-nopie")
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	pid := os.Getpid()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "maps"), []byte(
+		"7f0000000000-7f0000001000 rw-p 00000000 00:00 0\n"+
+			"00401000-00402000 r-xp 00001000 fd:01 100 "+abs+"\n",
+	), 0o644))
+
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	mm := process.NewMapManager(
+		prometheus.NewRegistry(),
+		fs,
+		objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 1),
+	)
+	mappings, err := mm.MappingsForPID(pid)
+	require.NoError(t, err)
+	require.Len(t, mappings, 2)
+
+	buildID := mappings[1].BuildID
+	require.NotEmpty(t, buildID)
+	stripped := *mappings[1]
+	stripped.BuildID = ""
+
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\n"),
+	}))
+	prof, err := NewConverter(
+		log.NewNopLogger(), ConverterOptions{AddressNormalizer: offsetNormalizer{}, Ksym: k, UnknownFrames: UnknownFramesAddress},
+		pid, nil, process.Mappings{mappings[0], &stripped}, time.Now(), 1,
+	).Convert(context.Background(), []profile.RawSample{{UserStack: []uint64{0x401010}, Value: 1}})
+	require.NoError(t, err)
+
+	l := prof.Sample[0].Location[0]
+	require.Equal(t, uint64(0x10), l.Address)
+	require.Equal(t, abs, l.Mapping.File)
+	require.Equal(t, buildID, l.Mapping.BuildID)
+}
+
+func TestConvertCanceled(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f6d1140 T do_syscall_64\n"),
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 1).Convert(ctx, []profile.RawSample{{Value: 1}})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestConvertReusesIndexes(t *testing.T) {
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte("ffffffff8f000000 T do_syscall_64\n"),
+	}))
+	metrics := NewConverterMetrics(prometheus.NewRegistry(), "test")
+	convert := func(samples []profile.RawSample) *pprofprofile.Profile {
+		prof, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, Metrics: metrics, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 1).Convert(context.Background(), samples)
+		require.NoError(t, err)
+		return prof
+	}
+
+	first := convert([]profile.RawSample{{Value: 1, UserStack: []uint64{0x1, 0x2}, KernelStack: []uint64{0xffffffff8f000000}}})
+	second := convert([]profile.RawSample{{Value: 2, UserStack: []uint64{0x2}}})
+
+	// Nothing of the first conversion leaks into the second one.
+	require.Len(t, second.Location, 1)
+	require.Equal(t, uint64(0x2), second.Location[0].Address)
+	require.Equal(t, uint64(1), second.Location[0].ID)
+	require.Empty(t, second.Function)
+
+	require.Len(t, first.Location, 3)
+	require.Equal(t, "do_syscall_64", first.Sample[0].Location[0].Line[0].Function.Name)
+	require.Equal(t, []int64{1}, first.Sample[0].Value)
+	require.NoError(t, first.CheckValid())
+	require.NoError(t, second.CheckValid())
+}
+
+func BenchmarkConvert(b *testing.B) {
+	var kallsyms strings.Builder
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&kallsyms, "%x T function_%d\n", 0xffffffff8f000000+uint64(i)*0x100, i)
+	}
+	k := ksym.NewKsym(log.NewNopLogger(), prometheus.NewRegistry(), b.TempDir(), testutil.NewFakeFS(map[string][]byte{
+		"/proc/kallsyms": []byte(kallsyms.String()),
+	}))
+	metrics := NewConverterMetrics(prometheus.NewRegistry(), "bench")
+
+	samples := make([]profile.RawSample, 0, 2_000)
+	for i := 0; i < cap(samples); i++ {
+		s := profile.RawSample{Value: 1}
+		for j := 0; j < 16; j++ {
+			s.UserStack = append(s.UserStack, uint64(0x1000+(i*7+j*13)%4_000))
+			s.KernelStack = append(s.KernelStack, 0xffffffff8f000000+uint64((i+j)%16)*0x100)
+		}
+		for j := 0; j < 4; j++ {
+			n := (i + j*31) % 500
+			s.InterpreterStack = append(s.InterpreterStack, profile.InterpreterFrame{
+				NativeIndex: j,
+				Line: profile.Line{
+					Function: profile.Function{Name: fmt.Sprintf("function_%d", n), Filename: "main.py"},
+					Line:     n,
+				},
+			})
+		}
+		samples = append(samples, s)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewConverter(log.NewNopLogger(), ConverterOptions{Ksym: k, Metrics: metrics, UnknownFrames: UnknownFramesAddress}, 1, nil, nil, time.Now(), 1).Convert(context.Background(), samples); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
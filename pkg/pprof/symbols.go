@@ -0,0 +1,104 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/parca-dev/parca/gen/proto/go/parca/metastore/v1alpha1"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+)
+
+// Interval in which the symbols not used by any conversion are dropped.
+const symbolGeneration = 10 * time.Minute
+
+// symbols is shared by all the converters of the agent, as the same
+// processes are converted over and over.
+var symbols = newSymbolTable(symbolGeneration)
+
+// symbol is the function of a name resolved on the host, as written in the
+// profiles.
+type symbol struct {
+	name       string
+	systemName string
+}
+
+// symbolKey is the name to intern and the demangler it is demangled with, if
+// any, as the converters can be given different ones.
+type symbolKey struct {
+	name      string
+	demangler *demangle.Demangler
+}
+
+// symbolTable interns the names of the functions resolved on the host, so
+// that the converters don't each keep a copy of them nor demangle them again.
+// Go has no weak references, the symbols are instead kept by generation: the
+// ones not looked up for a whole generation are dropped.
+type symbolTable struct {
+	mtx sync.Mutex
+
+	generation time.Duration
+	rotated    time.Time
+	current    map[symbolKey]symbol
+	previous   map[symbolKey]symbol
+}
+
+func newSymbolTable(generation time.Duration) *symbolTable {
+	return &symbolTable{
+		generation: generation,
+		rotated:    time.Now(),
+		current:    map[symbolKey]symbol{},
+		previous:   map[symbolKey]symbol{},
+	}
+}
+
+// lookup returns the interned function of the name, demangled when a
+// demangler is given.
+func (t *symbolTable) lookup(name string, demangler *demangle.Demangler) symbol {
+	key := symbolKey{name: name, demangler: demangler}
+
+	t.mtx.Lock()
+	if time.Since(t.rotated) > t.generation {
+		t.previous = t.current
+		t.current = map[symbolKey]symbol{}
+		t.rotated = time.Now()
+	}
+	s, ok := t.current[key]
+	if !ok {
+		s, ok = t.previous[key]
+		if ok {
+			t.current[key] = s
+		}
+	}
+	t.mtx.Unlock()
+	if ok {
+		return s
+	}
+
+	// Demangling can be slow, it is done outside of the lock.
+	s = symbol{name: name}
+	if demangler != nil {
+		s.name = demangler.Demangle(&pb.Function{SystemName: name}).Name
+		s.systemName = name
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if interned, ok := t.current[key]; ok {
+		return interned
+	}
+	t.current[key] = s
+	return s
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymbolTable(t *testing.T) {
+	table := newSymbolTable(time.Hour)
+	demangler := demangle.NewDemangler("simple", false)
+
+	first := table.lookup(strings.Clone("_ZN3foo3barEv"), demangler)
+	require.Equal(t, symbol{name: "foo::bar", systemName: "_ZN3foo3barEv"}, first)
+
+	// The copy of the first lookup is returned.
+	second := table.lookup(strings.Clone("_ZN3foo3barEv"), demangler)
+	require.Equal(t, unsafe.StringData(first.name), unsafe.StringData(second.name))
+	require.Equal(t, unsafe.StringData(first.systemName), unsafe.StringData(second.systemName))
+
+	// Without a demangler the name is kept as is.
+	require.Equal(t, symbol{name: "_ZN3foo3barEv"}, table.lookup("_ZN3foo3barEv", nil))
+	require.Equal(t, "foo::bar()", table.lookup("_ZN3foo3barEv", demangle.NewDemangler("full", false)).name)
+
+	// The symbols looked up in the last generation survive the rotation, the
+	// others are dropped.
+	table.rotated = time.Now().Add(-2 * time.Hour)
+	table.lookup("_ZN3foo3barEv", demangler)
+	table.rotated = time.Now().Add(-2 * time.Hour)
+	table.lookup("other", nil)
+	require.Contains(t, table.previous, symbolKey{name: "_ZN3foo3barEv", demangler: demangler})
+	require.NotContains(t, table.previous, symbolKey{name: "_ZN3foo3barEv"})
+	require.NotContains(t, table.current, symbolKey{name: "_ZN3foo3barEv"})
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
+
+	"github.com/parca-dev/parca-agent/pkg/metadata/labels"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+// ProcessProfileWriter converts the samples of the processes seen by a
+// profiler and writes their profiles, labeled with the labels of the
+// processes and the name of the profiler.
+type ProcessProfileWriter struct {
+	logger log.Logger
+
+	name               string
+	processInfoManager profiler.ProcessInfoManager
+	options            ConverterOptions
+	profileWriter      profiler.ProfileWriter
+	// Counts the profiles dropped for the lack of process information, when
+	// set.
+	metrics *profiler.StackMetrics
+}
+
+func NewProcessProfileWriter(
+	logger log.Logger,
+	name string,
+	processInfoManager profiler.ProcessInfoManager,
+	options ConverterOptions,
+	profileWriter profiler.ProfileWriter,
+	metrics *profiler.StackMetrics,
+) *ProcessProfileWriter {
+	return &ProcessProfileWriter{
+		logger:             logger,
+		name:               name,
+		processInfoManager: processInfoManager,
+		options:            options,
+		profileWriter:      profileWriter,
+		metrics:            metrics,
+	}
+}
+
+// Write converts the samples of a process, taken from the capture time on at
+// the given period, lets finish complete the profile, e.g. with its sample
+// types, and writes it. The profiles of the processes without labels are
+// dropped.
+func (w *ProcessProfileWriter) Write(
+	ctx context.Context,
+	pid int,
+	captureTime time.Time,
+	periodNS int64,
+	samples []profile.RawSample,
+	finish func(*pprofprofile.Profile),
+) error {
+	pi, err := w.processInfoManager.Info(ctx, pid)
+	if err != nil {
+		if w.metrics != nil {
+			w.metrics.ProfileDrop.WithLabelValues(profiler.ProfileDropReasonProcessInfo).Inc()
+		}
+		return fmt.Errorf("failed to get process info: %w", err)
+	}
+
+	prof, err := NewConverter(
+		w.logger,
+		w.options,
+		pid,
+		pi.PIDFD,
+		pi.Mappings,
+		captureTime,
+		periodNS,
+	).Convert(ctx, samples)
+	if err != nil {
+		return fmt.Errorf("failed to convert profile to pprof: %w", err)
+	}
+	finish(prof)
+
+	labelSet, err := pi.Labels(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get process labels: %w", err)
+	}
+	if len(labelSet) == 0 {
+		level.Debug(w.logger).Log("msg", "profile dropped", "pid", pid)
+		return nil
+	}
+	_, labelSet, _ = profiler.TargetOverrides(labelSet)
+	labelSet = labels.WithProfilerName(labelSet, w.name)
+
+	return w.profileWriter.Write(ctx, labelSet, prof)
+}
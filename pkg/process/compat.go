@@ -0,0 +1,45 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errNotELF = errors.New("not an ELF file")
+
+// isCompat returns whether the executable at the given path is a 32-bit one,
+// judging by the class in its ELF header. Such executables, such as i386 or
+// armv7 programs, are run in compatibility mode on 64-bit hosts.
+func isCompat(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var ident [elf.EI_NIDENT]byte
+	if _, err := io.ReadFull(f, ident[:]); err != nil {
+		return false, fmt.Errorf("failed to read ELF header: %w", err)
+	}
+	if !bytes.Equal(ident[:len(elf.ELFMAG)], []byte(elf.ELFMAG)) {
+		return false, errNotELF
+	}
+	return elf.Class(ident[elf.EI_CLASS]) == elf.ELFCLASS32, nil
+}
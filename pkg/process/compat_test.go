@@ -0,0 +1,42 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCompat(t *testing.T) {
+	compat, err := isCompat("testdata/fib")
+	require.NoError(t, err)
+	require.False(t, compat)
+
+	ident := make([]byte, elf.EI_NIDENT)
+	copy(ident, elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	path := filepath.Join(t.TempDir(), "i386")
+	require.NoError(t, os.WriteFile(path, ident, 0o755))
+
+	compat, err = isCompat(path)
+	require.NoError(t, err)
+	require.True(t, compat)
+
+	_, err = isCompat("compat.go")
+	require.ErrorIs(t, err, errNotELF)
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// NameFilter decides which processes are profiled from their command name
+// and command line, and whether they opted out of being profiled. A nil
+// filter keeps every process.
+type NameFilter struct {
+	fs      procfs.FS
+	rootFS  *RootFS
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	optOutName  string
+	optOutValue string
+	optOutFile  string
+}
+
+// OptOut is how the owners of the processes opt them out of being profiled,
+// without changing the configuration of the agent. The checks are disabled
+// when empty.
+type OptOut struct {
+	// Env is an environment variable assignment, e.g. PARCA_PROFILING=off.
+	// The value is compared case-insensitively.
+	Env string
+	// File is the path of a file in the root filesystem of the process, e.g.
+	// its container.
+	File string
+}
+
+// NewNameFilter returns a filter keeping the processes matching any of the
+// include expressions, or every process when there are none, unless they
+// match any of the exclude expressions or opted out. It returns nil when
+// there is nothing to filter by.
+func NewNameFilter(fs procfs.FS, rootFS *RootFS, include, exclude []string, optOut OptOut) (*NameFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 && optOut == (OptOut{}) {
+		return nil, nil
+	}
+
+	f := &NameFilter{fs: fs, rootFS: rootFS, optOutFile: optOut.File}
+	if optOut.Env != "" {
+		var ok bool
+		f.optOutName, f.optOutValue, ok = strings.Cut(optOut.Env, "=")
+		if !ok || f.optOutName == "" {
+			return nil, fmt.Errorf("invalid opt-out environment variable %q, expected NAME=value", optOut.Env)
+		}
+	}
+
+	var err error
+	if f.include, err = compileAll(include); err != nil {
+		return nil, fmt.Errorf("invalid include expression: %w", err)
+	}
+	if f.exclude, err = compileAll(exclude); err != nil {
+		return nil, fmt.Errorf("invalid exclude expression: %w", err)
+	}
+	return f, nil
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Keep returns whether the process with the given PID is profiled.
+// Processes whose name can't be read anymore, most likely because they
+// exited, only match empty expressions.
+func (f *NameFilter) Keep(pid int) bool {
+	if f == nil {
+		return true
+	}
+
+	var comm, cmdline string
+	proc, err := f.fs.Proc(pid)
+	if err == nil {
+		comm, _ = proc.Comm()
+		args, _ := proc.CmdLine()
+		cmdline = strings.Join(args, " ")
+	}
+	if !f.keep(comm, cmdline) {
+		return false
+	}
+
+	var environ []string
+	if err == nil && f.optOutName != "" {
+		environ, _ = proc.Environ()
+	}
+	return !f.optedOut(pid, environ)
+}
+
+func (f *NameFilter) keep(comm, cmdline string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, comm, cmdline) {
+		return false
+	}
+	return !matchAny(f.exclude, comm, cmdline)
+}
+
+// optedOut returns whether the process has the opt-out environment variable
+// or file.
+func (f *NameFilter) optedOut(pid int, environ []string) bool {
+	for _, v := range environ {
+		if name, value, ok := strings.Cut(v, "="); ok && name == f.optOutName && strings.EqualFold(value, f.optOutValue) {
+			return true
+		}
+	}
+	if f.optOutFile == "" || f.rootFS == nil {
+		return false
+	}
+
+	path, err := f.rootFS.Path(pid, f.optOutFile)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func matchAny(res []*regexp.Regexp, comm, cmdline string) bool {
+	for _, re := range res {
+		if re.MatchString(comm) || re.MatchString(cmdline) {
+			return true
+		}
+	}
+	return false
+}
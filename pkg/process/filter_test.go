@@ -0,0 +1,124 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameFilter(t *testing.T) {
+	f, err := NewNameFilter(procfs.FS{}, nil, nil, nil, OptOut{})
+	require.NoError(t, err)
+	require.Nil(t, f)
+	require.True(t, f.Keep(1))
+
+	_, err = NewNameFilter(procfs.FS{}, nil, []string{"("}, nil, OptOut{})
+	require.Error(t, err)
+
+	for name, tc := range map[string]struct {
+		include, exclude []string
+		comm, cmdline    string
+		expected         bool
+	}{
+		"included by comm": {
+			include:  []string{"^nginx$"},
+			comm:     "nginx",
+			cmdline:  "nginx: worker process",
+			expected: true,
+		},
+		"included by cmdline": {
+			include:  []string{"--config=/etc/app"},
+			comm:     "java",
+			cmdline:  "/usr/bin/java --config=/etc/app/app.yaml",
+			expected: true,
+		},
+		"not included": {
+			include: []string{"^nginx$"},
+			comm:    "postgres",
+			cmdline: "postgres -D /var/lib/postgresql",
+		},
+		"excluded": {
+			exclude: []string{"^kworker"},
+			comm:    "kworker/0:1",
+		},
+		"not excluded": {
+			exclude:  []string{"^kworker"},
+			comm:     "sshd",
+			cmdline:  "sshd: /usr/sbin/sshd -D",
+			expected: true,
+		},
+		"included then excluded": {
+			include: []string{"python"},
+			exclude: []string{"pip install"},
+			comm:    "python3",
+			cmdline: "python3 -m pip install requests",
+		},
+		"exited": {
+			include: []string{"^nginx$"},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			f, err := NewNameFilter(procfs.FS{}, nil, tc.include, tc.exclude, OptOut{})
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, f.keep(tc.comm, tc.cmdline))
+		})
+	}
+}
+
+func TestNameFilterOptOut(t *testing.T) {
+	_, err := NewNameFilter(procfs.FS{}, nil, nil, nil, OptOut{Env: "PARCA_PROFILING"})
+	require.Error(t, err)
+
+	root := t.TempDir()
+	writeProc := func(pid string, environ string, optOutFile bool) {
+		t.Helper()
+		dir := filepath.Join(root, pid)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "root"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "comm"), []byte("app\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cmdline"), []byte("app\x00"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "environ"), []byte(environ), 0o644))
+		if optOutFile {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "root", ".parca-no-profiling"), nil, 0o644))
+		}
+	}
+	writeProc("1", "HOME=/root\x00PARCA_PROFILING=off\x00", false)
+	writeProc("2", "HOME=/root\x00PARCA_PROFILING=OFF\x00", false)
+	writeProc("3", "HOME=/root\x00PARCA_PROFILING=on\x00", false)
+	writeProc("4", "HOME=/root\x00", true)
+
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	rootFS := NewRootFS(log.NewNopLogger(), prometheus.NewRegistry(), root, time.Second)
+	f, err := NewNameFilter(fs, rootFS, nil, nil, OptOut{Env: "PARCA_PROFILING=off", File: "/.parca-no-profiling"})
+	require.NoError(t, err)
+	require.False(t, f.Keep(1))
+	require.False(t, f.Keep(2))
+	require.True(t, f.Keep(3))
+	require.False(t, f.Keep(4))
+	// Exited.
+	require.True(t, f.Keep(5))
+
+	f, err = NewNameFilter(fs, rootFS, []string{"^other$"}, nil, OptOut{Env: "PARCA_PROFILING=off"})
+	require.NoError(t, err)
+	require.False(t, f.Keep(3))
+}
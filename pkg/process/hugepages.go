@@ -0,0 +1,71 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"strings"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// isRemappedText returns whether the mapping can hold code moved out of the
+// mapping of a file, that is anonymous memory, possibly backed by huge pages.
+func isRemappedText(pm *procfs.ProcMap) bool {
+	if !pm.Perms.Execute {
+		return false
+	}
+	return pm.Pathname == "" ||
+		strings.HasPrefix(pm.Pathname, "/anon_hugepage") ||
+		strings.HasPrefix(pm.Pathname, "[anon:") ||
+		strings.Contains(pm.Pathname, "libhugetlbfs")
+}
+
+// AttributeRemappedText attributes the code that was moved from the mapping of
+// a file to anonymous memory back to the file, so that its samples are
+// normalized, unwound and symbolized with it. Frameworks such as libhugetlbfs,
+// or the huge page remapping of Node.js and other Intel optimized runtimes,
+// copy the .text of their executable to huge pages, and map them over the
+// original range, which leaves a hole in the mappings of the file.
+//
+// The anonymous executable mappings right between two mappings of the same
+// file, which are laid out as they are in the file, are given the path, device,
+// inode and offset the file would have been mapped at. Anonymous mappings next
+// to a single mapping of a file, such as the code of JIT compilers placed close
+// to their executable, are left alone. It returns the number of mappings
+// attributed.
+func AttributeRemappedText(maps []*procfs.ProcMap) int {
+	var n int
+	for i := 1; i+1 < len(maps); i++ {
+		prev, m, next := maps[i-1], maps[i], maps[i+1]
+		if !isRemappedText(m) || !doesReferToFile(prev.Pathname) {
+			continue
+		}
+		if prev.Pathname != next.Pathname || prev.Dev != next.Dev || prev.Inode != next.Inode {
+			continue
+		}
+		if prev.EndAddr != m.StartAddr || m.EndAddr != next.StartAddr {
+			continue
+		}
+		if next.Offset != prev.Offset+int64(next.StartAddr-prev.StartAddr) {
+			continue
+		}
+
+		m.Pathname = prev.Pathname
+		m.Dev = prev.Dev
+		m.Inode = prev.Inode
+		m.Offset = prev.Offset + int64(m.StartAddr-prev.StartAddr)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"testing"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributeRemappedText(t *testing.T) {
+	var (
+		r  = &procfs.ProcMapPermissions{Read: true, Private: true}
+		rx = &procfs.ProcMapPermissions{Read: true, Execute: true, Private: true}
+	)
+	fileMapping := func(start, end uintptr, offset int64, perms *procfs.ProcMapPermissions) *procfs.ProcMap {
+		return &procfs.ProcMap{StartAddr: start, EndAddr: end, Offset: offset, Perms: perms, Dev: 0x803, Inode: 42, Pathname: "/usr/bin/node"}
+	}
+
+	t.Run("huge pages", func(t *testing.T) {
+		maps := []*procfs.ProcMap{
+			fileMapping(0x400000, 0x600000, 0, r),
+			fileMapping(0x600000, 0x800000, 0x200000, rx),
+			{StartAddr: 0x800000, EndAddr: 0x2000000, Perms: rx, Pathname: "/anon_hugepage (deleted)"},
+			fileMapping(0x2000000, 0x2100000, 0x1c00000, rx),
+			fileMapping(0x2100000, 0x2400000, 0x1d00000, r),
+		}
+		require.Equal(t, 1, AttributeRemappedText(maps))
+		require.Equal(t, "/usr/bin/node", maps[2].Pathname)
+		require.Equal(t, int64(0x400000), maps[2].Offset)
+		require.Equal(t, uint64(42), maps[2].Inode)
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		maps := []*procfs.ProcMap{
+			fileMapping(0x400000, 0x600000, 0, r),
+			{StartAddr: 0x600000, EndAddr: 0x800000, Perms: rx},
+			fileMapping(0x800000, 0x900000, 0x400000, r),
+		}
+		require.Equal(t, 1, AttributeRemappedText(maps))
+		require.Equal(t, "/usr/bin/node", maps[1].Pathname)
+		require.Equal(t, int64(0x200000), maps[1].Offset)
+	})
+
+	t.Run("not laid out as in the file", func(t *testing.T) {
+		maps := []*procfs.ProcMap{
+			fileMapping(0x400000, 0x600000, 0, r),
+			{StartAddr: 0x600000, EndAddr: 0x800000, Perms: rx},
+			fileMapping(0x800000, 0x900000, 0x200000, r),
+		}
+		require.Zero(t, AttributeRemappedText(maps))
+		require.Empty(t, maps[1].Pathname)
+	})
+
+	t.Run("next to a single mapping", func(t *testing.T) {
+		maps := []*procfs.ProcMap{
+			fileMapping(0x400000, 0x600000, 0, r),
+			{StartAddr: 0x600000, EndAddr: 0x800000, Perms: rx},
+			{StartAddr: 0x800000, EndAddr: 0x900000, Perms: r},
+		}
+		require.Zero(t, AttributeRemappedText(maps))
+	})
+
+	t.Run("not executable", func(t *testing.T) {
+		maps := []*procfs.ProcMap{
+			fileMapping(0x400000, 0x600000, 0, r),
+			{StartAddr: 0x600000, EndAddr: 0x800000, Perms: r},
+			fileMapping(0x800000, 0x900000, 0x400000, r),
+		}
+		require.Zero(t, AttributeRemappedText(maps))
+	})
+}
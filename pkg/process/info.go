@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -32,12 +34,24 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 
+	"github.com/parca-dev/parca-agent/internal/procfs"
 	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/goruntime"
+	"github.com/parca-dev/parca-agent/pkg/interpreter"
+	"github.com/parca-dev/parca-agent/pkg/lifecycle"
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+	"github.com/parca-dev/parca-agent/pkg/tracecontext"
 )
 
+// ErrDebuginfoUnavailable is returned by the DebuginfoManager while the
+// server is unavailable, the uploads are paused in the meantime.
+var ErrDebuginfoUnavailable = errors.New("debuginfo server unavailable")
+
 type DebuginfoManager interface {
 	ShouldInitiateUpload(context.Context, string) (bool, error)
 	UploadMapping(context.Context, *Mapping) error
+	// Drain waits for the uploads in flight to finish on shutdown.
+	Drain(context.Context) error
 	Close() error
 }
 
@@ -54,6 +68,7 @@ const (
 
 	lvAlreadyClosed        = "already_closed"
 	lvShouldInitiateUpload = "should_initiate_upload"
+	lvUnavailable          = "unavailable"
 	lvUnknown              = "unknown"
 )
 
@@ -64,6 +79,7 @@ type metrics struct {
 	get              prometheus.Counter
 	uploadErrors     *prometheus.CounterVec
 	metadataDuration prometheus.Histogram
+	runtimeDetected  *prometheus.CounterVec
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -85,6 +101,10 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			Name: "parca_agent_process_info_get_total",
 			Help: "Total number of debug information gets.",
 		}),
+		runtimeDetected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_process_info_runtime_detected_total",
+			Help: "Total number of processes by the language runtime detected.",
+		}, []string{"runtime"}),
 		uploadErrors: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "parca_agent_process_info_upload_errors_total",
 			Help: "Total number of debug information upload errors.",
@@ -100,7 +120,11 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 	m.fetched.WithLabelValues(lvShared)
 	m.uploadErrors.WithLabelValues(lvShouldInitiateUpload)
 	m.uploadErrors.WithLabelValues(lvAlreadyClosed)
+	m.uploadErrors.WithLabelValues(lvUnavailable)
 	m.uploadErrors.WithLabelValues(lvUnknown)
+	for _, r := range runtimes {
+		m.runtimeDetected.WithLabelValues(string(r))
+	}
 	return m
 }
 
@@ -113,12 +137,34 @@ type InfoManager struct {
 	fetchInProgress  *sync.Map
 	uploadInprogress *sync.Map
 
-	mapManager       *MapManager
-	debuginfoManager DebuginfoManager
-	labelManager     LabelManager
+	mapManager         *MapManager
+	debuginfoManager   DebuginfoManager
+	labelManager       LabelManager
+	interpreterFinder  *interpreter.Finder
+	goRuntimeFinder    *goruntime.Finder
+	traceContextFinder *tracecontext.Finder
+	// Runtimes whose interpreter unwinders are enabled.
+	runtimeUnwinders map[Runtime]struct{}
+	// Optional, records the processes discovered and their uploads.
+	events *lifecycle.EventLog
 }
 
-func NewInfoManager(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, mm *MapManager, dim DebuginfoManager, lm LabelManager, profilingDuration time.Duration) *InfoManager {
+func NewInfoManager(
+	logger log.Logger,
+	tracer trace.Tracer,
+	reg prometheus.Registerer,
+	mm *MapManager,
+	dim DebuginfoManager,
+	lm LabelManager,
+	profilingDuration time.Duration,
+	runtimeUnwinders []Runtime,
+	events *lifecycle.EventLog,
+) *InfoManager {
+	unwinders := make(map[Runtime]struct{}, len(runtimeUnwinders))
+	for _, r := range runtimeUnwinders {
+		unwinders[r] = struct{}{}
+	}
+
 	return &InfoManager{
 		logger:  logger,
 		tracer:  tracer,
@@ -127,12 +173,22 @@ func NewInfoManager(logger log.Logger, tracer trace.Tracer, reg prometheus.Regis
 			burrow.WithMaximumSize(2048),
 			burrow.WithExpireAfterAccess(12*profilingDuration),
 			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "process_info")),
+			burrow.WithRemovalListener(func(_ burrow.Key, v burrow.Value) {
+				if info, ok := v.(Info); ok {
+					info.PIDFD.Close()
+				}
+			}),
 		),
-		mapManager:       mm,
-		debuginfoManager: dim,
-		labelManager:     lm,
-		fetchInProgress:  &sync.Map{},
-		uploadInprogress: &sync.Map{},
+		mapManager:         mm,
+		debuginfoManager:   dim,
+		labelManager:       lm,
+		interpreterFinder:  interpreter.NewFinder(),
+		goRuntimeFinder:    goruntime.NewFinder(),
+		traceContextFinder: tracecontext.NewFinder(),
+		runtimeUnwinders:   unwinders,
+		events:             events,
+		fetchInProgress:    &sync.Map{},
+		uploadInprogress:   &sync.Map{},
 	}
 }
 
@@ -146,6 +202,20 @@ type Info struct {
 	//   * "/proc/%d/root/jit-%d.dump" for JITDUMP
 	// - Unwind Information
 	Mappings Mappings
+	// PIDFD refers to the process the information was read from, to detect
+	// the PID being reused by another process.
+	PIDFD *PIDFD
+	// Interpreter run by the process whose stack can be walked, if any.
+	Interpreter *interpreter.Info
+	// Go runtime of the process, if it is a supported Go program.
+	GoRuntime *goruntime.Info
+	// Trace context published by the process, if it is instrumented.
+	TraceContext *tracecontext.Info
+	// Runtime detected for the process.
+	Runtime Runtime
+	// Compat is whether the process runs a 32-bit executable, such as an
+	// i386 or armv7 program on a 64-bit host.
+	Compat bool
 }
 
 func (i Info) Labels(ctx context.Context) (model.LabelSet, error) {
@@ -170,12 +240,38 @@ func (im *InfoManager) Fetch(ctx context.Context, pid int) (err error) { //nolin
 		if !ok {
 			return fmt.Errorf("unexpected type in cache: %T", val)
 		}
+		if !info.PIDFD.Alive() {
+			// The cached process exited and the PID has been reused by a new
+			// one, which has nothing in common with it.
+			im.cache.Invalidate(pid)
+			info.PIDFD.Close()
+			return im.Fetch(ctx, pid)
+		}
 
 		im.metrics.fetched.WithLabelValues(lvShared).Inc()
 
-		// Always try to upload debug information of the discovered object files, in case it is not uploaded before.
-		// Debuginfo manager makes sure that the debug information is uploaded only once.
-		im.ensureDebuginfoUploaded(ctx, pid, info.Mappings)
+		if _, exists := im.fetchInProgress.LoadOrStore(pid, struct{}{}); exists {
+			return nil
+		}
+		defer im.fetchInProgress.Delete(pid)
+
+		// Only the mappings added since, such as the libraries loaded with dlopen(3),
+		// are initialized and have their debug information uploaded.
+		mappings, diff, err := im.mapManager.RefreshMappingsForPID(pid, info.Mappings)
+		if err == nil {
+			err = info.PIDFD.Check()
+		}
+		if err != nil {
+			level.Debug(im.logger).Log("msg", "failed to refresh mappings", "pid", pid, "err", err)
+			return nil
+		}
+		if diff.Empty() {
+			return nil
+		}
+		info.Mappings = mappings
+		im.cache.Put(pid, info)
+
+		im.ensureDebuginfoUploaded(ctx, pid, diff.Added)
 		return nil
 	}
 
@@ -199,6 +295,18 @@ func (im *InfoManager) Fetch(ctx context.Context, pid int) (err error) { //nolin
 	// And to avoid missing information for the short lived processes, the extraction and finding of debug information
 	// should be done as soon as possible.
 
+	// The process is pinned before anything is read from /proc/<pid>, so that
+	// reads racing with the PID being recycled can be detected below.
+	pidfd, err := OpenPIDFD(pid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			pidfd.Close()
+		}
+	}()
+
 	mappings, err := im.mapManager.MappingsForPID(pid)
 	if err != nil {
 		return err
@@ -207,13 +315,57 @@ func (im *InfoManager) Fetch(ctx context.Context, pid int) (err error) { //nolin
 	// Upload debug information of the discovered object files.
 	im.ensureDebuginfoUploaded(ctx, pid, mappings)
 
+	procMaps := make([]*procfs.ProcMap, 0, len(mappings))
+	for _, m := range mappings {
+		procMaps = append(procMaps, m.ProcMap)
+	}
+	goRuntime, gErr := im.goRuntimeFinder.Find(pid)
+	if gErr != nil {
+		level.Debug(im.logger).Log("msg", "failed to find Go runtime", "pid", pid, "err", gErr)
+	}
+	runtime := detectRuntime(pid, procMaps, goRuntime != nil)
+	im.metrics.runtimeDetected.WithLabelValues(string(runtime)).Inc()
+
+	// Best effort, stacks are still walked natively without it.
+	var interp *interpreter.Info
+	if _, ok := im.runtimeUnwinders[runtime]; ok {
+		var iErr error
+		interp, iErr = im.interpreterFinder.Find(pid, procMaps)
+		if iErr != nil {
+			level.Debug(im.logger).Log("msg", "failed to find interpreter", "pid", pid, "err", iErr)
+		}
+	}
+
+	compat, cErr := isCompat(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if cErr != nil {
+		level.Debug(im.logger).Log("msg", "failed to read the ELF class of the executable", "pid", pid, "err", cErr)
+	}
+
+	traceContext, tErr := im.traceContextFinder.Find(pid)
+	if tErr != nil {
+		level.Debug(im.logger).Log("msg", "failed to find trace context", "pid", pid, "err", tErr)
+	}
+
+	// Everything above may have been read from a process that reused the PID
+	// after the pinned one exited.
+	if err := pidfd.Check(); err != nil {
+		return err
+	}
+
 	// No matter what happens with the debug information, we should continue.
 	// And cache other process information.
 	im.cache.Put(pid, Info{
-		im:       im,
-		pid:      pid,
-		Mappings: mappings,
+		im:           im,
+		pid:          pid,
+		Mappings:     mappings,
+		PIDFD:        pidfd,
+		Interpreter:  interp,
+		GoRuntime:    goRuntime,
+		TraceContext: traceContext,
+		Runtime:      runtime,
+		Compat:       compat,
 	})
+	im.events.Record(pid, lifecycle.Discovered, fmt.Sprintf("runtime=%s mappings=%d", runtime, len(mappings)), nil)
 
 	now = time.Now()
 	defer func() {
@@ -269,6 +421,13 @@ func (im *InfoManager) ensureDebuginfoUploaded(ctx context.Context, pid int, map
 
 	span.SetAttributes(attribute.Int("pid", pid))
 
+	// The debuginfo is uploaded as the tenant of the process.
+	if ls, err := im.labelManager.LabelSet(ctx, pid); err == nil {
+		if t, ok := ls[tenant.Label]; ok {
+			ctx = tenant.WithTenant(ctx, string(t))
+		}
+	}
+
 	var (
 		di = im.debuginfoManager
 		wg = &sync.WaitGroup{}
@@ -288,6 +447,11 @@ func (im *InfoManager) ensureDebuginfoUploaded(ctx context.Context, pid int, map
 			// All the caches and references are based on the source file's buildID.
 
 			shouldInitiateUpload, err := di.ShouldInitiateUpload(ctx, m.BuildID)
+			if errors.Is(err, ErrDebuginfoUnavailable) {
+				// Nothing is extracted nor logged while the server is down.
+				im.metrics.uploadErrors.WithLabelValues(lvUnavailable).Inc()
+				return
+			}
 			if err != nil {
 				im.metrics.uploadErrors.WithLabelValues(lvShouldInitiateUpload).Inc()
 				err = fmt.Errorf("failed to check whether build ID exists: %w", err)
@@ -306,12 +470,18 @@ func (im *InfoManager) ensureDebuginfoUploaded(ctx context.Context, pid int, map
 					im.metrics.uploadErrors.WithLabelValues(lvAlreadyClosed).Inc()
 					return
 				}
+				if errors.Is(err, ErrDebuginfoUnavailable) {
+					im.metrics.uploadErrors.WithLabelValues(lvUnavailable).Inc()
+					return
+				}
 				im.metrics.uploadErrors.WithLabelValues(lvUnknown).Inc()
 				err = fmt.Errorf("failed to ensure debug information uploaded: %w", err)
 				level.Error(im.logger).Log("msg", "upload mapping", "err", err, "buildid", m.BuildID, "filepath", m.AbsolutePath())
 				span.RecordError(err)
+				im.events.Record(pid, lifecycle.DebuginfoUpload, "buildid="+m.BuildID, err)
 				return
 			}
+			im.events.Record(pid, lifecycle.DebuginfoUpload, "buildid="+m.BuildID, nil)
 		}(span, m)
 	}
 
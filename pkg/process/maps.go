@@ -28,9 +28,9 @@ import (
 	"github.com/google/pprof/profile"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/procfs"
 
 	"github.com/parca-dev/parca-agent/internal/pprof/elfexec"
+	"github.com/parca-dev/parca-agent/internal/procfs"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 )
 
@@ -49,11 +49,16 @@ const (
 	lvObtainFD            = "obtain_fd"
 	lvOpenObjectfile      = "open_objectfile"
 	lvComputeKernelOffset = "compute_kernel_offset"
+
+	lvAdded     = "added"
+	lvRemoved   = "removed"
+	lvUnchanged = "unchanged"
 )
 
 type mapMetrics struct {
 	initialized *prometheus.CounterVec
 	initErrors  *prometheus.CounterVec
+	changes     *prometheus.CounterVec
 }
 
 func newMapMetrics(reg prometheus.Registerer) *mapMetrics {
@@ -66,12 +71,19 @@ func newMapMetrics(reg prometheus.Registerer) *mapMetrics {
 			Name: "parca_agent_mapping_initialization_errors_total",
 			Help: "Total number of times a mapping failed to init.",
 		}, []string{"type"}),
+		changes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_mapping_changes_total",
+			Help: "Total number of mappings found added, removed or unchanged when the mappings of a process were read again.",
+		}, []string{"change"}),
 	}
 	m.initialized.WithLabelValues(lvSuccess)
 	m.initialized.WithLabelValues(lvFail)
 	m.initErrors.WithLabelValues(lvObtainFD)
 	m.initErrors.WithLabelValues(lvOpenObjectfile)
 	m.initErrors.WithLabelValues(lvComputeKernelOffset)
+	m.changes.WithLabelValues(lvAdded)
+	m.changes.WithLabelValues(lvRemoved)
+	m.changes.WithLabelValues(lvUnchanged)
 	return m
 }
 
@@ -116,20 +128,85 @@ var (
 
 // MappingsForPID returns all the mappings for the given PID.
 func (mm *MapManager) MappingsForPID(pid int) (Mappings, error) {
+	mappings, _, err := mm.RefreshMappingsForPID(pid, nil)
+	return mappings, err
+}
+
+// MappingsDiff is the difference between two reads of the mappings of a
+// process.
+type MappingsDiff struct {
+	// Added are the mappings that weren't there before, such as the
+	// libraries loaded with dlopen(3) or new JIT regions.
+	Added Mappings
+	// Removed are the mappings that are gone since.
+	Removed Mappings
+}
+
+// Empty returns true if the mappings didn't change.
+func (d MappingsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// mappingKey identifies a mapping across reads of the mappings of a process.
+type mappingKey struct {
+	startAddr, endAddr uintptr
+	perms              procfs.ProcMapPermissions
+	offset             int64
+	dev                uint64
+	inode              uint64
+	pathname           string
+}
+
+func keyOf(pm *procfs.ProcMap) mappingKey {
+	k := mappingKey{
+		startAddr: pm.StartAddr,
+		endAddr:   pm.EndAddr,
+		offset:    pm.Offset,
+		dev:       pm.Dev,
+		inode:     pm.Inode,
+		pathname:  pm.Pathname,
+	}
+	if pm.Perms != nil {
+		k.perms = *pm.Perms
+	}
+	return k
+}
+
+// RefreshMappingsForPID reads the mappings of the given PID again, and returns
+// them along with how they changed since the previous ones. The mappings that
+// were already there are reused as they are, only the new ones are initialized,
+// so that processes with thousands of mappings are cheap to refresh.
+func (mm *MapManager) RefreshMappingsForPID(pid int, previous Mappings) (Mappings, MappingsDiff, error) {
 	proc, err := mm.Proc(pid)
 	if err != nil {
-		return nil, errors.Join(ErrProcNotFound, fmt.Errorf("failed to open proc %d: %w", pid, err))
+		return nil, MappingsDiff{}, errors.Join(ErrProcNotFound, fmt.Errorf("failed to open proc %d: %w", pid, err))
 	}
 
 	maps, err := proc.ProcMaps()
 	if err != nil {
-		return nil, errors.Join(ErrProcNotFound, fmt.Errorf("failed to read proc maps for proc %d: %w", pid, err))
+		return nil, MappingsDiff{}, errors.Join(ErrProcNotFound, fmt.Errorf("failed to read proc maps for proc %d: %w", pid, err))
 	}
+	AttributeRemappedText(maps)
 
-	res := make([]*Mapping, 0, len(maps))
-	var errs error
-	idx := 0
+	existing := make(map[mappingKey]*Mapping, len(previous))
+	for _, m := range previous {
+		existing[keyOf(m.ProcMap)] = m
+	}
+
+	var (
+		res  = make([]*Mapping, 0, len(maps))
+		diff MappingsDiff
+		errs error
+	)
 	for _, m := range maps {
+		k := keyOf(m)
+		if mapping, ok := existing[k]; ok {
+			delete(existing, k)
+			mm.metrics.changes.WithLabelValues(lvUnchanged).Inc()
+			res = append(res, mapping)
+			continue
+		}
+
 		// TODO(kakkoyun): Try to parallelize this to minimize the race window.
 		mapping, err := mm.newUserMapping(m, pid)
 		if err != nil {
@@ -144,9 +221,60 @@ func (mm *MapManager) MappingsForPID(pid int) (Mappings, error) {
 		}
 		mm.metrics.initialized.WithLabelValues(lvSuccess).Inc()
 		res = append(res, mapping)
-		idx++
+		if previous != nil {
+			mm.metrics.changes.WithLabelValues(lvAdded).Inc()
+		}
+		diff.Added = append(diff.Added, mapping)
 	}
-	return res, errs
+	for _, m := range previous {
+		if _, ok := existing[keyOf(m.ProcMap)]; ok {
+			mm.metrics.changes.WithLabelValues(lvRemoved).Inc()
+			diff.Removed = append(diff.Removed, m)
+		}
+	}
+	return res, diff, errs
+}
+
+// Executable returns the executable mappings, the ones ConvertToPprof
+// converts, in the same order.
+func (ms Mappings) Executable() Mappings {
+	res := make(Mappings, 0, len(ms))
+	for _, m := range ms {
+		if m.isExecutable() {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// Symbolizable returns true if any of the executable mappings refers to a
+// file that has a build ID to upload its debug information by, or unwind
+// information.
+func (ms Mappings) Symbolizable() bool {
+	for _, m := range ms {
+		if m.isSymbolizable() && (m.BuildID != "" || m.HasEhFrame) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecutableBuildID returns the build ID of the executable of the process,
+// the file mapped first, or an empty string if it has none.
+func (ms Mappings) ExecutableBuildID() string {
+	var executable string
+	for _, m := range ms {
+		if !doesReferToFile(m.Pathname) {
+			continue
+		}
+		if executable == "" {
+			executable = m.Pathname
+		}
+		if m.Pathname == executable && m.isExecutable() {
+			return m.BuildID
+		}
+	}
+	return ""
 }
 
 // MappingForAddr returns the executable mapping that contains the given address.
@@ -175,6 +303,9 @@ type Mapping struct {
 	// So that it could be GCed and closed.
 	// This is needed for pprof conversion.
 	BuildID string
+	// Whether the mapped file has unwind information, in its .eh_frame
+	// section. Only populated along with the build ID.
+	HasEhFrame bool
 
 	// Offset of kernel relocation symbol.
 	// Only defined for kernel images, nil otherwise. e. g. _stext.
@@ -211,6 +342,13 @@ func (mm *MapManager) newUserMapping(pm *procfs.ProcMap, pid int) (*Mapping, err
 		return nil, fmt.Errorf("failed to compute kernel offset: %w", err)
 	}
 
+	ef, release, err := obj.ELF()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ELF file: %w", err)
+	}
+	m.HasEhFrame = ef.Section(".eh_frame") != nil
+	release()
+
 	m.objFile = obj // Hold on to this until base is computed.
 	m.BuildID = obj.BuildID
 	return m, nil
@@ -234,6 +372,24 @@ func doesReferToFile(path string) bool {
 	// NOTICE: Add more patterns when needed.
 }
 
+// IsAnonymous returns true if the mapping is not backed by a file with code
+// to be found by its path: anonymous memory, named or not, memory created
+// with memfd_create(2) and shared anonymous memory. JITs writing perf maps,
+// e.g. Julia and LuaJIT, place their code in them.
+func (m *Mapping) IsAnonymous() bool {
+	return isAnonymous(m.Pathname)
+}
+
+func isAnonymous(path string) bool {
+	path = strings.TrimSpace(path)
+	return path == "" ||
+		strings.HasPrefix(path, "[anon:") ||
+		strings.HasPrefix(path, "[anon_shmem:") ||
+		strings.HasPrefix(path, "/memfd:") ||
+		strings.HasPrefix(path, "/dev/zero"+deletedSuffix) ||
+		strings.HasPrefix(path, "/SYSV")
+}
+
 // Root returns the root filesystem of the process that owns the mapping.
 func (m *Mapping) Root() string {
 	return path.Join("/proc", strconv.Itoa(m.PID), "/root")
@@ -241,7 +397,24 @@ func (m *Mapping) Root() string {
 
 // AbsolutePath returns path relative to the root namespace of the system.
 func (m *Mapping) AbsolutePath() string {
-	return path.Join("/proc", strconv.Itoa(m.PID), "/root", m.Pathname)
+	return MappedFilePath(m.PID, m.Pathname, uint64(m.StartAddr), uint64(m.EndAddr))
+}
+
+// deletedSuffix is appended to the path of the mapped files that were
+// deleted, including the ones created with memfd_create(2), which are named
+// "/memfd:<name> (deleted)".
+const deletedSuffix = " (deleted)"
+
+// MappedFilePath returns the path the file of a mapping can be read at from
+// the root namespace of the system. The files that can't be found by their
+// path, because they were created with memfd_create(2) by packers or JIT
+// frameworks or were deleted since they were mapped, are read through the
+// map_files directory of the process, which requires CAP_SYS_ADMIN.
+func MappedFilePath(pid int, pathname string, start, end uint64) string {
+	if strings.HasSuffix(pathname, deletedSuffix) {
+		return path.Join("/proc", strconv.Itoa(pid), "map_files", fmt.Sprintf("%x-%x", start, end))
+	}
+	return path.Join("/proc", strconv.Itoa(pid), "/root", pathname)
 }
 
 // kernelRelocationSymbol extracts kernel relocation symbol _text or _stext
@@ -361,7 +534,13 @@ func (m *Mapping) findProgramHeader(ef *elf.File, addr uint64) (*elf.ProgHeader,
 	// Get all program headers associated with the mapping.
 	headers := elfexec.ProgramHeadersForMapping(phdrs, uint64(m.Offset), uint64(m.EndAddr)-uint64(m.StartAddr))
 	if len(headers) == 0 {
-		return nil, errors.New("no program header matches mapping info")
+		// The mapping isn't aligned to the segments the way the loader of
+		// the system would, e.g. with pages larger than 4KiB or when mapped
+		// by a custom loader, so the header is looked up by the file offset
+		// of the address only.
+		for i := range phdrs {
+			headers = append(headers, &phdrs[i])
+		}
 	}
 	if len(headers) == 1 {
 		return headers[0], nil
@@ -421,16 +600,30 @@ func (m *Mapping) computeBase(addr uint64) {
 	m.base = base
 }
 
-// ConvertToPprof converts the Mapping to a pprof profile.Mapping.
-func (m *Mapping) ConvertToPprof() *profile.Mapping {
-	var (
-		buildID = m.BuildID
-		path    = m.Pathname
-	)
+// ResolveBuildID returns the build ID of the mapped file, looked up in the
+// object file pool, for the mappings that don't have one yet. It is the hash
+// of the file for the ones without a Go or GNU build ID. The mappings that
+// don't refer to a file have none.
+func (m *Mapping) ResolveBuildID() (string, error) {
+	if m.BuildID != "" || !m.isSymbolizable() {
+		return m.BuildID, nil
+	}
+	if m.mm == nil {
+		return "", errors.New("mapping has no object file pool")
+	}
 
-	if buildID == "" {
-		buildID = "unknown"
+	obj, err := m.mm.objFilePool.Open(m.AbsolutePath())
+	if err != nil {
+		return "", fmt.Errorf("failed to open mapped object file: %w", err)
 	}
+	defer obj.HoldOn()
+	return obj.BuildID, nil
+}
+
+// ConvertToPprof converts the Mapping to a pprof profile.Mapping. The build
+// ID is left empty when it is unknown, see ResolveBuildID.
+func (m *Mapping) ConvertToPprof() *profile.Mapping {
+	path := m.Pathname
 	if path == "" {
 		// TODO: Maybe add detection for JITs that use files.
 		path = "jit"
@@ -440,7 +633,7 @@ func (m *Mapping) ConvertToPprof() *profile.Mapping {
 		Start:   uint64(m.StartAddr),
 		Limit:   uint64(m.EndAddr),
 		Offset:  uint64(m.Offset),
-		BuildID: buildID,
+		BuildID: m.BuildID,
 		File:    path,
 	}
 }
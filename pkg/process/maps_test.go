@@ -14,8 +14,11 @@
 package process
 
 import (
+	"debug/elf"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/go-kit/log"
@@ -464,6 +467,26 @@ func TestELFObjAddrPIE(t *testing.T) {
 }
 
 // TODO(kakkoyun): Add real proc map examples.
+func TestFindProgramHeaderByFileOffset(t *testing.T) {
+	ef, err := elf.Open("testdata/fib-nopie")
+	require.NoError(t, err)
+	t.Cleanup(func() { ef.Close() })
+
+	// Starts in the last page of the data segment and extends past it, so
+	// no segment matches the mapping the way the loader maps them.
+	m := &Mapping{ProcMap: &procfs.ProcMap{StartAddr: 0x7f0000002000, EndAddr: 0x7f0000004000, Offset: 0x2f00}}
+	ph, err := m.findProgramHeader(ef, 0x7f0000002000)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x2e10), ph.Off)
+	require.Equal(t, uint64(0x403e10), ph.Vaddr)
+}
+
+func TestMappedFilePath(t *testing.T) {
+	require.Equal(t, "/proc/42/root/usr/lib/libc.so.6", MappedFilePath(42, "/usr/lib/libc.so.6", 0x7f0000000000, 0x7f0000001000))
+	require.Equal(t, "/proc/42/map_files/7f0000000000-7f0000001000", MappedFilePath(42, "/memfd:packed (deleted)", 0x7f0000000000, 0x7f0000001000))
+	require.Equal(t, "/proc/42/map_files/400000-401000", MappedFilePath(42, "/tmp/app (deleted)", 0x400000, 0x401000))
+}
+
 func TestMapping_doesReferToFile(t *testing.T) {
 	cases := []struct {
 		path     string
@@ -485,3 +508,151 @@ func TestMapping_doesReferToFile(t *testing.T) {
 		}
 	}
 }
+
+func TestMapping_isAnonymous(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"":                               true,
+		"[anon:julia]":                   true,
+		"[anon_shmem:luajit]":            true,
+		"/memfd:julia-codegen (deleted)": true,
+		"/dev/zero (deleted)":            true,
+		"/SYSV00000000 (deleted)":        true,
+		"[vdso]":                         false,
+		"[heap]":                         false,
+		"/usr/lib/libjulia.so.1":         false,
+		"/dev/zero":                      false,
+	} {
+		require.Equal(t, expected, isAnonymous(path), path)
+	}
+}
+
+func TestMappingsSymbolizable(t *testing.T) {
+	exec := procfs.ProcMapPermissions{Read: true, Execute: true}
+	stripped := &Mapping{ProcMap: &procfs.ProcMap{Pathname: "/app", Perms: &exec}}
+	anonymous := &Mapping{ProcMap: &procfs.ProcMap{Perms: &exec}}
+	data := &Mapping{ProcMap: &procfs.ProcMap{Pathname: "/lib/libc.so.6", Perms: &procfs.ProcMapPermissions{Read: true}}, BuildID: "abc"}
+
+	require.False(t, Mappings{}.Symbolizable())
+	require.False(t, Mappings{stripped, anonymous, data}.Symbolizable())
+
+	withBuildID := &Mapping{ProcMap: &procfs.ProcMap{Pathname: "/lib/libc.so.6", Perms: &exec}, BuildID: "abc"}
+	require.True(t, Mappings{stripped, withBuildID}.Symbolizable())
+
+	withEhFrame := &Mapping{ProcMap: &procfs.ProcMap{Pathname: "/app", Perms: &exec}, HasEhFrame: true}
+	require.True(t, Mappings{anonymous, withEhFrame}.Symbolizable())
+}
+
+func TestMappingsExecutableBuildID(t *testing.T) {
+	read := procfs.ProcMapPermissions{Read: true}
+	exec := procfs.ProcMapPermissions{Read: true, Execute: true}
+
+	require.Equal(t, "", Mappings{}.ExecutableBuildID())
+	require.Equal(t, "app", Mappings{
+		{ProcMap: &procfs.ProcMap{Perms: &exec}},
+		{ProcMap: &procfs.ProcMap{Pathname: "/app", Perms: &read}},
+		{ProcMap: &procfs.ProcMap{Pathname: "/app", Perms: &exec}, BuildID: "app"},
+		{ProcMap: &procfs.ProcMap{Pathname: "/lib/libc.so.6", Perms: &exec}, BuildID: "libc"},
+	}.ExecutableBuildID())
+	// Stripped of its build ID.
+	require.Equal(t, "", Mappings{
+		{ProcMap: &procfs.ProcMap{Pathname: "/app", Perms: &exec}},
+		{ProcMap: &procfs.ProcMap{Pathname: "/lib/libc.so.6", Perms: &exec}, BuildID: "libc"},
+	}.ExecutableBuildID())
+}
+
+func TestRefreshMappingsForPID(t *testing.T) {
+	abs, err := filepath.Abs("testdata/fib-nopie")
+	require.NoError(t, err)
+
+	// The mappings are read from a fake procfs, while the mapped files are
+	// opened through the root of this very process.
+	root := t.TempDir()
+	pid := os.Getpid()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	writeMaps := func(lines ...string) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "maps"), []byte(strings.Join(lines, "\n")+"\n"), 0o644))
+	}
+
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	mm := NewMapManager(
+		prometheus.NewRegistry(),
+		fs,
+		objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 1),
+	)
+
+	writeMaps(
+		"00401000-00402000 r-xp 00001000 fd:01 100 "+abs,
+		"7f0000000000-7f0000001000 rw-p 00000000 00:00 0",
+	)
+	first, diff, err := mm.RefreshMappingsForPID(pid, nil)
+	require.NoError(t, err)
+	require.Len(t, first, 2)
+	require.Equal(t, first, diff.Added)
+	require.Empty(t, diff.Removed)
+	require.NotEmpty(t, first[0].BuildID)
+
+	// Nothing changed.
+	second, diff, err := mm.RefreshMappingsForPID(pid, first)
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+	require.Same(t, first[0], second[0])
+	require.Same(t, first[1], second[1])
+
+	// A library is loaded, and an anonymous mapping is unmapped.
+	writeMaps(
+		"00401000-00402000 r-xp 00001000 fd:01 100 "+abs,
+		"7f0000002000-7f0000003000 r-xp 00001000 fd:01 100 "+abs,
+	)
+	third, diff, err := mm.RefreshMappingsForPID(pid, second)
+	require.NoError(t, err)
+	require.Len(t, third, 2)
+	require.Same(t, first[0], third[0])
+	require.Equal(t, Mappings{third[1]}, diff.Added)
+	require.Equal(t, Mappings{first[1]}, diff.Removed)
+}
+
+func TestMappingResolveBuildID(t *testing.T) {
+	abs, err := filepath.Abs("testdata/fib-nopie")
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	pid := os.Getpid()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "maps"), []byte(
+		"00401000-00402000 r-xp 00001000 fd:01 100 "+abs+"\n"+
+			"7f0000000000-7f0000001000 r-xp 00000000 00:00 0\n",
+	), 0o644))
+
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	mm := NewMapManager(
+		prometheus.NewRegistry(),
+		fs,
+		objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 1),
+	)
+	mappings, err := mm.MappingsForPID(pid)
+	require.NoError(t, err)
+	require.Len(t, mappings, 2)
+
+	buildID := mappings[0].BuildID
+	require.NotEmpty(t, buildID)
+	stripped := *mappings[0]
+	stripped.BuildID = ""
+	require.Empty(t, stripped.ConvertToPprof().BuildID)
+	resolved, err := stripped.ResolveBuildID()
+	require.NoError(t, err)
+	require.Equal(t, buildID, resolved)
+
+	// Anonymous mappings have none.
+	resolved, err = mappings[1].ResolveBuildID()
+	require.NoError(t, err)
+	require.Empty(t, resolved)
+
+	stripped.mm = nil
+	_, err = stripped.ResolveBuildID()
+	require.Error(t, err)
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrProcessExited is returned when a process exited while its information
+// was read, so the PID may already refer to a different process.
+var ErrProcessExited = errors.New("process exited")
+
+// PIDFD is a stable reference to a process. Unlike its PID, it can't be
+// recycled for another process once the referenced one exits, which makes it
+// possible to tell whether something read from /proc/<pid> belongs to it.
+//
+// A nil PIDFD is valid and is used on kernels without pidfd_open(2) (< 5.3)
+// and on other platforms; it reports the process as alive, falling back to
+// plain PID semantics.
+type PIDFD struct {
+	pid int
+	f   *os.File
+}
+
+// Alive reports whether the referenced process is still running, that is,
+// whether its PID still refers to it.
+func (p *PIDFD) Alive() bool {
+	if p == nil {
+		return true
+	}
+	return p.alive()
+}
+
+// Close releases the reference, after which the process is reported as
+// exited. It is safe to call more than once.
+func (p *PIDFD) Close() error {
+	if p == nil {
+		return nil
+	}
+	if err := p.f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Check returns ErrProcessExited if the referenced process is gone. It is
+// meant to be called after reading from /proc/<pid> to validate the read.
+func (p *PIDFD) Check() error {
+	if !p.Alive() {
+		return fmt.Errorf("%w: pid %d", ErrProcessExited, p.pid)
+	}
+	return nil
+}
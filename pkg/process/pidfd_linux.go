@@ -0,0 +1,55 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenPIDFD opens a reference to the process currently running as pid.
+func OpenPIDFD(pid int) (*PIDFD, error) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+			return nil, nil
+		}
+		if errors.Is(err, unix.ESRCH) {
+			return nil, fmt.Errorf("%w: pid %d", ErrProcessExited, pid)
+		}
+		return nil, fmt.Errorf("pidfd_open: %w", err)
+	}
+	return &PIDFD{pid: pid, f: os.NewFile(uintptr(fd), fmt.Sprintf("pidfd:%d", pid))}, nil
+}
+
+func (p *PIDFD) alive() bool {
+	alive := true
+	if err := p.control(func(fd uintptr) {
+		alive = !errors.Is(unix.PidfdSendSignal(int(fd), 0, nil, 0), unix.ESRCH)
+	}); err != nil {
+		return false
+	}
+	return alive
+}
+
+func (p *PIDFD) control(f func(fd uintptr)) error {
+	rc, err := p.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rc.Control(f)
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPIDFD(t *testing.T) {
+	self, err := OpenPIDFD(os.Getpid())
+	require.NoError(t, err)
+	if self == nil {
+		t.Skip("pidfd_open(2) is not supported")
+	}
+	require.True(t, self.Alive())
+	require.NoError(t, self.Check())
+
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Start())
+	child, err := OpenPIDFD(cmd.Process.Pid)
+	require.NoError(t, err)
+	require.NoError(t, cmd.Wait())
+
+	// The PID may be reused from now on, the reference must not follow it.
+	require.False(t, child.Alive())
+	require.ErrorIs(t, child.Check(), ErrProcessExited)
+
+	// Once closed, the reference can't tell anymore.
+	require.NoError(t, self.Close())
+	require.NoError(t, self.Close())
+	require.False(t, self.Alive())
+
+	// A nil reference, when pidfds aren't supported, assumes the PID is right.
+	var unsupported *PIDFD
+	require.True(t, unsupported.Alive())
+	require.NoError(t, unsupported.Close())
+}
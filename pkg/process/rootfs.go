@@ -0,0 +1,200 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	burrow "github.com/goburrow/cache"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
+)
+
+// Maximum number of symbolic links followed while resolving a path, as the
+// kernel's.
+const maxSymlinks = 40
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// RootFS resolves the paths of files in the root filesystems of processes,
+// which differ from the agent's one for containerized processes, to paths the
+// agent can open.
+//
+// Paths are resolved through /proc/<pid>/root, following symbolic links
+// within the root of the process: the kernel resolves absolute links found
+// past /proc/<pid>/root against the root of the agent instead. A running
+// process of each mount namespace is remembered, so that the files of a
+// process that exited can still be found through the other processes of its
+// container.
+type RootFS struct {
+	proc string
+
+	// Mount namespace of the processes seen.
+	namespaces burrow.Cache
+
+	mtx sync.Mutex
+	// A running process of each mount namespace.
+	processes map[uint64]int
+}
+
+// NewRootFS returns a resolver of the paths of processes listed in the given
+// procfs mount point, usually /proc.
+func NewRootFS(logger log.Logger, reg prometheus.Registerer, proc string, profilingDuration time.Duration) *RootFS {
+	return &RootFS{
+		proc: proc,
+		namespaces: cache.NewSizedCache(
+			burrow.WithMaximumSize(4096),
+			burrow.WithExpireAfterAccess(10*profilingDuration),
+			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "process_mount_namespace")),
+		),
+		processes: map[uint64]int{},
+	}
+}
+
+func (r *RootFS) root(pid int) string {
+	return filepath.Join(r.proc, strconv.Itoa(pid), "root")
+}
+
+// CacheSizes returns how many mount namespaces of processes are cached.
+func (r *RootFS) CacheSizes() map[string]int {
+	return map[string]int{"process_mount_namespace": cache.Len(r.namespaces)}
+}
+
+// mountNamespace returns the inode of the mount namespace of the given
+// process.
+func (r *RootFS) mountNamespace(pid int) (uint64, error) {
+	info, err := os.Stat(filepath.Join(r.proc, strconv.Itoa(pid), "ns", "mnt"))
+	if err != nil {
+		return 0, err
+	}
+	id, ok := fileinfo.IDOf(info)
+	if !ok {
+		return 0, fmt.Errorf("unexpected stat type %T", info.Sys())
+	}
+	return id.Ino, nil
+}
+
+// inMountNamespace returns whether the given process is still running in the
+// given mount namespace, its PID could have been reused by a process of
+// another namespace.
+func (r *RootFS) inMountNamespace(pid int, ns uint64) bool {
+	other, err := r.mountNamespace(pid)
+	return err == nil && other == ns
+}
+
+// Root returns the root directory of the given process. If the process
+// exited, the root of another process of the same mount namespace is
+// returned if one is known.
+func (r *RootFS) Root(pid int) string {
+	if ns, err := r.mountNamespace(pid); err == nil {
+		r.namespaces.Put(pid, ns)
+
+		// Long-lived processes are kept, as they are the most likely to
+		// outlive the others.
+		r.mtx.Lock()
+		if other, ok := r.processes[ns]; !ok || (other != pid && !r.inMountNamespace(other, ns)) {
+			r.processes[ns] = pid
+		}
+		r.mtx.Unlock()
+		return r.root(pid)
+	}
+
+	val, ok := r.namespaces.GetIfPresent(pid)
+	if !ok {
+		return r.root(pid)
+	}
+	ns, ok := val.(uint64)
+	if !ok {
+		return r.root(pid)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	other, ok := r.processes[ns]
+	if !ok || other == pid {
+		delete(r.processes, ns)
+		return r.root(pid)
+	}
+	if !r.inMountNamespace(other, ns) {
+		delete(r.processes, ns)
+		return r.root(pid)
+	}
+	return r.root(other)
+}
+
+// Path returns the path to open the file at the given path in the root
+// filesystem of the given process with.
+func (r *RootFS) Path(pid int, path string) (string, error) {
+	return ResolveInRoot(r.Root(pid), path)
+}
+
+// ResolveInRoot joins the given path to the given root directory, following
+// the symbolic links in the path as if root was the root directory, so that
+// they can't point outside of it. Components past the first one that doesn't
+// exist are joined as they are.
+func ResolveInRoot(root, path string) (string, error) {
+	resolved := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return filepath.Join(root, next, remaining), nil
+			}
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s: %w", path, errTooManySymlinks)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "var", "tmp"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "lib", "debug"), 0o755))
+	// Absolute links are resolved within the root rather than the host's.
+	require.NoError(t, os.Symlink("/var/tmp", filepath.Join(root, "tmp")))
+	require.NoError(t, os.Symlink("../../../../../../var", filepath.Join(root, "usr", "lib", "debug", "var")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(root, "loop")))
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/tmp/perf-1.map", expected: "/var/tmp/perf-1.map"},
+		{path: "tmp", expected: "/var/tmp"},
+		{path: "/usr/lib/debug/var/tmp", expected: "/var/tmp"},
+		{path: "/../../tmp/./x", expected: "/var/tmp/x"},
+		{path: "/missing/tmp/x", expected: "/missing/tmp/x"},
+		{path: "/", expected: ""},
+	} {
+		resolved, err := ResolveInRoot(root, tc.path)
+		require.NoError(t, err, tc.path)
+		require.Equal(t, filepath.Join(root, tc.expected), resolved, tc.path)
+	}
+
+	_, err := ResolveInRoot(root, "/loop/x")
+	require.ErrorIs(t, err, errTooManySymlinks)
+}
+
+func TestRootFS(t *testing.T) {
+	proc := t.TempDir()
+	newProcess := func(pid, ns string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Join(proc, pid, "root"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(proc, pid, "ns"), 0o755))
+		// Processes of the same namespace share the inode of its file.
+		if _, err := os.Stat(ns); err != nil {
+			require.NoError(t, os.WriteFile(ns, nil, 0o644))
+		}
+		require.NoError(t, os.Link(ns, filepath.Join(proc, pid, "ns", "mnt")))
+	}
+	container := filepath.Join(t.TempDir(), "container")
+	newProcess("10", container)
+	newProcess("20", container)
+	newProcess("30", filepath.Join(t.TempDir(), "host"))
+
+	r := NewRootFS(log.NewNopLogger(), prometheus.NewRegistry(), proc, 10*time.Second)
+	require.Equal(t, filepath.Join(proc, "10", "root"), r.Root(10))
+	require.Equal(t, filepath.Join(proc, "20", "root"), r.Root(20))
+	require.Equal(t, filepath.Join(proc, "30", "root"), r.Root(30))
+
+	// The files of an exited process are found through the processes of
+	// its mount namespace.
+	require.NoError(t, os.RemoveAll(filepath.Join(proc, "20")))
+	require.Equal(t, filepath.Join(proc, "10", "root"), r.Root(20))
+
+	path, err := r.Path(20, "/tmp/perf-20.map")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(proc, "10", "root", "tmp", "perf-20.map"), path)
+
+	// Not once they all exited.
+	require.NoError(t, os.RemoveAll(filepath.Join(proc, "10")))
+	require.Equal(t, filepath.Join(proc, "20", "root"), r.Root(20))
+	require.Equal(t, filepath.Join(proc, "40", "root"), r.Root(40))
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+	"github.com/parca-dev/parca-agent/pkg/interpreter"
+)
+
+// Runtime is the language runtime a process runs.
+type Runtime string
+
+const (
+	RuntimeUnknown Runtime = "unknown"
+	RuntimeGo      Runtime = "go"
+	RuntimeJVM     Runtime = "jvm"
+	RuntimeDotnet  Runtime = "dotnet"
+	RuntimeNodeJS  Runtime = "nodejs"
+	RuntimePHP     Runtime = "php"
+	RuntimePython  Runtime = "python"
+	RuntimeRuby    Runtime = "ruby"
+)
+
+var runtimes = []Runtime{
+	RuntimeUnknown,
+	RuntimeGo,
+	RuntimeJVM,
+	RuntimeDotnet,
+	RuntimeNodeJS,
+	RuntimePHP,
+	RuntimePython,
+	RuntimeRuby,
+}
+
+// Runtimes whose stacks can be walked by an interpreter unwinder.
+var interpreterRuntimes = map[interpreter.Type]Runtime{
+	interpreter.TypePHP: RuntimePHP,
+	interpreter.TypeV8:  RuntimeNodeJS,
+}
+
+// RuntimeOfInterpreter returns the runtime of the given interpreter.
+func RuntimeOfInterpreter(t interpreter.Type) Runtime {
+	if r, ok := interpreterRuntimes[t]; ok {
+		return r
+	}
+	return RuntimeUnknown
+}
+
+// ParseRuntimeUnwinders validates the names of runtimes whose unwinders are
+// enabled.
+func ParseRuntimeUnwinders(names []string) ([]Runtime, error) {
+	res := make([]Runtime, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, r := range interpreterRuntimes {
+			if string(r) == name {
+				res = append(res, r)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no unwinder for runtime %q, supported runtimes are: %s, %s", name, RuntimePHP, RuntimeNodeJS)
+		}
+	}
+	return res, nil
+}
+
+var (
+	// Binaries and libraries that identify a runtime. Interpreters with an
+	// unwinder are matched by the interpreter package.
+	runtimeBinaries = []struct {
+		re      *regexp.Regexp
+		runtime Runtime
+	}{
+		{regexp.MustCompile(`^libjvm\.so$`), RuntimeJVM},
+		{regexp.MustCompile(`^libcoreclr\.so$`), RuntimeDotnet},
+		{regexp.MustCompile(`^(python[0-9.]*|libpython[0-9.]+m?\.so(\.[0-9.]+)?)$`), RuntimePython},
+		{regexp.MustCompile(`^(ruby[0-9.]*|libruby(-static)?\.so(\.[0-9.]+)?)$`), RuntimeRuby},
+	}
+	// Environment variables set for a runtime, used when nothing mapped
+	// identifies one, e.g. for statically linked runtimes.
+	runtimeEnvironment = []struct {
+		prefix  string
+		runtime Runtime
+	}{
+		{"JAVA_TOOL_OPTIONS=", RuntimeJVM},
+		{"JDK_JAVA_OPTIONS=", RuntimeJVM},
+		{"DOTNET_", RuntimeDotnet},
+		{"CORECLR_", RuntimeDotnet},
+		{"NODE_OPTIONS=", RuntimeNodeJS},
+		{"PYTHONPATH=", RuntimePython},
+		{"PYTHONHOME=", RuntimePython},
+		{"RUBYOPT=", RuntimeRuby},
+		{"GEM_HOME=", RuntimeRuby},
+	}
+)
+
+// detectRuntime returns the runtime of a process, judging by the binaries it
+// mapped or else its environment.
+func detectRuntime(pid int, maps []*procfs.ProcMap, isGo bool) Runtime {
+	if isGo {
+		return RuntimeGo
+	}
+
+	for _, m := range maps {
+		if !m.Perms.Execute || m.Pathname == "" {
+			continue
+		}
+		if t := interpreter.Match(m.Pathname); t != interpreter.TypeNone {
+			return RuntimeOfInterpreter(t)
+		}
+		name := filepath.Base(m.Pathname)
+		for _, b := range runtimeBinaries {
+			if b.re.MatchString(name) {
+				return b.runtime
+			}
+		}
+	}
+
+	environ, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return RuntimeUnknown
+	}
+	return runtimeFromEnvironment(environ)
+}
+
+func runtimeFromEnvironment(environ []byte) Runtime {
+	for _, v := range bytes.Split(environ, []byte{0}) {
+		for _, e := range runtimeEnvironment {
+			if bytes.HasPrefix(v, []byte(e.prefix)) {
+				return e.runtime
+			}
+		}
+	}
+	return RuntimeUnknown
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"testing"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectRuntime(t *testing.T) {
+	mapping := func(pathname string) *procfs.ProcMap {
+		return &procfs.ProcMap{Pathname: pathname, Perms: &procfs.ProcMapPermissions{Read: true, Execute: true}}
+	}
+
+	for name, tc := range map[string]struct {
+		maps     []*procfs.ProcMap
+		expected Runtime
+	}{
+		"php": {
+			maps:     []*procfs.ProcMap{mapping("/usr/sbin/php-fpm8.2"), mapping("/usr/lib/libc.so.6")},
+			expected: RuntimePHP,
+		},
+		"node": {
+			maps:     []*procfs.ProcMap{mapping("/usr/local/bin/node")},
+			expected: RuntimeNodeJS,
+		},
+		"jvm": {
+			maps:     []*procfs.ProcMap{mapping("/usr/bin/java"), mapping("/usr/lib/jvm/java-17/lib/server/libjvm.so")},
+			expected: RuntimeJVM,
+		},
+		"embedded python": {
+			maps:     []*procfs.ProcMap{mapping("/usr/bin/uwsgi"), mapping("/usr/lib/libpython3.11.so.1.0")},
+			expected: RuntimePython,
+		},
+		"ruby": {
+			maps:     []*procfs.ProcMap{mapping("/usr/bin/ruby3.2"), mapping("/usr/lib/libruby.so.3.2")},
+			expected: RuntimeRuby,
+		},
+		"dotnet": {
+			maps:     []*procfs.ProcMap{mapping("/usr/share/dotnet/dotnet"), mapping("/usr/share/dotnet/shared/Microsoft.NETCore.App/8.0.0/libcoreclr.so")},
+			expected: RuntimeDotnet,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expected, detectRuntime(-1, tc.maps, false))
+		})
+	}
+
+	require.Equal(t, RuntimeGo, detectRuntime(-1, nil, true))
+	// Without mappings nor environment.
+	require.Equal(t, RuntimeUnknown, detectRuntime(-1, nil, false))
+}
+
+func TestRuntimeFromEnvironment(t *testing.T) {
+	require.Equal(t, RuntimeNodeJS, runtimeFromEnvironment([]byte("PATH=/bin\x00NODE_OPTIONS=--max-old-space-size=512\x00")))
+	require.Equal(t, RuntimeDotnet, runtimeFromEnvironment([]byte("DOTNET_gcServer=1\x00")))
+	require.Equal(t, RuntimeUnknown, runtimeFromEnvironment([]byte("PATH=/bin\x00HOME=/root\x00")))
+}
+
+func TestParseRuntimeUnwinders(t *testing.T) {
+	runtimes, err := ParseRuntimeUnwinders([]string{"php", "nodejs"})
+	require.NoError(t, err)
+	require.Equal(t, []Runtime{RuntimePHP, RuntimeNodeJS}, runtimes)
+
+	_, err = ParseRuntimeUnwinders([]string{"python"})
+	require.ErrorContains(t, err, `no unwinder for runtime "python"`)
+}
@@ -22,8 +22,8 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/prometheus/procfs"
 
+	"github.com/parca-dev/parca-agent/internal/procfs"
 	"github.com/parca-dev/parca-agent/pkg/cgroup"
 )
 
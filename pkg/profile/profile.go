@@ -18,12 +18,49 @@ type PID uint32
 type ProcessRawData struct {
 	PID        PID
 	RawSamples []RawSample
+	// LostSamples is the number of samples that were taken but couldn't be
+	// stored, e.g. because the maps storing them were full.
+	LostSamples uint64
+	// PerfEventSamples are the samples taken on hardware events rather
+	// than the CPU clock, by the index of the event.
+	PerfEventSamples map[int][]RawSample
 }
 
 type RawSample struct {
 	UserStack   []uint64
 	KernelStack []uint64
-	Value       uint64
+	// Frames of interpreted code, already symbolized by the unwinder.
+	InterpreterStack []InterpreterFrame
+	// Labels of the sample, e.g. the goroutine it was taken in.
+	Labels map[string]string
+	// Unix times in nanoseconds at which the stacks were sampled, when
+	// sample timestamps are enabled. There may be fewer than Value of them.
+	Timestamps []int64
+	Value      uint64
+	// PeriodNS is the time every sample stands for, in nanoseconds, when
+	// samples are weighed by it. Samples taken at different frequencies
+	// can then be in the same profile.
+	PeriodNS int64
+	// Truncated is set when the user stack was cut at the maximum stack
+	// depth, its outermost frames are missing then.
+	Truncated bool
+}
+
+// InterpreterFrame is a frame of interpreted code, sorted from the leaf like
+// the native stacks.
+type InterpreterFrame struct {
+	Line
+	// Entry marks the outermost frame run by an invocation of the
+	// interpreter loop.
+	Entry bool
+	// NativeIndex is the index of the native frame of the interpreter loop
+	// running this frame in the user stack. Interpreter frames are placed
+	// right before it.
+	NativeIndex int
+	// Address is the native address the frame was running at, for JIT
+	// compiled frames. The native frame at NativeIndex is replaced by this
+	// one when it has the same address.
+	Address uint64
 }
 
 type RawData []ProcessRawData
@@ -0,0 +1,129 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+// Package bpfmaps holds the helpers the profilers share to read and clean the
+// BPF maps their programs aggregate stacks in.
+package bpfmaps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+var (
+	ErrMissing      = errors.New("missing stack trace")
+	ErrUnwindFailed = errors.New("stack ID is 0, probably stack unwinding failed")
+)
+
+// Clear deletes all the entries of a map, and returns how many it deleted.
+func Clear(bpfMap *bpf.BPFMap) (int, error) {
+	// BPF iterators need the previous value to iterate to the next, so we
+	// can only delete the "previous" item once we've already iterated to
+	// the next.
+
+	deleted := 0
+	it := bpfMap.Iterator()
+	var prev []byte
+	for it.Next() {
+		if prev != nil {
+			err := bpfMap.DeleteKey(unsafe.Pointer(&prev[0]))
+			if err != nil && !errors.Is(err, syscall.ENOENT) {
+				return deleted, fmt.Errorf("failed to delete map key: %w", err)
+			}
+			deleted++
+		}
+
+		key := it.Key()
+		prev = make([]byte, len(key))
+		copy(prev, key)
+	}
+	if prev != nil {
+		err := bpfMap.DeleteKey(unsafe.Pointer(&prev[0]))
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return deleted, fmt.Errorf("failed to delete map key: %w", err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// ReadStack reads the stack with the given ID from a stack traces map into the
+// given buffer.
+func ReadStack(stackTraces *bpf.BPFMap, byteOrder binary.ByteOrder, stackID int32, stack []uint64) error {
+	if stackID == 0 {
+		return ErrUnwindFailed
+	}
+
+	stackBytes, err := stackTraces.GetValue(unsafe.Pointer(&stackID))
+	if err != nil {
+		return fmt.Errorf("read user stack trace, %w: %w", err, ErrMissing)
+	}
+
+	return binary.Read(bytes.NewBuffer(stackBytes), byteOrder, stack)
+}
+
+// CleanStackTraces deletes the stacks of a stack traces map but the ones still
+// referenced by the values of the given map, such as the ones of the threads
+// in the middle of a wait, which are only aggregated once it's over. The
+// stack ID of a value is returned by stackID. The stacks are listed before
+// the referencing map is read, so that the ones of the threads starting to
+// wait in between are kept.
+func CleanStackTraces(stackTraces, referencing *bpf.BPFMap, byteOrder binary.ByteOrder, stackID func(value []byte) (int32, error)) error {
+	var stackIDs []int32
+	it := stackTraces.Iterator()
+	for it.Next() {
+		stackIDs = append(stackIDs, int32(byteOrder.Uint32(it.Key())))
+	}
+	if it.Err() != nil {
+		return fmt.Errorf("failed to iterate stack traces: %w", it.Err())
+	}
+
+	referenced := map[int32]struct{}{}
+	it = referencing.Iterator()
+	for it.Next() {
+		key := it.Key()
+		valueBytes, err := referencing.GetValue(unsafe.Pointer(&key[0]))
+		if err != nil {
+			// The entry was deleted in the meantime.
+			continue
+		}
+		id, err := stackID(valueBytes)
+		if err != nil {
+			return fmt.Errorf("failed to read stack ID: %w", err)
+		}
+		referenced[id] = struct{}{}
+	}
+	if it.Err() != nil {
+		return fmt.Errorf("failed to iterate referencing map: %w", it.Err())
+	}
+
+	for _, id := range profiler.UnreferencedStackIDs(stackIDs, referenced) {
+		id := id
+		err := stackTraces.DeleteKey(unsafe.Pointer(&id))
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete map key: %w", err)
+		}
+	}
+	return nil
+}
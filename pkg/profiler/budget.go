@@ -0,0 +1,302 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// Names of the profilers sharing the sampling budget, by which their weights
+// are configured. They are the profilers sampling at a rate the budget can
+// lower.
+const (
+	BudgetCPU       = "cpu"
+	BudgetWallClock = "wall_clock"
+)
+
+// minBudgetFactor is the lowest share of its events a target is sampled at,
+// so that it still shows up in profiles however tight the budget is.
+const minBudgetFactor = 0.01
+
+type budgetMetrics struct {
+	overhead prometheus.Gauge
+	factor   *prometheus.GaugeVec
+}
+
+func newBudgetMetrics(reg prometheus.Registerer) *budgetMetrics {
+	return &budgetMetrics{
+		overhead: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_budget_overhead_percent",
+			Help: "CPU time of the agent in percents of the CPU time of the host, over the last budget interval.",
+		}),
+		factor: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_budget_factor",
+			Help: "Share of its events a profiler is allowed to sample by the budget.",
+		}, []string{"profiler"}),
+	}
+}
+
+// Budget keeps the overhead of the agent below a share of the CPU time of
+// the host by allocating event rates to the profilers and their targets.
+//
+// The profilers record the events they sampled per target. Every interval,
+// the CPU time the agent used is divided among these events to estimate what
+// an event costs, which gives the number of events the budget affords. They
+// are shared among the profilers according to their weights, and the share
+// of each profiler among its targets, so that the busiest profilers and
+// targets are throttled first. The unused share of the profilers and targets
+// sampling less than they are allowed to is given to the others.
+type Budget struct {
+	logger  log.Logger
+	metrics *budgetMetrics
+	fs      procfs.FS
+
+	// percent is the share of the CPU time of the host the agent is allowed
+	// to use.
+	percent float64
+	weights map[string]float64
+
+	mtx sync.Mutex
+	// The events sampled per profiler and target since the last allocation.
+	events map[string]map[int]uint64
+	// The share of their events the targets are sampled at, 1 when missing.
+	factors map[string]map[int]float64
+
+	lastAgent, lastHost float64
+	hasLast             bool
+}
+
+// NewBudget returns a budget allowing the agent to use the given percentage
+// of the CPU time of the host. Profilers without a weight weigh 1.
+func NewBudget(logger log.Logger, reg prometheus.Registerer, fs procfs.FS, percent float64, weights map[string]float64) (*Budget, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid CPU budget %g, it must be above 0 and at most 100", percent)
+	}
+	for name, weight := range weights {
+		if name != BudgetCPU && name != BudgetWallClock {
+			return nil, fmt.Errorf("unknown profiler %s, only %s and %s share the budget", name, BudgetCPU, BudgetWallClock)
+		}
+		if weight <= 0 {
+			return nil, fmt.Errorf("invalid weight %g of profiler %s, it must be above 0", weight, name)
+		}
+	}
+	return &Budget{
+		logger:  logger,
+		metrics: newBudgetMetrics(reg),
+		fs:      fs,
+		percent: percent,
+		weights: weights,
+		events:  map[string]map[int]uint64{},
+		factors: map[string]map[int]float64{},
+	}, nil
+}
+
+// Record adds events sampled by the given profiler in a target.
+func (b *Budget) Record(profiler string, pid int, events uint64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.events[profiler] == nil {
+		b.events[profiler] = map[int]uint64{}
+	}
+	b.events[profiler][pid] += events
+}
+
+// Factor returns the share of its events the given profiler is allowed to
+// sample in a target, between minBudgetFactor and 1.
+func (b *Budget) Factor(profiler string, pid int) float64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.factor(profiler, pid)
+}
+
+func (b *Budget) factor(profiler string, pid int) float64 {
+	if f, ok := b.factors[profiler][pid]; ok {
+		return f
+	}
+	return 1
+}
+
+func (b *Budget) weight(profiler string) float64 {
+	if w, ok := b.weights[profiler]; ok {
+		return w
+	}
+	return 1
+}
+
+// Run allocates the event rates every interval until the context is done.
+func (b *Budget) Run(ctx context.Context, interval time.Duration) error {
+	// Takes the first measurement the CPU time is compared to.
+	_, _ = b.readOverhead()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		overhead, err := b.readOverhead()
+		if err != nil {
+			level.Debug(b.logger).Log("msg", "failed to read the overhead of the agent", "err", err)
+			continue
+		}
+		b.metrics.overhead.Set(overhead)
+		b.allocate(overhead)
+	}
+}
+
+// readOverhead returns the CPU time of the agent in percents of the CPU time
+// of the host since the previous measurement. The first measurement has
+// nothing to compare to, and returns an error.
+func (b *Budget) readOverhead() (float64, error) {
+	self, err := b.fs.Self()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the agent process: %w", err)
+	}
+	procStat, err := self.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the agent CPU statistics: %w", err)
+	}
+	stat, err := b.fs.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read CPU statistics: %w", err)
+	}
+
+	agent, host := procStat.CPUTime(), cpuTime(stat.CPUTotal)
+	lastAgent, lastHost, hasLast := b.lastAgent, b.lastHost, b.hasLast
+	b.lastAgent, b.lastHost, b.hasLast = agent, host, true
+	if !hasLast {
+		return 0, errors.New("no previous CPU statistics to compare to")
+	}
+	if host <= lastHost {
+		return 0, nil
+	}
+	return 100 * (agent - lastAgent) / (host - lastHost), nil
+}
+
+// allocate sets the factors of the targets from the events sampled since the
+// last allocation and the overhead they caused.
+func (b *Budget) allocate(overhead float64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	events := b.events
+	b.events = map[string]map[int]uint64{}
+
+	var total uint64
+	for _, targets := range events {
+		for _, n := range targets {
+			total += n
+		}
+	}
+	if total == 0 || overhead <= 0 {
+		b.factors = map[string]map[int]float64{}
+		for profiler := range events {
+			b.metrics.factor.WithLabelValues(profiler).Set(1)
+		}
+		return
+	}
+	capacity := float64(total) * b.percent / overhead
+
+	// The demands are the events the profilers and targets would sample
+	// without the budget, estimated from the factors they sampled at.
+	profilers := make([]string, 0, len(events))
+	for profiler := range events {
+		profilers = append(profilers, profiler)
+	}
+	sort.Strings(profilers)
+	demands := make([][]float64, len(profilers))
+	pids := make([][]int, len(profilers))
+	profilerDemands := make([]float64, len(profilers))
+	weights := make([]float64, len(profilers))
+	for i, profiler := range profilers {
+		for pid, n := range events[profiler] {
+			d := float64(n) / b.factor(profiler, pid)
+			pids[i] = append(pids[i], pid)
+			demands[i] = append(demands[i], d)
+			profilerDemands[i] += d
+		}
+		weights[i] = b.weight(profiler)
+	}
+
+	factors := map[string]map[int]float64{}
+	profilerLevel := waterLevel(profilerDemands, weights, capacity)
+	for i, profiler := range profilers {
+		allowed := math.Min(profilerDemands[i], profilerLevel*weights[i])
+		b.metrics.factor.WithLabelValues(profiler).Set(allowed / profilerDemands[i])
+
+		targetLevel := waterLevel(demands[i], nil, allowed)
+		for j, pid := range pids[i] {
+			if demands[i][j] <= targetLevel {
+				continue
+			}
+			if factors[profiler] == nil {
+				factors[profiler] = map[int]float64{}
+			}
+			factors[profiler][pid] = math.Max(targetLevel/demands[i][j], minBudgetFactor)
+		}
+	}
+	b.factors = factors
+}
+
+// waterLevel shares the capacity among demands in proportion to their
+// weights, giving what the ones under their share leave to the others. It
+// returns the level each demand is allowed up to, times its weight, or
+// infinity if all the demands fit. Nil weights weigh 1.
+func waterLevel(demands, weights []float64, capacity float64) float64 {
+	weight := func(i int) float64 {
+		if weights == nil {
+			return 1
+		}
+		return weights[i]
+	}
+
+	order := make([]int, len(demands))
+	totalWeight := 0.0
+	for i := range order {
+		order[i] = i
+		totalWeight += weight(i)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return demands[order[a]]/weight(order[a]) < demands[order[b]]/weight(order[b])
+	})
+
+	for _, i := range order {
+		level := capacity / totalWeight
+		if demands[i]/weight(i) > level {
+			return level
+		}
+		capacity -= demands[i]
+		totalWeight -= weight(i)
+	}
+	return math.Inf(1)
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaterLevel(t *testing.T) {
+	// Everything fits.
+	require.True(t, math.IsInf(waterLevel([]float64{10, 20}, nil, 30), 1))
+
+	// The small demand is met, the rest is left to the big one.
+	require.InDelta(t, 90.0, waterLevel([]float64{10, 200}, nil, 100), 1e-9)
+
+	// Shared in proportion to the weights.
+	require.InDelta(t, 25.0, waterLevel([]float64{100, 100}, []float64{3, 1}, 100), 1e-9)
+}
+
+func TestBudget(t *testing.T) {
+	_, err := NewBudget(log.NewNopLogger(), prometheus.NewRegistry(), procfs.FS{}, 0, nil)
+	require.Error(t, err)
+	_, err = NewBudget(log.NewNopLogger(), prometheus.NewRegistry(), procfs.FS{}, 1, map[string]float64{BudgetCPU: 0})
+	require.Error(t, err)
+	_, err = NewBudget(log.NewNopLogger(), prometheus.NewRegistry(), procfs.FS{}, 1, map[string]float64{"allocation": 1})
+	require.Error(t, err)
+
+	b, err := NewBudget(log.NewNopLogger(), prometheus.NewRegistry(), procfs.FS{}, 1, map[string]float64{BudgetCPU: 3})
+	require.NoError(t, err)
+
+	// Under the budget, everything is sampled.
+	b.Record(BudgetCPU, 1, 100)
+	b.allocate(0.5)
+	require.Equal(t, 1.0, b.Factor(BudgetCPU, 1))
+
+	// Twice over the budget, half of the 400 events are allowed. The CPU
+	// profiler gets 150 of them, and the wall-clock one the other 50.
+	b.Record(BudgetCPU, 1, 10)
+	b.Record(BudgetCPU, 2, 290)
+	b.Record(BudgetWallClock, 1, 100)
+	b.allocate(2)
+	require.Equal(t, 1.0, b.Factor(BudgetCPU, 1))
+	require.InDelta(t, 140.0/290, b.Factor(BudgetCPU, 2), 1e-9)
+	require.InDelta(t, 0.5, b.Factor(BudgetWallClock, 1), 1e-9)
+	// Targets not sampled yet are not throttled.
+	require.Equal(t, 1.0, b.Factor(BudgetCPU, 3))
+
+	// The events are sampled at the factors, the demands are the same, and
+	// the budget is met so the factors are kept.
+	b.Record(BudgetCPU, 1, 10)
+	b.Record(BudgetCPU, 2, 140)
+	b.Record(BudgetWallClock, 1, 50)
+	b.allocate(1)
+	require.InDelta(t, 140.0/290, b.Factor(BudgetCPU, 2), 1e-9)
+	require.InDelta(t, 0.5, b.Factor(BudgetWallClock, 1), 1e-9)
+
+	// The throttling is lifted once the overhead drops.
+	b.Record(BudgetCPU, 2, 140)
+	b.allocate(0.1)
+	require.Equal(t, 1.0, b.Factor(BudgetCPU, 2))
+	require.Equal(t, 1.0, b.Factor(BudgetWallClock, 1))
+}
@@ -40,6 +40,13 @@ func (eb *EfficientBuffer) PutUint64(v uint64) {
 	*eb = (*eb)[8:]
 }
 
+// PutBytes writes the passed bytes as they are
+// and advances the current slice.
+func (eb *EfficientBuffer) PutBytes(b []byte) {
+	copy(*eb, b)
+	*eb = (*eb)[len(b):]
+}
+
 // PutUint32 writes the passed uint32 in little
 // endian and advances the current slice.
 func (eb *EfficientBuffer) PutUint32(v uint32) {
@@ -74,6 +74,21 @@ func TestEfficientBufferAgainstBinaryWrite(t *testing.T) {
 	require.Equal(t, buf2.Bytes()[:15], []byte(buf[:15]))
 }
 
+func TestEfficientBufferPutBytes(t *testing.T) {
+	buf := make(EfficientBuffer, 0, 1000)
+	subSlice := buf.Slice(16)
+	written := subSlice
+	subSlice.PutUint64(111)
+	subSlice.PutUint64(222)
+
+	buf2 := make(EfficientBuffer, 0, 1000)
+	subSlice2 := buf2.Slice(16)
+	subSlice2.PutBytes(written[:16])
+
+	require.Equal(t, 0, len(subSlice2))
+	require.Equal(t, []byte(buf), []byte(buf2))
+}
+
 func BenchmarkEfficientBufferSliceWrite(b *testing.B) {
 	b.ReportAllocs()
 
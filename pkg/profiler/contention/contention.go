@@ -0,0 +1,385 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package contention
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/hashicorp/go-multierror"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/parca-dev/parca-agent/pkg/byteorder"
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/perf"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+	"github.com/parca-dev/parca-agent/pkg/profiler/bpfmaps"
+	"github.com/parca-dev/parca-agent/pkg/rlimit"
+)
+
+//go:embed contention-profiler.bpf.o
+var bpfObj []byte
+
+const (
+	stackDepth = 127 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
+
+	profilerName = "parca_agent_contention"
+
+	enterProgramName = "futex_enter"
+	exitProgramName  = "futex_exit"
+	configKey        = "contention_config"
+
+	stackTracesMapName   = "stack_traces"
+	contentionNsMapName  = "contention_ns"
+	waitStartsMapName    = "wait_starts"
+	tracepointCategory   = "syscalls"
+	enterTracepointName  = "sys_enter_futex"
+	exitTracepointName   = "sys_exit_futex"
+	contentionSampleType = "contention"
+	contentionSampleUnit = "nanoseconds"
+)
+
+type Config struct {
+	MinWaitNs uint64
+}
+
+// contentionKey mirrors the contention_key_t struct in the BPF program.
+type contentionKey struct {
+	PID         int32
+	TGID        int32
+	UserStackID int32
+}
+
+// waitStart mirrors the wait_start_t struct in the BPF program.
+type waitStart struct {
+	StartNs     uint64
+	UserStackID int32
+	_           uint32
+}
+
+type userStack [stackDepth]uint64
+
+// Contention is a profiler that samples the time threads spend blocked
+// waiting on futexes, which is where contended locks end up.
+type Contention struct {
+	profiler.Status
+
+	logger  log.Logger
+	reg     prometheus.Registerer
+	metrics *profiler.StackMetrics
+
+	profilingDuration time.Duration
+	minWaitDuration   time.Duration
+
+	writer *pprof.ProcessProfileWriter
+
+	stackTraces  *bpf.BPFMap
+	contentionNs *bpf.BPFMap
+	waitStarts   *bpf.BPFMap
+	byteOrder    binary.ByteOrder
+
+	memlockRlimit uint64
+	btfPath       string
+}
+
+func NewContentionProfiler(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	processInfoManager profiler.ProcessInfoManager,
+	addressNormalizer profiler.AddressNormalizer,
+	vdsoSymbolizer pprof.VDSOSymbolizer,
+	localSymbolizer pprof.LocalSymbolizer,
+	ksym *ksym.Ksym,
+	perfMapCache *perf.PerfMapCache,
+	jitdumpCache *perf.JitdumpCache,
+	disableJITSymbolization bool,
+	demangler *demangle.Demangler,
+	unknownFrames pprof.UnknownFramePolicy,
+	profileWriter profiler.ProfileWriter,
+	profilingDuration time.Duration,
+	minWaitDuration time.Duration,
+	memlockRlimit uint64,
+	btfPath string,
+) *Contention {
+	metrics := profiler.NewStackMetrics(reg, "contention")
+	return &Contention{
+		logger:  logger,
+		reg:     reg,
+		metrics: metrics,
+
+		profilingDuration: profilingDuration,
+		minWaitDuration:   minWaitDuration,
+
+		writer: pprof.NewProcessProfileWriter(
+			logger,
+			profilerName,
+			processInfoManager,
+			pprof.ConverterOptions{
+				AddressNormalizer:       addressNormalizer,
+				Ksym:                    ksym,
+				VDSOSymbolizer:          vdsoSymbolizer,
+				LocalSymbolizer:         localSymbolizer,
+				PerfMapCache:            perfMapCache,
+				JitdumpCache:            jitdumpCache,
+				Metrics:                 pprof.NewConverterMetrics(reg, "contention"),
+				DisableJITSymbolization: disableJITSymbolization,
+				Demangler:               demangler,
+				UnknownFrames:           unknownFrames,
+			},
+			profileWriter,
+			metrics,
+		),
+
+		byteOrder: byteorder.GetHostByteOrder(),
+
+		memlockRlimit: memlockRlimit,
+		btfPath:       btfPath,
+	}
+}
+
+func (p *Contention) Name() string {
+	return profilerName
+}
+
+func (p *Contention) loadBpfProgram() (*bpf.Module, error) {
+	m, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
+		BPFObjBuff: bpfObj,
+		BPFObjName: "parca-contention",
+		BTFObjPath: p.btfPath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new bpf module: %w", err)
+	}
+
+	// Must be called after bpf.NewModuleFromBufferArgs to avoid limit override.
+	if _, err := rlimit.BumpMemlock(p.memlockRlimit, p.memlockRlimit); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("bump memlock: %w", err)
+	}
+
+	if err := m.InitGlobalVariable(configKey, Config{MinWaitNs: uint64(p.minWaitDuration.Nanoseconds())}); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("init global variable: %w", err)
+	}
+
+	if err := m.BPFLoadObject(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("load bpf object: %w", err)
+	}
+
+	for _, tp := range []struct{ program, name string }{
+		{enterProgramName, enterTracepointName},
+		{exitProgramName, exitTracepointName},
+	} {
+		prog, err := m.GetProgram(tp.program)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("get bpf program %s: %w", tp.program, err)
+		}
+		// The link is destroyed when the module is closed.
+		if _, err := prog.AttachTracepoint(tracepointCategory, tp.name); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("attach tracepoint %s: %w", tp.name, err)
+		}
+	}
+
+	return m, nil
+}
+
+func (p *Contention) Run(ctx context.Context) error {
+	level.Debug(p.logger).Log("msg", "starting contention profiler")
+
+	if support, err := bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeTracepoint); !support {
+		return fmt.Errorf("tracepoint program type not supported: %w", err)
+	}
+
+	m, err := p.loadBpfProgram()
+	if err != nil {
+		return fmt.Errorf("load bpf program: %w", err)
+	}
+	defer m.Close()
+
+	p.stackTraces, err = m.GetMap(stackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get stack traces map: %w", err)
+	}
+	p.contentionNs, err = m.GetMap(contentionNsMapName)
+	if err != nil {
+		return fmt.Errorf("get contention map: %w", err)
+	}
+	p.waitStarts, err = m.GetMap(waitStartsMapName)
+	if err != nil {
+		return fmt.Errorf("get wait starts map: %w", err)
+	}
+
+	p.Start()
+
+	ticker := time.NewTicker(p.profilingDuration)
+	defer ticker.Stop()
+
+	level.Debug(p.logger).Log("msg", "start profiling loop")
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		obtainStart := time.Now()
+		rawData, err := p.obtainRawData(ctx)
+		if err != nil {
+			p.metrics.ObtainAttempts.WithLabelValues(profiler.LabelError).Inc()
+			level.Warn(p.logger).Log("msg", "failed to obtain profiles from eBPF maps", "err", err)
+			continue
+		}
+		p.metrics.ObtainAttempts.WithLabelValues(profiler.LabelSuccess).Inc()
+		p.metrics.ObtainDuration.Observe(time.Since(obtainStart).Seconds())
+
+		processLastErrors := map[int]error{}
+		for _, perProcessRawData := range rawData {
+			pid := int(perProcessRawData.PID)
+			processLastErrors[pid] = nil
+
+			if err := p.writeProfile(ctx, pid, perProcessRawData.RawSamples); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to write contention profile", "pid", pid, "err", err)
+				processLastErrors[pid] = err
+			}
+		}
+		p.Report(nil, processLastErrors)
+	}
+}
+
+func (p *Contention) writeProfile(ctx context.Context, pid int, rawSamples []profile.RawSample) error {
+	return p.writer.Write(ctx, pid, p.LastProfileStartedAt(), 1, rawSamples, func(prof *pprofprofile.Profile) {
+		// Sample values are the total time spent waiting.
+		prof.SampleType = []*pprofprofile.ValueType{{Type: contentionSampleType, Unit: contentionSampleUnit}}
+		prof.PeriodType = &pprofprofile.ValueType{Type: contentionSampleType, Unit: contentionSampleUnit}
+	})
+}
+
+// obtainRawData collects the wait times per stack from the BPF maps and
+// clears them for the next round.
+func (p *Contention) obtainRawData(ctx context.Context) (profile.RawData, error) {
+	rawData := map[int32]map[userStack]uint64{}
+
+	it := p.contentionNs.Iterator()
+	for it.Next() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		keyBytes := it.Key()
+
+		var key contentionKey
+		if err := binary.Read(bytes.NewBuffer(keyBytes), p.byteOrder, &key); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonKey).Inc()
+			return nil, fmt.Errorf("read contention key: %w", err)
+		}
+
+		stack := userStack{}
+		if err := bpfmaps.ReadStack(p.stackTraces, p.byteOrder, key.UserStackID, stack[:]); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonUser).Inc()
+			continue
+		}
+
+		valueBytes, err := p.contentionNs.GetValue(unsafe.Pointer(&keyBytes[0]))
+		if err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonCount).Inc()
+			return nil, fmt.Errorf("read value: %w", err)
+		}
+		value := p.byteOrder.Uint64(valueBytes)
+		if value == 0 {
+			continue
+		}
+
+		perProcessData, ok := rawData[key.PID]
+		if !ok {
+			perProcessData = map[userStack]uint64{}
+			rawData[key.PID] = perProcessData
+		}
+		perProcessData[stack] += value
+	}
+	if it.Err() != nil {
+		p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonIterator).Inc()
+		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+	}
+
+	if err := p.cleanMaps(); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to clean BPF maps that store stacktraces", "err", err)
+	}
+
+	return preprocessRawData(rawData), nil
+}
+
+func (p *Contention) cleanMaps() error {
+	var result error
+	if err := p.cleanStackTraces(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if _, err := bpfmaps.Clear(p.contentionNs); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result
+}
+
+// cleanStackTraces deletes the stacks of the stack traces map but the ones of
+// the threads still waiting, which are only read once their wait is over, so
+// that the longest waits aren't lost.
+func (p *Contention) cleanStackTraces() error {
+	return bpfmaps.CleanStackTraces(p.stackTraces, p.waitStarts, p.byteOrder, func(value []byte) (int32, error) {
+		var start waitStart
+		if err := binary.Read(bytes.NewBuffer(value), p.byteOrder, &start); err != nil {
+			return 0, fmt.Errorf("failed to read wait start: %w", err)
+		}
+		return start.UserStackID, nil
+	})
+}
+
+// preprocessRawData turns the aggregated wait times into a profile.RawData.
+func preprocessRawData(rawData map[int32]map[userStack]uint64) profile.RawData {
+	res := make(profile.RawData, 0, len(rawData))
+	for pid, perProcessRawData := range rawData {
+		p := profile.ProcessRawData{
+			PID:        profile.PID(pid),
+			RawSamples: make([]profile.RawSample, 0, len(perProcessRawData)),
+		}
+
+		for stack, value := range perProcessRawData {
+			p.RawSamples = append(p.RawSamples, profile.RawSample{
+				UserStack: profiler.TrimStack(stack[:]),
+				Value:     value,
+			})
+		}
+
+		res = append(res, p)
+	}
+
+	return res
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package contention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/logger"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+// Ensures the BPF program loads and attaches in the running kernel.
+func TestLoadBpfProgram(t *testing.T) {
+	p := NewContentionProfiler(
+		logger.NewLogger("debug", logger.LogFormatLogfmt, "parca-contention-test"),
+		prometheus.NewRegistry(),
+		nil, nil, nil, nil, nil, nil, nil, false, nil, pprof.UnknownFramesAddress, nil,
+		10*time.Second,
+		time.Microsecond,
+		uint64(100*1024*1024),
+		"",
+	)
+
+	m, err := p.loadBpfProgram()
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	_, err = m.GetMap(contentionNsMapName)
+	require.NoError(t, err)
+}
+
+func TestPreprocessRawData(t *testing.T) {
+	stack := userStack{0x1, 0x2, 0x3}
+	rawData := preprocessRawData(map[int32]map[userStack]uint64{
+		42: {stack: 1500},
+	})
+
+	require.Equal(t, profile.RawData{
+		{
+			PID: 42,
+			RawSamples: []profile.RawSample{
+				{UserStack: []uint64{0x1, 0x2, 0x3}, Value: 1500},
+			},
+		},
+	}, rawData)
+}
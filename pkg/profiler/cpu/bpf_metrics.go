@@ -12,6 +12,8 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package cpu
 
 import (
@@ -90,6 +92,21 @@ var (
 		"There was an error while unwinding the stack.",
 		[]string{"reason"}, nil,
 	)
+	descNativeUnwinderSkipped = prometheus.NewDesc(
+		"parca_agent_native_unwinder_skipped_total",
+		"Samples whose stack wasn't walked as it can't be unwound.",
+		[]string{"reason"}, nil,
+	)
+	descBPFMapFull = prometheus.NewDesc(
+		"parca_agent_bpf_map_full_samples_total",
+		"Samples dropped because a BPF map storing stacks was full.",
+		[]string{"bpf_map_name"}, nil,
+	)
+	descBPFEventsLost = prometheus.NewDesc(
+		"parca_agent_bpf_ringbuf_lost_events_total",
+		"Events dropped because the BPF ring buffer was full.",
+		nil, nil,
+	)
 )
 
 func (c *bpfMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -101,6 +118,9 @@ func (c *bpfMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- descNativeUnwinderTotalSamples
 	ch <- descNativeUnwinderSuccess
 	ch <- descNativeUnwinderErrors
+	ch <- descNativeUnwinderSkipped
+	ch <- descBPFMapFull
+	ch <- descBPFEventsLost
 }
 
 func (c *bpfMetricsCollector) Collect(ch chan<- prometheus.Metric) {
@@ -128,6 +148,8 @@ func (c *bpfMetricsCollector) collectUnwinderStatistics(ch chan<- prometheus.Met
 	stats := c.getUnwinderStats()
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderTotalSamples, prometheus.CounterValue, float64(stats.Total), "dwarf")
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderSuccess, prometheus.CounterValue, float64(stats.SuccessDwarf), "dwarf")
+	ch <- prometheus.MustNewConstMetric(descNativeUnwinderTotalSamples, prometheus.CounterValue, float64(stats.TotalLBR), "lbr")
+	ch <- prometheus.MustNewConstMetric(descNativeUnwinderSuccess, prometheus.CounterValue, float64(stats.TotalLBR-stats.ErrorLBREmpty), "lbr")
 
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderErrors, prometheus.CounterValue, float64(stats.ErrorTruncated), "truncated")
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderErrors, prometheus.CounterValue, float64(stats.ErrorUnsupportedExpression), "unsupported_expression")
@@ -137,4 +159,14 @@ func (c *bpfMetricsCollector) collectUnwinderStatistics(ch chan<- prometheus.Met
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderErrors, prometheus.CounterValue, float64(stats.ErrorShouldNeverHappen), "should_never_happen")
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderErrors, prometheus.CounterValue, float64(stats.ErrorPcNotCovered), "pc_not_covered")
 	ch <- prometheus.MustNewConstMetric(descNativeUnwinderErrors, prometheus.CounterValue, float64(stats.ErrorUnsupportedJit), "unsupported_jit")
+	ch <- prometheus.MustNewConstMetric(descNativeUnwinderErrors, prometheus.CounterValue, float64(stats.ErrorLBREmpty), "lbr_empty")
+
+	ch <- prometheus.MustNewConstMetric(descNativeUnwinderSkipped, prometheus.CounterValue, float64(stats.SkippedCompat), "compat")
+
+	ch <- prometheus.MustNewConstMetric(descBPFMapFull, prometheus.CounterValue, float64(stats.StackCountsFull), stackCountsMapName)
+	ch <- prometheus.MustNewConstMetric(descBPFMapFull, prometheus.CounterValue, float64(stats.StackTracesFull), stackTracesMapName)
+	ch <- prometheus.MustNewConstMetric(descBPFMapFull, prometheus.CounterValue, float64(stats.DwarfStackTracesFull), dwarfStackTracesMapName)
+	ch <- prometheus.MustNewConstMetric(descBPFMapFull, prometheus.CounterValue, float64(stats.InterpreterStackTracesFull), interpreterStackTracesMapName)
+
+	ch <- prometheus.MustNewConstMetric(descBPFEventsLost, prometheus.CounterValue, float64(stats.EventsLost))
 }
@@ -12,6 +12,8 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package cpu
 
 import (
@@ -124,6 +126,14 @@ func (c *bpfMetricsCollector) readCounters() (unwinderStats, error) {
 		total.ErrorShouldNeverHappen += partial.ErrorShouldNeverHappen
 		total.ErrorPcNotCovered += partial.ErrorPcNotCovered
 		total.ErrorUnsupportedJit += partial.ErrorUnsupportedJit
+		total.StackCountsFull += partial.StackCountsFull
+		total.StackTracesFull += partial.StackTracesFull
+		total.DwarfStackTracesFull += partial.DwarfStackTracesFull
+		total.InterpreterStackTracesFull += partial.InterpreterStackTracesFull
+		total.EventsLost += partial.EventsLost
+		total.TotalLBR += partial.TotalLBR
+		total.ErrorLBREmpty += partial.ErrorLBREmpty
+		total.SkippedCompat += partial.SkippedCompat
 	}
 
 	return total, nil
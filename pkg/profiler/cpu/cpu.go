@@ -12,6 +12,8 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package cpu
 
 import "C" //nolint:all
@@ -23,9 +25,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -35,21 +41,36 @@ import (
 	bpf "github.com/aquasecurity/libbpfgo"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
 	"github.com/hashicorp/go-multierror"
 
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/procfs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sys/unix"
 
 	"github.com/parca-dev/parca-agent/pkg/byteorder"
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
+	"github.com/parca-dev/parca-agent/pkg/dlopen"
+	"github.com/parca-dev/parca-agent/pkg/goruntime"
+	"github.com/parca-dev/parca-agent/pkg/interpreter"
 	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/lifecycle"
 	"github.com/parca-dev/parca-agent/pkg/metadata/labels"
 	"github.com/parca-dev/parca-agent/pkg/perf"
 	"github.com/parca-dev/parca-agent/pkg/pprof"
+	"github.com/parca-dev/parca-agent/pkg/process"
 	"github.com/parca-dev/parca-agent/pkg/profile"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
 	"github.com/parca-dev/parca-agent/pkg/rlimit"
 	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
+	"github.com/parca-dev/parca-agent/pkg/tracecontext"
+	"github.com/parca-dev/parca-agent/pkg/tracer"
 )
 
 var (
@@ -57,44 +78,199 @@ var (
 	bpfObj []byte
 
 	cpuProgramFd = uint64(0)
+	// Interpreter unwinders are stored at the index of their type.
+	phpProgramFd = uint64(interpreter.TypePHP)
+	v8ProgramFd  = uint64(interpreter.TypeV8)
 )
 
 const (
-	stackDepth       = 127 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
+	stackDepth       = 255 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
 	doubleStackDepth = stackDepth * 2
 
+	// DefaultStackDepth is the number of frames stacks are walked up to,
+	// unless configured otherwise, and MaxStackDepth the most they can be.
+	DefaultStackDepth = 127
+	MaxStackDepth     = stackDepth
+
 	programName              = "profile_cpu"
+	perfEventProgramName     = "profile_event_%d"
+	execProgramName          = "trace_process_exec"
+	exitProgramName          = "trace_process_exit"
+	dlopenProgramName        = "trace_dlopen"
 	dwarfUnwinderProgramName = "walk_user_stacktrace_impl"
+	phpUnwinderProgramName   = "unwind_php_stack"
+	v8UnwinderProgramName    = "unwind_v8_stack"
 	configKey                = "unwinder_config"
+
+	// Labels of the samples, when CPU or NUMA node labels are enabled.
+	cpuLabel      = "cpu"
+	numaNodeLabel = "numa_node"
+
+	// Label of the profiles some samples of which were lost, with the share
+	// of them that were, rounded to two decimals.
+	lostSamplesRatioLabel = "lost_samples_ratio"
+
+	// MaxPerfEvents is the number of hardware events that can be sampled in
+	// addition to the CPU clock, one per program of the BPF program.
+	MaxPerfEvents = 4
+)
+
+// Buffers the BPF program can send its events through. The ring buffer is
+// shared by all CPUs and preserves the order of the events, but requires
+// Linux 5.8 or later; auto picks it when available, and falls back to the
+// per-CPU perf buffers otherwise.
+const (
+	EventsBufferAuto    = "auto"
+	EventsBufferRingbuf = "ringbuf"
+	EventsBufferPerf    = "perf"
 )
 
 type Config struct {
 	FilterProcesses   bool
 	VerboseLogging    bool
 	MixedStackWalking bool
+	SampleTimestamps  bool
+	CPULabels         bool
+	NUMANodeLabels    bool
+	FilterCgroups     bool
+	EventsRingbuf     bool
+	LBRFallback       bool
+	_                 [3]byte
+	MaxStackDepth     uint32
+}
+
+// Options configures the CPU profiler, while Config is the configuration of
+// its BPF program.
+type Options struct {
+	ProfilingDuration time.Duration
+	SamplingFrequency uint64
+	// Hardware events sampled in addition to the CPU clock.
+	PerfEvents    []profiler.PerfEvent
+	MemlockRlimit uint64
+	BTFPath       string
+	// Processes whose unwinding is logged by the BPF program.
+	DebugProcessNames []string
+
+	DisableJITSymbolization bool
+	UnknownFrames           pprof.UnknownFramePolicy
+
+	DisableDWARFUnwinding bool
+	MixedUnwinding        bool
+	LBRFallback           bool
+	// Number of frames after which stacks are truncated, at most
+	// MaxStackDepth.
+	MaxStackDepth uint32
+
+	GoroutineLabels    bool
+	TraceContextLabels bool
+	SampleTimestamps   bool
+	CPULabels          bool
+	NUMANodeLabels     bool
+
+	SkipUnsymbolizable    bool
+	TrackProcesses        bool
+	TrackLibraries        bool
+	AggregateByExecutable bool
+
+	TimeBuckets       int
+	ConversionWorkers int
+	ConversionTimeout time.Duration
+
+	EventsBuffer      string
+	EventsBufferPages int
+	VerboseBPFLogging bool
+
+	UnwindTableCacheDir  string
+	UnwindTableServerURL string
 }
 
 type combinedStack [doubleStackDepth]uint64
 
+// sampleValue is the number of times the stacks of a sample were taken, and
+// the boot times in nanoseconds they were taken at, when sample timestamps
+// are enabled.
+type sampleValue struct {
+	count      uint64
+	timestamps []uint64
+}
+
+// sampleKey identifies the stacks of a sample.
+type sampleKey struct {
+	stack              combinedStack
+	interpreterStackID int32
+	goroutine          goroutine
+	traceID            [16]byte
+	spanID             [8]byte
+	location           sampleLocation
+	// Perf event the sample was taken on, see stackCountKey.
+	event uint32
+	// Whether the user stack was cut at the maximum stack depth.
+	truncated bool
+}
+
+// sampleLocation is the CPU and NUMA node a sample was taken on, when samples
+// are labeled with them.
+type sampleLocation struct {
+	cpu, numaNode       uint32
+	hasCPU, hasNUMANode bool
+}
+
+// goroutine is the goroutine a sample of a Go process was taken in.
+type goroutine struct {
+	id                 uint64
+	status, waitReason uint32
+}
+
+// interpreterStackKey identifies an interpreter stack. Frames of some
+// interpreters can only be decoded with the process they come from.
+type interpreterStackKey struct {
+	pid, id int32
+}
+
 type CPU struct {
 	logger  log.Logger
 	reg     prometheus.Registerer
+	tracer  trace.Tracer
 	metrics *metrics
 
 	mtx *sync.RWMutex
 
 	profilingDuration          time.Duration
 	profilingSamplingFrequency uint64
+	// Adapts the sampling frequency to the load of the host, when set.
+	frequencyController *profiler.FrequencyController
+	hostLoad            *profiler.HostLoad
+	// Throttles the processes sampled more than the CPU budget affords,
+	// when set.
+	budget *profiler.Budget
+	// Frequency the perf events currently fire at. Only accessed by the
+	// profiling loop.
+	samplingFrequency uint64
+	perfEventFDs      []int
+	// Hardware events sampled in addition to the CPU clock, each written
+	// as its own profile.
+	perfEvents []profiler.PerfEvent
 
 	processInfoManager      profiler.ProcessInfoManager
 	addressNormalizer       profiler.AddressNormalizer
 	vdsoSymbolizer          pprof.VDSOSymbolizer
+	localSymbolizer         pprof.LocalSymbolizer
 	ksym                    *ksym.Ksym
 	disableJITSymbolization bool
+	demangler               *demangle.Demangler
+	unknownFrames           pprof.UnknownFramePolicy
 	perfMapCache            *perf.PerfMapCache
 	jitdumpCache            *perf.JitdumpCache
 	converterMetrics        *pprof.ConverterMetrics
 	profileWriter           profiler.ProfileWriter
+	// Optional, tracks how the addresses of the binaries sampled are
+	// symbolized.
+	symbolizationCoverage *pprof.SymbolizationCoverage
+	// Optional, tracks where the DWARF unwinder fails in the binaries
+	// sampled.
+	unwindFailures *profiler.UnwindFailures
+	// Optional, records the lifecycle of the profiled processes.
+	events *lifecycle.EventLog
 
 	framePointerCache unwind.FramePointerCache
 
@@ -112,68 +288,211 @@ type CPU struct {
 	dwarfUnwindingDisable bool
 
 	memlockRlimit     uint64
+	btfPath           string
 	bpfLoggingVerbose bool
 
 	mixedUnwinding    bool
+	lbrFallback       bool
 	verboseBpfLogging bool
+	// Number of frames after which stacks are truncated.
+	maxStackDepth   uint32
+	goroutineLabels bool
+	// Label samples with the trace context of their thread.
+	traceContextLabels bool
+	// Record the time of every sample.
+	sampleTimestamps bool
+	// Label samples with the CPU and NUMA node they were taken on, or the
+	// NUMA node only.
+	cpuLabels      bool
+	numaNodeLabels bool
+	// Restricts sampling to the cgroups of the processes it keeps, when set.
+	cgroupFilter profiler.Labeler
+	// Don't sample the processes none of whose binaries can be symbolized.
+	skipUnsymbolizable bool
+	// Prepare the processes for profiling when they exec, and forget them
+	// when they exit.
+	trackProcesses bool
+	// Refresh the mappings of the processes as soon as they load a shared
+	// library, by attaching uprobes to the functions loading them.
+	trackLibraries bool
+	dlopenFinder   *dlopen.Finder
+	dlopenProgram  *bpf.BPFProg
+	// Write the profiles of the processes running the same executable with
+	// the same labels, other than their PIDs, as a single one.
+	aggregateByExecutable bool
+	// Profiles are converted and written by up to as many workers at once
+	// as there are tokens, each within the timeout when set.
+	conversionTokens  *semaphore.Weighted
+	conversionTimeout time.Duration
+	// Buffer the BPF events are sent through, and its size in pages per CPU.
+	eventsBuffer      string
+	eventsBufferPages int
+
+	unwindTableCacheDir  string
+	unwindTableServerURL string
 
 	// Notify that the BPF program was loaded.
 	bpfProgramLoaded chan bool
+
+	// Profiles of the targets being accumulated, until their profiling
+	// duration is over. Only accessed by the profiling loop.
+	pending map[int]*pendingProfile
+
+	// Profiles requested on demand, see Capture.
+	captureMtx *sync.Mutex
+	captures   []*capture
+
+	// Samples read before the end of the round because the maps storing
+	// stacks were full, see flushStacks. Only accessed by the profiling loop.
+	flushedRawData           map[int32]map[sampleKey]sampleValue
+	flushedInterpreterStacks map[interpreterStackKey][]uint64
+
+	// Number of time buckets every round is cut into, each written as its
+	// own profile, and the buckets of the current round that ended, see
+	// closeTimeBucket. Only accessed by the profiling loop.
+	timeBuckets       int
+	closedTimeBuckets []timeBucket
+	timeBucketStart   time.Time
+}
+
+// timeBucket holds the samples read at the end of a time bucket of a round.
+type timeBucket struct {
+	start, end        time.Time
+	rawData           map[int32]map[sampleKey]sampleValue
+	interpreterStacks map[interpreterStackKey][]uint64
+}
+
+// rawDataBucket is the raw data of the processes sampled in a time bucket.
+type rawDataBucket struct {
+	start, end time.Time
+	rawData    profile.RawData
+}
+
+// pendingProfile accumulates the samples of a target over profiling rounds.
+type pendingProfile struct {
+	info      *process.Info
+	labelSet  model.LabelSet
+	startedAt time.Time
+	// Since it started when unset.
+	duration time.Duration
+	periodNS int64
+	samples  []profile.RawSample
+	// Samples that were taken but couldn't be stored.
+	lostSamples uint64
+	// The samples by time bucket, when rounds are cut into time buckets.
+	buckets []*pendingProfile
+
+	// Rounds since the profile started, and after which it is written.
+	rounds, dueRounds int
+}
+
+// ErrNoSamples is returned when a process wasn't sampled during a capture.
+var ErrNoSamples = errors.New("no samples were taken of the process")
+
+// capture accumulates the samples of a process requested on demand.
+type capture struct {
+	pendingProfile
+
+	pid  int
+	done chan captureResult
+}
+
+type captureResult struct {
+	prof *pprofprofile.Profile
+	err  error
 }
 
 func NewCPUProfiler(
 	logger log.Logger,
 	reg prometheus.Registerer,
+	tracer trace.Tracer,
 	processInfoManager profiler.ProcessInfoManager,
 	addressNormalizer profiler.AddressNormalizer,
 	vdsoSymbolizer pprof.VDSOSymbolizer,
+	localSymbolizer pprof.LocalSymbolizer,
 	ksym *ksym.Ksym,
 	perfMapCache *perf.PerfMapCache,
 	jitdumpCache *perf.JitdumpCache,
-	disableJITSymbolization bool,
+	demangler *demangle.Demangler,
 	profileWriter profiler.ProfileWriter,
-	profilingDuration time.Duration,
-	profilingSamplingFrequency uint64,
-	memlockRlimit uint64,
-	debugProcessNames []string,
-	disableDWARFUnwinding bool,
-	mixedUnwinding bool,
-	verboseBpfLogging bool,
+	frequencyController *profiler.FrequencyController,
+	budget *profiler.Budget,
+	cgroupFilter profiler.Labeler,
+	events *lifecycle.EventLog,
+	symbolizationCoverage *pprof.SymbolizationCoverage,
+	unwindFailures *profiler.UnwindFailures,
+	options Options,
 	bpfProgramLoaded chan bool,
 ) *CPU {
 	return &CPU{
 		logger: logger,
 		reg:    reg,
+		tracer: tracer,
 
 		processInfoManager:      processInfoManager,
 		addressNormalizer:       addressNormalizer,
 		vdsoSymbolizer:          vdsoSymbolizer,
+		localSymbolizer:         localSymbolizer,
 		ksym:                    ksym,
 		perfMapCache:            perfMapCache,
 		jitdumpCache:            jitdumpCache,
-		converterMetrics:        pprof.NewConverterMetrics(reg),
-		disableJITSymbolization: disableJITSymbolization,
+		converterMetrics:        pprof.NewConverterMetrics(reg, "cpu"),
+		disableJITSymbolization: options.DisableJITSymbolization,
+		demangler:               demangler,
+		unknownFrames:           options.UnknownFrames,
 		profileWriter:           profileWriter,
 
 		// CPU profiler specific caches.
 		framePointerCache: unwind.NewHasFramePointersCache(logger, reg),
 
-		profilingDuration:          profilingDuration,
-		profilingSamplingFrequency: profilingSamplingFrequency,
+		profilingDuration:          options.ProfilingDuration,
+		profilingSamplingFrequency: options.SamplingFrequency,
+		frequencyController:        frequencyController,
+		budget:                     budget,
+		samplingFrequency:          options.SamplingFrequency,
+		perfEvents:                 options.PerfEvents,
 
 		mtx:       &sync.RWMutex{},
 		byteOrder: byteorder.GetHostByteOrder(),
 		metrics:   newMetrics(reg),
 
-		memlockRlimit: memlockRlimit,
+		memlockRlimit: options.MemlockRlimit,
+		btfPath:       options.BTFPath,
+
+		debugProcessNames: options.DebugProcessNames,
+
+		dwarfUnwindingDisable: options.DisableDWARFUnwinding,
+		mixedUnwinding:        options.MixedUnwinding,
+		lbrFallback:           options.LBRFallback,
+		maxStackDepth:         options.MaxStackDepth,
+		goroutineLabels:       options.GoroutineLabels,
+		traceContextLabels:    options.TraceContextLabels,
+		sampleTimestamps:      options.SampleTimestamps,
+		cpuLabels:             options.CPULabels,
+		numaNodeLabels:        options.NUMANodeLabels || options.CPULabels,
+		cgroupFilter:          cgroupFilter,
+		skipUnsymbolizable:    options.SkipUnsymbolizable,
+		trackProcesses:        options.TrackProcesses,
+		trackLibraries:        options.TrackLibraries,
+		dlopenFinder:          dlopen.NewFinder(),
+		aggregateByExecutable: options.AggregateByExecutable,
+		timeBuckets:           options.TimeBuckets,
+		conversionTokens:      semaphore.NewWeighted(int64(options.ConversionWorkers)),
+		conversionTimeout:     options.ConversionTimeout,
+		eventsBuffer:          options.EventsBuffer,
+		eventsBufferPages:     options.EventsBufferPages,
+		bpfLoggingVerbose:     options.VerboseBPFLogging,
+		unwindTableCacheDir:   options.UnwindTableCacheDir,
+		unwindTableServerURL:  options.UnwindTableServerURL,
+		events:                events,
+		symbolizationCoverage: symbolizationCoverage,
+		unwindFailures:        unwindFailures,
 
-		debugProcessNames: debugProcessNames,
+		bpfProgramLoaded: bpfProgramLoaded,
 
-		dwarfUnwindingDisable: disableDWARFUnwinding,
-		mixedUnwinding:        mixedUnwinding,
-		bpfLoggingVerbose:     verboseBpfLogging,
+		pending: map[int]*pendingProfile{},
 
-		bpfProgramLoaded: bpfProgramLoaded,
+		captureMtx: &sync.Mutex{},
 	}
 }
 
@@ -203,9 +522,24 @@ func (p *CPU) debugProcesses() bool {
 	return len(p.debugProcessNames) > 0
 }
 
+// useRingbuf returns whether the events are sent through the ring buffer with
+// the given events buffer setting.
+func useRingbuf(eventsBuffer string) (bool, error) {
+	if eventsBuffer == EventsBufferPerf {
+		return false, nil
+	}
+	// An error means support couldn't be probed, which is handled as no
+	// support.
+	supported, _ := bpf.BPFMapTypeIsSupported(bpf.MapTypeRingbuf)
+	if eventsBuffer == EventsBufferRingbuf && !supported {
+		return false, errors.New("ring buffer is not supported by the kernel")
+	}
+	return supported, nil
+}
+
 // loadBpfProgram loads the BPF program and maps adjusting the unwind shards to
 // the highest possible value.
-func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding, debugEnabled, verboseBpfLogging bool, memlockRlimit uint64) (*bpf.Module, *bpfMaps, error) {
+func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, config Config, memlockRlimit uint64, btfPath string, eventsBufferPages int) (*bpf.Module, *bpfMaps, error) {
 	var lerr error
 
 	maxLoadAttempts := 10
@@ -222,6 +556,7 @@ func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding
 		m, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
 			BPFObjBuff: bpfObj,
 			BPFObjName: "parca",
+			BTFObjPath: btfPath,
 		})
 		if err != nil {
 			return nil, nil, fmt.Errorf("new bpf module: %w", err)
@@ -241,11 +576,11 @@ func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding
 		}
 
 		level.Info(logger).Log("msg", "Attempting to create unwind shards", "count", unwindShards)
-		if err := bpfMaps.adjustMapSizes(debugEnabled, unwindShards); err != nil {
+		if err := bpfMaps.adjustMapSizes(config, unwindShards, eventsBufferPages); err != nil {
 			return nil, nil, fmt.Errorf("failed to adjust map sizes: %w", err)
 		}
 
-		if err := m.InitGlobalVariable(configKey, Config{FilterProcesses: debugEnabled, VerboseLogging: verboseBpfLogging, MixedStackWalking: mixedUnwinding}); err != nil {
+		if err := m.InitGlobalVariable(configKey, config); err != nil {
 			return nil, nil, fmt.Errorf("init global variable: %w", err)
 		}
 
@@ -268,7 +603,10 @@ func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding
 	return nil, nil, lerr
 }
 
-func (p *CPU) addUnwindTableForProcess(pid int) {
+func (p *CPU) addUnwindTableForProcess(ctx context.Context, pid int) {
+	_, span := p.tracer.Start(ctx, "CPU.addUnwindTableForProcess", trace.WithAttributes(attribute.Int("pid", pid)))
+	defer span.End()
+
 	executable := fmt.Sprintf("/proc/%d/exe", pid)
 	hasFramePointers, err := p.framePointerCache.HasFramePointers(executable)
 	if err != nil {
@@ -283,6 +621,12 @@ func (p *CPU) addUnwindTableForProcess(pid int) {
 		return
 	}
 
+	// Their samples are skipped, and their executables are not supported by
+	// the unwind tables.
+	if p.bpfMaps.isCompat(pid) {
+		return
+	}
+
 	level.Debug(p.logger).Log("msg", "adding unwind tables", "pid", pid)
 
 	err = p.bpfMaps.addUnwindTableForProcess(pid, nil, true)
@@ -297,6 +641,7 @@ func (p *CPU) addUnwindTableForProcess(pid int) {
 		} else {
 			level.Error(p.logger).Log("msg", "failed to add unwind table", "pid", pid, "err", err)
 		}
+		span.RecordError(err)
 		return
 	}
 }
@@ -324,25 +669,164 @@ func (p *CPU) listenEvents(ctx context.Context, eventsChan <-chan []byte, lostCh
 				// See onDemandUnwindInfoBatcher for consumer.
 				requestUnwindInfoChan <- pid
 			case payload&RequestProcessMappings == RequestProcessMappings:
-				// Manager will make sure there is only one request per PID.
-				go func() {
-					if err := p.processInfoManager.Fetch(ctx, pid); err != nil {
-						level.Debug(p.logger).Log("msg", "failed to load process info", "pid", pid, "err", err)
-					}
-				}()
+				go p.fetchProcessInfo(ctx, pid)
 			case payload&RequestRefreshProcInfo == RequestRefreshProcInfo:
 				// Refresh mappings and their unwind info if they've changed.
 				//
 				// TODO: update the mappings cache above.
 				// TODO: consider calling this async.
 				p.bpfMaps.refreshProcessInfo(pid)
+			case payload&ProcessExec == ProcessExec:
+				// Prepared before the process is first sampled, as short-lived
+				// ones might exit before their samples could be unwound and
+				// symbolized otherwise.
+				go p.fetchProcessInfo(ctx, pid)
+				if !p.dwarfUnwindingDisable {
+					requestUnwindInfoChan <- pid
+				}
+			case payload&ProcessExit == ProcessExit:
+				p.bpfMaps.forgetProcess(pid)
+			case payload&LibraryLoaded == LibraryLoaded:
+				// The library gets its debug information uploaded and its
+				// unwind table built before it is sampled.
+				go p.fetchProcessInfo(ctx, pid)
+				if p.bpfMaps.hasProcessInfo(pid) {
+					p.bpfMaps.refreshProcessInfo(pid)
+				}
 			}
 		case lost := <-lostChan:
+			p.metrics.lostEvents.Add(float64(lost))
 			level.Warn(p.logger).Log("msg", "lost events", "count", lost)
 		}
 	}
 }
 
+// fetchProcessInfo loads the information of a process, and passes the parts
+// the BPF program uses to it.
+func (p *CPU) fetchProcessInfo(ctx context.Context, pid int) {
+	// Manager will make sure there is only one request per PID.
+	if err := p.processInfoManager.Fetch(ctx, pid); err != nil {
+		level.Debug(p.logger).Log("msg", "failed to load process info", "pid", pid, "err", err)
+		return
+	}
+	p.updateCompat(ctx, pid)
+	p.updateRuntimeInfo(ctx, pid)
+	if p.skipUnsymbolizable {
+		p.updateSymbolizable(ctx, pid)
+	}
+	if p.dlopenProgram != nil {
+		p.attachDlopenProbes(ctx, pid)
+	}
+}
+
+// attachDlopenProbes attaches uprobes to the functions loading shared
+// libraries in the files mapped by the given process, unless they were
+// attached for another process mapping the same files.
+func (p *CPU) attachDlopenProbes(ctx context.Context, pid int) {
+	pi, err := p.processInfoManager.Info(ctx, pid)
+	if err != nil {
+		return
+	}
+	procMaps := make([]*procfs.ProcMap, 0, len(pi.Mappings))
+	for _, m := range pi.Mappings {
+		procMaps = append(procMaps, m.ProcMap)
+	}
+
+	targets, err := p.dlopenFinder.Find(pid, procMaps)
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "failed to find the functions loading shared libraries", "pid", pid, "err", err)
+	}
+	for _, t := range targets {
+		for _, offset := range t.Offsets {
+			// The link is destroyed when the module is closed.
+			if _, err := p.dlopenProgram.AttachURetprobe(-1, t.Path, uint32(offset)); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to attach uprobe to the function loading shared libraries", "path", t.Path, "offset", offset, "err", err)
+				continue
+			}
+			level.Debug(p.logger).Log("msg", "attached uprobe to the function loading shared libraries", "path", t.Path, "offset", offset)
+		}
+	}
+}
+
+// updateCompat makes the BPF program stop sampling the given process if it is
+// a 32-bit one, rather than walking its stack as if it was a 64-bit one.
+func (p *CPU) updateCompat(ctx context.Context, pid int) {
+	pi, err := p.processInfoManager.Info(ctx, pid)
+	if err != nil {
+		return
+	}
+	if err := p.bpfMaps.setCompat(pid, pi.Compat); err != nil {
+		level.Debug(p.logger).Log("msg", "failed to set whether the process is a 32-bit one", "pid", pid, "err", err)
+		return
+	}
+	if pi.Compat {
+		level.Debug(p.logger).Log("msg", "not sampling 32-bit process", "pid", pid)
+	}
+	p.metrics.compatProcesses.Set(float64(p.bpfMaps.compatProcesses()))
+}
+
+// updateRuntimeInfo lets the BPF program walk the interpreter stacks of the
+// given process, if it runs a supported interpreter, read its goroutines if
+// it is a Go program and its trace context if it publishes one, when the
+// respective labels are enabled.
+func (p *CPU) updateRuntimeInfo(ctx context.Context, pid int) {
+	pi, err := p.processInfoManager.Info(ctx, pid)
+	if err != nil {
+		return
+	}
+	if err := p.bpfMaps.setInterpreterInfo(pid, pi.Interpreter); err != nil {
+		level.Debug(p.logger).Log("msg", "failed to set interpreter info", "pid", pid, "err", err)
+	}
+	if p.goroutineLabels {
+		if err := p.bpfMaps.setGoRuntimeInfo(pid, pi.GoRuntime); err != nil {
+			level.Debug(p.logger).Log("msg", "failed to set go runtime info", "pid", pid, "err", err)
+		}
+	}
+	if p.traceContextLabels {
+		if err := p.bpfMaps.setTraceContextInfo(pid, pi.TraceContext); err != nil {
+			level.Debug(p.logger).Log("msg", "failed to set trace context info", "pid", pid, "err", err)
+		}
+	}
+}
+
+// updateSymbolizable makes the BPF program stop sampling the given process
+// when none of its binaries can be symbolized: none has a build ID or unwind
+// information, and the process has no perf map.
+func (p *CPU) updateSymbolizable(ctx context.Context, pid int) {
+	pi, err := p.processInfoManager.Info(ctx, pid)
+	if err != nil {
+		return
+	}
+	unsymbolizable := !pi.Mappings.Symbolizable() && !p.hasPerfMap(pid)
+	if err := p.bpfMaps.setUnsymbolizable(pid, unsymbolizable); err != nil {
+		level.Debug(p.logger).Log("msg", "failed to set whether the process is symbolizable", "pid", pid, "err", err)
+		return
+	}
+	if unsymbolizable {
+		level.Debug(p.logger).Log("msg", "not sampling process without any symbolizable binary", "pid", pid)
+	}
+}
+
+// recheckUnsymbolizable samples again the processes that wrote a perf map
+// since they were found unsymbolizable, such as JIT compilers.
+func (p *CPU) recheckUnsymbolizable() {
+	pids := p.bpfMaps.unsymbolizableProcesses()
+	for _, pid := range pids {
+		if !p.hasPerfMap(pid) {
+			continue
+		}
+		if err := p.bpfMaps.setUnsymbolizable(pid, false); err != nil {
+			level.Debug(p.logger).Log("msg", "failed to set whether the process is symbolizable", "pid", pid, "err", err)
+		}
+	}
+	p.metrics.unsymbolizableProcesses.Set(float64(len(p.bpfMaps.unsymbolizableProcesses())))
+}
+
+func (p *CPU) hasPerfMap(pid int) bool {
+	_, err := p.perfMapCache.PerfMapForPID(pid)
+	return !errors.Is(err, perf.ErrPerfMapNotFound) && !errors.Is(err, perf.ErrProcNotFound)
+}
+
 // onDemandUnwindInfoBatcher batches PIDs sent from the BPF program when
 // frame pointers and unwind information are not present.
 //
@@ -417,12 +901,53 @@ func (p *CPU) Run(ctx context.Context) error {
 
 	debugEnabled := len(matchers) > 0
 
-	m, bpfMaps, err := loadBpfProgram(p.logger, p.reg, p.mixedUnwinding, debugEnabled, p.bpfLoggingVerbose, p.memlockRlimit)
+	var cgroupMountpoint string
+	if p.cgroupFilter != nil {
+		cgroupMountpoint, err = cgroup.V2Mountpoint()
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "cgroup filter requires cgroup2, profiling every cgroup", "err", err)
+		}
+	}
+	filterCgroups := cgroupMountpoint != ""
+
+	eventsRingbuf, err := useRingbuf(p.eventsBuffer)
+	if err != nil {
+		return err
+	}
+	level.Debug(p.logger).Log("msg", "sending BPF events", "ringbuf", eventsRingbuf)
+
+	m, bpfMaps, err := loadBpfProgram(p.logger, p.reg, Config{
+		FilterProcesses:   debugEnabled,
+		VerboseLogging:    p.bpfLoggingVerbose,
+		MixedStackWalking: p.mixedUnwinding,
+		SampleTimestamps:  p.sampleTimestamps,
+		CPULabels:         p.cpuLabels,
+		NUMANodeLabels:    p.numaNodeLabels,
+		FilterCgroups:     filterCgroups,
+		EventsRingbuf:     eventsRingbuf,
+		LBRFallback:       p.lbrFallback,
+		MaxStackDepth:     p.maxStackDepth,
+	}, p.memlockRlimit, p.btfPath, p.eventsBufferPages)
 	if err != nil {
 		return fmt.Errorf("load bpf program: %w", err)
 	}
 	defer m.Close()
 
+	if p.unwindTableCacheDir != "" {
+		unwindTableCache, err := unwind.NewTableCache(log.With(p.logger, "component", "unwind_table_cache"), p.reg, p.unwindTableCacheDir)
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to initialize the unwind table disk cache", "err", err)
+		} else {
+			bpfMaps.unwindTableCache = unwindTableCache
+		}
+	}
+	if p.unwindTableServerURL != "" {
+		bpfMaps.unwindTableFetcher = unwind.NewTableFetcher(log.With(p.logger, "component", "unwind_table_fetcher"), p.reg, p.unwindTableServerURL)
+	}
+
+	bpfMaps.metrics = p.metrics
+	bpfMaps.events = p.events
+
 	p.bpfProgramLoaded <- true
 	p.bpfMaps = bpfMaps
 
@@ -432,25 +957,20 @@ func (p *CPU) Run(ctx context.Context) error {
 		level.Debug(p.logger).Log("msg", "error getting parca-agent pid", "err", err)
 	}
 
-	p.reg.MustRegister(newBPFMetricsCollector(p, m, agentProc.PID))
+	bpfMetrics := newBPFMetricsCollector(p, m, agentProc.PID)
+	p.reg.MustRegister(bpfMetrics)
 
-	// Period is the number of events between sampled occurrences.
-	// By default we sample at 19Hz (19 times per second),
-	// which is every ~0.05s or 52,631,578 nanoseconds (1 Hz = 1e9 ns).
-	samplingPeriod := int64(1e9 / p.profilingSamplingFrequency)
 	cpus := runtime.NumCPU()
 
 	for i := 0; i < cpus; i++ {
-		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
-			Type:   unix.PERF_TYPE_SOFTWARE,
-			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-			Sample: p.profilingSamplingFrequency,
-			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-		}, -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
+		fd, err := unix.PerfEventOpen(p.cpuPerfEventAttr(), -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
 		if err != nil {
+			if p.lbrFallback {
+				return fmt.Errorf("open perf event with the Last Branch Record, which requires an Intel CPU from Haswell on, usually not exposed to virtual machines: %w", err)
+			}
 			return fmt.Errorf("open perf event: %w", err)
 		}
+		p.perfEventFDs = append(p.perfEventFDs, fd)
 
 		// Do not close this fd manually as it will result in an error in the
 		// best case, if the FD doesn't exist and in the worst case it will
@@ -481,6 +1001,35 @@ func (p *CPU) Run(ctx context.Context) error {
 		}
 	}
 
+	if err := p.attachPerfEvents(m, cpus); err != nil {
+		return err
+	}
+
+	if p.trackProcesses {
+		for _, tp := range []struct{ program, name string }{
+			{execProgramName, "sched_process_exec"},
+			{exitProgramName, "sched_process_exit"},
+		} {
+			prog, err := m.GetProgram(tp.program)
+			if err != nil {
+				return fmt.Errorf("get bpf program %s: %w", tp.program, err)
+			}
+			// The link is destroyed when the module is closed.
+			if _, err := prog.AttachTracepoint("sched", tp.name); err != nil {
+				return fmt.Errorf("attach tracepoint %s: %w", tp.name, err)
+			}
+		}
+	}
+
+	if p.trackLibraries {
+		prog, err := m.GetProgram(dlopenProgramName)
+		if err != nil {
+			return fmt.Errorf("get bpf program %s: %w", dlopenProgramName, err)
+		}
+		// Attached to the files mapped by the processes once they are discovered.
+		p.dlopenProgram = prog
+	}
+
 	// Record start time for first profile.
 	p.mtx.Lock()
 	p.lastProfileStartedAt = time.Now()
@@ -500,6 +1049,23 @@ func (p *CPU) Run(ctx context.Context) error {
 		return fmt.Errorf("failure updating: %w", err)
 	}
 
+	for _, unwinder := range []struct {
+		name string
+		idx  uint64
+	}{
+		{phpUnwinderProgramName, phpProgramFd},
+		{v8UnwinderProgramName, v8ProgramFd},
+	} {
+		unwinderProg, err := m.GetProgram(unwinder.name)
+		if err != nil {
+			return fmt.Errorf("get bpf program: %w", err)
+		}
+		unwinderFd := unwinderProg.FileDescriptor()
+		if err := programs.Update(unsafe.Pointer(&unwinder.idx), unsafe.Pointer(&unwinderFd)); err != nil {
+			return fmt.Errorf("failure updating: %w", err)
+		}
+	}
+
 	if err := p.bpfMaps.create(); err != nil {
 		return fmt.Errorf("failed to create maps: %w", err)
 	}
@@ -509,26 +1075,53 @@ func (p *CPU) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to create procfs: %w", err)
 	}
 
+	p.metrics.samplingFrequency.Set(float64(p.samplingFrequency))
+	if p.frequencyController != nil {
+		p.hostLoad = profiler.NewHostLoad(pfs)
+		// Takes the first measurement the CPU utilization is compared to.
+		_, _ = p.hostLoad.Read()
+	}
+
 	// Update the debug pids map.
 	go p.watchProcesses(ctx, pfs, matchers)
 
+	if filterCgroups {
+		// The filter is empty until it is first updated, nothing is sampled
+		// before that.
+		p.updateCgroupFilter(ctx, pfs, cgroupMountpoint)
+		go p.watchCgroups(ctx, pfs, cgroupMountpoint)
+	}
+
 	// Process BPF events.
 	var (
 		eventsChan               = make(chan []byte)
-		lostChannel              = make(chan uint64)
+		lostChannel              chan uint64
 		requestUnwindInfoChannel = make(chan int)
 	)
-	perfBuf, err := m.InitPerfBuf("events", eventsChan, lostChannel, 64)
-	if err != nil {
-		return fmt.Errorf("failed to init perf buffer: %w", err)
+	if eventsRingbuf {
+		// Lost events are counted by the BPF program.
+		ringBuf, err := m.InitRingBuf(eventsRingbufMapName, eventsChan)
+		if err != nil {
+			return fmt.Errorf("failed to init ring buffer: %w", err)
+		}
+		ringBuf.Poll(250)
+	} else {
+		lostChannel = make(chan uint64)
+		perfBuf, err := m.InitPerfBuf(eventsMapName, eventsChan, lostChannel, p.eventsBufferPages)
+		if err != nil {
+			return fmt.Errorf("failed to init perf buffer: %w", err)
+		}
+		perfBuf.Poll(250)
 	}
-	perfBuf.Poll(250)
 	go p.listenEvents(ctx, eventsChan, lostChannel, requestUnwindInfoChannel)
 
 	go func() {
 		onDemandUnwindInfoBatcher(ctx, requestUnwindInfoChannel, 150*time.Millisecond, func(pids []int) {
+			ctx, span := p.tracer.Start(ctx, "CPU.addUnwindTables", trace.WithAttributes(attribute.Int("processes", len(pids))))
+			defer span.End()
+
 			for _, pid := range pids {
-				p.addUnwindTableForProcess(pid)
+				p.addUnwindTableForProcess(ctx, pid)
 			}
 
 			// Must be called after all the calls to `addUnwindTableForProcess`, as it's possible
@@ -544,84 +1137,779 @@ func (p *CPU) Run(ctx context.Context) error {
 		})
 	}()
 
-	ticker := time.NewTicker(p.profilingDuration)
+	// Rounds are cut into time buckets, the samples of which are read at
+	// the end of each of them.
+	if p.timeBuckets < 1 {
+		p.timeBuckets = 1
+	}
+	ticker := time.NewTicker(p.profilingDuration / time.Duration(p.timeBuckets))
 	defer ticker.Stop()
+	p.timeBucketStart = p.LastProfileStartedAt()
+	var bucket int
+
+	// The maps storing stacks are checked for overflows a few times per
+	// round, and flushed early if any happened, rather than dropping the
+	// new stacks until the end of the round.
+	overflowTicker := time.NewTicker(p.profilingDuration / 4)
+	defer overflowTicker.Stop()
+	mapsFull := bpfMetrics.getUnwinderStats().mapsFull()
 
 	level.Debug(p.logger).Log("msg", "start profiling loop")
+	var round uint64
 	for {
 		select {
 		case <-ctx.Done():
+			// The samples taken since the last round and the profiles
+			// pending are written rather than abandoned, within the time
+			// of a round as the context of the profiler is canceled.
+			flushCtx, cancel := context.WithTimeout(context.Background(), p.profilingDuration)
+			p.round(flushCtx, round+1, true)
+			cancel()
 			return ctx.Err()
+		case <-overflowTicker.C:
+			full := bpfMetrics.getUnwinderStats().mapsFull()
+			if full > mapsFull {
+				level.Debug(p.logger).Log("msg", "maps storing stacks overflowed, flushing them", "dropped_samples", full-mapsFull)
+				if err := p.flushStacks(ctx); err != nil {
+					level.Warn(p.logger).Log("msg", "failed to flush the maps storing stacks", "err", err)
+				}
+			}
+			mapsFull = full
+			continue
 		case <-ticker.C:
+			bucket++
+			if bucket < p.timeBuckets {
+				if err := p.closeTimeBucket(ctx); err != nil {
+					level.Warn(p.logger).Log("msg", "failed to read the samples of the time bucket", "err", err)
+				}
+				continue
+			}
+			bucket = 0
 		}
 
-		obtainStart := time.Now()
-		rawData, err := p.obtainRawData(ctx)
-		if err != nil {
-			p.metrics.obtainAttempts.WithLabelValues(labelError).Inc()
-			level.Warn(p.logger).Log("msg", "failed to obtain profiles from eBPF maps", "err", err)
+		round++
+		p.round(ctx, round, false)
+	}
+}
+
+// round reads the samples of the last round from the BPF maps, and writes
+// the profiles due. The final round writes all the pending profiles.
+func (p *CPU) round(ctx context.Context, round uint64, final bool) {
+	// All the spans of a round, from draining the samples to writing
+	// the profiles, share its profile batch ID.
+	batchID := fmt.Sprintf("%s-%d-%d", p.Name(), os.Getpid(), round)
+	ctx, span := p.tracer.Start(tracer.WithProfileBatchID(ctx, batchID), "CPU.round", trace.WithAttributes(tracer.ProfileBatchIDKey.String(batchID)))
+
+	obtainStart := time.Now()
+	buckets, err := p.obtainRawData(ctx)
+	if err != nil {
+		p.metrics.obtainAttempts.WithLabelValues(labelError).Inc()
+		level.Warn(p.logger).Log("msg", "failed to obtain profiles from eBPF maps", "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
+	}
+	p.metrics.obtainAttempts.WithLabelValues(labelSuccess).Inc()
+	p.metrics.obtainDuration.Observe(time.Since(obtainStart).Seconds())
+
+	processLastErrors := map[int]error{}
+	// The sampling frequencies overridden apply from the next round on,
+	// all the buckets of this one were sampled at the same frequency.
+	frequencies := map[int]uint64{}
+	for _, bucket := range buckets {
+		p.processRawData(ctx, bucket, processLastErrors, frequencies)
+	}
+	for pid, frequency := range frequencies {
+		p.setSamplingFrequency(pid, frequency)
+	}
+	span.SetAttributes(attribute.Int("processes", len(processLastErrors)))
+
+	due := map[int]*pendingProfile{}
+	aggregates := map[aggregationKey]map[int]*pendingProfile{}
+	for pid, pending := range p.pending {
+		pending.rounds++
+		if pending.rounds < pending.dueRounds && !final {
 			continue
 		}
-		p.metrics.obtainAttempts.WithLabelValues(labelSuccess).Inc()
-		p.metrics.obtainDuration.Observe(time.Since(obtainStart).Seconds())
+		delete(p.pending, pid)
+
+		if p.aggregateByExecutable {
+			if key, ok := newAggregationKey(pending); ok {
+				if aggregates[key] == nil {
+					aggregates[key] = map[int]*pendingProfile{}
+				}
+				aggregates[key][pid] = pending
+				continue
+			}
+		}
+		due[pid] = pending
+	}
+	for pid, err := range p.writeProfiles(ctx, due, aggregates) {
+		if err != nil {
+			processLastErrors[pid] = err
+		}
+	}
+	p.adaptSamplingFrequency()
+	if p.skipUnsymbolizable {
+		p.recheckUnsymbolizable()
+	}
+	p.finishCaptures(ctx)
+	p.report(err, processLastErrors)
+	span.End()
+}
 
-		processLastErrors := map[int]error{}
-		for _, perProcessRawData := range rawData {
-			pid := int(perProcessRawData.PID)
+// processRawData adds the samples of the processes sampled in a time bucket to
+// their pending profiles, and writes their perf event profiles. The errors
+// and the sampling frequencies overridden are set by PID.
+func (p *CPU) processRawData(ctx context.Context, bucket rawDataBucket, processLastErrors map[int]error, frequencies map[int]uint64) {
+	for _, perProcessRawData := range bucket.rawData {
+		pid := int(perProcessRawData.PID)
+		if _, ok := processLastErrors[pid]; !ok {
 			processLastErrors[pid] = nil
+		}
 
-			pi, err := p.processInfoManager.Info(ctx, pid)
-			if err != nil {
-				p.metrics.profileDrop.WithLabelValues(profileDropReasonProcessInfo).Inc()
-				level.Warn(p.logger).Log("msg", "failed to get process info", "pid", pid, "err", err)
-				processLastErrors[pid] = err
-				continue
+		pi, err := p.processInfoManager.Info(ctx, pid)
+		if err != nil {
+			p.metrics.profileDrop.WithLabelValues(profileDropReasonProcessInfo).Inc()
+			level.Warn(p.logger).Log("msg", "failed to get process info", "pid", pid, "err", err)
+			processLastErrors[pid] = err
+			continue
+		}
+		p.events.RecordOnce(pid, lifecycle.FirstSample, fmt.Sprintf("stacks=%d", len(perProcessRawData.RawSamples)))
+		if p.budget != nil {
+			var samples uint64
+			for _, s := range perProcessRawData.RawSamples {
+				samples += s.Value
 			}
+			p.budget.Record(profiler.BudgetCPU, pid, samples)
+		}
 
-			pprof, err := pprof.NewConverter(
-				p.logger,
-				p.addressNormalizer,
-				p.ksym,
-				p.vdsoSymbolizer,
-				p.perfMapCache,
-				p.jitdumpCache,
-				p.converterMetrics,
-				p.disableJITSymbolization,
-
-				pid,
-				pi.Mappings,
-				p.LastProfileStartedAt(),
-				samplingPeriod,
-			).Convert(ctx, perProcessRawData.RawSamples)
-			if err != nil {
-				level.Warn(p.logger).Log("msg", "failed to convert profile to pprof", "pid", pid, "err", err)
-				processLastErrors[pid] = err
-				continue
+		// Samples were taken at the frequency set so far, and are weighed
+		// by its period so that the ones taken at other frequencies can be
+		// in the same profile.
+		periodNS := p.samplingPeriod(pid)
+		for i := range perProcessRawData.RawSamples {
+			perProcessRawData.RawSamples[i].PeriodNS = periodNS
+		}
+		if pi.Interpreter != nil {
+			for i := range perProcessRawData.RawSamples {
+				pi.Interpreter.Interleave(&perProcessRawData.RawSamples[i])
+			}
+			for _, samples := range perProcessRawData.PerfEventSamples {
+				for i := range samples {
+					pi.Interpreter.Interleave(&samples[i])
+				}
 			}
+		}
+		p.addToCaptures(pid, pi, perProcessRawData.RawSamples)
+
+		labelSet, err := pi.Labels(ctx)
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to get process labels", "pid", pid, "err", err)
+			processLastErrors[pid] = err
+			continue
+		}
+		if len(labelSet) == 0 {
+			level.Debug(p.logger).Log("msg", "profile dropped", "pid", pid)
+			continue
+		}
+
+		overrides, labelSet, err := profiler.TargetOverrides(labelSet)
+		if err != nil {
+			level.Debug(p.logger).Log("msg", "ignoring invalid profiling overrides", "pid", pid, "err", err)
+		}
+		frequencies[pid] = overrides.CPUSamplingFrequency
+		p.accumulate(pid, pi, labelSet, overrides.ProfilingDuration, periodNS, bucket, perProcessRawData.RawSamples, perProcessRawData.LostSamples)
+		if err := p.writePerfEventProfiles(ctx, pid, pi, labelSet, bucket, perProcessRawData.PerfEventSamples); err != nil {
+			processLastErrors[pid] = err
+		}
+	}
+}
 
-			labelSet, err := pi.Labels(ctx)
+// cpuPerfEventAttr returns the event the CPU is sampled on. It is the CPU
+// clock, or the CPU cycles when the stacks are taken from the Last Branch
+// Record as a fallback, since only hardware events record branches.
+func (p *CPU) cpuPerfEventAttr() *unix.PerfEventAttr {
+	attr := &unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Sample: p.profilingSamplingFrequency,
+		Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+	}
+	if p.lbrFallback {
+		attr.Type = unix.PERF_TYPE_HARDWARE
+		attr.Config = unix.PERF_COUNT_HW_CPU_CYCLES
+		attr.Sample_type = unix.PERF_SAMPLE_BRANCH_STACK
+		attr.Branch_sample_type = unix.PERF_SAMPLE_BRANCH_CALL_STACK | unix.PERF_SAMPLE_BRANCH_USER
+	}
+	return attr
+}
+
+// attachPerfEvents opens the hardware events on every CPU and attaches them
+// to their own program, which tags their samples with the index of the event.
+// Unlike the CPU clock, they are sampled every period occurrences, which the
+// frequency adaptation doesn't change.
+func (p *CPU) attachPerfEvents(m *bpf.Module, cpus int) error {
+	for i, event := range p.perfEvents {
+		prog, err := m.GetProgram(fmt.Sprintf(perfEventProgramName, i+1))
+		if err != nil {
+			return fmt.Errorf("get bpf program of perf event %s: %w", event.Name, err)
+		}
+		for cpu := 0; cpu < cpus; cpu++ {
+			fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
+				Type:   event.Type,
+				Config: event.Config,
+				Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+				Sample: event.Period,
+				Bits:   unix.PerfBitDisabled,
+			}, -1 /* pid */, cpu /* cpu id */, -1 /* group */, 0 /* flags */)
 			if err != nil {
-				level.Warn(p.logger).Log("msg", "failed to get process labels", "pid", pid, "err", err)
-				processLastErrors[pid] = err
-				continue
+				// Most likely not supported by the CPU or the hypervisor.
+				return fmt.Errorf("open perf event %s: %w", event.Name, err)
 			}
-			if len(labelSet) == 0 {
-				level.Debug(p.logger).Log("msg", "profile dropped", "pid", pid)
-				continue
+			// As for the CPU clock, the fd is closed along with the module.
+			if _, err := prog.AttachPerfEvent(fd); err != nil {
+				return fmt.Errorf("attach perf event %s: %w", event.Name, err)
 			}
-			// Add the profiler name as a label.
-			// Uses labels.Merge under the hood, so it re-allocates the label set.
-			// If we want to drop/disable a profiler, we should do it with another mechanism besides relabelling.
-			labelSet = labels.WithProfilerName(labelSet, p.Name())
+		}
+	}
+	return nil
+}
 
-			if err := p.profileWriter.Write(ctx, labelSet, pprof); err != nil {
-				level.Warn(p.logger).Log("msg", "failed to write profile", "pid", pid, "err", err)
-				processLastErrors[pid] = err
-				continue
+// writePerfEventProfiles writes the samples of a round taken on the hardware
+// events as one profile per event, whose sample type is the event and whose
+// values are the number of its occurrences. They are written right away,
+// regardless of the profiling duration of the process.
+func (p *CPU) writePerfEventProfiles(ctx context.Context, pid int, pi *process.Info, labelSet model.LabelSet, bucket rawDataBucket, samples map[int][]profile.RawSample) error {
+	var lastErr error
+	for i, eventSamples := range samples {
+		if i >= len(p.perfEvents) || len(eventSamples) == 0 {
+			continue
+		}
+		event := p.perfEvents[i]
+
+		prof, err := p.convert(ctx, pid, &pendingProfile{
+			info:      pi,
+			startedAt: bucket.start,
+			duration:  bucket.end.Sub(bucket.start),
+			periodNS:  int64(event.Period),
+			samples:   eventSamples,
+		})
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to convert profile to pprof", "pid", pid, "event", event.Name, "err", err)
+			p.events.Record(pid, lifecycle.ConversionError, event.Name, err)
+			lastErr = err
+			continue
+		}
+		valueType := &pprofprofile.ValueType{Type: event.Name, Unit: "count"}
+		prof.SampleType = []*pprofprofile.ValueType{valueType}
+		prof.PeriodType = valueType
+		for _, s := range prof.Sample {
+			for j := range s.Value {
+				s.Value[j] *= int64(event.Period)
+			}
+		}
+
+		if err := p.profileWriter.Write(ctx, labels.WithProfilerName(labelSet, p.Name()), prof); err != nil {
+			level.Warn(p.logger).Log("msg", "failed to write profile", "pid", pid, "event", event.Name, "err", err)
+			p.events.Record(pid, lifecycle.ProfileWriteError, event.Name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// adaptSamplingFrequency lowers or raises the frequency the next rounds are
+// sampled at according to the load of the host, when enabled.
+func (p *CPU) adaptSamplingFrequency() {
+	if p.frequencyController == nil {
+		return
+	}
+
+	load, err := p.hostLoad.Read()
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "failed to read host load", "err", err)
+		return
+	}
+	p.metrics.hostLoad.Set(load)
+
+	frequency := p.frequencyController.Next(p.samplingFrequency, load)
+	if frequency == p.samplingFrequency {
+		return
+	}
+
+	// The events are in frequency mode, so their period is the frequency.
+	for _, fd := range p.perfEventFDs {
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.PERF_EVENT_IOC_PERIOD, uintptr(unsafe.Pointer(&frequency))); errno != 0 {
+			level.Warn(p.logger).Log("msg", "failed to update sampling frequency", "fd", fd, "err", errno)
+		}
+	}
+
+	direction := labelDown
+	if frequency > p.samplingFrequency {
+		direction = labelUp
+	}
+	level.Info(p.logger).Log("msg", "adjusted sampling frequency to host load", "load", load, "from", p.samplingFrequency, "to", frequency)
+	p.metrics.samplingFrequencyAdjustments.WithLabelValues(direction).Inc()
+	p.metrics.samplingFrequency.Set(float64(frequency))
+	p.samplingFrequency = frequency
+}
+
+// samplingPeriod returns the period between the samples of the given process,
+// in nanoseconds. By default we sample at 19Hz (19 times per second), which is
+// every ~0.05s or 52,631,578 nanoseconds (1 Hz = 1e9 ns).
+func (p *CPU) samplingPeriod(pid int) int64 {
+	return int64(1e9/p.samplingFrequency) * int64(p.bpfMaps.samplingRatio(pid))
+}
+
+// setSamplingFrequency makes the BPF program sample the given process at the
+// given frequency, or the frequency of the profiler if zero. Samples can only
+// be dropped, so the frequency of the profiler is the highest, and frequencies
+// are rounded to the closest fraction of it. When the frequency of the
+// profiler is lowered under load, the one of the process is lowered as much,
+// and it is lowered further when the CPU budget throttles the process.
+func (p *CPU) setSamplingFrequency(pid int, frequency uint64) {
+	if p.budget != nil {
+		if frequency == 0 {
+			frequency = p.profilingSamplingFrequency
+		}
+		frequency = uint64(math.Max(1, math.Round(float64(frequency)*p.budget.Factor(profiler.BudgetCPU, pid))))
+	}
+	every := uint32(1)
+	if frequency != 0 && frequency < p.profilingSamplingFrequency {
+		every = uint32((p.profilingSamplingFrequency + frequency/2) / frequency)
+	}
+	if err := p.bpfMaps.setSamplingRatio(pid, every); err != nil {
+		level.Debug(p.logger).Log("msg", "failed to set sampling ratio", "pid", pid, "err", err)
+	}
+}
+
+// accumulate adds the samples of a time bucket to the pending profile of the
+// given process. Profiles are written after as many rounds as their duration
+// lasts, or right away without an overridden duration. The samples carry their
+// period, so the ones taken at different frequencies are weighed accordingly.
+func (p *CPU) accumulate(pid int, pi *process.Info, labelSet model.LabelSet, duration time.Duration, periodNS int64, bucket rawDataBucket, samples []profile.RawSample, lostSamples uint64) {
+	dueRounds := 1
+	if duration > p.profilingDuration {
+		dueRounds = int((duration + p.profilingDuration - 1) / p.profilingDuration)
+	}
+
+	pending, ok := p.pending[pid]
+	if !ok {
+		pending = &pendingProfile{startedAt: bucket.start}
+		p.pending[pid] = pending
+	}
+	pending.info = pi
+	pending.periodNS = periodNS
+	pending.labelSet = labelSet
+	pending.dueRounds = dueRounds
+	pending.samples = append(pending.samples, samples...)
+	pending.lostSamples += lostSamples
+	if p.timeBuckets > 1 {
+		pending.buckets = append(pending.buckets, &pendingProfile{
+			startedAt:   bucket.start,
+			duration:    bucket.end.Sub(bucket.start),
+			periodNS:    periodNS,
+			samples:     samples,
+			lostSamples: lostSamples,
+		})
+	}
+}
+
+// Capture profiles the given process for the given duration, regardless of
+// whether its profiles are dropped by relabeling, and returns the profile
+// right away instead of writing it. The duration is rounded up to whole
+// profiling rounds.
+func (p *CPU) Capture(ctx context.Context, pid int, duration time.Duration) (*pprofprofile.Profile, error) {
+	dueRounds := 1
+	if duration > p.profilingDuration {
+		dueRounds = int((duration + p.profilingDuration - 1) / p.profilingDuration)
+	}
+	c := &capture{
+		pendingProfile: pendingProfile{dueRounds: dueRounds},
+		pid:            pid,
+		done:           make(chan captureResult, 1),
+	}
+
+	p.captureMtx.Lock()
+	p.captures = append(p.captures, c)
+	p.captureMtx.Unlock()
+
+	select {
+	case res := <-c.done:
+		return res.prof, res.err
+	case <-ctx.Done():
+		p.captureMtx.Lock()
+		for i, other := range p.captures {
+			if other == c {
+				p.captures = append(p.captures[:i], p.captures[i+1:]...)
+				break
 			}
 		}
-		p.report(err, processLastErrors)
+		p.captureMtx.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// addToCaptures adds the samples of a round to the captures of the process.
+func (p *CPU) addToCaptures(pid int, pi *process.Info, samples []profile.RawSample) {
+	p.captureMtx.Lock()
+	defer p.captureMtx.Unlock()
+
+	for _, c := range p.captures {
+		if c.pid != pid {
+			continue
+		}
+		if c.samples == nil {
+			c.startedAt = p.LastProfileStartedAt()
+			c.periodNS = p.samplingPeriod(pid)
+		}
+		c.info = pi
+		c.samples = append(c.samples, samples...)
+	}
+}
+
+// finishCaptures completes the captures that lasted long enough.
+func (p *CPU) finishCaptures(ctx context.Context) {
+	p.captureMtx.Lock()
+	var due []*capture
+	remaining := p.captures[:0]
+	for _, c := range p.captures {
+		c.rounds++
+		if c.rounds < c.dueRounds {
+			remaining = append(remaining, c)
+			continue
+		}
+		due = append(due, c)
+	}
+	p.captures = remaining
+	p.captureMtx.Unlock()
+
+	for _, c := range due {
+		if len(c.samples) == 0 {
+			c.done <- captureResult{err: ErrNoSamples}
+			continue
+		}
+		prof, err := p.convert(ctx, c.pid, &c.pendingProfile)
+		c.done <- captureResult{prof: prof, err: err}
+	}
+}
+
+// writeProfiles converts and writes the given profiles, and the aggregates of
+// profiles, in parallel, so that the profiles of hundreds of processes are
+// written well within a round. It returns the errors by PID.
+func (p *CPU) writeProfiles(ctx context.Context, due map[int]*pendingProfile, aggregates map[aggregationKey]map[int]*pendingProfile) map[int]error {
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		errs = make(map[int]error, len(due))
+	)
+	run := func(write func(ctx context.Context) map[int]error) {
+		if err := p.conversionTokens.Acquire(ctx, 1); err != nil {
+			// The profiler is stopping.
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer p.conversionTokens.Release(1)
+
+			ctx := ctx
+			if p.conversionTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, p.conversionTimeout)
+				defer cancel()
+			}
+			start := time.Now()
+			res := write(ctx)
+			p.metrics.conversionDuration.Observe(time.Since(start).Seconds())
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			for pid, err := range res {
+				errs[pid] = err
+			}
+		}()
+	}
+
+	for pid, pending := range due {
+		pid, pending := pid, pending
+		run(func(ctx context.Context) map[int]error {
+			return map[int]error{pid: p.writeProfile(ctx, pid, pending)}
+		})
+	}
+	for _, pendings := range aggregates {
+		pendings := pendings
+		run(func(ctx context.Context) map[int]error {
+			return p.writeAggregatedProfile(ctx, pendings)
+		})
+	}
+	wg.Wait()
+	return errs
+}
+
+// writeProfile converts a pending profile and writes it, as one profile per
+// time bucket when rounds are cut into time buckets.
+func (p *CPU) writeProfile(ctx context.Context, pid int, pending *pendingProfile) error {
+	if len(pending.buckets) > 0 {
+		var lastErr error
+		for _, bucket := range pending.buckets {
+			bucket.info = pending.info
+			bucket.labelSet = pending.labelSet
+			if err := p.writeProfile(ctx, pid, bucket); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	pprof, err := p.convert(ctx, pid, pending)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to convert profile to pprof", "pid", pid, "err", err)
+		p.events.Record(pid, lifecycle.ConversionError, "", err)
+		return err
+	}
+
+	// Add the profiler name as a label.
+	// Uses labels.Merge under the hood, so it re-allocates the label set.
+	// If we want to drop/disable a profiler, we should do it with another mechanism besides relabelling.
+	labelSet := labels.WithProfilerName(pending.labelSet, p.Name())
+	if ratio := lostSamplesRatio(pending.samples, pending.lostSamples); ratio != "" {
+		labelSet[lostSamplesRatioLabel] = model.LabelValue(ratio)
+	}
+
+	ctx, span := p.tracer.Start(ctx, "CPU.writeProfile", trace.WithAttributes(attribute.Int("pid", pid)))
+	defer span.End()
+
+	if err := p.profileWriter.Write(ctx, labelSet, pprof); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to write profile", "pid", pid, "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		p.events.Record(pid, lifecycle.ProfileWriteError, "", err)
+		return err
+	}
+	p.events.RecordOnce(pid, lifecycle.ProfileWritten, "")
+	return nil
+}
+
+// lostSamplesRatio returns the share of the samples of a profile that were
+// lost, rounded to two decimals to keep the number of series low, or an
+// empty string if it rounds to zero.
+func lostSamplesRatio(samples []profile.RawSample, lost uint64) string {
+	if lost == 0 {
+		return ""
+	}
+	total := lost
+	for _, s := range samples {
+		total += s.Value
+	}
+	ratio := strconv.FormatFloat(float64(lost)/float64(total), 'f', 2, 64)
+	if ratio == "0.00" {
+		return ""
+	}
+	return ratio
+}
+
+// aggregationKey identifies the profiles that can be aggregated: the ones of
+// processes running the same executable, with the same labels other than
+// their PIDs, which include their cgroup by default.
+type aggregationKey struct {
+	buildID     string
+	fingerprint model.Fingerprint
+}
+
+// Labels that differ between the processes of an aggregated profile.
+var perProcessLabels = []model.LabelName{"pid", "ppid"}
+
+// newAggregationKey returns the aggregation key of a profile, if its
+// executable has a build ID.
+func newAggregationKey(pending *pendingProfile) (aggregationKey, bool) {
+	buildID := pending.info.Mappings.ExecutableBuildID()
+	if buildID == "" {
+		return aggregationKey{}, false
+	}
+	return aggregationKey{
+		buildID:     buildID,
+		fingerprint: withoutPerProcessLabels(pending.labelSet).Fingerprint(),
+	}, true
+}
+
+func withoutPerProcessLabels(labelSet model.LabelSet) model.LabelSet {
+	res := labelSet.Clone()
+	for _, name := range perProcessLabels {
+		delete(res, name)
+	}
+	return res
+}
+
+// writeAggregatedProfile merges the profiles of processes with the same
+// aggregation key and writes them as a single one, without the labels that
+// differ between the processes. It returns the errors by PID.
+func (p *CPU) writeAggregatedProfile(ctx context.Context, pendings map[int]*pendingProfile) map[int]error {
+	errs := map[int]error{}
+	if len(pendings) == 1 {
+		for pid, pending := range pendings {
+			errs[pid] = p.writeProfile(ctx, pid, pending)
+		}
+		return errs
+	}
+
+	var (
+		profs    = make([]*pprofprofile.Profile, 0, len(pendings))
+		pids     = make([]int, 0, len(pendings))
+		labelSet model.LabelSet
+		samples  []profile.RawSample
+		lost     uint64
+	)
+	for pid, pending := range pendings {
+		prof, err := p.convert(ctx, pid, pending)
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to convert profile to pprof", "pid", pid, "err", err)
+			p.events.Record(pid, lifecycle.ConversionError, "", err)
+			errs[pid] = err
+			continue
+		}
+		profs = append(profs, prof)
+		pids = append(pids, pid)
+		labelSet = pending.labelSet
+		samples = append(samples, pending.samples...)
+		lost += pending.lostSamples
+	}
+	if len(profs) == 0 {
+		return errs
+	}
+
+	merged, err := pprofprofile.Merge(profs)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to merge profiles", "pids", fmt.Sprint(pids), "err", err)
+		for _, pid := range pids {
+			errs[pid] = err
+		}
+		return errs
+	}
+
+	labelSet = labels.WithProfilerName(withoutPerProcessLabels(labelSet), p.Name())
+	if ratio := lostSamplesRatio(samples, lost); ratio != "" {
+		labelSet[lostSamplesRatioLabel] = model.LabelValue(ratio)
+	}
+	ctx, span := p.tracer.Start(ctx, "CPU.writeAggregatedProfile", trace.WithAttributes(attribute.IntSlice("pids", pids)))
+	defer span.End()
+
+	err = p.profileWriter.Write(ctx, labelSet, merged)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to write profile", "pids", fmt.Sprint(pids), "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	for _, pid := range pids {
+		if err != nil {
+			p.events.Record(pid, lifecycle.ProfileWriteError, "aggregated", err)
+		} else {
+			p.events.RecordOnce(pid, lifecycle.ProfileWritten, "aggregated")
+		}
+		errs[pid] = err
+	}
+	return errs
+}
+
+// convert converts the samples of a pending profile to pprof. Their values
+// are the CPU time they stand for, in nanoseconds.
+func (p *CPU) convert(ctx context.Context, pid int, pending *pendingProfile) (*pprofprofile.Profile, error) {
+	ctx, span := p.tracer.Start(ctx, "CPU.convert", trace.WithAttributes(attribute.Int("pid", pid), attribute.Int("samples", len(pending.samples))))
+	defer span.End()
+
+	prof, err := pprof.NewConverter(
+		p.logger,
+		pprof.ConverterOptions{
+			AddressNormalizer:       p.addressNormalizer,
+			Ksym:                    p.ksym,
+			VDSOSymbolizer:          p.vdsoSymbolizer,
+			LocalSymbolizer:         p.localSymbolizer,
+			PerfMapCache:            p.perfMapCache,
+			JitdumpCache:            p.jitdumpCache,
+			Metrics:                 p.converterMetrics,
+			Coverage:                p.symbolizationCoverage,
+			DisableJITSymbolization: p.disableJITSymbolization,
+			Demangler:               p.demangler,
+			UnknownFrames:           p.unknownFrames,
+		},
+
+		pid,
+		pending.info.PIDFD,
+		pending.info.Mappings,
+		pending.startedAt,
+		pending.periodNS,
+	).Convert(ctx, pending.samples)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	prof.SampleType = []*pprofprofile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}
+	if pending.duration > 0 {
+		prof.DurationNanos = int64(pending.duration)
+	}
+	return prof, nil
+}
+
+// watchCgroups keeps the cgroup filter up to date with the cgroups of the
+// processes being profiled.
+func (p *CPU) watchCgroups(ctx context.Context, pfs procfs.FS, mountpoint string) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p.updateCgroupFilter(ctx, pfs, mountpoint)
+	}
+}
+
+// updateCgroupFilter makes the BPF program only sample the cgroups of the
+// processes kept after relabeling. The samples of the processes dropped are
+// then never copied to userspace, unless they share a cgroup with a process
+// that is kept. Processes started in new cgroups are not sampled until the
+// next update.
+func (p *CPU) updateCgroupFilter(ctx context.Context, pfs procfs.FS, mountpoint string) {
+	procs, err := pfs.AllProcs()
+	if err != nil {
+		level.Error(p.logger).Log("msg", "failed to list processes", "err", err)
+		return
+	}
+
+	ids := map[uint64]struct{}{}
+	for _, proc := range procs {
+		labelSet, err := p.cgroupFilter.LabelSet(ctx, proc.PID)
+		// Processes whose labels can't be read are kept, the error may be
+		// transient.
+		if err == nil && len(labelSet) == 0 {
+			continue
+		}
+
+		_, path, err := cgroup.Paths(proc.PID)
+		if err != nil {
+			// The process has most likely exited.
+			level.Debug(p.logger).Log("msg", "failed to read cgroup of process", "pid", proc.PID, "err", err)
+			continue
+		}
+		id, err := cgroup.ID(filepath.Join(mountpoint, path))
+		if err != nil {
+			level.Debug(p.logger).Log("msg", "failed to get cgroup ID of process", "pid", proc.PID, "err", err)
+			continue
+		}
+		ids[id] = struct{}{}
 	}
+
+	if err := p.bpfMaps.setProfiledCgroups(ids); err != nil {
+		level.Error(p.logger).Log("msg", "failed to update cgroup filter", "err", err)
+	}
+	p.metrics.profiledCgroups.Set(float64(len(p.bpfMaps.profiledCgroups)))
 }
 
 // TODO(kakkoyun): Combine with process information discovery.
@@ -720,11 +2008,29 @@ type (
 	// https://dave.cheney.net/2015/10/09/padding-is-hard
 	// TODO(https://github.com/parca-dev/parca-agent/issues/207)
 	stackCountKey struct {
-		PID              int32
-		TGID             int32
-		UserStackID      int32
-		KernelStackID    int32
-		UserStackIDDWARF int32
+		PID                int32
+		TGID               int32
+		UserStackID        int32
+		KernelStackID      int32
+		UserStackIDDWARF   int32
+		InterpreterStackID int32
+		// Set for Go processes when goroutine labels are enabled.
+		GoroutineID         uint64
+		GoroutineStatus     uint32
+		GoroutineWaitReason uint32
+		// Set when trace context labels are enabled and a span is active
+		// on the thread.
+		TraceID [16]byte
+		SpanID  [8]byte
+		// Set when CPU or NUMA node labels are enabled.
+		CPU      uint32
+		NUMANode uint32
+		// Zero for the CPU clock, the index of the hardware event in
+		// perfEvents plus one otherwise.
+		Event uint32
+		// Non-zero when the DWARF walked user stack was cut at the maximum
+		// stack depth.
+		Truncated uint32
 	}
 )
 
@@ -732,15 +2038,169 @@ func (s *stackCountKey) walkedWithDwarf() bool {
 	return s.UserStackIDDWARF != 0
 }
 
-// obtainProfiles collects profiles from the BPF maps.
-func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
-	rawData := map[int32]map[combinedStack]uint64{}
+// obtainRawData collects profiles from the BPF maps, one per time bucket of the
+// round.
+func (p *CPU) obtainRawData(ctx context.Context) ([]rawDataBucket, error) {
+	ctx, span := p.tracer.Start(ctx, "CPU.obtainRawData")
+	defer span.End()
 
+	if err := p.closeTimeBucket(ctx); err != nil {
+		return nil, err
+	}
+	closed := p.closedTimeBuckets
+	p.closedTimeBuckets = nil
+
+	symbolizedInterpreterStacks := make([]map[interpreterStackKey][]profile.InterpreterFrame, len(closed))
+	// Before finalizing, which forgets the processes that exited.
+	goRuntimes := map[int32]*goruntime.Info{}
+	for i, bucket := range closed {
+		symbolizedInterpreterStacks[i] = p.symbolizeInterpreterStacks(bucket.interpreterStacks)
+		for pid := range bucket.rawData {
+			if _, ok := goRuntimes[pid]; ok {
+				continue
+			}
+			if info := p.bpfMaps.processGoRuntime(int(pid)); info != nil {
+				goRuntimes[pid] = info
+			}
+		}
+	}
+
+	lostSamples, err := p.bpfMaps.readLostSamples()
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to read lost samples", "err", err)
+	}
+	p.reportUnwindFailures(ctx)
+
+	if err := p.bpfMaps.finalizeProfileLoop(); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to clean BPF maps that store stacktraces", "err", err)
+	}
+
+	var bootTime int64
+	if p.sampleTimestamps {
+		var err error
+		if bootTime, err = monotonicClockStart(); err != nil {
+			level.Warn(p.logger).Log("msg", "failed to read the monotonic clock", "err", err)
+		}
+	}
+
+	res := make([]rawDataBucket, 0, len(closed))
+	for i, bucket := range closed {
+		rawData := preprocessRawData(bucket.rawData, symbolizedInterpreterStacks[i], goRuntimes, bootTime)
+		// The samples lost aren't counted by time bucket, they are
+		// attributed to the last one.
+		if i == len(closed)-1 {
+			for j := range rawData {
+				rawData[j].LostSamples = lostSamples[int32(rawData[j].PID)]
+			}
+		}
+		res = append(res, rawDataBucket{start: bucket.start, end: bucket.end, rawData: rawData})
+	}
+	for _, lost := range lostSamples {
+		p.metrics.lostSamples.Add(float64(lost))
+	}
+	return res, nil
+}
+
+// reportUnwindFailures records the failures of the DWARF unwinder sampled by
+// the BPF program since it was last called, by the binary they happened in.
+func (p *CPU) reportUnwindFailures(ctx context.Context) {
+	failures, err := p.bpfMaps.readUnwindFailures()
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to read unwind failures", "err", err)
+	}
+	if len(failures) == 0 {
+		return
+	}
+
+	now := time.Now()
+	res := make([]profiler.UnwindFailure, 0, len(failures))
+	for f, count := range failures {
+		reason := "unknown"
+		if int(f.Reason) < len(unwindFailureReasons) {
+			reason = unwindFailureReasons[f.Reason]
+		}
+		failure := profiler.UnwindFailure{
+			PID:     int(f.PID),
+			File:    "[unknown]",
+			Address: f.PC,
+			Reason:  reason,
+			Count:   count,
+			Time:    now,
+		}
+		// The process may have exited since, then the binary is unknown.
+		if pi, err := p.processInfoManager.Info(ctx, int(f.PID)); err == nil {
+			if m := pi.Mappings.MappingForAddr(f.PC); m != nil {
+				failure.BuildID = m.BuildID
+				if m.Pathname != "" {
+					failure.File = m.Pathname
+				}
+				if addr, err := m.Normalize(f.PC); err == nil {
+					failure.Address = addr
+				}
+			}
+		}
+		level.Debug(p.logger).Log("msg", "unwinder failed", "pid", failure.PID, "file", failure.File, "build_id", failure.BuildID, "address", fmt.Sprintf("%x", failure.Address), "reason", reason, "count", count)
+		res = append(res, failure)
+	}
+	p.unwindFailures.Record(res)
+}
+
+// closeTimeBucket reads the samples of the time bucket that just ended, along
+// with the ones flushed during it, and clears the maps storing stacks for the
+// next one.
+func (p *CPU) closeTimeBucket(ctx context.Context) error {
+	rawData, interpreterStacks := p.flushedRawData, p.flushedInterpreterStacks
+	p.flushedRawData, p.flushedInterpreterStacks = nil, nil
+	if rawData == nil {
+		rawData = map[int32]map[sampleKey]sampleValue{}
+		interpreterStacks = map[interpreterStackKey][]uint64{}
+	}
+
+	if err := p.readStacks(ctx, rawData, interpreterStacks); err != nil {
+		// The samples are read again at the end of the next time bucket.
+		return err
+	}
+
+	now := time.Now()
+	p.closedTimeBuckets = append(p.closedTimeBuckets, timeBucket{
+		start:             p.timeBucketStart,
+		end:               now,
+		rawData:           rawData,
+		interpreterStacks: interpreterStacks,
+	})
+	p.timeBucketStart = now
+	if p.timeBuckets <= 1 {
+		// The maps are cleaned once the round is finalized.
+		return nil
+	}
+	return p.bpfMaps.cleanStacks()
+}
+
+// flushStacks reads the samples stored so far in the round and clears the
+// maps storing stacks to make room for new ones. The samples read are added
+// to the ones of the end of the round.
+func (p *CPU) flushStacks(ctx context.Context) error {
+	if p.flushedRawData == nil {
+		p.flushedRawData = map[int32]map[sampleKey]sampleValue{}
+		p.flushedInterpreterStacks = map[interpreterStackKey][]uint64{}
+	}
+	if err := p.readStacks(ctx, p.flushedRawData, p.flushedInterpreterStacks); err != nil {
+		// The samples are read again at the end of the round.
+		p.flushedRawData, p.flushedInterpreterStacks = nil, nil
+		return err
+	}
+	p.metrics.stackMapsFlushes.Inc()
+	return p.bpfMaps.cleanStacks()
+}
+
+// readStacks reads the samples in the maps storing stacks, and adds them to
+// the given ones.
+func (p *CPU) readStacks(ctx context.Context, rawData map[int32]map[sampleKey]sampleValue, interpreterStacks map[interpreterStackKey][]uint64) error {
 	it := p.bpfMaps.stackCounts.Iterator()
 	for it.Next() {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return ctx.Err()
 		default:
 		}
 
@@ -753,7 +2213,7 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 		// See the comment in stackCountKey for more details.
 		if err := binary.Read(bytes.NewBuffer(keyBytes), p.byteOrder, &key); err != nil {
 			p.metrics.stackDrop.WithLabelValues(labelStackDropReasonKey).Inc()
-			return nil, fmt.Errorf("read stack count key: %w", err)
+			return fmt.Errorf("read stack count key: %w", err)
 		}
 
 		pid := key.PID
@@ -770,7 +2230,7 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 				p.metrics.stackDrop.WithLabelValues(labelStackDropReasonUserDWARF).Inc()
 				if errors.Is(userErr, errUnrecoverable) {
 					p.metrics.readMapAttempts.WithLabelValues(labelUser, labelDwarfUnwind, labelError).Inc()
-					return nil, userErr
+					return userErr
 				}
 				if errors.Is(userErr, errUnwindFailed) {
 					p.metrics.readMapAttempts.WithLabelValues(labelUser, labelDwarfUnwind, labelFailed).Inc()
@@ -788,7 +2248,7 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 				p.metrics.stackDrop.WithLabelValues(labelStackDropReasonUserFramePointer).Inc()
 				if errors.Is(userErr, errUnrecoverable) {
 					p.metrics.readMapAttempts.WithLabelValues(labelUser, labelKernelUnwind, labelError).Inc()
-					return nil, userErr
+					return userErr
 				}
 				if errors.Is(userErr, errUnwindFailed) {
 					p.metrics.readMapAttempts.WithLabelValues(labelUser, labelKernelUnwind, labelFailed).Inc()
@@ -806,7 +2266,7 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 			p.metrics.stackDrop.WithLabelValues(labelStackDropReasonKernel).Inc()
 			if errors.Is(kernelErr, errUnrecoverable) {
 				p.metrics.readMapAttempts.WithLabelValues(labelKernel, labelKernelUnwind, labelError).Inc()
-				return nil, kernelErr
+				return kernelErr
 			}
 			if errors.Is(kernelErr, errUnwindFailed) {
 				p.metrics.readMapAttempts.WithLabelValues(labelKernel, labelKernelUnwind, labelFailed).Inc()
@@ -824,10 +2284,26 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 			continue
 		}
 
+		interpreterStackID := key.InterpreterStackID
+		interpreterKey := interpreterStackKey{pid: pid, id: interpreterStackID}
+		if _, ok := interpreterStacks[interpreterKey]; interpreterStackID != 0 && !ok {
+			frames, err := p.bpfMaps.readInterpreterStack(interpreterStackID)
+			if err != nil {
+				p.metrics.stackDrop.WithLabelValues(labelStackDropReasonInterpreter).Inc()
+				if errors.Is(err, errUnrecoverable) {
+					return err
+				}
+				// Keep the native stacks of the sample.
+				interpreterStackID = 0
+			} else {
+				interpreterStacks[interpreterKey] = frames
+			}
+		}
+
 		value, err := p.bpfMaps.readStackCount(keyBytes)
 		if err != nil {
 			p.metrics.stackDrop.WithLabelValues(labelStackDropReasonCount).Inc()
-			return nil, fmt.Errorf("read value: %w", err)
+			return fmt.Errorf("read value: %w", err)
 		}
 		if value == 0 {
 			p.metrics.stackDrop.WithLabelValues(labelStackDropReasonZeroCount).Inc()
@@ -836,33 +2312,150 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 			continue
 		}
 
+		if info := p.bpfMaps.processInterpreter(int(pid)); info != nil {
+			status := labelSuccess
+			if interpreterStackID == 0 {
+				status = labelEmpty
+			}
+			p.metrics.runtimeUnwind.WithLabelValues(string(process.RuntimeOfInterpreter(info.Type)), status).Add(float64(value))
+		}
+
 		perProcessData, ok := rawData[pid]
 		if !ok {
 			// We haven't seen this id yet.
-			perProcessData = map[combinedStack]uint64{}
+			perProcessData = map[sampleKey]sampleValue{}
 			rawData[pid] = perProcessData
 		}
 
-		perProcessData[stack] += value
+		sk := sampleKey{
+			stack:              stack,
+			interpreterStackID: interpreterStackID,
+			goroutine: goroutine{
+				id:         key.GoroutineID,
+				status:     key.GoroutineStatus,
+				waitReason: key.GoroutineWaitReason,
+			},
+			traceID: key.TraceID,
+			spanID:  key.SpanID,
+			location: sampleLocation{
+				cpu:         key.CPU,
+				numaNode:    key.NUMANode,
+				hasCPU:      p.cpuLabels,
+				hasNUMANode: p.numaNodeLabels,
+			},
+			event: key.Event,
+			// Stacks walked with frame pointers are cut by the size of the
+			// stack traces map without telling, so the ones filling it are
+			// considered truncated.
+			truncated: key.Truncated != 0 || userFrames(&stack) >= int(p.maxStackDepth),
+		}
+		sv := perProcessData[sk]
+		sv.count += value
+		if p.sampleTimestamps {
+			timestamps, err := p.bpfMaps.readStackTimestamps(keyBytes)
+			if err != nil {
+				level.Debug(p.logger).Log("msg", "failed to read sample timestamps", "err", err)
+			}
+			sv.timestamps = append(sv.timestamps, timestamps...)
+		}
+		perProcessData[sk] = sv
 	}
 	if it.Err() != nil {
 		p.metrics.stackDrop.WithLabelValues(labelStackDropReasonIterator).Inc()
-		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+		return fmt.Errorf("failed iterator: %w", it.Err())
 	}
+	return nil
+}
 
-	if err := p.bpfMaps.finalizeProfileLoop(); err != nil {
-		level.Warn(p.logger).Log("msg", "failed to clean BPF maps that store stacktraces", "err", err)
+// monotonicClockStart returns the Unix time in nanoseconds the monotonic
+// clock, which the BPF program timestamps samples with, started at.
+func monotonicClockStart() (int64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
 	}
+	return time.Now().UnixNano() - ts.Nano(), nil
+}
 
-	return preprocessRawData(rawData), nil
+// symbolizeInterpreterStacks decodes the frames of the interpreter stacks,
+// which depends on the interpreter of their process. It must be called after
+// reading the stacks, so all the symbols they reference are stored.
+func (p *CPU) symbolizeInterpreterStacks(stacks map[interpreterStackKey][]uint64) map[interpreterStackKey][]profile.InterpreterFrame {
+	res := make(map[interpreterStackKey][]profile.InterpreterFrame, len(stacks))
+
+	var symbols map[uint32]profile.Function
+	v8Symbolizers := map[int32]*interpreter.V8Symbolizer{}
+	defer func() {
+		for _, s := range v8Symbolizers {
+			if s != nil {
+				s.Close()
+			}
+		}
+	}()
+
+	for key, frames := range stacks {
+		info := p.bpfMaps.processInterpreter(int(key.pid))
+		if info == nil {
+			// The process exited in the meantime.
+			continue
+		}
+
+		switch info.Type {
+		case interpreter.TypeV8:
+			s, ok := v8Symbolizers[key.pid]
+			if !ok {
+				var err error
+				s, err = interpreter.NewV8Symbolizer(int(key.pid), info)
+				if err != nil {
+					level.Debug(p.logger).Log("msg", "failed to read the V8 heap", "pid", key.pid, "err", err)
+				}
+				v8Symbolizers[key.pid] = s
+			}
+			if s != nil {
+				res[key] = s.Frames(frames)
+			}
+		default:
+			if symbols == nil {
+				var err error
+				symbols, err = p.bpfMaps.readInterpreterSymbols()
+				if err != nil {
+					level.Warn(p.logger).Log("msg", "failed to read interpreter symbols", "err", err)
+				}
+				if symbols == nil {
+					symbols = map[uint32]profile.Function{}
+				}
+			}
+			res[key] = decodeInterpreterFrames(frames, symbols)
+		}
+	}
+	return res
+}
+
+// userFrames returns the number of frames of the user stack of the given
+// stack.
+func userFrames(stack *combinedStack) int {
+	n := 0
+	for _, addr := range stack[:stackDepth] {
+		if addr != 0 {
+			n++
+		}
+	}
+	return n
 }
 
 // preprocessRawData takes the raw data from the BPF maps and converts it into
 // a profile.RawData, which already splits the stacks into user and kernel
 // stacks. Since the input data is a map of maps, we can assume that they're
 // already unique and there are no duplicates, which is why at this point we
-// can just transform them into plain slices and structs.
-func preprocessRawData(rawData map[int32]map[combinedStack]uint64) profile.RawData {
+// can just transform them into plain slices and structs. The timestamps of
+// the samples are converted to Unix times given the one the monotonic clock
+// started at.
+func preprocessRawData(
+	rawData map[int32]map[sampleKey]sampleValue,
+	interpreterStacks map[interpreterStackKey][]profile.InterpreterFrame,
+	goRuntimes map[int32]*goruntime.Info,
+	bootTime int64,
+) profile.RawData {
 	res := make(profile.RawData, 0, len(rawData))
 	for pid, perProcessRawData := range rawData {
 		p := profile.ProcessRawData{
@@ -870,18 +2463,14 @@ func preprocessRawData(rawData map[int32]map[combinedStack]uint64) profile.RawDa
 			RawSamples: make([]profile.RawSample, 0, len(perProcessRawData)),
 		}
 
-		for stack, count := range perProcessRawData {
+		for key, value := range perProcessRawData {
+			stack := key.stack
 			kernelStackDepth := 0
-			userStackDepth := 0
 
 			// We count the number of kernel and user frames in the stack to be
 			// able to preallocate. If an address in the stack is 0 then the
 			// stack ended.
-			for _, addr := range stack[:stackDepth] {
-				if addr != 0 {
-					userStackDepth++
-				}
-			}
+			userStackDepth := userFrames(&stack)
 			for _, addr := range stack[stackDepth:] {
 				if addr != 0 {
 					kernelStackDepth++
@@ -894,11 +2483,68 @@ func preprocessRawData(rawData map[int32]map[combinedStack]uint64) profile.RawDa
 			copy(userStack, stack[:userStackDepth])
 			copy(kernelStack, stack[stackDepth:stackDepth+kernelStackDepth])
 
-			p.RawSamples = append(p.RawSamples, profile.RawSample{
-				UserStack:   userStack,
-				KernelStack: kernelStack,
-				Value:       count,
-			})
+			var interpreterStack []profile.InterpreterFrame
+			if frames := interpreterStacks[interpreterStackKey{pid: pid, id: key.interpreterStackID}]; len(frames) > 0 {
+				// Each sample gets its own copy, as the native frames they
+				// are interleaved with differ.
+				interpreterStack = make([]profile.InterpreterFrame, len(frames))
+				copy(interpreterStack, frames)
+			}
+
+			var labels map[string]string
+			if g := key.goroutine; g.id != 0 {
+				if info, ok := goRuntimes[pid]; ok {
+					labels = info.Labels(g.id, g.status, g.waitReason)
+				}
+			}
+			if key.traceID != [16]byte{} {
+				if labels == nil {
+					labels = map[string]string{}
+				}
+				for k, v := range tracecontext.Labels(key.traceID, key.spanID) {
+					labels[k] = v
+				}
+			}
+			if loc := key.location; loc.hasCPU || loc.hasNUMANode {
+				if labels == nil {
+					labels = map[string]string{}
+				}
+				if loc.hasCPU {
+					labels[cpuLabel] = strconv.FormatUint(uint64(loc.cpu), 10)
+				}
+				if loc.hasNUMANode {
+					labels[numaNodeLabel] = strconv.FormatUint(uint64(loc.numaNode), 10)
+				}
+			}
+
+			var timestamps []int64
+			if len(value.timestamps) > 0 {
+				timestamps = make([]int64, len(value.timestamps))
+				for i, t := range value.timestamps {
+					timestamps[i] = bootTime + int64(t)
+				}
+				// The samples of the different threads are interleaved.
+				sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+			}
+
+			sample := profile.RawSample{
+				UserStack:        userStack,
+				KernelStack:      kernelStack,
+				InterpreterStack: interpreterStack,
+				Labels:           labels,
+				Timestamps:       timestamps,
+				Value:            value.count,
+				Truncated:        key.truncated,
+			}
+			if key.event == 0 {
+				p.RawSamples = append(p.RawSamples, sample)
+				continue
+			}
+			if p.PerfEventSamples == nil {
+				p.PerfEventSamples = map[int][]profile.RawSample{}
+			}
+			i := int(key.event) - 1
+			p.PerfEventSamples[i] = append(p.PerfEventSamples[i], sample)
 		}
 
 		res = append(res, p)
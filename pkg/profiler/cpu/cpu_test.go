@@ -12,18 +12,30 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package cpu
 
 import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	bpf "github.com/aquasecurity/libbpfgo"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 
 	"github.com/parca-dev/parca-agent/pkg/logger"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/profile"
 )
 
 // The intent of these tests is to ensure that libbpfgo behaves the
@@ -36,7 +48,15 @@ func SetUpBpfProgram(t *testing.T) (*bpf.Module, error) {
 	logger := logger.NewLogger("debug", logger.LogFormatLogfmt, "parca-cpu-test")
 
 	memLock := uint64(1200 * 1024 * 1024) // ~1.2GiB
-	m, _, err := loadBpfProgram(logger, prometheus.NewRegistry(), true, true, true, memLock)
+	m, _, err := loadBpfProgram(logger, prometheus.NewRegistry(), Config{
+		FilterProcesses:   true,
+		VerboseLogging:    true,
+		MixedStackWalking: true,
+		SampleTimestamps:  true,
+		CPULabels:         true,
+		NUMANodeLabels:    true,
+		MaxStackDepth:     DefaultStackDepth,
+	}, memLock, "", 64)
 	require.NoError(t, err)
 	require.NotNil(t, m)
 
@@ -170,3 +190,236 @@ func TestGetValueAndDeleteBatchExactElements(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, len(values))
 }
+
+func TestAccumulate(t *testing.T) {
+	p := &CPU{
+		mtx:               &sync.RWMutex{},
+		profilingDuration: 10 * time.Second,
+		pending:           map[int]*pendingProfile{},
+	}
+	sample := profile.RawSample{UserStack: []uint64{0x1000}, Value: 1}
+	const period = int64(1_000_000_000 / 19)
+	start := time.Now()
+	bucket := rawDataBucket{start: start, end: start.Add(10 * time.Second)}
+
+	p.accumulate(1, &process.Info{}, nil, 0, period, bucket, []profile.RawSample{sample}, 0)
+	require.Equal(t, 1, p.pending[1].dueRounds)
+
+	// Rounded up to whole rounds.
+	p.accumulate(2, &process.Info{}, nil, 25*time.Second, period, bucket, []profile.RawSample{sample}, 1)
+	p.accumulate(2, &process.Info{}, nil, 25*time.Second, period, bucket, []profile.RawSample{sample, sample}, 2)
+	require.Equal(t, 3, p.pending[2].dueRounds)
+	require.Len(t, p.pending[2].samples, 3)
+	require.Equal(t, uint64(3), p.pending[2].lostSamples)
+	require.Empty(t, p.pending[2].buckets)
+
+	// Samples taken at another frequency are in the same profile.
+	p.accumulate(2, &process.Info{}, nil, 25*time.Second, 2*period, bucket, []profile.RawSample{sample}, 0)
+	require.Len(t, p.pending[2].samples, 4)
+	require.Equal(t, 2*period, p.pending[2].periodNS)
+
+	// Cut into time buckets.
+	p.timeBuckets = 10
+	second := rawDataBucket{start: start, end: start.Add(time.Second)}
+	p.accumulate(3, &process.Info{}, nil, 0, period, second, []profile.RawSample{sample}, 0)
+	second = rawDataBucket{start: second.end, end: second.end.Add(time.Second)}
+	p.accumulate(3, &process.Info{}, nil, 0, period, second, []profile.RawSample{sample, sample}, 1)
+	require.Equal(t, start, p.pending[3].startedAt)
+	require.Len(t, p.pending[3].samples, 3)
+	require.Len(t, p.pending[3].buckets, 2)
+	require.Equal(t, start.Add(time.Second), p.pending[3].buckets[1].startedAt)
+	require.Equal(t, time.Second, p.pending[3].buckets[1].duration)
+	require.Len(t, p.pending[3].buckets[1].samples, 2)
+	require.Equal(t, uint64(1), p.pending[3].buckets[1].lostSamples)
+}
+
+func TestLostSamplesRatio(t *testing.T) {
+	samples := []profile.RawSample{{Value: 60}, {Value: 30}}
+
+	require.Equal(t, "", lostSamplesRatio(samples, 0))
+	require.Equal(t, "0.10", lostSamplesRatio(samples, 10))
+	// Rounds to zero.
+	require.Equal(t, "", lostSamplesRatio([]profile.RawSample{{Value: 1000}}, 1))
+	require.Equal(t, "1.00", lostSamplesRatio(nil, 5))
+}
+
+func TestNewAggregationKey(t *testing.T) {
+	exec := procfs.ProcMapPermissions{Read: true, Execute: true}
+	pending := func(buildID, pid, cgroup string) *pendingProfile {
+		return &pendingProfile{
+			info: &process.Info{Mappings: process.Mappings{
+				{ProcMap: &procfs.ProcMap{Pathname: "/app", Perms: &exec}, BuildID: buildID},
+			}},
+			labelSet: model.LabelSet{"pid": model.LabelValue(pid), "ppid": "1", "cgroup": model.LabelValue(cgroup)},
+			periodNS: 1_000,
+		}
+	}
+
+	key, ok := newAggregationKey(pending("a", "10", "/ci"))
+	require.True(t, ok)
+	other, ok := newAggregationKey(pending("a", "11", "/ci"))
+	require.True(t, ok)
+	require.Equal(t, key, other)
+
+	other, _ = newAggregationKey(pending("b", "10", "/ci"))
+	require.NotEqual(t, key, other)
+	other, _ = newAggregationKey(pending("a", "10", "/cgi"))
+	require.NotEqual(t, key, other)
+
+	_, ok = newAggregationKey(pending("", "10", "/ci"))
+	require.False(t, ok)
+}
+
+func TestPreprocessRawDataTimestamps(t *testing.T) {
+	var stack combinedStack
+	stack[0] = 0x1000
+
+	rawData := map[int32]map[sampleKey]sampleValue{
+		1: {
+			{stack: stack}: {count: 3, timestamps: []uint64{300, 100, 200}},
+		},
+	}
+	res := preprocessRawData(rawData, nil, nil, 1_000)
+	require.Len(t, res, 1)
+	require.Len(t, res[0].RawSamples, 1)
+
+	sample := res[0].RawSamples[0]
+	require.Equal(t, uint64(3), sample.Value)
+	require.Equal(t, []uint64{0x1000}, sample.UserStack)
+	require.Equal(t, []int64{1_100, 1_200, 1_300}, sample.Timestamps)
+}
+
+func TestPreprocessRawDataLocation(t *testing.T) {
+	var stack combinedStack
+	stack[0] = 0x1000
+
+	rawData := map[int32]map[sampleKey]sampleValue{
+		1: {
+			{stack: stack, location: sampleLocation{cpu: 3, numaNode: 1, hasCPU: true, hasNUMANode: true}}: {count: 1},
+		},
+		2: {
+			{stack: stack, location: sampleLocation{numaNode: 0, hasNUMANode: true}}: {count: 1},
+		},
+		3: {
+			{stack: stack}: {count: 1},
+		},
+	}
+	labels := map[profile.PID]map[string]string{}
+	for _, p := range preprocessRawData(rawData, nil, nil, 0) {
+		labels[p.PID] = p.RawSamples[0].Labels
+	}
+	require.Equal(t, map[string]string{"cpu": "3", "numa_node": "1"}, labels[1])
+	require.Equal(t, map[string]string{"numa_node": "0"}, labels[2])
+	require.Nil(t, labels[3])
+}
+
+func TestPreprocessRawDataPerfEvents(t *testing.T) {
+	var stack combinedStack
+	stack[0] = 0x1000
+
+	rawData := map[int32]map[sampleKey]sampleValue{
+		1: {
+			{stack: stack}:           {count: 2},
+			{stack: stack, event: 2}: {count: 5},
+		},
+	}
+	res := preprocessRawData(rawData, nil, nil, 0)
+	require.Len(t, res, 1)
+	require.Len(t, res[0].RawSamples, 1)
+	require.Equal(t, uint64(2), res[0].RawSamples[0].Value)
+
+	require.Len(t, res[0].PerfEventSamples, 1)
+	require.Len(t, res[0].PerfEventSamples[1], 1)
+	require.Equal(t, uint64(5), res[0].PerfEventSamples[1][0].Value)
+}
+
+func TestRingbufSize(t *testing.T) {
+	require.Equal(t, uint32(4096), ringbufSize(1, 4096, 1))
+	require.Equal(t, uint32(64*4096*8), ringbufSize(64, 4096, 8))
+	// Rounded up to a power of two.
+	require.Equal(t, uint32(64*4096*8), ringbufSize(64, 4096, 6))
+	require.Equal(t, uint32(4096), ringbufSize(0, 4096, 4))
+}
+
+// BenchmarkEventsBuffer samples every CPU at a high frequency while burning
+// CPU, and reports the rate of BPF events received and lost with each events
+// buffer.
+func BenchmarkEventsBuffer(b *testing.B) {
+	for _, eventsBuffer := range []string{EventsBufferPerf, EventsBufferRingbuf} {
+		eventsBuffer := eventsBuffer
+		b.Run(eventsBuffer, func(b *testing.B) {
+			ringbuf, err := useRingbuf(eventsBuffer)
+			if err != nil {
+				b.Skip(err)
+			}
+
+			logger := logger.NewLogger("error", logger.LogFormatLogfmt, "parca-cpu-test")
+			memLock := uint64(1200 * 1024 * 1024) // ~1.2GiB
+			m, _, err := loadBpfProgram(logger, prometheus.NewRegistry(), Config{EventsRingbuf: ringbuf, MaxStackDepth: DefaultStackDepth}, memLock, "", 64)
+			require.NoError(b, err)
+			b.Cleanup(m.Close)
+
+			prog, err := m.GetProgram(programName)
+			require.NoError(b, err)
+			for i := 0; i < runtime.NumCPU(); i++ {
+				fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
+					Type:   unix.PERF_TYPE_SOFTWARE,
+					Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+					Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+					Sample: 10_000,
+					Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+				}, -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
+				require.NoError(b, err)
+				_, err = prog.AttachPerfEvent(fd)
+				require.NoError(b, err)
+			}
+
+			var received, lost atomic.Uint64
+			eventsChan := make(chan []byte)
+			lostChan := make(chan uint64)
+			if ringbuf {
+				ringBuf, err := m.InitRingBuf(eventsRingbufMapName, eventsChan)
+				require.NoError(b, err)
+				ringBuf.Poll(250)
+			} else {
+				perfBuf, err := m.InitPerfBuf(eventsMapName, eventsChan, lostChan, 64)
+				require.NoError(b, err)
+				perfBuf.Poll(250)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-eventsChan:
+						received.Add(1)
+					case n := <-lostChan:
+						lost.Add(n)
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			start := time.Now()
+			var sum uint64
+			for i := 0; i < b.N; i++ {
+				for j := uint64(0); j < 1_000_000; j++ {
+					sum += j * j
+				}
+			}
+			elapsed := time.Since(start).Seconds()
+			b.StopTimer()
+			runtime.KeepAlive(sum)
+
+			if ringbuf {
+				stats, err := newBPFMetricsCollector(&CPU{logger: logger}, m, 0).readCounters()
+				require.NoError(b, err)
+				lost.Add(stats.EventsLost)
+			}
+			b.ReportMetric(float64(received.Load())/elapsed, "events/s")
+			b.ReportMetric(float64(lost.Load())/elapsed, "lost/s")
+		})
+	}
+}
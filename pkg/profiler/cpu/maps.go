@@ -12,6 +12,8 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package cpu
 
 import "C"
@@ -22,8 +24,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
+	"runtime"
 	"sort"
 	"sync"
 	"syscall"
@@ -41,14 +44,27 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/buildid"
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/executable"
+	"github.com/parca-dev/parca-agent/pkg/goruntime"
+	"github.com/parca-dev/parca-agent/pkg/interpreter"
+	"github.com/parca-dev/parca-agent/pkg/lifecycle"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/profile"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
+	"github.com/parca-dev/parca-agent/pkg/profiler/bpfmaps"
 	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
+	"github.com/parca-dev/parca-agent/pkg/tracecontext"
 )
 
 const (
-	debugPIDsMapName   = "debug_pids"
-	stackCountsMapName = "stack_counts"
-	stackTracesMapName = "stack_traces"
+	debugPIDsMapName       = "debug_pids"
+	cgroupFilterMapName    = "cgroup_filter"
+	stackCountsMapName     = "stack_counts"
+	stackTracesMapName     = "stack_traces"
+	stackTimestampsMapName = "stack_timestamps"
+	lostSamplesMapName     = "lost_samples"
+	unwindFailuresMapName  = "unwind_failures"
+	eventsMapName          = "events"
+	eventsRingbufMapName   = "events_ringbuf"
 
 	unwindInfoChunksMapName = "unwind_info_chunks"
 	dwarfStackTracesMapName = "dwarf_stack_traces"
@@ -57,13 +73,36 @@ const (
 	programsMapName         = "programs"
 	perCPUStatsMapName      = "percpu_stats"
 
+	interpreterInfoMapName        = "interpreter_info"
+	interpreterStackTracesMapName = "interpreter_stack_traces"
+	interpreterSymbolsMapName     = "interpreter_symbols"
+	goRuntimeInfoMapName          = "go_runtime_info"
+	traceContextInfoMapName       = "trace_context_info"
+	samplingInfoMapName           = "sampling_info"
+	unsymbolizablePIDsMapName     = "unsymbolizable_pids"
+	compatPIDsMapName             = "compat_pids"
+
 	// With the current compact rows, the max items we can store in the kernels
 	// we have tested is 262k per map, which we rounded it down to 250k.
 	maxUnwindShards       = 50         // How many unwind table shards we have.
 	maxUnwindTableSize    = 250 * 1000 // Always needs to be sync with MAX_UNWIND_TABLE_SIZE in the BPF program.
 	maxMappingsPerProcess = 250        // Always need to be in sync with MAX_MAPPINGS_PER_PROCESS.
 	maxUnwindTableChunks  = 30         // Always need to be in sync with MAX_UNWIND_TABLE_CHUNKS.
+	maxUnwindInfoLinks    = 4          // Always need to be in sync with MAX_UNWIND_INFO_CHAIN_LINKS.
 	maxProcesses          = 5000       // Always need to be in sync with MAX_PROCESSES.
+	maxStackCountsEntries = 10240      // Always need to be in sync with MAX_STACK_COUNTS_ENTRIES.
+	maxStackTracesEntries = 64000      // Always need to be in sync with MAX_STACK_TRACES_ENTRIES.
+	maxSampleTimestamps   = 64         // Always need to be in sync with MAX_SAMPLE_TIMESTAMPS.
+	maxCgroups            = 10000      // Size of the cgroup filter, which is resized in userspace only.
+
+	maxInterpreterStackDepth = 64    // Always need to be in sync with MAX_INTERPRETER_STACK_DEPTH.
+	maxInterpreterSymbols    = 10000 // Always need to be in sync with MAX_INTERPRETER_SYMBOLS.
+	// Interpreter symbols are cleaned when the map is this full, as they
+	// are not removed otherwise.
+	interpreterSymbolsCleanupThreshold = maxInterpreterSymbols * 9 / 10
+
+	interpreterFrameEntry      = 1 << 31    // Always need to be in sync with INTERPRETER_FRAME_ENTRY.
+	interpreterFrameLinenoMask = 0x7FFFFFFF // Always need to be in sync with INTERPRETER_FRAME_LINENO_MASK.
 
 	/*
 		TODO: once we generate the bindings automatically, remove this.
@@ -126,17 +165,59 @@ type unwinderStats struct {
 	ErrorShouldNeverHappen      uint64
 	ErrorPcNotCovered           uint64
 	ErrorUnsupportedJit         uint64
+	// Samples dropped because a map storing stacks was full.
+	StackCountsFull            uint64
+	StackTracesFull            uint64
+	DwarfStackTracesFull       uint64
+	InterpreterStackTracesFull uint64
+	EventsLost                 uint64
+	// Samples whose stack was read from the Last Branch Record, and the
+	// ones for which it was empty.
+	TotalLBR      uint64
+	ErrorLBREmpty uint64
+	// Samples of 32-bit processes, whose stacks aren't walked.
+	SkippedCompat uint64
+}
+
+// Why the DWARF unwinder failed, by the reason reported by the BPF program.
+// Always need to be in sync with enum unwind_failure_reason.
+var unwindFailureReasons = []string{
+	"pc_not_covered",
+	"unsupported_expression",
+	"unsupported_frame_pointer_action",
+	"unsupported_cfa_register",
+	"bogus_cfa",
+	"bogus_return_address",
+}
+
+// Must be in sync with unwind_failure_t.
+type unwindFailure struct {
+	PID    int32
+	Reason uint32
+	PC     uint64
+}
+
+// mapsFull returns the number of samples dropped because a map storing
+// stacks was full.
+func (s unwinderStats) mapsFull() uint64 {
+	return s.StackCountsFull + s.StackTracesFull + s.DwarfStackTracesFull + s.InterpreterStackTracesFull
 }
 
 const (
 	mappingTypeJitted  = 1
 	mappingTypeSpecial = 2
+	// Mappings without unwind information that are unwound using frame
+	// pointers in mixed-mode unwinding.
+	mappingTypeFramePointers = 3
 )
 
 const (
 	RequestUnwindInformation = 1 << 63
 	RequestProcessMappings   = 1 << 62
 	RequestRefreshProcInfo   = 1 << 61
+	ProcessExec              = 1 << 60
+	ProcessExit              = 1 << 59
+	LibraryLoaded            = 1 << 58
 )
 
 var (
@@ -147,34 +228,34 @@ var (
 	ErrNeedMoreProfilingRounds   = errors.New("not enough profiling rounds with this unwind info")
 )
 
-func clearBpfMap(bpfMap *bpf.BPFMap) error {
-	// BPF iterators need the previous value to iterate to the next, so we
-	// can only delete the "previous" item once we've already iterated to
-	// the next.
-
-	it := bpfMap.Iterator()
-	var prev []byte = nil
-	for it.Next() {
-		if prev != nil {
-			err := bpfMap.DeleteKey(unsafe.Pointer(&prev[0]))
-			if err != nil && !errors.Is(err, syscall.ENOENT) {
-				return fmt.Errorf("failed to delete map key: %w", err)
-			}
-		}
+type (
+	// interpreterInfo mirrors interpreter_info_t in the BPF program.
+	interpreterInfo struct {
+		Type           uint64
+		GlobalsAddress uint64
+		PHP            interpreter.PHPOffsets
+		V8             interpreter.V8Offsets
+	}
 
-		key := it.Key()
-		prev = make([]byte, len(key))
-		copy(prev, key)
+	// interpreterSymbol mirrors symbol_t in the BPF program.
+	interpreterSymbol struct {
+		ClassName    [32]byte
+		FunctionName [64]byte
+		Path         [128]byte
 	}
-	if prev != nil {
-		err := bpfMap.DeleteKey(unsafe.Pointer(&prev[0]))
-		if err != nil && !errors.Is(err, syscall.ENOENT) {
-			return fmt.Errorf("failed to delete map key: %w", err)
-		}
+
+	// interpreterStack mirrors interpreter_stack_t in the BPF program.
+	interpreterStack struct {
+		Len    uint64
+		Frames [maxInterpreterStackDepth]uint64
 	}
 
-	return nil
-}
+	// stackTimestamps mirrors sample_timestamps_t in the BPF program.
+	stackTimestamps struct {
+		Len   uint64
+		KTime [maxSampleTimestamps]uint64
+	}
+)
 
 type bpfMaps struct {
 	logger log.Logger
@@ -184,7 +265,14 @@ type bpfMaps struct {
 
 	debugPIDs *bpf.BPFMap
 
+	cgroupFilter *bpf.BPFMap
+	// Cgroup IDs in the cgroup filter.
+	profiledCgroups map[uint64]struct{}
+
 	stackCounts      *bpf.BPFMap
+	stackTimestamps  *bpf.BPFMap
+	lostSamples      *bpf.BPFMap
+	unwindFailures   *bpf.BPFMap
 	stackTraces      *bpf.BPFMap
 	dwarfStackTraces *bpf.BPFMap
 	processInfo      *bpf.BPFMap
@@ -193,10 +281,49 @@ type bpfMaps struct {
 	unwindTables *bpf.BPFMap
 	programs     *bpf.BPFMap
 
+	interpreterInfo        *bpf.BPFMap
+	interpreterStackTraces *bpf.BPFMap
+	interpreterSymbols     *bpf.BPFMap
+	// PIDs with their interpreter information in the BPF map.
+	interpreters map[int]*interpreter.Info
+
+	goRuntimeInfo *bpf.BPFMap
+	// PIDs with their Go runtime information in the BPF map.
+	goRuntimes map[int]*goruntime.Info
+
+	traceContextInfo *bpf.BPFMap
+	// PIDs with their trace context information in the BPF map.
+	traceContexts map[int]*tracecontext.Info
+
+	samplingInfo *bpf.BPFMap
+	// PIDs with the ratio of their samples kept by the BPF program, for the
+	// ones sampled at a lower frequency.
+	samplingRatios map[int]uint32
+
+	unsymbolizablePIDs *bpf.BPFMap
+	// PIDs the BPF program doesn't sample, as none of their binaries can be
+	// symbolized.
+	unsymbolizable map[int]struct{}
+
+	compatPIDs *bpf.BPFMap
+	// PIDs of the 32-bit processes the BPF program doesn't sample.
+	compat map[int]struct{}
+
 	// Unwind stuff 🔬
 	processCache      *processCache
 	mappingInfoMemory profiler.EfficientBuffer
-
+	// Optional, persists the generated unwind tables across restarts.
+	unwindTableCache *unwind.TableCache
+	// Optional, fetches precomputed unwind tables instead of generating them.
+	unwindTableFetcher *unwind.TableFetcher
+	metrics            *metrics
+	// Optional, records the unwind tables built for each process.
+	events *lifecycle.EventLog
+
+	// Unwind tables are keyed by the build ID of the executables rather than
+	// by process, so the processes running the same executables, such as the
+	// replicas of a container, share them. Their mappings point to a table by
+	// its executable ID, along with their own load address.
 	buildIDMapping map[string]uint64
 	// Which shard we are using
 	maxUnwindShards  uint64
@@ -229,6 +356,15 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
+// processMappings are the executable mappings of a process, along with the
+// mapping information written to the process information for each of them.
+// Only the mappings added since, such as the libraries loaded with dlopen(3)
+// or new JIT regions, have their executables read when it is refreshed.
+type processMappings struct {
+	mappings unwind.ExecutableMappings
+	written  map[unwind.ExecutableMapping][]byte
+}
+
 type processCache struct {
 	burrow.Cache
 	statsCounter *cache.BurrowStatsCounter
@@ -273,6 +409,13 @@ func initializeMaps(logger log.Logger, reg prometheus.Registerer, m *bpf.Module,
 		mappingInfoMemory: mappingInfoMemory,
 		unwindInfoMemory:  unwindInfoMemory,
 		buildIDMapping:    make(map[string]uint64),
+		interpreters:      make(map[int]*interpreter.Info),
+		goRuntimes:        make(map[int]*goruntime.Info),
+		traceContexts:     make(map[int]*tracecontext.Info),
+		samplingRatios:    make(map[int]uint32),
+		unsymbolizable:    make(map[int]struct{}),
+		compat:            make(map[int]struct{}),
+		profiledCgroups:   make(map[uint64]struct{}),
 		mutex:             sync.Mutex{},
 	}
 
@@ -288,10 +431,13 @@ func (m *bpfMaps) close() error {
 	return m.processCache.close()
 }
 
-// adjustMapSizes updates the amount of unwind shards.
+// adjustMapSizes updates the amount of unwind shards, sizes the stack traces
+// maps to the maximum stack depth, sizes the events ring buffer to the given
+// amount of pages per CPU, and sizes the maps of the optional features that
+// are enabled.
 //
 // Note: It must be called before `BPFLoadObject()`.
-func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards uint32) error {
+func (m *bpfMaps) adjustMapSizes(config Config, unwindTableShards uint32, eventsBufferPages int) error {
 	unwindTables, err := m.module.GetMap(unwindTablesMapName)
 	if err != nil {
 		return fmt.Errorf("get unwind tables map: %w", err)
@@ -305,8 +451,34 @@ func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards uint32) er
 
 	m.maxUnwindShards = uint64(unwindTableShards)
 
+	// Adjust stack_traces and dwarf_stack_traces to hold stacks as deep as
+	// they are walked, with as many fewer or more of them as needed to use
+	// the memory they take with the default depth.
+	depth := config.MaxStackDepth
+	entries := uint32(maxStackTracesEntries * DefaultStackDepth / depth)
+	stackTraces, err := m.module.GetMap(stackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get stack traces map: %w", err)
+	}
+	if err := stackTraces.SetValueSize(depth * 8); err != nil {
+		return fmt.Errorf("set stack traces map value size: %w", err)
+	}
+	if err := stackTraces.Resize(entries); err != nil {
+		return fmt.Errorf("resize stack traces map from default to %d elements: %w", entries, err)
+	}
+	dwarfStackTraces, err := m.module.GetMap(dwarfStackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get dwarf stack traces map: %w", err)
+	}
+	if err := dwarfStackTraces.SetValueSize(8 + depth*8); err != nil {
+		return fmt.Errorf("set dwarf stack traces map value size: %w", err)
+	}
+	if err := dwarfStackTraces.Resize(entries); err != nil {
+		return fmt.Errorf("resize dwarf stack traces map from default to %d elements: %w", entries, err)
+	}
+
 	// Adjust debug_pids size.
-	if debugEnabled {
+	if config.FilterProcesses {
 		debugPIDs, err := m.module.GetMap(debugPIDsMapName)
 		if err != nil {
 			return fmt.Errorf("get debug pids map: %w", err)
@@ -315,20 +487,97 @@ func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards uint32) er
 			return fmt.Errorf("resize debug pids map from default to %d elements: %w", maxProcesses, err)
 		}
 	}
+
+	// Adjust stack_timestamps size.
+	if config.SampleTimestamps {
+		stackTimestamps, err := m.module.GetMap(stackTimestampsMapName)
+		if err != nil {
+			return fmt.Errorf("get stack timestamps map: %w", err)
+		}
+		if err := stackTimestamps.Resize(maxStackCountsEntries); err != nil {
+			return fmt.Errorf("resize stack timestamps map from default to %d elements: %w", maxStackCountsEntries, err)
+		}
+	}
+
+	// Adjust cgroup_filter size.
+	if config.FilterCgroups {
+		cgroupFilter, err := m.module.GetMap(cgroupFilterMapName)
+		if err != nil {
+			return fmt.Errorf("get cgroup filter map: %w", err)
+		}
+		if err := cgroupFilter.Resize(maxCgroups); err != nil {
+			return fmt.Errorf("resize cgroup filter map from default to %d elements: %w", maxCgroups, err)
+		}
+	}
+
+	// Adjust events_ringbuf size, or turn it into a map that can be created
+	// on kernels without ring buffers when the perf buffer is used.
+	eventsRingbuf, err := m.module.GetMap(eventsRingbufMapName)
+	if err != nil {
+		return fmt.Errorf("get events ring buffer map: %w", err)
+	}
+	if config.EventsRingbuf {
+		size := ringbufSize(eventsBufferPages, os.Getpagesize(), runtime.NumCPU())
+		if err := eventsRingbuf.Resize(size); err != nil {
+			return fmt.Errorf("resize events ring buffer map from default to %d bytes: %w", size, err)
+		}
+	} else {
+		if err := eventsRingbuf.SetType(bpf.MapTypeQueue); err != nil {
+			return fmt.Errorf("set events ring buffer map type: %w", err)
+		}
+		if err := eventsRingbuf.SetValueSize(8); err != nil {
+			return fmt.Errorf("set events ring buffer map value size: %w", err)
+		}
+		if err := eventsRingbuf.Resize(1); err != nil {
+			return fmt.Errorf("resize events ring buffer map to 1 element: %w", err)
+		}
+	}
 	return nil
 }
 
+// ringbufSize returns the size of a ring buffer holding as many pages per CPU
+// as a perf buffer would, rounded up to the power of two ring buffers must be
+// sized to.
+func ringbufSize(pagesPerCPU, pageSize, cpus int) uint32 {
+	want := uint64(pagesPerCPU) * uint64(pageSize) * uint64(cpus)
+	size := uint64(pageSize)
+	for size < want {
+		size <<= 1
+	}
+	return uint32(size)
+}
+
 func (m *bpfMaps) create() error {
 	debugPIDs, err := m.module.GetMap(debugPIDsMapName)
 	if err != nil {
 		return fmt.Errorf("get debug pids map: %w", err)
 	}
 
+	cgroupFilter, err := m.module.GetMap(cgroupFilterMapName)
+	if err != nil {
+		return fmt.Errorf("get cgroup filter map: %w", err)
+	}
+
 	stackCounts, err := m.module.GetMap(stackCountsMapName)
 	if err != nil {
 		return fmt.Errorf("get counts map: %w", err)
 	}
 
+	stackTimestamps, err := m.module.GetMap(stackTimestampsMapName)
+	if err != nil {
+		return fmt.Errorf("get stack timestamps map: %w", err)
+	}
+
+	lostSamples, err := m.module.GetMap(lostSamplesMapName)
+	if err != nil {
+		return fmt.Errorf("get lost samples map: %w", err)
+	}
+
+	unwindFailures, err := m.module.GetMap(unwindFailuresMapName)
+	if err != nil {
+		return fmt.Errorf("get unwind failures map: %w", err)
+	}
+
 	stackTraces, err := m.module.GetMap(stackTracesMapName)
 	if err != nil {
 		return fmt.Errorf("get stack traces map: %w", err)
@@ -354,13 +603,65 @@ func (m *bpfMaps) create() error {
 		return fmt.Errorf("get process info map: %w", err)
 	}
 
+	interpreterInfo, err := m.module.GetMap(interpreterInfoMapName)
+	if err != nil {
+		return fmt.Errorf("get interpreter info map: %w", err)
+	}
+
+	interpreterStackTraces, err := m.module.GetMap(interpreterStackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get interpreter stack traces map: %w", err)
+	}
+
+	interpreterSymbols, err := m.module.GetMap(interpreterSymbolsMapName)
+	if err != nil {
+		return fmt.Errorf("get interpreter symbols map: %w", err)
+	}
+
+	goRuntimeInfo, err := m.module.GetMap(goRuntimeInfoMapName)
+	if err != nil {
+		return fmt.Errorf("get go runtime info map: %w", err)
+	}
+
+	traceContextInfo, err := m.module.GetMap(traceContextInfoMapName)
+	if err != nil {
+		return fmt.Errorf("get trace context info map: %w", err)
+	}
+
+	samplingInfo, err := m.module.GetMap(samplingInfoMapName)
+	if err != nil {
+		return fmt.Errorf("get sampling info map: %w", err)
+	}
+
+	unsymbolizablePIDs, err := m.module.GetMap(unsymbolizablePIDsMapName)
+	if err != nil {
+		return fmt.Errorf("get unsymbolizable pids map: %w", err)
+	}
+
+	compatPIDs, err := m.module.GetMap(compatPIDsMapName)
+	if err != nil {
+		return fmt.Errorf("get compat pids map: %w", err)
+	}
+
 	m.debugPIDs = debugPIDs
+	m.cgroupFilter = cgroupFilter
 	m.stackCounts = stackCounts
+	m.stackTimestamps = stackTimestamps
+	m.lostSamples = lostSamples
+	m.unwindFailures = unwindFailures
 	m.stackTraces = stackTraces
 	m.unwindShards = unwindShards
 	m.unwindTables = unwindTables
 	m.dwarfStackTraces = dwarfStackTraces
 	m.processInfo = processInfo
+	m.interpreterInfo = interpreterInfo
+	m.interpreterStackTraces = interpreterStackTraces
+	m.interpreterSymbols = interpreterSymbols
+	m.goRuntimeInfo = goRuntimeInfo
+	m.traceContextInfo = traceContextInfo
+	m.samplingInfo = samplingInfo
+	m.unsymbolizablePIDs = unsymbolizablePIDs
+	m.compatPIDs = compatPIDs
 
 	return nil
 }
@@ -398,6 +699,40 @@ func (m *bpfMaps) setDebugPIDs(pids []int) error {
 	return nil
 }
 
+// setProfiledCgroups makes the BPF program only sample the given cgroups. If
+// they don't all fit in the cgroup filter, every cgroup is sampled instead.
+func (m *bpfMaps) setProfiledCgroups(ids map[uint64]struct{}) error {
+	if len(ids) > maxCgroups {
+		level.Warn(m.logger).Log("msg", "too many cgroups to profile, profiling every cgroup", "cgroups", len(ids), "max", maxCgroups)
+		ids = map[uint64]struct{}{0: {}}
+	}
+
+	// Stale cgroups are removed first to make room for the new ones.
+	for id := range m.profiledCgroups {
+		if _, ok := ids[id]; ok {
+			continue
+		}
+		id := id
+		if err := m.cgroupFilter.DeleteKey(unsafe.Pointer(&id)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete cgroup %d from the filter: %w", id, err)
+		}
+		delete(m.profiledCgroups, id)
+	}
+
+	one := uint8(1)
+	for id := range ids {
+		if _, ok := m.profiledCgroups[id]; ok {
+			continue
+		}
+		id := id
+		if err := m.cgroupFilter.Update(unsafe.Pointer(&id), unsafe.Pointer(&one)); err != nil {
+			return fmt.Errorf("failed to add cgroup %d to the filter: %w", id, err)
+		}
+		m.profiledCgroups[id] = struct{}{}
+	}
+	return nil
+}
+
 // readUserStack reads the user stack trace from the stacktraces ebpf map into the given buffer.
 func (m *bpfMaps) readUserStack(userStackID int32, stack *combinedStack) error {
 	if userStackID == 0 {
@@ -409,7 +744,8 @@ func (m *bpfMaps) readUserStack(userStackID int32, stack *combinedStack) error {
 		return fmt.Errorf("read user stack trace, %w: %w", err, errMissing)
 	}
 
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:stackDepth]); err != nil {
+	// The stack traces map holds as many frames as stacks are walked up to.
+	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:stackFrames(stackBytes)]); err != nil {
 		return fmt.Errorf("read user stack bytes, %w: %w", err, errUnrecoverable)
 	}
 
@@ -422,25 +758,30 @@ func (m *bpfMaps) readUserStackWithDwarf(userStackID int32, stack *combinedStack
 		return errUnwindFailed
 	}
 
-	type dwarfStacktrace struct {
-		Len   uint64
-		Addrs [stackDepth]uint64
-	}
-
 	stackBytes, err := m.dwarfStackTraces.GetValue(unsafe.Pointer(&userStackID))
 	if err != nil {
 		return fmt.Errorf("read user stack trace, %w: %w", err, errMissing)
 	}
+	if len(stackBytes) < 8 {
+		return fmt.Errorf("read user stack bytes, %w: %w", io.ErrUnexpectedEOF, errUnrecoverable)
+	}
 
-	var dwarfStack dwarfStacktrace
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, &dwarfStack); err != nil {
+	// The stack length is followed by as many frames as stacks are walked
+	// up to.
+	var dwarfStackLen uint64
+	addrs := make([]uint64, stackFrames(stackBytes[8:]))
+	buf := bytes.NewBuffer(stackBytes)
+	if err := binary.Read(buf, m.byteOrder, &dwarfStackLen); err != nil {
+		return fmt.Errorf("read user stack bytes, %w: %w", err, errUnrecoverable)
+	}
+	if err := binary.Read(buf, m.byteOrder, addrs); err != nil {
 		return fmt.Errorf("read user stack bytes, %w: %w", err, errUnrecoverable)
 	}
 
 	userStack := stack[:stackDepth]
 
-	for i, addr := range dwarfStack.Addrs {
-		if i >= stackDepth || i >= int(dwarfStack.Len) || addr == 0 {
+	for i, addr := range addrs {
+		if i >= stackDepth || i >= int(dwarfStackLen) || addr == 0 {
 			break
 		}
 		userStack[i] = addr
@@ -460,13 +801,23 @@ func (m *bpfMaps) readKernelStack(kernelStackID int32, stack *combinedStack) err
 		return fmt.Errorf("read kernel stack trace, %w: %w", err, errMissing)
 	}
 
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[stackDepth:]); err != nil {
+	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[stackDepth:stackDepth+stackFrames(stackBytes)]); err != nil {
 		return fmt.Errorf("read kernel stack bytes, %w: %w", err, errUnrecoverable)
 	}
 
 	return nil
 }
 
+// stackFrames returns the number of frames the given stack trace bytes hold,
+// at most stackDepth.
+func stackFrames(stackBytes []byte) int {
+	n := len(stackBytes) / 8
+	if n > stackDepth {
+		n = stackDepth
+	}
+	return n
+}
+
 // readStackCount reads the value of the given key from the counts ebpf map.
 func (m *bpfMaps) readStackCount(keyBytes []byte) (uint64, error) {
 	valueBytes, err := m.stackCounts.GetValue(unsafe.Pointer(&keyBytes[0]))
@@ -476,22 +827,92 @@ func (m *bpfMaps) readStackCount(keyBytes []byte) (uint64, error) {
 	return m.byteOrder.Uint64(valueBytes), nil
 }
 
-func (m *bpfMaps) cleanStacks() error {
-	var result error
+// readLostSamples reads the number of samples of each process that were
+// taken but couldn't be stored since it was last called.
+func (m *bpfMaps) readLostSamples() (map[int32]uint64, error) {
+	lost := map[int32]uint64{}
+	it := m.lostSamples.Iterator()
+	for it.Next() {
+		keyBytes := it.Key()
+		valueBytes, err := m.lostSamples.GetValue(unsafe.Pointer(&keyBytes[0]))
+		if err != nil {
+			continue
+		}
+		lost[int32(m.byteOrder.Uint32(keyBytes))] = m.byteOrder.Uint64(valueBytes)
+	}
+	if it.Err() != nil {
+		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+	}
+
+	if _, err := bpfmaps.Clear(m.lostSamples); err != nil {
+		return lost, err
+	}
+	return lost, nil
+}
 
-	// stackTraces
-	if err := clearBpfMap(m.stackTraces); err != nil {
-		result = multierror.Append(result, err)
+// readUnwindFailures reads the failures of the DWARF unwinder sampled since it
+// was last called, with the number of times they happened.
+func (m *bpfMaps) readUnwindFailures() (map[unwindFailure]uint64, error) {
+	failures := map[unwindFailure]uint64{}
+	it := m.unwindFailures.Iterator()
+	for it.Next() {
+		keyBytes := it.Key()
+		valueBytes, err := m.unwindFailures.GetValue(unsafe.Pointer(&keyBytes[0]))
+		if err != nil {
+			continue
+		}
+		var failure unwindFailure
+		if err := binary.Read(bytes.NewReader(keyBytes), m.byteOrder, &failure); err != nil {
+			return nil, fmt.Errorf("read unwind failure bytes: %w", err)
+		}
+		failures[failure] = m.byteOrder.Uint64(valueBytes)
+	}
+	if it.Err() != nil {
+		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+	}
+
+	if _, err := bpfmaps.Clear(m.unwindFailures); err != nil {
+		return failures, err
+	}
+	return failures, nil
+}
+
+// readStackTimestamps reads the boot times in nanoseconds at which the stacks
+// of the given key of the counts ebpf map were sampled.
+func (m *bpfMaps) readStackTimestamps(keyBytes []byte) ([]uint64, error) {
+	valueBytes, err := m.stackTimestamps.GetValue(unsafe.Pointer(&keyBytes[0]))
+	if err != nil {
+		return nil, fmt.Errorf("get timestamps value: %w", err)
 	}
 
-	// dwarfStackTraces
-	if err := clearBpfMap(m.dwarfStackTraces); err != nil {
-		result = multierror.Append(result, err)
+	var timestamps stackTimestamps
+	if err := binary.Read(bytes.NewBuffer(valueBytes), m.byteOrder, &timestamps); err != nil {
+		return nil, fmt.Errorf("read timestamps bytes: %w", err)
 	}
 
-	// stackCounts
-	if err := clearBpfMap(m.stackCounts); err != nil {
-		result = multierror.Append(result, err)
+	n := min(timestamps.Len, maxSampleTimestamps)
+	res := make([]uint64, n)
+	copy(res, timestamps.KTime[:n])
+	return res, nil
+}
+
+// cleanStacks clears the maps storing stacks, and records how full they got
+// since they were last cleared.
+func (m *bpfMaps) cleanStacks() error {
+	var result error
+
+	for _, bpfMap := range []*bpf.BPFMap{
+		m.stackTraces,
+		m.dwarfStackTraces,
+		m.interpreterStackTraces,
+		m.stackCounts,
+		m.stackTimestamps,
+	} {
+		deleted, err := bpfmaps.Clear(bpfMap)
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+		m.metrics.mapPressure.WithLabelValues(bpfMap.Name()).Set(float64(deleted) / float64(bpfMap.GetMaxEntries()))
 	}
 
 	return result
@@ -500,11 +921,408 @@ func (m *bpfMaps) cleanStacks() error {
 func (m *bpfMaps) finalizeProfileLoop() error {
 	m.profilingRoundsWithoutUnwindInfoReset++
 	m.profilingRoundsWithoutProcessInfoReset++
-	return m.cleanStacks()
+	m.cleanInterpreterInfo()
+	if err := m.cleanStacks(); err != nil {
+		return err
+	}
+	// Symbols are only referenced by the stacks just cleaned.
+	return m.cleanInterpreterSymbols()
+}
+
+// cleanInterpreterInfo removes the interpreter, Go runtime, trace context,
+// sampling, symbolization and compatibility mode information of the processes
+// that exited.
+func (m *bpfMaps) cleanInterpreterInfo() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cleanExitedProcesses(m.logger, m.interpreters, m.interpreterInfo)
+	cleanExitedProcesses(m.logger, m.goRuntimes, m.goRuntimeInfo)
+	cleanExitedProcesses(m.logger, m.traceContexts, m.traceContextInfo)
+	cleanExitedProcesses(m.logger, m.samplingRatios, m.samplingInfo)
+	cleanExitedProcesses(m.logger, m.unsymbolizable, m.unsymbolizablePIDs)
+	cleanExitedProcesses(m.logger, m.compat, m.compatPIDs)
+}
+
+// cleanExitedProcesses removes the entries of the processes that exited from
+// a BPF map keyed by PID and the map tracking them.
+func cleanExitedProcesses[T any](logger log.Logger, pids map[int]T, bpfMap *bpf.BPFMap) {
+	for pid := range pids {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		key := int32(pid)
+		if err := bpfMap.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			level.Debug(logger).Log("msg", "failed to delete process entry", "map", bpfMap.Name(), "pid", pid, "err", err)
+			continue
+		}
+		delete(pids, pid)
+	}
+}
+
+// readInterpreterStack reads the frames of an interpreter stack trace.
+func (m *bpfMaps) readInterpreterStack(stackID int32) ([]uint64, error) {
+	stackBytes, err := m.interpreterStackTraces.GetValue(unsafe.Pointer(&stackID))
+	if err != nil {
+		return nil, fmt.Errorf("read interpreter stack trace, %w: %w", err, errMissing)
+	}
+
+	var stack interpreterStack
+	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, &stack); err != nil {
+		return nil, fmt.Errorf("read interpreter stack bytes, %w: %w", err, errUnrecoverable)
+	}
+
+	n := min(stack.Len, maxInterpreterStackDepth)
+	frames := make([]uint64, n)
+	copy(frames, stack.Frames[:n])
+	return frames, nil
+}
+
+// readInterpreterSymbols returns the interpreter symbols by ID.
+func (m *bpfMaps) readInterpreterSymbols() (map[uint32]profile.Function, error) {
+	symbols := map[uint32]profile.Function{}
+
+	it := m.interpreterSymbols.Iterator()
+	for it.Next() {
+		keyBytes := it.Key()
+
+		var symbol interpreterSymbol
+		if err := binary.Read(bytes.NewBuffer(keyBytes), m.byteOrder, &symbol); err != nil {
+			return nil, fmt.Errorf("read interpreter symbol: %w", err)
+		}
+		idBytes, err := m.interpreterSymbols.GetValue(unsafe.Pointer(&keyBytes[0]))
+		if err != nil {
+			continue
+		}
+
+		symbols[m.byteOrder.Uint32(idBytes)] = symbol.function()
+	}
+	if it.Err() != nil {
+		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+	}
+	return symbols, nil
+}
+
+// cleanInterpreterSymbols clears the interpreter symbols once too many
+// accumulate. It must only be called once the stacks referencing them have
+// been read and cleared, so the IDs of the stacks of a round stay resolvable.
+func (m *bpfMaps) cleanInterpreterSymbols() error {
+	count := 0
+	it := m.interpreterSymbols.Iterator()
+	for it.Next() {
+		count++
+	}
+	if it.Err() != nil {
+		return fmt.Errorf("failed iterator: %w", it.Err())
+	}
+	if count < interpreterSymbolsCleanupThreshold {
+		return nil
+	}
+
+	level.Debug(m.logger).Log("msg", "cleaning interpreter symbols", "count", count)
+	if _, err := bpfmaps.Clear(m.interpreterSymbols); err != nil {
+		return fmt.Errorf("clean interpreter symbols: %w", err)
+	}
+	return nil
+}
+
+func (s interpreterSymbol) function() profile.Function {
+	name := cString(s.FunctionName[:])
+	if name == "" {
+		// Code outside of any function, such as the script itself.
+		name = "{main}"
+	}
+	if class := cString(s.ClassName[:]); class != "" {
+		name = class + "::" + name
+	}
+	return profile.Function{
+		Name:     name,
+		Filename: cString(s.Path[:]),
+	}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// decodeInterpreterFrames symbolizes the frames of an interpreter stack.
+func decodeInterpreterFrames(frames []uint64, symbols map[uint32]profile.Function) []profile.InterpreterFrame {
+	res := make([]profile.InterpreterFrame, 0, len(frames))
+	for _, frame := range frames {
+		fn, ok := symbols[uint32(frame>>32)]
+		if !ok {
+			fn = profile.Function{Name: "unknown"}
+		}
+		res = append(res, profile.InterpreterFrame{
+			Line: profile.Line{
+				Function: fn,
+				Line:     int(frame & interpreterFrameLinenoMask),
+			},
+			Entry: frame&interpreterFrameEntry != 0,
+		})
+	}
+	return res
+}
+
+// processInterpreter returns the interpreter information of the given
+// process, or nil if its interpreter stacks aren't walked.
+func (m *bpfMaps) processInterpreter(pid int) *interpreter.Info {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.interpreters[pid]
+}
+
+// setInterpreterInfo makes the BPF program walk the stacks of the
+// interpreter run by the given process, or stop doing so if info is nil.
+func (m *bpfMaps) setInterpreterInfo(pid int, info *interpreter.Info) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.interpreters[pid]
+	if current == info {
+		return nil
+	}
+
+	key := int32(pid)
+	if info == nil {
+		if !ok {
+			return nil
+		}
+		delete(m.interpreters, pid)
+		if err := m.interpreterInfo.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("delete interpreter info: %w", err)
+		}
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, m.byteOrder, interpreterInfo{
+		Type:           uint64(info.Type),
+		GlobalsAddress: info.GlobalsAddress,
+		PHP:            info.PHP,
+		V8:             info.V8,
+	}); err != nil {
+		return fmt.Errorf("write interpreter info: %w", err)
+	}
+	if err := m.interpreterInfo.Update(unsafe.Pointer(&key), unsafe.Pointer(&buf.Bytes()[0])); err != nil {
+		return fmt.Errorf("update interpreter info: %w", err)
+	}
+	m.interpreters[pid] = info
+	return nil
+}
+
+// processGoRuntime returns the Go runtime information of the given process,
+// or nil if its goroutines aren't read.
+func (m *bpfMaps) processGoRuntime(pid int) *goruntime.Info {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.goRuntimes[pid]
+}
+
+// setGoRuntimeInfo makes the BPF program read the goroutine of the samples of
+// the given process, or stop doing so if info is nil.
+func (m *bpfMaps) setGoRuntimeInfo(pid int, info *goruntime.Info) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.goRuntimes[pid]
+	if current == info {
+		return nil
+	}
+
+	key := int32(pid)
+	if info == nil {
+		if !ok {
+			return nil
+		}
+		delete(m.goRuntimes, pid)
+		if err := m.goRuntimeInfo.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("delete go runtime info: %w", err)
+		}
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, m.byteOrder, info.Offsets); err != nil {
+		return fmt.Errorf("write go runtime info: %w", err)
+	}
+	if err := m.goRuntimeInfo.Update(unsafe.Pointer(&key), unsafe.Pointer(&buf.Bytes()[0])); err != nil {
+		return fmt.Errorf("update go runtime info: %w", err)
+	}
+	m.goRuntimes[pid] = info
+	return nil
+}
+
+// setTraceContextInfo makes the BPF program read the trace context of the
+// samples of the given process, or stop doing so if info is nil.
+func (m *bpfMaps) setTraceContextInfo(pid int, info *tracecontext.Info) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.traceContexts[pid]
+	if current == info {
+		return nil
+	}
+
+	key := int32(pid)
+	if info == nil {
+		if !ok {
+			return nil
+		}
+		delete(m.traceContexts, pid)
+		if err := m.traceContextInfo.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("delete trace context info: %w", err)
+		}
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, m.byteOrder, info); err != nil {
+		return fmt.Errorf("write trace context info: %w", err)
+	}
+	if err := m.traceContextInfo.Update(unsafe.Pointer(&key), unsafe.Pointer(&buf.Bytes()[0])); err != nil {
+		return fmt.Errorf("update trace context info: %w", err)
+	}
+	m.traceContexts[pid] = info
+	return nil
+}
+
+// setSamplingRatio makes the BPF program keep one in every `every` samples of
+// the given process, or all of them if every is 1.
+func (m *bpfMaps) setSamplingRatio(pid int, every uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.samplingRatios[pid]
+	if current == every || (!ok && every <= 1) {
+		return nil
+	}
+
+	key := int32(pid)
+	if every <= 1 {
+		delete(m.samplingRatios, pid)
+		if err := m.samplingInfo.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("delete sampling info: %w", err)
+		}
+		return nil
+	}
+
+	// Mirrors sampling_info_t, with the count of samples starting over.
+	info := struct{ Every, Count uint32 }{Every: every}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, m.byteOrder, info); err != nil {
+		return fmt.Errorf("write sampling info: %w", err)
+	}
+	if err := m.samplingInfo.Update(unsafe.Pointer(&key), unsafe.Pointer(&buf.Bytes()[0])); err != nil {
+		return fmt.Errorf("update sampling info: %w", err)
+	}
+	m.samplingRatios[pid] = every
+	return nil
+}
+
+// samplingRatio returns the ratio of the samples of the given process kept by
+// the BPF program.
+func (m *bpfMaps) samplingRatio(pid int) uint32 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if every, ok := m.samplingRatios[pid]; ok {
+		return every
+	}
+	return 1
+}
+
+// setUnsymbolizable makes the BPF program stop sampling the given process, or
+// sample it again.
+func (m *bpfMaps) setUnsymbolizable(pid int, unsymbolizable bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.unsymbolizable[pid]; ok == unsymbolizable {
+		return nil
+	}
+
+	key := int32(pid)
+	if !unsymbolizable {
+		delete(m.unsymbolizable, pid)
+		if err := m.unsymbolizablePIDs.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("delete unsymbolizable pid: %w", err)
+		}
+		return nil
+	}
+
+	value := uint8(1)
+	if err := m.unsymbolizablePIDs.Update(unsafe.Pointer(&key), unsafe.Pointer(&value)); err != nil {
+		return fmt.Errorf("update unsymbolizable pids: %w", err)
+	}
+	m.unsymbolizable[pid] = struct{}{}
+	return nil
+}
+
+// unsymbolizableProcesses returns the PIDs the BPF program doesn't sample.
+func (m *bpfMaps) unsymbolizableProcesses() []int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pids := make([]int, 0, len(m.unsymbolizable))
+	for pid := range m.unsymbolizable {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// setCompat makes the BPF program stop sampling the given process, if it is a
+// 32-bit one, or sample it again, as it may have executed a 64-bit program.
+func (m *bpfMaps) setCompat(pid int, compat bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.compat[pid]; ok == compat {
+		return nil
+	}
+
+	key := int32(pid)
+	if !compat {
+		delete(m.compat, pid)
+		if err := m.compatPIDs.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("delete compat pid: %w", err)
+		}
+		return nil
+	}
+
+	value := uint8(1)
+	if err := m.compatPIDs.Update(unsafe.Pointer(&key), unsafe.Pointer(&value)); err != nil {
+		return fmt.Errorf("update compat pids: %w", err)
+	}
+	m.compat[pid] = struct{}{}
+	return nil
+}
+
+// isCompat returns whether the given process is a 32-bit one.
+func (m *bpfMaps) isCompat(pid int) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.compat[pid]
+	return ok
+}
+
+// compatProcesses returns the number of 32-bit processes the BPF program
+// doesn't sample.
+func (m *bpfMaps) compatProcesses() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.compat)
 }
 
 func (m *bpfMaps) cleanProcessInfo() error {
-	if err := clearBpfMap(m.processInfo); err != nil {
+	if _, err := bpfmaps.Clear(m.processInfo); err != nil {
 		return err
 	}
 	return nil
@@ -512,7 +1330,7 @@ func (m *bpfMaps) cleanProcessInfo() error {
 
 func (m *bpfMaps) cleanShardInfo() error {
 	// unwindShards
-	if err := clearBpfMap(m.unwindShards); err != nil {
+	if _, err := bpfmaps.Clear(m.unwindShards); err != nil {
 		return err
 	}
 	return nil
@@ -537,8 +1355,6 @@ func (m *bpfMaps) resetMappingInfoBuffer() error {
 func (m *bpfMaps) refreshProcessInfo(pid int) {
 	level.Debug(m.logger).Log("msg", "refreshing process info", "pid", pid)
 
-	cachedHash, _ := m.processCache.GetIfPresent(pid)
-
 	proc, err := procfs.NewProc(pid)
 	if err != nil {
 		return
@@ -547,19 +1363,42 @@ func (m *bpfMaps) refreshProcessInfo(pid int) {
 	if err != nil {
 		return
 	}
+	process.AttributeRemappedText(mappings)
 	executableMappings := unwind.ListExecutableMappings(mappings)
-	currentHash, err := executableMappings.Hash()
-	if err != nil {
-		level.Error(m.logger).Log("msg", "executableMappings hash failed", "err", err)
-		return
-	}
 
-	if cachedHash != currentHash {
-		err := m.addUnwindTableForProcess(pid, executableMappings, false)
-		if err != nil {
-			level.Error(m.logger).Log("msg", "addUnwindTableForProcess failed", "err", err)
+	if val, ok := m.processCache.GetIfPresent(pid); ok {
+		cached, ok := val.(*processMappings)
+		if ok {
+			added, removed := executableMappings.Diff(cached.mappings)
+			if len(added) == 0 && len(removed) == 0 {
+				return
+			}
 		}
 	}
+
+	if err := m.addUnwindTableForProcess(pid, executableMappings, false); err != nil {
+		level.Error(m.logger).Log("msg", "addUnwindTableForProcess failed", "err", err)
+	}
+}
+
+// hasProcessInfo returns true if the process information of the given process,
+// with its mappings and their unwind tables, was written.
+func (m *bpfMaps) hasProcessInfo(pid int) bool {
+	_, ok := m.processCache.GetIfPresent(pid)
+	return ok
+}
+
+// forgetProcess removes the unwind information of a process that exited, so
+// that a new process reusing its PID gets its own.
+func (m *bpfMaps) forgetProcess(pid int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.processCache.Invalidate(pid)
+	key := int32(pid)
+	if err := m.processInfo.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+		level.Debug(m.logger).Log("msg", "failed to delete process info", "pid", pid, "err", err)
+	}
 }
 
 // 1. Find executable sections
@@ -591,6 +1430,7 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 		if err != nil {
 			return err
 		}
+		process.AttributeRemappedText(mappings)
 		executableMappings = unwind.ListExecutableMappings(mappings)
 	}
 
@@ -610,6 +1450,17 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 		return errTooManyExecutableMappings
 	}
 
+	// The mappings that were already written for the process are written
+	// again as they were, only the new ones are looked up.
+	var previous *processMappings
+	if val, ok := m.processCache.GetIfPresent(pid); ok {
+		previous, _ = val.(*processMappings)
+	}
+	current := &processMappings{
+		mappings: executableMappings,
+		written:  make(map[unwind.ExecutableMapping][]byte, len(executableMappings)),
+	}
+
 	mappingInfoMemory := m.mappingInfoMemory.Slice(mappingInfoSizeBytes)
 	// .type
 	mappingInfoMemory.PutUint64(isJitCompiler)
@@ -620,9 +1471,26 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 		if executableMapping.IsJitDump() {
 			continue
 		}
+		if previous != nil {
+			if written, ok := previous.written[*executableMapping]; ok {
+				mappingInfoMemory.PutBytes(written)
+				current.written[*executableMapping] = written
+				continue
+			}
+		}
+
+		before := mappingInfoMemory
 		if err := m.setUnwindTableForMapping(&mappingInfoMemory, pid, executableMapping); err != nil {
 			return fmt.Errorf("setUnwindTableForMapping for executable %s starting at 0x%x failed: %w", executableMapping.Executable, executableMapping.StartAddr, err)
 		}
+		if n := len(before) - len(mappingInfoMemory); n > 0 {
+			current.written[*executableMapping] = bytes.Clone(before[:n])
+		}
+	}
+	if previous != nil {
+		added, removed := executableMappings.Diff(previous.mappings)
+		m.metrics.unwindTableMappingChanges.WithLabelValues(labelAdded).Add(float64(len(added)))
+		m.metrics.unwindTableMappingChanges.WithLabelValues(labelRemoved).Add(float64(len(removed)))
 	}
 
 	// TODO(javierhonduco): There's a small window where it's possible that
@@ -654,12 +1522,60 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 		return fmt.Errorf("update processInfo: %w", err)
 	}
 
-	mapsHash, err := executableMappings.Hash()
+	m.processCache.Put(pid, current)
+	m.events.Record(pid, lifecycle.UnwindTableBuilt, fmt.Sprintf("executables=%d", len(executableMappings)), nil)
+	return nil
+}
+
+// compactUnwindTable returns the compact unwind table for a given executable,
+// loading it from the disk cache or fetching it from the table server if
+// possible, and generating it otherwise.
+func (m *bpfMaps) compactUnwindTable(fullExecutablePath, buildID string, mapping *unwind.ExecutableMapping) (unwind.CompactUnwindTable, error) {
+	if m.unwindTableCache != nil {
+		ut, err := m.unwindTableCache.Get(buildID)
+		if err == nil {
+			level.Debug(m.logger).Log("msg", "loaded unwind table from disk cache", "executable", mapping.Executable, "buildID", buildID, "len", len(ut))
+			return ut, nil
+		}
+		if !errors.Is(err, unwind.ErrTableCacheMiss) {
+			level.Debug(m.logger).Log("msg", "failed to load unwind table from disk cache", "buildID", buildID, "err", err)
+		}
+	}
+
+	ut, err := m.fetchCompactUnwindTable(buildID, mapping)
 	if err != nil {
-		return fmt.Errorf("maps hash: %w", err)
+		ut, err = m.generateCompactUnwindTable(fullExecutablePath, mapping)
+		if err != nil {
+			return ut, err
+		}
 	}
-	m.processCache.Put(pid, mapsHash)
-	return nil
+
+	if m.unwindTableCache == nil {
+		return ut, nil
+	}
+
+	if err := m.unwindTableCache.Put(buildID, ut); err != nil {
+		level.Warn(m.logger).Log("msg", "failed to persist unwind table", "buildID", buildID, "err", err)
+	}
+	return ut, nil
+}
+
+// fetchCompactUnwindTable fetches the precomputed compact unwind table for a
+// given executable from the table server.
+func (m *bpfMaps) fetchCompactUnwindTable(buildID string, mapping *unwind.ExecutableMapping) (unwind.CompactUnwindTable, error) {
+	if m.unwindTableFetcher == nil {
+		return nil, unwind.ErrTableCacheMiss
+	}
+
+	ut, err := m.unwindTableFetcher.Get(buildID)
+	if err != nil {
+		if !errors.Is(err, unwind.ErrTableCacheMiss) {
+			level.Debug(m.logger).Log("msg", "failed to fetch unwind table, generating it", "buildID", buildID, "err", err)
+		}
+		return nil, err
+	}
+	level.Debug(m.logger).Log("msg", "fetched unwind table", "executable", mapping.Executable, "buildID", buildID, "len", len(ut))
+	return ut, nil
 }
 
 // generateCompactUnwindTable produces the compact unwidn table for a given
@@ -715,7 +1631,7 @@ func (m *bpfMaps) writeUnwindTableRow(rowSlice *profiler.EfficientBuffer, row un
 //
 // Note: we write field by field to avoid the expensive reflection code paths
 // when writing structs using `binary.Write`.
-func (m *bpfMaps) writeMapping(buf *profiler.EfficientBuffer, loadAddress, startAddr, endAddr, executableID, type_ uint64) {
+func (m *bpfMaps) writeMapping(buf *profiler.EfficientBuffer, loadAddress, startAddr, endAddr, executableID, mappingType uint64) {
 	// .load_address
 	buf.PutUint64(loadAddress)
 	// .begin
@@ -725,7 +1641,7 @@ func (m *bpfMaps) writeMapping(buf *profiler.EfficientBuffer, loadAddress, start
 	// .executable_id
 	buf.PutUint64(executableID)
 	// .type
-	buf.PutUint64(type_)
+	buf.PutUint64(mappingType)
 }
 
 // mappingID returns the internal identifier for a memory mapping.
@@ -734,18 +1650,21 @@ func (m *bpfMaps) writeMapping(buf *profiler.EfficientBuffer, loadAddress, start
 // one while indicating whether it was already seen or not.
 //
 // This allows us to reuse the unwind tables for the mappings we
-// see.
+// see. New IDs are reserved right away, so an executable whose unwind
+// table can't be generated never shares its ID with the next one.
 func (m *bpfMaps) mappingID(buildID string) (uint64, bool) {
-	_, alreadySeenMapping := m.buildIDMapping[buildID]
-	if alreadySeenMapping {
+	if id, ok := m.buildIDMapping[buildID]; ok {
 		level.Debug(m.logger).Log("msg", "mapping caching, seen before", "buildID", buildID)
 		m.referencedMappings += 1
-	} else {
-		level.Debug(m.logger).Log("msg", "mapping caching, new", "buildID", buildID)
-		m.buildIDMapping[buildID] = m.executableID
+		m.metrics.unwindTableMappings.WithLabelValues("shared").Inc()
+		return id, true
 	}
 
-	return m.buildIDMapping[buildID], alreadySeenMapping
+	level.Debug(m.logger).Log("msg", "mapping caching, new", "buildID", buildID)
+	id := m.executableID
+	m.buildIDMapping[buildID] = id
+	m.executableID++
+	return id, false
 }
 
 // resetInFlightBuffer zeroes and resets the length of the
@@ -924,23 +1843,23 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 	// Deal with mappings that are not filed backed. They don't have unwind
 	// information.
 	if mapping.IsNotFileBacked() {
-		var type_ uint64
+		var mappingType uint64
 		if mapping.IsJitted() {
 			level.Debug(m.logger).Log("msg", "jit section", "pid", pid)
-			type_ = mappingTypeJitted
+			mappingType = mappingTypeJitted
 		}
 		if mapping.IsSpecial() {
 			level.Debug(m.logger).Log("msg", "special section", "pid", pid)
-			type_ = mappingTypeSpecial
+			mappingType = mappingTypeSpecial
 		}
 
-		m.writeMapping(buf, mapping.LoadAddr, mapping.StartAddr, mapping.EndAddr, uint64(0), type_)
+		m.writeMapping(buf, mapping.LoadAddr, mapping.StartAddr, mapping.EndAddr, uint64(0), mappingType)
 		return nil
 	}
 
 	// Deal with mappings that are backed by a file and might contain unwind
 	// information.
-	fullExecutablePath := path.Join("/proc/", fmt.Sprintf("%d", pid), "/root/", mapping.Executable)
+	fullExecutablePath := process.MappedFilePath(pid, mapping.Executable, mapping.StartAddr, mapping.EndAddr)
 
 	f, err := os.Open(fullExecutablePath)
 	if err != nil {
@@ -973,12 +1892,17 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 		adjustedLoadAddress = mapping.LoadAddr
 	}
 
-	level.Debug(m.logger).Log("msg", "adding memory mappings in for executable", "executableID", m.executableID, "buildID", buildID, "executable", mapping.Executable)
-
 	// Add the memory mapping information.
 	foundexecutableID, mappingAlreadySeen := m.mappingID(buildID)
+	level.Debug(m.logger).Log("msg", "adding memory mappings in for executable", "executableID", foundexecutableID, "buildID", buildID, "executable", mapping.Executable)
 
-	m.writeMapping(buf, adjustedLoadAddress, mapping.StartAddr, mapping.EndAddr, foundexecutableID, uint64(0))
+	var mappingType uint64
+	if !hasUnwindInformation(elfFile) {
+		level.Debug(m.logger).Log("msg", "no unwind information, falling back to frame pointers", "executable", mapping.Executable)
+		mappingType = mappingTypeFramePointers
+	}
+
+	m.writeMapping(buf, adjustedLoadAddress, mapping.StartAddr, mapping.EndAddr, foundexecutableID, mappingType)
 
 	// Generated and add the unwind table, if needed.
 	if !mappingAlreadySeen {
@@ -988,7 +1912,7 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 		// Generate the unwind table.
 		// PERF(javierhonduco): Not reusing a buffer here yet, let's profile and decide whether this
 		// change would be worth it.
-		ut, err := m.generateCompactUnwindTable(fullExecutablePath, mapping)
+		ut, err := m.compactUnwindTable(fullExecutablePath, buildID, mapping)
 		if err != nil {
 			if errors.Is(err, unwind.ErrNoFDEsFound) {
 				// is it ok to return here?
@@ -1006,6 +1930,7 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 		}
 
 		chunkIndex := 0
+		link := uint64(0)
 
 		var (
 			currentChunk unwind.CompactUnwindTable
@@ -1016,6 +1941,9 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 
 		for {
 			if m.waitingToResetUnwindInfo {
+				// Don't share the partially written table, the next
+				// process running this executable generates it again.
+				delete(m.buildIDMapping, buildID)
 				return ErrNeedMoreProfilingRounds
 			}
 			maxThreshold := min(len(restChunks), int(m.availableEntries()))
@@ -1025,6 +1953,25 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 				break
 			}
 
+			// The current link is full, continue in the next one.
+			if chunkIndex == maxUnwindTableChunks {
+				if link+1 == maxUnwindInfoLinks {
+					level.Warn(m.logger).Log("msg", "unwind table is too big, truncating it", "executable", mapping.Executable, "buildID", buildID, "truncatedRows", len(restChunks))
+					m.metrics.unwindTableTruncated.Inc()
+					m.metrics.unwindTableTruncatedRows.Add(float64(len(restChunks)))
+					break
+				}
+
+				if err := m.updateUnwindInfoChunks(foundexecutableID, link, unwindShardsValBuf.Bytes()); err != nil {
+					return err
+				}
+				unwindShardsValBuf.Reset()
+				m.metrics.unwindTableChainedLinks.Inc()
+
+				link++
+				chunkIndex = 0
+			}
+
 			// Find the end of the last function and split the unwind table
 			// at that index.
 			currentChunkCandidate := restChunks[:maxThreshold]
@@ -1060,11 +2007,6 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 
 			m.assertInvariants()
 
-			if chunkIndex >= maxUnwindTableChunks {
-				level.Error(m.logger).Log("msg", "have more chunks than the max", "chunks", chunkIndex, "maxChunks", maxUnwindTableChunks)
-				// TODO(javierhonduco): not returning an error right now, but let's handle this later on.
-			}
-
 			level.Debug(m.logger).Log("current chunk size", len(currentChunk))
 			level.Debug(m.logger).Log("rest of chunk size", len(restChunks))
 
@@ -1076,7 +2018,7 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 
 			// Add shard information.
 
-			level.Debug(m.logger).Log("executableID", m.executableID, "executable", mapping.Executable, "current shard", chunkIndex)
+			level.Debug(m.logger).Log("executableID", foundexecutableID, "executable", mapping.Executable, "current shard", chunkIndex)
 
 			// Dealing with the first chunk, we must add the lowest known PC.
 			minPc := currentChunk[0].Pc()
@@ -1130,16 +2072,37 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 			chunkIndex++
 		}
 
-		executableID := m.executableID
-		if err := m.unwindShards.Update(
-			unsafe.Pointer(&executableID),
-			unsafe.Pointer(&unwindShardsValBuf.Bytes()[0])); err != nil {
-			return fmt.Errorf("failed to update unwind shard: %w", err)
+		if err := m.updateUnwindInfoChunks(foundexecutableID, link, unwindShardsValBuf.Bytes()); err != nil {
+			return err
 		}
 
-		m.executableID++
 		m.uniqueMappings++
+		m.metrics.unwindTableMappings.WithLabelValues("generated").Inc()
 	}
 
 	return nil
 }
+
+// hasUnwindInformation returns whether the executable contains .eh_frame
+// unwind information.
+func hasUnwindInformation(elfFile *elf.File) bool {
+	sec := elfFile.Section(".eh_frame")
+	return sec != nil && sec.Size > 0
+}
+
+// updateUnwindInfoChunks writes the chunks of a link of an executable's unwind
+// information. Unused chunks are zeroed, which marks the end of the link.
+func (m *bpfMaps) updateUnwindInfoChunks(executableID, link uint64, chunks []byte) error {
+	if len(chunks) > unwindShardsSizeBytes {
+		return fmt.Errorf("too many unwind info chunks: %d bytes", len(chunks))
+	}
+
+	val := make([]byte, unwindShardsSizeBytes)
+	copy(val, chunks)
+
+	key := executableID | link<<32
+	if err := m.unwindShards.Update(unsafe.Pointer(&key), unsafe.Pointer(&val[0])); err != nil {
+		return fmt.Errorf("failed to update unwind shard: %w", err)
+	}
+	return nil
+}
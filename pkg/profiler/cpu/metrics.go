@@ -12,11 +12,16 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package cpu
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/pkg/interpreter"
+	"github.com/parca-dev/parca-agent/pkg/process"
 )
 
 const (
@@ -28,11 +33,17 @@ const (
 	labelMissing      = "missing"
 	labelFailed       = "failed"
 	labelSuccess      = "success"
+	labelEmpty        = "empty"
+	labelUp           = "up"
+	labelDown         = "down"
+	labelAdded        = "added"
+	labelRemoved      = "removed"
 
 	labelStackDropReasonKey              = "read_stack_key"
 	labelStackDropReasonUserDWARF        = "read_user_stack_with_dwarf"
 	labelStackDropReasonUserFramePointer = "read_user_stack_with_frame_pointer"
 	labelStackDropReasonKernel           = "read_kernel_stack"
+	labelStackDropReasonInterpreter      = "read_interpreter_stack"
 	labelStackDropReasonCount            = "read_stack_count"
 	labelStackDropReasonZeroCount        = "read_stack_count_zero"
 	labelStackDropReasonIterator         = "iterator"
@@ -42,13 +53,40 @@ const (
 
 type metrics struct {
 	// profile level
-	obtainAttempts *prometheus.CounterVec
-	obtainDuration prometheus.Histogram
-	profileDrop    *prometheus.CounterVec
+	obtainAttempts     *prometheus.CounterVec
+	obtainDuration     prometheus.Histogram
+	conversionDuration prometheus.Histogram
+	profileDrop        *prometheus.CounterVec
 
 	// stack level
 	stackDrop       *prometheus.CounterVec
 	readMapAttempts *prometheus.CounterVec
+
+	// interpreter unwinders
+	runtimeUnwind *prometheus.CounterVec
+
+	// unwind tables
+	unwindTableChainedLinks   prometheus.Counter
+	unwindTableTruncated      prometheus.Counter
+	unwindTableTruncatedRows  prometheus.Counter
+	unwindTableMappings       *prometheus.CounterVec
+	unwindTableMappingChanges *prometheus.CounterVec
+
+	// adaptive sampling frequency
+	samplingFrequency            prometheus.Gauge
+	samplingFrequencyAdjustments *prometheus.CounterVec
+	hostLoad                     prometheus.Gauge
+	profiledCgroups              prometheus.Gauge
+	unsymbolizableProcesses      prometheus.Gauge
+	compatProcesses              prometheus.Gauge
+
+	// pressure of the maps storing stacks
+	mapPressure      *prometheus.GaugeVec
+	stackMapsFlushes prometheus.Counter
+
+	// samples and events lost by the BPF program
+	lostSamples prometheus.Counter
+	lostEvents  prometheus.Counter
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -69,6 +107,14 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 				NativeHistogramBucketFactor: 1.1,
 			},
 		),
+		conversionDuration: promauto.With(reg).NewHistogram(
+			prometheus.HistogramOpts{
+				Name:                        "parca_agent_profiler_conversion_duration_seconds",
+				Help:                        "The duration it takes to convert a profile to pprof and write it, per process or aggregate",
+				ConstLabels:                 map[string]string{"type": "cpu"},
+				NativeHistogramBucketFactor: 1.1,
+			},
+		),
 		stackDrop: promauto.With(reg).NewCounterVec(
 			prometheus.CounterOpts{
 				Name:        "parca_agent_profiler_stack_drop_total",
@@ -93,14 +139,136 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			},
 			[]string{"reason"},
 		),
+		runtimeUnwind: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_runtime_unwind_samples_total",
+				Help:        "Number of samples of processes with an interpreter unwinder, by whether an interpreter stack was found.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+			[]string{"runtime", "status"},
+		),
+		unwindTableChainedLinks: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_unwind_table_chained_links_total",
+				Help:        "Number of additional chunk entries used for executables whose unwind tables don't fit in a single one.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		unwindTableTruncated: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_unwind_table_truncated_total",
+				Help:        "Number of executables whose unwind tables were truncated as they were too big.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		unwindTableTruncatedRows: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_unwind_table_truncated_rows_total",
+				Help:        "Number of unwind table rows that were dropped due to truncation.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		unwindTableMappings: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_unwind_table_mappings_total",
+				Help:        "Number of executable mappings added to the unwind tables, by whether their table was generated or shared with other processes running the same executable.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+			[]string{"table"},
+		),
+		unwindTableMappingChanges: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_unwind_table_mapping_changes_total",
+				Help:        "Number of executable mappings added to or removed from processes whose unwind information was refreshed, such as the libraries loaded with dlopen(3).",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+			[]string{"change"},
+		),
+		samplingFrequency: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "parca_agent_profiler_sampling_frequency_hertz",
+				Help:        "The frequency the CPU is currently sampled at.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		samplingFrequencyAdjustments: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_sampling_frequency_adjustments_total",
+				Help:        "Number of times the sampling frequency was lowered or raised according to the load of the host.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+			[]string{"direction"},
+		),
+		hostLoad: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "parca_agent_profiler_host_load_percent",
+				Help:        "The CPU load of the host the sampling frequency is adapted to.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		profiledCgroups: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "parca_agent_profiler_cgroup_filter_cgroups",
+				Help:        "Number of cgroups sampled by the BPF program, when sampling is restricted to the cgroups of the processes being profiled.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		unsymbolizableProcesses: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "parca_agent_profiler_unsymbolizable_processes",
+				Help:        "Number of processes not sampled by the BPF program as none of their binaries can be symbolized.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		compatProcesses: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "parca_agent_profiler_compat_processes",
+				Help:        "Number of 32-bit processes not sampled by the BPF program as their stacks can't be walked.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		mapPressure: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        "parca_agent_bpf_map_pressure_ratio",
+				Help:        "Share of the entries of the BPF maps storing stacks that were used when they were last cleared.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+			[]string{"bpf_map_name"},
+		),
+		stackMapsFlushes: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_stack_maps_flushes_total",
+				Help:        "Number of times the BPF maps storing stacks were read and cleared before the end of a profiling round because they were full.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		lostSamples: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_lost_samples_total",
+				Help:        "Number of samples that were taken but couldn't be stored by the BPF program.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
+		lostEvents: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_lost_events_total",
+				Help:        "Number of events of the BPF program, such as requests for the unwind information of processes, lost by the perf buffer.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
 	}
+	m.samplingFrequencyAdjustments.WithLabelValues(labelUp)
+	m.samplingFrequencyAdjustments.WithLabelValues(labelDown)
 	m.obtainAttempts.WithLabelValues(labelSuccess)
 	m.obtainAttempts.WithLabelValues(labelError)
+	m.unwindTableMappingChanges.WithLabelValues(labelAdded)
+	m.unwindTableMappingChanges.WithLabelValues(labelRemoved)
 
 	m.stackDrop.WithLabelValues(labelStackDropReasonKey)
 	m.stackDrop.WithLabelValues(labelStackDropReasonUserDWARF)
 	m.stackDrop.WithLabelValues(labelStackDropReasonUserFramePointer)
 	m.stackDrop.WithLabelValues(labelStackDropReasonKernel)
+	m.stackDrop.WithLabelValues(labelStackDropReasonInterpreter)
 	m.stackDrop.WithLabelValues(labelStackDropReasonCount)
 	m.stackDrop.WithLabelValues(labelStackDropReasonZeroCount)
 	m.stackDrop.WithLabelValues(labelStackDropReasonIterator)
@@ -122,5 +290,11 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 
 	m.profileDrop.WithLabelValues(profileDropReasonProcessInfo)
 
+	for _, t := range []interpreter.Type{interpreter.TypePHP, interpreter.TypeV8} {
+		runtime := string(process.RuntimeOfInterpreter(t))
+		m.runtimeUnwind.WithLabelValues(runtime, labelSuccess)
+		m.runtimeUnwind.WithLabelValues(runtime, labelEmpty)
+	}
+
 	return m
 }
@@ -0,0 +1,116 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+)
+
+// FrequencyController adapts the sampling frequency to the load of the host:
+// it is halved while the load is above the high threshold, down to the
+// minimum frequency, and doubled back while it is below the low one, up to
+// the maximum frequency. The gap between the thresholds keeps the frequency
+// from flapping.
+type FrequencyController struct {
+	min, max  uint64
+	low, high float64
+}
+
+// NewFrequencyController returns a controller keeping the frequency between
+// the given minimum and maximum, with thresholds in percents of load.
+func NewFrequencyController(minFrequency, maxFrequency uint64, low, high float64) (*FrequencyController, error) {
+	if minFrequency == 0 || minFrequency > maxFrequency {
+		return nil, fmt.Errorf("invalid minimum frequency %d, it must be between 1 and %d", minFrequency, maxFrequency)
+	}
+	if low < 0 || high > 100 || low >= high {
+		return nil, fmt.Errorf("invalid load thresholds %g and %g, they must be between 0 and 100 and the low one below the high one", low, high)
+	}
+	return &FrequencyController{min: minFrequency, max: maxFrequency, low: low, high: high}, nil
+}
+
+// Next returns the frequency to sample at given the current one and the load
+// of the host in percents.
+func (c *FrequencyController) Next(current uint64, load float64) uint64 {
+	next := current
+	switch {
+	case load > c.high:
+		next = current / 2
+	case load < c.low:
+		next = current * 2
+	}
+	if next < c.min {
+		return c.min
+	}
+	if next > c.max {
+		return c.max
+	}
+	return next
+}
+
+// HostLoad measures the CPU load of the host in percents: the share of time
+// some tasks were stalled waiting for a CPU over the last 10 seconds when
+// pressure stall information is available, or else the CPU utilization since
+// the previous measurement.
+type HostLoad struct {
+	fs procfs.FS
+
+	noPSI   bool
+	last    procfs.CPUStat
+	hasLast bool
+}
+
+func NewHostLoad(fs procfs.FS) *HostLoad {
+	return &HostLoad{fs: fs}
+}
+
+// Read returns the current load. The first reading of the CPU utilization
+// has nothing to compare to, and returns an error.
+func (h *HostLoad) Read() (float64, error) {
+	if !h.noPSI {
+		psi, err := h.fs.PSIStatsForResource("cpu")
+		if err == nil && psi.Some != nil {
+			return psi.Some.Avg10, nil
+		}
+		// The kernel is built or booted without PSI.
+		h.noPSI = true
+	}
+
+	stat, err := h.fs.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read CPU statistics: %w", err)
+	}
+	last, hasLast := h.last, h.hasLast
+	h.last, h.hasLast = stat.CPUTotal, true
+	if !hasLast {
+		return 0, errors.New("no previous CPU statistics to compare to")
+	}
+	return cpuUtilization(last, stat.CPUTotal), nil
+}
+
+func cpuUtilization(prev, cur procfs.CPUStat) float64 {
+	idle := (cur.Idle + cur.Iowait) - (prev.Idle + prev.Iowait)
+	total := cpuTime(cur) - cpuTime(prev)
+	if total <= 0 {
+		return 0
+	}
+	return 100 * (total - idle) / total
+}
+
+func cpuTime(s procfs.CPUStat) float64 {
+	// Guest times are already accounted in the user ones.
+	return s.User + s.Nice + s.System + s.Idle + s.Iowait + s.IRQ + s.SoftIRQ + s.Steal
+}
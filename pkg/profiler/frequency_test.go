@@ -0,0 +1,55 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"testing"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrequencyController(t *testing.T) {
+	_, err := NewFrequencyController(0, 19, 50, 90)
+	require.Error(t, err)
+	_, err = NewFrequencyController(20, 19, 50, 90)
+	require.Error(t, err)
+	_, err = NewFrequencyController(1, 19, 90, 50)
+	require.Error(t, err)
+
+	c, err := NewFrequencyController(3, 19, 50, 90)
+	require.NoError(t, err)
+
+	// Halved under high load, down to the minimum.
+	require.Equal(t, uint64(9), c.Next(19, 95))
+	require.Equal(t, uint64(4), c.Next(9, 95))
+	require.Equal(t, uint64(3), c.Next(4, 95))
+	require.Equal(t, uint64(3), c.Next(3, 95))
+
+	// Kept between the thresholds.
+	require.Equal(t, uint64(3), c.Next(3, 70))
+
+	// Doubled back under low load, up to the maximum.
+	require.Equal(t, uint64(6), c.Next(3, 10))
+	require.Equal(t, uint64(12), c.Next(6, 10))
+	require.Equal(t, uint64(19), c.Next(12, 10))
+	require.Equal(t, uint64(19), c.Next(19, 10))
+}
+
+func TestCPUUtilization(t *testing.T) {
+	prev := procfs.CPUStat{User: 10, System: 10, Idle: 80}
+	cur := procfs.CPUStat{User: 40, System: 20, Idle: 90, Iowait: 10}
+	require.InDelta(t, 66.67, cpuUtilization(prev, cur), 0.01)
+	require.Equal(t, 0.0, cpuUtilization(cur, cur))
+}
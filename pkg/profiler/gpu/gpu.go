@@ -0,0 +1,368 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gpu ingests GPU kernel activity reported by an on-host helper, such
+// as a CUPTI or ROCm tracer library injected in the profiled processes, and
+// turns it into profiles where the GPU kernels are the leaves of the CPU
+// stacks that launched them.
+package gpu
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/perf"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+const (
+	// Stacks deeper than this are truncated.
+	maxStackDepth = 127
+
+	profilerName = "parca_agent_gpu"
+
+	gpuMappingFile = "[gpu]"
+
+	lvSuccess = "success"
+	lvError   = "error"
+)
+
+// Record is a GPU kernel execution as reported by the helper, one JSON
+// object per line.
+type Record struct {
+	PID int `json:"pid"`
+	// Kernel is the name of the GPU kernel, e.g. the (mangled) CUDA
+	// function name.
+	Kernel string `json:"kernel"`
+	// Device is an optional identifier of the GPU that ran the kernel.
+	Device string `json:"device,omitempty"`
+	// DurationNs is how long the kernel ran on the GPU.
+	DurationNs uint64 `json:"duration_ns"`
+	// Stack holds the user space addresses of the CPU stack that launched
+	// the kernel, leaf first.
+	Stack []uint64 `json:"stack"`
+}
+
+type sampleKey struct {
+	kernel string
+	stack  string
+}
+
+type sample struct {
+	kernel     string
+	stack      []uint64
+	durationNs uint64
+}
+
+type metrics struct {
+	records        *prometheus.CounterVec
+	recordsDropped prometheus.Counter
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		records: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_gpu_records_total",
+			Help: "Total number of GPU activity records received from the helper.",
+		}, []string{"result"}),
+		recordsDropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_gpu_records_dropped_total",
+			Help: "Total number of GPU activity records dropped because too many were pending.",
+		}),
+	}
+	m.records.WithLabelValues(lvSuccess)
+	m.records.WithLabelValues(lvError)
+	return m
+}
+
+// GPU is a profiler that listens on a unix socket for GPU activity records.
+type GPU struct {
+	profiler.Status
+
+	logger  log.Logger
+	metrics *metrics
+
+	socketPath        string
+	profilingDuration time.Duration
+	maxPendingRecords int
+
+	writer *pprof.ProcessProfileWriter
+
+	// Records received in the current profiling round, per PID.
+	pendingMtx     *sync.Mutex
+	pending        map[int]map[sampleKey]*sample
+	pendingRecords int
+}
+
+func NewGPUProfiler(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	processInfoManager profiler.ProcessInfoManager,
+	addressNormalizer profiler.AddressNormalizer,
+	vdsoSymbolizer pprof.VDSOSymbolizer,
+	localSymbolizer pprof.LocalSymbolizer,
+	ksym *ksym.Ksym,
+	perfMapCache *perf.PerfMapCache,
+	jitdumpCache *perf.JitdumpCache,
+	disableJITSymbolization bool,
+	demangler *demangle.Demangler,
+	unknownFrames pprof.UnknownFramePolicy,
+	profileWriter profiler.ProfileWriter,
+	profilingDuration time.Duration,
+	socketPath string,
+) *GPU {
+	return &GPU{
+		logger:  logger,
+		metrics: newMetrics(reg),
+
+		socketPath:        socketPath,
+		profilingDuration: profilingDuration,
+		maxPendingRecords: 100_000,
+
+		writer: pprof.NewProcessProfileWriter(
+			logger,
+			profilerName,
+			processInfoManager,
+			pprof.ConverterOptions{
+				AddressNormalizer:       addressNormalizer,
+				Ksym:                    ksym,
+				VDSOSymbolizer:          vdsoSymbolizer,
+				LocalSymbolizer:         localSymbolizer,
+				PerfMapCache:            perfMapCache,
+				JitdumpCache:            jitdumpCache,
+				Metrics:                 pprof.NewConverterMetrics(reg, "gpu"),
+				DisableJITSymbolization: disableJITSymbolization,
+				Demangler:               demangler,
+				UnknownFrames:           unknownFrames,
+			},
+			profileWriter,
+			nil,
+		),
+
+		pendingMtx: &sync.Mutex{},
+		pending:    map[int]map[sampleKey]*sample{},
+	}
+}
+
+func (p *GPU) Name() string {
+	return profilerName
+}
+
+func (p *GPU) Run(ctx context.Context) error {
+	level.Debug(p.logger).Log("msg", "starting gpu profiler", "socket", p.socketPath)
+
+	// Remove a socket left behind by a previous run.
+	if err := os.Remove(p.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", p.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", p.socketPath, err)
+	}
+	defer l.Close()
+
+	go p.accept(ctx, l)
+
+	p.Start()
+
+	ticker := time.NewTicker(p.profilingDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		processLastErrors := map[int]error{}
+		for pid, samples := range p.flush() {
+			processLastErrors[pid] = nil
+			if err := p.writeProfile(ctx, pid, samples); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to write gpu profile", "pid", pid, "err", err)
+				processLastErrors[pid] = err
+			}
+		}
+		p.Report(nil, processLastErrors)
+	}
+}
+
+func (p *GPU) accept(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				level.Warn(p.logger).Log("msg", "failed to accept connection", "err", err)
+			}
+			return
+		}
+		go p.handle(ctx, conn)
+	}
+}
+
+// handle reads the records sent through a connection until it's closed.
+func (p *GPU) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			p.metrics.records.WithLabelValues(lvError).Inc()
+			level.Debug(p.logger).Log("msg", "failed to decode gpu record", "err", err)
+			continue
+		}
+		p.metrics.records.WithLabelValues(lvSuccess).Inc()
+		p.add(r)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		level.Debug(p.logger).Log("msg", "gpu helper connection failed", "err", err)
+	}
+}
+
+// add aggregates a record in the current profiling round.
+func (p *GPU) add(r Record) {
+	if r.PID <= 0 || r.Kernel == "" {
+		p.metrics.records.WithLabelValues(lvError).Inc()
+		return
+	}
+	if len(r.Stack) > maxStackDepth {
+		r.Stack = r.Stack[:maxStackDepth]
+	}
+
+	kernel := r.Kernel
+	if r.Device != "" {
+		kernel = fmt.Sprintf("%s [%s]", r.Kernel, r.Device)
+	}
+	key := sampleKey{kernel: kernel, stack: stackKey(r.Stack)}
+
+	p.pendingMtx.Lock()
+	defer p.pendingMtx.Unlock()
+
+	samples, ok := p.pending[r.PID]
+	if !ok {
+		samples = map[sampleKey]*sample{}
+		p.pending[r.PID] = samples
+	}
+	if s, ok := samples[key]; ok {
+		s.durationNs += r.DurationNs
+		return
+	}
+	if p.pendingRecords >= p.maxPendingRecords {
+		p.metrics.recordsDropped.Inc()
+		return
+	}
+	p.pendingRecords++
+	samples[key] = &sample{kernel: kernel, stack: r.Stack, durationNs: r.DurationNs}
+}
+
+// flush returns the samples of the current profiling round and starts a new
+// one.
+func (p *GPU) flush() map[int]map[sampleKey]*sample {
+	p.pendingMtx.Lock()
+	defer p.pendingMtx.Unlock()
+
+	pending := p.pending
+	p.pending = map[int]map[sampleKey]*sample{}
+	p.pendingRecords = 0
+	return pending
+}
+
+func stackKey(stack []uint64) string {
+	var b strings.Builder
+	for _, addr := range stack {
+		fmt.Fprintf(&b, "%x;", addr)
+	}
+	return b.String()
+}
+
+func (p *GPU) writeProfile(ctx context.Context, pid int, samples map[sampleKey]*sample) error {
+	rawSamples := make([]profile.RawSample, 0, len(samples))
+	kernels := make([]string, 0, len(samples))
+	for _, s := range samples {
+		rawSamples = append(rawSamples, profile.RawSample{
+			UserStack: s.stack,
+			Value:     s.durationNs,
+		})
+		kernels = append(kernels, s.kernel)
+	}
+
+	return p.writer.Write(ctx, pid, p.LastProfileStartedAt(), 1, rawSamples, func(prof *pprofprofile.Profile) {
+		addKernelFrames(prof, kernels)
+	})
+}
+
+// addKernelFrames sets the GPU sample type and adds a frame for the GPU
+// kernel as the leaf of every sample, which are in the same order as the
+// given kernel names.
+func addKernelFrames(prof *pprofprofile.Profile, kernels []string) {
+	prof.SampleType = []*pprofprofile.ValueType{{Type: "gpu", Unit: "nanoseconds"}}
+	prof.PeriodType = &pprofprofile.ValueType{Type: "gpu", Unit: "nanoseconds"}
+
+	mapping := &pprofprofile.Mapping{
+		ID:   uint64(len(prof.Mapping)) + 1,
+		File: gpuMappingFile,
+	}
+	prof.Mapping = append(prof.Mapping, mapping)
+
+	locations := map[string]*pprofprofile.Location{}
+	for i, s := range prof.Sample {
+		l, ok := locations[kernels[i]]
+		if !ok {
+			f := &pprofprofile.Function{
+				ID:   uint64(len(prof.Function)) + 1,
+				Name: kernels[i],
+			}
+			prof.Function = append(prof.Function, f)
+
+			l = &pprofprofile.Location{
+				ID:      uint64(len(prof.Location)) + 1,
+				Mapping: mapping,
+				Line:    []pprofprofile.Line{{Function: f}},
+			}
+			prof.Location = append(prof.Location, l)
+			locations[kernels[i]] = l
+		}
+
+		s.Location = append([]*pprofprofile.Location{l}, s.Location...)
+	}
+}
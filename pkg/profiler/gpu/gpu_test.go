@@ -0,0 +1,110 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gpu
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+)
+
+func newTestProfiler() *GPU {
+	return NewGPUProfiler(
+		log.NewNopLogger(),
+		prometheus.NewRegistry(),
+		nil, nil, nil, nil, nil, nil, nil, false, nil, pprof.UnknownFramesAddress, nil,
+		10*time.Second,
+		"",
+	)
+}
+
+func TestHandleAggregatesRecords(t *testing.T) {
+	p := newTestProfiler()
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.handle(context.Background(), server)
+		close(done)
+	}()
+
+	_, err := client.Write([]byte(`{"pid":42,"kernel":"sgemm","duration_ns":100,"stack":[1,2]}
+{"pid":42,"kernel":"sgemm","duration_ns":50,"stack":[1,2]}
+not json
+{"pid":42,"kernel":"sgemm","device":"0","duration_ns":7,"stack":[1,2]}
+{"pid":43,"kernel":"reduce","duration_ns":10,"stack":[3]}
+`))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	<-done
+
+	pending := p.flush()
+	require.Len(t, pending, 2)
+	require.Len(t, pending[42], 2)
+	require.Equal(t, uint64(150), pending[42][sampleKey{kernel: "sgemm", stack: stackKey([]uint64{1, 2})}].durationNs)
+	require.Equal(t, uint64(7), pending[42][sampleKey{kernel: "sgemm [0]", stack: stackKey([]uint64{1, 2})}].durationNs)
+	require.Equal(t, uint64(10), pending[43][sampleKey{kernel: "reduce", stack: stackKey([]uint64{3})}].durationNs)
+
+	require.Empty(t, p.flush())
+}
+
+func TestAddDropsRecordsOverLimit(t *testing.T) {
+	p := newTestProfiler()
+	p.maxPendingRecords = 1
+
+	p.add(Record{PID: 1, Kernel: "a", DurationNs: 1})
+	p.add(Record{PID: 1, Kernel: "b", DurationNs: 1})
+	// Already pending samples keep being aggregated.
+	p.add(Record{PID: 1, Kernel: "a", DurationNs: 1})
+
+	pending := p.flush()
+	require.Len(t, pending[1], 1)
+	require.Equal(t, uint64(2), pending[1][sampleKey{kernel: "a", stack: ""}].durationNs)
+}
+
+func TestAddKernelFrames(t *testing.T) {
+	cpuLocation := &pprofprofile.Location{ID: 1}
+	prof := &pprofprofile.Profile{
+		Mapping:  []*pprofprofile.Mapping{{ID: 1}},
+		Location: []*pprofprofile.Location{cpuLocation},
+		Sample: []*pprofprofile.Sample{
+			{Value: []int64{10}, Location: []*pprofprofile.Location{cpuLocation}},
+			{Value: []int64{20}, Location: []*pprofprofile.Location{cpuLocation}},
+			{Value: []int64{30}, Location: []*pprofprofile.Location{cpuLocation}},
+		},
+	}
+
+	addKernelFrames(prof, []string{"sgemm", "reduce", "sgemm"})
+
+	require.Equal(t, "gpu", prof.SampleType[0].Type)
+	require.Equal(t, "nanoseconds", prof.SampleType[0].Unit)
+	require.Len(t, prof.Location, 3)
+	require.Len(t, prof.Function, 2)
+
+	require.Equal(t, "sgemm", prof.Sample[0].Location[0].Line[0].Function.Name)
+	require.Equal(t, "reduce", prof.Sample[1].Location[0].Line[0].Function.Name)
+	require.Same(t, prof.Sample[0].Location[0], prof.Sample[2].Location[0])
+	require.Same(t, cpuLocation, prof.Sample[0].Location[1])
+	require.Equal(t, gpuMappingFile, prof.Sample[0].Location[0].Mapping.File)
+
+	require.NoError(t, prof.CheckValid())
+}
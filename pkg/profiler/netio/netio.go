@@ -0,0 +1,437 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package netio
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/hashicorp/go-multierror"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/parca-dev/parca-agent/pkg/byteorder"
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/perf"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+	"github.com/parca-dev/parca-agent/pkg/profiler/bpfmaps"
+	"github.com/parca-dev/parca-agent/pkg/rlimit"
+)
+
+//go:embed netio-profiler.bpf.o
+var bpfObj []byte
+
+const (
+	stackDepth = 127 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
+
+	profilerName = "parca_agent_network_io"
+
+	stackTracesMapName = "stack_traces"
+	netioMapName       = "netio"
+	inflightMapName    = "inflight"
+	tracepointCategory = "syscalls"
+
+	// Must match the DIRECTION_* values in the BPF program.
+	directionSend = 0
+	directionRecv = 1
+
+	directionLabel = "direction"
+)
+
+// syscalls are the socket syscalls that are traced. Each of them has a
+// <syscall>_enter and <syscall>_exit program.
+var syscalls = []string{"sendto", "sendmsg", "recvfrom", "recvmsg"}
+
+// netioKey mirrors the netio_key_t struct in the BPF program.
+type netioKey struct {
+	PID         int32
+	TGID        int32
+	UserStackID int32
+	Direction   int32
+}
+
+// netioValue mirrors the netio_value_t struct in the BPF program.
+type netioValue struct {
+	Bytes     uint64
+	LatencyNs uint64
+}
+
+// inflight mirrors the inflight_t struct in the BPF program.
+type inflight struct {
+	StartNs     uint64
+	UserStackID int32
+	Direction   int32
+}
+
+type userStack [stackDepth]uint64
+
+type sampleKey struct {
+	stack     userStack
+	direction int32
+}
+
+// processRawData holds the samples of a process. The values of the samples
+// are the bytes transferred, and latencies and directions are indexed like
+// them.
+type processRawData struct {
+	pid        int
+	samples    []profile.RawSample
+	latencies  []uint64
+	directions []string
+}
+
+// NetIO is a profiler that attributes the bytes transferred through socket
+// syscalls, and the time spent in them, to the user stacks that issued them.
+type NetIO struct {
+	profiler.Status
+
+	logger  log.Logger
+	reg     prometheus.Registerer
+	metrics *profiler.StackMetrics
+
+	profilingDuration time.Duration
+
+	writer *pprof.ProcessProfileWriter
+
+	stackTraces *bpf.BPFMap
+	netio       *bpf.BPFMap
+	inflight    *bpf.BPFMap
+	byteOrder   binary.ByteOrder
+
+	memlockRlimit uint64
+	btfPath       string
+}
+
+func NewNetIOProfiler(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	processInfoManager profiler.ProcessInfoManager,
+	addressNormalizer profiler.AddressNormalizer,
+	vdsoSymbolizer pprof.VDSOSymbolizer,
+	localSymbolizer pprof.LocalSymbolizer,
+	ksym *ksym.Ksym,
+	perfMapCache *perf.PerfMapCache,
+	jitdumpCache *perf.JitdumpCache,
+	disableJITSymbolization bool,
+	demangler *demangle.Demangler,
+	unknownFrames pprof.UnknownFramePolicy,
+	profileWriter profiler.ProfileWriter,
+	profilingDuration time.Duration,
+	memlockRlimit uint64,
+	btfPath string,
+) *NetIO {
+	metrics := profiler.NewStackMetrics(reg, "network_io")
+	return &NetIO{
+		logger:  logger,
+		reg:     reg,
+		metrics: metrics,
+
+		profilingDuration: profilingDuration,
+
+		writer: pprof.NewProcessProfileWriter(
+			logger,
+			profilerName,
+			processInfoManager,
+			pprof.ConverterOptions{
+				AddressNormalizer:       addressNormalizer,
+				Ksym:                    ksym,
+				VDSOSymbolizer:          vdsoSymbolizer,
+				LocalSymbolizer:         localSymbolizer,
+				PerfMapCache:            perfMapCache,
+				JitdumpCache:            jitdumpCache,
+				Metrics:                 pprof.NewConverterMetrics(reg, "network_io"),
+				DisableJITSymbolization: disableJITSymbolization,
+				Demangler:               demangler,
+				UnknownFrames:           unknownFrames,
+			},
+			profileWriter,
+			metrics,
+		),
+
+		byteOrder: byteorder.GetHostByteOrder(),
+
+		memlockRlimit: memlockRlimit,
+		btfPath:       btfPath,
+	}
+}
+
+func (p *NetIO) Name() string {
+	return profilerName
+}
+
+func (p *NetIO) loadBpfProgram() (*bpf.Module, error) {
+	m, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
+		BPFObjBuff: bpfObj,
+		BPFObjName: "parca-netio",
+		BTFObjPath: p.btfPath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new bpf module: %w", err)
+	}
+
+	// Must be called after bpf.NewModuleFromBufferArgs to avoid limit override.
+	if _, err := rlimit.BumpMemlock(p.memlockRlimit, p.memlockRlimit); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("bump memlock: %w", err)
+	}
+
+	if err := m.BPFLoadObject(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("load bpf object: %w", err)
+	}
+
+	for _, name := range syscalls {
+		for _, tp := range []struct{ program, name string }{
+			{name + "_enter", "sys_enter_" + name},
+			{name + "_exit", "sys_exit_" + name},
+		} {
+			prog, err := m.GetProgram(tp.program)
+			if err != nil {
+				m.Close()
+				return nil, fmt.Errorf("get bpf program %s: %w", tp.program, err)
+			}
+			// The link is destroyed when the module is closed.
+			if _, err := prog.AttachTracepoint(tracepointCategory, tp.name); err != nil {
+				m.Close()
+				return nil, fmt.Errorf("attach tracepoint %s: %w", tp.name, err)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func (p *NetIO) Run(ctx context.Context) error {
+	level.Debug(p.logger).Log("msg", "starting network I/O profiler")
+
+	if support, err := bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeTracepoint); !support {
+		return fmt.Errorf("tracepoint program type not supported: %w", err)
+	}
+
+	m, err := p.loadBpfProgram()
+	if err != nil {
+		return fmt.Errorf("load bpf program: %w", err)
+	}
+	defer m.Close()
+
+	p.stackTraces, err = m.GetMap(stackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get stack traces map: %w", err)
+	}
+	p.netio, err = m.GetMap(netioMapName)
+	if err != nil {
+		return fmt.Errorf("get network I/O map: %w", err)
+	}
+	p.inflight, err = m.GetMap(inflightMapName)
+	if err != nil {
+		return fmt.Errorf("get inflight map: %w", err)
+	}
+
+	p.Start()
+
+	ticker := time.NewTicker(p.profilingDuration)
+	defer ticker.Stop()
+
+	level.Debug(p.logger).Log("msg", "start profiling loop")
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		obtainStart := time.Now()
+		rawData, err := p.obtainRawData(ctx)
+		if err != nil {
+			p.metrics.ObtainAttempts.WithLabelValues(profiler.LabelError).Inc()
+			level.Warn(p.logger).Log("msg", "failed to obtain profiles from eBPF maps", "err", err)
+			continue
+		}
+		p.metrics.ObtainAttempts.WithLabelValues(profiler.LabelSuccess).Inc()
+		p.metrics.ObtainDuration.Observe(time.Since(obtainStart).Seconds())
+
+		processLastErrors := map[int]error{}
+		for _, perProcessRawData := range rawData {
+			pid := perProcessRawData.pid
+			processLastErrors[pid] = nil
+
+			if err := p.writeProfile(ctx, perProcessRawData); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to write network I/O profile", "pid", pid, "err", err)
+				processLastErrors[pid] = err
+			}
+		}
+		p.Report(nil, processLastErrors)
+	}
+}
+
+func (p *NetIO) writeProfile(ctx context.Context, data processRawData) error {
+	return p.writer.Write(ctx, data.pid, p.LastProfileStartedAt(), 1, data.samples, func(prof *pprofprofile.Profile) {
+		addLatencies(prof, data)
+	})
+}
+
+// addLatencies adds the latency as a second sample value, and the direction
+// as a sample label, to the samples of a converted profile, which are in the
+// same order as the raw samples.
+func addLatencies(prof *pprofprofile.Profile, data processRawData) {
+	prof.SampleType = []*pprofprofile.ValueType{
+		{Type: "network_io", Unit: "bytes"},
+		{Type: "network_io_latency", Unit: "nanoseconds"},
+	}
+	prof.PeriodType = &pprofprofile.ValueType{Type: "network_io", Unit: "bytes"}
+	prof.DefaultSampleType = "network_io"
+
+	for i, s := range prof.Sample {
+		s.Value = append(s.Value, int64(data.latencies[i]))
+		if s.Label == nil {
+			s.Label = make(map[string][]string, 1)
+		}
+		s.Label[directionLabel] = []string{data.directions[i]}
+	}
+}
+
+// obtainRawData collects the transferred bytes and latencies per stack from
+// the BPF maps and clears them for the next round.
+func (p *NetIO) obtainRawData(ctx context.Context) ([]processRawData, error) {
+	rawData := map[int32]map[sampleKey]netioValue{}
+
+	it := p.netio.Iterator()
+	for it.Next() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		keyBytes := it.Key()
+
+		var key netioKey
+		if err := binary.Read(bytes.NewBuffer(keyBytes), p.byteOrder, &key); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonKey).Inc()
+			return nil, fmt.Errorf("read network I/O key: %w", err)
+		}
+
+		stack := userStack{}
+		if err := bpfmaps.ReadStack(p.stackTraces, p.byteOrder, key.UserStackID, stack[:]); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonUser).Inc()
+			continue
+		}
+
+		valueBytes, err := p.netio.GetValue(unsafe.Pointer(&keyBytes[0]))
+		if err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonCount).Inc()
+			return nil, fmt.Errorf("read value: %w", err)
+		}
+		var value netioValue
+		if err := binary.Read(bytes.NewBuffer(valueBytes), p.byteOrder, &value); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonCount).Inc()
+			return nil, fmt.Errorf("read network I/O value: %w", err)
+		}
+
+		perProcessData, ok := rawData[key.PID]
+		if !ok {
+			perProcessData = map[sampleKey]netioValue{}
+			rawData[key.PID] = perProcessData
+		}
+		k := sampleKey{stack: stack, direction: key.Direction}
+		v := perProcessData[k]
+		v.Bytes += value.Bytes
+		v.LatencyNs += value.LatencyNs
+		perProcessData[k] = v
+	}
+	if it.Err() != nil {
+		p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonIterator).Inc()
+		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+	}
+
+	if err := p.cleanMaps(); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to clean BPF maps that store stacktraces", "err", err)
+	}
+
+	return preprocessRawData(rawData), nil
+}
+
+func (p *NetIO) cleanMaps() error {
+	var result error
+	if err := p.cleanStackTraces(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if _, err := bpfmaps.Clear(p.netio); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result
+}
+
+// cleanStackTraces deletes the stacks of the stack traces map but the ones of
+// the threads still inside of a socket syscall, which are only accounted once
+// it returns, so that the slowest transfers aren't lost.
+func (p *NetIO) cleanStackTraces() error {
+	return bpfmaps.CleanStackTraces(p.stackTraces, p.inflight, p.byteOrder, func(value []byte) (int32, error) {
+		var start inflight
+		if err := binary.Read(bytes.NewBuffer(value), p.byteOrder, &start); err != nil {
+			return 0, fmt.Errorf("failed to read inflight syscall: %w", err)
+		}
+		return start.UserStackID, nil
+	})
+}
+
+func directionString(direction int32) string {
+	switch direction {
+	case directionSend:
+		return "send"
+	case directionRecv:
+		return "recv"
+	default:
+		return "unknown"
+	}
+}
+
+// preprocessRawData turns the aggregated values into per process samples.
+func preprocessRawData(rawData map[int32]map[sampleKey]netioValue) []processRawData {
+	res := make([]processRawData, 0, len(rawData))
+	for pid, perProcessRawData := range rawData {
+		p := processRawData{
+			pid:        int(pid),
+			samples:    make([]profile.RawSample, 0, len(perProcessRawData)),
+			latencies:  make([]uint64, 0, len(perProcessRawData)),
+			directions: make([]string, 0, len(perProcessRawData)),
+		}
+
+		for key, value := range perProcessRawData {
+			p.samples = append(p.samples, profile.RawSample{
+				UserStack: profiler.TrimStack(key.stack[:]),
+				Value:     value.Bytes,
+			})
+			p.latencies = append(p.latencies, value.LatencyNs)
+			p.directions = append(p.directions, directionString(key.direction))
+		}
+
+		res = append(res, p)
+	}
+
+	return res
+}
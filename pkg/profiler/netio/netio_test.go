@@ -0,0 +1,69 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package netio
+
+import (
+	"testing"
+	"time"
+
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/logger"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+)
+
+// Ensures the BPF program loads and attaches in the running kernel.
+func TestLoadBpfProgram(t *testing.T) {
+	p := NewNetIOProfiler(
+		logger.NewLogger("debug", logger.LogFormatLogfmt, "parca-netio-test"),
+		prometheus.NewRegistry(),
+		nil, nil, nil, nil, nil, nil, nil, false, nil, pprof.UnknownFramesAddress, nil,
+		10*time.Second,
+		uint64(100*1024*1024),
+		"",
+	)
+
+	m, err := p.loadBpfProgram()
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	_, err = m.GetMap(netioMapName)
+	require.NoError(t, err)
+}
+
+func TestAddLatencies(t *testing.T) {
+	data := preprocessRawData(map[int32]map[sampleKey]netioValue{
+		42: {
+			sampleKey{stack: userStack{0x1, 0x2}, direction: directionSend}: {Bytes: 512, LatencyNs: 3000},
+		},
+	})
+	require.Len(t, data, 1)
+	require.Equal(t, 42, data[0].pid)
+	require.Equal(t, []uint64{0x1, 0x2}, data[0].samples[0].UserStack)
+
+	prof := &pprofprofile.Profile{
+		Sample: []*pprofprofile.Sample{{Value: []int64{512}, Label: map[string][]string{pprof.StackBoundaryLabel: {"corrected"}}}},
+	}
+	addLatencies(prof, data[0])
+
+	require.Len(t, prof.SampleType, 2)
+	require.Equal(t, []int64{512, 3000}, prof.Sample[0].Value)
+	require.Equal(t, []string{"send"}, prof.Sample[0].Label[directionLabel])
+	// The labels set by the converter are kept.
+	require.Equal(t, []string{"corrected"}, prof.Sample[0].Label[pprof.StackBoundaryLabel])
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+)
+
+// Labels of targets overriding the profiling settings of the agent, set by
+// relabeling or from the annotations of pods. They are removed from the
+// labels of profiles.
+const (
+	CPUSamplingFrequencyLabel model.LabelName = "__cpu_sampling_frequency__"
+	ProfilingDurationLabel    model.LabelName = "__profiling_duration__"
+	WallClockLabel            model.LabelName = "__wall_clock__"
+)
+
+// Annotations of pods overriding the profiling settings of their processes.
+const (
+	CPUSamplingFrequencyAnnotation = "parca.dev/cpu-sampling-frequency"
+	ProfilingDurationAnnotation    = "parca.dev/profiling-duration"
+	WallClockAnnotation            = "parca.dev/wall-clock"
+)
+
+// Overrides are the profiling settings of a target, zero when not overridden.
+type Overrides struct {
+	CPUSamplingFrequency uint64
+	ProfilingDuration    time.Duration
+	// WallClock selects the target for wall-clock profiling.
+	WallClock bool
+}
+
+// TargetOverrides returns the settings overridden by the labels of a target,
+// and its labels without them. Invalid values are reported and ignored.
+func TargetOverrides(ls model.LabelSet) (Overrides, model.LabelSet, error) {
+	var (
+		o    Overrides
+		errs error
+	)
+	frequency, hasFrequency := ls[CPUSamplingFrequencyLabel]
+	duration, hasDuration := ls[ProfilingDurationLabel]
+	wallClock, hasWallClock := ls[WallClockLabel]
+	if !hasFrequency && !hasDuration && !hasWallClock {
+		return o, ls, nil
+	}
+
+	if hasFrequency {
+		f, err := strconv.ParseUint(string(frequency), 10, 64)
+		if err != nil || f == 0 {
+			errs = errors.Join(errs, fmt.Errorf("invalid CPU sampling frequency %q", frequency))
+		} else {
+			o.CPUSamplingFrequency = f
+		}
+	}
+	if hasDuration {
+		d, err := time.ParseDuration(string(duration))
+		if err != nil || d <= 0 {
+			errs = errors.Join(errs, fmt.Errorf("invalid profiling duration %q", duration))
+		} else {
+			o.ProfilingDuration = d
+		}
+	}
+	if hasWallClock {
+		w, err := strconv.ParseBool(string(wallClock))
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("invalid wall-clock selection %q", wallClock))
+		} else {
+			o.WallClock = w
+		}
+	}
+
+	res := make(model.LabelSet, len(ls))
+	for k, v := range ls {
+		if k != CPUSamplingFrequencyLabel && k != ProfilingDurationLabel && k != WallClockLabel {
+			res[k] = v
+		}
+	}
+	return o, res, errs
+}
+
+// OverrideLabels returns the labels overriding the profiling settings of the
+// processes of a pod with the given annotations, and setting their tenant.
+func OverrideLabels(annotations map[string]string) model.LabelSet {
+	ls := model.LabelSet{}
+	if v, ok := annotations[tenant.Annotation]; ok {
+		ls[tenant.Label] = model.LabelValue(v)
+	}
+	if v, ok := annotations[CPUSamplingFrequencyAnnotation]; ok {
+		ls[CPUSamplingFrequencyLabel] = model.LabelValue(v)
+	}
+	if v, ok := annotations[ProfilingDurationAnnotation]; ok {
+		ls[ProfilingDurationLabel] = model.LabelValue(v)
+	}
+	if v, ok := annotations[WallClockAnnotation]; ok {
+		ls[WallClockLabel] = model.LabelValue(v)
+	}
+	return ls
+}
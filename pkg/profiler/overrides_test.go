@@ -0,0 +1,58 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/tenant"
+)
+
+func TestTargetOverrides(t *testing.T) {
+	ls := model.LabelSet{"pod": "checkout"}
+	o, res, err := TargetOverrides(ls)
+	require.NoError(t, err)
+	require.Equal(t, Overrides{}, o)
+	require.Equal(t, ls, res)
+
+	o, res, err = TargetOverrides(ls.Merge(OverrideLabels(map[string]string{
+		CPUSamplingFrequencyAnnotation: "49",
+		ProfilingDurationAnnotation:    "1m",
+		WallClockAnnotation:            "true",
+		"team":                         "payments",
+	})))
+	require.NoError(t, err)
+	require.Equal(t, Overrides{CPUSamplingFrequency: 49, ProfilingDuration: time.Minute, WallClock: true}, o)
+	require.Equal(t, ls, res)
+
+	// The tenant is kept for the profile writers.
+	_, res, err = TargetOverrides(ls.Merge(OverrideLabels(map[string]string{tenant.Annotation: "team-a"})))
+	require.NoError(t, err)
+	require.Equal(t, ls.Merge(model.LabelSet{tenant.Label: "team-a"}), res)
+
+	// Invalid values are ignored, but still removed.
+	o, res, err = TargetOverrides(ls.Merge(model.LabelSet{
+		CPUSamplingFrequencyLabel: "0",
+		ProfilingDurationLabel:    "30s",
+		WallClockLabel:            "sometimes",
+	}))
+	require.ErrorContains(t, err, `invalid CPU sampling frequency "0"`)
+	require.ErrorContains(t, err, `invalid wall-clock selection "sometimes"`)
+	require.Equal(t, Overrides{ProfilingDuration: 30 * time.Second}, o)
+	require.Equal(t, ls, res)
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PerfEvent is a hardware event the CPU profiler samples on in addition to
+// the CPU clock, once every period occurrences of it.
+type PerfEvent struct {
+	// Name is the perf name of the event, which is also the sample type of
+	// its profiles.
+	Name   string
+	Type   uint32
+	Config uint64
+	Period uint64
+}
+
+// perfEventConfig is how an event is opened with perf_event_open(2).
+type perfEventConfig struct {
+	typ    uint32
+	config uint64
+}
+
+// PerfEventNames returns the names of the supported events.
+func PerfEventNames() []string {
+	names := make([]string, 0, len(perfEvents))
+	for name := range perfEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePerfEvents parses events given as <name>@<period>, e.g.
+// instructions@1000000.
+func ParsePerfEvents(specs []string) ([]PerfEvent, error) {
+	res := make([]PerfEvent, 0, len(specs))
+	seen := map[string]struct{}{}
+	for _, spec := range specs {
+		name, period, ok := strings.Cut(spec, "@")
+		if !ok {
+			return nil, fmt.Errorf("invalid perf event %q, expected <name>@<period>", spec)
+		}
+		e, ok := perfEvents[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported perf event %q, expected one of %s", name, strings.Join(PerfEventNames(), ", "))
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("perf event %q given more than once", name)
+		}
+		seen[name] = struct{}{}
+		p, err := strconv.ParseUint(period, 10, 64)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid period %q of perf event %q, expected a positive number of events", period, name)
+		}
+		res = append(res, PerfEvent{Name: name, Type: e.typ, Config: e.config, Period: p})
+	}
+	return res, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParsePerfEvents(t *testing.T) {
+	events, err := ParsePerfEvents([]string{"instructions@1000000", "LLC-load-misses@10000"})
+	require.NoError(t, err)
+	require.Equal(t, []PerfEvent{
+		{Name: "instructions", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_INSTRUCTIONS, Period: 1000000},
+		{Name: "LLC-load-misses", Type: unix.PERF_TYPE_HW_CACHE, Config: 0x10002, Period: 10000},
+	}, events)
+
+	for spec, msg := range map[string]string{
+		"instructions":        "expected <name>@<period>",
+		"page-faults@100":     "unsupported perf event",
+		"cache-misses@0":      "invalid period",
+		"branch-misses@often": "invalid period",
+	} {
+		_, err := ParsePerfEvents([]string{spec})
+		require.ErrorContains(t, err, msg, spec)
+	}
+
+	_, err = ParsePerfEvents([]string{"cycles@1000", "cycles@2000"})
+	require.ErrorContains(t, err, "more than once")
+}
@@ -17,9 +17,12 @@ package profiler
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,31 +36,122 @@ import (
 
 // TODO(kakkoyun): refactor: Remove reference to pprof.Profile.
 
+// localStoreTimeFormat is sortable and safe to use in file names.
+const localStoreTimeFormat = "20060102T150405.000000000Z"
+
 // FileProfileWriter writes profiles to a local file.
 type FileProfileWriter struct {
-	dir string
+	logger log.Logger
+	dir    string
+	// retention is how long profiles are kept, they are kept forever when
+	// it is zero.
+	retention time.Duration
 }
 
 // NewFileProfileWriter creates a new FileProfileWriter.
-func NewFileProfileWriter(dirPath string) *FileProfileWriter {
-	return &FileProfileWriter{dir: dirPath}
+func NewFileProfileWriter(logger log.Logger, dirPath string, retention time.Duration) *FileProfileWriter {
+	return &FileProfileWriter{
+		logger:    logger,
+		dir:       dirPath,
+		retention: retention,
+	}
 }
 
+// Write stores the profile in a file named after the PID, the profile type
+// and the time it was written, e.g. 42_parca_agent_cpu_20230612T101500.000000000Z.pb.gz.
 func (fw *FileProfileWriter) Write(_ context.Context, labels model.LabelSet, prof *profile.Profile) error {
-	path := fmt.Sprintf("%s_%s_%03d.pb.gz", string(labels["pid"]), string(labels["__name__"]), time.Now().UnixNano())
+	name := fmt.Sprintf("%s_%s_%s.pb.gz", string(labels["pid"]), string(labels["__name__"]), time.Now().UTC().Format(localStoreTimeFormat))
 
 	if err := os.MkdirAll(fw.dir, 0o755); err != nil {
 		return fmt.Errorf("could not use temp dir, %s: %w", fw.dir, err)
 	}
 
-	f, err := os.OpenFile(filepath.Join(fw.dir, path), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	// Write to a temporary file first, so readers never observe partial
+	// profiles.
+	f, err := os.CreateTemp(fw.dir, ".tmp-*")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create temporary file: %w", err)
 	}
+	defer os.Remove(f.Name())
+
 	if err := prof.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(fw.dir, name)); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
+
+// Run removes the profiles that are older than the retention until the
+// context is canceled.
+func (fw *FileProfileWriter) Run(ctx context.Context) error {
+	if fw.retention <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	interval := fw.retention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > 10*time.Minute {
+		interval = 10 * time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fw.cleanup(time.Now()); err != nil {
+			level.Warn(fw.logger).Log("msg", "failed to clean up local profiles", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanup removes the profiles written before the retention relative to now.
+func (fw *FileProfileWriter) cleanup(now time.Time) error {
+	entries, err := os.ReadDir(fw.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
 
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pb.gz") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) <= fw.retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(fw.dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			level.Debug(fw.logger).Log("msg", "failed to remove local profile", "file", e.Name(), "err", err)
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		level.Debug(fw.logger).Log("msg", "removed local profiles past their retention", "count", removed)
+	}
 	return nil
 }
 
@@ -68,10 +162,13 @@ type RemoteProfileWriter struct {
 	pool sync.Pool
 	// isNormalized indicates whether sampled addresses are normalized by the agent.
 	isNormalized bool
+	// uncompressed indicates whether profiles are sent uncompressed, because
+	// the requests they are batched in are compressed as a whole.
+	uncompressed bool
 }
 
 // NewRemoteProfileWriter creates a new RemoteProfileWriter.
-func NewRemoteProfileWriter(logger log.Logger, profileStoreClient profilestorepb.ProfileStoreServiceClient, isNormalized bool) *RemoteProfileWriter {
+func NewRemoteProfileWriter(logger log.Logger, profileStoreClient profilestorepb.ProfileStoreServiceClient, isNormalized, uncompressed bool) *RemoteProfileWriter {
 	return &RemoteProfileWriter{
 		profileStoreClient: profileStoreClient,
 		pool: sync.Pool{New: func() interface{} {
@@ -83,21 +180,28 @@ func NewRemoteProfileWriter(logger log.Logger, profileStoreClient profilestorepb
 			return z
 		}},
 		isNormalized: isNormalized,
+		uncompressed: uncompressed,
 	}
 }
 
 // Write sends the profile using the designated write client.
 func (rw *RemoteProfileWriter) Write(ctx context.Context, labels model.LabelSet, prof *profile.Profile) error {
 	buf := bytes.NewBuffer(nil)
-	zw := rw.pool.Get().(*gzip.Writer) //nolint:forcetypeassert
-	zw.Reset(buf)
-	if err := prof.WriteUncompressed(zw); err != nil {
+	if rw.uncompressed {
+		if err := prof.WriteUncompressed(buf); err != nil {
+			return err
+		}
+	} else {
+		zw := rw.pool.Get().(*gzip.Writer) //nolint:forcetypeassert
+		zw.Reset(buf)
+		if err := prof.WriteUncompressed(zw); err != nil {
+			zw.Close()
+			rw.pool.Put(zw)
+			return err
+		}
 		zw.Close()
 		rw.pool.Put(zw)
-		return err
 	}
-	zw.Close()
-	rw.pool.Put(zw)
 
 	_, err := rw.profileStoreClient.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
 		Normalized: rw.isNormalized,
@@ -112,6 +216,8 @@ func (rw *RemoteProfileWriter) Write(ctx context.Context, labels model.LabelSet,
 	return err
 }
 
+// convertLabels returns the labels sorted by name, so equal label sets
+// convert to equal label lists.
 func convertLabels(labels model.LabelSet) []*profilestorepb.Label {
 	newLabels := make([]*profilestorepb.Label, 0, len(labels))
 	for key, value := range labels {
@@ -120,5 +226,6 @@ func convertLabels(labels model.LabelSet) []*profilestorepb.Label {
 			Value: string(value),
 		})
 	}
+	sort.Slice(newLabels, func(i, j int) bool { return newLabels[i].Name < newLabels[j].Name })
 	return newLabels
 }
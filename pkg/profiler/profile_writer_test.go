@@ -0,0 +1,67 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileProfileWriter(t *testing.T) {
+	dir := t.TempDir()
+	fw := NewFileProfileWriter(log.NewNopLogger(), dir, time.Hour)
+
+	labels := model.LabelSet{"pid": "42", "__name__": "parca_agent_cpu"}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+	}
+	require.NoError(t, fw.Write(context.Background(), labels, prof))
+	require.NoError(t, fw.Write(context.Background(), labels, prof))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		require.True(t, strings.HasPrefix(e.Name(), "42_parca_agent_cpu_"), e.Name())
+		require.True(t, strings.HasSuffix(e.Name(), ".pb.gz"), e.Name())
+
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		require.NoError(t, err)
+		_, err = profile.Parse(f)
+		f.Close()
+		require.NoError(t, err)
+	}
+
+	// Age one of the profiles past the retention.
+	old := filepath.Join(dir, entries[0].Name())
+	past := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(old, past, past))
+
+	require.NoError(t, fw.cleanup(time.Now()))
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NotEqual(t, filepath.Base(old), entries[0].Name())
+}
@@ -16,6 +16,7 @@ package profiler
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/pprof/profile"
 	"github.com/prometheus/common/model"
@@ -122,6 +123,12 @@ type ProcessInfoManager interface {
 	Info(ctx context.Context, pid int) (*process.Info, error)
 }
 
+// Labeler returns the labels of a process after relabeling, or nil if the
+// process is dropped.
+type Labeler interface {
+	LabelSet(ctx context.Context, pid int) (model.LabelSet, error)
+}
+
 type AddressNormalizer interface {
 	Normalize(m *process.Mapping, addr uint64) (uint64, error)
 }
@@ -135,3 +142,8 @@ type Symbolizer interface {
 type ProfileWriter interface {
 	Write(ctx context.Context, labels model.LabelSet, prof *profile.Profile) error
 }
+
+// Capturer is implemented by profilers that can profile a process on demand.
+type Capturer interface {
+	Capture(ctx context.Context, pid int, duration time.Duration) (*profile.Profile, error)
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+type rollupMetrics struct {
+	merged  prometheus.Counter
+	written prometheus.Counter
+	pending prometheus.Gauge
+}
+
+func newRollupMetrics(reg prometheus.Registerer) *rollupMetrics {
+	return &rollupMetrics{
+		merged: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_profile_rollup_merged_total",
+			Help: "Total number of profiles merged into rolled up profiles.",
+		}),
+		written: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_profile_rollup_written_total",
+			Help: "Total number of rolled up profiles written.",
+		}),
+		pending: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_profile_rollup_pending",
+			Help: "Number of profile series with profiles waiting to be rolled up.",
+		}),
+	}
+}
+
+// rollup is the profile of a series being rolled up.
+type rollup struct {
+	labels    model.LabelSet
+	prof      *profile.Profile
+	intervals int
+	startedAt time.Time
+}
+
+// RollupProfileWriter merges the profiles of the same series written in
+// successive profiling intervals into a single profile, which is written to
+// the next writer once it covers the configured number of intervals. It
+// trades time resolution for fewer, larger writes.
+type RollupProfileWriter struct {
+	logger    log.Logger
+	metrics   *rollupMetrics
+	next      ProfileWriter
+	intervals int
+	// maxAge is how long the profiles of a series that stopped being written,
+	// e.g. whose process exited, are held before they are written anyway.
+	maxAge time.Duration
+
+	mtx     sync.Mutex
+	rollups map[model.Fingerprint]*rollup
+}
+
+// NewRollupProfileWriter creates a RollupProfileWriter merging the given
+// number of profiling intervals, each lasting profilingDuration.
+func NewRollupProfileWriter(logger log.Logger, reg prometheus.Registerer, next ProfileWriter, intervals int, profilingDuration time.Duration) *RollupProfileWriter {
+	return &RollupProfileWriter{
+		logger:    logger,
+		metrics:   newRollupMetrics(reg),
+		next:      next,
+		intervals: intervals,
+		// One interval of slack, as the profiles aren't written exactly
+		// every profiling duration.
+		maxAge:  time.Duration(intervals+1) * profilingDuration,
+		rollups: map[model.Fingerprint]*rollup{},
+	}
+}
+
+// Write merges the profile into the profile of its series, which is written
+// once it covers enough intervals.
+func (rw *RollupProfileWriter) Write(ctx context.Context, labels model.LabelSet, prof *profile.Profile) error {
+	key := labels.Fingerprint()
+
+	rw.mtx.Lock()
+	r, ok := rw.rollups[key]
+	var incompatible *rollup
+	if ok {
+		merged, err := profile.Merge([]*profile.Profile{r.prof, prof})
+		if err != nil {
+			// The profile type of the series changed, e.g. its sampling
+			// period: the profiles so far are written as they are.
+			delete(rw.rollups, key)
+			incompatible, ok = r, false
+		} else {
+			r.prof = merged
+			r.labels = labels
+			r.intervals++
+		}
+	}
+	if !ok {
+		r = &rollup{labels: labels, prof: prof, intervals: 1, startedAt: time.Now()}
+		rw.rollups[key] = r
+	}
+	rw.metrics.merged.Inc()
+
+	var done *rollup
+	if r.intervals >= rw.intervals {
+		delete(rw.rollups, key)
+		done = r
+	}
+	rw.metrics.pending.Set(float64(len(rw.rollups)))
+	rw.mtx.Unlock()
+
+	if incompatible != nil {
+		if err := rw.write(ctx, incompatible); err != nil {
+			level.Warn(rw.logger).Log("msg", "failed to write rolled up profile", "err", err)
+		}
+	}
+	if done != nil {
+		return rw.write(ctx, done)
+	}
+	return nil
+}
+
+func (rw *RollupProfileWriter) write(ctx context.Context, r *rollup) error {
+	rw.metrics.written.Inc()
+	return rw.next.Write(ctx, r.labels, r.prof)
+}
+
+// Run writes the profiles of the series that stopped being written once
+// they are too old, and all the pending ones once the context is canceled.
+func (rw *RollupProfileWriter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(rw.maxAge / time.Duration(rw.intervals+1))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The context of the agent is canceled, the pending profiles
+			// are written on their own before they are lost.
+			rw.flush(context.Background(), time.Time{})
+			return nil
+		case now := <-ticker.C:
+			rw.flush(ctx, now.Add(-rw.maxAge))
+		}
+	}
+}
+
+// flush writes the pending profiles started before the given time, all of
+// them when it is zero.
+func (rw *RollupProfileWriter) flush(ctx context.Context, before time.Time) {
+	rw.mtx.Lock()
+	var expired []*rollup
+	for key, r := range rw.rollups {
+		if before.IsZero() || r.startedAt.Before(before) {
+			expired = append(expired, r)
+			delete(rw.rollups, key)
+		}
+	}
+	rw.metrics.pending.Set(float64(len(rw.rollups)))
+	rw.mtx.Unlock()
+
+	for _, r := range expired {
+		if err := rw.write(ctx, r); err != nil {
+			level.Warn(rw.logger).Log("msg", "failed to write rolled up profile", "intervals", r.intervals, "err", err)
+		}
+	}
+}
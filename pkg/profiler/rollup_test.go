@@ -0,0 +1,92 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+type writtenProfile struct {
+	labels model.LabelSet
+	prof   *profile.Profile
+}
+
+type recordingProfileWriter struct {
+	written []writtenProfile
+}
+
+func (w *recordingProfileWriter) Write(_ context.Context, labels model.LabelSet, prof *profile.Profile) error {
+	w.written = append(w.written, writtenProfile{labels, prof})
+	return nil
+}
+
+func rollupTestProfile(periodType string, value int64) *profile.Profile {
+	fn := &profile.Function{ID: 1, Name: "main"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	return &profile.Profile{
+		SampleType:    []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType:    &profile.ValueType{Type: periodType, Unit: "nanoseconds"},
+		Period:        1,
+		DurationNanos: int64(10 * time.Second),
+		Sample:        []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+		Location:      []*profile.Location{loc},
+		Function:      []*profile.Function{fn},
+	}
+}
+
+func TestRollupProfileWriter(t *testing.T) {
+	ctx := context.Background()
+	next := &recordingProfileWriter{}
+	rw := NewRollupProfileWriter(log.NewNopLogger(), prometheus.NewRegistry(), next, 3, 10*time.Second)
+
+	a := model.LabelSet{"pid": "1", "__name__": "parca_agent_cpu"}
+	b := model.LabelSet{"pid": "2", "__name__": "parca_agent_cpu"}
+
+	require.NoError(t, rw.Write(ctx, a, rollupTestProfile("cpu", 1)))
+	require.NoError(t, rw.Write(ctx, b, rollupTestProfile("cpu", 5)))
+	require.NoError(t, rw.Write(ctx, a, rollupTestProfile("cpu", 2)))
+	require.Empty(t, next.written)
+
+	// The third interval of the series completes its profile.
+	require.NoError(t, rw.Write(ctx, a, rollupTestProfile("cpu", 3)))
+	require.Len(t, next.written, 1)
+	require.Equal(t, a, next.written[0].labels)
+	prof := next.written[0].prof
+	require.Len(t, prof.Sample, 1)
+	require.Equal(t, []int64{6}, prof.Sample[0].Value)
+	require.Equal(t, int64(30*time.Second), prof.DurationNanos)
+
+	// Profiles that can't be merged are written as they are.
+	require.NoError(t, rw.Write(ctx, b, rollupTestProfile("wall", 7)))
+	require.Len(t, next.written, 2)
+	require.Equal(t, b, next.written[1].labels)
+	require.Equal(t, []int64{5}, next.written[1].prof.Sample[0].Value)
+
+	// The series that stopped being written are written once too old.
+	rw.flush(ctx, time.Now().Add(-time.Hour))
+	require.Len(t, next.written, 2)
+	rw.flush(ctx, time.Now().Add(time.Second))
+	require.Len(t, next.written, 3)
+	require.Equal(t, b, next.written[2].labels)
+	require.Equal(t, "wall", next.written[2].prof.PeriodType.Type)
+	require.Empty(t, rw.rollups)
+}
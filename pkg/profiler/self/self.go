@@ -0,0 +1,198 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package self profiles the agent itself with runtime/pprof, and writes the
+// profiles along with the ones of the profiled processes, so regressions in
+// the overhead of the agent are visible in Parca.
+package self
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/metadata/labels"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+const (
+	// Job is the job label of the profiles of the agent.
+	Job = "parca-agent-self"
+
+	// The names of the profiles follow the ones Parca gives to the profiles
+	// it scrapes from Go programs.
+	cpuProfileName  = "process_cpu"
+	heapProfileName = "memory"
+)
+
+// Self is a profiler that captures the CPU and heap profiles of the agent.
+type Self struct {
+	logger log.Logger
+
+	mtx *sync.RWMutex
+
+	profileWriter     profiler.ProfileWriter
+	labels            model.LabelSet
+	profilingDuration time.Duration
+	interval          time.Duration
+
+	lastError            error
+	lastProfileStartedAt time.Time
+}
+
+// NewSelfProfiler returns a profiler that captures the CPU profile of the
+// agent for the profiling duration, followed by its heap profile, every
+// interval. The profiles are labeled with the node, the external labels and
+// the job parca-agent-self.
+func NewSelfProfiler(
+	logger log.Logger,
+	profileWriter profiler.ProfileWriter,
+	node string,
+	externalLabels map[string]string,
+	profilingDuration time.Duration,
+	interval time.Duration,
+) *Self {
+	ls := model.LabelSet{}
+	for k, v := range externalLabels {
+		ls[model.LabelName(k)] = model.LabelValue(v)
+	}
+	ls["node"] = model.LabelValue(node)
+	ls["pid"] = model.LabelValue(strconv.Itoa(os.Getpid()))
+	ls[model.JobLabel] = Job
+
+	return &Self{
+		logger: logger,
+
+		mtx: &sync.RWMutex{},
+
+		profileWriter:     profileWriter,
+		labels:            ls,
+		profilingDuration: profilingDuration,
+		interval:          interval,
+	}
+}
+
+func (p *Self) Name() string {
+	return "parca_agent_self"
+}
+
+func (p *Self) LastProfileStartedAt() time.Time {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.lastProfileStartedAt
+}
+
+func (p *Self) LastError() error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.lastError
+}
+
+func (p *Self) ProcessLastErrors() map[int]error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return map[int]error{os.Getpid(): p.lastError}
+}
+
+func (p *Self) Run(ctx context.Context) error {
+	level.Debug(p.logger).Log("msg", "starting self profiler", "interval", p.interval)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		err := p.profile(ctx)
+		if err != nil && ctx.Err() == nil {
+			level.Warn(p.logger).Log("msg", "failed to profile the agent", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// profile captures and writes the CPU and heap profiles of the agent.
+func (p *Self) profile(ctx context.Context) (err error) {
+	p.mtx.Lock()
+	p.lastProfileStartedAt = time.Now()
+	p.mtx.Unlock()
+	defer func() {
+		p.mtx.Lock()
+		p.lastError = err
+		p.mtx.Unlock()
+	}()
+
+	prof, err := p.cpuProfile(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to capture the CPU profile: %w", err)
+	}
+	if err := p.write(ctx, cpuProfileName, prof); err != nil {
+		return err
+	}
+
+	prof, err = lookupProfile("heap")
+	if err != nil {
+		return fmt.Errorf("failed to capture the heap profile: %w", err)
+	}
+	return p.write(ctx, heapProfileName, prof)
+}
+
+// cpuProfile profiles the CPU usage of the agent for the profiling duration.
+// It fails when the CPU is already profiled, e.g. through /debug/pprof.
+func (p *Self) cpuProfile(ctx context.Context) (*profile.Profile, error) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(p.profilingDuration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	pprof.StopCPUProfile()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return profile.Parse(&buf)
+}
+
+func lookupProfile(name string) (*profile.Profile, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	return profile.Parse(&buf)
+}
+
+func (p *Self) write(ctx context.Context, name string, prof *profile.Profile) error {
+	if err := p.profileWriter.Write(ctx, labels.WithProfilerName(p.labels, name), prof); err != nil {
+		return fmt.Errorf("failed to write the %s profile: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package self
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+type profileWriter struct {
+	labels   []model.LabelSet
+	profiles []*profile.Profile
+}
+
+func (w *profileWriter) Write(_ context.Context, labels model.LabelSet, prof *profile.Profile) error {
+	w.labels = append(w.labels, labels)
+	w.profiles = append(w.profiles, prof)
+	return nil
+}
+
+func TestProfile(t *testing.T) {
+	w := &profileWriter{}
+	p := NewSelfProfiler(log.NewNopLogger(), w, "node-1", map[string]string{"cluster": "test"}, 100*time.Millisecond, time.Minute)
+
+	require.NoError(t, p.profile(context.Background()))
+	require.NoError(t, p.LastError())
+
+	require.Len(t, w.labels, 2)
+	for i, name := range []model.LabelValue{cpuProfileName, heapProfileName} {
+		require.Equal(t, name, w.labels[i]["__name__"])
+		require.Equal(t, model.LabelValue(Job), w.labels[i]["job"])
+		require.Equal(t, model.LabelValue("node-1"), w.labels[i]["node"])
+		require.Equal(t, model.LabelValue("test"), w.labels[i]["cluster"])
+	}
+	require.Equal(t, "cpu", w.profiles[0].SampleType[1].Type)
+	require.Equal(t, "inuse_space", w.profiles[1].SampleType[3].Type)
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Label values of the metrics of the profilers aggregating stacks in BPF maps.
+const (
+	LabelError   = "error"
+	LabelSuccess = "success"
+
+	StackDropReasonKey      = "read_stack_key"
+	StackDropReasonUser     = "read_user_stack_with_frame_pointer"
+	StackDropReasonCount    = "read_stack_count"
+	StackDropReasonIterator = "iterator"
+
+	ProfileDropReasonProcessInfo = "process_info"
+)
+
+// StackMetrics are the metrics of the profilers aggregating stacks in BPF
+// maps, such as the contention, network I/O and wall-clock ones.
+type StackMetrics struct {
+	ObtainAttempts *prometheus.CounterVec
+	ObtainDuration prometheus.Histogram
+	ProfileDrop    *prometheus.CounterVec
+	StackDrop      *prometheus.CounterVec
+}
+
+// NewStackMetrics registers the metrics of a profiler, told apart from the
+// other ones by the given type label.
+func NewStackMetrics(reg prometheus.Registerer, profilerType string) *StackMetrics {
+	m := &StackMetrics{
+		ObtainAttempts: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_attempts_total",
+				Help:        "Total number of attempts to obtain a profile.",
+				ConstLabels: map[string]string{"type": profilerType},
+			},
+			[]string{"status"},
+		),
+		ObtainDuration: promauto.With(reg).NewHistogram(
+			prometheus.HistogramOpts{
+				Name:                        "parca_agent_profiler_attempt_duration_seconds",
+				Help:                        "The duration it takes to collect profiles from the BPF maps",
+				ConstLabels:                 map[string]string{"type": profilerType},
+				NativeHistogramBucketFactor: 1.1,
+			},
+		),
+		StackDrop: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_stack_drop_total",
+				Help:        "Total number of stacks dropped from the profile.",
+				ConstLabels: map[string]string{"type": profilerType},
+			},
+			[]string{"reason"},
+		),
+		ProfileDrop: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_profiles_drop_total",
+				Help:        "Number of profiles dropped from the profile (one profile represents 1 process in a profiling duration).",
+				ConstLabels: map[string]string{"type": profilerType},
+			},
+			[]string{"reason"},
+		),
+	}
+	m.ObtainAttempts.WithLabelValues(LabelSuccess)
+	m.ObtainAttempts.WithLabelValues(LabelError)
+
+	m.StackDrop.WithLabelValues(StackDropReasonKey)
+	m.StackDrop.WithLabelValues(StackDropReasonUser)
+	m.StackDrop.WithLabelValues(StackDropReasonCount)
+	m.StackDrop.WithLabelValues(StackDropReasonIterator)
+
+	m.ProfileDrop.WithLabelValues(ProfileDropReasonProcessInfo)
+
+	return m
+}
+
+// TrimStack returns a copy of the addresses of a fixed size stack buffer up
+// to the first zero one.
+func TrimStack(stack []uint64) []uint64 {
+	depth := 0
+	for _, addr := range stack {
+		if addr == 0 {
+			break
+		}
+		depth++
+	}
+
+	res := make([]uint64, depth)
+	copy(res, stack[:depth])
+	return res
+}
+
+// UnreferencedStackIDs returns the given stack IDs but the referenced ones.
+func UnreferencedStackIDs(stackIDs []int32, referenced map[int32]struct{}) []int32 {
+	res := make([]int32, 0, len(stackIDs))
+	for _, id := range stackIDs {
+		if _, ok := referenced[id]; !ok {
+			res = append(res, id)
+		}
+	}
+	return res
+}
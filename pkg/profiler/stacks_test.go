@@ -0,0 +1,41 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrimStack(t *testing.T) {
+	var stack [8]uint64
+	stack[0], stack[1], stack[2] = 0x1, 0x2, 0x3
+	stack[4] = 0x4
+
+	trimmed := TrimStack(stack[:])
+	require.Equal(t, []uint64{0x1, 0x2, 0x3}, trimmed)
+
+	// The result doesn't share the buffer, which is reused for the next stack.
+	stack[0] = 0x5
+	require.Equal(t, uint64(0x1), trimmed[0])
+
+	require.Empty(t, TrimStack(nil))
+}
+
+func TestUnreferencedStackIDs(t *testing.T) {
+	// The stacks of the threads still waiting are kept.
+	require.Equal(t, []int32{1, 3}, UnreferencedStackIDs([]int32{1, 2, 3, 4}, map[int32]struct{}{2: {}, 4: {}, 5: {}}))
+	require.Empty(t, UnreferencedStackIDs(nil, nil))
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"sync"
+	"time"
+)
+
+// Status keeps the outcome of the last profiling round of a profiler, and
+// implements the LastProfileStartedAt, LastError and ProcessLastErrors methods
+// of the profilers embedding it.
+type Status struct {
+	mtx sync.RWMutex
+
+	lastError            error
+	processLastErrors    map[int]error
+	lastProfileStartedAt time.Time
+}
+
+func (s *Status) LastProfileStartedAt() time.Time {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastProfileStartedAt
+}
+
+func (s *Status) LastError() error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastError
+}
+
+func (s *Status) ProcessLastErrors() map[int]error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.processLastErrors
+}
+
+// Start marks the start of the first profiling round.
+func (s *Status) Start() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastProfileStartedAt = time.Now()
+}
+
+// Report records the outcome of a profiling round, and starts the next one
+// unless it failed.
+func (s *Status) Report(lastError error, processLastErrors map[int]error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if lastError == nil {
+		s.lastProfileStartedAt = time.Now()
+	}
+	s.lastError = lastError
+	s.processLastErrors = processLastErrors
+}
@@ -0,0 +1,190 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxUnwindFailureSamples is the number of the most recent failures kept per
+// binary.
+const maxUnwindFailureSamples = 16
+
+// UnwindFailure is a failure of the unwinder sampled in a binary.
+type UnwindFailure struct {
+	PID     int    `json:"pid"`
+	BuildID string `json:"build_id,omitempty"`
+	File    string `json:"file"`
+	// Address is the address the unwinder failed at, normalized to the
+	// binary when it is known.
+	Address uint64 `json:"address"`
+	Reason  string `json:"reason"`
+	// Count is the number of times the unwinder failed there since it was
+	// last sampled.
+	Count uint64    `json:"count"`
+	Time  time.Time `json:"time"`
+}
+
+var descUnwindFailures = prometheus.NewDesc(
+	"parca_agent_unwind_failures_sampled_total",
+	"Total number of sampled unwinder failures of a binary by their reason.",
+	[]string{"build_id", "file", "reason"}, nil,
+)
+
+// UnwindFailures tracks the failures of the unwinder sampled in the most
+// recently failing binaries, so unwinder bugs can be pinpointed per binary.
+// It is a collector of the metrics of each binary.
+type UnwindFailures struct {
+	mtx         sync.Mutex
+	binaries    map[string]*binaryUnwindFailures
+	maxBinaries int
+}
+
+type binaryUnwindFailures struct {
+	buildID string
+	file    string
+	counts  map[string]uint64
+	// recent are the most recent failures, oldest first.
+	recent     []UnwindFailure
+	lastFailed time.Time
+}
+
+// NewUnwindFailures returns the unwinder failures of up to the given number
+// of binaries, registered with the given registerer. The binaries that
+// failed the least recently are forgotten to make room for new ones.
+func NewUnwindFailures(reg prometheus.Registerer, maxBinaries int) *UnwindFailures {
+	f := &UnwindFailures{
+		binaries:    map[string]*binaryUnwindFailures{},
+		maxBinaries: maxBinaries,
+	}
+	if reg != nil {
+		reg.MustRegister(f)
+	}
+	return f
+}
+
+// Record adds the given sampled failures.
+func (f *UnwindFailures) Record(failures []UnwindFailure) {
+	if f == nil || len(failures) == 0 {
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for _, failure := range failures {
+		// Binaries are identified by their build ID, or by their file when
+		// they have none.
+		key := failure.BuildID
+		if key == "" {
+			key = failure.File
+		}
+		b, ok := f.binaries[key]
+		if !ok {
+			if len(f.binaries) >= f.maxBinaries {
+				f.evictLeastRecent()
+			}
+			b = &binaryUnwindFailures{buildID: failure.BuildID, file: failure.File, counts: map[string]uint64{}}
+			f.binaries[key] = b
+		}
+		b.counts[failure.Reason] += failure.Count
+		if len(b.recent) == maxUnwindFailureSamples {
+			copy(b.recent, b.recent[1:])
+			b.recent = b.recent[:len(b.recent)-1]
+		}
+		b.recent = append(b.recent, failure)
+		b.lastFailed = failure.Time
+	}
+}
+
+func (f *UnwindFailures) evictLeastRecent() {
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, b := range f.binaries {
+		if oldest.IsZero() || b.lastFailed.Before(oldest) {
+			oldestKey, oldest = key, b.lastFailed
+		}
+	}
+	delete(f.binaries, oldestKey)
+}
+
+// BinaryUnwindFailures are the unwinder failures sampled in a binary.
+type BinaryUnwindFailures struct {
+	BuildID string `json:"build_id,omitempty"`
+	File    string `json:"file"`
+	// Number of failures by their reason.
+	Counts map[string]uint64 `json:"counts"`
+	// The most recent failures, newest first.
+	Recent []UnwindFailure `json:"recent"`
+}
+
+// Binaries returns the failures of the binaries, the ones failing the most
+// first.
+func (f *UnwindFailures) Binaries() []BinaryUnwindFailures {
+	if f == nil {
+		return []BinaryUnwindFailures{}
+	}
+
+	f.mtx.Lock()
+	res := make([]BinaryUnwindFailures, 0, len(f.binaries))
+	for _, b := range f.binaries {
+		bf := BinaryUnwindFailures{
+			BuildID: b.buildID,
+			File:    b.file,
+			Counts:  make(map[string]uint64, len(b.counts)),
+			Recent:  make([]UnwindFailure, 0, len(b.recent)),
+		}
+		for reason, n := range b.counts {
+			bf.Counts[reason] = n
+		}
+		for i := len(b.recent) - 1; i >= 0; i-- {
+			bf.Recent = append(bf.Recent, b.recent[i])
+		}
+		res = append(res, bf)
+	}
+	f.mtx.Unlock()
+
+	total := func(b BinaryUnwindFailures) uint64 {
+		var n uint64
+		for _, c := range b.Counts {
+			n += c
+		}
+		return n
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if ti, tj := total(res[i]), total(res[j]); ti != tj {
+			return ti > tj
+		}
+		return res[i].File < res[j].File
+	})
+	return res
+}
+
+func (f *UnwindFailures) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descUnwindFailures
+}
+
+func (f *UnwindFailures) Collect(ch chan<- prometheus.Metric) {
+	for _, b := range f.Binaries() {
+		for reason, n := range b.Counts {
+			ch <- prometheus.MustNewConstMetric(descUnwindFailures, prometheus.CounterValue, float64(n), b.BuildID, b.File, reason)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnwindFailures(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	f := NewUnwindFailures(reg, 2)
+
+	now := time.Now()
+	f.Record([]UnwindFailure{
+		{PID: 1, BuildID: "a", File: "/usr/bin/a", Address: 0x10, Reason: "pc_not_covered", Count: 3, Time: now},
+		{PID: 1, BuildID: "a", File: "/usr/bin/a", Address: 0x20, Reason: "bogus_cfa", Count: 1, Time: now},
+		{PID: 2, File: "/tmp/jit", Address: 0x30, Reason: "pc_not_covered", Count: 1, Time: now.Add(time.Second)},
+	})
+
+	binaries := f.Binaries()
+	require.Len(t, binaries, 2)
+	require.Equal(t, "a", binaries[0].BuildID)
+	require.Equal(t, map[string]uint64{"pc_not_covered": 3, "bogus_cfa": 1}, binaries[0].Counts)
+	// Newest first.
+	require.Equal(t, uint64(0x20), binaries[0].Recent[0].Address)
+	require.Equal(t, "/tmp/jit", binaries[1].File)
+	require.Equal(t, 3, testutil.CollectAndCount(reg, "parca_agent_unwind_failures_sampled_total"))
+
+	// The binary that failed the least recently is forgotten.
+	f.Record([]UnwindFailure{{PID: 3, BuildID: "c", File: "/usr/bin/c", Reason: "bogus_cfa", Count: 1, Time: now.Add(2 * time.Second)}})
+	binaries = f.Binaries()
+	require.Len(t, binaries, 2)
+	require.Equal(t, "/tmp/jit", binaries[0].File)
+	require.Equal(t, "c", binaries[1].BuildID)
+}
+
+func TestUnwindFailuresKeepsRecent(t *testing.T) {
+	f := NewUnwindFailures(nil, 1)
+
+	for i := 0; i < 2*maxUnwindFailureSamples; i++ {
+		f.Record([]UnwindFailure{{BuildID: "a", Address: uint64(i), Reason: "bogus_cfa", Count: 1}})
+	}
+	binaries := f.Binaries()
+	require.Len(t, binaries[0].Recent, maxUnwindFailureSamples)
+	require.Equal(t, uint64(2*maxUnwindFailureSamples-1), binaries[0].Recent[0].Address)
+	require.Equal(t, uint64(2*maxUnwindFailureSamples), binaries[0].Counts["bogus_cfa"])
+}
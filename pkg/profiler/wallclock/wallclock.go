@@ -0,0 +1,586 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package wallclock
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
+	"github.com/hashicorp/go-multierror"
+	"github.com/parca-dev/parca/pkg/symbol/demangle"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+
+	"github.com/parca-dev/parca-agent/pkg/byteorder"
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/perf"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+	"github.com/parca-dev/parca-agent/pkg/profiler/bpfmaps"
+	"github.com/parca-dev/parca-agent/pkg/rlimit"
+)
+
+//go:embed wallclock-profiler.bpf.o
+var bpfObj []byte
+
+const (
+	stackDepth = 127 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
+
+	profilerName = "parca_agent_wall_clock"
+
+	onCPUProgramName       = "on_cpu_sample"
+	schedSwitchProgramName = "sched_switch"
+	configKey              = "wallclock_config"
+
+	stackTracesMapName  = "stack_traces"
+	wallclockNsMapName  = "wallclock_ns"
+	offCPUStartsMapName = "off_cpu_starts"
+	profiledPIDsMapName = "profiled_pids"
+	tracepointCategory  = "sched"
+	tracepointName      = "sched_switch"
+
+	// Must match the STATE_* values in the BPF program.
+	stateOnCPU  = 0
+	stateOffCPU = 1
+
+	stateLabel = "state"
+
+	wallSampleType = "wall"
+	wallSampleUnit = "nanoseconds"
+)
+
+type Config struct {
+	SamplePeriodNs uint64
+}
+
+// wallclockKey mirrors the wallclock_key_t struct in the BPF program.
+type wallclockKey struct {
+	PID         int32
+	TID         int32
+	UserStackID int32
+	State       int32
+}
+
+// offCPUStart mirrors the off_cpu_start_t struct in the BPF program.
+type offCPUStart struct {
+	StartNs     uint64
+	PID         int32
+	UserStackID int32
+}
+
+type userStack [stackDepth]uint64
+
+type sampleKey struct {
+	stack userStack
+	state int32
+}
+
+// processRawData holds the samples of a process. The values of the samples
+// are nanoseconds, and states are indexed like them.
+type processRawData struct {
+	pid     int
+	samples []profile.RawSample
+	states  []string
+}
+
+// WallClock is a profiler that samples the threads of the selected processes
+// both while they run and while they are switched out, so the time spent
+// sleeping in syscalls or waiting to be scheduled shows up next to the CPU
+// time.
+type WallClock struct {
+	profiler.Status
+
+	logger  log.Logger
+	reg     prometheus.Registerer
+	metrics *profiler.StackMetrics
+	// Number of processes selected for wall-clock profiling.
+	profiledProcesses prometheus.Gauge
+
+	profilingDuration          time.Duration
+	profilingSamplingFrequency uint64
+
+	writer  *pprof.ProcessProfileWriter
+	labeler profiler.Labeler
+	// Throttles the processes sampled more than the CPU budget affords,
+	// when set.
+	budget *profiler.Budget
+
+	stackTraces  *bpf.BPFMap
+	wallclockNs  *bpf.BPFMap
+	offCPUStarts *bpf.BPFMap
+	profiledPIDs *bpf.BPFMap
+	byteOrder    binary.ByteOrder
+
+	// The processes in the profiled PIDs map, with the ratio of their on-CPU
+	// samples kept.
+	profiled map[int]uint8
+
+	memlockRlimit uint64
+	btfPath       string
+}
+
+func NewWallClockProfiler(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	processInfoManager profiler.ProcessInfoManager,
+	addressNormalizer profiler.AddressNormalizer,
+	vdsoSymbolizer pprof.VDSOSymbolizer,
+	localSymbolizer pprof.LocalSymbolizer,
+	ksym *ksym.Ksym,
+	perfMapCache *perf.PerfMapCache,
+	jitdumpCache *perf.JitdumpCache,
+	disableJITSymbolization bool,
+	demangler *demangle.Demangler,
+	unknownFrames pprof.UnknownFramePolicy,
+	profileWriter profiler.ProfileWriter,
+	labeler profiler.Labeler,
+	budget *profiler.Budget,
+	profilingDuration time.Duration,
+	profilingSamplingFrequency uint64,
+	memlockRlimit uint64,
+	btfPath string,
+) *WallClock {
+	metrics := profiler.NewStackMetrics(reg, "wall_clock")
+	return &WallClock{
+		logger:  logger,
+		reg:     reg,
+		metrics: metrics,
+		profiledProcesses: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_wall_clock_processes",
+			Help: "Number of processes selected for wall-clock profiling.",
+		}),
+
+		writer: pprof.NewProcessProfileWriter(
+			logger,
+			profilerName,
+			processInfoManager,
+			pprof.ConverterOptions{
+				AddressNormalizer:       addressNormalizer,
+				Ksym:                    ksym,
+				VDSOSymbolizer:          vdsoSymbolizer,
+				LocalSymbolizer:         localSymbolizer,
+				PerfMapCache:            perfMapCache,
+				JitdumpCache:            jitdumpCache,
+				Metrics:                 pprof.NewConverterMetrics(reg, "wall_clock"),
+				DisableJITSymbolization: disableJITSymbolization,
+				Demangler:               demangler,
+				UnknownFrames:           unknownFrames,
+			},
+			profileWriter,
+			metrics,
+		),
+		labeler: labeler,
+		budget:  budget,
+
+		profilingDuration:          profilingDuration,
+		profilingSamplingFrequency: profilingSamplingFrequency,
+
+		byteOrder: byteorder.GetHostByteOrder(),
+		profiled:  map[int]uint8{},
+
+		memlockRlimit: memlockRlimit,
+		btfPath:       btfPath,
+	}
+}
+
+func (p *WallClock) Name() string {
+	return profilerName
+}
+
+// samplePeriod returns the fixed period on-CPU samples are taken at. Unlike
+// the CPU profiler the frequency isn't adjusted by the kernel, so every
+// sample accounts for the same time.
+func (p *WallClock) samplePeriod() uint64 {
+	return uint64(time.Second.Nanoseconds()) / p.profilingSamplingFrequency
+}
+
+func (p *WallClock) loadBpfProgram() (*bpf.Module, error) {
+	m, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
+		BPFObjBuff: bpfObj,
+		BPFObjName: "parca-wallclock",
+		BTFObjPath: p.btfPath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new bpf module: %w", err)
+	}
+
+	// Must be called after bpf.NewModuleFromBufferArgs to avoid limit override.
+	if _, err := rlimit.BumpMemlock(p.memlockRlimit, p.memlockRlimit); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("bump memlock: %w", err)
+	}
+
+	if err := m.InitGlobalVariable(configKey, Config{SamplePeriodNs: p.samplePeriod()}); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("init global variable: %w", err)
+	}
+
+	if err := m.BPFLoadObject(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("load bpf object: %w", err)
+	}
+
+	prog, err := m.GetProgram(schedSwitchProgramName)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("get bpf program %s: %w", schedSwitchProgramName, err)
+	}
+	// The link is destroyed when the module is closed.
+	if _, err := prog.AttachTracepoint(tracepointCategory, tracepointName); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("attach tracepoint %s: %w", tracepointName, err)
+	}
+
+	prog, err = m.GetProgram(onCPUProgramName)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("get bpf program %s: %w", onCPUProgramName, err)
+	}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
+			Type:   unix.PERF_TYPE_SOFTWARE,
+			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+			Sample: p.samplePeriod(),
+		}, -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("open perf event: %w", err)
+		}
+		// The link, and the perf event with it, is destroyed when the module
+		// is closed.
+		if _, err := prog.AttachPerfEvent(fd); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("attach perf event: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+func (p *WallClock) Run(ctx context.Context) error {
+	level.Debug(p.logger).Log("msg", "starting wall-clock profiler")
+
+	if support, err := bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeTracepoint); !support {
+		return fmt.Errorf("tracepoint program type not supported: %w", err)
+	}
+
+	pfs, err := procfs.NewDefaultFS()
+	if err != nil {
+		return fmt.Errorf("failed to create procfs: %w", err)
+	}
+
+	m, err := p.loadBpfProgram()
+	if err != nil {
+		return fmt.Errorf("load bpf program: %w", err)
+	}
+	defer m.Close()
+
+	p.stackTraces, err = m.GetMap(stackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get stack traces map: %w", err)
+	}
+	p.wallclockNs, err = m.GetMap(wallclockNsMapName)
+	if err != nil {
+		return fmt.Errorf("get wall-clock map: %w", err)
+	}
+	p.offCPUStarts, err = m.GetMap(offCPUStartsMapName)
+	if err != nil {
+		return fmt.Errorf("get off-CPU starts map: %w", err)
+	}
+	p.profiledPIDs, err = m.GetMap(profiledPIDsMapName)
+	if err != nil {
+		return fmt.Errorf("get profiled PIDs map: %w", err)
+	}
+
+	p.updateProfiledProcesses(ctx, pfs)
+
+	p.Start()
+
+	ticker := time.NewTicker(p.profilingDuration)
+	defer ticker.Stop()
+
+	level.Debug(p.logger).Log("msg", "start profiling loop")
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		obtainStart := time.Now()
+		rawData, err := p.obtainRawData(ctx)
+		if err != nil {
+			p.metrics.ObtainAttempts.WithLabelValues(profiler.LabelError).Inc()
+			level.Warn(p.logger).Log("msg", "failed to obtain profiles from eBPF maps", "err", err)
+			continue
+		}
+		p.metrics.ObtainAttempts.WithLabelValues(profiler.LabelSuccess).Inc()
+		p.metrics.ObtainDuration.Observe(time.Since(obtainStart).Seconds())
+
+		processLastErrors := map[int]error{}
+		for _, perProcessRawData := range rawData {
+			pid := perProcessRawData.pid
+			processLastErrors[pid] = nil
+			p.recordBudget(perProcessRawData)
+
+			if err := p.writeProfile(ctx, perProcessRawData); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to write wall-clock profile", "pid", pid, "err", err)
+				processLastErrors[pid] = err
+			}
+		}
+		p.Report(nil, processLastErrors)
+
+		// Processes selected in the meantime are profiled from the next round
+		// on.
+		p.updateProfiledProcesses(ctx, pfs)
+	}
+}
+
+// updateProfiledProcesses selects the processes whose targets enable
+// wall-clock profiling in the BPF program.
+func (p *WallClock) updateProfiledProcesses(ctx context.Context, pfs procfs.FS) {
+	procs, err := pfs.AllProcs()
+	if err != nil {
+		level.Error(p.logger).Log("msg", "failed to list processes", "err", err)
+		return
+	}
+
+	pids := map[int]uint8{}
+	for _, proc := range procs {
+		labelSet, err := p.labeler.LabelSet(ctx, proc.PID)
+		if err != nil || len(labelSet) == 0 {
+			continue
+		}
+		overrides, _, err := profiler.TargetOverrides(labelSet)
+		if err != nil {
+			level.Debug(p.logger).Log("msg", "ignoring invalid profiling overrides", "pid", proc.PID, "err", err)
+		}
+		if overrides.WallClock {
+			pids[proc.PID] = p.samplingRatio(proc.PID)
+		}
+	}
+
+	if err := p.setProfiledProcesses(pids); err != nil {
+		level.Error(p.logger).Log("msg", "failed to update the processes to profile", "err", err)
+	}
+	p.profiledProcesses.Set(float64(len(p.profiled)))
+}
+
+// samplingRatio returns the ratio of the on-CPU samples of the given process
+// to keep, one in every returned samples.
+func (p *WallClock) samplingRatio(pid int) uint8 {
+	if p.budget == nil {
+		return 1
+	}
+	return uint8(math.Min(math.MaxUint8, math.Round(1/p.budget.Factor(profiler.BudgetWallClock, pid))))
+}
+
+// recordBudget records the on-CPU samples of a process kept in the last round
+// in the CPU budget.
+func (p *WallClock) recordBudget(data processRawData) {
+	if p.budget == nil {
+		return
+	}
+	var ns uint64
+	for i, s := range data.samples {
+		if data.states[i] == stateString(stateOnCPU) {
+			ns += s.Value
+		}
+	}
+	every := uint64(p.profiled[data.pid])
+	if every == 0 {
+		every = 1
+	}
+	p.budget.Record(profiler.BudgetWallClock, data.pid, ns/(every*p.samplePeriod()))
+}
+
+// setProfiledProcesses makes the BPF program only sample the given processes,
+// keeping one in every given number of their on-CPU samples.
+func (p *WallClock) setProfiledProcesses(pids map[int]uint8) error {
+	// Stale processes are removed first to make room for the new ones.
+	for pid := range p.profiled {
+		if _, ok := pids[pid]; ok {
+			continue
+		}
+		key := uint32(pid)
+		if err := p.profiledPIDs.DeleteKey(unsafe.Pointer(&key)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete process %d: %w", pid, err)
+		}
+		delete(p.profiled, pid)
+	}
+
+	for pid, every := range pids {
+		if current, ok := p.profiled[pid]; ok && current == every {
+			continue
+		}
+		key := uint32(pid)
+		if err := p.profiledPIDs.Update(unsafe.Pointer(&key), unsafe.Pointer(&every)); err != nil {
+			return fmt.Errorf("failed to add process %d: %w", pid, err)
+		}
+		p.profiled[pid] = every
+	}
+	return nil
+}
+
+func (p *WallClock) writeProfile(ctx context.Context, data processRawData) error {
+	return p.writer.Write(ctx, data.pid, p.LastProfileStartedAt(), int64(p.samplePeriod()), data.samples, func(prof *pprofprofile.Profile) {
+		addStates(prof, data)
+	})
+}
+
+// addStates sets the wall-clock sample type, and adds whether the thread was
+// on or off CPU as a sample label, to the samples of a converted profile,
+// which are in the same order as the raw samples.
+func addStates(prof *pprofprofile.Profile, data processRawData) {
+	prof.SampleType = []*pprofprofile.ValueType{{Type: wallSampleType, Unit: wallSampleUnit}}
+	prof.PeriodType = &pprofprofile.ValueType{Type: wallSampleType, Unit: wallSampleUnit}
+	prof.DefaultSampleType = wallSampleType
+
+	for i, s := range prof.Sample {
+		if s.Label == nil {
+			s.Label = make(map[string][]string, 1)
+		}
+		s.Label[stateLabel] = []string{data.states[i]}
+	}
+}
+
+// obtainRawData collects the time spent on and off CPU per stack from the BPF
+// maps and clears them for the next round.
+func (p *WallClock) obtainRawData(ctx context.Context) ([]processRawData, error) {
+	rawData := map[int32]map[sampleKey]uint64{}
+
+	it := p.wallclockNs.Iterator()
+	for it.Next() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		keyBytes := it.Key()
+
+		var key wallclockKey
+		if err := binary.Read(bytes.NewBuffer(keyBytes), p.byteOrder, &key); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonKey).Inc()
+			return nil, fmt.Errorf("read wall-clock key: %w", err)
+		}
+
+		stack := userStack{}
+		if err := bpfmaps.ReadStack(p.stackTraces, p.byteOrder, key.UserStackID, stack[:]); err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonUser).Inc()
+			continue
+		}
+
+		valueBytes, err := p.wallclockNs.GetValue(unsafe.Pointer(&keyBytes[0]))
+		if err != nil {
+			p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonCount).Inc()
+			return nil, fmt.Errorf("read value: %w", err)
+		}
+
+		perProcessData, ok := rawData[key.PID]
+		if !ok {
+			perProcessData = map[sampleKey]uint64{}
+			rawData[key.PID] = perProcessData
+		}
+		perProcessData[sampleKey{stack: stack, state: key.State}] += p.byteOrder.Uint64(valueBytes)
+	}
+	if it.Err() != nil {
+		p.metrics.StackDrop.WithLabelValues(profiler.StackDropReasonIterator).Inc()
+		return nil, fmt.Errorf("failed iterator: %w", it.Err())
+	}
+
+	if err := p.cleanMaps(); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to clean BPF maps that store stacktraces", "err", err)
+	}
+
+	return preprocessRawData(rawData), nil
+}
+
+func (p *WallClock) cleanMaps() error {
+	var result error
+	if err := p.cleanStackTraces(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if _, err := bpfmaps.Clear(p.wallclockNs); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result
+}
+
+// cleanStackTraces deletes the stacks of the stack traces map but the ones of
+// the threads still switched out, which are only accounted once they're
+// switched back in, so that the longest sleeps aren't lost.
+func (p *WallClock) cleanStackTraces() error {
+	return bpfmaps.CleanStackTraces(p.stackTraces, p.offCPUStarts, p.byteOrder, func(value []byte) (int32, error) {
+		var start offCPUStart
+		if err := binary.Read(bytes.NewBuffer(value), p.byteOrder, &start); err != nil {
+			return 0, fmt.Errorf("failed to read off-CPU start: %w", err)
+		}
+		return start.UserStackID, nil
+	})
+}
+
+func stateString(state int32) string {
+	switch state {
+	case stateOnCPU:
+		return "on_cpu"
+	case stateOffCPU:
+		return "off_cpu"
+	default:
+		return "unknown"
+	}
+}
+
+// preprocessRawData turns the aggregated values into per process samples.
+func preprocessRawData(rawData map[int32]map[sampleKey]uint64) []processRawData {
+	res := make([]processRawData, 0, len(rawData))
+	for pid, perProcessRawData := range rawData {
+		p := processRawData{
+			pid:     int(pid),
+			samples: make([]profile.RawSample, 0, len(perProcessRawData)),
+			states:  make([]string, 0, len(perProcessRawData)),
+		}
+
+		for key, value := range perProcessRawData {
+			p.samples = append(p.samples, profile.RawSample{
+				UserStack: profiler.TrimStack(key.stack[:]),
+				Value:     value,
+			})
+			p.states = append(p.states, stateString(key.state))
+		}
+
+		res = append(res, p)
+	}
+
+	return res
+}
@@ -12,6 +12,8 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package rlimit
 
 import (
@@ -29,6 +29,8 @@ const (
 	cfaTypeRsp
 	cfaTypeExpression
 	cfaTypeEndFdeMarker
+	cfaTypeDerefRbp
+	cfaTypeDerefRsp
 )
 
 type bpfRbpType uint16
@@ -39,6 +41,9 @@ const (
 	rbpRuleRegister
 	rbpTypeExpression
 	rbpTypeUndefinedReturnAddress
+	rbpTypeDerefRbp
+	rbpTypeDerefRsp
+	rbpTypeReturnAddressInRegister
 )
 
 // CompactUnwindTableRows encodes unwind information using 2x 64 bit words.
@@ -93,7 +98,7 @@ func BuildCompactUnwindTable(fdes frame.FrameDescriptionEntries) (CompactUnwindT
 		frameContext := frame.ExecuteDwarfProgram(fde, nil)
 		for insCtx := frameContext.Next(); frameContext.HasNext(); insCtx = frameContext.Next() {
 			row := unwindTableRow(insCtx)
-			compactRow, err := rowToCompactRow(row)
+			compactRow, err := rowToCompactRow(row, fde.Registers())
 			if err != nil {
 				return CompactUnwindTable{}, err
 			}
@@ -108,8 +113,9 @@ func BuildCompactUnwindTable(fdes frame.FrameDescriptionEntries) (CompactUnwindT
 	return table, nil
 }
 
-// rowToCompactRow converts an unwind row to a compact row.
-func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
+// rowToCompactRow converts an unwind row to a compact row, where the rbp and
+// rsp types refer to the frame and stack pointers of the given architecture.
+func rowToCompactRow(row *UnwindTableRow, regs frame.Registers) (CompactUnwindTableRow, error) {
 	var cfaType uint8
 	var rbpType uint8
 	var cfaOffset int16
@@ -119,15 +125,32 @@ func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
 	//nolint:exhaustive
 	switch row.CFA.Rule {
 	case frame.RuleCFA:
-		if row.CFA.Reg == frame.X86_64FramePointer {
+		if row.CFA.Reg == regs.FramePointer {
 			cfaType = uint8(cfaTypeRbp)
-		} else if row.CFA.Reg == frame.X86_64StackPointer {
+		} else if row.CFA.Reg == regs.StackPointer {
 			cfaType = uint8(cfaTypeRsp)
 		}
 		cfaOffset = int16(row.CFA.Offset)
 	case frame.RuleExpression:
 		cfaType = uint8(cfaTypeExpression)
 		cfaOffset = int16(ExpressionIdentifier(row.CFA.Expression))
+
+		if expression, ok := EvaluateRegisterExpression(row.CFA.Expression); ok && cfaOffset == int16(ExpressionUnknown) {
+			switch {
+			case expression.Reg == regs.FramePointer && expression.Deref:
+				cfaType = uint8(cfaTypeDerefRbp)
+			case expression.Reg == regs.StackPointer && expression.Deref:
+				cfaType = uint8(cfaTypeDerefRsp)
+			case expression.Reg == regs.FramePointer:
+				// Equivalent to DW_CFA_def_cfa.
+				cfaType = uint8(cfaTypeRbp)
+			case expression.Reg == regs.StackPointer:
+				cfaType = uint8(cfaTypeRsp)
+			}
+			if cfaType != uint8(cfaTypeExpression) {
+				cfaOffset = expression.Offset
+			}
+		}
 	default:
 		return CompactUnwindTableRow{}, fmt.Errorf("CFA rule is not valid: %d", row.CFA.Rule)
 	}
@@ -141,6 +164,19 @@ func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
 		rbpType = uint8(rbpRuleRegister)
 	case frame.RuleExpression:
 		rbpType = uint8(rbpTypeExpression)
+
+		// The expression computes the address where the frame pointer
+		// is saved.
+		if expression, ok := EvaluateRegisterExpression(row.RBP.Expression); ok && !expression.Deref {
+			switch expression.Reg {
+			case regs.FramePointer:
+				rbpType = uint8(rbpTypeDerefRbp)
+				rbpOffset = expression.Offset
+			case regs.StackPointer:
+				rbpType = uint8(rbpTypeDerefRsp)
+				rbpOffset = expression.Offset
+			}
+		}
 	case frame.RuleUndefined:
 	case frame.RuleUnknown:
 	case frame.RuleSameVal:
@@ -152,6 +188,18 @@ func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
 	// Return address.
 	if row.RA.Rule == frame.RuleUndefined {
 		rbpType = uint8(rbpTypeUndefinedReturnAddress)
+	} else if regs == frame.RISCV64Registers {
+		// Unlike on x86_64, calls don't push the return address, which
+		// stays in its register until the prologue saves it, right below
+		// the CFA. The BPF unwinder doesn't support it anywhere else, as it
+		// doesn't support expressions.
+		switch {
+		case row.RA.Rule == frame.RuleOffset && row.RA.Offset == -8:
+		case (row.RA.Rule == frame.RuleUnknown || row.RA.Rule == frame.RuleSameVal) && rbpType == uint8(rbpRuleOffsetUnchanged):
+			rbpType = uint8(rbpTypeReturnAddressInRegister)
+		default:
+			rbpType = uint8(rbpTypeExpression)
+		}
 	}
 
 	return CompactUnwindTableRow{
@@ -164,15 +212,15 @@ func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
 	}, nil
 }
 
-// CompactUnwindTableRepresentation converts an unwind table to its compact table
-// representation.
+// CompactUnwindTableRepresentation converts an unwind table of an x86_64
+// executable to its compact table representation.
 func CompactUnwindTableRepresentation(unwindTable UnwindTable) (CompactUnwindTable, error) {
 	compactTable := make(CompactUnwindTable, 0, len(unwindTable))
 
 	for i := range unwindTable {
 		row := unwindTable[i]
 
-		compactRow, err := rowToCompactRow(&row)
+		compactRow, err := rowToCompactRow(&row, frame.X86_64Registers)
 		if err != nil {
 			return CompactUnwindTable{}, err
 		}
@@ -180,6 +180,82 @@ func TestCompactUnwindTable(t *testing.T) {
 				rbpOffset:         0,
 			},
 		},
+		{
+			name: "CFA register expression with deref",
+			input: UnwindTableRow{
+				Loc: 123,
+				// DW_OP_breg6 -8; DW_OP_deref.
+				CFA: frame.DWRule{Rule: frame.RuleExpression, Expression: []byte{frame.DW_OP_breg6, 0x78, frame.DW_OP_deref}},
+				RBP: frame.DWRule{Rule: frame.RuleUnknown},
+				RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+			},
+
+			want: CompactUnwindTableRow{
+				pc:                123,
+				_reservedDoNotUse: 0,
+				cfaType:           5,
+				rbpType:           0,
+				cfaOffset:         -8,
+				rbpOffset:         0,
+			},
+		},
+		{
+			name: "CFA register expression without deref",
+			input: UnwindTableRow{
+				Loc: 123,
+				// DW_OP_breg7 16.
+				CFA: frame.DWRule{Rule: frame.RuleExpression, Expression: []byte{frame.DW_OP_breg7, 0x10}},
+				RBP: frame.DWRule{Rule: frame.RuleUnknown},
+				RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+			},
+
+			want: CompactUnwindTableRow{
+				pc:                123,
+				_reservedDoNotUse: 0,
+				cfaType:           2,
+				rbpType:           0,
+				cfaOffset:         16,
+				rbpOffset:         0,
+			},
+		},
+		{
+			name: "CFA register expression on unsupported register",
+			input: UnwindTableRow{
+				Loc: 123,
+				// DW_OP_breg3 8; DW_OP_deref.
+				CFA: frame.DWRule{Rule: frame.RuleExpression, Expression: []byte{frame.DW_OP_breg3, 0x08, frame.DW_OP_deref}},
+				RBP: frame.DWRule{Rule: frame.RuleUnknown},
+				RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+			},
+
+			want: CompactUnwindTableRow{
+				pc:                123,
+				_reservedDoNotUse: 0,
+				cfaType:           3,
+				rbpType:           0,
+				cfaOffset:         0,
+				rbpOffset:         0,
+			},
+		},
+		{
+			name: "RBP register expression",
+			input: UnwindTableRow{
+				Loc: 123,
+				CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64StackPointer, Offset: 8},
+				// DW_OP_breg6 -16.
+				RBP: frame.DWRule{Rule: frame.RuleExpression, Expression: []byte{frame.DW_OP_breg6, 0x70}},
+				RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+			},
+
+			want: CompactUnwindTableRow{
+				pc:                123,
+				_reservedDoNotUse: 0,
+				cfaType:           2,
+				rbpType:           5,
+				cfaOffset:         8,
+				rbpOffset:         -16,
+			},
+		},
 		{
 			name:    "Invalid CFA rule returns error",
 			input:   UnwindTableRow{},
@@ -200,3 +276,110 @@ func TestCompactUnwindTable(t *testing.T) {
 		})
 	}
 }
+
+func TestCompactUnwindTableRISCV64(t *testing.T) {
+	tests := []struct {
+		name  string
+		input UnwindTableRow
+		want  CompactUnwindTableRow
+	}{
+		{
+			name: "Return address in register at function entry",
+			input: UnwindTableRow{
+				Loc: 123,
+				CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: frame.RISCV64StackPointer, Offset: 0},
+				RBP: frame.DWRule{Rule: frame.RuleUnknown},
+				RA:  frame.DWRule{Rule: frame.RuleUnknown},
+			},
+			want: CompactUnwindTableRow{
+				pc:      123,
+				cfaType: uint8(cfaTypeRsp),
+				rbpType: uint8(rbpTypeReturnAddressInRegister),
+			},
+		},
+		{
+			name: "Return address saved below the CFA",
+			input: UnwindTableRow{
+				Loc: 123,
+				CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: frame.RISCV64FramePointer, Offset: 0},
+				RBP: frame.DWRule{Rule: frame.RuleOffset, Offset: -16},
+				RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+			},
+			want: CompactUnwindTableRow{
+				pc:        123,
+				cfaType:   uint8(cfaTypeRbp),
+				rbpType:   uint8(rbpRuleOffset),
+				rbpOffset: -16,
+			},
+		},
+		{
+			name: "Return address saved elsewhere is not supported",
+			input: UnwindTableRow{
+				Loc: 123,
+				CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: frame.RISCV64StackPointer, Offset: 32},
+				RBP: frame.DWRule{Rule: frame.RuleOffset, Offset: -16},
+				RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -24},
+			},
+			want: CompactUnwindTableRow{
+				pc:        123,
+				cfaType:   uint8(cfaTypeRsp),
+				rbpType:   uint8(rbpTypeExpression),
+				cfaOffset: 32,
+				rbpOffset: -16,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			have, err := rowToCompactRow(&test.input, frame.RISCV64Registers)
+			require.NoError(t, err)
+			require.Equal(t, test.want, have)
+		})
+	}
+}
+
+func TestEvaluateRegisterExpression(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression []byte
+		want       RegisterExpression
+		wantOk     bool
+	}{
+		{
+			name:       "breg with deref",
+			expression: []byte{frame.DW_OP_breg6, 0x78, frame.DW_OP_deref},
+			want:       RegisterExpression{Reg: frame.X86_64FramePointer, Offset: -8, Deref: true},
+			wantOk:     true,
+		},
+		{
+			name:       "breg without deref",
+			expression: []byte{frame.DW_OP_breg7, 0x10},
+			want:       RegisterExpression{Reg: frame.X86_64StackPointer, Offset: 16},
+			wantOk:     true,
+		},
+		{
+			name:       "PLT expression",
+			expression: Plt1[:],
+		},
+		{
+			name:       "unsupported operation",
+			expression: []byte{frame.DW_OP_breg7, 0x10, frame.DW_OP_deref, frame.DW_OP_deref},
+		},
+		{
+			name:       "truncated",
+			expression: []byte{frame.DW_OP_breg7},
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			have, ok := EvaluateRegisterExpression(test.expression)
+			require.Equal(t, test.wantOk, ok)
+			require.Equal(t, test.want, have)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package unwind
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/parca-dev/parca-agent/internal/procfs"
+	"github.com/parca-dev/parca-agent/pkg/elfreader"
+)
+
+// noteTypeFile is the type of the note of core dumps listing the mapped
+// files, NT_FILE.
+const noteTypeFile = 0x46494c45
+
+var errNoMappedFiles = errors.New("core dump has no NT_FILE note")
+
+// mappedFile is an entry of the NT_FILE note.
+type mappedFile struct {
+	start, end, offset uint64
+	path               string
+}
+
+// CoreMappings returns the memory mappings of the process a core dump was
+// taken of, as they would be read from its maps, so the unwind tables of the
+// objects it had mapped can be listed with ListExecutableMappings.
+func CoreMappings(path string) ([]*procfs.ProcMap, error) {
+	core, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	defer core.Close()
+
+	if core.Type != elf.ET_CORE {
+		return nil, fmt.Errorf("%s is not a core dump", path)
+	}
+
+	var files []mappedFile
+	for _, prog := range core.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		align := int(prog.Align)
+		if align < 4 {
+			align = 4
+		}
+		notes, err := elfreader.ParseNotes(prog.Open(), align, core.ByteOrder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read notes: %w", err)
+		}
+		for _, n := range notes {
+			if n.Name != "CORE" || n.Type != noteTypeFile {
+				continue
+			}
+			files, err = parseMappedFiles(n.Desc, core.Class, core.ByteOrder)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read NT_FILE note: %w", err)
+			}
+		}
+	}
+	if files == nil {
+		return nil, errNoMappedFiles
+	}
+
+	var maps []*procfs.ProcMap
+	for _, prog := range core.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		m := &procfs.ProcMap{
+			StartAddr: uintptr(prog.Vaddr),
+			EndAddr:   uintptr(prog.Vaddr + prog.Memsz),
+			Perms: &procfs.ProcMapPermissions{
+				Read:    prog.Flags&elf.PF_R != 0,
+				Write:   prog.Flags&elf.PF_W != 0,
+				Execute: prog.Flags&elf.PF_X != 0,
+			},
+		}
+		for _, f := range files {
+			if f.start <= prog.Vaddr && prog.Vaddr < f.end {
+				m.Pathname = f.path
+				m.Offset = int64(f.offset + prog.Vaddr - f.start)
+				break
+			}
+		}
+		maps = append(maps, m)
+	}
+	sort.Slice(maps, func(i, j int) bool { return maps[i].StartAddr < maps[j].StartAddr })
+	return maps, nil
+}
+
+// parseMappedFiles parses the description of an NT_FILE note, a count and a
+// page size followed by the start, end and offset in pages of every file,
+// and then their NUL-terminated paths.
+func parseMappedFiles(desc []byte, class elf.Class, order binary.ByteOrder) ([]mappedFile, error) {
+	word := 8
+	if class == elf.ELFCLASS32 {
+		word = 4
+	}
+	read := func() (uint64, error) {
+		if len(desc) < word {
+			return 0, errors.New("truncated note")
+		}
+		var v uint64
+		if word == 4 {
+			v = uint64(order.Uint32(desc))
+		} else {
+			v = order.Uint64(desc)
+		}
+		desc = desc[word:]
+		return v, nil
+	}
+
+	count, err := read()
+	if err != nil {
+		return nil, err
+	}
+	pageSize, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(desc)/(3*word)) {
+		return nil, fmt.Errorf("note has more files than it fits: %d", count)
+	}
+
+	files := make([]mappedFile, count)
+	for i := range files {
+		var err error
+		if files[i].start, err = read(); err != nil {
+			return nil, err
+		}
+		if files[i].end, err = read(); err != nil {
+			return nil, err
+		}
+		if files[i].offset, err = read(); err != nil {
+			return nil, err
+		}
+		files[i].offset *= pageSize
+	}
+	for i := range files {
+		end := bytes.IndexByte(desc, 0)
+		if end < 0 {
+			return nil, errors.New("truncated note")
+		}
+		files[i].path = string(desc[:end])
+		desc = desc[end+1:]
+	}
+	return files, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMappedFiles(t *testing.T) {
+	var desc []byte
+	for _, v := range []uint64{
+		2, 0x1000,
+		0x400000, 0x401000, 0,
+		0x7f0000, 0x7f2000, 3,
+	} {
+		desc = binary.LittleEndian.AppendUint64(desc, v)
+	}
+	desc = append(desc, "/usr/bin/app\x00/usr/lib/libc.so.6\x00"...)
+
+	files, err := parseMappedFiles(desc, elf.ELFCLASS64, binary.LittleEndian)
+	require.NoError(t, err)
+	require.Equal(t, []mappedFile{
+		{start: 0x400000, end: 0x401000, offset: 0, path: "/usr/bin/app"},
+		{start: 0x7f0000, end: 0x7f2000, offset: 0x3000, path: "/usr/lib/libc.so.6"},
+	}, files)
+
+	_, err = parseMappedFiles(desc[:len(desc)-2], elf.ELFCLASS64, binary.LittleEndian)
+	require.Error(t, err)
+	_, err = parseMappedFiles(desc[:40], elf.ELFCLASS64, binary.LittleEndian)
+	require.Error(t, err)
+}
+
+func TestCoreMappingsRejectsExecutables(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	_, err = CoreMappings(exe)
+	require.ErrorContains(t, err, "is not a core dump")
+}
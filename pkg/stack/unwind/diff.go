@@ -0,0 +1,227 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+// functionRow is an unwind table row whose location is relative to the start
+// of its function, so rows can be compared across binaries.
+type functionRow struct {
+	offset uint64
+	cfa    string
+	rbp    string
+	ra     string
+}
+
+func (r functionRow) String() string {
+	return fmt.Sprintf("+%-6x CFA: %-20s RBP: %-16s RA: %s", r.offset, r.cfa, r.rbp, r.ra)
+}
+
+// ruleString returns a textual representation of a DWARF rule, which is also
+// used to compare them.
+func ruleString(rule frame.DWRule) string {
+	//nolint:exhaustive
+	switch rule.Rule {
+	case frame.RuleUndefined:
+		return "undefined"
+	case frame.RuleUnknown:
+		return "u"
+	case frame.RuleSameVal:
+		return "same"
+	case frame.RuleOffset:
+		return fmt.Sprintf("c%+d", rule.Offset)
+	case frame.RuleValOffset:
+		return fmt.Sprintf("val c%+d", rule.Offset)
+	case frame.RuleRegister:
+		return "$" + x64RegisterToString(rule.Reg)
+	case frame.RuleCFA:
+		return fmt.Sprintf("$%s%+d", x64RegisterToString(rule.Reg), rule.Offset)
+	case frame.RuleExpression, frame.RuleValExpression:
+		if id := ExpressionIdentifier(rule.Expression); id != ExpressionUnknown {
+			return fmt.Sprintf("exp (plt %d)", id)
+		}
+		if expression, ok := EvaluateRegisterExpression(rule.Expression); ok {
+			return fmt.Sprintf("exp (%s)", expression.String())
+		}
+		return fmt.Sprintf("exp (%x)", rule.Expression)
+	default:
+		return fmt.Sprintf("rule %d", rule.Rule)
+	}
+}
+
+// functionSymbols returns the name of the function symbols indexed by their
+// start address.
+func functionSymbols(obj *elf.File) map[uint64]string {
+	symbols := map[uint64]string{}
+	add := func(syms []elf.Symbol) {
+		for _, sym := range syms {
+			if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 || sym.Name == "" {
+				continue
+			}
+			if _, ok := symbols[sym.Value]; !ok {
+				symbols[sym.Value] = sym.Name
+			}
+		}
+	}
+
+	// Errors are ignored as stripped binaries won't have these sections.
+	syms, _ := obj.Symbols()
+	add(syms)
+	dynSyms, _ := obj.DynamicSymbols()
+	add(dynSyms)
+
+	return symbols
+}
+
+// functionTables returns the unwind rows of every function in the executable
+// that can be attributed to a symbol, and the number of FDEs that couldn't.
+func functionTables(path string) (map[string][]functionRow, int, error) {
+	obj, err := elf.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open elf: %w", err)
+	}
+	symbols := functionSymbols(obj)
+	obj.Close()
+
+	fdes, err := ReadFDEs(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tables := map[string][]functionRow{}
+	unnamed := 0
+	for _, fde := range fdes {
+		name, ok := symbols[fde.Begin()]
+		if !ok {
+			unnamed++
+			continue
+		}
+
+		rows := []functionRow{}
+		frameContext := frame.ExecuteDwarfProgram(fde, nil)
+		for insCtx := frameContext.Next(); frameContext.HasNext(); insCtx = frameContext.Next() {
+			row := unwindTableRow(insCtx)
+			rows = append(rows, functionRow{
+				offset: row.Loc - fde.Begin(),
+				cfa:    ruleString(row.CFA),
+				rbp:    ruleString(row.RBP),
+				ra:     ruleString(row.RA),
+			})
+		}
+		tables[name] = rows
+	}
+
+	return tables, unnamed, nil
+}
+
+// DiffTables is a debugging helper that compares the unwind tables of two
+// executables, aligning their FDEs by function symbol, and prints the
+// functions whose unwind rules differ to the given io.Writer.
+func (ptb *UnwindTableBuilder) DiffTables(writer io.Writer, oldPath, newPath string) (err error) {
+	// The frame package can raise in case of malformed unwind data.
+	defer func() {
+		if r := recover(); r != nil {
+			level.Info(ptb.logger).Log("msg", "recovered a panic in DiffTables", "stack", r)
+			err = errors.New("failed to diff unwind tables")
+		}
+	}()
+
+	oldTables, oldUnnamed, err := functionTables(oldPath)
+	if err != nil {
+		return fmt.Errorf("failed to read unwind tables for %s: %w", oldPath, err)
+	}
+	newTables, newUnnamed, err := functionTables(newPath)
+	if err != nil {
+		return fmt.Errorf("failed to read unwind tables for %s: %w", newPath, err)
+	}
+
+	names := make([]string, 0, len(oldTables)+len(newTables))
+	for name := range oldTables {
+		names = append(names, name)
+	}
+	for name := range newTables {
+		if _, ok := oldTables[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var added, removed, changed int
+	for _, name := range names {
+		oldRows, inOld := oldTables[name]
+		newRows, inNew := newTables[name]
+
+		switch {
+		case !inOld:
+			added++
+			fmt.Fprintf(writer, "+ %s (%d rows)\n", name, len(newRows))
+		case !inNew:
+			removed++
+			fmt.Fprintf(writer, "- %s (%d rows)\n", name, len(oldRows))
+		case !equalFunctionRows(oldRows, newRows):
+			changed++
+			fmt.Fprintf(writer, "~ %s\n", name)
+			printRowsDiff(writer, oldRows, newRows)
+		}
+	}
+
+	fmt.Fprintf(writer, "\n%d functions changed, %d added, %d removed\n", changed, added, removed)
+	fmt.Fprintf(writer, "%d FDEs in %s and %d FDEs in %s without a function symbol were skipped\n", oldUnnamed, oldPath, newUnnamed, newPath)
+	return nil
+}
+
+func equalFunctionRows(a, b []functionRow) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// printRowsDiff prints the rows of a function that differ, matching them by
+// their offset from the start of the function.
+func printRowsDiff(writer io.Writer, oldRows, newRows []functionRow) {
+	i, j := 0, 0
+	for i < len(oldRows) || j < len(newRows) {
+		switch {
+		case j == len(newRows) || (i < len(oldRows) && oldRows[i].offset < newRows[j].offset):
+			fmt.Fprintf(writer, "\t- %s\n", oldRows[i])
+			i++
+		case i == len(oldRows) || newRows[j].offset < oldRows[i].offset:
+			fmt.Fprintf(writer, "\t+ %s\n", newRows[j])
+			j++
+		default:
+			if oldRows[i] != newRows[j] {
+				fmt.Fprintf(writer, "\t- %s\n", oldRows[i])
+				fmt.Fprintf(writer, "\t+ %s\n", newRows[j])
+			}
+			i++
+			j++
+		}
+	}
+}
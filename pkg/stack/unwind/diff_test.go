@@ -0,0 +1,49 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+func TestRuleString(t *testing.T) {
+	require.Equal(t, "$rsp+8", ruleString(frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64StackPointer, Offset: 8}))
+	require.Equal(t, "c-16", ruleString(frame.DWRule{Rule: frame.RuleOffset, Offset: -16}))
+	require.Equal(t, "exp (plt 1)", ruleString(frame.DWRule{Rule: frame.RuleExpression, Expression: Plt1[:]}))
+	require.Equal(t, "u", ruleString(frame.DWRule{Rule: frame.RuleUnknown}))
+}
+
+func TestPrintRowsDiff(t *testing.T) {
+	oldRows := []functionRow{
+		{offset: 0x0, cfa: "$rsp+8", rbp: "u", ra: "c-8"},
+		{offset: 0x1, cfa: "$rsp+16", rbp: "c-16", ra: "c-8"},
+		{offset: 0x4, cfa: "$rbp+16", rbp: "c-16", ra: "c-8"},
+	}
+	newRows := []functionRow{
+		{offset: 0x0, cfa: "$rsp+8", rbp: "u", ra: "c-8"},
+		{offset: 0x1, cfa: "$rsp+16", rbp: "c-16", ra: "c-8"},
+		{offset: 0x8, cfa: "$rsp+32", rbp: "c-16", ra: "c-8"},
+	}
+	require.False(t, equalFunctionRows(oldRows, newRows))
+	require.True(t, equalFunctionRows(oldRows, oldRows))
+
+	buf := new(bytes.Buffer)
+	printRowsDiff(buf, oldRows, newRows)
+	require.Equal(t, "\t- "+oldRows[2].String()+"\n\t+ "+newRows[2].String()+"\n", buf.String())
+}
@@ -15,7 +15,12 @@
 package unwind
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+
 	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+	"github.com/parca-dev/parca-agent/internal/dwarf/util"
 )
 
 type DwarfExpressionID int16
@@ -90,3 +95,68 @@ func ExpressionIdentifier(expression []byte) DwarfExpressionID {
 
 	return ExpressionUnknown
 }
+
+// RegisterExpression represents the subset of DWARF expressions that can be
+// evaluated by the BPF unwinder. The computed value is `Reg + Offset`,
+// dereferenced if `Deref` is set.
+type RegisterExpression struct {
+	Reg    uint64
+	Offset int16
+	Deref  bool
+}
+
+func (e RegisterExpression) String() string {
+	if e.Deref {
+		return fmt.Sprintf("deref $%s%+d", x64RegisterToString(e.Reg), e.Offset)
+	}
+	return fmt.Sprintf("$%s%+d", x64RegisterToString(e.Reg), e.Offset)
+}
+
+// EvaluateRegisterExpression evaluates simple DWARF expressions of the form
+// `DW_OP_bregN offset [DW_OP_deref]`, which are commonly emitted, for example,
+// for functions that realign the stack. It returns false if the expression
+// is not supported.
+func EvaluateRegisterExpression(expression []byte) (result RegisterExpression, ok bool) {
+	// The LEB128 decoding functions panic on malformed input.
+	defer func() {
+		if r := recover(); r != nil {
+			result, ok = RegisterExpression{}, false
+		}
+	}()
+
+	buf := bytes.NewBuffer(expression)
+
+	opcode, err := buf.ReadByte()
+	if err != nil {
+		return RegisterExpression{}, false
+	}
+	if opcode < frame.DW_OP_breg0 || opcode > frame.DW_OP_breg31 {
+		return RegisterExpression{}, false
+	}
+	if buf.Len() == 0 {
+		return RegisterExpression{}, false
+	}
+
+	offset, _ := util.DecodeSLEB128(buf)
+	if offset < math.MinInt16 || offset > math.MaxInt16 {
+		return RegisterExpression{}, false
+	}
+
+	result = RegisterExpression{
+		Reg:    uint64(opcode - frame.DW_OP_breg0),
+		Offset: int16(offset),
+	}
+
+	for buf.Len() > 0 {
+		opcode, _ := buf.ReadByte()
+		switch {
+		case opcode == frame.DW_OP_deref && !result.Deref:
+			result.Deref = true
+		case opcode == frame.DW_OP_nop:
+		default:
+			return RegisterExpression{}, false
+		}
+	}
+
+	return result, true
+}
@@ -20,7 +20,7 @@ import (
 	"hash/maphash"
 	"strings"
 
-	"github.com/prometheus/procfs"
+	"github.com/parca-dev/parca-agent/internal/procfs"
 )
 
 var seed = maphash.MakeSeed()
@@ -90,6 +90,29 @@ func (pm ExecutableMappings) HasJitted() bool {
 	return false
 }
 
+// Diff returns the mappings that are in pm but not in previous, such as the
+// libraries loaded with dlopen(3) or new JIT regions, and the ones that are
+// gone since. Mappings are compared by value.
+func (pm ExecutableMappings) Diff(previous ExecutableMappings) (added, removed ExecutableMappings) {
+	seen := make(map[ExecutableMapping]struct{}, len(previous))
+	for _, m := range previous {
+		seen[*m] = struct{}{}
+	}
+	for _, m := range pm {
+		if _, ok := seen[*m]; ok {
+			delete(seen, *m)
+			continue
+		}
+		added = append(added, m)
+	}
+	for _, m := range previous {
+		if _, ok := seen[*m]; ok {
+			removed = append(removed, m)
+		}
+	}
+	return added, removed
+}
+
 // Hash produces a summary of the executable mappings.
 func (pm ExecutableMappings) Hash() (uint64, error) {
 	var h maphash.Hash
@@ -150,6 +150,31 @@ func TestExecutableHashWorks(t *testing.T) {
 	require.NotEqual(t, hash, hashTypo)
 }
 
+func TestExecutableMappingsDiff(t *testing.T) {
+	previous := ListExecutableMappings([]*procfs.ProcMap{
+		{StartAddr: 0x0, EndAddr: 0x100, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "./my_executable"},
+		{StartAddr: 0x100, EndAddr: 0x200, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "libc"},
+		{StartAddr: 0x200, EndAddr: 0x300, Perms: &procfs.ProcMapPermissions{Execute: true}},
+	})
+	current := ListExecutableMappings([]*procfs.ProcMap{
+		{StartAddr: 0x0, EndAddr: 0x100, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "./my_executable"},
+		{StartAddr: 0x100, EndAddr: 0x200, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "libc"},
+		{StartAddr: 0x400, EndAddr: 0x500, Perms: &procfs.ProcMapPermissions{Execute: true}, Pathname: "libplugin"},
+	})
+
+	added, removed := current.Diff(previous)
+	require.Equal(t, ExecutableMappings{current[2]}, added)
+	require.Equal(t, ExecutableMappings{previous[2]}, removed)
+
+	added, removed = current.Diff(current)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	added, removed = current.Diff(nil)
+	require.Equal(t, current, added)
+	require.Empty(t, removed)
+}
+
 // Not to be run normally, but helpful to find behavior that
 // might not be covered by unittests.
 func TestAllProcesses(t *testing.T) {
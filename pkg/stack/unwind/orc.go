@@ -0,0 +1,276 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+var (
+	ErrORCSectionsNotFound = errors.New("failed to find .orc_unwind and .orc_unwind_ip sections")
+	ErrORCSectionsMismatch = errors.New(".orc_unwind and .orc_unwind_ip sections have a different number of entries")
+)
+
+const (
+	// Size of `struct orc_entry`, which is packed.
+	orcEntrySize = 6
+	// Each entry in .orc_unwind_ip is a s32 relative to its own address.
+	orcIPEntrySize = 4
+)
+
+// ORC register identifiers. They must be kept in sync with
+// arch/x86/include/asm/orc_types.h.
+const (
+	orcRegUndefined = 0
+	orcRegPrevSP    = 1
+	orcRegBP        = 4
+	orcRegSP        = 5
+)
+
+// ORCType describes how the entry should be unwound. As the raw values
+// changed across kernel versions, they are normalised when parsing.
+type ORCType uint8
+
+const (
+	// ORCTypeUndefined marks addresses without unwind information, such as
+	// the gaps between functions.
+	ORCTypeUndefined ORCType = iota
+	// ORCTypeEndOfStack marks the bottom of the kernel stack.
+	ORCTypeEndOfStack
+	// ORCTypeCall is a regular function frame.
+	ORCTypeCall
+	// ORCTypeRegs means that a full `pt_regs` is at the top of the stack.
+	ORCTypeRegs
+	// ORCTypeRegsPartial means that the `iret` part of `pt_regs` is at the
+	// top of the stack.
+	ORCTypeRegsPartial
+)
+
+// ORCEntry is a decoded row of the kernel's ORC unwind information.
+type ORCEntry struct {
+	IP       uint64
+	SPOffset int16
+	BPOffset int16
+	SPReg    uint8
+	BPReg    uint8
+	Type     ORCType
+}
+
+type ORCEntries []ORCEntry
+
+func (e ORCEntries) Len() int           { return len(e) }
+func (e ORCEntries) Less(i, j int) bool { return e[i].IP < e[j].IP }
+func (e ORCEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// ReadORC reads the ORC unwind information from a kernel image, such as
+// vmlinux, which is the unwind information format used by x86_64 kernels
+// built with CONFIG_UNWINDER_ORC. The kernel stacks of the samples are walked
+// by the kernel's own ORC unwinder, so this is only used to inspect the unwind
+// information of kernels, see PrintORCTable.
+func ReadORC(path string) (ORCEntries, error) {
+	obj, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	defer obj.Close()
+
+	ipSec := obj.Section(".orc_unwind_ip")
+	unwindSec := obj.Section(".orc_unwind")
+	if ipSec == nil || unwindSec == nil {
+		return nil, ErrORCSectionsNotFound
+	}
+
+	ipData, err := ipSec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .orc_unwind_ip section: %w", err)
+	}
+	unwindData, err := unwindSec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .orc_unwind section: %w", err)
+	}
+
+	// The .orc_header section was introduced in Linux 6.4 together with
+	// the new layout of the `type` bitfield.
+	newLayout := obj.Section(".orc_header") != nil
+
+	return ParseORC(ipData, unwindData, ipSec.Addr, obj.ByteOrder, newLayout)
+}
+
+// ParseORC decodes the contents of the .orc_unwind_ip and .orc_unwind
+// sections. The returned entries are sorted by instruction pointer.
+func ParseORC(ipData, unwindData []byte, ipSectionAddr uint64, byteOrder binary.ByteOrder, newLayout bool) (ORCEntries, error) {
+	if len(ipData)%orcIPEntrySize != 0 || len(unwindData)%orcEntrySize != 0 {
+		return nil, fmt.Errorf("ORC sections have an unexpected size: %w", ErrORCSectionsMismatch)
+	}
+
+	count := len(ipData) / orcIPEntrySize
+	if count != len(unwindData)/orcEntrySize {
+		return nil, ErrORCSectionsMismatch
+	}
+
+	if count == 0 {
+		return nil, ErrNoFDEsFound
+	}
+
+	entries := make(ORCEntries, 0, count)
+	for i := 0; i < count; i++ {
+		relativeIP := int32(byteOrder.Uint32(ipData[i*orcIPEntrySize:]))
+		raw := unwindData[i*orcEntrySize : (i+1)*orcEntrySize]
+
+		entry := ORCEntry{
+			IP:       uint64(int64(ipSectionAddr) + int64(i*orcIPEntrySize) + int64(relativeIP)),
+			SPOffset: int16(byteOrder.Uint16(raw[0:])),
+			BPOffset: int16(byteOrder.Uint16(raw[2:])),
+		}
+
+		bits := byteOrder.Uint16(raw[4:])
+		entry.SPReg = uint8(bits & 0xf)
+		entry.BPReg = uint8((bits >> 4) & 0xf)
+
+		if newLayout {
+			// type:3, signal:1.
+			entry.Type = ORCType((bits >> 8) & 0x7)
+		} else {
+			// type:2, end:1.
+			switch {
+			case (bits>>10)&0x1 == 1:
+				entry.Type = ORCTypeEndOfStack
+			case entry.SPReg == orcRegUndefined:
+				entry.Type = ORCTypeUndefined
+			default:
+				// CALL, REGS and REGS_PARTIAL were 0, 1 and 2 respectively.
+				entry.Type = ORCType((bits>>8)&0x3) + ORCTypeCall
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Stable(entries)
+	return entries, nil
+}
+
+// orcUnwindTableRow converts an ORC entry to the same row representation
+// used for DWARF derived unwind information. It returns nil for entries that
+// don't contain unwind information.
+func orcUnwindTableRow(entry ORCEntry) *UnwindTableRow {
+	//nolint:exhaustive
+	switch entry.Type {
+	case ORCTypeUndefined:
+		return nil
+	case ORCTypeEndOfStack:
+		return &UnwindTableRow{
+			Loc: entry.IP,
+			CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64StackPointer},
+			RA:  frame.DWRule{Rule: frame.RuleUndefined},
+		}
+	}
+
+	row := &UnwindTableRow{
+		Loc: entry.IP,
+		RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+	}
+
+	// Frames containing `pt_regs` can't be represented in the current
+	// unwind table format, use an unknown expression so the unwinder
+	// bails out.
+	if entry.Type != ORCTypeCall {
+		row.CFA = frame.DWRule{Rule: frame.RuleExpression}
+		row.RBP = frame.DWRule{Rule: frame.RuleUnknown}
+		return row
+	}
+
+	switch entry.SPReg {
+	case orcRegSP:
+		row.CFA = frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64StackPointer, Offset: int64(entry.SPOffset)}
+	case orcRegBP:
+		row.CFA = frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64FramePointer, Offset: int64(entry.SPOffset)}
+	default:
+		row.CFA = frame.DWRule{Rule: frame.RuleExpression}
+	}
+
+	switch entry.BPReg {
+	case orcRegUndefined:
+		row.RBP = frame.DWRule{Rule: frame.RuleUnknown}
+	case orcRegPrevSP:
+		row.RBP = frame.DWRule{Rule: frame.RuleOffset, Offset: int64(entry.BPOffset)}
+	default:
+		row.RBP = frame.DWRule{Rule: frame.RuleExpression}
+	}
+
+	return row
+}
+
+// BuildCompactUnwindTableFromORC produces a compact unwind table for the given
+// ORC entries. As ORC doesn't have the notion of functions, addresses without
+// unwind information are encoded as end of FDE markers, which also allows
+// splitting the resulting table in shards.
+func BuildCompactUnwindTableFromORC(entries ORCEntries) (CompactUnwindTable, error) {
+	table := make(CompactUnwindTable, 0, len(entries))
+	for _, entry := range entries {
+		row := orcUnwindTableRow(entry)
+		if row == nil {
+			// Avoid leading and repeated markers.
+			if len(table) == 0 || table[len(table)-1].IsEndOfFDEMarker() {
+				continue
+			}
+			table = append(table, CompactUnwindTableRow{
+				pc:      entry.IP,
+				cfaType: uint8(cfaTypeEndFdeMarker),
+			})
+			continue
+		}
+
+		compactRow, err := rowToCompactRow(row, frame.X86_64Registers)
+		if err != nil {
+			return CompactUnwindTable{}, err
+		}
+		table = append(table, compactRow)
+	}
+	return table, nil
+}
+
+// PrintORCTable prints the compact unwind table built from the ORC unwind
+// information of the given kernel image, or only the row covering the given
+// PC when set.
+func PrintORCTable(writer io.Writer, path string, pc *uint64) error {
+	entries, err := ReadORC(path)
+	if err != nil {
+		return err
+	}
+	table, err := BuildCompactUnwindTableFromORC(entries)
+	if err != nil {
+		return err
+	}
+
+	for i, row := range table {
+		if pc != nil && (row.Pc() > *pc || (i+1 < len(table) && table[i+1].Pc() <= *pc)) {
+			continue
+		}
+		fmt.Fprintf(writer, "pc: %x ", row.Pc())
+		fmt.Fprintf(writer, "cfa_type: %-2d ", row.CfaType())
+		fmt.Fprintf(writer, "rbp_type: %-2d ", row.RbpType())
+		fmt.Fprintf(writer, "cfa_offset: %-4d ", row.CfaOffset())
+		fmt.Fprintf(writer, "rbp_offset: %-4d", row.RbpOffset())
+		fmt.Fprintf(writer, "\n")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type rawORCEntry struct {
+	ip       uint64
+	spOffset int16
+	bpOffset int16
+	bits     uint16
+}
+
+func encodeORC(t *testing.T, sectionAddr uint64, raw []rawORCEntry) ([]byte, []byte) {
+	t.Helper()
+
+	ipData := make([]byte, 0, len(raw)*orcIPEntrySize)
+	unwindData := make([]byte, 0, len(raw)*orcEntrySize)
+	for i, r := range raw {
+		relative := int32(int64(r.ip) - int64(sectionAddr) - int64(i*orcIPEntrySize))
+		ipData = binary.LittleEndian.AppendUint32(ipData, uint32(relative))
+		unwindData = binary.LittleEndian.AppendUint16(unwindData, uint16(r.spOffset))
+		unwindData = binary.LittleEndian.AppendUint16(unwindData, uint16(r.bpOffset))
+		unwindData = binary.LittleEndian.AppendUint16(unwindData, r.bits)
+	}
+	return ipData, unwindData
+}
+
+func TestParseORC(t *testing.T) {
+	const sectionAddr = 0xffffffff82000000
+
+	ipData, unwindData := encodeORC(t, sectionAddr, []rawORCEntry{
+		// Out of order on purpose, they must be sorted.
+		{ip: 0xffffffff81000010, spOffset: 16, bpOffset: -16, bits: orcRegSP | orcRegPrevSP<<4},
+		{ip: 0xffffffff81000000, spOffset: 8, bits: orcRegSP},
+		{ip: 0xffffffff81000020, bits: 0},
+		{ip: 0xffffffff81000030, bits: orcRegSP | 1<<10},
+	})
+
+	entries, err := ParseORC(ipData, unwindData, sectionAddr, binary.LittleEndian, false)
+	require.NoError(t, err)
+	require.Equal(t, ORCEntries{
+		{IP: 0xffffffff81000000, SPOffset: 8, SPReg: orcRegSP, Type: ORCTypeCall},
+		{IP: 0xffffffff81000010, SPOffset: 16, BPOffset: -16, SPReg: orcRegSP, BPReg: orcRegPrevSP, Type: ORCTypeCall},
+		{IP: 0xffffffff81000020, Type: ORCTypeUndefined},
+		{IP: 0xffffffff81000030, SPReg: orcRegSP, Type: ORCTypeEndOfStack},
+	}, entries)
+}
+
+func TestParseORCNewLayout(t *testing.T) {
+	const sectionAddr = 0x1000
+
+	ipData, unwindData := encodeORC(t, sectionAddr, []rawORCEntry{
+		{ip: 0x100, spOffset: 8, bits: orcRegSP | 2<<8},
+		{ip: 0x200, bits: orcRegSP | 3<<8},
+		{ip: 0x300, bits: 1 << 8},
+	})
+
+	entries, err := ParseORC(ipData, unwindData, sectionAddr, binary.LittleEndian, true)
+	require.NoError(t, err)
+	require.Equal(t, ORCTypeCall, entries[0].Type)
+	require.Equal(t, ORCTypeRegs, entries[1].Type)
+	require.Equal(t, ORCTypeEndOfStack, entries[2].Type)
+}
+
+func TestParseORCMismatch(t *testing.T) {
+	_, err := ParseORC(make([]byte, 8), make([]byte, 6), 0, binary.LittleEndian, false)
+	require.ErrorIs(t, err, ErrORCSectionsMismatch)
+}
+
+func TestBuildCompactUnwindTableFromORC(t *testing.T) {
+	entries := ORCEntries{
+		{IP: 0x10, Type: ORCTypeUndefined},
+		{IP: 0x20, SPOffset: 8, SPReg: orcRegSP, Type: ORCTypeCall},
+		{IP: 0x24, SPOffset: 16, BPOffset: -16, SPReg: orcRegSP, BPReg: orcRegPrevSP, Type: ORCTypeCall},
+		{IP: 0x30, Type: ORCTypeUndefined},
+		{IP: 0x34, Type: ORCTypeUndefined},
+		{IP: 0x40, SPOffset: 16, SPReg: orcRegBP, Type: ORCTypeCall},
+		{IP: 0x48, SPReg: orcRegSP, Type: ORCTypeRegs},
+		{IP: 0x50, Type: ORCTypeEndOfStack},
+		{IP: 0x60, Type: ORCTypeUndefined},
+	}
+
+	table, err := BuildCompactUnwindTableFromORC(entries)
+	require.NoError(t, err)
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x20, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpRuleOffsetUnchanged), cfaOffset: 8},
+		{pc: 0x24, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpRuleOffset), cfaOffset: 16, rbpOffset: -16},
+		{pc: 0x30, cfaType: uint8(cfaTypeEndFdeMarker)},
+		{pc: 0x40, cfaType: uint8(cfaTypeRbp), rbpType: uint8(rbpRuleOffsetUnchanged), cfaOffset: 16},
+		{pc: 0x48, cfaType: uint8(cfaTypeExpression), rbpType: uint8(rbpRuleOffsetUnchanged), cfaOffset: int16(ExpressionUnknown)},
+		{pc: 0x50, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpTypeUndefinedReturnAddress)},
+		{pc: 0x60, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, table)
+}
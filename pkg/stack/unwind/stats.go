@@ -0,0 +1,185 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+// TableStats summarises the unwind information of an executable.
+type TableStats struct {
+	FDEs int
+	Rows int
+	// Unsupported counts the rows that the BPF unwinder can't handle, keyed
+	// by the rule and the DWARF opcode that caused it.
+	Unsupported map[string]int
+	// TextCoverage is the fraction of the .text section covered by FDEs.
+	TextCoverage float64
+	// MaxRows is the highest number of rows of a single function, which
+	// starts at MaxRowsFunction.
+	MaxRows         int
+	MaxRowsFunction uint64
+}
+
+func expressionOpcodeString(expression []byte) string {
+	if len(expression) == 0 {
+		return "empty"
+	}
+
+	opcode := expression[0]
+	switch {
+	case opcode >= frame.DW_OP_breg0 && opcode <= frame.DW_OP_breg31:
+		return fmt.Sprintf("DW_OP_breg%d", opcode-frame.DW_OP_breg0)
+	case opcode >= frame.DW_OP_reg0 && opcode <= frame.DW_OP_reg31:
+		return fmt.Sprintf("DW_OP_reg%d", opcode-frame.DW_OP_reg0)
+	default:
+		return fmt.Sprintf("DW_OP %#x", opcode)
+	}
+}
+
+// unsupportedReason returns why the given row can't be used by the BPF
+// unwinder, or an empty string if it can.
+func unsupportedReason(row *UnwindTableRow, regs frame.Registers) string {
+	compactRow, err := rowToCompactRow(row, regs)
+	if err != nil {
+		return "invalid CFA rule"
+	}
+
+	if compactRow.CfaType() == uint8(cfaTypeExpression) && compactRow.CfaOffset() == int16(ExpressionUnknown) {
+		return "CFA expression " + expressionOpcodeString(row.CFA.Expression)
+	}
+
+	switch compactRow.RbpType() {
+	case uint8(rbpRuleRegister):
+		return "RBP register"
+	case uint8(rbpTypeExpression):
+		if row.RBP.Rule != frame.RuleExpression {
+			return "return address " + ruleString(row.RA)
+		}
+		return "RBP expression " + expressionOpcodeString(row.RBP.Expression)
+	}
+	return ""
+}
+
+// textCoverage returns the fraction of the .text section that is covered by
+// the given FDEs, which must be sorted.
+func textCoverage(text *elf.Section, fdes frame.FrameDescriptionEntries) float64 {
+	if text == nil || text.Size == 0 {
+		return 0
+	}
+
+	start, end := text.Addr, text.Addr+text.Size
+	covered := uint64(0)
+	last := start
+	for _, fde := range fdes {
+		begin := fde.Begin()
+		if begin < last {
+			begin = last
+		}
+		finish := fde.End()
+		if finish > end {
+			finish = end
+		}
+		if finish <= begin {
+			continue
+		}
+		covered += finish - begin
+		last = finish
+	}
+
+	return float64(covered) / float64(text.Size)
+}
+
+// Stats computes statistics about the unwind information of the given
+// executable.
+func (ptb *UnwindTableBuilder) Stats(path string) (*TableStats, error) {
+	obj, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	text := obj.Section(".text")
+	obj.Close()
+
+	fdes, err := ReadFDEs(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(fdes)
+
+	stats := &TableStats{
+		FDEs:         len(fdes),
+		Unsupported:  map[string]int{},
+		TextCoverage: textCoverage(text, fdes),
+	}
+
+	for _, fde := range fdes {
+		rows := functionStats(fde, stats.Unsupported)
+		stats.Rows += rows
+		if rows > stats.MaxRows {
+			stats.MaxRows = rows
+			stats.MaxRowsFunction = fde.Begin()
+		}
+	}
+
+	return stats, nil
+}
+
+// functionStats returns the number of rows of the given FDE and records the
+// unsupported ones.
+func functionStats(fde *frame.FrameDescriptionEntry, unsupported map[string]int) (rows int) {
+	// The frame package panics when it finds an unknown opcode.
+	defer func() {
+		if r := recover(); r != nil {
+			unsupported["invalid CFA program"]++
+		}
+	}()
+
+	frameContext := frame.ExecuteDwarfProgram(fde, nil)
+	for insCtx := frameContext.Next(); frameContext.HasNext(); insCtx = frameContext.Next() {
+		rows++
+		if reason := unsupportedReason(unwindTableRow(insCtx), fde.Registers()); reason != "" {
+			unsupported[reason]++
+		}
+	}
+	return rows
+}
+
+// Print writes a human readable report to the given io.Writer.
+func (s *TableStats) Print(writer io.Writer) {
+	fmt.Fprintf(writer, "FDEs: %d\n", s.FDEs)
+	fmt.Fprintf(writer, "Rows: %d\n", s.Rows)
+	fmt.Fprintf(writer, ".text coverage: %.2f%%\n", s.TextCoverage*100)
+	fmt.Fprintf(writer, "Max rows per function: %d (function start: %x)\n", s.MaxRows, s.MaxRowsFunction)
+
+	reasons := make([]string, 0, len(s.Unsupported))
+	for reason := range s.Unsupported {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if s.Unsupported[reasons[i]] == s.Unsupported[reasons[j]] {
+			return reasons[i] < reasons[j]
+		}
+		return s.Unsupported[reasons[i]] > s.Unsupported[reasons[j]]
+	})
+
+	fmt.Fprintf(writer, "Unsupported rows:\n")
+	for _, reason := range reasons {
+		fmt.Fprintf(writer, "\t%-40s %d\n", reason, s.Unsupported[reason])
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+func TestUnsupportedReason(t *testing.T) {
+	cfa := frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64StackPointer, Offset: 8}
+
+	require.Empty(t, unsupportedReason(&UnwindTableRow{CFA: cfa, RBP: frame.DWRule{Rule: frame.RuleOffset, Offset: -16}}, frame.X86_64Registers))
+	require.Empty(t, unsupportedReason(&UnwindTableRow{CFA: frame.DWRule{Rule: frame.RuleExpression, Expression: Plt2[:]}}, frame.X86_64Registers))
+	require.Equal(t, "invalid CFA rule", unsupportedReason(&UnwindTableRow{}, frame.X86_64Registers))
+	require.Equal(t, "CFA expression DW_OP_breg3", unsupportedReason(&UnwindTableRow{
+		CFA: frame.DWRule{Rule: frame.RuleExpression, Expression: []byte{frame.DW_OP_breg3, 0x08, frame.DW_OP_deref}},
+	}, frame.X86_64Registers))
+	require.Equal(t, "RBP register", unsupportedReason(&UnwindTableRow{CFA: cfa, RBP: frame.DWRule{Rule: frame.RuleRegister, Reg: 3}}, frame.X86_64Registers))
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CompactUnwindTableFormatVersion must be bumped every time the layout or the
+// semantics of the compact unwind table rows change, so stale tables persisted
+// on disk are not loaded.
+const CompactUnwindTableFormatVersion = 3
+
+const (
+	tableCacheMagic      = "PUWT"
+	tableCacheHeaderSize = 24
+	// Size of a serialized compact unwind table row, which matches the
+	// layout used in the BPF maps.
+	compactRowSize = 14
+)
+
+var (
+	ErrTableCacheMiss    = errors.New("unwind table not found in the cache")
+	ErrTableCacheCorrupt = errors.New("unwind table cache entry is corrupt")
+)
+
+const (
+	lvHit     = "hit"
+	lvMiss    = "miss"
+	lvCorrupt = "corrupt"
+	lvSuccess = "success"
+	lvError   = "error"
+)
+
+type tableCacheMetrics struct {
+	lookups *prometheus.CounterVec
+	stores  *prometheus.CounterVec
+}
+
+func newTableCacheMetrics(reg prometheus.Registerer) *tableCacheMetrics {
+	m := &tableCacheMetrics{
+		lookups: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_unwind_table_disk_cache_lookups_total",
+			Help: "Total number of unwind table lookups in the disk cache.",
+		}, []string{"result"}),
+		stores: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_unwind_table_disk_cache_stores_total",
+			Help: "Total number of unwind tables stored in the disk cache.",
+		}, []string{"result"}),
+	}
+	m.lookups.WithLabelValues(lvHit)
+	m.lookups.WithLabelValues(lvMiss)
+	m.lookups.WithLabelValues(lvCorrupt)
+	m.lookups.WithLabelValues(lvError)
+	m.stores.WithLabelValues(lvSuccess)
+	m.stores.WithLabelValues(lvError)
+	return m
+}
+
+// TableCache persists compact unwind tables on disk so they don't have to be
+// regenerated after the agent restarts. Entries are keyed by build ID and by
+// the table format version.
+//
+// Each entry is laid out as:
+//
+//	magic [4]byte | version u32 | rows u64 | crc32 u32 | reserved u32 | rows...
+//
+// where the checksum covers the serialized rows.
+type TableCache struct {
+	logger  log.Logger
+	metrics *tableCacheMetrics
+	dir     string
+}
+
+// NewTableCache returns a cache that stores unwind tables in the given
+// directory, creating it if needed.
+func NewTableCache(logger log.Logger, reg prometheus.Registerer, dir string) (*TableCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create unwind table cache directory: %w", err)
+	}
+
+	return &TableCache{
+		logger:  logger,
+		metrics: newTableCacheMetrics(reg),
+		dir:     dir,
+	}, nil
+}
+
+func (c *TableCache) path(buildID string) string {
+	return filepath.Join(c.dir, tableCacheEntryName(buildID))
+}
+
+// tableCacheEntryName returns the file name of the entry for the given build
+// ID.
+func tableCacheEntryName(buildID string) string {
+	return fmt.Sprintf("%s.v%d.unwind", filepath.Base(buildID), CompactUnwindTableFormatVersion)
+}
+
+// Get loads the unwind table for the given build ID. Entries that fail the
+// integrity checks are removed.
+func (c *TableCache) Get(buildID string) (CompactUnwindTable, error) {
+	p := c.path(buildID)
+
+	table, err := readTableCacheEntry(p)
+	switch {
+	case err == nil:
+		c.metrics.lookups.WithLabelValues(lvHit).Inc()
+		return table, nil
+	case errors.Is(err, os.ErrNotExist):
+		c.metrics.lookups.WithLabelValues(lvMiss).Inc()
+		return nil, ErrTableCacheMiss
+	case errors.Is(err, ErrTableCacheCorrupt):
+		c.metrics.lookups.WithLabelValues(lvCorrupt).Inc()
+		level.Warn(c.logger).Log("msg", "removing corrupt unwind table cache entry", "path", p, "err", err)
+		if err := os.Remove(p); err != nil {
+			level.Debug(c.logger).Log("msg", "failed to remove unwind table cache entry", "path", p, "err", err)
+		}
+		return nil, err
+	default:
+		c.metrics.lookups.WithLabelValues(lvError).Inc()
+		return nil, err
+	}
+}
+
+// Put stores the unwind table for the given build ID. The entry is written to
+// a temporary file first and then renamed so readers never observe partial
+// writes.
+func (c *TableCache) Put(buildID string, table CompactUnwindTable) error {
+	if err := c.put(buildID, table); err != nil {
+		c.metrics.stores.WithLabelValues(lvError).Inc()
+		return err
+	}
+	c.metrics.stores.WithLabelValues(lvSuccess).Inc()
+	return nil
+}
+
+func (c *TableCache) put(buildID string, table CompactUnwindTable) error {
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(encodeTableCacheEntry(table)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write unwind table: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), c.path(buildID)); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
+
+func encodeTableCacheEntry(table CompactUnwindTable) []byte {
+	buf := make([]byte, tableCacheHeaderSize+len(table)*compactRowSize)
+
+	rows := buf[tableCacheHeaderSize:]
+	for i, row := range table {
+		r := rows[i*compactRowSize:]
+		binary.LittleEndian.PutUint64(r[0:], row.pc)
+		r[8] = row.cfaType
+		r[9] = row.rbpType
+		binary.LittleEndian.PutUint16(r[10:], uint16(row.cfaOffset))
+		binary.LittleEndian.PutUint16(r[12:], uint16(row.rbpOffset))
+	}
+
+	copy(buf[0:], tableCacheMagic)
+	binary.LittleEndian.PutUint32(buf[4:], CompactUnwindTableFormatVersion)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(table)))
+	binary.LittleEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(rows))
+	return buf
+}
+
+func readTableCacheEntry(path string) (CompactUnwindTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	if size < tableCacheHeaderSize {
+		return nil, fmt.Errorf("file is too small: %w", ErrTableCacheCorrupt)
+	}
+
+	data, release, err := mapFile(f, int(size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to mmap unwind table: %w", err)
+	}
+	defer release()
+
+	return decodeTableCacheEntry(data)
+}
+
+func decodeTableCacheEntry(data []byte) (CompactUnwindTable, error) {
+	if len(data) < tableCacheHeaderSize || string(data[0:4]) != tableCacheMagic {
+		return nil, fmt.Errorf("bad magic: %w", ErrTableCacheCorrupt)
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != CompactUnwindTableFormatVersion {
+		return nil, fmt.Errorf("unexpected format version %d: %w", version, ErrTableCacheCorrupt)
+	}
+
+	count := binary.LittleEndian.Uint64(data[8:])
+	rows := data[tableCacheHeaderSize:]
+	if uint64(len(rows)) != count*compactRowSize {
+		return nil, fmt.Errorf("expected %d rows, found %d bytes: %w", count, len(rows), ErrTableCacheCorrupt)
+	}
+	if checksum := binary.LittleEndian.Uint32(data[16:]); checksum != crc32.ChecksumIEEE(rows) {
+		return nil, fmt.Errorf("checksum mismatch: %w", ErrTableCacheCorrupt)
+	}
+
+	table := make(CompactUnwindTable, count)
+	for i := range table {
+		r := rows[i*compactRowSize:]
+		table[i] = CompactUnwindTableRow{
+			pc:        binary.LittleEndian.Uint64(r[0:]),
+			cfaType:   r[8],
+			rbpType:   r[9],
+			cfaOffset: int16(binary.LittleEndian.Uint16(r[10:])),
+			rbpOffset: int16(binary.LittleEndian.Uint16(r[12:])),
+		}
+	}
+	return table, nil
+}
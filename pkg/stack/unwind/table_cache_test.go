@@ -0,0 +1,70 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableCacheRoundTrip(t *testing.T) {
+	c, err := NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir())
+	require.NoError(t, err)
+
+	_, err = c.Get("deadbeef")
+	require.ErrorIs(t, err, ErrTableCacheMiss)
+
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpRuleOffsetUnchanged), cfaOffset: 8},
+		{pc: 0x1004, cfaType: uint8(cfaTypeRbp), rbpType: uint8(rbpRuleOffset), cfaOffset: 16, rbpOffset: -16},
+		{pc: 0x1010, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	require.NoError(t, c.Put("deadbeef", table))
+
+	have, err := c.Get("deadbeef")
+	require.NoError(t, err)
+	require.Equal(t, table, have)
+}
+
+func TestTableCacheCorruptEntry(t *testing.T) {
+	c, err := NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, c.Put("deadbeef", CompactUnwindTable{{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8}}))
+
+	// Flip a bit in the rows.
+	data, err := os.ReadFile(c.path("deadbeef"))
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0x1
+	require.NoError(t, os.WriteFile(c.path("deadbeef"), data, 0o600))
+
+	_, err = c.Get("deadbeef")
+	require.ErrorIs(t, err, ErrTableCacheCorrupt)
+
+	// Corrupt entries are removed.
+	_, err = c.Get("deadbeef")
+	require.ErrorIs(t, err, ErrTableCacheMiss)
+}
+
+func TestDecodeTableCacheEntryVersionMismatch(t *testing.T) {
+	data := encodeTableCacheEntry(CompactUnwindTable{})
+	data[4]++
+
+	_, err := decodeTableCacheEntry(data)
+	require.ErrorIs(t, err, ErrTableCacheCorrupt)
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	tableFetchTimeout = 5 * time.Second
+	// maxFetchedTableSize bounds the entries read from the server, well above
+	// the size of the biggest unwind tables the BPF maps can hold.
+	maxFetchedTableSize = 256 * 1024 * 1024
+)
+
+// TableFetcher fetches precomputed compact unwind tables from an HTTP server,
+// so they don't have to be generated locally. Entries are requested by the
+// name they have in a TableCache directory, which a sidecar or another agent
+// can serve with any static file server.
+type TableFetcher struct {
+	logger  log.Logger
+	lookups *prometheus.CounterVec
+	client  *http.Client
+	url     string
+}
+
+// NewTableFetcher returns a fetcher of unwind tables from the server at the
+// given URL.
+func NewTableFetcher(logger log.Logger, reg prometheus.Registerer, url string) *TableFetcher {
+	lookups := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "parca_agent_unwind_table_remote_lookups_total",
+		Help: "Total number of unwind table lookups in the remote table server.",
+	}, []string{"result"})
+	lookups.WithLabelValues(lvHit)
+	lookups.WithLabelValues(lvMiss)
+	lookups.WithLabelValues(lvCorrupt)
+	lookups.WithLabelValues(lvError)
+
+	return &TableFetcher{
+		logger:  logger,
+		lookups: lookups,
+		client:  &http.Client{Timeout: tableFetchTimeout},
+		url:     strings.TrimSuffix(url, "/"),
+	}
+}
+
+// Get fetches the unwind table for the given build ID. It returns
+// ErrTableCacheMiss when the server doesn't have it.
+func (f *TableFetcher) Get(buildID string) (CompactUnwindTable, error) {
+	table, err := f.get(buildID)
+	switch {
+	case err == nil:
+		f.lookups.WithLabelValues(lvHit).Inc()
+	case errors.Is(err, ErrTableCacheMiss):
+		f.lookups.WithLabelValues(lvMiss).Inc()
+	case errors.Is(err, ErrTableCacheCorrupt):
+		f.lookups.WithLabelValues(lvCorrupt).Inc()
+		level.Warn(f.logger).Log("msg", "fetched corrupt unwind table", "buildID", buildID, "err", err)
+	default:
+		f.lookups.WithLabelValues(lvError).Inc()
+	}
+	return table, err
+}
+
+func (f *TableFetcher) get(buildID string) (CompactUnwindTable, error) {
+	resp, err := f.client.Get(f.url + "/" + tableCacheEntryName(buildID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unwind table: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrTableCacheMiss
+	default:
+		return nil, fmt.Errorf("unexpected status fetching unwind table: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchedTableSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unwind table: %w", err)
+	}
+	if len(data) > maxFetchedTableSize {
+		return nil, fmt.Errorf("unwind table is bigger than %d bytes: %w", maxFetchedTableSize, ErrTableCacheCorrupt)
+	}
+	return decodeTableCacheEntry(data)
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableFetcher(t *testing.T) {
+	// A directory of a table cache served by a static file server.
+	c, err := NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), t.TempDir())
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.FileServer(http.Dir(c.dir)))
+	t.Cleanup(srv.Close)
+
+	f := NewTableFetcher(log.NewNopLogger(), prometheus.NewRegistry(), srv.URL+"/")
+
+	_, err = f.Get("deadbeef")
+	require.ErrorIs(t, err, ErrTableCacheMiss)
+
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpRuleOffsetUnchanged), cfaOffset: 8},
+		{pc: 0x1010, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	require.NoError(t, c.Put("deadbeef", table))
+
+	have, err := f.Get("deadbeef")
+	require.NoError(t, err)
+	require.Equal(t, table, have)
+
+	require.NoError(t, os.WriteFile(c.path("deadbeef"), []byte("not a table"), 0o600))
+	_, err = f.Get("deadbeef")
+	require.ErrorIs(t, err, ErrTableCacheCorrupt)
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -28,8 +29,9 @@ import (
 )
 
 var (
-	ErrNoFDEsFound            = errors.New("no FDEs found")
-	ErrEhFrameSectionNotFound = errors.New("failed to find .eh_frame section")
+	ErrNoFDEsFound             = errors.New("no FDEs found")
+	ErrEhFrameSectionNotFound  = errors.New("failed to find .eh_frame section")
+	ErrUnsupportedArchitecture = errors.New("unsupported architecture")
 )
 
 type UnwindTableBuilder struct {
@@ -57,6 +59,28 @@ func x64RegisterToString(reg uint64) string {
 	return x86_64Regs[reg]
 }
 
+// riscv64RegisterToString returns the ABI name of the given DWARF register,
+// see https://github.com/riscv-non-isa/riscv-elf-psabi-doc/blob/master/riscv-dwarf.adoc.
+func riscv64RegisterToString(reg uint64) string {
+	riscv64Regs := []string{
+		"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2", "s0", "s1", "a0", "a1",
+		"a2", "a3", "a4", "a5", "a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+		"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+	}
+
+	if reg >= uint64(len(riscv64Regs)) {
+		return fmt.Sprintf("r%d", reg)
+	}
+	return riscv64Regs[reg]
+}
+
+func registerToString(regs frame.Registers, reg uint64) string {
+	if regs == frame.RISCV64Registers {
+		return riscv64RegisterToString(reg)
+	}
+	return x64RegisterToString(reg)
+}
+
 // PrintTable is a debugging helper that prints the unwinding table to the given io.Writer.
 func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact bool, pc *uint64) error {
 	fdes, err := ReadFDEs(path)
@@ -81,6 +105,8 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 
 		fmt.Fprintf(writer, "=> Function start: %x, Function end: %x\n", fde.Begin(), fde.End())
 
+		regs := fde.Registers()
+
 		frameContext := frame.ExecuteDwarfProgram(fde, unwindContext)
 		for insCtx := frameContext.Next(); frameContext.HasNext(); insCtx = frameContext.Next() {
 			unwindRow := unwindTableRow(insCtx)
@@ -90,7 +116,7 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 			}
 
 			if compact {
-				compactRow, err := rowToCompactRow(unwindRow)
+				compactRow, err := rowToCompactRow(unwindRow, regs)
 				if err != nil {
 					return err
 				}
@@ -106,12 +132,16 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 				//nolint:exhaustive
 				switch unwindRow.CFA.Rule {
 				case frame.RuleCFA:
-					CFAReg := x64RegisterToString(unwindRow.CFA.Reg)
+					CFAReg := registerToString(regs, unwindRow.CFA.Reg)
 					fmt.Fprintf(writer, "\tLoc: %x CFA: $%s=%-4d", unwindRow.Loc, CFAReg, unwindRow.CFA.Offset)
 				case frame.RuleExpression:
 					expressionID := ExpressionIdentifier(unwindRow.CFA.Expression)
 					if expressionID == ExpressionUnknown {
-						fmt.Fprintf(writer, "\tLoc: %x CFA: exp     ", unwindRow.Loc)
+						if expression, ok := EvaluateRegisterExpression(unwindRow.CFA.Expression); ok {
+							fmt.Fprintf(writer, "\tLoc: %x CFA: exp (%s)", unwindRow.Loc, expression.String())
+						} else {
+							fmt.Fprintf(writer, "\tLoc: %x CFA: exp     ", unwindRow.Loc)
+						}
 					} else {
 						fmt.Fprintf(writer, "\tLoc: %x CFA: exp (plt %d)", unwindRow.Loc, expressionID)
 					}
@@ -125,12 +155,16 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 				case frame.RuleUndefined, frame.RuleUnknown:
 					fmt.Fprintf(writer, "\tRBP: u")
 				case frame.RuleRegister:
-					RBPReg := x64RegisterToString(unwindRow.RBP.Reg)
+					RBPReg := registerToString(regs, unwindRow.RBP.Reg)
 					fmt.Fprintf(writer, "\tRBP: $%s", RBPReg)
 				case frame.RuleOffset:
 					fmt.Fprintf(writer, "\tRBP: c%-4d", unwindRow.RBP.Offset)
 				case frame.RuleExpression:
-					fmt.Fprintf(writer, "\tRBP: exp")
+					if expression, ok := EvaluateRegisterExpression(unwindRow.RBP.Expression); ok {
+						fmt.Fprintf(writer, "\tRBP: exp (%s)", expression.String())
+					} else {
+						fmt.Fprintf(writer, "\tRBP: exp")
+					}
 				default:
 					panic(fmt.Sprintf("Got rule %d for RBP, which wasn't expected", unwindRow.RBP.Rule))
 				}
@@ -143,6 +177,35 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 	return nil
 }
 
+// PrintMappingTables is a debugging helper that prints the unwinding tables
+// of the objects of the given mappings of a process in address order, read
+// at the path returned by objectPath. Mappings that are not file-backed, or
+// whose objects fail to be read, are listed without their tables.
+func (ptb *UnwindTableBuilder) PrintMappingTables(writer io.Writer, mappings ExecutableMappings, objectPath func(*ExecutableMapping) string, compact bool, pc *uint64) {
+	sorted := make(ExecutableMappings, len(mappings))
+	copy(sorted, mappings)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartAddr < sorted[j].StartAddr })
+
+	for _, m := range sorted {
+		name := m.Executable
+		if m.IsJitted() {
+			name = "[anonymous]"
+		}
+		if m.IsMainObject() {
+			name += " (main executable)"
+		}
+		fmt.Fprintf(writer, "==> Mapping start: %x, Mapping end: %x, Load address: %x, Object: %s\n", m.StartAddr, m.EndAddr, m.LoadAddr, name)
+
+		if m.IsNotFileBacked() {
+			fmt.Fprintf(writer, "\tnot file-backed, no unwind tables\n")
+			continue
+		}
+		if err := ptb.PrintTable(writer, objectPath(m), compact, pc); err != nil {
+			fmt.Fprintf(writer, "\tfailed to print unwind tables: %v\n", err)
+		}
+	}
+}
+
 func ReadFDEs(path string) (frame.FrameDescriptionEntries, error) {
 	obj, err := elf.Open(path)
 	if err != nil {
@@ -162,8 +225,13 @@ func ReadFDEs(path string) (frame.FrameDescriptionEntries, error) {
 		return nil, fmt.Errorf("failed to read .eh_frame section: %w", err)
 	}
 
+	regs, err := registers(obj)
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO: Byte order of a DWARF section can be different.
-	fdes, err := frame.Parse(ehFrame, obj.ByteOrder, 0, pointerSize(obj.Machine), sec.Addr)
+	fdes, err := frame.Parse(ehFrame, obj.ByteOrder, 0, pointerSize(obj.Machine), sec.Addr, regs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse frame data: %w", err)
 	}
@@ -228,9 +296,24 @@ func pointerSize(arch elf.Machine) int {
 	switch arch {
 	case elf.EM_386:
 		return 4
-	case elf.EM_AARCH64, elf.EM_X86_64:
+	case elf.EM_AARCH64, elf.EM_X86_64, elf.EM_RISCV:
 		return 8
 	default:
 		return 0
 	}
 }
+
+// registers returns the DWARF numbering of the registers the unwind tables
+// are built from for the architecture of the given executable.
+func registers(obj *elf.File) (frame.Registers, error) {
+	//nolint:exhaustive
+	switch obj.Machine {
+	case elf.EM_X86_64:
+		return frame.X86_64Registers, nil
+	case elf.EM_RISCV:
+		if obj.Class == elf.ELFCLASS64 {
+			return frame.RISCV64Registers, nil
+		}
+	}
+	return frame.Registers{}, fmt.Errorf("%w: %s (%s)", ErrUnsupportedArchitecture, obj.Machine, obj.Class)
+}
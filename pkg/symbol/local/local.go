@@ -0,0 +1,308 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package local symbolizes the addresses of the native binaries on the host,
+// for the agents that send their profiles somewhere else than to a Parca
+// server, which would otherwise symbolize them with the uploaded debuginfo.
+package local
+
+import (
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	burrow "github.com/goburrow/cache"
+	parcaprofile "github.com/parca-dev/parca/pkg/profile"
+	"github.com/parca-dev/parca/pkg/symbol/addr2line"
+	"github.com/parca-dev/parca/pkg/symbol/elfutils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/debuginfo"
+	"github.com/parca-dev/parca-agent/pkg/logger"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+const (
+	lvSuccess = "success"
+
+	lvErrNoBuildID  = "no_build_id"
+	lvErrNoLiner    = "no_liner"
+	lvErrNotFound   = "not_found"
+	lvErrLookupFail = "lookup_failed"
+
+	// Interval in which an error of each type is logged at most once, as
+	// they can happen for every sample.
+	errorLogInterval = time.Minute
+	// The binaries that aren't symbolized for a while are closed, their
+	// debug information can take a lot of memory.
+	linerTTL = 10 * time.Minute
+)
+
+var (
+	errNoBuildID = errors.New("mapping has no build ID")
+	errNoLiner   = errors.New("no debug information or symbols to symbolize with")
+	errNotFound  = errors.New("address not found")
+)
+
+type metrics struct {
+	lookups *prometheus.CounterVec
+
+	// Rate limits the logs of the errors by type.
+	errorLogs *logger.Deduplicator
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		lookups: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parca_agent_local_symbolizer_lookups_total",
+				Help: "Total number of addresses of native binaries looked up by the local symbolizer, by result.",
+			},
+			[]string{"result"},
+		),
+		errorLogs: logger.NewDeduplicator(reg, "local_symbolizer", errorLogInterval),
+	}
+	for _, result := range []string{lvSuccess, lvErrNoBuildID, lvErrNoLiner, lvErrNotFound, lvErrLookupFail} {
+		m.lookups.WithLabelValues(result)
+	}
+	return m
+}
+
+// liner resolves the addresses of a binary to their source lines.
+type liner interface {
+	PCToLines(addr uint64) ([]parcaprofile.LocationLine, error)
+	Close() error
+}
+
+// entry is the liner of a binary, or the reason there is none. The liners
+// aren't safe for concurrent use.
+type entry struct {
+	mtx   sync.Mutex
+	liner liner
+	err   error
+}
+
+// Symbolizer symbolizes the normalized addresses of the native binaries with
+// their DWARF debug information, their Go symbol table or their ELF symbol
+// tables, in this order, like the Parca server does. The separate debuginfo
+// files of the binaries are preferred when they are found on the host.
+type Symbolizer struct {
+	logger  log.Logger
+	metrics *metrics
+
+	objFilePool *objectfile.Pool
+	finder      *debuginfo.Finder
+
+	// The liners of the binaries by build ID.
+	liners burrow.Cache
+	loads  singleflight.Group
+}
+
+// NewSymbolizer creates a Symbolizer that keeps the liners of at most
+// cacheSize binaries.
+func NewSymbolizer(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	objFilePool *objectfile.Pool,
+	finder *debuginfo.Finder,
+	cacheSize int,
+) *Symbolizer {
+	return &Symbolizer{
+		logger:      logger,
+		metrics:     newMetrics(reg),
+		objFilePool: objFilePool,
+		finder:      finder,
+		liners: burrow.New(
+			burrow.WithMaximumSize(cacheSize),
+			burrow.WithExpireAfterAccess(linerTTL),
+			burrow.WithRemovalListener(func(_ burrow.Key, v burrow.Value) {
+				e := v.(*entry) //nolint:forcetypeassert
+				e.mtx.Lock()
+				defer e.mtx.Unlock()
+				if e.liner != nil {
+					e.liner.Close()
+					e.liner = nil
+				}
+			}),
+			burrow.WithStatsCounter(cache.NewBurrowStatsCounter(logger, reg, "local_symbolizer")),
+		),
+	}
+}
+
+// Close closes the binaries of the liners.
+func (s *Symbolizer) Close() error {
+	return s.liners.Close()
+}
+
+// Symbolize returns the source lines of the normalized address of a mapping,
+// the innermost inlined function first. The function names are left mangled.
+func (s *Symbolizer) Symbolize(m *process.Mapping, addr uint64) ([]profile.Line, error) {
+	lines, err := s.symbolize(m, addr)
+	if err != nil {
+		errType := lvErrLookupFail
+		switch {
+		case errors.Is(err, errNoBuildID):
+			errType = lvErrNoBuildID
+		case errors.Is(err, errNoLiner):
+			errType = lvErrNoLiner
+		case errors.Is(err, errNotFound):
+			errType = lvErrNotFound
+		}
+		s.metrics.lookups.WithLabelValues(errType).Inc()
+		if ok, suppressed := s.metrics.errorLogs.Allow(errType); ok {
+			level.Debug(s.logger).Log("msg", "failed to symbolize address", "path", m.Pathname, "buildid", m.BuildID, "address", fmt.Sprintf("%x", addr), "err", err, "suppressed", suppressed)
+		}
+		return nil, err
+	}
+	s.metrics.lookups.WithLabelValues(lvSuccess).Inc()
+	return lines, nil
+}
+
+func (s *Symbolizer) symbolize(m *process.Mapping, addr uint64) ([]profile.Line, error) {
+	if m.BuildID == "" {
+		return nil, errNoBuildID
+	}
+
+	e := s.entry(m)
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.err != nil {
+		return nil, e.err
+	}
+	if e.liner == nil {
+		// Evicted in the meantime, the next profile loads it again.
+		return nil, errNoLiner
+	}
+
+	locationLines, err := e.liner.PCToLines(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotFound, err)
+	}
+
+	// The function of the address comes first, followed by the functions
+	// inlined into it from the innermost one. They are returned innermost
+	// first, like pprof orders them.
+	if len(locationLines) > 1 {
+		locationLines = append(locationLines[1:], locationLines[0])
+	}
+
+	lines := make([]profile.Line, 0, len(locationLines))
+	for _, l := range locationLines {
+		if l.Function == nil {
+			continue
+		}
+		// The symbol tables only have the system names.
+		name := l.Function.Name
+		if name == "" {
+			name = l.Function.SystemName
+		}
+		if name == "" || name == "?" {
+			continue
+		}
+		filename := l.Function.Filename
+		if filename == "?" {
+			filename = ""
+		}
+		lines = append(lines, profile.Line{
+			Function: profile.Function{
+				Name:      name,
+				Filename:  filename,
+				StartLine: int(l.Function.StartLine),
+			},
+			Line: int(l.Line),
+		})
+	}
+	if len(lines) == 0 {
+		return nil, errNotFound
+	}
+	return lines, nil
+}
+
+// entry returns the liner of the binary of a mapping, which is loaded once
+// per build ID.
+func (s *Symbolizer) entry(m *process.Mapping) *entry {
+	if v, ok := s.liners.GetIfPresent(m.BuildID); ok {
+		return v.(*entry) //nolint:forcetypeassert
+	}
+
+	v, _, _ := s.loads.Do(m.BuildID, func() (any, error) {
+		e := &entry{}
+		e.liner, e.err = s.load(m)
+		s.liners.Put(m.BuildID, e)
+		return e, nil
+	})
+	return v.(*entry) //nolint:forcetypeassert
+}
+
+// load creates the liner of the binary of a mapping, from its separate
+// debuginfo file when there is one and from the binary itself otherwise.
+func (s *Symbolizer) load(m *process.Mapping) (liner, error) {
+	path := m.AbsolutePath()
+	paths := []string{path}
+	if s.finder != nil {
+		obj, err := s.objFilePool.OpenWithBuildID(path, m.BuildID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open object file: %w", err)
+		}
+		// The finder doesn't need to be traced or canceled, it only looks
+		// for files on the host.
+		if debuginfoPath, err := s.finder.Find(context.Background(), m.Root(), obj); err == nil {
+			paths = []string{debuginfoPath, path}
+		}
+	}
+
+	var errs error
+	for _, p := range paths {
+		l, err := newLiner(s.logger, p)
+		if err == nil {
+			return l, nil
+		}
+		errs = errors.Join(errs, err)
+	}
+	return nil, errs
+}
+
+// newLiner creates the liner of the best symbolization source of a file.
+func newLiner(logger log.Logger, path string) (liner, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ELF file %s: %w", path, err)
+	}
+
+	var l liner
+	switch {
+	case elfutils.HasDWARF(f):
+		l, err = addr2line.DWARF(logger, path, f, nil)
+	case elfutils.HasGoPclntab(f):
+		l, err = addr2line.Go(logger, path, f)
+	case elfutils.HasSymtab(f) || elfutils.HasDynsym(f):
+		l, err = addr2line.Symbols(logger, path, f, nil)
+	default:
+		err = fmt.Errorf("%w: %s", errNoLiner, path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/process"
+)
+
+func testMapping(t *testing.T, path, buildID string) *process.Mapping {
+	t.Helper()
+
+	path, err := filepath.Abs(path)
+	require.NoError(t, err)
+	return &process.Mapping{
+		ProcMap: &procfs.ProcMap{Pathname: path},
+		PID:     os.Getpid(),
+		BuildID: buildID,
+	}
+}
+
+func TestSymbolize(t *testing.T) {
+	s := NewSymbolizer(log.NewNopLogger(), prometheus.NewRegistry(), nil, nil, 8)
+	t.Cleanup(func() { s.Close() })
+
+	for _, tc := range []struct {
+		name string
+		path string
+		addr uint64
+		want string
+		// Whether the binary has the source lines.
+		lines bool
+	}{
+		{
+			name:  "dwarf",
+			path:  "../../../internal/pprof/binutils/testdata/exe_linux_64",
+			addr:  0x400531,
+			want:  "main",
+			lines: true,
+		},
+		{
+			name: "symtab",
+			path: "../../process/testdata/fib-nopie",
+			addr: 0x40112a,
+			want: "fibNaive",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines, err := s.Symbolize(testMapping(t, tc.path, tc.name), tc.addr)
+			require.NoError(t, err)
+			require.Len(t, lines, 1)
+			require.Equal(t, tc.want, lines[0].Name)
+			if tc.lines {
+				require.NotEmpty(t, lines[0].Filename)
+				require.NotZero(t, lines[0].Line)
+			}
+		})
+	}
+}
+
+func TestSymbolizeErrors(t *testing.T) {
+	s := NewSymbolizer(log.NewNopLogger(), prometheus.NewRegistry(), nil, nil, 8)
+	t.Cleanup(func() { s.Close() })
+
+	_, err := s.Symbolize(testMapping(t, "../../process/testdata/fib-nopie", ""), 0x40112a)
+	require.ErrorIs(t, err, errNoBuildID)
+
+	_, err = s.Symbolize(testMapping(t, "../../process/testdata/fib-nopie", "fib-nopie"), 0x10)
+	require.ErrorIs(t, err, errNotFound)
+
+	_, err = s.Symbolize(testMapping(t, "testdata/missing", "missing"), 0x10)
+	require.Error(t, err)
+}
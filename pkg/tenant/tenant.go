@@ -0,0 +1,78 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tenant sends the profiles and the debug information of targets to
+// the tenant of the store they belong to.
+package tenant
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Label is the label of targets setting their tenant, by relabeling or from
+// the Annotation of pods. It is removed from the labels of profiles, which
+// are sent as the tenant instead.
+const Label model.LabelName = "__tenant__"
+
+// Annotation of pods setting the tenant of their processes.
+const Annotation = "parca.dev/tenant"
+
+// DefaultHeader is the metadata the tenant is sent in by default, as
+// multi-tenant stores such as Pyroscope expect it.
+const DefaultHeader = "X-Scope-OrgID"
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose requests are sent as the tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// FromContext returns the tenant the requests of the context are sent as,
+// if any.
+func FromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// DialOptions returns the options of a connection sending the tenant of the
+// context of its requests in the given metadata header.
+func DialOptions(header string) []grpc.DialOption {
+	withHeader := func(ctx context.Context) context.Context {
+		if tenant, ok := FromContext(ctx); ok {
+			return metadata.AppendToOutgoingContext(ctx, header, tenant)
+		}
+		return ctx
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(withHeader(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(withHeader(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// CacheKey returns the key of what is cached per tenant, such as whether the
+// debug information of a build ID was uploaded.
+func CacheKey(ctx context.Context, key string) string {
+	if tenant, ok := FromContext(ctx); ok {
+		return tenant + "/" + key
+	}
+	return key
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tenant
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+type recordingHealthServer struct {
+	*health.Server
+	tenants []string
+}
+
+func (s *recordingHealthServer) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.tenants = append(s.tenants, md.Get("x-scope-orgid")...)
+	return s.Server.Check(ctx, in)
+}
+
+func TestDialOptions(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer()
+	hs := &recordingHealthServer{Server: health.NewServer()}
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis) //nolint:errcheck
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), append(DialOptions(DefaultHeader), grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client := healthpb.NewHealthClient(conn)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(WithTenant(context.Background(), "team-a"), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	// Only the requests with a tenant carry the header.
+	require.Equal(t, []string{"team-a"}, hs.tenants)
+}
+
+func TestCacheKey(t *testing.T) {
+	require.Equal(t, "abc", CacheKey(context.Background(), "abc"))
+	require.Equal(t, "team-a/abc", CacheKey(WithTenant(context.Background(), "team-a"), "abc"))
+	require.Equal(t, "abc", CacheKey(WithTenant(context.Background(), ""), "abc"))
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracecontext finds the thread local trace context published by
+// instrumented processes, so samples can be labelled with the trace and span
+// they were taken in.
+//
+// Processes publish it in a thread local variable of the executable named
+// otel_thread_ctx_v1, pointing to the following record while a span is
+// active on the thread, and to NULL otherwise:
+//
+//	struct otel_thread_ctx_v1 {
+//	  uint8_t trace_id[16];
+//	  uint8_t span_id[8];
+//	};
+package tracecontext
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/parca-dev/parca-agent/pkg/fileinfo"
+)
+
+// SymbolName is the name of the thread local variable holding the trace
+// context.
+const SymbolName = "otel_thread_ctx_v1"
+
+// Info describes where a process publishes its trace context. Must be in
+// sync with trace_context_info_t in the BPF program.
+type Info struct {
+	// Of the variable, relative to the thread pointer.
+	TLSOffset int64
+}
+
+// Labels returns the pprof labels of a sample taken in the given span.
+func Labels(traceID [16]byte, spanID [8]byte) map[string]string {
+	return map[string]string{
+		"trace_id": hex.EncodeToString(traceID[:]),
+		"span_id":  hex.EncodeToString(spanID[:]),
+	}
+}
+
+// Finder finds the trace context of processes. Results for the same binary
+// are cached, as many processes usually share it.
+type Finder struct {
+	mtx   *sync.Mutex
+	cache map[fileKey]*Info
+}
+
+type fileKey struct {
+	dev, ino uint64
+	mtime    int64
+}
+
+func NewFinder() *Finder {
+	return &Finder{
+		mtx:   &sync.Mutex{},
+		cache: map[fileKey]*Info{},
+	}
+}
+
+// Find returns where the given process publishes its trace context, or nil
+// if it doesn't.
+func (f *Finder) Find(pid int) (*Info, error) {
+	path := filepath.Join("/proc", strconv.Itoa(pid), "exe")
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var key fileKey
+	if id, ok := fileinfo.IDOf(stat); ok {
+		key = fileKey{dev: id.Dev, ino: id.Ino, mtime: stat.ModTime().UnixNano()}
+	}
+
+	f.mtx.Lock()
+	info, ok := f.cache[key]
+	f.mtx.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+	info = find(ef)
+
+	f.mtx.Lock()
+	f.cache[key] = info
+	f.mtx.Unlock()
+	return info, nil
+}
+
+// find looks for the variable in the static TLS block of the executable,
+// which ends at the thread pointer on amd64.
+func find(ef *elf.File) *Info {
+	if ef.Machine != elf.EM_X86_64 {
+		return nil
+	}
+
+	var tls *elf.Prog
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_TLS {
+			tls = p
+			break
+		}
+	}
+	if tls == nil {
+		return nil
+	}
+
+	for _, symbols := range []func() ([]elf.Symbol, error){ef.DynamicSymbols, ef.Symbols} {
+		syms, err := symbols()
+		if err != nil {
+			continue
+		}
+		for _, sym := range syms {
+			if sym.Name != SymbolName || elf.ST_TYPE(sym.Info) != elf.STT_TLS || sym.Section == elf.SHN_UNDEF {
+				continue
+			}
+			align := tls.Align
+			if align == 0 {
+				align = 1
+			}
+			size := (tls.Memsz + align - 1) &^ (align - 1)
+			return &Info{TLSOffset: int64(sym.Value) - int64(size)}
+		}
+	}
+	return nil
+}
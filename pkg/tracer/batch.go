@@ -0,0 +1,39 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ProfileBatchIDKey is the attribute of the spans of the profile pipeline
+// telling which batch of profiles, such as a profiling round of a profiler,
+// they are part of. The spans of the requests sending the profiles of several
+// batches at once have all of their IDs.
+const ProfileBatchIDKey = attribute.Key("profile.batch_id")
+
+type profileBatchIDKey struct{}
+
+// WithProfileBatchID returns a context carrying the given profile batch ID.
+func WithProfileBatchID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, profileBatchIDKey{}, id)
+}
+
+// ProfileBatchID returns the profile batch ID the context carries, if any.
+func ProfileBatchID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(profileBatchIDKey{}).(string)
+	return id, ok
+}
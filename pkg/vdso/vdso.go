@@ -16,13 +16,17 @@ package vdso
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"go.uber.org/multierr"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/parca-dev/parca/pkg/symbol/symbolsearcher"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/parca-dev/parca-agent/pkg/logger"
 	"github.com/parca-dev/parca-agent/pkg/metadata"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	"github.com/parca-dev/parca-agent/pkg/process"
@@ -38,11 +42,18 @@ const (
 	lvErrAddrOutOfRange  = "addr_out_of_range"
 	lvErrBaseCalculation = "base_calculation"
 	lvErrUnknown         = "unknown"
+
+	// Interval in which a lookup error of each type is logged at most once,
+	// as they can happen for every sample.
+	errorLogInterval = time.Minute
 )
 
 type metrics struct {
 	lookup       *prometheus.CounterVec
 	lookupErrors *prometheus.CounterVec
+
+	// Rate limits the logs of the lookup errors by type.
+	errorLogs *logger.Deduplicator
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -61,6 +72,7 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			},
 			[]string{"type"},
 		),
+		errorLogs: logger.NewDeduplicator(reg, "vdso", errorLogInterval),
 	}
 	m.lookup.WithLabelValues(lvSuccess)
 	m.lookupErrors.WithLabelValues(lvErrNotFound)
@@ -72,13 +84,14 @@ type NoopCache struct{}
 func (NoopCache) Resolve(uint64, *process.Mapping) (string, error) { return "", nil }
 
 type Cache struct {
+	logger  log.Logger
 	metrics *metrics
 
 	searcher symbolsearcher.Searcher
 	f        string
 }
 
-func NewCache(reg prometheus.Registerer, objFilePool *objectfile.Pool) (*Cache, error) {
+func NewCache(logger log.Logger, reg prometheus.Registerer, objFilePool *objectfile.Pool) (*Cache, error) {
 	kernelVersion, err := metadata.KernelRelease()
 	if err != nil {
 		return nil, err
@@ -126,7 +139,12 @@ func NewCache(reg prometheus.Registerer, objFilePool *objectfile.Pool) (*Cache,
 	if err != nil {
 		return nil, err
 	}
-	return &Cache{newMetrics(reg), symbolsearcher.New(syms), path}, nil
+	return &Cache{
+		logger:   logger,
+		metrics:  newMetrics(reg),
+		searcher: symbolsearcher.New(syms),
+		f:        path,
+	}, nil
 }
 
 func (c *Cache) Resolve(addr uint64, m *process.Mapping) (string, error) {
@@ -137,25 +155,31 @@ func (c *Cache) Resolve(addr uint64, m *process.Mapping) (string, error) {
 		c.metrics.lookupErrors.WithLabelValues(lvError).Inc()
 		return "", errors.New("mapping is nil")
 	}
-	addr, err := m.Normalize(addr)
+	normalized, err := m.Normalize(addr)
 	if err != nil {
 		c.metrics.lookupErrors.WithLabelValues(lvError).Inc()
 		var addrErr *process.AddressOutOfRangeError
+		errType := lvErrUnknown
 		switch {
 		case errors.As(err, &addrErr):
-			c.metrics.lookupErrors.WithLabelValues(lvErrAddrOutOfRange).Inc()
+			errType = lvErrAddrOutOfRange
 		case errors.Is(err, process.ErrBaseAddressCannotCalculated):
-			c.metrics.lookupErrors.WithLabelValues(lvErrBaseCalculation).Inc()
-		default:
-			c.metrics.lookupErrors.WithLabelValues(lvErrUnknown).Inc()
+			errType = lvErrBaseCalculation
+		}
+		c.metrics.lookupErrors.WithLabelValues(errType).Inc()
+		if ok, suppressed := c.metrics.errorLogs.Allow(errType); ok {
+			level.Debug(c.logger).Log("msg", "failed to normalize VDSO address", "address", fmt.Sprintf("%x", addr), "err", err, "suppressed", suppressed)
 		}
 		return "", err
 	}
 
-	sym, err := c.searcher.Search(addr)
+	sym, err := c.searcher.Search(normalized)
 	if err != nil {
 		c.metrics.lookupErrors.WithLabelValues(lvError).Inc()
 		c.metrics.lookupErrors.WithLabelValues(lvErrNotFound).Inc()
+		if ok, suppressed := c.metrics.errorLogs.Allow(lvErrNotFound); ok {
+			level.Debug(c.logger).Log("msg", "failed to symbolize VDSO address", "address", fmt.Sprintf("%x", addr), "err", err, "suppressed", suppressed)
+		}
 		return "", err
 	}
 	c.metrics.lookup.WithLabelValues(lvSuccess).Inc()
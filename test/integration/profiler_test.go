@@ -12,6 +12,8 @@
 // limitations under the License.
 //
 
+//go:build linux
+
 package integration
 
 import (
@@ -41,6 +43,7 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/namespace"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	"github.com/parca-dev/parca-agent/pkg/perf"
+	"github.com/parca-dev/parca-agent/pkg/pprof"
 	"github.com/parca-dev/parca-agent/pkg/process"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
 	"github.com/parca-dev/parca-agent/pkg/profiler/cpu"
@@ -156,7 +159,7 @@ func symbolizeProfile(t *testing.T, profile *profile.Profile, demangle bool) [][
 			address := frame.Address
 			file := frame.Mapping.File
 
-			if file == "jit" {
+			if file == "jit" || file == "[unknown]" {
 				continue
 			}
 
@@ -222,9 +225,10 @@ func prepareProfiler(t *testing.T, profileWriter profiler.ProfileWriter, logger
 	memlockRlimit := uint64(4000000)
 
 	ofp := objectfile.NewPool(logger, reg, 0)
+	rootFS := process.NewRootFS(logger, reg, procfs.DefaultMountPoint, loopDuration)
 
 	var vdsoCache symbol.VDSOResolver
-	vdsoCache, err = vdso.NewCache(reg, ofp)
+	vdsoCache, err = vdso.NewCache(logger, reg, ofp)
 	if err != nil {
 		t.Log("VDSO cache not available, using noop cache")
 		vdsoCache = vdso.NoopCache{}
@@ -242,6 +246,7 @@ func prepareProfiler(t *testing.T, profileWriter profiler.ProfileWriter, logger
 			metadata.PodHosts(),
 		},
 		[]*relabel.Config{},
+		nil,
 		false,
 		loopDuration,
 	)
@@ -249,6 +254,7 @@ func prepareProfiler(t *testing.T, profileWriter profiler.ProfileWriter, logger
 	profiler := cpu.NewCPUProfiler(
 		logger,
 		reg,
+		trace.NewNoopTracerProvider().Tracer("test"),
 		process.NewInfoManager(
 			logger,
 			trace.NewNoopTracerProvider().Tracer("test"),
@@ -257,21 +263,36 @@ func prepareProfiler(t *testing.T, profileWriter profiler.ProfileWriter, logger
 			dbginfo,
 			labelsManager,
 			loopDuration,
+			[]process.Runtime{process.RuntimePHP, process.RuntimeNodeJS},
+			nil,
 		),
 		address.NewNormalizer(logger, reg, normalizeAddresses),
 		vdsoCache,
+		nil,
 		ksym.NewKsym(logger, reg, tempDir),
-		perf.NewPerfMapCache(logger, reg, namespace.NewCache(logger, reg, loopDuration), loopDuration),
-		perf.NewJitdumpCache(logger, reg, loopDuration),
-		disableJit,
+		perf.NewPerfMapCache(logger, reg, namespace.NewCache(logger, reg, loopDuration), rootFS, loopDuration),
+		perf.NewJitdumpCache(logger, reg, rootFS, loopDuration),
+		nil,
 		profileWriter,
-		loopDuration,
-		frequency,
-		memlockRlimit,
-		[]string{},
-		false,
-		false,
-		true,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		cpu.Options{
+			ProfilingDuration:       loopDuration,
+			SamplingFrequency:       frequency,
+			MemlockRlimit:           memlockRlimit,
+			DisableJITSymbolization: disableJit,
+			UnknownFrames:           pprof.UnknownFramesAddress,
+			MaxStackDepth:           cpu.DefaultStackDepth,
+			TimeBuckets:             1,
+			ConversionWorkers:       4,
+			EventsBuffer:            cpu.EventsBufferAuto,
+			EventsBufferPages:       64,
+			VerboseBPFLogging:       true,
+		},
 		bpfProgramLoaded,
 	)
 
@@ -323,8 +344,8 @@ func TestCPUProfilerWorks(t *testing.T) {
 
 		// Test basic profile structure.
 		require.True(t, sample.profile.DurationNanos < profileDuration.Nanoseconds())
-		require.Equal(t, sample.profile.SampleType[0].Type, "samples")
-		require.Equal(t, sample.profile.SampleType[0].Unit, "count")
+		require.Equal(t, sample.profile.SampleType[0].Type, "cpu")
+		require.Equal(t, sample.profile.SampleType[0].Unit, "nanoseconds")
 
 		require.True(t, len(sample.profile.Sample) > 0)
 		require.True(t, len(sample.profile.Location) > 0)
@@ -350,8 +371,8 @@ func TestCPUProfilerWorks(t *testing.T) {
 
 		// Test basic profile structure.
 		require.True(t, sample.profile.DurationNanos < profileDuration.Nanoseconds())
-		require.Equal(t, sample.profile.SampleType[0].Type, "samples")
-		require.Equal(t, sample.profile.SampleType[0].Unit, "count")
+		require.Equal(t, sample.profile.SampleType[0].Type, "cpu")
+		require.Equal(t, sample.profile.SampleType[0].Unit, "nanoseconds")
 
 		require.True(t, len(sample.profile.Sample) > 0)
 		require.True(t, len(sample.profile.Location) > 0)